@@ -0,0 +1,127 @@
+// +build pcap
+
+// Wire test of the [client_tcp] behaviors: the station's responses to
+// unauthenticated probes are captured on loopback and checked against the
+// configuration. It needs libpcap and the privileges to capture on lo, see
+// the wire-test target of the Makefile.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/stretchr/testify/require"
+)
+
+// probeResponse is what the station sent on a probe's connection.
+type probeResponse struct {
+	synAck      *layers.TCP
+	windowScale int // -1 if the SYN-ACK carries no window scale option
+	closeFlag   string
+	closeDelay  time.Duration // from the probe's FIN to the station's close
+}
+
+// probeStation opens a listener configured with tcp, sends it a probe that
+// is not a registered client (a PROXY header for an unregistered phantom,
+// some bytes, then a FIN) and returns what was captured of the station's
+// side of the connection.
+func probeStation(t *testing.T, tcp cj.ClientTCPConfig) probeResponse {
+	testSubnetPath := os.Getenv("GOPATH") + "/src/github.com/refraction-networking/conjure/application/lib/test/phantom_subnets.toml"
+	os.Setenv("PHANTOM_SUBNET_LOCATION", testSubnetPath)
+	rm := cj.NewRegistrationManager()
+	logger = rm.Logger
+	conf := &cj.Config{ClientTCP: tcp}
+
+	resolver, err := cj.NewOriginalDstResolver("proxy_header")
+	require.Nil(t, err)
+	listeners, err := cj.ListenAll([]string{"127.0.0.1:0"}, resolver, conf.ClientTCP.Control)
+	require.Nil(t, err)
+	defer cj.CloseAll(listeners)
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	go func() {
+		conn, err := listeners[0].AcceptTCP()
+		if err == nil {
+			handleNewConn(rm, conn, conf, resolver)
+		}
+	}()
+
+	handle, err := pcap.OpenLive("lo", 262144, false, 50*time.Millisecond)
+	require.Nil(t, err, "capturing on lo requires libpcap and CAP_NET_RAW")
+	defer handle.Close()
+	require.Nil(t, handle.SetBPFFilter(fmt.Sprintf("tcp port %d", port)))
+	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+
+	probe, err := net.DialTCP("tcp", nil, listeners[0].Addr().(*net.TCPAddr))
+	require.Nil(t, err)
+	defer probe.Close()
+	_, err = fmt.Fprintf(probe, "PROXY TCP4 127.0.0.1 192.0.2.1 %d 443\r\n", probe.LocalAddr().(*net.TCPAddr).Port)
+	require.Nil(t, err)
+	_, err = probe.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.Nil(t, err)
+	require.Nil(t, probe.CloseWrite())
+
+	resp := probeResponse{windowScale: -1}
+	var probeFIN time.Time
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case p, ok := <-packets:
+			require.True(t, ok, "capture ended")
+			seg, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !ok {
+				continue
+			}
+			fromStation := int(seg.SrcPort) == port
+			switch {
+			case fromStation && seg.SYN && seg.ACK:
+				resp.synAck = seg
+				for _, opt := range seg.Options {
+					if opt.OptionType == layers.TCPOptionKindWindowScale && len(opt.OptionData) == 1 {
+						resp.windowScale = int(opt.OptionData[0])
+					}
+				}
+			case !fromStation && seg.FIN:
+				probeFIN = p.Metadata().Timestamp
+			case fromStation && (seg.FIN || seg.RST):
+				require.False(t, probeFIN.IsZero(), "station closed before the probe's FIN")
+				resp.closeFlag = "fin"
+				if seg.RST {
+					resp.closeFlag = "rst"
+				}
+				resp.closeDelay = p.Metadata().Timestamp.Sub(probeFIN)
+				require.NotNil(t, resp.synAck, "no SYN-ACK captured")
+				return resp
+			}
+		case <-timeout:
+			t.Fatalf("station did not close the probe's connection")
+		}
+	}
+}
+
+func TestClientTCPWire(t *testing.T) {
+	resp := probeStation(t, cj.ClientTCPConfig{FailureClose: cj.FailureCloseFIN})
+	require.Equal(t, "fin", resp.closeFlag)
+
+	tcp := cj.ClientTCPConfig{
+		FailureClose:  cj.FailureCloseRST,
+		ReceiveBuffer: 16384,
+		WindowClamp:   8192,
+		CloseDelayMin: 200,
+		CloseDelayMax: 300,
+	}
+	resp = probeStation(t, tcp)
+	require.Equal(t, "rst", resp.closeFlag)
+	require.True(t, resp.closeDelay >= 200*time.Millisecond, "closed %v after the probe's FIN", resp.closeDelay)
+	// The clamp bounds the window offered in the SYN-ACK and, being below
+	// 64KB, leaves no room for scaling it.
+	require.True(t, int(resp.synAck.Window) <= tcp.WindowClamp, "SYN-ACK window %d", resp.synAck.Window)
+	require.True(t, resp.windowScale <= 0, "SYN-ACK window scale %d", resp.windowScale)
+}
@@ -0,0 +1,45 @@
+// Package clock is the station's seam for wall-clock time. Code whose
+// behavior depends on time passing (registration TTLs, session idle
+// timeouts, the liveness cache, stats intervals) takes a Clock, Real outside
+// of tests, so that tests can drive it with testutil.FakeClock instead of
+// sleeping.
+package clock
+
+import "time"
+
+// Clock tells the time and waits for it to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer returns a Timer sending the time on its channel after d.
+	NewTimer(d time.Duration) Timer
+
+	// After returns a channel the time is sent on after d.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+
+	// Stop and Reset are as for time.Timer.
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the real clock, that of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
@@ -0,0 +1,141 @@
+// +build conformance_client
+
+// This file is not built with the station. client_vectors.sh copies it into
+// the gotapdance tapdance package and runs it there, so that the vectors come
+// from the client's own key derivation and phantom selection rather than from
+// a copy of them.
+
+package tapdance
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// The station's phantom subnet config, see SubnetsFromTomlFile.
+type conformanceSubnets struct {
+	Networks map[string]struct {
+		Generation      uint32
+		WeightedSubnets []struct {
+			Weight  uint32
+			Subnets []string
+		}
+	}
+}
+
+type conformanceKey struct {
+	Secret        string `json:"secret"`
+	FspKey        string `json:"fsp_key"`
+	FspIv         string `json:"fsp_iv"`
+	VspKey        string `json:"vsp_key"`
+	VspIv         string `json:"vsp_iv"`
+	MasterSecret  string `json:"master_secret"`
+	DarkDecoySeed string `json:"dark_decoy_seed"`
+}
+
+type conformancePhantom struct {
+	Seed       string `json:"seed"`
+	Generation uint32 `json:"generation"`
+	V6         bool   `json:"v6"`
+	Phantom    string `json:"phantom"`
+}
+
+// TestConformanceVectors writes CONFORMANCE_N (default 20) key vectors and
+// the phantoms the client selects for them in every generation of
+// CONFORMANCE_SUBNETS to CONFORMANCE_OUT.
+func TestConformanceVectors(t *testing.T) {
+	out, subnetsPath := os.Getenv("CONFORMANCE_OUT"), os.Getenv("CONFORMANCE_SUBNETS")
+	if out == "" || subnetsPath == "" {
+		t.Skip("CONFORMANCE_OUT and CONFORMANCE_SUBNETS not set")
+	}
+	n := 20
+	if s := os.Getenv("CONFORMANCE_N"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			t.Fatalf("bad CONFORMANCE_N: %v", err)
+		}
+	}
+
+	var subnets conformanceSubnets
+	if _, err := toml.DecodeFile(subnetsPath, &subnets); err != nil {
+		t.Fatalf("failed to load phantom subnets: %v", err)
+	}
+	var confs []*pb.ClientConf
+	for _, network := range subnets.Networks {
+		list := &pb.PhantomSubnetsList{}
+		for _, ws := range network.WeightedSubnets {
+			list.WeightedSubnets = append(list.WeightedSubnets, &pb.PhantomSubnets{
+				Weight:  proto.Uint32(ws.Weight),
+				Subnets: ws.Subnets,
+			})
+		}
+		confs = append(confs, &pb.ClientConf{
+			Generation:         proto.Uint32(network.Generation),
+			PhantomSubnetsList: list,
+		})
+	}
+	sort.Slice(confs, func(i, j int) bool { return confs[i].GetGeneration() < confs[j].GetGeneration() })
+
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	AssetsSetDir(dir)
+
+	var v struct {
+		Keys     []conformanceKey     `json:"keys"`
+		Phantoms []conformancePhantom `json:"phantoms"`
+	}
+	for i := 0; i < n; i++ {
+		var pubkey [32]byte
+		if _, err := rand.Read(pubkey[:]); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := generateSharedKeys(pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Keys = append(v.Keys, conformanceKey{
+			Secret:        hex.EncodeToString(keys.SharedSecret),
+			FspKey:        hex.EncodeToString(keys.FspKey),
+			FspIv:         hex.EncodeToString(keys.FspIv),
+			VspKey:        hex.EncodeToString(keys.VspKey),
+			VspIv:         hex.EncodeToString(keys.VspIv),
+			MasterSecret:  hex.EncodeToString(keys.NewMasterSecret),
+			DarkDecoySeed: hex.EncodeToString(keys.ConjureSeed),
+		})
+
+		for _, conf := range confs {
+			if err := Assets().SetClientConf(conf); err != nil {
+				t.Fatal(err)
+			}
+			phantom4, phantom6, err := SelectPhantom(keys.ConjureSeed, both)
+			if err != nil {
+				t.Fatalf("generation %d: %v", conf.GetGeneration(), err)
+			}
+			seed := hex.EncodeToString(keys.ConjureSeed)
+			v.Phantoms = append(v.Phantoms,
+				conformancePhantom{seed, conf.GetGeneration(), false, phantom4.String()},
+				conformancePhantom{seed, conf.GetGeneration(), true, phantom6.String()})
+		}
+	}
+
+	raw, err := json.MarshalIndent(&v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(out, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
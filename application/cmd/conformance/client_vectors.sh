@@ -0,0 +1,25 @@
+#!/bin/bash
+# Generates conformance vectors with the gotapdance client's own key
+# derivation and phantom selection, for TestClientVectors or conformance
+# -check. The client is taken from GOPATH, as the station is built.
+#
+#   ./client_vectors.sh phantom_subnets.toml client.json [count]
+
+set -e
+
+subnets=$(realpath "$1")
+out=$(realpath "$2")
+count=${3:-20}
+td="$(go env GOPATH)/src/github.com/refraction-networking/gotapdance/tapdance"
+here=$(dirname "$(realpath "$0")")
+
+if [ ! -d "$td" ]; then
+    echo "gotapdance not found in $td" >&2
+    exit 2
+fi
+
+cp "$here/client/conformance_vectors_test.go" "$td/"
+trap 'rm -f "$td/conformance_vectors_test.go"' EXIT
+cd "$td"
+CONFORMANCE_SUBNETS="$subnets" CONFORMANCE_OUT="$out" CONFORMANCE_N="$count" \
+    go test -tags conformance_client -run '^TestConformanceVectors$' -count 1 .
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+)
+
+// Vectors is the interchange format between the client and station sides of
+// the conformance check. Either side can generate a file that the other then
+// checks, so the two implementations never have to be built together.
+type Vectors struct {
+	Keys     []KeyVector     `json:"keys"`
+	Phantoms []PhantomVector `json:"phantoms"`
+	Exports  []ExportVector  `json:"exports,omitempty"`
+}
+
+// KeyVector holds everything derived from one registration shared secret.
+// All values are hex encoded. Values left empty were not derived by the side
+// that generated the vectors (the client has no obfs4 keys or connection tag)
+// and are not checked.
+type KeyVector struct {
+	Secret        string `json:"secret"`
+	FspKey        string `json:"fsp_key"`
+	FspIv         string `json:"fsp_iv"`
+	VspKey        string `json:"vsp_key"`
+	VspIv         string `json:"vsp_iv"`
+	MasterSecret  string `json:"master_secret"`
+	DarkDecoySeed string `json:"dark_decoy_seed"`
+	Obfs4Public   string `json:"obfs4_public"`
+	Obfs4NodeID   string `json:"obfs4_node_id"`
+	ConnTag       string `json:"conn_tag"`
+}
+
+// PhantomVector is the phantom chosen for a seed in a subnet generation.
+type PhantomVector struct {
+	Seed       string `json:"seed"`
+	Generation uint   `json:"generation"`
+	V6         bool   `json:"v6"`
+	Phantom    string `json:"phantom"`
+}
+
+// ExportVector is keying material exported from a shared secret, see
+// ConjureSharedKeys.ExportKeyingMaterial. Secret, Context and EKM are hex.
+type ExportVector struct {
+	Secret  string `json:"secret"`
+	Label   string `json:"label"`
+	Context string `json:"context"`
+	Length  int    `json:"length"`
+	EKM     string `json:"ekm"`
+}
+
+func exportKeys(secret []byte, label string, context []byte, length int) (string, error) {
+	keys, err := cj.GenSharedKeys(secret)
+	if err != nil {
+		return "", err
+	}
+	defer keys.Zero()
+
+	ekm, err := keys.ExportKeyingMaterial(label, context, length)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ekm), nil
+}
+
+func deriveKeys(secret []byte) (KeyVector, error) {
+	keys, err := cj.GenSharedKeys(secret)
+	if err != nil {
+		return KeyVector{}, err
+	}
+	defer keys.Zero()
+
+	return KeyVector{
+		Secret:        hex.EncodeToString(secret),
+		FspKey:        hex.EncodeToString(keys.FspKey[:]),
+		FspIv:         hex.EncodeToString(keys.FspIv[:]),
+		VspKey:        hex.EncodeToString(keys.VspKey[:]),
+		VspIv:         hex.EncodeToString(keys.VspIv[:]),
+		MasterSecret:  hex.EncodeToString(keys.MasterSecret[:]),
+		DarkDecoySeed: hex.EncodeToString(keys.DarkDecoySeed[:]),
+		Obfs4Public:   keys.Obfs4Keys.PublicKey.Hex(),
+		Obfs4NodeID:   keys.Obfs4Keys.NodeID.Hex(),
+		ConnTag:       hex.EncodeToString(keys.ConnTag[:]),
+	}, nil
+}
+
+func selectPhantom(selector *cj.PhantomIPSelector, seed []byte, generation uint, v6 bool) (string, error) {
+	addr, err := selector.Select(seed, generation, v6)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// generateVectors derives vectors for n shared secrets read from rand, with
+// an exported key and a v4 and a v6 phantom from every generation in
+// selector for each of them.
+func generateVectors(n int, rand io.Reader, selector *cj.PhantomIPSelector) (*Vectors, error) {
+	var generations []uint
+	for gen := range selector.Networks {
+		generations = append(generations, gen)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+
+	v := &Vectors{}
+	for i := 0; i < n; i++ {
+		secret := make([]byte, 32)
+		if _, err := io.ReadFull(rand, secret); err != nil {
+			return nil, err
+		}
+		kv, err := deriveKeys(secret)
+		if err != nil {
+			return nil, err
+		}
+		v.Keys = append(v.Keys, kv)
+
+		context := make([]byte, 16)
+		if _, err := io.ReadFull(rand, context); err != nil {
+			return nil, err
+		}
+		ekm, err := exportKeys(secret, "conformance", context, 32)
+		if err != nil {
+			return nil, err
+		}
+		v.Exports = append(v.Exports, ExportVector{kv.Secret, "conformance", hex.EncodeToString(context), 32, ekm})
+
+		seed, _ := hex.DecodeString(kv.DarkDecoySeed)
+		for _, gen := range generations {
+			for _, v6 := range []bool{false, true} {
+				phantom, err := selectPhantom(selector, seed, gen, v6)
+				if err != nil {
+					return nil, fmt.Errorf("generation %d: %v", gen, err)
+				}
+				v.Phantoms = append(v.Phantoms, PhantomVector{kv.DarkDecoySeed, gen, v6, phantom})
+			}
+		}
+	}
+	return v, nil
+}
+
+// checkVectors recomputes every vector on the station side and returns one
+// line per value that differs. An empty result means the two sides agree.
+func checkVectors(v *Vectors, selector *cj.PhantomIPSelector) []string {
+	var diffs []string
+	mismatch := func(what, field, want, got string) {
+		diffs = append(diffs, fmt.Sprintf("%s %s:\n\t- %s\n\t+ %s", what, field, want, got))
+	}
+
+	for _, want := range v.Keys {
+		what := "secret " + want.Secret
+		secret, err := hex.DecodeString(want.Secret)
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: bad secret: %v", what, err))
+			continue
+		}
+		got, err := deriveKeys(secret)
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: %v", what, err))
+			continue
+		}
+
+		for _, f := range []struct{ name, want, got string }{
+			{"fsp_key", want.FspKey, got.FspKey},
+			{"fsp_iv", want.FspIv, got.FspIv},
+			{"vsp_key", want.VspKey, got.VspKey},
+			{"vsp_iv", want.VspIv, got.VspIv},
+			{"master_secret", want.MasterSecret, got.MasterSecret},
+			{"dark_decoy_seed", want.DarkDecoySeed, got.DarkDecoySeed},
+			{"obfs4_public", want.Obfs4Public, got.Obfs4Public},
+			{"obfs4_node_id", want.Obfs4NodeID, got.Obfs4NodeID},
+			{"conn_tag", want.ConnTag, got.ConnTag},
+		} {
+			if f.want != "" && f.want != f.got {
+				mismatch(what, f.name, f.want, f.got)
+			}
+		}
+	}
+
+	for _, want := range v.Exports {
+		what := fmt.Sprintf("secret %s label %q context %s", want.Secret, want.Label, want.Context)
+		secret, err := hex.DecodeString(want.Secret)
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: bad secret: %v", what, err))
+			continue
+		}
+		context, err := hex.DecodeString(want.Context)
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: bad context: %v", what, err))
+			continue
+		}
+		got, err := exportKeys(secret, want.Label, context, want.Length)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != want.EKM {
+			mismatch(what, "ekm", want.EKM, got)
+		}
+	}
+
+	for _, want := range v.Phantoms {
+		what := fmt.Sprintf("seed %s generation %d v6 %v", want.Seed, want.Generation, want.V6)
+		seed, err := hex.DecodeString(want.Seed)
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: bad seed: %v", what, err))
+			continue
+		}
+		got, err := selectPhantom(selector, seed, want.Generation, want.V6)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != want.Phantom {
+			mismatch(what, "phantom", want.Phantom, got)
+		}
+	}
+	return diffs
+}
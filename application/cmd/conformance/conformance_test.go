@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/stretchr/testify/require"
+)
+
+const testSubnets = "../../lib/test/phantom_subnets.toml"
+
+func checkVectorsFile(t *testing.T, path string) {
+	selector, err := cj.SubnetsFromTomlFile(testSubnets)
+	require.Nil(t, err)
+
+	raw, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var v Vectors
+	require.Nil(t, json.Unmarshal(raw, &v))
+	require.NotEmpty(t, v.Keys)
+	require.NotEmpty(t, v.Phantoms)
+
+	diffs := checkVectors(&v, selector)
+	require.Empty(t, diffs, strings.Join(diffs, "\n"))
+}
+
+// CONFORMANCE_CLIENT_VECTORS names vectors generated by the gotapdance
+// client itself with client_vectors.sh, as CI does. Without it there is
+// nothing from the client to check against.
+func TestClientVectors(t *testing.T) {
+	path := os.Getenv("CONFORMANCE_CLIENT_VECTORS")
+	if path == "" {
+		t.Skip("CONFORMANCE_CLIENT_VECTORS not set, generate client vectors with client_vectors.sh")
+	}
+	checkVectorsFile(t, path)
+}
+
+// station_vectors.json holds values the station derived (the same vectors as
+// the lib key and phantom tests). It only catches changes to the station's
+// own derivation, agreement with the client is TestClientVectors.
+func TestStationVectors(t *testing.T) {
+	checkVectorsFile(t, "test/station_vectors.json")
+}
+
+func TestGeneratedVectorsRoundTrip(t *testing.T) {
+	selector, err := cj.SubnetsFromTomlFile(testSubnets)
+	require.Nil(t, err)
+
+	v, err := generateVectors(3, bytes.NewReader(bytes.Repeat([]byte{0x42}, 3*(32+16))), selector)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(v.Keys))
+	require.Equal(t, 3*2*len(selector.Networks), len(v.Phantoms))
+	require.Equal(t, 3, len(v.Exports))
+	require.Empty(t, checkVectors(v, selector))
+
+	v.Keys[1].ConnTag = strings.Repeat("00", 32)
+	v.Exports[2].Label = "other"
+	v.Phantoms[0].Phantom = "192.0.2.1"
+	diffs := checkVectors(v, selector)
+	require.Equal(t, 3, len(diffs))
+	require.Contains(t, diffs[0], "conn_tag")
+	require.Contains(t, diffs[1], "ekm")
+	require.Contains(t, diffs[2], "phantom")
+}
@@ -0,0 +1,78 @@
+// Command conformance cross-checks the station's key derivation and phantom
+// selection against the client's.
+//
+// Generate vectors from the station side for the client to check:
+//
+//	conformance -subnets phantom_subnets.toml -gen 100 > station.json
+//
+// Check vectors generated by the client against the station side:
+//
+//	./client_vectors.sh phantom_subnets.toml client.json
+//	conformance -subnets phantom_subnets.toml -check client.json
+//
+// client_vectors.sh runs client/conformance_vectors_test.go inside the
+// gotapdance tapdance package, so that the vectors come from the client's own
+// code.
+// Any mismatch is printed as a diff and the command exits non-zero.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+)
+
+func main() {
+	var subnetsPath, checkPath string
+	var n int
+	flag.StringVar(&subnetsPath, "subnets", os.Getenv("PHANTOM_SUBNET_LOCATION"), "Phantom subnet config (toml)")
+	flag.StringVar(&checkPath, "check", "", "Vectors file to check against the station side")
+	flag.IntVar(&n, "gen", 0, "Number of random secrets to generate station vectors for")
+	flag.Parse()
+
+	selector, err := cj.SubnetsFromTomlFile(subnetsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load phantom subnets: %v\n", err)
+		os.Exit(2)
+	}
+
+	switch {
+	case checkPath != "":
+		raw, err := ioutil.ReadFile(checkPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read vectors: %v\n", err)
+			os.Exit(2)
+		}
+		var v Vectors
+		if err := json.Unmarshal(raw, &v); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse vectors: %v\n", err)
+			os.Exit(2)
+		}
+		diffs := checkVectors(&v, selector)
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+		if len(diffs) > 0 {
+			fmt.Fprintf(os.Stderr, "%d mismatches in %d key and %d phantom vectors\n", len(diffs), len(v.Keys), len(v.Phantoms))
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%d key and %d phantom vectors match\n", len(v.Keys), len(v.Phantoms))
+	case n > 0:
+		v, err := generateVectors(n, rand.Reader, selector)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to generate vectors: %v\n", err)
+			os.Exit(2)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
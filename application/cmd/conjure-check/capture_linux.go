@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// openCapture opens a packet socket on iface, as capturing on it does. It
+// needs CAP_NET_RAW, like the detector's PF_RING capture.
+func openCapture(iface *net.Interface) error {
+	proto := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(proto))
+	if err != nil {
+		return fmt.Errorf("failed to open a packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		return fmt.Errorf("failed to bind a packet socket to %s: %v", iface.Name, err)
+	}
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func openCapture(iface *net.Interface) error {
+	return fmt.Errorf("packet capture is only checked on linux")
+}
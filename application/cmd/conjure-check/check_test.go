@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+)
+
+// checkConfig writes a station config for a loopback test station and loads
+// it the way the command does.
+func checkConfig(t *testing.T, extra string) *cj.Config {
+	dir := t.TempDir()
+	kp, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+	keyPath := filepath.Join(dir, "station.key")
+	require.Nil(t, ioutil.WriteFile(keyPath, append(kp.Private()[:], kp.Public()[:]...), 0600))
+
+	confPath := filepath.Join(dir, "station.toml")
+	require.Nil(t, ioutil.WriteFile(confPath, []byte(fmt.Sprintf(`
+listen_addrs = ["127.0.0.1:0"]
+original_dst_mode = "proxy_header"
+enable_v4 = true
+management_listen_addr = "127.0.0.1:0"
+socket_name = "conjure-check-test-%d"
+privkey_path = %q
+station_privkey_paths = [%q]
+%s
+`, time.Now().UnixNano(), keyPath, keyPath, extra)), 0600))
+
+	defer os.Unsetenv("CJ_STATION_CONFIG")
+	os.Setenv("CJ_STATION_CONFIG", confPath)
+	conf, err := cj.ParseConfig()
+	require.Nil(t, err)
+	return conf
+}
+
+func resultsByCheck(results []result) map[string]result {
+	m := make(map[string]result)
+	for _, r := range results {
+		m[r.Check] = r
+	}
+	return m
+}
+
+func TestChecks(t *testing.T) {
+	defer os.Unsetenv("PHANTOM_SUBNET_LOCATION")
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "../../lib/test/phantom_subnets.toml")
+
+	c := &checker{conf: checkConfig(t, ""), timeout: time.Second}
+	c.run()
+	results := resultsByCheck(c.results)
+	for _, check := range []string{"station_keys", "phantom_subnets", "self_registration", "listeners", "zmq_proxy", "management"} {
+		require.Equal(t, statusPass, results[check].Status, "%s: %s", check, results[check].Detail)
+	}
+	require.Equal(t, statusSkip, results["phantom_redirect"].Status)
+	require.Equal(t, statusSkip, results["instance_lock"].Status)
+	require.Equal(t, statusSkip, results["packet_capture"].Status)
+	require.Len(t, c.phantoms, 1)
+	require.NotNil(t, c.phantoms[0].IP.To4())
+	require.NotZero(t, c.phantoms[0].Port)
+
+	// The listeners are closed again.
+	require.Nil(t, bindTest(c.listeners[0].Addr().String()))
+}
+
+func TestChecksFail(t *testing.T) {
+	defer os.Unsetenv("PHANTOM_SUBNET_LOCATION")
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "/nonexistent/phantom_subnets.toml")
+
+	c := &checker{conf: checkConfig(t, `registration_api_addr = "127.0.0.1:0"
+registration_api_cert = "/nonexistent/cert.pem"
+registration_api_key = "/nonexistent/key.pem"`), timeout: time.Second}
+	c.run()
+	results := resultsByCheck(c.results)
+	require.Equal(t, statusFail, results["phantom_subnets"].Status)
+	require.Equal(t, statusSkip, results["self_registration"].Status)
+	require.Equal(t, statusFail, results["registration_api"].Status)
+	require.True(t, c.failed())
+}
+
+func TestCheckPacketCapture(t *testing.T) {
+	defer os.Unsetenv("CJ_IFACE")
+	os.Setenv("CJ_IFACE", "zc:conjure-none0")
+	c := &checker{}
+	c.checkPacketCapture()
+	require.Equal(t, statusFail, c.results[0].Status)
+	require.Contains(t, c.results[0].Detail, "conjure-none0")
+}
+
+func TestOutput(t *testing.T) {
+	results := []result{
+		{Check: "config", Status: statusPass, Detail: "station.toml"},
+		{Check: "fd_limit", Status: statusFail, Detail: "open file limit 1024"},
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, writeTable(&buf, results))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, []string{"CHECK", "RESULT", "DETAIL"}, strings.Fields(lines[0]))
+	require.Equal(t, []string{"fd_limit", "FAIL", "open", "file", "limit", "1024"}, strings.Fields(lines[2]))
+
+	buf.Reset()
+	require.Nil(t, writeJSON(&buf, results))
+	var decoded []map[string]string
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, []map[string]string{
+		{"check": "config", "status": "pass", "detail": "station.toml"},
+		{"check": "fd_limit", "status": "fail", "detail": "open file limit 1024"},
+	}, decoded)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// Check outcomes. Only failures make the command exit non-zero: a warning is
+// something the station runs without, but degraded.
+const (
+	statusPass = "pass"
+	statusFail = "fail"
+	statusWarn = "warn"
+	statusSkip = "skip"
+)
+
+// minFDLimit is the open file limit below which the station is likely to run
+// out of descriptors under load, every proxied session holds two.
+const minFDLimit = 65536
+
+// checkCovert is the covert of the registrations the checker sends itself. It
+// is never dialed.
+const checkCovert = "192.0.2.1:443"
+
+type result struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// checker runs the checks in order, later ones use what earlier ones loaded.
+type checker struct {
+	conf                  *cj.Config
+	timeout               time.Duration
+	allowPublicManagement bool
+	results               []result
+
+	selector  *cj.PhantomIPSelector
+	keys      []*cj.StationKey
+	phantoms  []*net.TCPAddr // phantoms and ports of the registrations sent to ourselves
+	resolver  cj.OriginalDstResolver
+	listeners []*net.TCPListener
+}
+
+func (c *checker) add(check, status, format string, args ...interface{}) {
+	c.results = append(c.results, result{Check: check, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) addErr(check string, err error, format string, args ...interface{}) {
+	if err != nil {
+		c.add(check, statusFail, "%v", err)
+		return
+	}
+	c.add(check, statusPass, format, args...)
+}
+
+func (c *checker) failed() bool {
+	for _, r := range c.results {
+		if r.Status == statusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs every check after loading the configuration.
+func (c *checker) run() {
+	defer func() { cj.CloseAll(c.listeners) }()
+
+	c.checkInstanceLock()
+	c.checkStationKeys()
+	c.checkPhantomSubnets()
+	c.checkSelfRegistration()
+	c.checkListeners()
+	c.checkPhantomRedirect()
+	c.checkZMQ()
+	c.checkRegistrationAPI()
+	c.checkManagement()
+	c.checkFDLimit()
+	c.checkICMP()
+	c.checkPacketCapture()
+}
+
+// The lock is what stops a second station from starting, the listen and bind
+// checks below would fail for the same reason.
+func (c *checker) checkInstanceLock() {
+	if c.conf.LockFile == "" {
+		c.add("instance_lock", statusSkip, "no lock_file configured")
+		return
+	}
+	lock, err := cj.AcquireInstanceLock(c.conf.LockFile)
+	if err != nil {
+		c.add("instance_lock", statusFail, "%v", err)
+		return
+	}
+	lock.Release()
+	c.add("instance_lock", statusPass, "%s is free", c.conf.LockFile)
+}
+
+func (c *checker) checkStationKeys() {
+	keys, err := cj.LoadStationKeys(c.conf.StationPrivkeyPaths)
+	switch {
+	case err != nil:
+		c.add("station_keys", statusFail, "%v", err)
+	case len(keys) == 0:
+		c.add("station_keys", statusWarn, "no station_privkey_paths configured, only registrations carrying their shared secret can be read")
+	default:
+		c.keys = keys
+		c.add("station_keys", statusPass, "%d key(s) loaded", len(keys))
+	}
+}
+
+func (c *checker) checkPhantomSubnets() {
+	selector, err := cj.NewPhantomIPSelector()
+	if err == nil && len(selector.Networks) == 0 {
+		err = fmt.Errorf("no phantom subnet generations in PHANTOM_SUBNET_LOCATION")
+	}
+	if err != nil {
+		c.add("phantom_subnets", statusFail, "%v", err)
+		return
+	}
+	c.selector = selector
+	c.add("phantom_subnets", statusPass, "generations %v", generations(selector))
+}
+
+// checkSelfRegistration makes a registration for each station key the way a
+// client does and reads it back with the station's registration code, for
+// the latest phantom generation and each enabled IP family.
+func (c *checker) checkSelfRegistration() {
+	if len(c.keys) == 0 || c.selector == nil {
+		c.add("self_registration", statusSkip, "needs station keys and phantom subnets")
+		return
+	}
+	gens := generations(c.selector)
+	generation := gens[len(gens)-1]
+
+	var families []bool // v6
+	if c.conf.EnableIPv4 {
+		families = append(families, false)
+	}
+	if c.conf.EnableIPv6 {
+		families = append(families, true)
+	}
+	if len(families) == 0 {
+		c.add("self_registration", statusFail, "neither enable_v4 nor enable_v6 is set, every registration is dropped")
+		return
+	}
+
+	regManager := &cj.RegistrationManager{PhantomSelector: c.selector, StationKeys: c.keys}
+	var blocked []string
+	for i, key := range c.keys {
+		for _, v6 := range families {
+			phantom, err := selfRegister(regManager, key, i, generation, v6)
+			if err != nil {
+				c.add("self_registration", statusFail, "station key %d: %v", i, err)
+				return
+			}
+			if c.conf.IsBlocklistedPhantom(phantom.IP) {
+				blocked = append(blocked, phantom.IP.String())
+			}
+			if i == 0 {
+				c.phantoms = append(c.phantoms, phantom)
+			}
+		}
+	}
+	if len(blocked) > 0 {
+		c.add("self_registration", statusWarn, "phantoms %s are in phantom_blocklist", strings.Join(blocked, ", "))
+		return
+	}
+	c.add("self_registration", statusPass, "%d key(s), generation %d, phantoms %v", len(c.keys), generation, c.phantoms)
+}
+
+// selfRegister sends the station a registration for key and returns the
+// phantom the station derived, which must be the client's, with the port
+// clients connect to it on.
+func selfRegister(regManager *cj.RegistrationManager, key *cj.StationKey, index int, generation uint, v6 bool) (*net.TCPAddr, error) {
+	reg, err := cj.NewClientRegistration(key.PublicKey[:], regManager.PhantomSelector, generation, checkCovert, v6)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(reg.Wrapper, parsed); err != nil {
+		return nil, err
+	}
+	candidates, err := regManager.SharedSecretCandidates(parsed, reg.Wrapper)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		if candidate.KeyIndex != index {
+			continue
+		}
+		parsed.SharedSecret = candidate.Secret
+		stationReg, err := regManager.NewRegistrationC2SWrapper(parsed, v6)
+		if err != nil {
+			return nil, err
+		}
+		if !stationReg.DarkDecoy.Equal(reg.Phantom) {
+			return nil, fmt.Errorf("station derived phantom %v, client %v", stationReg.DarkDecoy, reg.Phantom)
+		}
+		return &net.TCPAddr{IP: stationReg.DarkDecoy, Port: int(stationReg.DstPort())}, nil
+	}
+	return nil, fmt.Errorf("no shared secret derived with this key")
+}
+
+func (c *checker) checkListeners() {
+	resolver, err := cj.NewOriginalDstResolver(c.conf.OriginalDstMode)
+	if err != nil {
+		c.add("listeners", statusFail, "%v", err)
+		return
+	}
+	listeners, err := cj.ListenAll(c.conf.ListenAddrs, resolver, c.conf.ClientTCP.Control)
+	if err != nil {
+		c.add("listeners", statusFail, "%v", err)
+		return
+	}
+	c.resolver, c.listeners = resolver, listeners
+
+	var addrs []string
+	for _, ln := range listeners {
+		if err := resolver.SelfCheck(ln); err != nil {
+			c.add("listeners", statusFail, "%v: %v", ln.Addr(), err)
+			return
+		}
+		addrs = append(addrs, ln.Addr().String())
+	}
+	c.add("listeners", statusPass, "bound %s", strings.Join(addrs, ", "))
+}
+
+// checkPhantomRedirect connects to the self registration phantoms, on the
+// ports their registrations derived, from the station host and checks that
+// the connection reaches a listener with the phantom as its original
+// destination: the redirect rules and phantom routes are in place. Rules matching only forwarded traffic (e.g. in
+// PREROUTING on the tap interface) do not catch local connections, they
+// need a matching OUTPUT rule for this check.
+func (c *checker) checkPhantomRedirect() {
+	switch {
+	case c.conf.OriginalDstMode == "proxy_header":
+		c.add("phantom_redirect", statusSkip, "original_dst_mode \"proxy_header\" uses no redirect")
+		return
+	case len(c.listeners) == 0 || len(c.phantoms) == 0:
+		c.add("phantom_redirect", statusSkip, "needs listeners and a self registration")
+		return
+	}
+
+	for _, phantom := range c.phantoms {
+		if err := redirectLoopback(c.listeners, c.resolver, phantom, c.timeout); err != nil {
+			c.add("phantom_redirect", statusFail, "%v", err)
+			return
+		}
+	}
+	c.add("phantom_redirect", statusPass, "connections to %v reached the listeners", c.phantoms)
+}
+
+func redirectLoopback(listeners []*net.TCPListener, resolver cj.OriginalDstResolver, target *net.TCPAddr, timeout time.Duration) error {
+	accepted := make(chan *net.TCPConn, len(listeners))
+	for _, ln := range listeners {
+		ln.SetDeadline(time.Now().Add(timeout))
+		go func(ln *net.TCPListener) {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				conn = nil
+			}
+			accepted <- conn
+		}(ln)
+	}
+	// Stop the other accepts and wait for them, so that the listeners are
+	// left as they were.
+	pending := len(listeners)
+	defer func() {
+		for _, ln := range listeners {
+			ln.SetDeadline(time.Now())
+		}
+		for ; pending > 0; pending-- {
+			if conn := <-accepted; conn != nil {
+				conn.Close()
+			}
+		}
+		for _, ln := range listeners {
+			ln.SetDeadline(time.Time{})
+		}
+	}()
+
+	client, err := net.DialTimeout("tcp", target.String(), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to phantom %v: %v", target, err)
+	}
+	defer client.Close()
+
+	var conn *net.TCPConn
+	for conn == nil && pending > 0 {
+		conn = <-accepted
+		pending--
+	}
+	if conn == nil {
+		return fmt.Errorf("connection to phantom %v did not reach a listener", target)
+	}
+	defer conn.Close()
+	originalDst, err := resolver.OriginalDst(conn)
+	if err != nil {
+		return fmt.Errorf("connection to phantom %v: %v", target, err)
+	}
+	if !originalDst.IP.Equal(target.IP) || originalDst.Port != target.Port {
+		return fmt.Errorf("connection to phantom %v arrived with original destination %v", target, originalDst)
+	}
+	return nil
+}
+
+// checkZMQ checks the local proxy socket and key, and that every TCP
+// registrar the proxy connects to accepts connections. ZMQ reconnects
+// silently, so without this an unreachable registrar only shows up as missing
+// registrations.
+func (c *checker) checkZMQ() {
+	c.addErr("zmq_proxy", cj.CheckZMQProxy(c.conf.ZMQConfig), "ipc://@%s bound, key loaded", c.conf.SocketName)
+
+	for _, sock := range c.conf.ConnectSockets {
+		check := "zmq_connect " + sock.Address
+		if !strings.HasPrefix(sock.Address, "tcp://") {
+			c.add(check, statusSkip, "only tcp:// addresses are checked")
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(sock.Address, "tcp://"), c.timeout)
+		if err != nil {
+			c.add(check, statusFail, "%v", err)
+			continue
+		}
+		conn.Close()
+		c.add(check, statusPass, "reachable")
+	}
+}
+
+func (c *checker) checkRegistrationAPI() {
+	if c.conf.RegistrationAPIAddr == "" {
+		c.add("registration_api", statusSkip, "no registration_api_addr configured")
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(c.conf.RegistrationAPICert, c.conf.RegistrationAPIKey); err != nil {
+		c.add("registration_api", statusFail, "failed to load certificate: %v", err)
+		return
+	}
+	c.addErr("registration_api", bindTest(c.conf.RegistrationAPIAddr), "%s bound, certificate loaded", c.conf.RegistrationAPIAddr)
+}
+
+func (c *checker) checkManagement() {
+	ln, err := cj.ListenManagement(c.conf.ManagementListenAddr, c.allowPublicManagement)
+	if err != nil {
+		c.add("management", statusFail, "%v", err)
+		return
+	}
+	ln.Close()
+	c.add("management", statusPass, "%s bound", c.conf.ManagementListenAddr)
+}
+
+func bindTest(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+func (c *checker) checkFDLimit() {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		c.add("fd_limit", statusFail, "%v", err)
+		return
+	}
+	if limit.Cur < minFDLimit {
+		c.add("fd_limit", statusFail, "open file limit %d (hard %d), need at least %d", limit.Cur, limit.Max, minFDLimit)
+		return
+	}
+	c.add("fd_limit", statusPass, "open file limit %d", limit.Cur)
+}
+
+func (c *checker) checkICMP() {
+	if err := cj.CheckICMPProbes(); err != nil {
+		c.add("icmp_probes", statusWarn, "%v, phantoms are only probed over TCP (needs CAP_NET_RAW)", err)
+		return
+	}
+	c.add("icmp_probes", statusPass, "raw ICMP socket available")
+}
+
+// checkPacketCapture checks that every tap interface of CJ_IFACE (the
+// detector's, see sysconfig/conjure.conf) exists, is up and can be captured
+// on by this user. The ZC clusters zbalance_ipc builds from them are not
+// checked.
+func (c *checker) checkPacketCapture() {
+	ifaces := os.Getenv("CJ_IFACE")
+	if ifaces == "" {
+		c.add("packet_capture", statusSkip, "CJ_IFACE not set")
+		return
+	}
+	var names []string
+	for _, name := range strings.Split(ifaces, ",") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "zc:")
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			c.add("packet_capture", statusFail, "interface %s: %v", name, err)
+			return
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			c.add("packet_capture", statusFail, "interface %s is down", name)
+			return
+		}
+		if err := openCapture(iface); err != nil {
+			c.add("packet_capture", statusFail, "%v (needs CAP_NET_RAW)", err)
+			return
+		}
+		names = append(names, name)
+	}
+	c.add("packet_capture", statusPass, "can capture on %s", strings.Join(names, ", "))
+}
+
+func generations(selector *cj.PhantomIPSelector) []uint {
+	var gens []uint
+	for gen := range selector.Networks {
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens
+}
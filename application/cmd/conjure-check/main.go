@@ -0,0 +1,82 @@
+// Command conjure-check verifies a station deployment before the station is
+// started. It loads the station configuration the way the station does
+// (CJ_STATION_CONFIG, PHANTOM_SUBNET_LOCATION) and actively runs each check
+// with the station's own code:
+//
+//   - the instance lock, listeners, ZMQ proxy socket, registration API and
+//     management addresses can be bound (so the station must not be running),
+//     and the management address is a loopback one unless
+//     -allow-public-management is given, as the station requires
+//   - the station and ZMQ keys parse, and the API certificate loads
+//   - a registration the checker sends itself is read back with every station
+//     key and yields the client's phantom
+//   - a connection to that phantom from this host is redirected to a listener
+//     with the phantom as original destination
+//   - the TCP registrars in connect_sockets accept connections
+//   - the open file limit is high enough and ICMP liveness probes can open a
+//     raw socket
+//   - the tap interfaces of CJ_IFACE are up and can be captured on
+//
+// It prints a table of results, or JSON with -json, and exits non-zero if any
+// check failed. The detector itself is not covered.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+)
+
+func main() {
+	var jsonOut, allowPublicManagement bool
+	var timeout time.Duration
+	flag.BoolVar(&jsonOut, "json", false, "Print results as JSON")
+	flag.BoolVar(&allowPublicManagement, "allow-public-management", false, "The station is run with -allow-public-management")
+	flag.DurationVar(&timeout, "timeout", 3*time.Second, "Timeout of each network check")
+	flag.Parse()
+
+	c := &checker{timeout: timeout, allowPublicManagement: allowPublicManagement}
+	conf, err := cj.ParseConfig()
+	if err != nil {
+		c.add("config", statusFail, "%v", err)
+	} else {
+		c.conf = conf
+		c.add("config", statusPass, "%s", os.Getenv("CJ_STATION_CONFIG"))
+		c.run()
+	}
+
+	if jsonOut {
+		err = writeJSON(os.Stdout, c.results)
+	} else {
+		err = writeTable(os.Stdout, c.results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write results: %v\n", err)
+		os.Exit(2)
+	}
+	if c.failed() {
+		os.Exit(1)
+	}
+}
+
+func writeTable(w io.Writer, results []result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Check, strings.ToUpper(r.Status), r.Detail)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, results []result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
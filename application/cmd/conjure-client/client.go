@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+)
+
+// registerAPI POSTs the registration to the station's registration API.
+func registerAPI(url string, reg *cj.ClientRegistration, insecure bool) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+	resp, err := client.Post(url, "application/x-protobuf", bytes.NewReader(reg.Wrapper))
+	if err != nil {
+		return fmt.Errorf("registration failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registration rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+// registerZMQ publishes the registration on a ZMQ PUB socket bound to addr,
+// which the station's ZMQ proxy must list in its connect_sockets (type NULL).
+// ZMQ drops messages sent before the subscriber has connected, so the
+// registration is published repeatedly for a while, the station ignores the
+// duplicates.
+func registerZMQ(addr string, reg *cj.ClientRegistration, duration time.Duration) error {
+	pub, err := zmq.NewSocket(zmq.PUB)
+	if err != nil {
+		return fmt.Errorf("failed to create zmq socket: %v", err)
+	}
+	defer pub.Close()
+	if err := pub.Bind(addr); err != nil {
+		return fmt.Errorf("failed to bind zmq socket %s: %v", addr, err)
+	}
+
+	for end := time.Now().Add(duration); time.Now().Before(end); time.Sleep(250 * time.Millisecond) {
+		if _, err := pub.SendBytes(reg.Wrapper, 0); err != nil {
+			return fmt.Errorf("failed to publish registration: %v", err)
+		}
+	}
+	return nil
+}
+
+// dial connects to the registration's phantom on its phantom port, which must
+// be redirected to a station listener, or to station directly if it is not
+// empty. A direct connection states the phantom in a PROXY header, the
+// station must be running with original_dst_mode "proxy_header".
+func dial(reg *cj.ClientRegistration, station string) (net.Conn, error) {
+	phantom := net.JoinHostPort(reg.Phantom.String(), strconv.Itoa(int(reg.PhantomPort)))
+	if station == "" {
+		return net.DialTimeout("tcp", phantom, 10*time.Second)
+	}
+
+	conn, err := net.DialTimeout("tcp", station, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	family, src := "TCP4", local.IP.String()
+	if reg.Phantom.To4() == nil {
+		family = "TCP6"
+		if local.IP.To4() != nil {
+			src = "::1"
+		}
+	} else if local.IP.To4() == nil {
+		src = "127.0.0.1"
+	}
+	header := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src, reg.Phantom, local.Port, reg.PhantomPort)
+	if _, err := conn.Write([]byte(header)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// minHandshake performs the min transport handshake: the connection tag
+// identifies the registration, everything after it is proxied.
+func minHandshake(conn net.Conn, reg *cj.ClientRegistration) error {
+	_, err := conn.Write(reg.Keys.ConnTag[:])
+	return err
+}
+
+// echoCheck sends size random bytes through conn and checks that the same
+// bytes come back.
+func echoCheck(conn net.Conn, size int, timeout time.Duration) error {
+	sent := make([]byte, size)
+	if _, err := rand.Read(sent); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(sent)
+		writeErr <- err
+	}()
+
+	received := make([]byte, size)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return fmt.Errorf("echo read failed: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("echo write failed: %v", err)
+	}
+	if !bytes.Equal(sent, received) {
+		return errors.New("echo mismatch: received bytes differ from those sent")
+	}
+	return nil
+}
+
+// serveEcho echoes every connection accepted on ln back to itself, until ln
+// is closed.
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// genStationKey returns a new station key in the format the station loads
+// (LoadStationKey): the private key followed by the public key.
+func genStationKey() ([]byte, error) {
+	kp, err := ntor.NewKeypair(false)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), kp.Private()[:]...), kp.Public()[:]...), nil
+}
+
+// clientConfPubkey returns the station public key and generation from a
+// marshaled ClientConf, preferring the conjure key over the default one.
+func clientConfPubkey(raw []byte) ([]byte, uint, error) {
+	conf := &pb.ClientConf{}
+	if err := proto.Unmarshal(raw, conf); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse ClientConf: %v", err)
+	}
+	key := conf.GetConjurePubkey().GetKey()
+	if len(key) == 0 {
+		key = conf.GetDefaultPubkey().GetKey()
+	}
+	if len(key) == 0 {
+		return nil, 0, errors.New("ClientConf has no station public key")
+	}
+	return key, uint(conf.GetGeneration()), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialPROXYHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	reg := &cj.ClientRegistration{Phantom: net.ParseIP("192.0.2.1"), PhantomPort: 443}
+	conn, err := dial(reg, ln.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	accepted, err := ln.Accept()
+	require.Nil(t, err)
+	defer accepted.Close()
+	accepted.SetDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(accepted).ReadString('\n')
+	require.Nil(t, err)
+	require.True(t, regexp.MustCompile(`^PROXY TCP4 127\.0\.0\.1 192\.0\.2\.1 \d+ 443\r\n$`).MatchString(line), line)
+}
+
+func TestEchoCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go serveEcho(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Nil(t, echoCheck(conn, 256*1024, 5*time.Second))
+}
+
+func TestClientConfPubkey(t *testing.T) {
+	pub, _ := hex.DecodeString("0102030405060708091011121314151617181920212223242526272829303132")
+	raw, err := proto.Marshal(&pb.ClientConf{
+		Generation:    proto.Uint32(957),
+		DefaultPubkey: &pb.PubKey{Key: []byte("tapdance key")},
+		ConjurePubkey: &pb.PubKey{Key: pub},
+	})
+	require.Nil(t, err)
+	key, generation, err := clientConfPubkey(raw)
+	require.Nil(t, err)
+	require.Equal(t, pub, key)
+	require.Equal(t, uint(957), generation)
+
+	raw, err = proto.Marshal(&pb.ClientConf{})
+	require.Nil(t, err)
+	_, _, err = clientConfPubkey(raw)
+	require.NotNil(t, err)
+}
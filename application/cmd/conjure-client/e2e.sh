@@ -0,0 +1,77 @@
+#!/bin/bash
+# End to end test of a station on loopback: builds the station and
+# conjure-client, starts the station with a throwaway key and config
+# (original_dst_mode "proxy_header", no covert blocklist), then registers and
+# echoes data through it once over the registration API and once over ZMQ.
+#
+# Run from application/ with "make e2e". Needs openssl for the API
+# certificate. Set KEEP=1 to keep the work directory and station log.
+set -euo pipefail
+
+cd "$(dirname "$0")/../.."
+work=$(mktemp -d)
+station_pid=
+cleanup() {
+	[ -n "$station_pid" ] && kill "$station_pid" 2>/dev/null || true
+	if [ -z "${KEEP:-}" ]; then rm -rf "$work"; else echo "work directory: $work"; fi
+}
+trap cleanup EXIT
+
+listen=127.0.0.1:${E2E_LISTEN_PORT:-41299}
+api=127.0.0.1:${E2E_API_PORT:-41298}
+zmq=tcp://127.0.0.1:${E2E_ZMQ_PORT:-41297}
+management=127.0.0.1:${E2E_MANAGEMENT_PORT:-41296}
+subnets=$PWD/lib/test/phantom_subnets.toml
+
+go build -o "$work/station" .
+go build -o "$work/conjure-client" ./cmd/conjure-client
+
+pubkey=$("$work/conjure-client" -genkey "$work/station.key")
+openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj /CN=127.0.0.1 \
+	-keyout "$work/api.key" -out "$work/api.crt" 2>/dev/null
+
+cat > "$work/station.toml" <<EOF
+listen_addrs = ["$listen"]
+original_dst_mode = "proxy_header"
+enable_v4 = true
+management_listen_addr = "$management"
+socket_name = "conjure-e2e-$$"
+privkey_path = "$work/station.key"
+station_privkey_paths = ["$work/station.key"]
+covert_connect_timeout = 5000
+liveness_timeout = 200
+serve_pending_registrations = true
+liveness_pending_timeout = 10
+live_phantom_policy = "log-only"
+registration_api_addr = "$api"
+registration_api_cert = "$work/api.crt"
+registration_api_key = "$work/api.key"
+covert_blocklist_subnets = []
+covert_blocklist_domains = []
+phantom_blocklist = []
+
+[[connect_sockets]]
+address = "$zmq"
+type = "NULL"
+EOF
+
+CJ_STATION_CONFIG="$work/station.toml" PHANTOM_SUBNET_LOCATION="$subnets" \
+	"$work/station" -zmq-address "ipc://@conjure-e2e-$$" -log-level debug > "$work/station.log" 2>&1 &
+station_pid=$!
+
+for _ in $(seq 50); do
+	grep -q "Listening on" "$work/station.log" && break
+	sleep 0.1
+done
+
+status=0
+echo "== registration API"
+"$work/conjure-client" -pubkey "$pubkey" -subnets "$subnets" -api "https://$api/" -insecure -station "$listen" || status=1
+echo "== ZMQ"
+"$work/conjure-client" -pubkey "$pubkey" -subnets "$subnets" -zmq "$zmq" -wait 3s -station "$listen" || status=1
+
+if [ $status -ne 0 ]; then
+	echo "== station log"
+	cat "$work/station.log"
+fi
+exit $status
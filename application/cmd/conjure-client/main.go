@@ -0,0 +1,145 @@
+// Command conjure-client is a minimal client for testing a station end to end
+// without the gotapdance stack. It registers, derives the phantom, connects
+// with the min transport and checks that data echoes back through the
+// station's proxy.
+//
+// Register over the station's registration API and connect to a station
+// listener running with original_dst_mode "proxy_header", with the covert
+// being an echo server run by the client itself:
+//
+//	conjure-client -pubkey <hex> -subnets phantom_subnets.toml \
+//		-api https://127.0.0.1:8443/register -insecure -station 127.0.0.1:41245
+//
+// With -zmq tcp://127.0.0.1:5599 the registration is published on a ZMQ
+// socket the station's proxy connects to instead. Without -station the
+// client connects to the phantom itself, which must be redirected to the
+// station (e.g. by an iptables rule in a test network namespace).
+//
+// A station key for the test station can be generated with
+//
+//	conjure-client -genkey station.key
+//
+// which prints the public key to pass as -pubkey. The command exits non-zero
+// if any step fails. See e2e.sh for the whole path on loopback.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+)
+
+func main() {
+	var pubkeyHex, clientConfPath, subnetsPath, apiURL, zmqAddr, station, covert, echoAddr, genKeyPath string
+	var generation uint
+	var v6, insecure bool
+	var wait, timeout time.Duration
+	var size int
+	flag.StringVar(&pubkeyHex, "pubkey", "", "Station public key (hex)")
+	flag.StringVar(&clientConfPath, "clientconf", "", "ClientConf to read the station public key and generation from, instead of -pubkey")
+	flag.StringVar(&subnetsPath, "subnets", os.Getenv("PHANTOM_SUBNET_LOCATION"), "Phantom subnet config (toml), the station's")
+	flag.UintVar(&generation, "generation", 1, "Phantom subnet generation")
+	flag.BoolVar(&v6, "v6", false, "Register for an IPv6 phantom")
+	flag.StringVar(&apiURL, "api", "", "URL of the station registration API to POST the registration to")
+	flag.BoolVar(&insecure, "insecure", false, "Do not verify the registration API certificate")
+	flag.StringVar(&zmqAddr, "zmq", "", "ZMQ address to bind and publish the registration on, instead of -api")
+	flag.DurationVar(&wait, "wait", 2*time.Second, "How long to wait after registering for the station to accept the registration")
+	flag.StringVar(&station, "station", "", "Station listener (host:port) to connect to with a PROXY header, instead of the phantom")
+	flag.StringVar(&covert, "covert", "", "Covert address (an echo server), empty runs one on -echo")
+	flag.StringVar(&echoAddr, "echo", "127.0.0.1:0", "Address of the echo server run when -covert is empty")
+	flag.IntVar(&size, "size", 64*1024, "Bytes to echo")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "Timeout of the echo check")
+	flag.StringVar(&genKeyPath, "genkey", "", "Write a new station key to this file, print its public key and exit")
+	flag.Parse()
+
+	if genKeyPath != "" {
+		key, err := genStationKey()
+		if err != nil {
+			fail("failed to generate station key: %v", err)
+		}
+		if err := ioutil.WriteFile(genKeyPath, key, 0600); err != nil {
+			fail("failed to write station key: %v", err)
+		}
+		fmt.Println(hex.EncodeToString(key[32:]))
+		return
+	}
+
+	var pubkey []byte
+	var err error
+	switch {
+	case clientConfPath != "":
+		raw, err := ioutil.ReadFile(clientConfPath)
+		if err != nil {
+			fail("failed to read ClientConf: %v", err)
+		}
+		pubkey, generation, err = clientConfPubkey(raw)
+		if err != nil {
+			fail("%v", err)
+		}
+	case pubkeyHex != "":
+		pubkey, err = hex.DecodeString(pubkeyHex)
+		if err != nil {
+			fail("bad station public key: %v", err)
+		}
+	default:
+		fail("one of -pubkey or -clientconf is required")
+	}
+	if (apiURL == "") == (zmqAddr == "") {
+		fail("exactly one of -api or -zmq is required")
+	}
+
+	selector, err := cj.SubnetsFromTomlFile(subnetsPath)
+	if err != nil {
+		fail("failed to load phantom subnets: %v", err)
+	}
+
+	if covert == "" {
+		ln, err := net.Listen("tcp", echoAddr)
+		if err != nil {
+			fail("failed to start echo server: %v", err)
+		}
+		defer ln.Close()
+		go serveEcho(ln)
+		covert = ln.Addr().String()
+	}
+
+	reg, err := cj.NewClientRegistration(pubkey, selector, generation, covert, v6)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "registering for phantom %v, covert %v\n", reg.Phantom, covert)
+
+	if apiURL != "" {
+		err = registerAPI(apiURL, reg, insecure)
+		time.Sleep(wait)
+	} else {
+		err = registerZMQ(zmqAddr, reg, wait)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+
+	conn, err := dial(reg, station)
+	if err != nil {
+		fail("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if err := minHandshake(conn, reg); err != nil {
+		fail("transport handshake failed: %v", err)
+	}
+	if err := echoCheck(conn, size, timeout); err != nil {
+		fail("%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "ok: %d bytes echoed through phantom %v\n", size, reg.Phantom)
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
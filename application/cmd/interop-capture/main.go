@@ -0,0 +1,80 @@
+// Command interop-capture records what a running detector publishes, to
+// (re)capture the interop corpus (application/interop/testdata). It
+// subscribes to the detector's ZMQ proxy (ipc://@detector, see detect.c)
+// alongside the station and writes each message to the corpus directory:
+// registrations as registration/<prefix>_<n>.bin, the payload frame of live
+// phantom reports as live_phantom/<prefix>_<n>.bin. Other messages are
+// reported and skipped.
+//
+// Run it against a test detector with dummy station keys, register with a
+// client (tagged decoy traffic through the tap for detector registrations),
+// then regenerate the goldens with make interop-goldens and review them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	cj "github.com/refraction-networking/conjure/application/lib"
+)
+
+func main() {
+	var addr, dir, prefix string
+	var count int
+	var timeout time.Duration
+	flag.StringVar(&addr, "addr", "ipc://@detector", "ZMQ address the detector publishes on")
+	flag.StringVar(&dir, "dir", "interop/testdata", "Corpus directory")
+	flag.StringVar(&prefix, "prefix", "captured", "Prefix of the file names written")
+	flag.IntVar(&count, "n", 10, "Number of messages to capture")
+	flag.DurationVar(&timeout, "timeout", 5*time.Minute, "How long to wait for them")
+	flag.Parse()
+
+	sub, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		log.Fatalf("failed to create zmq socket: %v", err)
+	}
+	defer sub.Close()
+	if err := sub.SetRcvtimeo(time.Second); err != nil {
+		log.Fatalf("failed to set receive timeout: %v", err)
+	}
+	if err := sub.Connect(addr); err != nil {
+		log.Fatalf("failed to connect to %s: %v", addr, err)
+	}
+	if err := sub.SetSubscribe(""); err != nil {
+		log.Fatalf("failed to subscribe to %s: %v", addr, err)
+	}
+
+	seen := map[string]int{}
+	for end := time.Now().Add(timeout); count > 0 && time.Now().Before(end); {
+		frames, err := sub.RecvMessageBytes(0)
+		if err != nil {
+			// Receive timeout, wait on.
+			continue
+		}
+		kind, msg := "registration", frames[0]
+		switch {
+		case len(frames) == 2 && string(frames[0]) == cj.LivePhantomTopic:
+			kind, msg = "live_phantom", frames[1]
+		case len(frames) != 1:
+			log.Printf("skipping a message of %d frames", len(frames))
+			continue
+		}
+		path := filepath.Join(dir, kind, fmt.Sprintf("%s_%d.bin", prefix, seen[kind]))
+		if err := ioutil.WriteFile(path, msg, 0644); err != nil {
+			log.Fatalf("failed to write %s: %v", path, err)
+		}
+		log.Printf("captured %s (%d bytes)", path, len(msg))
+		seen[kind]++
+		count--
+	}
+	if count > 0 {
+		fmt.Fprintf(os.Stderr, "timed out with %d messages left to capture\n", count)
+		os.Exit(1)
+	}
+}
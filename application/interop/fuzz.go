@@ -0,0 +1,21 @@
+// +build gofuzz
+
+package interop
+
+// FuzzRegistration is the go-fuzz target of registration message decoding,
+// see the fuzz targets of the Makefile.
+func FuzzRegistration(data []byte) int {
+	if decodeRegistration(data).Malformed {
+		return 0
+	}
+	return 1
+}
+
+// FuzzLivePhantomReport is the go-fuzz target of live phantom report
+// decoding.
+func FuzzLivePhantomReport(data []byte) int {
+	if decodeLivePhantomReport(data).Malformed {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,113 @@
+// Package interop checks that the station reads the messages of the Rust
+// detector as the detector means them. The corpus in testdata holds messages
+// as the detector sends them over ZMQ; the tests decode each with the
+// station's parsers and compare the result with the golden JSON next to it.
+// The same decoding is the entry point of the go-fuzz targets (see fuzz.go),
+// which start from the corpus.
+package interop
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// registration is what the station reads from a registration message, as
+// stored in the goldens.
+type registration struct {
+	Malformed bool `json:"malformed,omitempty"`
+
+	SharedSecret        string               `json:"shared_secret,omitempty"`
+	Source              string               `json:"registration_source,omitempty"`
+	RegistrationAddress string               `json:"registration_address,omitempty"`
+	DecoyAddress        string               `json:"decoy_address,omitempty"`
+	Expiry              *time.Time           `json:"expiry,omitempty"`
+	Payload             *registrationPayload `json:"registration_payload,omitempty"`
+}
+
+type registrationPayload struct {
+	DecoyListGeneration   uint32                `json:"decoy_list_generation"`
+	Transport             string                `json:"transport"`
+	CovertAddress         string                `json:"covert_address"`
+	MaskedDecoyServerName string                `json:"masked_decoy_server_name"`
+	V4Support             bool                  `json:"v4_support"`
+	V6Support             bool                  `json:"v6_support"`
+	Flags                 *pb.RegistrationFlags `json:"flags,omitempty"`
+	PaddingLength         int                   `json:"padding_length"`
+}
+
+// decodeRegistration reads a registration message (a marshaled C2SWrapper)
+// the way the station's ingest does.
+func decodeRegistration(msg []byte) registration {
+	wrapper := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(msg, wrapper); err != nil {
+		return registration{Malformed: true}
+	}
+	// Whether the expiry has passed is up to the ingest, not the decoding.
+	expiry, err := cj.RegistrationExpiry(msg, time.Time{})
+	if err != nil && !errors.Is(err, cj.ErrRegistrationExpired) {
+		return registration{Malformed: true}
+	}
+	c2s, err := cj.OpenRegistrationPayload(msg, wrapper.GetSharedSecret())
+	if err != nil {
+		return registration{Malformed: true}
+	}
+	if c2s == nil {
+		c2s = wrapper.GetRegistrationPayload()
+	}
+
+	r := registration{
+		SharedSecret:        hex.EncodeToString(wrapper.GetSharedSecret()),
+		Source:              wrapper.GetRegistrationSource().String(),
+		RegistrationAddress: addrString(wrapper.GetRegistrationAddress()),
+		DecoyAddress:        addrString(wrapper.GetDecoyAddress()),
+	}
+	if !expiry.IsZero() {
+		r.Expiry = &expiry
+	}
+	if c2s != nil {
+		r.Payload = &registrationPayload{
+			DecoyListGeneration:   c2s.GetDecoyListGeneration(),
+			Transport:             c2s.GetTransport().String(),
+			CovertAddress:         c2s.GetCovertAddress(),
+			MaskedDecoyServerName: c2s.GetMaskedDecoyServerName(),
+			V4Support:             c2s.GetV4Support(),
+			V6Support:             c2s.GetV6Support(),
+			Flags:                 c2s.GetFlags(),
+			PaddingLength:         len(c2s.GetPadding()),
+		}
+	}
+	return r
+}
+
+// livePhantomReport is what the station reads from a live phantom report.
+type livePhantomReport struct {
+	Malformed bool     `json:"malformed,omitempty"`
+	Phantoms  []string `json:"phantoms,omitempty"`
+}
+
+// decodeLivePhantomReport reads the payload frame of a live phantom report
+// (the frame after cj.LivePhantomTopic).
+func decodeLivePhantomReport(frame []byte) livePhantomReport {
+	phantoms, err := cj.ParseLivePhantomReport(frame)
+	if err != nil {
+		return livePhantomReport{Malformed: true}
+	}
+	var r livePhantomReport
+	for _, phantom := range phantoms {
+		r.Phantoms = append(r.Phantoms, phantom.String())
+	}
+	return r
+}
+
+func addrString(addr []byte) string {
+	if len(addr) == 0 {
+		return ""
+	}
+	return net.IP(addr).String()
+}
@@ -0,0 +1,46 @@
+package interop
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden JSON of the corpus from what the station decodes")
+
+// checkCorpus decodes every message in testdata/dir and compares it with the
+// golden JSON of the same name.
+func checkCorpus(t *testing.T, dir string, decode func([]byte) interface{}) {
+	files, err := filepath.Glob(filepath.Join("testdata", dir, "*.bin"))
+	require.Nil(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		msg, err := ioutil.ReadFile(file)
+		require.Nil(t, err)
+		got, err := json.MarshalIndent(decode(msg), "", "\t")
+		require.Nil(t, err)
+		got = append(got, '\n')
+
+		golden := strings.TrimSuffix(file, ".bin") + ".json"
+		if *update {
+			require.Nil(t, ioutil.WriteFile(golden, got, 0644))
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		require.Nil(t, err, "no golden for %s, run make interop-goldens", file)
+		require.Equal(t, string(want), string(got), file)
+	}
+}
+
+func TestInteropRegistrations(t *testing.T) {
+	checkCorpus(t, "registration", func(msg []byte) interface{} { return decodeRegistration(msg) })
+}
+
+func TestInteropLivePhantomReports(t *testing.T) {
+	checkCorpus(t, "live_phantom", func(msg []byte) interface{} { return decodeLivePhantomReport(msg) })
+}
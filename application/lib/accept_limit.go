@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Prefix lengths source addresses are grouped by for accept rate limiting
+// when none are configured.
+const (
+	defaultAcceptPrefixV4 = 24
+	defaultAcceptPrefixV6 = 64
+)
+
+// acceptSweepInterval is how often subnets whose bucket has refilled are
+// forgotten, so that the limiter only remembers recently seen subnets.
+const acceptSweepInterval = time.Minute
+
+// acceptLimiter rate limits accepted connections by source subnet, with one
+// token bucket of connections per subnet. A flood spread over many addresses
+// of one subnet is limited as a whole, while other subnets are unaffected.
+type acceptLimiter struct {
+	rate   float64 // connections per second
+	burst  float64
+	v4, v6 net.IPMask
+	clock  clock.Clock
+
+	m         sync.Mutex
+	buckets   map[string]*acceptBucket // by subnet
+	lastSweep time.Time
+}
+
+type acceptBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptLimiter(rate float64, burst, prefixV4, prefixV6 int) *acceptLimiter {
+	return &acceptLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		v4:      net.CIDRMask(prefixV4, 8*net.IPv4len),
+		v6:      net.CIDRMask(prefixV6, 8*net.IPv6len),
+		clock:   clock.Real,
+		buckets: make(map[string]*acceptBucket),
+	}
+}
+
+// subnet returns the subnet ip is limited as part of.
+func (l *acceptLimiter) subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(l.v4), Mask: l.v4}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(l.v6), Mask: l.v6}).String()
+}
+
+// allow takes a connection from the bucket of ip's subnet, it returns false
+// if the bucket is empty.
+func (l *acceptLimiter) allow(ip net.IP) bool {
+	subnet := l.subnet(ip)
+	now := l.clock.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	if now.Sub(l.lastSweep) >= acceptSweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[subnet]
+	if !ok {
+		b = &acceptBucket{tokens: l.burst, last: now}
+		l.buckets[subnet] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the subnets whose bucket is full by now, they are no
+// different from subnets never seen. l.m must be held.
+func (l *acceptLimiter) sweep(now time.Time) {
+	for subnet, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, subnet)
+		}
+	}
+	l.lastSweep = now
+}
+
+// subnets returns the number of subnets the limiter remembers.
+func (l *acceptLimiter) subnets() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return len(l.buckets)
+}
+
+func (c *ClientTCPConfig) parseAcceptLimit() error {
+	if c.AcceptRate < 0 || c.AcceptBurst < 0 {
+		return fmt.Errorf("client_tcp accept_rate and accept_burst must not be negative")
+	}
+	if c.AcceptPrefixV4 == 0 {
+		c.AcceptPrefixV4 = defaultAcceptPrefixV4
+	}
+	if c.AcceptPrefixV6 == 0 {
+		c.AcceptPrefixV6 = defaultAcceptPrefixV6
+	}
+	if c.AcceptPrefixV4 < 0 || c.AcceptPrefixV4 > 32 {
+		return fmt.Errorf("client_tcp accept_prefix_v4 must be between 1 and 32")
+	}
+	if c.AcceptPrefixV6 < 0 || c.AcceptPrefixV6 > 128 {
+		return fmt.Errorf("client_tcp accept_prefix_v6 must be between 1 and 128")
+	}
+	if c.AcceptRate == 0 {
+		return nil
+	}
+	if c.AcceptBurst == 0 {
+		c.AcceptBurst = int(math.Max(1, math.Ceil(c.AcceptRate)))
+	}
+	c.acceptLimiter = newAcceptLimiter(c.AcceptRate, c.AcceptBurst, c.AcceptPrefixV4, c.AcceptPrefixV6)
+	return nil
+}
+
+// AllowAccept reports whether a connection just accepted from addr is within
+// the accept rate of its source subnet. Connections over the limit are
+// counted in metrics.AcceptsRejected. Everything is allowed if AcceptRate is
+// zero.
+func (c *ClientTCPConfig) AllowAccept(addr net.Addr) bool {
+	if c.acceptLimiter == nil {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if !c.acceptLimiter.allow(tcpAddr.IP) {
+		metrics.AcceptsRejected.Inc()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptLimitSubnetFlood(t *testing.T) {
+	c := &ClientTCPConfig{AcceptRate: 10, AcceptBurst: 20}
+	require.Nil(t, c.parse())
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	c.acceptLimiter.clock = clk
+	rejected := metrics.AcceptsRejected.Value()
+
+	// A flood from every address of one /24 is limited as a whole.
+	allowed := 0
+	for i := 1; i <= 200; i++ {
+		addr := &net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("198.51.100.%d", i)), Port: 40000 + i}
+		if c.AllowAccept(addr) {
+			allowed++
+		}
+	}
+	require.Equal(t, 20, allowed)
+	require.Equal(t, rejected+180, metrics.AcceptsRejected.Value())
+
+	// Other subnets are not.
+	require.True(t, c.AllowAccept(&net.TCPAddr{IP: net.ParseIP("198.51.101.1")}))
+	require.True(t, c.AllowAccept(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:1::1")}))
+
+	// The subnet's bucket refills at the rate.
+	clk.Advance(500 * time.Millisecond)
+	allowed = 0
+	for i := 1; i <= 20; i++ {
+		if c.AllowAccept(&net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("198.51.100.%d", i))}) {
+			allowed++
+		}
+	}
+	require.Equal(t, 5, allowed)
+
+	// Subnets are forgotten once their bucket is full again.
+	require.Equal(t, 3, c.acceptLimiter.subnets())
+	clk.Advance(acceptSweepInterval)
+	require.True(t, c.AllowAccept(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}))
+	require.Equal(t, 1, c.acceptLimiter.subnets())
+}
+
+func TestAcceptLimitParse(t *testing.T) {
+	c := &ClientTCPConfig{}
+	require.Nil(t, c.parse())
+	require.Nil(t, c.acceptLimiter)
+	require.True(t, c.AllowAccept(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}))
+	require.Equal(t, defaultAcceptPrefixV4, c.AcceptPrefixV4)
+
+	c = &ClientTCPConfig{AcceptRate: 0.5, AcceptPrefixV6: 48}
+	require.Nil(t, c.parse())
+	require.Equal(t, 1, c.AcceptBurst)
+	require.Equal(t, "2001:db8:1::/48", c.acceptLimiter.subnet(net.ParseIP("2001:db8:1:2::1")))
+	require.Equal(t, "198.51.100.0/24", c.acceptLimiter.subnet(net.ParseIP("::ffff:198.51.100.7")))
+
+	for _, bad := range []ClientTCPConfig{
+		{AcceptRate: -1},
+		{AcceptRate: 1, AcceptBurst: -1},
+		{AcceptPrefixV4: 33},
+		{AcceptPrefixV6: 129},
+	} {
+		require.NotNil(t, bad.parse(), "%+v", bad)
+	}
+}
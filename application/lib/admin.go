@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// AdminServer serves station status to operators over HTTP. Each status page
+// is a function whose result is returned as JSON at /status/<name>, and
+// /status lists the pages. The station-wide server is the management
+// endpoint, it also serves the Prometheus metrics at /metrics, /healthz and
+// the Go profiler under /debug/pprof/.
+type AdminServer struct {
+	m      sync.RWMutex
+	status map[string]func() interface{}
+	mux    *http.ServeMux
+}
+
+// NewAdminServer returns an admin server with no status pages.
+func NewAdminServer() *AdminServer {
+	a := &AdminServer{
+		status: make(map[string]func() interface{}),
+		mux:    http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/status", a.serveIndex)
+	a.mux.HandleFunc("/status/", a.serveStatus)
+	return a
+}
+
+var adminInstance *AdminServer
+var adminOnce sync.Once
+
+// Admin returns the station-wide admin server.
+func Admin() *AdminServer {
+	adminOnce.Do(func() {
+		adminInstance = NewAdminServer()
+		adminInstance.HandleStatus("liveness_subnets", func() interface{} { return LivenessSubnets() })
+		adminInstance.Handle("/metrics", metrics.Handler())
+		adminInstance.Handle("/healthz", http.HandlerFunc(serveHealthz))
+		adminInstance.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+		adminInstance.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		adminInstance.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		adminInstance.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		adminInstance.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	})
+	return adminInstance
+}
+
+// HandleStatus serves the result of f as JSON at /status/name.
+func (a *AdminServer) HandleStatus(name string, f func() interface{}) {
+	a.m.Lock()
+	a.status[name] = f
+	a.m.Unlock()
+}
+
+// Handle registers handler for pattern, for admin endpoints that are more than
+// a status page.
+func (a *AdminServer) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Scrapes, health checks and detector registration lookups are too
+	// frequent to be worth auditing.
+	if r.URL.Path != "/metrics" && r.URL.Path != "/healthz" && r.URL.Path != registrationLookupPath {
+		Events().Publish(Event{Type: EventAdminAction, Detail: r.Method + " " + r.URL.Path})
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// ListenManagement opens the listener for the management endpoint. Unless
+// allowPublic is set addr must be a loopback address, the endpoint exposes
+// station internals and must not be reachable from outside the host.
+func ListenManagement(addr string, allowPublic bool) (net.Listener, error) {
+	if !allowPublic {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("bad management address %q: %v", addr, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("management address %s is not a loopback address, refusing to expose the management endpoint without -allow-public-management", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Health states of the station reported at /healthz.
+const (
+	HealthReady    int32 = iota // accepting connections
+	HealthDraining              // shutting down, waiting for sessions to finish
+	HealthDown                  // shut down, about to exit
+)
+
+var healthNames = map[int32]string{
+	HealthReady:    "ready",
+	HealthDraining: "draining",
+	HealthDown:     "down",
+}
+
+var healthState int32
+
+// SetHealth sets the state reported at /healthz, one of HealthReady,
+// HealthDraining or HealthDown.
+func SetHealth(state int32) {
+	atomic.StoreInt32(&healthState, state)
+}
+
+// serveHealthz reports the health state and the number of active sessions
+// as JSON, with status 200 when ready and 503 otherwise so that load
+// balancers stop sending new traffic to a station that is shutting down.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	state := atomic.LoadInt32(&healthState)
+	w.Header().Set("Content-Type", "application/json")
+	if state != HealthReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		Active int    `json:"active"`
+	}{healthNames[state], Sessions().Count()})
+}
+
+func (a *AdminServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	a.m.RLock()
+	names := make([]string, 0, len(a.status))
+	for name := range a.status {
+		names = append(names, name)
+	}
+	a.m.RUnlock()
+	sort.Strings(names)
+	writeJSON(w, names)
+}
+
+func (a *AdminServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	a.m.RLock()
+	f, ok := a.status[strings.TrimPrefix(r.URL.Path, "/status/")]
+	a.m.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, f())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
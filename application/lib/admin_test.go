@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminStatus(t *testing.T) {
+	a := NewAdminServer()
+	a.HandleStatus("things", func() interface{} { return map[string]int{"count": 3} })
+	a.HandleStatus("alpha", func() interface{} { return nil })
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/status")
+	require.Equal(t, http.StatusOK, w.Code)
+	var names []string
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &names))
+	require.Equal(t, []string{"alpha", "things"}, names)
+
+	w = get("/status/things")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var things map[string]int
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &things))
+	require.Equal(t, 3, things["count"])
+
+	require.Equal(t, http.StatusNotFound, get("/status/missing").Code)
+}
+
+func TestAdminMetrics(t *testing.T) {
+	source := pb.RegistrationSource_API
+	Stat().AddReg(0, &source)
+
+	w := httptest.NewRecorder()
+	Admin().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+
+	for _, family := range []string{
+		"conjure_registrations_total counter",
+		"conjure_registrations_active gauge",
+		"conjure_registration_states_total counter",
+		"conjure_ingest_messages_total counter",
+		"conjure_sessions_open gauge",
+		"conjure_sessions_completed_total counter",
+		"conjure_proxy_bytes_total counter",
+		"conjure_covert_dial_failures_total counter",
+		"conjure_detector_live_phantom_reports_total counter",
+	} {
+		require.Contains(t, body, "# TYPE "+family+"\n")
+	}
+	require.Contains(t, body, "conjure_registrations_total{source=\"api\"} ")
+}
+
+// /healthz follows the station through shutdown: ready, then draining while
+// sessions finish, then down.
+func TestAdminHealthz(t *testing.T) {
+	defer SetHealth(HealthReady)
+	healthz := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		Admin().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var body map[string]interface{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	client, covert := net.Pipe()
+	defer client.Close()
+	s := Sessions().Add(&DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1")}, client, covert)
+	active := float64(Sessions().Count())
+
+	code, body := healthz()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, map[string]interface{}{"status": "ready", "active": active}, body)
+
+	SetHealth(HealthDraining)
+	code, body = healthz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, map[string]interface{}{"status": "draining", "active": active}, body)
+
+	Sessions().Remove(s)
+	SetHealth(HealthDown)
+	code, body = healthz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, map[string]interface{}{"status": "down", "active": active - 1}, body)
+}
+
+// The management endpoint is only served on loopback addresses unless public
+// management is explicitly allowed.
+func TestListenManagementRefusesPublic(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", ":0", "[::]:0", "192.0.2.1:0", "example.com:0", "not an address"} {
+		_, err := ListenManagement(addr, false)
+		require.NotNil(t, err, addr)
+	}
+	_, err := ListenManagement("0.0.0.0:0", false)
+	require.Contains(t, err.Error(), "-allow-public-management")
+
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0"} {
+		ln, err := ListenManagement(addr, false)
+		require.Nil(t, err, addr)
+		ln.Close()
+	}
+
+	ln, err := ListenManagement("0.0.0.0:0", true)
+	require.Nil(t, err)
+	ln.Close()
+}
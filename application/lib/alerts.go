@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alert names, the "alert" field of webhook notifications.
+const (
+	alertRegistrationsStalled = "registrations_stalled"
+	alertCovertDialFailures   = "covert_dial_failures"
+)
+
+// Alert states, the "state" field of webhook notifications.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertWebhookTimeout bounds a single webhook POST.
+const alertWebhookTimeout = 10 * time.Second
+
+// alertQueueSize is the number of notifications waiting to be POSTed before
+// further ones are dropped.
+const alertQueueSize = 16
+
+// AlertNotification is the JSON body POSTed to the webhook. Text makes it
+// a valid Slack (and Mattermost) incoming webhook message, the other fields
+// are for receivers that parse it.
+type AlertNotification struct {
+	Text    string    `json:"text"`
+	Alert   string    `json:"alert"`
+	State   string    `json:"state"`
+	Detail  string    `json:"detail"`
+	Station string    `json:"station"` // the station ID
+	Time    time.Time `json:"time"`
+}
+
+// alertState is what is known of one alert: whether its rule currently
+// holds, and the state last notified and when.
+type alertState struct {
+	firing     bool
+	detail     string
+	notified   bool // firing was notified last, resolved if false
+	notifiedAt time.Time
+}
+
+// Alerter evaluates alert rules on the stats snapshots (see
+// Stats.OnSnapshot) and POSTs a notification to a webhook when an alert
+// starts firing and when it resolves:
+//
+// registrations_stalled fires when no registration, not even a duplicate,
+// was received for the configured time.
+//
+// covert_dial_failures fires when more than the configured ratio of covert
+// dials failed, over consecutive windows of the configured number of dials.
+//
+// Each alert notifies at most once per rate limit. A change of state within
+// the limit is held back, and only notified after it if it still holds.
+// Notifications are POSTed by Run, never from the stats goroutine, and are
+// not retried.
+type Alerter struct {
+	webhook         string
+	noRegistrations time.Duration
+	dialRatio       float64
+	dialWindow      int64
+	rateLimit       time.Duration
+	station         string
+	client          *http.Client
+	logger          *log.Logger
+	queue           chan AlertNotification
+
+	m                sync.Mutex
+	lastRegistration time.Time
+	windowDials      int64
+	windowFailures   int64
+	alerts           map[string]*alertState
+}
+
+// NewAlerter returns an alerter notifying webhook. noRegistrations is how long
+// without registrations fires registrations_stalled, zero disables it.
+// dialRatio is the covert dial failure ratio over dialWindow dials above which
+// covert_dial_failures fires, zero disables it. rateLimit is the least time
+// between two notifications of the same alert.
+func NewAlerter(webhook string, noRegistrations time.Duration, dialRatio float64, dialWindow int64, rateLimit time.Duration, logger *log.Logger) *Alerter {
+	return &Alerter{
+		webhook:         webhook,
+		noRegistrations: noRegistrations,
+		dialRatio:       dialRatio,
+		dialWindow:      dialWindow,
+		rateLimit:       rateLimit,
+		station:         Station().ID,
+		client:          &http.Client{Timeout: alertWebhookTimeout},
+		logger:          logger,
+		queue:           make(chan AlertNotification, alertQueueSize),
+		alerts:          make(map[string]*alertState),
+	}
+}
+
+// Observe evaluates the alert rules on snapshot s and queues the
+// notifications due. It never blocks.
+func (a *Alerter) Observe(s StatsSnapshot) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.noRegistrations > 0 {
+		if a.lastRegistration.IsZero() || s.NewRegistrations+s.NewDupRegistrations > 0 {
+			a.lastRegistration = s.Time
+		}
+		since := s.Time.Sub(a.lastRegistration)
+		a.set(alertRegistrationsStalled, since >= a.noRegistrations,
+			fmt.Sprintf("no registrations received for %v", since.Truncate(time.Second)))
+	}
+
+	if a.dialRatio > 0 && a.dialWindow > 0 {
+		a.windowDials += s.CovertDials
+		a.windowFailures += s.CovertDialFailures
+		if a.windowDials >= a.dialWindow {
+			ratio := float64(a.windowFailures) / float64(a.windowDials)
+			a.set(alertCovertDialFailures, ratio > a.dialRatio,
+				fmt.Sprintf("%d of the last %d covert dials failed (%.0f%%)", a.windowFailures, a.windowDials, ratio*100))
+			a.windowDials, a.windowFailures = 0, 0
+		}
+	}
+
+	for name, st := range a.alerts {
+		if st.firing == st.notified || (!st.notifiedAt.IsZero() && s.Time.Sub(st.notifiedAt) < a.rateLimit) {
+			continue
+		}
+		st.notified = st.firing
+		st.notifiedAt = s.Time
+		a.enqueue(name, st, s.Time)
+	}
+}
+
+// set records whether the rule of alert name holds. Called with a.m held.
+func (a *Alerter) set(name string, firing bool, detail string) {
+	st, ok := a.alerts[name]
+	if !ok {
+		st = &alertState{}
+		a.alerts[name] = st
+	}
+	st.firing = firing
+	st.detail = detail
+}
+
+func (a *Alerter) enqueue(name string, st *alertState, now time.Time) {
+	state := alertResolved
+	if st.firing {
+		state = alertFiring
+	}
+	n := AlertNotification{
+		Text:    fmt.Sprintf("[%s] %s %s: %s", a.station, name, state, st.detail),
+		Alert:   name,
+		State:   state,
+		Detail:  st.detail,
+		Station: a.station,
+		Time:    now,
+	}
+	select {
+	case a.queue <- n:
+	default:
+		a.logger.Printf("dropped %s %s notification, webhook is not keeping up", name, state)
+	}
+}
+
+// Run POSTs queued notifications to the webhook, it does not return.
+func (a *Alerter) Run() {
+	for n := range a.queue {
+		if err := a.post(n); err != nil {
+			a.logger.Printf("failed to notify %s %s: %v", n.Alert, n.State, err)
+			continue
+		}
+		a.logger.Printf("notified %s %s: %s", n.Alert, n.State, n.Detail)
+	}
+}
+
+func (a *Alerter) post(n AlertNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
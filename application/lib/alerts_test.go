@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// alertWebhook returns a webhook server passing the notifications it
+// receives to the returned channel.
+func alertWebhook(t *testing.T) (*httptest.Server, chan AlertNotification) {
+	received := make(chan AlertNotification, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n AlertNotification
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&n))
+		received <- n
+	}))
+	return srv, received
+}
+
+func requireNotification(t *testing.T, received chan AlertNotification, alert, state string) AlertNotification {
+	select {
+	case n := <-received:
+		require.Equal(t, alert, n.Alert)
+		require.Equal(t, state, n.State)
+		require.Contains(t, n.Text, alert+" "+state)
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s %s notification", alert, state)
+	}
+	return AlertNotification{}
+}
+
+func requireNoNotification(t *testing.T, received chan AlertNotification) {
+	select {
+	case n := <-received:
+		t.Fatalf("unexpected notification %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlertRegistrationsStalled(t *testing.T) {
+	srv, received := alertWebhook(t)
+	defer srv.Close()
+	a := NewAlerter(srv.URL, time.Minute, 0, 0, 10*time.Minute, log.New(ioutil.Discard, "", 0))
+	go a.Run()
+
+	start := time.Unix(1700000000, 0)
+	at := func(d time.Duration, regs int64) StatsSnapshot {
+		return StatsSnapshot{Time: start.Add(d), NewRegistrations: regs}
+	}
+	a.Observe(at(0, 0))
+	a.Observe(at(30*time.Second, 0))
+	requireNoNotification(t, received)
+
+	a.Observe(at(time.Minute, 0))
+	n := requireNotification(t, received, alertRegistrationsStalled, alertFiring)
+	require.Equal(t, "no registrations received for 1m0s", n.Detail)
+	a.Observe(at(2*time.Minute, 0))
+	requireNoNotification(t, received)
+
+	// Resolved within the rate limit, and firing again: nothing is sent.
+	a.Observe(at(3*time.Minute, 1))
+	a.Observe(at(5*time.Minute, 0))
+	requireNoNotification(t, received)
+
+	// Resolved for good, notified once the rate limit has passed.
+	a.Observe(at(6*time.Minute, 1))
+	requireNoNotification(t, received)
+	a.Observe(at(11*time.Minute, 1))
+	requireNotification(t, received, alertRegistrationsStalled, alertResolved)
+	a.Observe(at(12*time.Minute, 1))
+	requireNoNotification(t, received)
+}
+
+func TestAlertCovertDialFailures(t *testing.T) {
+	srv, received := alertWebhook(t)
+	defer srv.Close()
+	a := NewAlerter(srv.URL, 0, 0.5, 100, 0, log.New(ioutil.Discard, "", 0))
+	go a.Run()
+
+	now := time.Unix(1700000000, 0)
+	observe := func(dials, failures int64) {
+		now = now.Add(5 * time.Second)
+		a.Observe(StatsSnapshot{Time: now, CovertDials: dials, CovertDialFailures: failures})
+	}
+
+	// Windows are only evaluated once they hold enough dials.
+	observe(60, 60)
+	requireNoNotification(t, received)
+	observe(40, 0)
+	n := requireNotification(t, received, alertCovertDialFailures, alertFiring)
+	require.Equal(t, "60 of the last 100 covert dials failed (60%)", n.Detail)
+
+	observe(100, 50)
+	requireNotification(t, received, alertCovertDialFailures, alertResolved)
+	observe(100, 10)
+	requireNoNotification(t, received)
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// c2sWrapperAllowedSourcesField is the field number of the allowed_sources
+// field in the C2SWrapper message. See proto/signalling.proto.
+const c2sWrapperAllowedSourcesField = 13
+
+// maxAllowedSources is the most allowed sources a registration may carry.
+const maxAllowedSources = 32
+
+// ErrSourceNotAllowed is returned for a connection to a registration from a
+// client address outside of its AllowedSources.
+var ErrSourceNotAllowed = errors.New("client address is not an allowed source of the registration")
+
+// RegistrationAllowedSources returns the allowed sources set in the marshaled
+// C2SWrapper raw, nil if it sets none. Sources are CIDR networks or single
+// addresses; IPv4-mapped IPv6 ones are returned as IPv4.
+func RegistrationAllowedSources(raw []byte) ([]*net.IPNet, error) {
+	var sources []string
+	err := walkC2SWrapper(raw, func(field uint64, varint uint64, data []byte) {
+		if field == c2sWrapperAllowedSourcesField && data != nil {
+			sources = append(sources, string(data))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) > maxAllowedSources {
+		return nil, fmt.Errorf("registration has %d allowed sources, at most %d are supported", len(sources), maxAllowedSources)
+	}
+
+	var nets []*net.IPNet
+	for _, s := range sources {
+		n, err := parseAllowedSource(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseAllowedSource parses s, a CIDR network or a single address.
+func parseAllowedSource(s string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad allowed source %q", s)
+		}
+		n = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+	}
+	// An IPv4-mapped network only ever holds IPv4 clients, which are
+	// matched as IPv4.
+	ones, bits := n.Mask.Size()
+	mapped := 8 * (net.IPv6len - net.IPv4len)
+	if ip4 := n.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= mapped {
+		mask := net.CIDRMask(ones-mapped, 8*net.IPv4len)
+		n = &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	return n, nil
+}
+
+// AppendRegistrationAllowedSources appends the allowed_sources field set to
+// sources to the marshaled C2SWrapper raw, so that a registration shared
+// onwards keeps them.
+func AppendRegistrationAllowedSources(raw []byte, sources []*net.IPNet) []byte {
+	for _, n := range sources {
+		s := n.String()
+		var buf [2 * binary.MaxVarintLen64]byte
+		l := binary.PutUvarint(buf[:], c2sWrapperAllowedSourcesField<<3|2)
+		l += binary.PutUvarint(buf[l:], uint64(len(s)))
+		raw = append(append(raw, buf[:l]...), s...)
+	}
+	return raw
+}
+
+// CheckSource verifies that addr, the client address of a connection for
+// reg, is in one of reg's AllowedSources, if it has any. A mismatch is
+// counted in metrics.SourceMismatches and returned as ErrSourceNotAllowed.
+func (reg *DecoyRegistration) CheckSource(addr net.Addr) error {
+	if len(reg.AllowedSources) == 0 {
+		return nil
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if addr != nil {
+			if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+				ip = net.ParseIP(host)
+			}
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip != nil {
+		for _, n := range reg.AllowedSources {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	metrics.SourceMismatches.Inc()
+	return ErrSourceNotAllowed
+}
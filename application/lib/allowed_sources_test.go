@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"net"
+	"testing"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationAllowedSources(t *testing.T) {
+	raw := []byte{0x0a, 0x01, 0x00} // shared_secret
+	sources, err := RegistrationAllowedSources(raw)
+	require.Nil(t, err)
+	require.Nil(t, sources)
+
+	var nets []*net.IPNet
+	for _, s := range []string{"192.0.2.0/24", "2001:db8::/32", "::ffff:198.51.100.0/120", "203.0.113.7", "::ffff:203.0.113.8"} {
+		n, err := parseAllowedSource(s)
+		require.Nil(t, err, s)
+		nets = append(nets, n)
+	}
+	sources, err = RegistrationAllowedSources(AppendRegistrationAllowedSources(raw, nets))
+	require.Nil(t, err)
+	var got []string
+	for _, n := range sources {
+		got = append(got, n.String())
+	}
+	// IPv4-mapped sources are normalized to IPv4.
+	require.Equal(t, []string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.0/24", "203.0.113.7/32", "203.0.113.8/32"}, got)
+
+	_, err = RegistrationAllowedSources(append(raw, c2sWrapperAllowedSourcesField<<3|2, 3, 'b', 'a', 'd'))
+	require.NotNil(t, err)
+}
+
+func TestCheckSource(t *testing.T) {
+	reg := &DecoyRegistration{}
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	// Without allowed sources any client is.
+	require.Nil(t, reg.CheckSource(addr("203.0.113.1")))
+
+	for _, s := range []string{"192.0.2.0/24", "::ffff:198.51.100.0/120", "2001:db8::/32"} {
+		n, err := parseAllowedSource(s)
+		require.Nil(t, err)
+		reg.AllowedSources = append(reg.AllowedSources, n)
+	}
+	mismatches := metrics.SourceMismatches.Value()
+	for _, ip := range []string{"192.0.2.9", "::ffff:192.0.2.9", "198.51.100.200", "2001:db8::1"} {
+		require.Nil(t, reg.CheckSource(addr(ip)), ip)
+	}
+	require.Equal(t, mismatches, metrics.SourceMismatches.Value())
+
+	for _, ip := range []string{"192.0.3.1", "::ffff:198.51.101.1", "2001:db9::1", "::c000:209"} {
+		require.Equal(t, ErrSourceNotAllowed, reg.CheckSource(addr(ip)), ip)
+	}
+	require.Equal(t, ErrSourceNotAllowed, reg.CheckSource(nil))
+	require.Equal(t, mismatches+5, metrics.SourceMismatches.Value())
+}
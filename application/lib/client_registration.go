@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"golang.org/x/crypto/curve25519"
+)
+
+// ClientRegistration is a registration made the way a client makes one, for
+// the station's test and verification tools (cmd/conjure-client,
+// cmd/conjure-check).
+type ClientRegistration struct {
+	Keys    ConjureSharedKeys
+	Phantom net.IP
+	Wrapper []byte // marshaled C2SWrapper
+
+	// PhantomPort is the port to connect to the phantom on, derived as the
+	// station does, or 443 if the min transport does not derive ports.
+	PhantomPort uint16
+}
+
+// NewClientRegistration creates a min transport registration for covert with a
+// fresh client key exchanged with the station's public key: the station
+// recovers the shared secret from the representative, nothing secret is
+// sent.
+func NewClientRegistration(stationPub []byte, selector *PhantomIPSelector, generation uint, covert string, v6 bool) (*ClientRegistration, error) {
+	if len(stationPub) != 32 {
+		return nil, fmt.Errorf("bad station public key length %d", len(stationPub))
+	}
+	kp, err := ntor.NewKeypair(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate client key: %v", err)
+	}
+	secret, err := curve25519.X25519(kp.Private()[:], stationPub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+	keys, err := GenSharedKeys(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keys: %v", err)
+	}
+	phantom, err := selector.Select(keys.DarkDecoySeed[:], generation, v6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select phantom: %v", err)
+	}
+
+	transport := pb.TransportType_Min
+	source := pb.RegistrationSource_API
+	c2s := &pb.ClientToStation{
+		DecoyListGeneration: proto.Uint32(uint32(generation)),
+		CovertAddress:       proto.String(covert),
+		Transport:           &transport,
+		V4Support:           proto.Bool(!v6),
+		V6Support:           proto.Bool(v6),
+	}
+	// Over ZMQ the station learns the registration address from the
+	// wrapper, the API fills it in from the request.
+	regAddr := net.IPv4(127, 0, 0, 1).To16()
+	if v6 {
+		regAddr = net.IPv6loopback
+	}
+	wrapper, err := proto.Marshal(&pb.C2SWrapper{
+		RegistrationPayload: c2s,
+		RegistrationSource:  &source,
+		RegistrationAddress: regAddr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal registration: %v", err)
+	}
+	// The generated C2SWrapper predates the representative field, so it is
+	// appended to the marshaled wrapper by hand.
+	repr := kp.Representative()[:]
+	wrapper = append(wrapper, c2sWrapperRepresentativeField<<3|2, byte(len(repr)))
+	wrapper = append(wrapper, repr...)
+
+	port := selector.SelectPort(keys.DarkDecoySeed[:], transport)
+	if port == 0 {
+		port = DefaultPhantomPort
+	}
+
+	return &ClientRegistration{Keys: keys, Phantom: phantom, Wrapper: wrapper, PhantomPort: port}, nil
+}
@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+)
+
+// The station derives the same registration as the client from the wrapper.
+func TestRegistrationMatchesStation(t *testing.T) {
+	kp, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+	keyPath := filepath.Join(t.TempDir(), "station.key")
+	require.Nil(t, ioutil.WriteFile(keyPath, append(kp.Private()[:], kp.Public()[:]...), 0600))
+
+	selector, err := SubnetsFromTomlFile("test/phantom_subnets.toml")
+	require.Nil(t, err)
+	selector.Ports = map[pb.TransportType][]PortRange{pb.TransportType_Min: {{1024, 65535}}}
+	reg, err := NewClientRegistration(kp.Public()[:], selector, 1, "192.0.2.7:80", false)
+	require.Nil(t, err)
+
+	regManager := &RegistrationManager{PhantomSelector: selector}
+	regManager.StationKeys, err = LoadStationKeys([]string{keyPath})
+	require.Nil(t, err)
+
+	parsed := &pb.C2SWrapper{}
+	require.Nil(t, proto.Unmarshal(reg.Wrapper, parsed))
+	require.Empty(t, parsed.GetSharedSecret())
+	candidates, err := regManager.SharedSecretCandidates(parsed, reg.Wrapper)
+	require.Nil(t, err)
+	require.Len(t, candidates, 1)
+	parsed.SharedSecret = candidates[0].Secret
+
+	stationReg, err := regManager.NewRegistrationC2SWrapper(parsed, false)
+	require.Nil(t, err)
+	require.Equal(t, reg.Phantom.String(), stationReg.DarkDecoy.String())
+	require.Equal(t, reg.PhantomPort, stationReg.PhantomPort)
+	require.True(t, reg.PhantomPort >= 1024)
+	require.Equal(t, reg.Keys.ConnTag, stationReg.Keys.ConnTag)
+	require.Equal(t, "192.0.2.7:80", stationReg.Covert)
+	require.Equal(t, pb.TransportType_Min, stationReg.Transport)
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Ways connections that do not turn out to be a registered client are
+// closed, see ClientTCPConfig.FailureClose.
+const (
+	FailureCloseFIN    = "fin"
+	FailureCloseRST    = "rst"
+	FailureCloseRandom = "random"
+)
+
+// ClientTCPConfig controls the socket-level behavior of the station on the
+// client leg, i.e. of the connections accepted by its listeners, so that the
+// station's TCP stack does not stand out from the hosts it hides among. It
+// is the [client_tcp] section of the config.
+type ClientTCPConfig struct {
+	// How connections the station gives up on (no registration, no
+	// transport recognized, read errors) are closed: "fin" (the default),
+	// "rst" (SO_LINGER 0) or "random" (either, chosen per connection).
+	FailureClose string `toml:"failure_close"`
+
+	// SO_RCVBUF of the listeners, in bytes, inherited by the connections
+	// they accept. It bounds the advertised window and its scale. Zero keeps
+	// the system default.
+	ReceiveBuffer int `toml:"receive_buffer"`
+
+	// TCP_WINDOW_CLAMP of the listeners, in bytes, the largest window
+	// advertised to clients (linux only). Zero leaves it unclamped.
+	WindowClamp int `toml:"window_clamp"`
+
+	// Random delay before closing a failed connection, in milliseconds,
+	// uniformly between CloseDelayMin and CloseDelayMax. Zero closes at once.
+	CloseDelayMin int `toml:"close_delay_min"`
+	CloseDelayMax int `toml:"close_delay_max"`
+
+	// Connections accepted per second from each source subnet, the
+	// AcceptPrefixV4 (zero uses 24) or AcceptPrefixV6 (zero uses 64) bits of
+	// the client address, with bursts of up to AcceptBurst connections (zero
+	// uses the rate, at least 1). Connections over the limit are closed
+	// right after accept, before any registration lookup. Zero disables the
+	// limit.
+	AcceptRate     float64 `toml:"accept_rate"`
+	AcceptBurst    int     `toml:"accept_burst"`
+	AcceptPrefixV4 int     `toml:"accept_prefix_v4"`
+	AcceptPrefixV6 int     `toml:"accept_prefix_v6"`
+	acceptLimiter  *acceptLimiter
+}
+
+func (c *ClientTCPConfig) parse() error {
+	switch c.FailureClose {
+	case "":
+		c.FailureClose = FailureCloseFIN
+	case FailureCloseFIN, FailureCloseRST, FailureCloseRandom:
+	default:
+		return fmt.Errorf("unknown client_tcp failure_close %q", c.FailureClose)
+	}
+	if c.ReceiveBuffer < 0 || c.WindowClamp < 0 {
+		return fmt.Errorf("client_tcp receive_buffer and window_clamp must not be negative")
+	}
+	if c.CloseDelayMin < 0 || c.CloseDelayMax < c.CloseDelayMin {
+		return fmt.Errorf("client_tcp close delay must satisfy 0 <= close_delay_min <= close_delay_max")
+	}
+	return c.parseAcceptLimit()
+}
+
+// Control sets the configured socket options on a listener before it binds,
+// it is the net.ListenConfig Control hook of ListenAll.
+func (c *ClientTCPConfig) Control(network, address string, rc syscall.RawConn) error {
+	if c.ReceiveBuffer == 0 && c.WindowClamp == 0 {
+		return nil
+	}
+	var sockErr error
+	err := rc.Control(func(fd uintptr) {
+		if c.ReceiveBuffer > 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, c.ReceiveBuffer)
+			if sockErr != nil {
+				sockErr = fmt.Errorf("failed to set SO_RCVBUF: %v", sockErr)
+				return
+			}
+		}
+		if c.WindowClamp > 0 {
+			sockErr = setWindowClamp(fd, c.WindowClamp)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// CloseFailed closes conn, a connection the station gave up on, after the
+// configured delay and with the configured FIN or RST.
+func (c *ClientTCPConfig) CloseFailed(conn *net.TCPConn) error {
+	min := time.Duration(c.CloseDelayMin) * time.Millisecond
+	max := time.Duration(c.CloseDelayMax) * time.Millisecond
+	if max > 0 {
+		time.Sleep(Jitter(min, max))
+	}
+
+	rst := c.FailureClose == FailureCloseRST
+	if c.FailureClose == FailureCloseRandom {
+		jitterRand.Lock()
+		rst = jitterRand.Intn(2) == 0
+		jitterRand.Unlock()
+	}
+	if rst {
+		// Discards anything unsent and resets the connection on Close.
+		conn.SetLinger(0)
+	}
+	return conn.Close()
+}
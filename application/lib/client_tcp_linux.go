@@ -0,0 +1,13 @@
+package lib
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setWindowClamp(fd uintptr, clamp int) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_WINDOW_CLAMP, clamp); err != nil {
+		return fmt.Errorf("failed to set TCP_WINDOW_CLAMP: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package lib
+
+import "fmt"
+
+func setWindowClamp(fd uintptr, clamp int) error {
+	return fmt.Errorf("client_tcp window_clamp is only supported on linux")
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTCPConfigParse(t *testing.T) {
+	var c ClientTCPConfig
+	require.Nil(t, c.parse())
+	require.Equal(t, FailureCloseFIN, c.FailureClose)
+
+	for _, bad := range []ClientTCPConfig{
+		{FailureClose: "drop"},
+		{ReceiveBuffer: -1},
+		{CloseDelayMin: 20, CloseDelayMax: 10},
+	} {
+		require.NotNil(t, bad.parse(), "%+v", bad)
+	}
+}
+
+// acceptClientTCP returns both ends of a connection accepted by a listener
+// opened with the Control hook of c.
+func acceptClientTCP(t *testing.T, c *ClientTCPConfig) (*net.TCPConn, net.Conn) {
+	listeners, err := ListenAll([]string{"127.0.0.1:0"}, redirectResolver{}, c.Control)
+	require.Nil(t, err)
+	defer CloseAll(listeners)
+
+	client, err := net.Dial("tcp", listeners[0].Addr().String())
+	require.Nil(t, err)
+	server, err := listeners[0].AcceptTCP()
+	require.Nil(t, err)
+	return server, client
+}
+
+func TestClientTCPReceiveBuffer(t *testing.T) {
+	c := &ClientTCPConfig{ReceiveBuffer: 8192}
+	require.Nil(t, c.parse())
+	server, client := acceptClientTCP(t, c)
+	defer server.Close()
+	defer client.Close()
+
+	// The accepted connection inherits the listener's buffer (linux doubles
+	// the value set to account for its bookkeeping).
+	rc, err := server.SyscallConn()
+	require.Nil(t, err)
+	var rcvbuf int
+	require.Nil(t, rc.Control(func(fd uintptr) {
+		rcvbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}))
+	require.Nil(t, err)
+	require.True(t, rcvbuf >= 8192 && rcvbuf <= 2*8192, "SO_RCVBUF %d", rcvbuf)
+}
+
+func TestClientTCPCloseFailed(t *testing.T) {
+	for _, c := range []struct {
+		close string
+		reset bool
+	}{
+		{FailureCloseFIN, false},
+		{FailureCloseRST, true},
+	} {
+		conf := &ClientTCPConfig{FailureClose: c.close, CloseDelayMin: 50, CloseDelayMax: 60}
+		require.Nil(t, conf.parse())
+		server, client := acceptClientTCP(t, conf)
+
+		start := time.Now()
+		require.Nil(t, conf.CloseFailed(server))
+		require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := client.Read(make([]byte, 1))
+		if c.reset {
+			require.True(t, errors.Is(err, syscall.ECONNRESET), "%s close: %v", c.close, err)
+		} else {
+			require.Equal(t, io.EOF, err, c.close)
+		}
+		client.Close()
+	}
+}
@@ -7,11 +7,39 @@ import (
 	"regexp"
 
 	"github.com/BurntSushi/toml"
+	"github.com/refraction-networking/conjure/application/metrics"
 )
 
 // Config - Station golang configuration struct
 type Config struct {
 	ZMQConfig
+	ProxyConfig
+
+	// Identity of the station in the metrics, events and records it exports,
+	// the [station] section. It is only read at startup.
+	Station StationIdentity `toml:"station"`
+
+	// Addresses ("[host]:port") the station accepts redirected phantom
+	// connections on. Empty listens on :41245 only.
+	ListenAddrs []string `toml:"listen_addrs"`
+
+	// How connections to phantoms are diverted to the listeners, which
+	// determines how their original destination is found: "redirect" (iptables
+	// REDIRECT/DNAT, the default), "tproxy" or "pf" (a PF rdr rule, macOS
+	// only and meant for development). "proxy_header" takes the destination
+	// from a PROXY protocol header sent by the client, for testing only.
+	OriginalDstMode string `toml:"original_dst_mode"`
+
+	// Socket-level behavior on connections accepted by the listeners, the
+	// [client_tcp] section.
+	ClientTCP ClientTCPConfig `toml:"client_tcp"`
+
+	// The prefix transport, the [prefix_transport] section.
+	PrefixTransport PrefixTransportConfig `toml:"prefix_transport"`
+
+	// Names of the ingestors registrations are received from, see Ingestor.
+	// Empty uses the default of ["zmq"], the ZMQ proxy.
+	Ingestors []string `toml:"ingestors"`
 
 	// Bool to enable or disable sharing of registrations over API when received over decoy registrar
 	EnableShareOverAPI bool `toml:"enable_share_over_api"`
@@ -31,11 +59,258 @@ type Config struct {
 	CovertBlocklistDomains []string `toml:"covert_blocklist_domains"`
 	covertBlocklistDomains []*regexp.Regexp
 
+	// Glob patterns of covert policy files, TOML files of allow and deny
+	// lists for covert addresses merged with each other, see CovertPolicy.
+	// They are reloaded on SIGHUP.
+	CovertPolicyFiles []string `toml:"covert_policy_files"`
+	covertPolicy      *CovertPolicy
+
 	// Local list of disallowed subnets patterns for phantom addresses.
 	PhantomBlocklist []string `toml:"phantom_blocklist"`
 	phantomBlocklist []*net.IPNet
+
+	// Phantom subnets, as given in the phantom subnet file, drained at
+	// startup: registrations and connections to phantoms in them are refused.
+	// Subnets are also drained and served again on the management endpoint,
+	// see PhantomDrain.
+	DrainedPhantomSubnets []string `toml:"drained_phantom_subnets"`
+
+	// Paths to the station Curve25519 private keys used to derive shared
+	// secrets from client representatives, in priority order. Listing more
+	// than one allows rotating keys. Empty disables station side derivation.
+	StationPrivkeyPaths []string `toml:"station_privkey_paths"`
+
+	// Path to a lock file used to guarantee that only one station runs on this
+	// host at a time. Empty disables the check.
+	LockFile string `toml:"lock_file"`
+
+	// Interval in seconds between sweeps of the session reaper. Zero disables it.
+	SessionReapInterval int `toml:"session_reap_interval"`
+
+	// Sessions with no traffic for longer than this many seconds are
+	// force-closed by the reaper. Zero disables the idle limit.
+	SessionIdleTimeout int `toml:"session_idle_timeout"`
+
+	// Sessions open for longer than this many seconds are force-closed by the
+	// reaper regardless of activity. Zero disables the lifetime limit.
+	SessionMaxLifetime int `toml:"session_max_lifetime"`
+
+	// Increasing upper bounds of the buckets of the histograms of ended
+	// sessions' durations, in seconds, and sizes, in bytes proxied in both
+	// directions together. Empty keeps the log-scaled defaults.
+	SessionDurationBuckets []float64 `toml:"session_duration_buckets"`
+	SessionBytesBuckets    []float64 `toml:"session_bytes_buckets"`
+
+	// Seconds to wait on SIGINT or SIGTERM for active sessions to finish,
+	// after the listeners are closed and while /healthz reports draining.
+	// Zero exits as soon as the listeners are closed.
+	ShutdownGracePeriod int `toml:"shutdown_grace_period"`
+
+	// Log one in every ConnectLogSample connections accepted by the
+	// listeners at info level, the others at debug level. Zero or one logs
+	// every connection at info level, -1 none. Connections are counted in
+	// the stats all the same.
+	ConnectLogSample int `toml:"connect_log_sample"`
+	connLogSampler   *ConnLogSampler
+
+	// Seconds between heartbeat log lines summarizing registrations,
+	// connections, bytes proxied and memory use. Zero disables the heartbeat.
+	StatsHeartbeatInterval int `toml:"stats_heartbeat_interval"`
+
+	// Where the periodic stats reports go: "log" (the default) for log
+	// lines, "json" for JSON lines on stdout, or "metrics" for nowhere,
+	// leaving the stats to the metrics endpoint.
+	StatsOutput string `toml:"stats_output"`
+
+	// Seconds between the periodic reports of each stats component, by
+	// name: "station" (5 by default) and "heartbeat"
+	// (stats_heartbeat_interval by default). Zero quiets a component
+	// without stopping its collection.
+	StatsIntervals map[string]int `toml:"stats_intervals"`
+
+	// Debugging aid: the heartbeat also reports the heap bytes in use per
+	// active registration and the number of distinct coverts and masks held.
+	StatsRegistrationMemory bool `toml:"stats_registration_memory"`
+
+	// Path of a Unix domain socket on which registration and connection
+	// events are published as newline delimited JSON. Empty disables it.
+	EventSocket string `toml:"event_socket"`
+
+	// Path of a file the same events, plus rejected registrations, admin
+	// requests and config loads, are appended to as JSON lines. Empty
+	// disables it.
+	EventLog string `toml:"event_log"`
+
+	// Megabytes the event log may grow to before it is rotated. Zero never
+	// rotates.
+	EventLogMaxSize int `toml:"event_log_max_size"`
+
+	// Number of rotated event logs kept. Zero uses the default of 5.
+	EventLogKeep int `toml:"event_log_keep"`
+
+	// Milliseconds to wait for a phantom to answer the liveness probes before
+	// it is considered not live. Zero uses the default of 500.
+	LivenessTimeout int `toml:"liveness_timeout"`
+
+	// Maximum number of phantoms liveness probed at once, further checks
+	// queue. Zero uses the default of 64.
+	LivenessConcurrency int `toml:"liveness_concurrency"`
+
+	// Maximum number of liveness checks of pending registrations waiting for
+	// a probe slot, registrations beyond it are dropped. Zero uses the
+	// default of 4096.
+	LivenessQueue int `toml:"liveness_queue"`
+
+	// Number of phantom liveness results to cache. Zero disables the cache.
+	LivenessCacheSize int `toml:"liveness_cache_size"`
+
+	// Seconds to cache live and not live results for. Zero disables caching
+	// that kind of result.
+	LivenessCacheLiveTTL    int `toml:"liveness_cache_live_ttl"`
+	LivenessCacheNotLiveTTL int `toml:"liveness_cache_not_live_ttl"`
+
+	// Match connections to registrations whose liveness check is still
+	// running.
+	ServePendingRegistrations bool `toml:"serve_pending_registrations"`
+
+	// Seconds a registration may wait for its liveness check. Registrations
+	// still pending after this are no longer served and are dropped when the
+	// check completes. Zero uses the default of 10.
+	LivenessPendingTimeout int `toml:"liveness_pending_timeout"`
+
+	// What to do with registrations whose phantom is live: "reject" (the
+	// default), "log-only" or "divert".
+	LivePhantomPolicy string `toml:"live_phantom_policy"`
+
+	// Expire every other registration with a phantom once a connection finds
+	// it became live after registering, rather than only applying the live
+	// phantom policy to the registration connected to. That one is kept,
+	// tagged with the policy, unless the policy rejects it.
+	ExpireLivePhantoms bool `toml:"expire_live_phantoms"`
+
+	// Park connections to a phantom without any registration, reading
+	// nothing from them, for up to ParkTimeout milliseconds (zero uses the
+	// default of 2000) in case their registration is still on its way, and
+	// handle them normally if one arrives. At most ParkMax connections (zero
+	// uses the default of 1024) are parked at once, others are handled as
+	// missed at once.
+	ParkConnections bool `toml:"park_connections"`
+	ParkTimeout     int  `toml:"park_timeout"`
+	ParkMax         int  `toml:"park_max"`
+
+	// Only log (and count) connections to a phantom port other than the one
+	// their registration derived from its seed instead of treating them as
+	// not matching the registration, for rolling out derived ports.
+	PhantomPortWarnOnly bool `toml:"phantom_port_warn_only"`
+
+	// Skip probing phantoms in subnets that had this many consecutive not
+	// live results, for LivenessSubnetSkip seconds, still probing one in
+	// every LivenessSubnetResample skipped phantoms. A zero threshold
+	// disables subnet learning.
+	LivenessSubnetThreshold int `toml:"liveness_subnet_threshold"`
+	LivenessSubnetSkip      int `toml:"liveness_subnet_skip"`
+	LivenessSubnetResample  int `toml:"liveness_subnet_resample"`
+
+	// Address (host:port) of the management HTTP endpoint, the only one that
+	// serves station internals: status pages under /status/, metrics,
+	// /healthz and pprof. Empty uses AdminAddr, its old name, or else the
+	// default of 127.0.0.1:41246. The station refuses to start with a
+	// non-loopback address unless run with -allow-public-management.
+	ManagementListenAddr string `toml:"management_listen_addr"`
+	AdminAddr            string `toml:"admin_addr"`
+
+	// Number of experiment buckets registrations are split into by their
+	// shared secret. Zero or one puts every registration in bucket 0.
+	ExperimentBuckets int `toml:"experiment_buckets"`
+
+	// Address (host:port) of the HTTPS endpoint accepting registrations
+	// POSTed directly to the station, served with the given certificate and
+	// key files. Empty disables it. Request bodies larger than
+	// RegistrationAPIMaxBody bytes are rejected, zero uses the default of
+	// 16384.
+	RegistrationAPIAddr    string `toml:"registration_api_addr"`
+	RegistrationAPICert    string `toml:"registration_api_cert"`
+	RegistrationAPIKey     string `toml:"registration_api_key"`
+	RegistrationAPIMaxBody int64  `toml:"registration_api_max_body"`
+
+	// Address (host:port) of a StatsD (DogStatsD) server to send metrics to
+	// every StatsdFlushInterval seconds, zero uses the default of 10. Metric
+	// names are prefixed with StatsdPrefix and tagged with StatsdTags
+	// ("key:value"). Empty disables StatsD.
+	StatsdAddr          string   `toml:"statsd_addr"`
+	StatsdPrefix        string   `toml:"statsd_prefix"`
+	StatsdTags          []string `toml:"statsd_tags"`
+	StatsdFlushInterval int      `toml:"statsd_flush_interval"`
+
+	// Address (host:port) of an IPFIX collector to send a flow record to
+	// for every completed session, over UDP. Empty disables IPFIX export.
+	// Sessions open for longer than IPFIXActiveTimeout seconds are also
+	// exported every IPFIXActiveTimeout seconds, zero disables that.
+	// IPFIXEnterpriseID is the enterprise number of the transport field, zero
+	// uses the documentation number 32473. Client addresses are only
+	// exported if IPFIXClientAddresses is set.
+	IPFIXCollector         string `toml:"ipfix_collector"`
+	IPFIXObservationDomain uint32 `toml:"ipfix_observation_domain"`
+	IPFIXActiveTimeout     int    `toml:"ipfix_active_timeout"`
+	IPFIXEnterpriseID      uint32 `toml:"ipfix_enterprise_id"`
+	IPFIXClientAddresses   bool   `toml:"ipfix_client_addresses"`
+
+	// URL of a Slack compatible incoming webhook that alerts are POSTed to
+	// when they fire and when they resolve. Empty disables alerting.
+	// AlertNoRegistrations is the number of seconds without registrations
+	// that fires an alert, zero disables it. AlertDialFailureRatio is the
+	// ratio of failed covert dials, over windows of AlertDialFailureWindow
+	// dials (zero uses the default of 1000), above which an alert fires, zero
+	// disables it. An alert is notified at most once every AlertRateLimit
+	// seconds, zero uses the default of 300.
+	AlertWebhook           string  `toml:"alert_webhook"`
+	AlertNoRegistrations   int     `toml:"alert_no_registrations"`
+	AlertDialFailureRatio  float64 `toml:"alert_dial_failure_ratio"`
+	AlertDialFailureWindow int64   `toml:"alert_dial_failure_window"`
+	AlertRateLimit         int     `toml:"alert_rate_limit"`
+
+	// OTLP/HTTP endpoint (e.g. "http://localhost:4318/v1/traces") that
+	// traces of registration ingest and proxy sessions are exported to, JSON
+	// encoded. TracingSampleRatio is the fraction of them traced, zero uses
+	// the default of 1. Empty disables tracing.
+	TracingEndpoint    string  `toml:"tracing_endpoint"`
+	TracingSampleRatio float64 `toml:"tracing_sample_ratio"`
+
+	// Key shared with the stations this one transfers registrations to or
+	// from, a LoadSecret uri of at least 32 bytes. Empty disables transfers.
+	// With TransferListenAddr ("unix:/path" or "host:port") set the station
+	// imports the registrations other stations transfer to it there; it
+	// exports its own when POSTed /registrations/export?to=<addr> on the
+	// management endpoint.
+	TransferKeyPath    string `toml:"transfer_key_path"`
+	TransferListenAddr string `toml:"transfer_listen_addr"`
+	transferKey        []byte
 }
 
+// defaultStatsdFlushInterval is the StatsdFlushInterval, in seconds, used
+// when none is configured.
+const defaultStatsdFlushInterval = 10
+
+// defaultRegistrationAPIMaxBody is the RegistrationAPIMaxBody, in bytes, used
+// when none is configured.
+const defaultRegistrationAPIMaxBody = 16384
+
+// defaultAlertDialFailureWindow is the AlertDialFailureWindow, in covert
+// dials, used when none is configured.
+const defaultAlertDialFailureWindow = 1000
+
+// defaultAlertRateLimit is the AlertRateLimit, in seconds, used when none is
+// configured.
+const defaultAlertRateLimit = 300
+
+// defaultManagementListenAddr is the ManagementListenAddr used when none is
+// configured.
+const defaultManagementListenAddr = "127.0.0.1:41246"
+
+// defaultLivenessPendingTimeout is the LivenessPendingTimeout, in seconds,
+// used when none is configured.
+const defaultLivenessPendingTimeout = 10
+
 func ParseConfig() (*Config, error) {
 	var c Config
 	_, err := toml.DecodeFile(os.Getenv("CJ_STATION_CONFIG"), &c)
@@ -45,6 +320,179 @@ func ParseConfig() (*Config, error) {
 
 	c.parseBlocklists()
 
+	err = c.parseCovertPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.ZMQConfig.parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.Station.parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.ClientTCP.parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.PrefixTransport.parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertTransport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertFamilies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertResolver()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseSessionRateLimits()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertPrewarm()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertReuse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertMinClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseMux()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertDialsPerIP()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertWarmup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertSelfAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertTLS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertPreambles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertFallbacks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertResponseLimits()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseCovertEcho()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseSessionResume()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseTransfer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseSessionHistograms()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseStatsReporting()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseConnectLogSample()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = c.parseConnParking()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	c.LivePhantomPolicy, err = parseLivePhantomPolicy(c.LivePhantomPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	if len(c.Ingestors) == 0 {
+		c.Ingestors = []string{metrics.ChannelZMQ}
+	}
+
+	if c.LivenessPendingTimeout <= 0 {
+		c.LivenessPendingTimeout = defaultLivenessPendingTimeout
+	}
+
+	if c.RegistrationAPIAddr != "" && (c.RegistrationAPICert == "" || c.RegistrationAPIKey == "") {
+		return nil, fmt.Errorf("failed to load config: registration_api_addr requires registration_api_cert and registration_api_key")
+	}
+	if c.RegistrationAPIMaxBody <= 0 {
+		c.RegistrationAPIMaxBody = defaultRegistrationAPIMaxBody
+	}
+	if c.StatsdFlushInterval <= 0 {
+		c.StatsdFlushInterval = defaultStatsdFlushInterval
+	}
+	if c.AlertDialFailureWindow <= 0 {
+		c.AlertDialFailureWindow = defaultAlertDialFailureWindow
+	}
+	if c.AlertRateLimit <= 0 {
+		c.AlertRateLimit = defaultAlertRateLimit
+	}
+	if c.TracingSampleRatio == 0 {
+		c.TracingSampleRatio = 1
+	}
+	if c.ManagementListenAddr == "" {
+		c.ManagementListenAddr = c.AdminAddr
+	}
+	if c.ManagementListenAddr == "" {
+		c.ManagementListenAddr = defaultManagementListenAddr
+	}
+
 	return &c, nil
 }
 
@@ -82,6 +530,10 @@ func (c *Config) IsBlocklisted(urlStr string) bool {
 		return true
 	}
 
+	if c.covertPolicy.denies(host) {
+		return true
+	}
+
 	if addr := net.ParseIP(host); addr != nil {
 		for _, net := range c.covertBlocklistSubnets {
 			if net.Contains(addr) {
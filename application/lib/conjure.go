@@ -3,7 +3,10 @@ package lib
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 
 	"gitlab.com/yawning/obfs4.git/common/ntor"
 	"golang.org/x/crypto/curve25519"
@@ -23,7 +26,7 @@ func generateObfs4Keys(rand io.Reader) (Obfs4Keys, error) {
 		NodeID:     new(ntor.NodeID),
 	}
 
-	_, err := rand.Read(keys.PrivateKey[:])
+	_, err := io.ReadFull(rand, keys.PrivateKey[:])
 	if err != nil {
 		return keys, err
 	}
@@ -38,48 +41,96 @@ func generateObfs4Keys(rand io.Reader) (Obfs4Keys, error) {
 	}
 	copy(keys.PublicKey[:], pub)
 
-	_, err = rand.Read(keys.NodeID[:])
+	_, err = io.ReadFull(rand, keys.NodeID[:])
 	return keys, err
 }
 
+// conjureHKDFSalt is the HKDF salt used by the gotapdance client when expanding
+// the registration shared secret (see tapdance/conjure.go generateSharedKeys).
+const conjureHKDFSalt = "conjureconjureconjureconjure"
+
+// Lengths of the values read, in order, from the shared secret HKDF stream.
+// The order and lengths MUST match the client or every transport handshake
+// derived from these keys will fail.
+const (
+	fspKeyLen        = 16
+	fspIvLen         = 12
+	vspKeyLen        = 16
+	vspIvLen         = 12
+	masterSecretLen  = 48
+	darkDecoySeedLen = 16
+)
+
+// ConjureSharedKeys holds every value the station derives from a registration
+// shared secret. The keys are held in buffers owned by the struct so that Zero
+// can wipe them, and the struct refuses to be printed or JSON encoded so key
+// material cannot end up in logs.
 type ConjureSharedKeys struct {
-	SharedSecret                                              []byte
-	FspKey, FspIv, VspKey, VspIv, MasterSecret, DarkDecoySeed []byte
-	Obfs4Keys                                                 Obfs4Keys
+	// SharedSecret is the raw secret; it is also the HMAC key used to build
+	// connection tags (see ConjureHMAC).
+	SharedSecret []byte
+
+	// Keys and IVs for the forward and variable size payloads.
+	FspKey [fspKeyLen]byte
+	FspIv  [fspIvLen]byte
+	VspKey [vspKeyLen]byte
+	VspIv  [vspIvLen]byte
+
+	// MasterSecret is used to forge TLS sessions in the 3-way proxy.
+	MasterSecret [masterSecretLen]byte
+
+	// DarkDecoySeed seeds phantom address selection.
+	DarkDecoySeed [darkDecoySeedLen]byte
+
+	// ConnTag is the tag the client sends at the start of a min transport
+	// connection, HMAC(SharedSecret, ConnTagHMACString). It is computed once
+	// here rather than for every candidate registration on every connection.
+	ConnTag [ConnTagLen]byte
+
+	// Obfs4Keys holds the obfs4 server identity the client expects, read from
+	// the HKDF stream after all of the fields above.
+	Obfs4Keys Obfs4Keys
+
+	// ID identifies the registration in logs, events, traces and transfers,
+	// see DecoyRegistration.IDString. It is exported under regIDLabel so that
+	// it gives nothing of the shared secret away, and Zero leaves it.
+	ID [regIDLen / 2]byte
+
+	// zeroed is set by Zero so that no further keys are exported.
+	zeroed bool
 }
 
+// GenSharedKeys derives the station side keys for a registration from its
+// shared secret. This is HKDF-SHA256 with salt conjureHKDFSalt and empty info,
+// read sequentially as:
+//
+//	FspKey(16) | FspIv(12) | VspKey(16) | VspIv(12) | MasterSecret(48) |
+//	DarkDecoySeed(16) | obfs4 private key(32) | obfs4 node ID(20)
+//
+// which is the same stream the gotapdance client reads from.
 func GenSharedKeys(sharedSecret []byte) (ConjureSharedKeys, error) {
-	tdHkdf := hkdf.New(sha256.New, sharedSecret, []byte("conjureconjureconjureconjure"), nil)
+	tdHkdf := hkdf.New(sha256.New, sharedSecret, []byte(conjureHKDFSalt), nil)
 	keys := ConjureSharedKeys{
-		SharedSecret:  sharedSecret,
-		FspKey:        make([]byte, 16),
-		FspIv:         make([]byte, 12),
-		VspKey:        make([]byte, 16),
-		VspIv:         make([]byte, 12),
-		MasterSecret:  make([]byte, 48),
-		DarkDecoySeed: make([]byte, 16),
+		// Copy so that zeroing these keys never touches a buffer shared with
+		// the caller (e.g. the v4 and v6 registrations from one message).
+		SharedSecret: append([]byte(nil), sharedSecret...),
 	}
+	copy(keys.ConnTag[:], conjureHMAC(sharedSecret, ConnTagHMACString))
 
-	if _, err := tdHkdf.Read(keys.FspKey); err != nil {
-		return keys, err
-	}
-	if _, err := tdHkdf.Read(keys.FspIv); err != nil {
-		return keys, err
-	}
-	if _, err := tdHkdf.Read(keys.VspKey); err != nil {
-		return keys, err
-	}
-	if _, err := tdHkdf.Read(keys.VspIv); err != nil {
-		return keys, err
-	}
-	if _, err := tdHkdf.Read(keys.MasterSecret); err != nil {
-		return keys, err
-	}
-	if _, err := tdHkdf.Read(keys.DarkDecoySeed); err != nil {
-		return keys, err
+	for _, out := range [][]byte{keys.FspKey[:], keys.FspIv[:], keys.VspKey[:], keys.VspIv[:], keys.MasterSecret[:], keys.DarkDecoySeed[:]} {
+		if _, err := io.ReadFull(tdHkdf, out); err != nil {
+			return keys, err
+		}
 	}
+
 	var err error
 	keys.Obfs4Keys, err = generateObfs4Keys(tdHkdf)
+	if err != nil {
+		return keys, err
+	}
+
+	id, err := keys.ExportKeyingMaterial(regIDLabel, nil, len(keys.ID))
+	copy(keys.ID[:], id)
 	return keys, err
 }
 
@@ -93,3 +144,89 @@ func conjureHMAC(key []byte, str string) []byte {
 func (k *ConjureSharedKeys) ConjureHMAC(str string) []byte {
 	return conjureHMAC(k.SharedSecret, str)
 }
+
+// Zero overwrites all key material. The keys must not be used afterwards.
+func (k *ConjureSharedKeys) Zero() {
+	if k == nil {
+		return
+	}
+	zero(k.SharedSecret)
+	zero(k.FspKey[:])
+	zero(k.FspIv[:])
+	zero(k.VspKey[:])
+	zero(k.VspIv[:])
+	zero(k.MasterSecret[:])
+	zero(k.DarkDecoySeed[:])
+	zero(k.ConnTag[:])
+	if k.Obfs4Keys.PrivateKey != nil {
+		zero(k.Obfs4Keys.PrivateKey[:])
+	}
+	k.zeroed = true
+}
+
+// regIDLabel is the ExportKeyingMaterial label of registration IDs.
+const regIDLabel = "conjure registration id"
+
+// ekmInfoPrefix starts the HKDF info of every exported key so that exported
+// keys can never collide with the GenSharedKeys stream, which has empty info.
+const ekmInfoPrefix = "conjure-ekm"
+
+// maxEKMLen is the most output HKDF-SHA256 can produce from one expansion.
+const maxEKMLen = 255 * sha256.Size
+
+// ErrKeysZeroed is returned when exporting from keys that have been wiped.
+var ErrKeysZeroed = errors.New("shared keys have been zeroed")
+
+// ExportKeyingMaterial derives length bytes bound to the registration shared
+// secret, a label naming the use and a caller supplied context, e.g. a
+// per-session nonce and rekey counter for a transport that rekeys long lived
+// sessions. This is
+//
+//	HKDF-SHA256(salt: conjureHKDFSalt, secret: SharedSecret,
+//	            info: "conjure-ekm" | 0 | label | 0 | uint16(len(context)) | context)
+//
+// and clients must derive the same value; see TestExportKeyingMaterialVectors.
+// Different labels or contexts give independent keys. The label must be non
+// empty and must not contain a zero byte.
+func (k *ConjureSharedKeys) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if k == nil || k.zeroed {
+		return nil, ErrKeysZeroed
+	}
+	if label == "" || strings.IndexByte(label, 0) >= 0 {
+		return nil, fmt.Errorf("invalid keying material label %q", label)
+	}
+	if len(context) > 0xffff {
+		return nil, fmt.Errorf("keying material context too long: %d bytes", len(context))
+	}
+	if length <= 0 || length > maxEKMLen {
+		return nil, fmt.Errorf("invalid keying material length %d", length)
+	}
+
+	info := make([]byte, 0, len(ekmInfoPrefix)+len(label)+4+len(context))
+	info = append(info, ekmInfoPrefix...)
+	info = append(info, 0)
+	info = append(info, label...)
+	info = append(info, 0, byte(len(context)>>8), byte(len(context)))
+	info = append(info, context...)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.SharedSecret, []byte(conjureHKDFSalt), info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// String keeps key material out of anything formatted with %v or %s.
+func (k ConjureSharedKeys) String() string { return "[redacted]" }
+
+// GoString keeps key material out of anything formatted with %#v.
+func (k ConjureSharedKeys) GoString() string { return "[redacted]" }
+
+// MarshalJSON keeps key material out of any JSON encoded struct.
+func (k ConjureSharedKeys) MarshalJSON() ([]byte, error) { return []byte(`"[redacted]"`), nil }
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Vectors generated with the gotapdance client library, v1.2.0: the shared
+// keys from tapdance generateSharedKeys (against a fixed station public key),
+// the obfs4 keys from its Obfs4Keys and minTag from
+// conjureHMAC(SharedSecret, "MinTrasportHMACString").
+var sharedKeyVectors = []struct {
+	secret, fspKey, fspIv, vspKey, vspIv, masterSecret, seed string
+	obfs4Private, obfs4Public, obfs4NodeID, minTag           string
+}{
+	{
+		secret:       "15e8e973a73b143de38ff7c74718af3675586d117e271505469a50e4c0763d05",
+		fspKey:       "d07ad6aa608bbd4f9d54b78d2905385a",
+		fspIv:        "23ce1bf0eac860727b02f50e",
+		vspKey:       "1084aff2a85d41b518826af41734aac7",
+		vspIv:        "e9684c297d5c2f6a18951fd2",
+		masterSecret: "47cda8d8ab883bf12532475643e6cb6d40fcfdb3fbc7c0cb6dd278c665fb3a579472d3766d2497e1217b1ad916a4e1c4",
+		seed:         "05642f2773671dfd7b56b319eb14550f",
+		obfs4Private: "2822c679d6a8be7b23b45bc8c916abdbfdea8a739a1c7d15480d7dd1da43de51",
+		obfs4Public:  "45ef9d8419f8e2a54145868c73d619270fbe8d32e63850490866fc59a3470e64",
+		obfs4NodeID:  "34e03679cbfbdc1acdbb958f72792d7e592878be",
+		minTag:       "d0eccf3ed17ab825e3cbe019900d163355b3bdfab75528849748e5891acba532",
+	},
+	{
+		secret:       "4efa50c09be8eade6b422bd30f1815b433b4048a6179ddea073f79d025b9995a",
+		fspKey:       "441a3525997a4e0213914f9d2bd21085",
+		fspIv:        "e73006427be2d02bacdb95d2",
+		vspKey:       "e486b1995e096f162ba7805cac389eb7",
+		vspIv:        "6d95c3c22b10d99c82be0352",
+		masterSecret: "ebc1d8ad6574f06d9af94aa438d1e397b947095c32d818478dd0ef7e09bb242a0519f534352069e5810405f910295b7d",
+		seed:         "ba9a371e8275f8422a2da5037502a40d",
+		obfs4Private: "984e2ae8e222b34e8f8ebb96deed5a4b1e34ae819d2e43051441444d69508556",
+		obfs4Public:  "658fe7b97d0c5f1f14e826bed513368a26da3756d723dc462163ac0138626d42",
+		obfs4NodeID:  "1dd023683c5ce5a7a67ac00cf509210d9084e09a",
+		minTag:       "eb909fd6cbf6324990ef7ef8a17ec8ec6249434db07b40b98cc45ca3f40d0ede",
+	},
+}
+
+func TestGenSharedKeysVectors(t *testing.T) {
+	for _, v := range sharedKeyVectors {
+		secret, err := hex.DecodeString(v.secret)
+		require.Nil(t, err)
+
+		keys, err := GenSharedKeys(secret)
+		require.Nil(t, err)
+
+		require.Equal(t, v.fspKey, hex.EncodeToString(keys.FspKey[:]))
+		require.Equal(t, v.fspIv, hex.EncodeToString(keys.FspIv[:]))
+		require.Equal(t, v.vspKey, hex.EncodeToString(keys.VspKey[:]))
+		require.Equal(t, v.vspIv, hex.EncodeToString(keys.VspIv[:]))
+		require.Equal(t, v.masterSecret, hex.EncodeToString(keys.MasterSecret[:]))
+		require.Equal(t, v.seed, hex.EncodeToString(keys.DarkDecoySeed[:]))
+		require.Equal(t, v.obfs4Private, keys.Obfs4Keys.PrivateKey.Hex())
+		require.Equal(t, v.obfs4Public, keys.Obfs4Keys.PublicKey.Hex())
+		require.Equal(t, v.obfs4NodeID, keys.Obfs4Keys.NodeID.Hex())
+		require.Equal(t, v.minTag, hex.EncodeToString(keys.ConjureHMAC("MinTrasportHMACString")))
+		require.Equal(t, v.minTag, hex.EncodeToString(keys.ConnTag[:]))
+	}
+}
+
+// Vectors computed independently of this package with HMAC-SHA256 from the
+// Python standard library, following the construction documented on
+// ExportKeyingMaterial; the client library (v1.2.0) has no exporter to generate
+// them with.
+func TestExportKeyingMaterialVectors(t *testing.T) {
+	vectors := []struct {
+		secret, label, context string
+		length                 int
+		ekm                    string
+	}{
+		{sharedKeyVectors[0].secret, "obfs4 rekey", "0001020304050607", 32,
+			"c196993cb6059eac435a1ac988dce480cbbb50525d0bea738386eea5d49e0f82"},
+		{sharedKeyVectors[0].secret, "obfs4 rekey", "", 32,
+			"ebd45e29e8497381a92a09093cdec1391fa8921fab737a3383d1a81c0339afe0"},
+		{sharedKeyVectors[1].secret, "test", hex.EncodeToString([]byte("ctx")), 48,
+			"b817c7a192ac7e09babe24380b32b37aa0a7e088df1867b611fb52e4b63b83602977d8400c41701c9b738e7675c67281"},
+	}
+	for _, v := range vectors {
+		secret, _ := hex.DecodeString(v.secret)
+		context, _ := hex.DecodeString(v.context)
+		keys, err := GenSharedKeys(secret)
+		require.Nil(t, err)
+
+		ekm, err := keys.ExportKeyingMaterial(v.label, context, v.length)
+		require.Nil(t, err)
+		require.Equal(t, v.ekm, hex.EncodeToString(ekm))
+	}
+
+	keys, err := GenSharedKeys(make([]byte, 32))
+	require.Nil(t, err)
+	for _, bad := range []struct {
+		label  string
+		length int
+	}{{"", 32}, {"a\x00b", 32}, {"ok", 0}, {"ok", 255*32 + 1}} {
+		_, err = keys.ExportKeyingMaterial(bad.label, nil, bad.length)
+		require.NotNil(t, err)
+	}
+
+	keys.Zero()
+	_, err = keys.ExportKeyingMaterial("obfs4 rekey", nil, 32)
+	require.Equal(t, ErrKeysZeroed, err)
+}
+
+// The IDs, computed as the vectors above, must not be the start of the secret
+// they identify, and must outlive the keys.
+func TestRegistrationIDString(t *testing.T) {
+	for i, id := range []string{"c51af65468720d5b", "35e954e593317848"} {
+		secret, err := hex.DecodeString(sharedKeyVectors[i].secret)
+		require.Nil(t, err)
+		keys, err := GenSharedKeys(secret)
+		require.Nil(t, err)
+
+		reg := &DecoyRegistration{Keys: &keys}
+		require.Equal(t, id, reg.IDString())
+		require.NotEqual(t, sharedKeyVectors[i].secret[:regIDLen], reg.IDString())
+
+		keys.Zero()
+		require.Equal(t, id, reg.IDString())
+	}
+
+	var reg *DecoyRegistration
+	require.Equal(t, "0000000000000000", reg.IDString())
+	require.Equal(t, "0000000000000000", (&DecoyRegistration{}).IDString())
+}
+
+func TestSharedKeysZeroAndRedaction(t *testing.T) {
+	secret, err := hex.DecodeString(sharedKeyVectors[0].secret)
+	require.Nil(t, err)
+	keys, err := GenSharedKeys(secret)
+	require.Nil(t, err)
+
+	for _, out := range []string{
+		fmt.Sprintf("%v", keys), fmt.Sprintf("%+v", &keys), fmt.Sprintf("%#v", keys),
+	} {
+		require.Equal(t, "[redacted]", out)
+	}
+	asJSON, err := json.Marshal(struct{ Keys *ConjureSharedKeys }{&keys})
+	require.Nil(t, err)
+	require.Equal(t, `{"Keys":"[redacted]"}`, string(asJSON))
+
+	// Zeroing the keys must not touch the caller's buffer.
+	keys.Zero()
+	require.Equal(t, sharedKeyVectors[0].secret, hex.EncodeToString(secret))
+	for _, b := range [][]byte{keys.SharedSecret, keys.FspKey[:], keys.FspIv[:], keys.VspKey[:],
+		keys.VspIv[:], keys.MasterSecret[:], keys.DarkDecoySeed[:], keys.ConnTag[:], keys.Obfs4Keys.PrivateKey[:]} {
+		require.Equal(t, make([]byte, len(b)), b)
+	}
+}
+
+// Types that are JSON encoded into logs must not be able to carry key material.
+func TestDumpTypesHoldNoSecrets(t *testing.T) {
+	secretTypes := map[reflect.Type]bool{
+		reflect.TypeOf(ConjureSharedKeys{}): true,
+		reflect.TypeOf(Obfs4Keys{}):         true,
+		reflect.TypeOf(StationKey{}):        true,
+	}
+
+	var check func(path string, typ reflect.Type)
+	check = func(path string, typ reflect.Type) {
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			if typ.Elem().Kind() == reflect.Uint8 {
+				t.Errorf("%s is raw bytes (%v)", path, typ)
+				return
+			}
+			typ = typ.Elem()
+		}
+		require.False(t, secretTypes[typ], "%s holds %v", path, typ)
+		if typ.Kind() != reflect.Struct || typ.PkgPath() != reflect.TypeOf(regDigest{}).PkgPath() {
+			return
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported, never serialized
+			}
+			name := strings.ToLower(f.Name)
+			require.False(t, strings.Contains(name, "secret") || strings.Contains(name, "key"),
+				"%s.%s looks like key material", path, f.Name)
+			check(path+"."+f.Name, f.Type)
+		}
+	}
+
+	for _, v := range []interface{}{regDigest{}, regExpireLogMsg{}, sessionStats{}} {
+		typ := reflect.TypeOf(v)
+		check(typ.Name(), typ)
+	}
+}
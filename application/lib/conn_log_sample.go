@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ConnLogSampler counts the connections accepted by the listeners and logs
+// one in every few of them at info level, see Config.ConnectLogSample. The
+// others are logged at debug level, so that every connection is still logged
+// when troubleshooting.
+type ConnLogSampler struct {
+	every    int64 // zero logs none at info level
+	accepted int64
+}
+
+// NewConnLogSampler returns a sampler logging one in every connections at
+// info level, none if every is zero.
+func NewConnLogSampler(every int) *ConnLogSampler {
+	return &ConnLogSampler{every: int64(every)}
+}
+
+func (c *Config) parseConnectLogSample() error {
+	switch {
+	case c.ConnectLogSample < -1:
+		return fmt.Errorf("bad connect_log_sample %d, expected -1 or more", c.ConnectLogSample)
+	case c.ConnectLogSample == -1:
+		c.connLogSampler = NewConnLogSampler(0)
+	case c.ConnectLogSample == 0:
+		c.connLogSampler = NewConnLogSampler(1)
+	default:
+		c.connLogSampler = NewConnLogSampler(c.ConnectLogSample)
+	}
+	return nil
+}
+
+// ConnLogSampler returns the sampler of the accepted connections logged, nil
+// (logging every one) if the config was not parsed.
+func (c *Config) ConnLogSampler() *ConnLogSampler {
+	return c.connLogSampler
+}
+
+// Accept counts an accepted connection in the stats, whether or not it is
+// sampled, and logs it to logger at info level if it is, at debug level
+// otherwise. Safe to call on a nil sampler, which samples every connection.
+func (s *ConnLogSampler) Accept(logger *Logger, format string, v ...interface{}) {
+	Stat().AddConn()
+	if s.sample() {
+		logger.Infof(format, v...)
+	} else {
+		logger.Debugf(format, v...)
+	}
+}
+
+func (s *ConnLogSampler) sample() bool {
+	if s == nil {
+		return true
+	}
+	n := atomic.AddInt64(&s.accepted, 1)
+	return s.every > 0 && (n-1)%s.every == 0
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLogSampler(t *testing.T) {
+	defer SetLogLevel(LevelInfo)
+	SetLogLevel(LevelInfo)
+
+	for _, tt := range []struct {
+		sample int
+		logged int
+	}{
+		{0, 100},
+		{1, 100},
+		{10, 10},
+		{7, 15},
+		{-1, 0},
+	} {
+		conf := &Config{ConnectLogSample: tt.sample}
+		require.Nil(t, conf.parseConnectLogSample())
+
+		var buf bytes.Buffer
+		logger := &Logger{log.New(&buf, "", 0)}
+		before := atomic.LoadInt64(&Stat().newConns)
+		for i := 0; i < 100; i++ {
+			conf.ConnLogSampler().Accept(logger, "new connection %d", i)
+		}
+		require.Equal(t, tt.logged, strings.Count(buf.String(), "[INFO] new connection"), "sample %d", tt.sample)
+		require.Equal(t, before+100, atomic.LoadInt64(&Stat().newConns), "sample %d", tt.sample)
+	}
+
+	// Every connection is logged at debug level.
+	SetLogLevel(LevelDebug)
+	conf := &Config{ConnectLogSample: 10}
+	require.Nil(t, conf.parseConnectLogSample())
+	var buf bytes.Buffer
+	logger := &Logger{log.New(&buf, "", 0)}
+	for i := 0; i < 20; i++ {
+		conf.ConnLogSampler().Accept(logger, "new connection %d", i)
+	}
+	require.Equal(t, 2, strings.Count(buf.String(), "[INFO] new connection"))
+	require.Equal(t, 18, strings.Count(buf.String(), "[DEBUG] new connection"))
+
+	// A config that was not parsed logs every connection.
+	buf.Reset()
+	(&Config{}).ConnLogSampler().Accept(logger, "new connection")
+	require.Contains(t, buf.String(), "[INFO] new connection")
+
+	require.NotNil(t, (&Config{ConnectLogSample: -2}).parseConnectLogSample())
+}
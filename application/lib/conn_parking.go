@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+const (
+	// defaultParkTimeout is the ParkTimeout, in milliseconds, used when none
+	// is configured.
+	defaultParkTimeout = 2000
+
+	// defaultParkMax is the ParkMax used when none is configured.
+	defaultParkMax = 1024
+)
+
+// Outcomes of parking a connection, the label of metrics.ParkedConnOutcomes.
+const (
+	parkRescued = "rescued" // a registration of its phantom arrived
+	parkTimeout = "timeout" // none did within the park timeout
+	parkFull    = "full"    // ParkMax connections were parked already
+)
+
+// ConnParking holds connections to phantoms without any registration for a
+// short while, reading nothing from them, in case their registration is
+// still on its way: clients may connect to the phantom a few hundred
+// milliseconds before the registration has propagated to the station. A
+// parked connection is released as soon as a registration of its phantom is
+// added (when its registration_added event is published), and goes on to be
+// handled normally. One whose registration does not arrive in time gets the
+// usual treatment of a connection without registration.
+type ConnParking struct {
+	max     int
+	timeout time.Duration
+	clock   clock.Clock
+
+	m       sync.Mutex
+	parked  int
+	waiting map[string]*parkedPhantom
+}
+
+// parkedPhantom are the connections parked for one phantom.
+type parkedPhantom struct {
+	arrived chan struct{} // closed once a registration is added
+	conns   int
+}
+
+// NewConnParking returns a parking holding up to max connections at once,
+// each for up to timeout.
+func NewConnParking(max int, timeout time.Duration) *ConnParking {
+	return &ConnParking{
+		max:     max,
+		timeout: timeout,
+		clock:   clock.Real,
+		waiting: make(map[string]*parkedPhantom),
+	}
+}
+
+// park waits for a registration of phantom to be added, up to the timeout,
+// and reports whether one was. registered reports whether phantom has a
+// registration already, it is checked once the connection is parked so that
+// none added meanwhile is missed. p may be nil, parking nothing.
+func (p *ConnParking) park(phantom net.IP, registered func() bool) bool {
+	if p == nil {
+		return false
+	}
+	key := phantom.String()
+	p.m.Lock()
+	if p.parked >= p.max {
+		p.m.Unlock()
+		metrics.ParkedConnOutcomes.Inc(parkFull)
+		Stat().AddParkedConn(parkFull)
+		return false
+	}
+	p.parked++
+	metrics.ParkedConns.Inc()
+	Stat().SetParkedConns(p.parked)
+	waiting, ok := p.waiting[key]
+	if !ok {
+		waiting = &parkedPhantom{arrived: make(chan struct{})}
+		p.waiting[key] = waiting
+	}
+	waiting.conns++
+	p.m.Unlock()
+
+	rescued := registered()
+	if !rescued {
+		timer := p.clock.NewTimer(p.timeout)
+		select {
+		case <-waiting.arrived:
+			rescued = true
+		case <-timer.C():
+		}
+		timer.Stop()
+	}
+
+	p.m.Lock()
+	p.parked--
+	metrics.ParkedConns.Dec()
+	Stat().SetParkedConns(p.parked)
+	// The last connection parked for the phantom removes its wait, unless
+	// a registration removed it already.
+	waiting.conns--
+	if waiting.conns == 0 && p.waiting[key] == waiting {
+		delete(p.waiting, key)
+	}
+	p.m.Unlock()
+
+	outcome := parkTimeout
+	if rescued {
+		outcome = parkRescued
+	}
+	metrics.ParkedConnOutcomes.Inc(outcome)
+	Stat().AddParkedConn(outcome)
+	return rescued
+}
+
+// registrationAdded releases the connections parked for phantom.
+func (p *ConnParking) registrationAdded(phantom string) {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if waiting, ok := p.waiting[phantom]; ok {
+		close(waiting.arrived)
+		delete(p.waiting, phantom)
+	}
+}
+
+// parseConnParking checks the parking settings, and fills in the defaults.
+func (c *Config) parseConnParking() error {
+	if c.ParkTimeout < 0 || c.ParkMax < 0 {
+		return fmt.Errorf("park_timeout and park_max must not be negative")
+	}
+	if c.ParkTimeout == 0 {
+		c.ParkTimeout = defaultParkTimeout
+	}
+	if c.ParkMax == 0 {
+		c.ParkMax = defaultParkMax
+	}
+	return nil
+}
+
+// ConnParking returns the parking of connections arriving before their
+// registration, nil unless ParkConnections is set.
+func (c *Config) ConnParking() *ConnParking {
+	if !c.ParkConnections {
+		return nil
+	}
+	return NewConnParking(c.ParkMax, time.Duration(c.ParkTimeout)*time.Millisecond)
+}
+
+// SetConnParking has connections to phantoms without registrations parked
+// in p, see ParkConnection. It must be set before connections are handled.
+func (regManager *RegistrationManager) SetConnParking(p *ConnParking) {
+	regManager.registeredDecoys.parking = p
+}
+
+// ParkConnection holds a connection to phantom, which has no registration,
+// until a registration of the phantom is added or the park timeout passes,
+// and reports whether one was added. It returns false at once without a
+// parking or with the parking full.
+func (regManager *RegistrationManager) ParkConnection(phantom net.IP) bool {
+	r := regManager.registeredDecoys
+	return r.parking.park(phantom, func() bool { return r.countRegistrations(phantom) > 0 })
+}
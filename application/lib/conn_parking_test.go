@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnParking(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	rm := &RegistrationManager{registeredDecoys: newConnTagTestDecoys(), Logger: &Logger{log.New(ioutil.Discard, "", 0)}}
+	p := NewConnParking(2, 2*time.Second)
+	p.clock = clk
+	rm.SetConnParking(p)
+	phantom, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	rescued := metrics.ParkedConnOutcomes.Value(parkRescued)
+	timeouts := metrics.ParkedConnOutcomes.Value(parkTimeout)
+	full := metrics.ParkedConnOutcomes.Value(parkFull)
+
+	// A connection parked before its registration arrives is released by it,
+	// one for another phantom waits on.
+	results := make(chan bool, 2)
+	go func() { results <- rm.ParkConnection(phantom) }()
+	go func() { results <- rm.ParkConnection(other) }()
+	require.True(t, clk.WaitForTimers(2, time.Second))
+	require.Equal(t, 2.0, metrics.ParkedConns.Value())
+
+	// The parking is full.
+	require.False(t, rm.ParkConnection(net.ParseIP("192.0.2.3")))
+	require.Equal(t, full+1, metrics.ParkedConnOutcomes.Value(parkFull))
+
+	reg := newConnTagTestReg(t, phantom)
+	require.Nil(t, rm.TrackRegistration(reg))
+	rm.AddRegistration(reg)
+	select {
+	case ok := <-results:
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("parked connection not released by its registration")
+	}
+	require.Equal(t, rescued+1, metrics.ParkedConnOutcomes.Value(parkRescued))
+
+	// Without a registration the connection is released after the timeout.
+	clk.Advance(2 * time.Second)
+	require.False(t, <-results)
+	require.Equal(t, timeouts+1, metrics.ParkedConnOutcomes.Value(parkTimeout))
+	require.Equal(t, 0.0, metrics.ParkedConns.Value())
+	require.Len(t, p.waiting, 0)
+
+	// A registration added before the connection is parked is not waited
+	// for.
+	require.True(t, rm.ParkConnection(phantom))
+	require.Equal(t, rescued+2, metrics.ParkedConnOutcomes.Value(parkRescued))
+
+	// Without a parking nothing is parked.
+	rm.SetConnParking(nil)
+	require.False(t, rm.ParkConnection(other))
+}
+
+func TestParseConnParking(t *testing.T) {
+	c := &Config{}
+	require.Nil(t, c.parseConnParking())
+	require.Equal(t, defaultParkTimeout, c.ParkTimeout)
+	require.Equal(t, defaultParkMax, c.ParkMax)
+	require.Nil(t, c.ConnParking())
+
+	c = &Config{ParkConnections: true, ParkTimeout: 500, ParkMax: 8}
+	require.Nil(t, c.parseConnParking())
+	p := c.ConnParking()
+	require.Equal(t, 500*time.Millisecond, p.timeout)
+	require.Equal(t, 8, p.max)
+
+	require.NotNil(t, (&Config{ParkTimeout: -1}).parseConnParking())
+	require.NotNil(t, (&Config{ParkMax: -1}).parseConnParking())
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"net"
+)
+
+// ConnTagHMACString is the HMAC string the client keys with the registration
+// shared secret to produce the tag it sends as the first bytes of a min
+// transport connection. The misspelling matches the client.
+const ConnTagHMACString = "MinTrasportHMACString"
+
+// ConnTagLen is the length of the connection tag (an HMAC-SHA256).
+const ConnTagLen = 32
+
+// connTagPrefixLen is how much of the tag is used to key the index. The rest
+// of the tag is checked in constant time once a candidate has been found.
+const connTagPrefixLen = 8
+
+type connTagKey struct {
+	phantom string
+	prefix  [connTagPrefixLen]byte
+}
+
+func newConnTagKey(phantom string, tag []byte) connTagKey {
+	k := connTagKey{phantom: phantom}
+	copy(k.prefix[:], tag)
+	return k
+}
+
+// indexConnTag adds d to the connection tag index. The RegisteredDecoys lock
+// must be held for writing. On a prefix collision on the same phantom, which
+// requires 2^32 registrations on it to become likely, the registration that was
+// indexed first is kept.
+func (r *RegisteredDecoys) indexConnTag(d *DecoyRegistration) {
+	if d.Keys == nil {
+		return
+	}
+	key := newConnTagKey(d.DarkDecoy.String(), d.Keys.ConnTag[:])
+	if _, exists := r.connTags[key]; exists {
+		return
+	}
+	r.connTags[key] = d
+	Stat().SetConnTagIndexSize(len(r.connTags))
+}
+
+// unindexConnTag removes d from the connection tag index. The RegisteredDecoys
+// lock must be held for writing.
+func (r *RegisteredDecoys) unindexConnTag(d *DecoyRegistration) {
+	if d.Keys == nil {
+		return
+	}
+	key := newConnTagKey(d.DarkDecoy.String(), d.Keys.ConnTag[:])
+	if r.connTags[key] == d {
+		delete(r.connTags, key)
+		Stat().SetConnTagIndexSize(len(r.connTags))
+	}
+}
+
+// lookupConnTag returns the valid registration on phantom whose connection tag
+// is tag, or nil.
+func (r *RegisteredDecoys) lookupConnTag(phantom net.IP, tag []byte) *DecoyRegistration {
+	if len(tag) != ConnTagLen {
+		return nil
+	}
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	reg, ok := r.connTags[newConnTagKey(phantom.String(), tag)]
+	if !ok || !r.servable(reg) {
+		return nil
+	}
+	if subtle.ConstantTimeCompare(reg.Keys.ConnTag[:], tag) != 1 {
+		return nil
+	}
+	return reg
+}
+
+// GetRegistrationByConnTag returns the valid registration on phantomAddr whose
+// precomputed connection tag (see ConjureSharedKeys.ConnTag) matches tag, or
+// nil if there is none. This costs a single map lookup and one constant time
+// comparison regardless of the number of registrations.
+func (regManager *RegistrationManager) GetRegistrationByConnTag(phantomAddr net.IP, tag []byte) *DecoyRegistration {
+	return regManager.registeredDecoys.lookupConnTag(phantomAddr, tag)
+}
+
+// ConnTagIndexSize returns the number of registrations in the connection tag
+// index.
+func (r *RegisteredDecoys) ConnTagIndexSize() int {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return len(r.connTags)
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newConnTagTestReg(t testing.TB, phantom net.IP) *DecoyRegistration {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.Nil(t, err)
+	keys, err := GenSharedKeys(secret)
+	require.Nil(t, err)
+	return &DecoyRegistration{DarkDecoy: phantom, Keys: &keys, Transport: 0}
+}
+
+func newConnTagTestDecoys() *RegisteredDecoys {
+	r := NewRegisteredDecoys()
+	r.transports[0] = mockTransport{}
+	return r
+}
+
+func TestConnTagIndex(t *testing.T) {
+	r := newConnTagTestDecoys()
+	phantom := net.ParseIP("192.0.2.1")
+	reg := newConnTagTestReg(t, phantom)
+	require.Nil(t, r.Track(reg))
+	require.Equal(t, 1, r.ConnTagIndexSize())
+
+	tag := append([]byte(nil), reg.Keys.ConnTag[:]...)
+
+	// Registrations are not usable until validated.
+	require.Nil(t, r.lookupConnTag(phantom, tag))
+	reg.Valid = true
+	require.Equal(t, reg, r.lookupConnTag(phantom, tag))
+
+	// Wrong phantom, wrong length and a tag that only matches on the prefix.
+	require.Nil(t, r.lookupConnTag(net.ParseIP("192.0.2.2"), tag))
+	require.Nil(t, r.lookupConnTag(phantom, tag[:ConnTagLen-1]))
+	badTag := append([]byte(nil), tag...)
+	badTag[ConnTagLen-1] ^= 1
+	require.Nil(t, r.lookupConnTag(phantom, badTag))
+
+	// Expiry removes the registration from the index.
+	require.NotNil(t, r.removeRegistration(reg.IDString()+phantom.String()))
+	require.Equal(t, 0, r.ConnTagIndexSize())
+	require.Nil(t, r.lookupConnTag(phantom, tag))
+}
+
+// Lookups must stay in the microseconds with a realistic number of
+// registrations: go test -run X -bench ConnTagLookup ./lib/
+func BenchmarkConnTagLookup(b *testing.B) {
+	const numRegs = 100000
+
+	r := newConnTagTestDecoys()
+	regs := make([]*DecoyRegistration, numRegs)
+	for i := range regs {
+		// Spread registrations over a few thousand phantoms.
+		phantom := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i%16))
+		regs[i] = newConnTagTestReg(b, phantom)
+		require.Nil(b, r.Track(regs[i]))
+		regs[i].Valid = true
+	}
+	require.Equal(b, numRegs, r.ConnTagIndexSize())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reg := regs[i%numRegs]
+		if r.lookupConnTag(reg.DarkDecoy, reg.Keys.ConnTag[:]) != reg {
+			b.Fatalf("lookup failed for registration %d", i%numRegs)
+		}
+	}
+}
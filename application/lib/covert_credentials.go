@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+)
+
+const (
+	// c2sCovertCredentialsField is the field number of the covert
+	// credentials in the ClientToStation message, unknown to the generated
+	// protobuf package. See proto/signalling.proto.
+	c2sCovertCredentialsField = 25
+
+	// maxCovertCredential is the longest username or password, the most
+	// SOCKS5 username/password authentication takes.
+	maxCovertCredential = 255
+)
+
+// CovertCredentials are the credentials a registration gives the station to
+// authenticate with to its covert, a proxy the station completes a SOCKS5 or
+// HTTP CONNECT handshake with (see CovertPreambleConfig.Handshake). They are
+// never logged: formatting them or encoding them as JSON gives
+// "[redacted]", and no error includes them.
+type CovertCredentials struct {
+	Username string
+	Password string
+}
+
+// String keeps the credentials out of anything formatted with %v or %s.
+func (c CovertCredentials) String() string { return "[redacted]" }
+
+// GoString keeps the credentials out of anything formatted with %#v.
+func (c CovertCredentials) GoString() string { return "[redacted]" }
+
+// MarshalJSON keeps the credentials out of any JSON encoded struct.
+func (c CovertCredentials) MarshalJSON() ([]byte, error) { return []byte(`"[redacted]"`), nil }
+
+// appendCovertCredentials appends the covert_credentials field set to creds
+// to the marshaled ClientToStation c2s.
+func appendCovertCredentials(c2s []byte, creds *CovertCredentials) []byte {
+	var msg []byte
+	msg = appendTransferUvarint(msg, 1<<3|2)
+	msg = appendTransferUvarint(msg, uint64(len(creds.Username)))
+	msg = append(msg, creds.Username...)
+	msg = appendTransferUvarint(msg, 2<<3|2)
+	msg = appendTransferUvarint(msg, uint64(len(creds.Password)))
+	msg = append(msg, creds.Password...)
+
+	c2s = appendTransferUvarint(c2s, c2sCovertCredentialsField<<3|2)
+	c2s = appendTransferUvarint(c2s, uint64(len(msg)))
+	return append(c2s, msg...)
+}
+
+// parseCovertCredentials returns the covert credentials of the marshaled
+// ClientToStation c2s, nil if it has none. The generated protobuf package
+// predates the field so the wire format is walked directly.
+func parseCovertCredentials(c2s []byte) (*CovertCredentials, error) {
+	var msg []byte
+	err := walkC2SWrapper(c2s, func(field uint64, varint uint64, data []byte) {
+		if field == c2sCovertCredentialsField && data != nil {
+			msg = data
+		}
+	})
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	creds := &CovertCredentials{}
+	err = walkC2SWrapper(msg, func(field uint64, varint uint64, data []byte) {
+		switch field {
+		case 1:
+			creds.Username = string(data)
+		case 2:
+			creds.Password = string(data)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("malformed covert credentials: %v", err)
+	}
+	if creds.Username == "" {
+		return nil, fmt.Errorf("covert credentials without a username")
+	}
+	if len(creds.Username) > maxCovertCredential || len(creds.Password) > maxCovertCredential {
+		return nil, fmt.Errorf("covert credentials longer than %d bytes", maxCovertCredential)
+	}
+	return creds, nil
+}
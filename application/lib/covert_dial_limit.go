@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// covertDialLimiter bounds the covert dials in flight for the sessions of a
+// single client IP, so that one client opening many connections (or mux
+// streams) at once cannot make the station dial coverts on its behalf many
+// times over. It is separate from the limits of a registration: one source
+// IP may carry sessions of many registrations.
+type covertDialLimiter struct {
+	max int
+
+	m        sync.Mutex
+	inFlight map[string]int
+}
+
+func newCovertDialLimiter(max int) *covertDialLimiter {
+	return &covertDialLimiter{max: max, inFlight: make(map[string]int)}
+}
+
+// acquire takes a dial slot of ip, it returns false if ip has none free.
+func (l *covertDialLimiter) acquire(ip string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.inFlight[ip] >= l.max {
+		return false
+	}
+	l.inFlight[ip]++
+	return true
+}
+
+// release returns a slot taken with acquire.
+func (l *covertDialLimiter) release(ip string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.inFlight[ip] <= 1 {
+		delete(l.inFlight, ip)
+		return
+	}
+	l.inFlight[ip]--
+}
+
+func (c *ProxyConfig) parseCovertDialsPerIP() error {
+	if c.CovertDialsPerIP < 0 {
+		return fmt.Errorf("covert_dials_per_ip must not be negative")
+	}
+	if c.CovertDialsPerIP > 0 {
+		c.covertDialLimiter = newCovertDialLimiter(c.CovertDialsPerIP)
+	}
+	return nil
+}
+
+// acquireCovertDial takes a covert dial slot of the client at addr, it
+// returns the function releasing it, or an error counted in
+// metrics.CovertDialsRejected if the client has CovertDialsPerIP dials in
+// flight already. conf may be nil.
+func (c *ProxyConfig) acquireCovertDial(addr net.Addr) (func(), error) {
+	if c == nil || c.covertDialLimiter == nil {
+		return func() {}, nil
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !c.covertDialLimiter.acquire(ip) {
+		metrics.CovertDialsRejected.Inc()
+		return nil, fmt.Errorf("client has %d covert dials in flight", c.CovertDialsPerIP)
+	}
+	return func() { c.covertDialLimiter.release(ip) }, nil
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyCovertDialsPerIP(t *testing.T) {
+	covert, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	go serveEcho(covert)
+	_, port, _ := net.SplitHostPort(covert.Addr().String())
+
+	// Dials stay in flight until unblock is closed, held up resolving the
+	// covert.
+	lookups := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	r, err := NewCovertResolver("", false, 0, 0)
+	require.Nil(t, err)
+	r.system = func(host string) ([]string, error) {
+		lookups <- struct{}{}
+		<-unblock
+		return []string{"127.0.0.1"}, nil
+	}
+	conf := &ProxyConfig{CovertDialsPerIP: 2, covertResolver: r}
+	require.Nil(t, conf.parseCovertDialsPerIP())
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: net.JoinHostPort("covert.example", port)}
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+
+	// One client IP opens many connections at once.
+	rejected := metrics.CovertDialsRejected.Value()
+	var clients []net.Conn
+	done := make(chan net.Conn, 10)
+	for i := 0; i < 5; i++ {
+		client, stationClient := tcpPair(t)
+		defer client.Close()
+		clients = append(clients, client)
+		go func() {
+			Proxy(reg, stationClient, 443, nil, logger, conf)
+			stationClient.Close()
+			done <- client
+		}()
+	}
+	<-lookups
+	<-lookups
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("excess sessions were not closed")
+		}
+	}
+	require.Equal(t, rejected+3, metrics.CovertDialsRejected.Value())
+	require.Len(t, lookups, 0)
+
+	// The sessions allowed to dial proceed and free their slots once dialed.
+	close(unblock)
+	proxied := 0
+	for _, client := range clients {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte("ping")); err != nil {
+			continue
+		}
+		echoed := make([]byte, 4)
+		if _, err := io.ReadFull(client, echoed); err == nil {
+			require.Equal(t, "ping", string(echoed))
+			proxied++
+			client.Close()
+			<-done
+		}
+	}
+	require.Equal(t, 2, proxied)
+	require.Equal(t, rejected+3, metrics.CovertDialsRejected.Value())
+	require.True(t, conf.covertDialLimiter.acquire("127.0.0.1"))
+	require.True(t, conf.covertDialLimiter.acquire("127.0.0.1"))
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+// Modes of the embedded covert, see ProxyConfig.CovertEcho.
+const (
+	covertEchoModeEcho = "echo" // writes back what it reads
+	covertEchoModeSink = "sink" // discards what it reads
+)
+
+// defaultCovertEchoAddr is the CovertEchoAddr used when none is configured,
+// a free loopback port.
+const defaultCovertEchoAddr = "127.0.0.1:0"
+
+func (c *ProxyConfig) parseCovertEcho() error {
+	switch c.CovertEcho {
+	case "":
+		return nil
+	case covertEchoModeEcho, covertEchoModeSink:
+	default:
+		return fmt.Errorf("unknown covert_echo mode %q, expected %q or %q", c.CovertEcho, covertEchoModeEcho, covertEchoModeSink)
+	}
+	if c.CovertEchoAddr == "" {
+		c.CovertEchoAddr = defaultCovertEchoAddr
+	}
+	if !isLoopbackAddr(c.CovertEchoAddr) {
+		return fmt.Errorf("covert_echo_addr %q is not a loopback address", c.CovertEchoAddr)
+	}
+	return nil
+}
+
+// isLoopbackAddr reports whether addr ("host:port") is on a loopback
+// address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// checkCovertEchoListeners returns an error naming the first of the station's
+// listeners that is reachable from outside the host: the phantom listeners,
+// the registration API and the registration transfer listener.
+func (c *Config) checkCovertEchoListeners() error {
+	listen := c.ListenAddrs
+	if len(listen) == 0 {
+		listen = []string{defaultListenAddr}
+	}
+	for _, addr := range listen {
+		if !isLoopbackAddr(addr) {
+			return fmt.Errorf("listen address %s is not a loopback address", addr)
+		}
+	}
+	if c.RegistrationAPIAddr != "" && !isLoopbackAddr(c.RegistrationAPIAddr) {
+		return fmt.Errorf("registration_api_addr %s is not a loopback address", c.RegistrationAPIAddr)
+	}
+	if c.TransferListenAddr != "" && !strings.HasPrefix(c.TransferListenAddr, "unix:") && !isLoopbackAddr(c.TransferListenAddr) {
+		return fmt.Errorf("transfer_listen_addr %s is not a loopback address", c.TransferListenAddr)
+	}
+	return nil
+}
+
+// StartCovertEcho starts the embedded covert every covert dial goes to, if
+// CovertEcho is set, logging to logger. It is for load testing only: unless
+// allowPublic is set the station refuses to run it while any of its
+// listeners is reachable from outside the host, as clients would get the
+// embedded covert instead of their own. It must be called at startup, before
+// sessions are proxied.
+func (c *Config) StartCovertEcho(allowPublic bool, logger *log.Logger) error {
+	if c.CovertEcho == "" {
+		return nil
+	}
+	if !allowPublic {
+		if err := c.checkCovertEchoListeners(); err != nil {
+			return fmt.Errorf("%v, refusing to run the test-only covert_echo without -allow-public-covert-echo", err)
+		}
+	}
+	echo, err := listenCovertEcho(c.CovertEchoAddr, c.CovertEcho == covertEchoModeSink)
+	if err != nil {
+		return err
+	}
+	c.covertEcho = echo
+	go echo.serve(logger)
+	return nil
+}
+
+// CovertEchoAddress returns the address the embedded covert listens on, nil
+// if it is not running.
+func (c *ProxyConfig) CovertEchoAddress() net.Addr {
+	if c == nil || c.covertEcho == nil {
+		return nil
+	}
+	return c.covertEcho.ln.Addr()
+}
+
+// covertEchoing reports whether covert dials go to the embedded covert. conf
+// may be nil.
+func (c *ProxyConfig) covertEchoing() bool {
+	return c != nil && c.covertEcho != nil
+}
+
+// covertEchoServer is the embedded covert of ProxyConfig.CovertEcho, echoing
+// or discarding what every connection sends until it closes its side.
+type covertEchoServer struct {
+	ln   net.Listener
+	sink bool
+}
+
+func listenCovertEcho(addr string, sink bool) (*covertEchoServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for covert_echo on %s: %v", addr, err)
+	}
+	return &covertEchoServer{ln: ln, sink: sink}, nil
+}
+
+func (s *covertEchoServer) serve(logger *log.Logger) {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			logger.Printf("covert echo listener closed: %v", err)
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *covertEchoServer) handle(conn net.Conn) {
+	defer conn.Close()
+	if s.sink {
+		io.Copy(ioutil.Discard, conn)
+		return
+	}
+	io.Copy(conn, conn)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// dial connects to the embedded covert.
+func (s *covertEchoServer) dial() (net.Conn, error) {
+	return net.Dial("tcp", s.ln.Addr().String())
+}
+
+func (s *covertEchoServer) Close() error {
+	return s.ln.Close()
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertEchoConfig(t *testing.T) {
+	conf := &Config{ProxyConfig: ProxyConfig{CovertEcho: covertEchoModeSink}}
+	require.Nil(t, conf.parseCovertEcho())
+	require.Equal(t, defaultCovertEchoAddr, conf.CovertEchoAddr)
+
+	require.NotNil(t, (&ProxyConfig{CovertEcho: "reflect"}).parseCovertEcho())
+	require.NotNil(t, (&ProxyConfig{CovertEcho: covertEchoModeEcho, CovertEchoAddr: "192.0.2.1:7"}).parseCovertEcho())
+
+	// The default listen address is on every interface.
+	require.NotNil(t, conf.checkCovertEchoListeners())
+	conf.ListenAddrs = []string{"127.0.0.1:41245", "[::1]:41245"}
+	require.Nil(t, conf.checkCovertEchoListeners())
+	conf.TransferListenAddr = "unix:/run/conjure/transfer.sock"
+	require.Nil(t, conf.checkCovertEchoListeners())
+	conf.RegistrationAPIAddr = ":8443"
+	require.NotNil(t, conf.checkCovertEchoListeners())
+
+	err := conf.StartCovertEcho(false, log.New(ioutil.Discard, "", 0))
+	require.Contains(t, err.Error(), "-allow-public-covert-echo")
+	require.Nil(t, conf.CovertEchoAddress())
+}
+
+func TestProxyCovertEcho(t *testing.T) {
+	conf := &Config{ProxyConfig: ProxyConfig{CovertEcho: covertEchoModeEcho}}
+	conf.ListenAddrs = []string{"127.0.0.1:0"}
+	require.Nil(t, conf.parseCovertEcho())
+	require.Nil(t, conf.StartCovertEcho(false, log.New(ioutil.Discard, "", 0)))
+	defer conf.covertEcho.Close()
+
+	// The covert is never dialed, nor its dial counted.
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: "192.0.2.2:443"}
+	dialsBefore := atomic.LoadInt64(&Stat().newCovertDials)
+	upBefore := metrics.ProxyBytes.Value(metrics.DirectionUp, reg.Transport.String())
+	echoBefore := metrics.CovertEchoBytes.Value(metrics.DirectionDown)
+
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, &conf.ProxyConfig)
+		stationClient.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.Write([]byte("hello"))
+	require.Nil(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(client, reply)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(reply))
+	client.CloseWrite()
+	<-done
+
+	require.Equal(t, dialsBefore, atomic.LoadInt64(&Stat().newCovertDials))
+	require.Equal(t, upBefore, metrics.ProxyBytes.Value(metrics.DirectionUp, reg.Transport.String()))
+	require.Equal(t, echoBefore+5, metrics.CovertEchoBytes.Value(metrics.DirectionDown))
+}
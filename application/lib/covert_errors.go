@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Classes of covert errors, the class label of metrics.CovertDialFailures
+// and metrics.CovertRelayErrors and the class field of covert logs. dns-fail,
+// refused, timeout and error are the dial failure classes from before errors
+// were classified further, kept so that dashboards and alerts on them still
+// match.
+const (
+	covertErrDNS          = "dns-fail"
+	covertErrConnRefused  = "refused"
+	covertErrTimeout      = "timeout"
+	covertErrReset        = "reset"
+	covertErrTLS          = "tls"
+	covertErrLoop         = "loop"
+	covertErrBlocklisted  = "blocklisted"
+	covertErrTLSHandshake = "tls_handshake"
+	covertErrOther        = "error"
+)
+
+// classifyCovertErr returns the class of err, an error dialing, reading from
+// or writing to a covert: a failed lookup of the covert host, a refused
+// connect, a timeout, a reset (or broken pipe), a TLS failure (bad record,
+// alert or certificate, e.g. from the strict TLS verification), a failed TLS
+// handshake of the station's own (ErrCovertTLSHandshake), a covert that is
+// the station itself (ErrCovertLoop), a covert resolving to a blocklisted
+// address (ErrCovertBlocklisted), or any other error.
+func classifyCovertErr(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrCovertLoop):
+		return covertErrLoop
+	case errors.Is(err, ErrCovertBlocklisted):
+		return covertErrBlocklisted
+	case errors.Is(err, ErrCovertTLSHandshake):
+		return covertErrTLSHandshake
+	case errors.As(err, &dnsErr):
+		return covertErrDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return covertErrConnRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return covertErrTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return covertErrReset
+	case errors.As(err, &recordErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCert),
+		// TLS alerts are not an exported type.
+		strings.Contains(err.Error(), "tls: "):
+		return covertErrTLS
+	default:
+		return covertErrOther
+	}
+}
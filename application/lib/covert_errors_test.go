@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyCovertErr(t *testing.T) {
+	opErr := func(op string, err error) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, err)}
+	}
+	for _, c := range []struct {
+		err   error
+		class string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "covert.example", IsNotFound: true}, covertErrDNS},
+		{&net.DNSError{Err: "i/o timeout", Name: "covert.example", IsTimeout: true}, covertErrDNS},
+		{opErr("connect", syscall.ECONNREFUSED), covertErrConnRefused},
+		{&net.OpError{Op: "dial", Err: dialTimeoutErr{}}, covertErrTimeout},
+		{opErr("read", syscall.ECONNRESET), covertErrReset},
+		{opErr("write", syscall.EPIPE), covertErrReset},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, covertErrTLS},
+		{x509.UnknownAuthorityError{}, covertErrTLS},
+		{x509.HostnameError{Certificate: &x509.Certificate{}, Host: "covert.example"}, covertErrTLS},
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}, covertErrTLS},
+		{fmt.Errorf("strict TLS: %w", x509.UnknownAuthorityError{}), covertErrTLS},
+		{fmt.Errorf("%w: 127.0.0.1:41245", ErrCovertLoop), covertErrLoop},
+		{fmt.Errorf("%w: 10.0.0.1:443", ErrCovertBlocklisted), covertErrBlocklisted},
+		{fmt.Errorf("%w: tls: handshake failure", ErrCovertTLSHandshake), covertErrTLSHandshake},
+		{fmt.Errorf("covert dial: %w", opErr("connect", syscall.ECONNREFUSED)), covertErrConnRefused},
+		{errors.New("no covert address to dial"), covertErrOther},
+	} {
+		require.Equal(t, c.class, classifyCovertErr(c.err), c.err.Error())
+	}
+}
+
+// Errors of real connections to a closed port and to a covert that does not
+// speak TLS.
+func TestClassifyCovertErrLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().String()
+	go serveEcho(ln)
+
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	conn.Write(make([]byte, 64))
+	err = tls.Client(conn, &tls.Config{ServerName: "covert.example"}).Handshake()
+	require.NotNil(t, err)
+	require.Equal(t, covertErrTLS, classifyCovertErr(err))
+	conn.Close()
+
+	ln.Close()
+	_, err = net.Dial("tcp", addr)
+	require.NotNil(t, err)
+	require.Equal(t, covertErrConnRefused, classifyCovertErr(err))
+}
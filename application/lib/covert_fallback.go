@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// defaultCovertDialDeadline bounds all attempts of a session's covert dial,
+// in milliseconds, when covert_dial_deadline is not set.
+const defaultCovertDialDeadline = 15000
+
+// ErrCovertDialDeadline is wrapped by errors of covert dials that ran out of
+// the covert dial deadline. It is classified as a timeout.
+var ErrCovertDialDeadline = fmt.Errorf("covert dial deadline exceeded: %w", os.ErrDeadlineExceeded)
+
+// Outcomes of covert dials that moved on to a fallback covert, the label of
+// metrics.CovertFallbackDials.
+const (
+	covertFallbackOK       = "ok"
+	covertFallbackFailed   = "failed"
+	covertFallbackDeadline = "deadline"
+)
+
+func (c *Config) parseCovertFallbacks() error {
+	if c.CovertDialDeadline == 0 {
+		c.CovertDialDeadline = defaultCovertDialDeadline
+	}
+	if c.CovertDialDeadline < 0 {
+		return fmt.Errorf("bad covert_dial_deadline %d, expected milliseconds", c.CovertDialDeadline)
+	}
+	for covert, fallbacks := range c.CovertFallbacks {
+		for _, fallback := range fallbacks {
+			_, port, err := net.SplitHostPort(fallback)
+			if err != nil {
+				return fmt.Errorf("covert_fallbacks %q: bad fallback %q: %v", covert, fallback, err)
+			}
+			if c.IsBlocklisted(fallback) {
+				return fmt.Errorf("covert_fallbacks %q: fallback %q is blocklisted", covert, fallback)
+			}
+			if c.CovertStrictTLS && port != "443" {
+				return fmt.Errorf("covert_fallbacks %q: fallback %q is not on port 443, required by covert_strict_tls", covert, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+// SetCovertFallbacks gives reg the fallback coverts configured for its covert,
+// see ProxyConfig.CovertFallbacks, leaving out those the covert policy denies
+// since it was last reloaded.
+func (c *Config) SetCovertFallbacks(reg *DecoyRegistration) {
+	for _, fallback := range c.CovertFallbacks[reg.Covert] {
+		if !c.IsBlocklisted(fallback) {
+			reg.CovertFallbacks = append(reg.CovertFallbacks, fallback)
+		}
+	}
+}
+
+func (c *ProxyConfig) covertDialDeadline() time.Duration {
+	if c == nil || c.CovertDialDeadline <= 0 {
+		return defaultCovertDialDeadline * time.Millisecond
+	}
+	return time.Duration(c.CovertDialDeadline) * time.Millisecond
+}
+
+// covertAttemptTimeout returns the timeout of a covert connect attempt that
+// must end by deadline (zero for none): the covert connect timeout, cut short
+// to what is left of deadline. It fails once deadline has passed.
+func (c *ProxyConfig) covertAttemptTimeout(deadline time.Time) (time.Duration, error) {
+	timeout := c.covertConnectTimeout()
+	if deadline.IsZero() {
+		return timeout, nil
+	}
+	left := deadline.Sub(c.getClock().Now())
+	if left <= 0 {
+		return 0, ErrCovertDialDeadline
+	}
+	if timeout == 0 || left < timeout {
+		timeout = left
+	}
+	return timeout, nil
+}
+
+// covertRetryable reports whether err, an error dialing a covert, is worth
+// trying a fallback covert for: a failed lookup, a refused, timed out or reset
+// connect, a covert that is the station itself or has no address in its IP
+// family, or a failed TLS handshake of the station's own.
+func covertRetryable(err error) bool {
+	if errors.Is(err, ErrCovertFamily) {
+		return true
+	}
+	switch classifyCovertErr(err) {
+	case covertErrDNS, covertErrConnRefused, covertErrTimeout, covertErrReset, covertErrLoop, covertErrTLSHandshake:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialCovertFallbacks connects to covert for a session of reg as dialCovertTo
+// does, with every attempt bounded by the covert dial deadline. If covert is
+// the registration's own and dialing it fails with a retryable error (see
+// covertRetryable), the fallback coverts of reg are tried in order until one
+// connects. It returns the covert connected to and which attempt it was, 1 for
+// covert itself and 2 on for the fallbacks. With the embedded covert running
+// (see ProxyConfig.CovertEcho) it is dialed instead, as covert.
+func dialCovertFallbacks(reg *DecoyRegistration, covert string, id uint64, conf *ProxyConfig, logger *Logger) (conn net.Conn, dialed string, attempt int, err error) {
+	// The embedded covert stands in for every covert, and its dials are none
+	// of theirs to count.
+	if conf.covertEchoing() {
+		conn, err = conf.covertEcho.dial()
+		if err != nil {
+			return nil, covert, 0, err
+		}
+		return conn, covert, 1, nil
+	}
+	defer func() { Stat().AddCovertDial(err == nil) }()
+
+	coverts := []string{covert}
+	if covert == reg.Covert {
+		coverts = append(coverts, reg.CovertFallbacks...)
+	}
+	redact := conf != nil && conf.RedactCovert
+	deadline := conf.getClock().Now().Add(conf.covertDialDeadline())
+	fellBack := false
+	for i, c := range coverts {
+		if i > 0 {
+			if !covertRetryable(err) {
+				break
+			}
+			if !conf.getClock().Now().Before(deadline) {
+				metrics.CovertFallbackDials.Inc(covertFallbackDeadline)
+				return nil, covert, 0, fmt.Errorf("%w after %d coverts: %v", ErrCovertDialDeadline, i, err)
+			}
+			fellBack = true
+			logger.Infof("covert dial conn=%d falling back to covert=%s attempt=%d/%d", id,
+				redactCovertAddr(c, redact), i+1, len(coverts))
+		}
+		conn, err = dialCovertTo(reg, c, id, deadline, conf, logger)
+		if err == nil {
+			if i > 0 {
+				metrics.CovertFallbackDials.Inc(covertFallbackOK)
+				Stat().AddCovertFallbackDial()
+			}
+			return conn, c, i + 1, nil
+		}
+	}
+	if fellBack {
+		metrics.CovertFallbackDials.Inc(covertFallbackFailed)
+	}
+	return nil, covert, 0, err
+}
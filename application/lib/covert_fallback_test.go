@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertFallbacksParse(t *testing.T) {
+	c := &Config{}
+	c.CovertBlocklistSubnets = []string{"192.0.2.0/24"}
+	c.parseBlocklists()
+	require.Nil(t, c.parseCovertFallbacks())
+	require.Equal(t, defaultCovertDialDeadline, c.CovertDialDeadline)
+
+	for name, fallbacks := range map[string][]string{
+		"no port":     {"covert.example.com"},
+		"blocklisted": {"192.0.2.1:443"},
+	} {
+		c.CovertFallbacks = map[string][]string{"covert.example.com:443": fallbacks}
+		require.NotNil(t, c.parseCovertFallbacks(), name)
+	}
+
+	c.CovertFallbacks = map[string][]string{"covert.example.com:443": {"198.51.100.1:80"}}
+	require.Nil(t, c.parseCovertFallbacks())
+	c.CovertStrictTLS = true
+	require.NotNil(t, c.parseCovertFallbacks())
+
+	c = &Config{}
+	c.CovertDialDeadline = -1
+	require.NotNil(t, c.parseCovertFallbacks())
+
+	c = &Config{}
+	c.CovertFallbacks = map[string][]string{"covert.example.com:443": {"198.51.100.1:443"}}
+	reg := &DecoyRegistration{Covert: "covert.example.com:443"}
+	c.SetCovertFallbacks(reg)
+	require.Equal(t, []string{"198.51.100.1:443"}, reg.CovertFallbacks)
+	reg = &DecoyRegistration{Covert: "other.example.com:443"}
+	c.SetCovertFallbacks(reg)
+	require.Nil(t, reg.CovertFallbacks)
+}
+
+func TestCovertAttemptTimeout(t *testing.T) {
+	conf := &ProxyConfig{CovertConnectTimeout: 5000}
+	timeout, err := conf.covertAttemptTimeout(time.Time{})
+	require.Nil(t, err)
+	require.Equal(t, 5*time.Second, timeout)
+
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	conf.clock = clk
+	deadline := clk.Now().Add(8 * time.Second)
+	timeout, err = conf.covertAttemptTimeout(deadline)
+	require.Nil(t, err)
+	require.Equal(t, 5*time.Second, timeout)
+
+	clk.Advance(7 * time.Second)
+	timeout, err = conf.covertAttemptTimeout(deadline)
+	require.Nil(t, err)
+	require.Equal(t, time.Second, timeout)
+
+	clk.Advance(time.Second)
+	_, err = conf.covertAttemptTimeout(deadline)
+	require.True(t, errors.Is(err, ErrCovertDialDeadline))
+	require.Equal(t, covertErrTimeout, classifyCovertErr(err))
+}
+
+func TestDialCovertFallbacks(t *testing.T) {
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+	covert, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	go serveEcho(covert)
+
+	// Nothing listens on a port we just closed.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	refused := closed.Addr().String()
+	closed.Close()
+
+	t.Run("fallback", func(t *testing.T) {
+		ok := metrics.CovertFallbackDials.Value(covertFallbackOK)
+		reg := &DecoyRegistration{Covert: refused, CovertFallbacks: []string{refused, covert.Addr().String()}}
+		conn, dialed, attempt, err := dialCovertFallbacks(reg, reg.Covert, 1, nil, logger)
+		require.Nil(t, err)
+		conn.Close()
+		require.Equal(t, covert.Addr().String(), dialed)
+		require.Equal(t, 3, attempt)
+		require.Equal(t, ok+1, metrics.CovertFallbackDials.Value(covertFallbackOK))
+	})
+
+	t.Run("primary", func(t *testing.T) {
+		reg := &DecoyRegistration{Covert: covert.Addr().String(), CovertFallbacks: []string{refused}}
+		conn, dialed, attempt, err := dialCovertFallbacks(reg, reg.Covert, 2, nil, logger)
+		require.Nil(t, err)
+		conn.Close()
+		require.Equal(t, covert.Addr().String(), dialed)
+		require.Equal(t, 1, attempt)
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		reg := &DecoyRegistration{Covert: "no port", CovertFallbacks: []string{covert.Addr().String()}}
+		_, _, _, err := dialCovertFallbacks(reg, reg.Covert, 3, nil, logger)
+		require.NotNil(t, err)
+	})
+
+	t.Run("other covert", func(t *testing.T) {
+		// Mux streams to coverts other than the registration's get no
+		// fallbacks.
+		reg := &DecoyRegistration{Covert: covert.Addr().String(), CovertFallbacks: []string{covert.Addr().String()}}
+		_, _, _, err := dialCovertFallbacks(reg, refused, 4, nil, logger)
+		require.NotNil(t, err)
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		failed := metrics.CovertFallbackDials.Value(covertFallbackFailed)
+		reg := &DecoyRegistration{Covert: refused, CovertFallbacks: []string{refused}}
+		_, _, _, err := dialCovertFallbacks(reg, reg.Covert, 5, nil, logger)
+		require.Equal(t, covertErrConnRefused, classifyCovertErr(err))
+		require.Equal(t, failed+1, metrics.CovertFallbackDials.Value(covertFallbackFailed))
+	})
+}
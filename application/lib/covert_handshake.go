@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Handshakes the station completes with a covert that is a proxy, the
+// Handshake of a CovertPreambleConfig.
+const (
+	CovertHandshakeSOCKS5      = "socks5"
+	CovertHandshakeHTTPConnect = "http_connect"
+)
+
+// maxCovertHandshakeHead is the longest HTTP CONNECT response head read, its
+// final blank line included.
+const maxCovertHandshakeHead = 8192
+
+// parseHandshake checks the handshake settings of the preamble, once its
+// write and expect are parsed.
+func (p *CovertPreambleConfig) parseHandshake() error {
+	switch p.Handshake {
+	case "":
+		if p.Target != "" {
+			return fmt.Errorf("target is only used with a handshake")
+		}
+		return nil
+	case CovertHandshakeSOCKS5:
+	case CovertHandshakeHTTPConnect:
+		if p.Target == "" {
+			return fmt.Errorf("the %s handshake needs a target", p.Handshake)
+		}
+	default:
+		return fmt.Errorf("unknown handshake %q", p.Handshake)
+	}
+	if len(p.write) > 0 || len(p.expect) > 0 || p.ExpectLine {
+		return fmt.Errorf("a handshake replaces write and expect, they must not be set")
+	}
+	if p.Target == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(p.Target)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil || host == "" || len(host) > 255 || strings.ContainsAny(p.Target, " \t\r\n") {
+		return fmt.Errorf("bad target %q", p.Target)
+	}
+	return nil
+}
+
+// runHandshake completes the handshake with conn, authenticating with creds
+// unless nil, see run.
+func (p *CovertPreambleConfig) runHandshake(conn net.Conn, creds *CovertCredentials) error {
+	// As for the expected reply, the connection is closed should the
+	// handshake be late.
+	timer := time.AfterFunc(time.Duration(p.ExpectTimeout)*time.Millisecond, func() { conn.Close() })
+	var reason string
+	var err error
+	switch p.Handshake {
+	case CovertHandshakeSOCKS5:
+		reason, err = socks5Handshake(conn, p.Target, creds)
+	case CovertHandshakeHTTPConnect:
+		reason, err = httpConnectHandshake(conn, p.Target, creds)
+	}
+	if !timer.Stop() {
+		metrics.CovertPreambleFailures.Inc(covertPreambleTimeout)
+		return fmt.Errorf("%w: %s handshake not done within %dms", ErrCovertPreamble, p.Handshake, p.ExpectTimeout)
+	}
+	if err != nil {
+		metrics.CovertPreambleFailures.Inc(reason)
+		return fmt.Errorf("%w: %s handshake: %v", ErrCovertPreamble, p.Handshake, err)
+	}
+	return nil
+}
+
+// socks5Handshake authenticates to the SOCKS5 proxy conn with creds, using
+// the username/password method of RFC 1929, or with no authentication if
+// creds is nil, then asks it to connect to target unless empty. It returns
+// the reason of a failure, for metrics.CovertPreambleFailures. Errors never
+// include the credentials.
+func socks5Handshake(conn net.Conn, target string, creds *CovertCredentials) (string, error) {
+	method := byte(0) // no authentication
+	if creds != nil {
+		method = 2 // username/password
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return covertPreambleWrite, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return covertPreambleRead, err
+	}
+	if reply[0] != 5 {
+		return covertPreambleMismatch, fmt.Errorf("unexpected version %d", reply[0])
+	}
+	if reply[1] != method {
+		return covertPreambleAuth, fmt.Errorf("covert refused authentication method %d", method)
+	}
+
+	if creds != nil {
+		auth := make([]byte, 0, 3+len(creds.Username)+len(creds.Password))
+		auth = append(auth, 1, byte(len(creds.Username)))
+		auth = append(auth, creds.Username...)
+		auth = append(auth, byte(len(creds.Password)))
+		auth = append(auth, creds.Password...)
+		_, err := conn.Write(auth)
+		zero(auth)
+		if err != nil {
+			return covertPreambleWrite, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return covertPreambleRead, err
+		}
+		if reply[1] != 0 {
+			return covertPreambleAuth, fmt.Errorf("covert rejected the registration's credentials")
+		}
+	}
+	if target == "" {
+		return "", nil
+	}
+
+	host, portText, _ := net.SplitHostPort(target)
+	port, _ := strconv.ParseUint(portText, 10, 16)
+	req := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		req = append(append(req, 1), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 4), ip.To16()...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return covertPreambleWrite, err
+	}
+
+	// The reply ends with the address the proxy bound, which is discarded.
+	var head [5]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return covertPreambleRead, err
+	}
+	if head[1] != 0 {
+		return covertPreambleMismatch, fmt.Errorf("covert refused to connect to %s: reply %d", target, head[1])
+	}
+	var rest int
+	switch head[3] {
+	case 1:
+		rest = net.IPv4len - 1 + 2
+	case 4:
+		rest = net.IPv6len - 1 + 2
+	case 3:
+		rest = int(head[4]) + 2
+	default:
+		return covertPreambleMismatch, fmt.Errorf("unexpected address type %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, rest)); err != nil {
+		return covertPreambleRead, err
+	}
+	return "", nil
+}
+
+// httpConnectHandshake asks the HTTP proxy conn to connect to target, with a
+// Proxy-Authorization header of basic authentication with creds unless nil.
+// It returns the reason of a failure, for metrics.CovertPreambleFailures.
+// Errors never include the credentials.
+func httpConnectHandshake(conn net.Conn, target string, creds *CovertCredentials) (string, error) {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if creds != nil {
+		if strings.Contains(creds.Username, ":") {
+			return covertPreambleAuth, fmt.Errorf("the registration's username contains a colon")
+		}
+		auth := []byte(creds.Username + ":" + creds.Password)
+		req.WriteString("Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString(auth) + "\r\n")
+		zero(auth)
+	}
+	req.WriteString("\r\n")
+	_, err := conn.Write(req.Bytes())
+	zero(req.Bytes())
+	if err != nil {
+		return covertPreambleWrite, err
+	}
+
+	head, err := readHTTPHead(conn)
+	if err != nil {
+		return covertPreambleRead, err
+	}
+	status := head
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		status = head[:i]
+	}
+	status = bytes.TrimRight(status, "\r")
+	fields := strings.Fields(string(status))
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return covertPreambleMismatch, fmt.Errorf("unexpected reply %q", status)
+	}
+	switch {
+	case fields[1] == "407" && creds == nil:
+		return covertPreambleAuth, fmt.Errorf("covert requires credentials, the registration has none")
+	case fields[1] == "407":
+		return covertPreambleAuth, fmt.Errorf("covert rejected the registration's credentials")
+	case len(fields[1]) != 3 || fields[1][0] != '2':
+		return covertPreambleMismatch, fmt.Errorf("unexpected reply %q", status)
+	}
+	return "", nil
+}
+
+// readHTTPHead reads a response head, up to and including the blank line
+// ending it. It is read a byte at a time so that none of the covert's data
+// after it is consumed.
+func readHTTPHead(conn net.Conn) ([]byte, error) {
+	var head []byte
+	var b [1]byte
+	for len(head) < maxCovertHandshakeHead {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return head, err
+		}
+		head = append(head, b[0])
+		if bytes.HasSuffix(head, []byte("\n\r\n")) || bytes.HasSuffix(head, []byte("\n\n")) {
+			return head, nil
+		}
+	}
+	return head, fmt.Errorf("response head longer than %d bytes", maxCovertHandshakeHead)
+}
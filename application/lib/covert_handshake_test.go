@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertHandshakeParse(t *testing.T) {
+	conf := &ProxyConfig{CovertPreamble: map[string]*CovertPreambleConfig{
+		"socks.example:1080": {Handshake: CovertHandshakeSOCKS5},
+		"proxy.example:3128": {Handshake: CovertHandshakeHTTPConnect, Target: "[2001:db8::1]:443"},
+	}}
+	require.Nil(t, conf.parseCovertPreambles())
+
+	for _, bad := range []*CovertPreambleConfig{
+		{Handshake: "socks4"},
+		{Target: "backend.example:443"},
+		{Handshake: CovertHandshakeHTTPConnect},
+		{Handshake: CovertHandshakeSOCKS5, WriteHex: "050100"},
+		{Handshake: CovertHandshakeSOCKS5, ExpectLine: true},
+		{Handshake: CovertHandshakeSOCKS5, Target: "backend.example"},
+		{Handshake: CovertHandshakeSOCKS5, Target: "backend.example:65536"},
+		{Handshake: CovertHandshakeHTTPConnect, Target: "backend.example:443\r\nX: y"},
+	} {
+		conf := &ProxyConfig{CovertPreamble: map[string]*CovertPreambleConfig{"a.example:443": bad}}
+		require.NotNil(t, conf.parseCovertPreambles(), "%+v", bad)
+	}
+}
+
+// lockedBuffer is a buffer safe to log to while a test reads it.
+type lockedBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.String()
+}
+
+// socks5Covert is a SOCKS5 proxy accepting user:pass, or no authentication
+// if user is empty, that echoes once connected. connected receives the
+// CONNECT request, if the station sends one before the client's data.
+func socks5Covert(user, pass string, connected chan<- []byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		if user == "" {
+			if greeting[2] != 0 {
+				conn.Write([]byte{5, 0xff})
+				return
+			}
+			conn.Write([]byte{5, 0})
+		} else {
+			if greeting[2] != 2 {
+				conn.Write([]byte{5, 0xff})
+				return
+			}
+			conn.Write([]byte{5, 2})
+			head := make([]byte, 2)
+			io.ReadFull(conn, head)
+			u := make([]byte, head[1])
+			io.ReadFull(conn, u)
+			io.ReadFull(conn, head[:1])
+			p := make([]byte, head[0])
+			io.ReadFull(conn, p)
+			if string(u) != user || string(p) != pass {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+		if connected != nil {
+			req := make([]byte, 4+4+2)
+			io.ReadFull(conn, req)
+			connected <- req
+			conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0x1f, 0x90})
+		}
+		io.Copy(conn, conn)
+	}
+}
+
+// echoed writes ping through client and requires it echoed back.
+func echoed(t *testing.T, client net.Conn) {
+	_, err := client.Write([]byte("ping"))
+	require.Nil(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(client, b)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(b))
+}
+
+func TestProxyCovertHandshakeSOCKS5(t *testing.T) {
+	creds := &CovertCredentials{Username: "alice", Password: "s3cret-pw"}
+
+	t.Run("credentials", func(t *testing.T) {
+		connected := make(chan []byte, 1)
+		covert := preambleCovert(t, socks5Covert("alice", "s3cret-pw", connected))
+		preamble := &CovertPreambleConfig{Handshake: CovertHandshakeSOCKS5, Target: "192.0.2.9:443"}
+		echoed(t, preambleProxyLogged(t, covert, preamble, creds, ioutil.Discard))
+		require.Equal(t, []byte{5, 1, 0, 1, 192, 0, 2, 9, 1, 187}, <-connected)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		// Without a target the client talks to the proxy once authenticated.
+		covert := preambleCovert(t, socks5Covert("", "", nil))
+		echoed(t, preambleProxy(t, covert, &CovertPreambleConfig{Handshake: CovertHandshakeSOCKS5}))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		before := metrics.CovertPreambleFailures.Value(covertPreambleAuth)
+		var logs lockedBuffer
+		covert := preambleCovert(t, socks5Covert("alice", "another", nil))
+		client := preambleProxyLogged(t, covert, &CovertPreambleConfig{Handshake: CovertHandshakeSOCKS5}, creds, &logs)
+		b, _ := ioutil.ReadAll(client)
+		require.Empty(t, b)
+		require.Equal(t, before+1, metrics.CovertPreambleFailures.Value(covertPreambleAuth))
+		require.Contains(t, logs.String(), "rejected the registration's credentials")
+		require.False(t, strings.Contains(logs.String(), "s3cret-pw"), logs.String())
+	})
+}
+
+// httpConnectCovert is an HTTP proxy answering CONNECT requests with
+// the status of respond, then echoing. requests receives the requests.
+func httpConnectCovert(respond func(*http.Request) int, requests chan<- *http.Request) func(net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- req
+		status := respond(req)
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nVia: test\r\n\r\n", status, http.StatusText(status))
+		if status == http.StatusOK {
+			io.Copy(conn, br)
+		}
+	}
+}
+
+func TestProxyCovertHandshakeHTTPConnect(t *testing.T) {
+	creds := &CovertCredentials{Username: "alice", Password: "s3cret-pw"}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret-pw"))
+	authenticate := func(req *http.Request) int {
+		if req.Header.Get("Proxy-Authorization") != basic {
+			return http.StatusProxyAuthRequired
+		}
+		return http.StatusOK
+	}
+	preamble := func() *CovertPreambleConfig {
+		return &CovertPreambleConfig{Handshake: CovertHandshakeHTTPConnect, Target: "backend.example:443"}
+	}
+
+	t.Run("credentials", func(t *testing.T) {
+		requests := make(chan *http.Request, 1)
+		covert := preambleCovert(t, httpConnectCovert(authenticate, requests))
+		echoed(t, preambleProxyLogged(t, covert, preamble(), creds, ioutil.Discard))
+		req := <-requests
+		require.Equal(t, http.MethodConnect, req.Method)
+		require.Equal(t, "backend.example:443", req.Host)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		requests := make(chan *http.Request, 1)
+		covert := preambleCovert(t, httpConnectCovert(func(*http.Request) int { return http.StatusOK }, requests))
+		echoed(t, preambleProxy(t, covert, preamble()))
+		require.Equal(t, "", (<-requests).Header.Get("Proxy-Authorization"))
+	})
+
+	for name, c := range map[string]*CovertCredentials{
+		"rejected": {Username: "alice", Password: "wrong-s3cret"},
+		"required": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			before := metrics.CovertPreambleFailures.Value(covertPreambleAuth)
+			var logs lockedBuffer
+			covert := preambleCovert(t, httpConnectCovert(authenticate, make(chan *http.Request, 1)))
+			client := preambleProxyLogged(t, covert, preamble(), c, &logs)
+			b, _ := ioutil.ReadAll(client)
+			require.Empty(t, b)
+			require.Equal(t, before+1, metrics.CovertPreambleFailures.Value(covertPreambleAuth))
+			require.Contains(t, logs.String(), "http_connect handshake: covert re")
+			require.False(t, strings.Contains(logs.String(), "s3cret"), logs.String())
+		})
+	}
+}
+
+func TestCovertCredentialsRedacted(t *testing.T) {
+	creds := &CovertCredentials{Username: "alice", Password: "s3cret-pw"}
+	reg := &DecoyRegistration{CovertCredentials: creds}
+	for _, s := range []string{
+		fmt.Sprintf("%v %s %+v %#v", creds, creds, *creds, *creds),
+		fmt.Sprintf("%+v", reg.CovertCredentials),
+	} {
+		require.False(t, strings.Contains(s, "alice") || strings.Contains(s, "s3cret"), s)
+	}
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ErrCovertLoop is wrapped by errors for covert addresses that loop back to
+// the station, a listener of the station itself or an address in its phantom
+// subnets: proxying to one would feed the station its own connections in a
+// loop, until it runs out of file descriptors.
+var ErrCovertLoop = errors.New("covert loops to the station")
+
+// ErrCovertBlocklisted is wrapped by errors for covert host names resolving
+// to an address in the covert blocklist, which only the names themselves
+// were checked against at registration.
+var ErrCovertBlocklisted = errors.New("covert resolves to a blocklisted address")
+
+// Kinds of covert loops, the kind label of metrics.CovertLoops.
+const (
+	covertLoopListener = "listener"
+	covertLoopPhantom  = "phantom"
+	covertLoopLocal    = "local"
+)
+
+// interfaceAddrs returns the addresses of the host's interfaces, replaced in
+// tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// covertSelfAddrs is the set of addresses the station's listeners are
+// reachable on, see ProxyConfig.CovertSelfAddrs.
+type covertSelfAddrs struct {
+	// "ip:port" of the listeners on every interface address and of
+	// CovertSelfAddrs
+	addrs map[string]bool
+	// ports listened on on all addresses, which loopback and unspecified
+	// addresses reach whether or not they are an interface's
+	anyPorts map[int]bool
+	// the interface addresses, at any port
+	local map[string]bool
+	// the covert blocklist subnets, see Config.IsBlocklisted
+	blocked []*net.IPNet
+}
+
+func normalizeHostPort(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// parseCovertSelfAddrs collects the addresses of the station's listeners, of
+// ListenAddrs on the interface addresses (as the host has them at startup)
+// and CovertSelfAddrs, and the interface addresses themselves. It must run
+// after the covert blocklist is parsed.
+func (c *Config) parseCovertSelfAddrs() error {
+	self := &covertSelfAddrs{
+		addrs:    make(map[string]bool),
+		anyPorts: make(map[int]bool),
+		local:    make(map[string]bool),
+		blocked:  c.covertBlocklistSubnets,
+	}
+	listen := c.ListenAddrs
+	if len(listen) == 0 {
+		listen = []string{defaultListenAddr}
+	}
+	var localIPs []net.IP
+	if ifAddrs, err := interfaceAddrs(); err == nil {
+		for _, a := range ifAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				localIPs = append(localIPs, ipNet.IP)
+				self.local[ipNet.IP.String()] = true
+			}
+		}
+	}
+	var ports []int
+	for _, addr := range listen {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("bad listen address %q: %v", addr, err)
+		}
+		ports = append(ports, tcpAddr.Port)
+		if tcpAddr.IP != nil && !tcpAddr.IP.IsUnspecified() {
+			self.addrs[normalizeHostPort(tcpAddr.IP, tcpAddr.Port)] = true
+			continue
+		}
+		self.anyPorts[tcpAddr.Port] = true
+		for _, ip := range localIPs {
+			self.addrs[normalizeHostPort(ip, tcpAddr.Port)] = true
+		}
+	}
+	for _, addr := range c.CovertSelfAddrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			for _, port := range ports {
+				self.addrs[normalizeHostPort(ip, port)] = true
+			}
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		n, perr := strconv.Atoi(port)
+		if err != nil || ip == nil || perr != nil {
+			return fmt.Errorf("bad covert_self_addrs address %q, expected ip or ip:port", addr)
+		}
+		self.addrs[normalizeHostPort(ip, n)] = true
+	}
+	c.covertSelf = self
+	return nil
+}
+
+// isCovertSelf reports whether addr, a resolved covert "ip:port", is a
+// listener of the station. conf may be nil.
+func (c *ProxyConfig) isCovertSelf(addr string) bool {
+	if c == nil || c.covertSelf == nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return false
+	}
+	if (ip.IsLoopback() || ip.IsUnspecified()) && c.covertSelf.anyPorts[n] {
+		return true
+	}
+	return c.covertSelf.addrs[normalizeHostPort(ip, n)]
+}
+
+// SetPhantomSubnets makes coverts in the phantom subnets of any generation of
+// selector loops, as the station's redirect would hand connections to them
+// back to the station. It must be called before sessions are proxied.
+func (c *ProxyConfig) SetPhantomSubnets(selector *PhantomIPSelector) error {
+	subnets, err := selector.allSubnets()
+	if err != nil {
+		return err
+	}
+	c.covertPhantoms = subnets
+	return nil
+}
+
+// covertLoop returns the kind of loop addr, a resolved covert "ip:port", is,
+// empty if it is none: a listener of the station, a phantom address, or
+// once the config is parsed any other address of the host (loopback,
+// unspecified, link-local or an interface's), whatever the port. conf may be
+// nil.
+func (c *ProxyConfig) covertLoop(addr string) string {
+	if c == nil {
+		return ""
+	}
+	if c.isCovertSelf(addr) {
+		return covertLoopListener
+	}
+	ip := hostPortIP(addr)
+	if ip == nil {
+		return ""
+	}
+	for _, subnet := range c.covertPhantoms {
+		if subnet.Contains(ip) {
+			return covertLoopPhantom
+		}
+	}
+	if c.covertSelf != nil && (ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || c.covertSelf.local[ip.String()]) {
+		return covertLoopLocal
+	}
+	return ""
+}
+
+// covertBlocklisted reports whether addr, a resolved covert "ip:port", is in
+// the covert blocklist subnets. conf may be nil.
+func (c *ProxyConfig) covertBlocklisted(addr string) bool {
+	if c == nil || c.covertSelf == nil {
+		return false
+	}
+	ip := hostPortIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range c.covertSelf.blocked {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPortIP returns the IP of addr, an "ip:port", in its 4-byte form if it
+// is IPv4, nil if addr is none.
+func hostPortIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
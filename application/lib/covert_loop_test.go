@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertSelfAddrs(t *testing.T) {
+	defer func() { interfaceAddrs = net.InterfaceAddrs }()
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("198.51.100.7"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::7"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+
+	c := &Config{}
+	c.ListenAddrs = []string{":41245", "10.0.0.1:8443"}
+	c.CovertSelfAddrs = []string{"203.0.113.9", "203.0.113.10:443"}
+	require.Nil(t, c.parseCovertSelfAddrs())
+	for addr, self := range map[string]bool{
+		"198.51.100.7:41245":  true,
+		"[2001:db8::7]:41245": true,
+		"127.0.0.2:41245":     true, // all of loopback is the host's
+		"0.0.0.0:41245":       true,
+		"10.0.0.1:8443":       true,
+		"203.0.113.9:41245":   true,
+		"203.0.113.9:8443":    true,
+		"203.0.113.10:443":    true,
+		"198.51.100.7:8443":   false, // only listening on 10.0.0.1
+		"198.51.100.7:443":    false,
+		"127.0.0.1:8443":      false,
+		"203.0.113.10:41245":  false,
+		"192.0.2.1:41245":     false,
+	} {
+		require.Equal(t, self, c.isCovertSelf(addr), addr)
+	}
+
+	c.CovertSelfAddrs = []string{"station.example:443"}
+	require.NotNil(t, c.parseCovertSelfAddrs())
+}
+
+// A covert pointing at the station's own listener is never dialed.
+func TestProxyCovertLoop(t *testing.T) {
+	station, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer station.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := station.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	c := &Config{}
+	c.ListenAddrs = []string{station.Addr().String()}
+	require.Nil(t, c.parseCovertSelfAddrs())
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = station.Addr().String()
+
+	loops := metrics.CovertDialFailures.Value(covertErrLoop)
+	listenerLoops := metrics.CovertLoops.Value(covertLoopListener)
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, &c.ProxyConfig)
+		stationClient.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session to the station's own listener not refused")
+	}
+	require.Equal(t, loops+1, metrics.CovertDialFailures.Value(covertErrLoop))
+	require.Equal(t, listenerLoops+1, metrics.CovertLoops.Value(covertLoopListener))
+	require.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+
+	conn, err := dialCovert(reg, 1, &c.ProxyConfig, &Logger{log.New(ioutil.Discard, "", 0)})
+	require.Nil(t, conn)
+	require.True(t, errors.Is(err, ErrCovertLoop))
+}
+
+func TestCovertLoopPhantomSubnets(t *testing.T) {
+	c := &Config{}
+	c.ListenAddrs = []string{"10.0.0.1:8443"}
+	require.Nil(t, c.parseCovertSelfAddrs())
+	selector := &PhantomIPSelector{Networks: map[uint]*SubnetConfig{
+		1: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24", "2001:db8::/32"}}}},
+		2: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24"}}}},
+	}}
+	require.Nil(t, c.SetPhantomSubnets(selector))
+	require.Len(t, c.covertPhantoms, 2)
+	for addr, loop := range map[string]string{
+		"10.0.0.1:8443":           covertLoopListener,
+		"192.0.2.77:443":          covertLoopPhantom,
+		"[::ffff:192.0.2.77]:443": covertLoopPhantom,
+		"[2001:db8::1:2]:80":      covertLoopPhantom,
+		"198.51.100.1:443":        "",
+		"[2001:db9::1]:443":       "",
+		"covert.example.com:443":  "",
+		"not an address":          "",
+	} {
+		require.Equal(t, loop, c.covertLoop(addr), addr)
+	}
+
+	selector.Networks[3] = &SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Subnets: []string{"bad"}}}}
+	require.NotNil(t, c.SetPhantomSubnets(selector))
+}
+
+// A covert that is a phantom address, which the station's redirect would hand
+// back to the station, is refused instead of spiraling.
+func TestProxyCovertPhantomLoop(t *testing.T) {
+	// The phantom's redirect target, standing in for the station's listener
+	// on another loopback address.
+	phantom, err := net.Listen("tcp", "127.0.0.2:0")
+	require.Nil(t, err)
+	defer phantom.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := phantom.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	conf := &ProxyConfig{}
+	require.Nil(t, conf.SetPhantomSubnets(&PhantomIPSelector{Networks: map[uint]*SubnetConfig{
+		1: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"127.0.0.2/32"}}}},
+	}}))
+	reg := newConnTagTestReg(t, net.ParseIP("127.0.0.2"))
+	reg.Covert = phantom.Addr().String()
+
+	loops := metrics.CovertLoops.Value(covertLoopPhantom)
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, conf)
+		stationClient.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session to a phantom address not refused")
+	}
+	require.Equal(t, loops+1, metrics.CovertLoops.Value(covertLoopPhantom))
+	require.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+}
+
+// Covert names are checked once resolved: one resolving to another loopback
+// address than the station's listener, or into the blocklist, is refused.
+func TestCovertLoopResolved(t *testing.T) {
+	covert, err := net.Listen("tcp", "127.0.0.2:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := covert.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(covert.Addr().String())
+
+	c := &Config{}
+	c.ListenAddrs = []string{"127.0.0.1:41245"}
+	c.CovertBlocklistSubnets = []string{"198.51.100.0/24"}
+	c.parseBlocklists()
+	require.Nil(t, c.parseCovertSelfAddrs())
+	resolver, err := NewCovertResolver("", false, 0, 0)
+	require.Nil(t, err)
+	resolver.system = func(host string) ([]string, error) {
+		return map[string][]string{
+			"loop.example":    {"127.0.0.2"},
+			"blocked.example": {"198.51.100.7"},
+		}[host], nil
+	}
+	c.covertResolver = resolver
+
+	for addr, loop := range map[string]string{
+		"127.0.0.2:443":      covertLoopLocal,
+		"0.0.0.0:443":        covertLoopLocal,
+		"[::1]:443":          covertLoopLocal,
+		"169.254.169.254:80": covertLoopLocal,
+		"[fe80::1]:443":      covertLoopLocal,
+		"192.0.2.1:443":      "",
+	} {
+		require.Equal(t, loop, c.covertLoop(addr), addr)
+	}
+
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+	localLoops := metrics.CovertLoops.Value(covertLoopLocal)
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = net.JoinHostPort("loop.example", port)
+	conn, err := dialCovert(reg, 1, &c.ProxyConfig, logger)
+	require.Nil(t, conn)
+	require.True(t, errors.Is(err, ErrCovertLoop), err)
+	require.Equal(t, localLoops+1, metrics.CovertLoops.Value(covertLoopLocal))
+	require.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+
+	reg.Covert = "blocked.example:443"
+	conn, err = dialCovert(reg, 1, &c.ProxyConfig, logger)
+	require.Nil(t, conn)
+	require.True(t, errors.Is(err, ErrCovertBlocklisted), err)
+}
+
+// Pre-warming a covert that loops to the station is refused as sessions are.
+func TestCovertPrewarmLoop(t *testing.T) {
+	station, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer station.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := station.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	c := &Config{}
+	c.ListenAddrs = []string{station.Addr().String()}
+	require.Nil(t, c.parseCovertSelfAddrs())
+
+	listenerLoops := metrics.CovertLoops.Value(covertLoopListener)
+	conn, err := c.ProxyConfig.dialPrewarm(station.Addr().String())
+	require.Nil(t, conn)
+	require.True(t, errors.Is(err, ErrCovertLoop))
+	require.Equal(t, listenerLoops+1, metrics.CovertLoops.Value(covertLoopListener))
+	require.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+const (
+	// defaultCovertMinClientTimeout is the CovertMinClientTimeout, in
+	// milliseconds, used when none is configured.
+	defaultCovertMinClientTimeout = 10000
+
+	// A TLS record header (type, version, length) and the largest record
+	// length allowed by RFC 8446 (TLSCiphertext, 2^14 + 256).
+	tlsRecordHeaderLen = 5
+	maxTLSRecordLen    = 16384 + 256
+)
+
+func (c *ProxyConfig) parseCovertMinClient() error {
+	if c.CovertMinClientBytes < 0 {
+		return fmt.Errorf("covert_min_client_bytes must not be negative")
+	}
+	if c.CovertMinClientTimeout <= 0 {
+		c.CovertMinClientTimeout = defaultCovertMinClientTimeout
+	}
+	return nil
+}
+
+// awaitClientData delays the covert dial until the client has sent
+// CovertMinClientBytes towards the covert, or a complete first TLS record
+// with CovertMinClientRecord, so that scans of a registered phantom never
+// reach the covert. It only peeks: the conn returned still reads everything
+// the client sent. Clients falling short within CovertMinClientTimeout are
+// counted as probable scans and an error is returned.
+func (c *ProxyConfig) awaitClientData(clientConn net.Conn) (net.Conn, error) {
+	if c == nil || (c.CovertMinClientBytes <= 0 && !c.CovertMinClientRecord) {
+		return clientConn, nil
+	}
+	size := c.CovertMinClientBytes
+	if c.CovertMinClientRecord && size < tlsRecordHeaderLen+maxTLSRecordLen {
+		size = tlsRecordHeaderLen + maxTLSRecordLen
+	}
+	r := bufio.NewReaderSize(clientConn, size)
+
+	clientConn.SetReadDeadline(time.Now().Add(time.Duration(c.CovertMinClientTimeout) * time.Millisecond))
+	defer clientConn.SetReadDeadline(time.Time{})
+	for {
+		peeked, _ := r.Peek(r.Buffered())
+		if c.CovertMinClientBytes > 0 && len(peeked) >= c.CovertMinClientBytes {
+			return makeBufferedReaderConn(clientConn, r), nil
+		}
+		if c.CovertMinClientRecord {
+			complete, ok := tlsRecordComplete(peeked)
+			if complete {
+				return makeBufferedReaderConn(clientConn, r), nil
+			}
+			if !ok && c.CovertMinClientBytes <= 0 {
+				if len(peeked) > tlsRecordHeaderLen {
+					peeked = peeked[:tlsRecordHeaderLen]
+				}
+				metrics.ProbableScans.Inc()
+				return nil, fmt.Errorf("probable scan: client sent a non-TLS record (%x)", peeked)
+			}
+		}
+		if _, err := r.Peek(len(peeked) + 1); err != nil {
+			metrics.ProbableScans.Inc()
+			return nil, fmt.Errorf("probable scan: client sent %d bytes before %v", r.Buffered(), err)
+		}
+	}
+}
+
+// tlsRecordComplete reports whether b starts with a whole TLS record, and
+// whether what it has of the record header looks valid.
+func tlsRecordComplete(b []byte) (complete, ok bool) {
+	if len(b) >= 1 && (b[0] < tlsRecordTypeChangeCipherSpec || b[0] > tlsRecordTypeApplicationData) {
+		return false, false
+	}
+	if len(b) >= 2 && b[1] != 3 {
+		return false, false
+	}
+	if len(b) < tlsRecordHeaderLen {
+		return false, true
+	}
+	n := int(b[3])<<8 | int(b[4])
+	if n == 0 || n > maxTLSRecordLen {
+		return false, false
+	}
+	return len(b) >= tlsRecordHeaderLen+n, true
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyCovertMinClient(t *testing.T) {
+	covert, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	dialed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := covert.Accept()
+			if err != nil {
+				return
+			}
+			dialed <- struct{}{}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// proxy proxies a new client connection with conf and returns the
+	// client's end and a channel closed once Proxy returned.
+	proxy := func(conf *ProxyConfig) (net.Conn, chan struct{}) {
+		require.Nil(t, conf.parseCovertMinClient())
+		client, stationClient := tcpPair(t)
+		reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: covert.Addr().String()}
+		logger := &Logger{log.New(ioutil.Discard, "", 0)}
+		done := make(chan struct{})
+		go func() {
+			Proxy(reg, stationClient, 443, nil, logger, conf)
+			stationClient.Close()
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		return client, done
+	}
+
+	t.Run("scanner", func(t *testing.T) {
+		before := metrics.ProbableScans.Value()
+		client, done := proxy(&ProxyConfig{CovertMinClientBytes: 16, CovertMinClientTimeout: 100})
+		defer client.Close()
+
+		_, err := client.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+		<-done
+		require.Len(t, dialed, 0)
+		require.Equal(t, before+1, metrics.ProbableScans.Value())
+	})
+
+	t.Run("client", func(t *testing.T) {
+		before := metrics.ProbableScans.Value()
+		client, _ := proxy(&ProxyConfig{CovertMinClientBytes: 16, CovertMinClientTimeout: 1000})
+		defer client.Close()
+
+		// The first write alone is short of the threshold, both are relayed.
+		_, err := client.Write([]byte("0123456789"))
+		require.Nil(t, err)
+		time.Sleep(50 * time.Millisecond)
+		require.Len(t, dialed, 0)
+		_, err = client.Write([]byte("abcdef"))
+		require.Nil(t, err)
+
+		echoed := make([]byte, 16)
+		_, err = io.ReadFull(client, echoed)
+		require.Nil(t, err)
+		require.Equal(t, "0123456789abcdef", string(echoed))
+		<-dialed
+		require.Equal(t, before, metrics.ProbableScans.Value())
+	})
+
+	t.Run("TLS record", func(t *testing.T) {
+		client, _ := proxy(&ProxyConfig{CovertMinClientRecord: true, CovertMinClientTimeout: 1000})
+		defer client.Close()
+
+		record := append([]byte{tlsRecordTypeHandshake, 3, 1, 0, 4}, "helo"...)
+		_, err := client.Write(record[:7])
+		require.Nil(t, err)
+		time.Sleep(50 * time.Millisecond)
+		require.Len(t, dialed, 0)
+		_, err = client.Write(record[7:])
+		require.Nil(t, err)
+
+		echoed := make([]byte, len(record))
+		_, err = io.ReadFull(client, echoed)
+		require.Nil(t, err)
+		require.Equal(t, record, echoed)
+		<-dialed
+	})
+
+	t.Run("not a TLS record", func(t *testing.T) {
+		before := metrics.ProbableScans.Value()
+		client, done := proxy(&ProxyConfig{CovertMinClientRecord: true, CovertMinClientTimeout: 1000})
+		defer client.Close()
+
+		_, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		require.Nil(t, err)
+		<-done
+		require.Len(t, dialed, 0)
+		require.Equal(t, before+1, metrics.ProbableScans.Value())
+	})
+}
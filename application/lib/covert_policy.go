@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Lists of a covert policy, the label of metrics.CovertPolicyRules.
+const (
+	covertPolicyAllow = "allow"
+	covertPolicyDeny  = "deny"
+)
+
+// covertPolicyFile is a covert policy file as written, see CovertPolicy.
+type covertPolicyFile struct {
+	AllowSubnets []string `toml:"allow_subnets"`
+	AllowDomains []string `toml:"allow_domains"`
+	DenySubnets  []string `toml:"deny_subnets"`
+	DenyDomains  []string `toml:"deny_domains"`
+}
+
+// covertRules are parsed covert allow and deny rules.
+type covertRules struct {
+	allowSubnets, denySubnets []*net.IPNet
+	allowDomains, denyDomains []*regexp.Regexp
+}
+
+func (r *covertRules) add(o *covertRules) {
+	r.allowSubnets = append(r.allowSubnets, o.allowSubnets...)
+	r.denySubnets = append(r.denySubnets, o.denySubnets...)
+	r.allowDomains = append(r.allowDomains, o.allowDomains...)
+	r.denyDomains = append(r.denyDomains, o.denyDomains...)
+}
+
+func (r *covertRules) allows() int { return len(r.allowSubnets) + len(r.allowDomains) }
+func (r *covertRules) denies() int { return len(r.denySubnets) + len(r.denyDomains) }
+
+func loadCovertPolicyFile(path string) (*covertRules, error) {
+	var f covertPolicyFile
+	if _, err := toml.DecodeFile(path, &f); err != nil {
+		return nil, err
+	}
+	var r covertRules
+	subnets := func(list []string, name string) ([]*net.IPNet, error) {
+		var parsed []*net.IPNet
+		for _, s := range list {
+			_, subnet, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			parsed = append(parsed, subnet)
+		}
+		return parsed, nil
+	}
+	domains := func(list []string, name string) ([]*regexp.Regexp, error) {
+		var parsed []*regexp.Regexp
+		for _, s := range list {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			parsed = append(parsed, re)
+		}
+		return parsed, nil
+	}
+	var err error
+	if r.allowSubnets, err = subnets(f.AllowSubnets, "allow_subnets"); err != nil {
+		return nil, err
+	}
+	if r.denySubnets, err = subnets(f.DenySubnets, "deny_subnets"); err != nil {
+		return nil, err
+	}
+	if r.allowDomains, err = domains(f.AllowDomains, "allow_domains"); err != nil {
+		return nil, err
+	}
+	if r.denyDomains, err = domains(f.DenyDomains, "deny_domains"); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// CovertPolicy is the covert allow and deny lists of every file matching a
+// set of glob patterns, merged. A covert matching any deny rule is denied.
+// Once any file has allow rules, a covert must also match one to be allowed:
+// covert IPs an allow_subnets rule, covert host names an allow_domains
+// pattern. Reload picks up changed, new and removed files; a file that fails
+// to load keeps its last good rules.
+type CovertPolicy struct {
+	patterns []string
+
+	reloadM sync.Mutex              // serializes Reload
+	files   map[string]*covertRules // last good rules, by path
+
+	m      sync.RWMutex // guards merged and files against readers
+	merged covertRules
+}
+
+// NewCovertPolicy loads the covert policy files matching patterns. Unlike
+// Reload it fails if any file does not load, there are no last good rules to
+// keep for it.
+func NewCovertPolicy(patterns []string) (*CovertPolicy, error) {
+	p := &CovertPolicy{patterns: patterns, files: make(map[string]*covertRules)}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reloads the files matching the policy's patterns. Files that fail to
+// load keep the rules they last loaded with (none if they never did) and are
+// returned as an error, the others take effect regardless. Files no longer
+// matching are dropped.
+func (p *CovertPolicy) Reload() error {
+	matched := make(map[string]bool)
+	for _, pattern := range p.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("bad covert policy pattern %q: %v", pattern, err)
+		}
+		for _, path := range paths {
+			matched[path] = true
+		}
+	}
+
+	// Files are read without blocking covert checks, which see either the
+	// old rules or the new ones.
+	p.reloadM.Lock()
+	defer p.reloadM.Unlock()
+
+	var failed []string
+	files := make(map[string]*covertRules, len(matched))
+	for path := range matched {
+		rules, err := loadCovertPolicyFile(path)
+		if err != nil {
+			metrics.CovertPolicyLoadErrors.Inc()
+			failed = append(failed, fmt.Sprintf("%s: %v", path, err))
+			rules = p.files[path]
+		}
+		if rules != nil {
+			files[path] = rules
+		}
+	}
+
+	// Merged in path order, so that rules are checked in the same order
+	// whatever order the files were in.
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var merged covertRules
+	for _, path := range paths {
+		merged.add(files[path])
+	}
+	p.m.Lock()
+	p.files, p.merged = files, merged
+	p.m.Unlock()
+	metrics.CovertPolicyRules.Set(float64(merged.allows()), covertPolicyAllow)
+	metrics.CovertPolicyRules.Set(float64(merged.denies()), covertPolicyDeny)
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to load covert policy files, keeping their last rules: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Rules returns the number of allow and deny rules in effect.
+func (p *CovertPolicy) Rules() (allow, deny int) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.merged.allows(), p.merged.denies()
+}
+
+// Files returns the number of files the policy has rules from.
+func (p *CovertPolicy) Files() int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return len(p.files)
+}
+
+// denies reports whether the policy denies coverts on host, an IP or a host
+// name. A nil policy denies nothing.
+func (p *CovertPolicy) denies(host string) bool {
+	if p == nil {
+		return false
+	}
+	p.m.RLock()
+	defer p.m.RUnlock()
+	r := &p.merged
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, subnet := range r.denySubnets {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+		if r.allows() == 0 {
+			return false
+		}
+		for _, subnet := range r.allowSubnets {
+			if subnet.Contains(ip) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, pattern := range r.denyDomains {
+		if pattern.MatchString(host) {
+			return true
+		}
+	}
+	if r.allows() == 0 {
+		return false
+	}
+	for _, pattern := range r.allowDomains {
+		if pattern.MatchString(host) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) parseCovertPolicy() error {
+	if len(c.CovertPolicyFiles) == 0 {
+		return nil
+	}
+	p, err := NewCovertPolicy(c.CovertPolicyFiles)
+	if err != nil {
+		return err
+	}
+	c.covertPolicy = p
+	return nil
+}
+
+// CovertPolicy returns the covert policy of covert_policy_files, nil if none
+// are configured.
+func (c *Config) CovertPolicy() *CovertPolicy {
+	return c.covertPolicy
+}
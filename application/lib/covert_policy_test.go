@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicyFile(t *testing.T, path, content string) {
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestCovertPolicyMerge(t *testing.T) {
+	dir := t.TempDir()
+	writePolicyFile(t, filepath.Join(dir, "a.toml"), `
+allow_subnets = ["198.51.100.0/24"]
+allow_domains = ["\\.example\\.com$"]
+`)
+	writePolicyFile(t, filepath.Join(dir, "b.toml"), `
+deny_subnets = ["198.51.100.128/25"]
+deny_domains = ["^blocked\\.example\\.com$"]
+`)
+
+	c := &Config{CovertPolicyFiles: []string{filepath.Join(dir, "*.toml")}}
+	c.parseBlocklists()
+	require.Nil(t, c.parseCovertPolicy())
+	allow, deny := c.CovertPolicy().Rules()
+	require.Equal(t, 2, allow)
+	require.Equal(t, 2, deny)
+	require.Equal(t, float64(2), metrics.CovertPolicyRules.Value(covertPolicyDeny))
+
+	for covert, blocked := range map[string]bool{
+		"198.51.100.1:443":        false,
+		"198.51.100.200:443":      true, // deny takes precedence
+		"203.0.113.1:443":         true, // allowed by no rule
+		"www.example.com:443":     false,
+		"blocked.example.com:443": true,
+		"example.org:443":         true,
+	} {
+		require.Equal(t, blocked, c.IsBlocklisted(covert), covert)
+	}
+
+	// A file failing to reload keeps its last rules, the others still take
+	// effect.
+	loadErrors := metrics.CovertPolicyLoadErrors.Value()
+	writePolicyFile(t, filepath.Join(dir, "a.toml"), `allow_subnets = ["not a subnet"]`)
+	writePolicyFile(t, filepath.Join(dir, "b.toml"), `deny_subnets = ["198.51.100.0/25"]`)
+	require.NotNil(t, c.CovertPolicy().Reload())
+	require.Equal(t, loadErrors+1, metrics.CovertPolicyLoadErrors.Value())
+	require.True(t, c.IsBlocklisted("198.51.100.1:443"))
+	require.False(t, c.IsBlocklisted("198.51.100.200:443"))
+	require.False(t, c.IsBlocklisted("blocked.example.com:443"))
+
+	// New files are picked up, removed ones dropped.
+	writePolicyFile(t, filepath.Join(dir, "a.toml"), `allow_subnets = ["203.0.113.0/24"]`)
+	writePolicyFile(t, filepath.Join(dir, "c.toml"), `deny_domains = ["^www\\."]`)
+	require.Nil(t, os.Remove(filepath.Join(dir, "b.toml")))
+	require.Nil(t, c.CovertPolicy().Reload())
+	require.Equal(t, 2, c.CovertPolicy().Files())
+	allow, deny = c.CovertPolicy().Rules()
+	require.Equal(t, 1, allow)
+	require.Equal(t, 1, deny)
+	require.False(t, c.IsBlocklisted("203.0.113.1:443"))
+	require.True(t, c.IsBlocklisted("www.example.com:443"))
+}
+
+func TestCovertPolicyStartup(t *testing.T) {
+	dir := t.TempDir()
+	writePolicyFile(t, filepath.Join(dir, "bad.toml"), `deny_domains = ["("]`)
+	c := &Config{CovertPolicyFiles: []string{filepath.Join(dir, "*.toml")}}
+	require.NotNil(t, c.parseCovertPolicy())
+
+	c = &Config{CovertPolicyFiles: []string{"["}}
+	require.NotNil(t, c.parseCovertPolicy())
+
+	// Without policy files nothing is denied by policy.
+	c = &Config{}
+	c.parseBlocklists()
+	require.Nil(t, c.parseCovertPolicy())
+	require.Nil(t, c.CovertPolicy())
+	require.False(t, c.IsBlocklisted("203.0.113.1:443"))
+}
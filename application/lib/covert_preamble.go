@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+const (
+	// defaultCovertPreambleTimeout is the ExpectTimeout, in milliseconds,
+	// used when none is configured.
+	defaultCovertPreambleTimeout = 5000
+
+	// maxCovertPreambleLine is the longest reply line read for ExpectLine,
+	// the line feed included.
+	maxCovertPreambleLine = 1024
+)
+
+// Reasons a covert preamble fails, the reason label of
+// metrics.CovertPreambleFailures.
+const (
+	covertPreambleWrite    = "write"
+	covertPreambleRead     = "read"
+	covertPreambleTimeout  = "timeout"
+	covertPreambleMismatch = "mismatch"
+	covertPreambleAuth     = "auth"
+)
+
+// ErrCovertPreamble is wrapped by errors of a covert's preamble, see
+// CovertPreambleConfig.
+var ErrCovertPreamble = errors.New("covert preamble failed")
+
+// CovertPreambleConfig is what the station writes to a covert, and the reply
+// it expects, before relaying the client's data, for backends that speak the
+// PROXY protocol or expect a greeting. It is a [covert_preamble."pattern"]
+// table of the config, pattern being a covert host:port or a glob of them as
+// path.Match takes them, e.g. "*.example.com:443".
+type CovertPreambleConfig struct {
+	// Send a PROXY protocol v1 header with the client's address first, as
+	// registrations asking for one get. It is only sent once for those.
+	ProxyHeader bool `toml:"proxy_header"`
+
+	// Bytes written next, as text or in hex (e.g. "050100", a SOCKS5
+	// greeting offering no authentication). At most one of the two.
+	Write    string `toml:"write"`
+	WriteHex string `toml:"write_hex"`
+	write    []byte
+
+	// Prefix the covert's reply must start with, as text or in hex, read and
+	// discarded before the covert's data is relayed. With ExpectLine the
+	// reply is a line (e.g. a banner or a PROXY reply) that must start with
+	// the prefix, the whole line is discarded. Empty and no ExpectLine reads
+	// nothing.
+	Expect     string `toml:"expect"`
+	ExpectHex  string `toml:"expect_hex"`
+	ExpectLine bool   `toml:"expect_line"`
+	expect     []byte
+
+	// Milliseconds to wait for the reply, zero uses the default of 5000.
+	ExpectTimeout int `toml:"expect_timeout"`
+
+	// Handshake the station completes with the covert, a proxy, in place of
+	// Write and Expect: "socks5" or "http_connect". It authenticates with
+	// the registration's covert credentials if it has any (see
+	// CovertCredentials), with no authentication otherwise. The whole
+	// handshake must be done within ExpectTimeout.
+	Handshake string `toml:"handshake"`
+
+	// Address (host:port) the proxy is asked to connect to, required for
+	// http_connect. Empty for socks5 stops after authenticating, leaving the
+	// client to send its own CONNECT request.
+	Target string `toml:"target"`
+}
+
+func (c *ProxyConfig) parseCovertPreambles() error {
+	c.covertPreamblePatterns = nil
+	for pattern, conf := range c.CovertPreamble {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad covert_preamble pattern %q: %v", pattern, err)
+		}
+		var err error
+		if conf.write, err = preambleBytes(conf.Write, conf.WriteHex); err != nil {
+			return fmt.Errorf("covert_preamble %q: write: %v", pattern, err)
+		}
+		if conf.expect, err = preambleBytes(conf.Expect, conf.ExpectHex); err != nil {
+			return fmt.Errorf("covert_preamble %q: expect: %v", pattern, err)
+		}
+		if conf.ExpectLine && bytes.IndexByte(conf.expect, '\n') >= 0 {
+			return fmt.Errorf("covert_preamble %q: an expected line must not contain a line feed", pattern)
+		}
+		if conf.ExpectTimeout < 0 {
+			return fmt.Errorf("covert_preamble %q: expect_timeout must not be negative", pattern)
+		}
+		if conf.ExpectTimeout == 0 {
+			conf.ExpectTimeout = defaultCovertPreambleTimeout
+		}
+		if err := conf.parseHandshake(); err != nil {
+			return fmt.Errorf("covert_preamble %q: %v", pattern, err)
+		}
+		c.covertPreamblePatterns = append(c.covertPreamblePatterns, pattern)
+	}
+	sort.Strings(c.covertPreamblePatterns)
+	return nil
+}
+
+// preambleBytes returns the bytes given as text or in hex, at most one of
+// which may be set.
+func preambleBytes(text, hexText string) ([]byte, error) {
+	if text != "" && hexText != "" {
+		return nil, fmt.Errorf("both text and hex given")
+	}
+	if hexText != "" {
+		b, err := hex.DecodeString(strings.Join(strings.Fields(hexText), ""))
+		if err != nil {
+			return nil, fmt.Errorf("bad hex: %v", err)
+		}
+		return b, nil
+	}
+	if text != "" {
+		return []byte(text), nil
+	}
+	return nil, nil
+}
+
+// covertPreamble returns the preamble of covert (a host:port), nil if it has
+// none. A pattern that is covert itself takes precedence, otherwise the first
+// matching pattern in lexical order is used (see matchCovertPattern). conf
+// may be nil.
+func (c *ProxyConfig) covertPreamble(covert string) *CovertPreambleConfig {
+	if c == nil || len(c.CovertPreamble) == 0 {
+		return nil
+	}
+	if pattern, ok := matchCovertPattern(covert, c.covertPreamblePatterns); ok {
+		return c.CovertPreamble[pattern]
+	}
+	return nil
+}
+
+// matchCovertPattern returns the pattern of patterns, sorted, that covert (a
+// host:port) matches: covert itself if it is one of them, otherwise the first
+// glob matching it. It reports whether any did.
+func matchCovertPattern(covert string, patterns []string) (string, bool) {
+	if i := sort.SearchStrings(patterns, covert); i < len(patterns) && patterns[i] == covert {
+		return covert, true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, covert); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// run writes the preamble to conn, a connection to the covert for a client at
+// clientAddr, then reads and checks the reply, or completes the handshake
+// with creds, which may be nil. proxyHeader is whether a PROXY header is
+// written regardless of the preamble. Failures are counted in
+// metrics.CovertPreambleFailures and wrap ErrCovertPreamble; conn is closed
+// if the reply times out.
+func (p *CovertPreambleConfig) run(conn net.Conn, clientAddr string, proxyHeader bool, creds *CovertCredentials) error {
+	if p.ProxyHeader || proxyHeader {
+		if err := writePROXYHeader(conn, clientAddr); err != nil {
+			metrics.CovertPreambleFailures.Inc(covertPreambleWrite)
+			return fmt.Errorf("%w: PROXY header: %v", ErrCovertPreamble, err)
+		}
+	}
+	if p.Handshake != "" {
+		return p.runHandshake(conn, creds)
+	}
+	if len(p.write) > 0 {
+		if _, err := conn.Write(p.write); err != nil {
+			metrics.CovertPreambleFailures.Inc(covertPreambleWrite)
+			return fmt.Errorf("%w: %v", ErrCovertPreamble, err)
+		}
+	}
+	if len(p.expect) == 0 && !p.ExpectLine {
+		return nil
+	}
+
+	// Covert read timeouts reset the read deadline on every read, the
+	// connection is closed instead should the reply be late.
+	timer := time.AfterFunc(time.Duration(p.ExpectTimeout)*time.Millisecond, func() { conn.Close() })
+	reply, err := p.readReply(conn)
+	if !timer.Stop() {
+		metrics.CovertPreambleFailures.Inc(covertPreambleTimeout)
+		return fmt.Errorf("%w: no reply within %dms", ErrCovertPreamble, p.ExpectTimeout)
+	}
+	if err != nil {
+		metrics.CovertPreambleFailures.Inc(covertPreambleRead)
+		return fmt.Errorf("%w: reading reply: %v", ErrCovertPreamble, err)
+	}
+	if !bytes.HasPrefix(reply, p.expect) {
+		metrics.CovertPreambleFailures.Inc(covertPreambleMismatch)
+		return fmt.Errorf("%w: unexpected reply %q", ErrCovertPreamble, reply)
+	}
+	return nil
+}
+
+// readReply reads the reply: as many bytes as expected or, with ExpectLine, a
+// line. Lines are read a byte at a time so that none of the covert's data
+// after them is consumed.
+func (p *CovertPreambleConfig) readReply(conn net.Conn) ([]byte, error) {
+	if !p.ExpectLine {
+		reply := make([]byte, len(p.expect))
+		_, err := io.ReadFull(conn, reply)
+		return reply, err
+	}
+	var line []byte
+	var b [1]byte
+	for len(line) < maxCovertPreambleLine {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return line, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return line, fmt.Errorf("reply line longer than %d bytes", maxCovertPreambleLine)
+}
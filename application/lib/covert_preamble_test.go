@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertPreambleSelect(t *testing.T) {
+	exact := &CovertPreambleConfig{Write: "exact"}
+	glob := &CovertPreambleConfig{WriteHex: "05 01 00"}
+	conf := &ProxyConfig{CovertPreamble: map[string]*CovertPreambleConfig{
+		"a.example.com:443": exact,
+		"*.example.com:443": glob,
+		"*:443":             {},
+	}}
+	require.Nil(t, conf.parseCovertPreambles())
+	require.Equal(t, []byte{5, 1, 0}, glob.write)
+	require.Equal(t, defaultCovertPreambleTimeout, glob.ExpectTimeout)
+
+	require.Equal(t, exact, conf.covertPreamble("a.example.com:443"))
+	require.Equal(t, glob, conf.covertPreamble("b.example.com:443"))
+	require.Equal(t, conf.CovertPreamble["*:443"], conf.covertPreamble("192.0.2.1:443"))
+	require.Nil(t, conf.covertPreamble("b.example.com:80"))
+	require.Nil(t, (*ProxyConfig)(nil).covertPreamble("b.example.com:443"))
+
+	for _, bad := range []map[string]*CovertPreambleConfig{
+		{"[.example.com:443": {}},
+		{"a.example.com:443": {Write: "x", WriteHex: "78"}},
+		{"a.example.com:443": {ExpectHex: "zz"}},
+		{"a.example.com:443": {Expect: "a\nb", ExpectLine: true}},
+		{"a.example.com:443": {ExpectTimeout: -1}},
+	} {
+		require.NotNil(t, (&ProxyConfig{CovertPreamble: bad}).parseCovertPreambles())
+	}
+}
+
+// preambleCovert serves a single connection with serve, at the returned
+// address.
+func preambleCovert(t *testing.T, serve func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+// preambleProxy proxies a new client connection to covert with preamble, and
+// returns the client's end.
+func preambleProxy(t *testing.T, covert string, preamble *CovertPreambleConfig) *net.TCPConn {
+	return preambleProxyLogged(t, covert, preamble, nil, ioutil.Discard)
+}
+
+// preambleProxyLogged is preambleProxy for a registration with the covert
+// credentials creds, logging to logs.
+func preambleProxyLogged(t *testing.T, covert string, preamble *CovertPreambleConfig, creds *CovertCredentials, logs io.Writer) *net.TCPConn {
+	conf := &ProxyConfig{CovertPreamble: map[string]*CovertPreambleConfig{covert: preamble}}
+	require.Nil(t, conf.parseCovertPreambles())
+	client, stationClient := tcpPair(t)
+	t.Cleanup(func() { client.Close() })
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: covert, CovertCredentials: creds}
+	go func() {
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(logs, "", 0)}, conf)
+		stationClient.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func TestProxyCovertPreambleWrite(t *testing.T) {
+	received := make(chan []byte, 1)
+	covert := preambleCovert(t, func(conn net.Conn) {
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	})
+	client := preambleProxy(t, covert, &CovertPreambleConfig{ProxyHeader: true, Write: "HELLO\n"})
+	_, err := client.Write([]byte("data"))
+	require.Nil(t, err)
+	client.CloseWrite()
+
+	_, port, _ := net.SplitHostPort(client.LocalAddr().String())
+	want := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %s 1234\r\nHELLO\ndata", port)
+	select {
+	case b := <-received:
+		require.Equal(t, want, string(b))
+	case <-time.After(5 * time.Second):
+		t.Fatal("covert received nothing")
+	}
+}
+
+func TestProxyCovertPreambleExpect(t *testing.T) {
+	// socks answers a SOCKS5 greeting with reply, then echoes.
+	socks := func(reply []byte) func(net.Conn) {
+		return func(conn net.Conn) {
+			greeting := make([]byte, 3)
+			if _, err := io.ReadFull(conn, greeting); err != nil || !bytes.Equal(greeting, []byte{5, 1, 0}) {
+				return
+			}
+			conn.Write(reply)
+			io.Copy(conn, conn)
+		}
+	}
+	greeting := &CovertPreambleConfig{WriteHex: "050100", ExpectHex: "0500"}
+
+	t.Run("prefix", func(t *testing.T) {
+		// The covert's data after the reply is relayed.
+		client := preambleProxy(t, preambleCovert(t, socks([]byte{5, 0, 'h', 'i'})), greeting)
+		b := make([]byte, 2)
+		_, err := io.ReadFull(client, b)
+		require.Nil(t, err)
+		require.Equal(t, "hi", string(b))
+		_, err = client.Write([]byte("ping"))
+		require.Nil(t, err)
+		b = make([]byte, 4)
+		_, err = io.ReadFull(client, b)
+		require.Nil(t, err)
+		require.Equal(t, "ping", string(b))
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		before := metrics.CovertPreambleFailures.Value(covertPreambleMismatch)
+		client := preambleProxy(t, preambleCovert(t, socks([]byte{5, 0xff})), greeting)
+		_, err := client.Write([]byte("ping"))
+		require.Nil(t, err)
+		b, _ := ioutil.ReadAll(client)
+		require.Empty(t, b)
+		require.Equal(t, before+1, metrics.CovertPreambleFailures.Value(covertPreambleMismatch))
+	})
+
+	t.Run("line", func(t *testing.T) {
+		covert := preambleCovert(t, func(conn net.Conn) {
+			conn.Write([]byte("PROXY OK v1\r\nbanner"))
+			io.Copy(ioutil.Discard, conn)
+		})
+		client := preambleProxy(t, covert, &CovertPreambleConfig{ProxyHeader: true, Expect: "PROXY OK", ExpectLine: true})
+		b := make([]byte, 6)
+		_, err := io.ReadFull(client, b)
+		require.Nil(t, err)
+		require.Equal(t, "banner", string(b))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		before := metrics.CovertPreambleFailures.Value(covertPreambleTimeout)
+		covert := preambleCovert(t, func(conn net.Conn) {
+			io.Copy(ioutil.Discard, conn)
+		})
+		client := preambleProxy(t, covert, &CovertPreambleConfig{Expect: "220 ", ExpectLine: true, ExpectTimeout: 100})
+		b, _ := ioutil.ReadAll(client)
+		require.Empty(t, b)
+		require.Equal(t, before+1, metrics.CovertPreambleFailures.Value(covertPreambleTimeout))
+	})
+}
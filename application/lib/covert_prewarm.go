@@ -0,0 +1,452 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+const (
+	// defaultCovertPrewarmIdle is the CovertPrewarmIdle used when none is
+	// configured.
+	defaultCovertPrewarmIdle = 2
+
+	// defaultCovertPrewarmMaxIdle is the CovertPrewarmMaxIdle, in seconds,
+	// used when none is configured.
+	defaultCovertPrewarmMaxIdle = 30
+
+	// covertPrewarmInterval is how often pools are topped up and expired
+	// connections replaced, besides right after a connection is taken.
+	covertPrewarmInterval = time.Second
+
+	// A covert is considered unhealthy after this many consecutive failed
+	// dials, by the pool or by sessions, and is not pre-warmed for
+	// covertPrewarmPause (doubling on every further failure, up to
+	// covertPrewarmMaxPause).
+	covertPrewarmFailures = 3
+	covertPrewarmPause    = 30 * time.Second
+	covertPrewarmMaxPause = 5 * time.Minute
+)
+
+// Outcomes of taking a connection from the pool, the label of
+// metrics.CovertPrewarm.
+const (
+	covertPrewarmHit   = "hit"
+	covertPrewarmMiss  = "miss"
+	covertPrewarmStale = "stale"
+)
+
+// Reasons idle connections leave the pool other than being taken, the label
+// of metrics.CovertPoolEvictions.
+const (
+	covertPoolExpired = "expired"
+	covertPoolStale   = "stale"
+	covertPoolFlushed = "flushed"
+)
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// covertPoolEntry is the pool of one covert, with the health of the covert.
+type covertPoolEntry struct {
+	idle     []pooledConn
+	dialing  int
+	failures int // consecutive failed dials
+	paused   time.Time
+
+	// flushes counts the Flushes of the pool, connections dialed before
+	// one are not kept.
+	flushes int
+}
+
+// CovertPool keeps a number of idle connections open to each of a list of
+// coverts, so that sessions for them skip the connect. Sessions take a
+// connection with Get and the pool replenishes itself in the background.
+// Idle connections are replaced after a maximum age, as servers close idle
+// connections, and a connection the covert closed or sent data on is never
+// handed out.
+//
+// Dial failures, including those of sessions dialing a covert its pool had no
+// connection for, count against the covert's health: after
+// covertPrewarmFailures consecutive failures it is not pre-warmed for a while,
+// so an unhealthy covert is not hammered with connects.
+type CovertPool struct {
+	size    int
+	maxIdle time.Duration
+	dial    func(covert string) (net.Conn, error)
+	logger  *log.Logger
+	now     func() time.Time
+	wake    chan struct{}
+
+	m       sync.Mutex
+	coverts map[string]*covertPoolEntry
+}
+
+// NewCovertPool returns a pool of size idle connections to each of coverts
+// (host:port, as registrations give them), made with dial and replaced when
+// older than maxIdle. The pool is only filled by Run.
+func NewCovertPool(coverts []string, size int, maxIdle time.Duration, dial func(covert string) (net.Conn, error), logger *log.Logger) *CovertPool {
+	p := &CovertPool{
+		size:    size,
+		maxIdle: maxIdle,
+		dial:    dial,
+		logger:  logger,
+		now:     time.Now,
+		wake:    make(chan struct{}, 1),
+		coverts: make(map[string]*covertPoolEntry),
+	}
+	for _, covert := range coverts {
+		e := &covertPoolEntry{}
+		p.coverts[covert] = e
+		p.updateGauges(covert, e)
+	}
+	return p
+}
+
+// updateGauges sets the size and idle gauges of covert. Called with p.m held.
+func (p *CovertPool) updateGauges(covert string, e *covertPoolEntry) {
+	metrics.CovertPoolSize.Set(float64(len(e.idle)+e.dialing), covert)
+	metrics.CovertPoolIdle.Set(float64(len(e.idle)), covert)
+}
+
+// Get takes an idle connection to covert from the pool, it returns nil if
+// covert is not pre-warmed or has no usable connection left.
+func (p *CovertPool) Get(covert string) net.Conn {
+	if p == nil {
+		return nil
+	}
+	p.m.Lock()
+	e, ok := p.coverts[covert]
+	if !ok {
+		p.m.Unlock()
+		return nil
+	}
+	defer p.replenish()
+	now := p.now()
+	for len(e.idle) > 0 {
+		pc := e.idle[len(e.idle)-1]
+		e.idle = e.idle[:len(e.idle)-1]
+		if now.Sub(pc.since) < p.maxIdle && pooledConnAlive(pc.conn) {
+			p.updateGauges(covert, e)
+			p.m.Unlock()
+			metrics.CovertPrewarm.Inc(covertPrewarmHit)
+			metrics.CovertPoolGets.Inc(covert, covertPrewarmHit)
+			return pc.conn
+		}
+		pc.conn.Close()
+		metrics.CovertPrewarm.Inc(covertPrewarmStale)
+		metrics.CovertPoolEvictions.Inc(covert, covertPoolStale)
+	}
+	p.updateGauges(covert, e)
+	p.m.Unlock()
+	metrics.CovertPrewarm.Inc(covertPrewarmMiss)
+	metrics.CovertPoolGets.Inc(covert, covertPrewarmMiss)
+	return nil
+}
+
+// Flush closes the idle connections to covert, e.g. after its backends were
+// redeployed, and has the pool dial fresh ones. Connections being dialed are
+// not kept either. It returns the number of connections closed and whether
+// covert is pre-warmed at all.
+func (p *CovertPool) Flush(covert string) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.m.Lock()
+	e, ok := p.coverts[covert]
+	if !ok {
+		p.m.Unlock()
+		return 0, false
+	}
+	n := len(e.idle)
+	for _, pc := range e.idle {
+		pc.conn.Close()
+	}
+	e.idle = nil
+	e.flushes++
+	p.updateGauges(covert, e)
+	p.m.Unlock()
+	metrics.CovertPoolEvictions.Add(float64(n), covert, covertPoolFlushed)
+	p.replenish()
+	return n, true
+}
+
+// pooledConnAlive reports whether an idle connection can still be used: the
+// covert neither closed it nor sent anything on it (which the session's
+// client would never see). It peeks at the socket without waiting.
+func pooledConnAlive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	alive := false
+	err = raw.Read(func(fd uintptr) bool {
+		var b [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		alive = errors.Is(err, syscall.EAGAIN)
+		return true
+	})
+	return err == nil && alive
+}
+
+// noteDial records the outcome of a session's dial to covert.
+func (p *CovertPool) noteDial(covert string, err error) {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if e, ok := p.coverts[covert]; ok {
+		p.noteResult(covert, e, err)
+	}
+}
+
+// noteResult updates the health of covert after a dial. Called with p.m
+// held.
+func (p *CovertPool) noteResult(covert string, e *covertPoolEntry, err error) {
+	if err == nil {
+		if e.failures >= covertPrewarmFailures {
+			p.logger.Printf("covert %s is reachable again, resuming pre-warming", covert)
+		}
+		e.failures = 0
+		e.paused = time.Time{}
+		return
+	}
+	e.failures++
+	if e.failures < covertPrewarmFailures {
+		return
+	}
+	pause := covertPrewarmPause << uint(e.failures-covertPrewarmFailures)
+	if pause > covertPrewarmMaxPause || pause <= 0 {
+		pause = covertPrewarmMaxPause
+	}
+	e.paused = p.now().Add(pause)
+	p.logger.Printf("covert %s failed %d dials in a row, pausing pre-warming for %v: %v", covert, e.failures, pause, err)
+}
+
+func (p *CovertPool) replenish() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Idle returns the number of idle connections to covert.
+func (p *CovertPool) Idle(covert string) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if e, ok := p.coverts[covert]; ok {
+		return len(e.idle)
+	}
+	return 0
+}
+
+// Run keeps the pools filled, it does not return.
+func (p *CovertPool) Run() {
+	ticker := time.NewTicker(covertPrewarmInterval)
+	defer ticker.Stop()
+	for {
+		p.maintain()
+		select {
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// maintain closes expired idle connections and starts the dials needed to
+// bring every healthy covert back to its target size.
+func (p *CovertPool) maintain() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	now := p.now()
+	for covert, e := range p.coverts {
+		fresh := e.idle[:0]
+		for _, pc := range e.idle {
+			if now.Sub(pc.since) < p.maxIdle {
+				fresh = append(fresh, pc)
+			} else {
+				pc.conn.Close()
+				metrics.CovertPoolEvictions.Inc(covert, covertPoolExpired)
+			}
+		}
+		e.idle = fresh
+
+		if !now.Before(e.paused) {
+			for n := len(e.idle) + e.dialing; n < p.size; n++ {
+				e.dialing++
+				go p.fill(covert, e, e.flushes)
+			}
+		}
+		p.updateGauges(covert, e)
+	}
+}
+
+// fill dials one connection to covert and adds it to its pool, unless the
+// pool was flushed since flushes.
+func (p *CovertPool) fill(covert string, e *covertPoolEntry, flushes int) {
+	conn, err := p.dial(covert)
+	p.m.Lock()
+	defer p.m.Unlock()
+	defer p.updateGauges(covert, e)
+	e.dialing--
+	p.noteResult(covert, e, err)
+	if err != nil {
+		return
+	}
+	if len(e.idle) >= p.size || e.flushes != flushes {
+		conn.Close()
+		return
+	}
+	e.idle = append(e.idle, pooledConn{conn, p.now()})
+}
+
+// Status summarizes the pools for the management endpoint.
+func (p *CovertPool) Status() interface{} {
+	type covertStatus struct {
+		Covert   string     `json:"covert"`
+		Idle     int        `json:"idle"`
+		Failures int        `json:"failures"`
+		Paused   *time.Time `json:"paused_until,omitempty"`
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	now := p.now()
+	status := make([]covertStatus, 0, len(p.coverts))
+	for covert, e := range p.coverts {
+		s := covertStatus{Covert: covert, Idle: len(e.idle), Failures: e.failures}
+		if now.Before(e.paused) {
+			paused := e.paused
+			s.Paused = &paused
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Covert < status[j].Covert })
+	return status
+}
+
+func (c *ProxyConfig) parseCovertPrewarm() error {
+	for _, covert := range c.CovertPrewarm {
+		if _, _, err := net.SplitHostPort(covert); err != nil {
+			return fmt.Errorf("covert_prewarm %q: %v", covert, err)
+		}
+	}
+	if c.CovertPrewarmIdle <= 0 {
+		c.CovertPrewarmIdle = defaultCovertPrewarmIdle
+	}
+	if c.CovertPrewarmMaxIdle <= 0 {
+		c.CovertPrewarmMaxIdle = defaultCovertPrewarmMaxIdle
+	}
+	return nil
+}
+
+// StartCovertPrewarm starts keeping connections open to the CovertPrewarm
+// coverts, if any, serves the pools' state at /status/covert_prewarm and
+// flushes a pool when POSTed /covert_prewarm/flush?covert=<host:port>. It
+// must be called before sessions are proxied.
+func (c *ProxyConfig) StartCovertPrewarm(logger *log.Logger) {
+	if len(c.CovertPrewarm) == 0 {
+		return
+	}
+	c.covertPool = NewCovertPool(c.CovertPrewarm, c.CovertPrewarmIdle,
+		time.Duration(c.CovertPrewarmMaxIdle)*time.Second, c.dialPrewarm, logger)
+	Admin().HandleStatus("covert_prewarm", c.covertPool.Status)
+	Admin().Handle("/covert_prewarm/flush", covertPoolFlush{c.covertPool, logger})
+	go c.covertPool.Run()
+}
+
+// covertPoolFlush is the management endpoint flushing a pool, see
+// CovertPool.Flush. The reply gives the number of connections closed.
+type covertPoolFlush struct {
+	pool   *CovertPool
+	logger *log.Logger
+}
+
+func (f covertPoolFlush) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	covert := r.URL.Query().Get("covert")
+	if covert == "" {
+		http.Error(w, "missing covert", http.StatusBadRequest)
+		return
+	}
+	n, ok := f.pool.Flush(covert)
+	if !ok {
+		http.Error(w, fmt.Sprintf("covert %s is not pre-warmed", covert), http.StatusNotFound)
+		return
+	}
+	f.logger.Printf("flushed %d idle connections to covert %s", n, covert)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Covert  string `json:"covert"`
+		Flushed int    `json:"flushed"`
+	}{covert, n})
+}
+
+// dialPrewarm connects to covert for its pool. Connections of a covert with
+// several addresses are spread across them as those of registrations are, by
+// choosing the first address from a random secret. Addresses that loop to the
+// station or are blocklisted are refused as they are for sessions.
+func (c *ProxyConfig) dialPrewarm(covert string) (net.Conn, error) {
+	var secret [32]byte
+	rand.Read(secret[:])
+	candidates, err := covertCandidates(covert, secret[:], c.covertFamily(covert), c.covertLookupHost())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range candidates {
+		if loop := c.covertLoop(addr); loop != "" {
+			metrics.CovertLoops.Inc(loop)
+			err = fmt.Errorf("%w: %s (%s)", ErrCovertLoop, addr, loop)
+			continue
+		}
+		if c.covertBlocklisted(addr) {
+			err = fmt.Errorf("%w: %s", ErrCovertBlocklisted, addr)
+			continue
+		}
+		var conn net.Conn
+		release, _ := c.acquireCovertWarmup(time.Time{})
+		conn, err = net.DialTimeout("tcp", addr, c.covertConnectTimeout())
+		release()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// prewarmedCovert takes a pre-warmed connection to covert, nil if there is
+// none.
+func (c *ProxyConfig) prewarmedCovert(covert string) net.Conn {
+	if c == nil {
+		return nil
+	}
+	return c.covertPool.Get(covert)
+}
+
+// noteCovertDial reports a session's dial to covert to its pool's health.
+func (c *ProxyConfig) noteCovertDial(covert string, err error) {
+	if c == nil {
+		return
+	}
+	c.covertPool.noteDial(covert, err)
+}
@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// waitIdle waits for p to hold n idle connections to covert.
+func waitIdle(t *testing.T, p *CovertPool, covert string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Idle(covert) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d idle connections, want %d", p.Idle(covert), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCovertPoolMaintainsSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	var accepted int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			defer conn.Close()
+		}
+	}()
+	covert := ln.Addr().String()
+
+	now := time.Unix(1700000000, 0)
+	p := NewCovertPool([]string{covert}, 3, time.Minute, func(covert string) (net.Conn, error) {
+		return net.Dial("tcp", covert)
+	}, log.New(ioutil.Discard, "", 0))
+	p.now = func() time.Time { return now }
+
+	p.maintain()
+	waitIdle(t, p, covert, 3)
+	require.Nil(t, p.Get("192.0.2.1:443"))
+
+	// Connections taken are replaced.
+	for i := 0; i < 2; i++ {
+		conn := p.Get(covert)
+		require.NotNil(t, conn)
+		conn.Close()
+	}
+	require.Equal(t, 1, p.Idle(covert))
+	p.maintain()
+	waitIdle(t, p, covert, 3)
+	require.Equal(t, int64(5), atomic.LoadInt64(&accepted))
+
+	// So are connections past the maximum idle time.
+	now = now.Add(time.Minute)
+	p.maintain()
+	waitIdle(t, p, covert, 3)
+	require.Equal(t, int64(8), atomic.LoadInt64(&accepted))
+}
+
+func TestCovertPoolSkipsClosed(t *testing.T) {
+	client, server := tcpPair(t)
+	p := NewCovertPool([]string{"covert:443"}, 1, time.Minute, nil, log.New(ioutil.Discard, "", 0))
+	p.coverts["covert:443"].idle = []pooledConn{{client, time.Now()}}
+
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	require.Nil(t, p.Get("covert:443"))
+	require.Equal(t, 0, p.Idle("covert:443"))
+}
+
+func TestCovertPoolPausesUnhealthy(t *testing.T) {
+	var dials int64
+	failing := func(covert string) (net.Conn, error) {
+		atomic.AddInt64(&dials, 1)
+		return nil, errors.New("connection refused")
+	}
+	now := time.Unix(1700000000, 0)
+	p := NewCovertPool([]string{"covert:443"}, 1, time.Minute, failing, log.New(ioutil.Discard, "", 0))
+	p.now = func() time.Time { return now }
+
+	// Sessions' failures count towards the threshold too.
+	p.noteDial("covert:443", errors.New("timeout"))
+	p.noteDial("covert:443", errors.New("timeout"))
+	p.maintain()
+	waitDials := func(n int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&dials) != n || p.dialing("covert:443") {
+			require.True(t, time.Now().Before(deadline), "dials %d, want %d", atomic.LoadInt64(&dials), n)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitDials(1)
+
+	// Paused: no more dials until the pause is over.
+	p.maintain()
+	p.maintain()
+	waitDials(1)
+	now = now.Add(covertPrewarmPause)
+	p.maintain()
+	waitDials(2)
+
+	// A successful session dial resumes pre-warming.
+	p.maintain()
+	waitDials(2)
+	p.noteDial("covert:443", nil)
+	p.maintain()
+	waitDials(3)
+}
+
+func TestCovertPoolFlush(t *testing.T) {
+	listen := func() string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		return ln.Addr().String()
+	}
+	flushed, kept := listen(), listen()
+
+	// Dials wait for the channel in blocked to be closed.
+	var blocked atomic.Value
+	open := make(chan struct{})
+	close(open)
+	blocked.Store(open)
+	p := NewCovertPool([]string{flushed, kept}, 2, time.Minute, func(covert string) (net.Conn, error) {
+		<-blocked.Load().(chan struct{})
+		return net.Dial("tcp", covert)
+	}, log.New(ioutil.Discard, "", 0))
+	p.maintain()
+	waitIdle(t, p, flushed, 2)
+	waitIdle(t, p, kept, 2)
+	require.Equal(t, float64(2), metrics.CovertPoolIdle.Value(flushed))
+	evictions := metrics.CovertPoolEvictions.Value(flushed, covertPoolFlushed)
+
+	n, ok := p.Flush(flushed)
+	require.True(t, ok)
+	require.Equal(t, 2, n)
+	require.Equal(t, 0, p.Idle(flushed))
+	require.Equal(t, 2, p.Idle(kept))
+	require.Equal(t, float64(0), metrics.CovertPoolIdle.Value(flushed))
+	require.Equal(t, float64(2), metrics.CovertPoolIdle.Value(kept))
+	require.Equal(t, evictions+2, metrics.CovertPoolEvictions.Value(flushed, covertPoolFlushed))
+	_, ok = p.Flush("192.0.2.1:443")
+	require.False(t, ok)
+
+	// Connections being dialed when the pool is flushed are not kept.
+	block := make(chan struct{})
+	blocked.Store(block)
+	p.maintain()
+	require.True(t, p.dialing(flushed))
+	require.Equal(t, float64(2), metrics.CovertPoolSize.Value(flushed))
+	p.Flush(flushed)
+	close(block)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.dialing(flushed) {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 0, p.Idle(flushed))
+
+	p.maintain()
+	waitIdle(t, p, flushed, 2)
+	require.Equal(t, 2, p.Idle(kept))
+}
+
+func TestCovertPoolFlushEndpoint(t *testing.T) {
+	client, server := tcpPair(t)
+	defer server.Close()
+	p := NewCovertPool([]string{"covert:443"}, 1, time.Minute, nil, log.New(ioutil.Discard, "", 0))
+	p.coverts["covert:443"].idle = []pooledConn{{client, time.Now()}}
+	flush := covertPoolFlush{p, log.New(ioutil.Discard, "", 0)}
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodGet, "/covert_prewarm/flush?covert=covert:443", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/covert_prewarm/flush", http.StatusBadRequest},
+		{http.MethodPost, "/covert_prewarm/flush?covert=other:443", http.StatusNotFound},
+		{http.MethodPost, "/covert_prewarm/flush?covert=covert:443", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		flush.ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		require.Equal(t, c.code, w.Code, c.target)
+		if c.code == http.StatusOK {
+			var reply struct {
+				Covert  string
+				Flushed int
+			}
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+			require.Equal(t, "covert:443", reply.Covert)
+			require.Equal(t, 1, reply.Flushed)
+		}
+	}
+	require.Equal(t, 0, p.Idle("covert:443"))
+}
+
+// dialing reports whether a pool dial to covert is in progress.
+func (p *CovertPool) dialing(covert string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.coverts[covert].dialing > 0
+}
+
+func TestDialCovertPrewarmed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go serveEcho(ln)
+	covert := ln.Addr().String()
+
+	pooled, err := net.Dial("tcp", covert)
+	require.Nil(t, err)
+	p := NewCovertPool([]string{covert}, 1, time.Minute, nil, log.New(ioutil.Discard, "", 0))
+	p.coverts[covert].idle = []pooledConn{{pooled, time.Now()}}
+	conf := &ProxyConfig{covertPool: p}
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+
+	conn, err := dialCovert(&DecoyRegistration{Covert: covert}, 1, conf, logger)
+	require.Nil(t, err)
+	require.Equal(t, pooled.LocalAddr(), conn.LocalAddr())
+	conn.Close()
+}
@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCovertResolverTimeout is the CovertResolverTimeout, in milliseconds,
+// used when none is configured.
+const defaultCovertResolverTimeout = 2000
+
+// maxCovertDNSCacheEntries bounds the covert host names remembered.
+const maxCovertDNSCacheEntries = 4096
+
+// CovertResolver resolves covert host names, over DNS over HTTPS (RFC 8484)
+// or DNS over TLS (RFC 7858) to a configured server when there is one rather
+// than through the system resolver, and caches the results.
+type CovertResolver struct {
+	doh      string // DoH URL, or
+	dot      string // DoT host:port
+	fallback bool   // use the system resolver if the upstream fails
+	timeout  time.Duration
+
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	system     lookupHostFunc
+
+	cacheTTL time.Duration
+	m        sync.Mutex
+	cache    map[string]covertDNSEntry
+	now      func() time.Time
+}
+
+type covertDNSEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewCovertResolver returns a resolver for upstream, a DoH URL
+// ("https://host/dns-query") or a DoT server ("tls://host[:port]"), or the
+// system resolver if upstream is empty. If fallback is set names the upstream
+// fails to resolve are looked up with the system resolver. Results are cached
+// for at most cacheTTL, zero disables caching.
+func NewCovertResolver(upstream string, fallback bool, timeout, cacheTTL time.Duration) (*CovertResolver, error) {
+	if timeout <= 0 {
+		timeout = defaultCovertResolverTimeout * time.Millisecond
+	}
+	r := &CovertResolver{
+		fallback:   fallback,
+		timeout:    timeout,
+		httpClient: &http.Client{Timeout: timeout},
+		system:     defaultLookupHost,
+		cacheTTL:   cacheTTL,
+		cache:      make(map[string]covertDNSEntry),
+		now:        time.Now,
+	}
+
+	switch {
+	case upstream == "":
+	case strings.HasPrefix(upstream, "https://"):
+		if _, err := url.Parse(upstream); err != nil {
+			return nil, fmt.Errorf("bad covert resolver URL: %v", err)
+		}
+		r.doh = upstream
+	case strings.HasPrefix(upstream, "tls://"):
+		addr := strings.TrimPrefix(upstream, "tls://")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+			addr = net.JoinHostPort(addr, "853")
+		}
+		r.dot = addr
+		r.tlsConfig = &tls.Config{ServerName: host}
+	default:
+		return nil, fmt.Errorf("unknown covert resolver %q, expected https://... (DoH) or tls://... (DoT)", upstream)
+	}
+	return r, nil
+}
+
+// LookupHost returns the addresses of host.
+func (r *CovertResolver) LookupHost(host string) ([]string, error) {
+	if addrs, ok := r.cached(host); ok {
+		return addrs, nil
+	}
+
+	if r.doh == "" && r.dot == "" {
+		addrs, err := r.system(host)
+		if err == nil {
+			r.store(host, addrs, r.cacheTTL)
+		}
+		return addrs, err
+	}
+
+	addrs, ttl, err := r.lookupUpstream(host)
+	if err == nil {
+		if ttl > r.cacheTTL {
+			ttl = r.cacheTTL
+		}
+		r.store(host, addrs, ttl)
+		return addrs, nil
+	}
+	if !r.fallback {
+		return nil, err
+	}
+
+	addrs, sysErr := r.system(host)
+	if sysErr != nil {
+		return nil, fmt.Errorf("%v, system resolver: %w", err, sysErr)
+	}
+	r.store(host, addrs, r.cacheTTL)
+	return addrs, nil
+}
+
+func (r *CovertResolver) cached(host string) ([]string, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	e, ok := r.cache[host]
+	if !ok || !r.now().Before(e.expires) {
+		return nil, false
+	}
+	return e.addrs, true
+}
+
+func (r *CovertResolver) store(host string, addrs []string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	now := r.now()
+	if len(r.cache) >= maxCovertDNSCacheEntries {
+		for h, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, h)
+			}
+		}
+		if len(r.cache) >= maxCovertDNSCacheEntries {
+			r.cache = make(map[string]covertDNSEntry)
+		}
+	}
+	r.cache[host] = covertDNSEntry{addrs, now.Add(ttl)}
+}
+
+// lookupUpstream queries the upstream for the A and AAAA records of host. It
+// returns the addresses and the smallest TTL among them. Errors are
+// *net.DNSError so that they are counted as DNS failures.
+func (r *CovertResolver) lookupUpstream(host string) ([]string, time.Duration, error) {
+	server := r.doh
+	if server == "" {
+		server = r.dot
+	}
+	var addrs []string
+	var minTTL time.Duration
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		resp, err := r.exchange(newDNSQuery(host, qtype))
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+		}
+		found, ttl, err := parseDNSAnswers(resp)
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+		}
+		if len(found) > 0 && (len(addrs) == 0 || ttl < minTTL) {
+			minTTL = ttl
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	return addrs, minTTL, nil
+}
+
+func (r *CovertResolver) exchange(query []byte) ([]byte, error) {
+	if r.doh != "" {
+		return r.exchangeDoH(query)
+	}
+	return r.exchangeDoT(query)
+}
+
+func (r *CovertResolver) exchangeDoH(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, r.doh, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (r *CovertResolver) exchangeDoT(query []byte) ([]byte, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: r.timeout}, "tcp", r.dot, r.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DNS record types and the response codes that are not an error.
+const (
+	dnsTypeA        = 1
+	dnsTypeAAAA     = 28
+	dnsClassIN      = 1
+	dnsRcodeNoError = 0
+	dnsRcodeNXName  = 3
+)
+
+var errDNSMalformed = errors.New("malformed DNS response")
+
+// newDNSQuery returns a recursive query for qtype records of name. The ID is
+// zero, as RFC 8484 recommends for DoH, answers are matched by connection.
+func newDNSQuery(name string, qtype uint16) []byte {
+	q := []byte{0, 0, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return q
+}
+
+// parseDNSAnswers returns the A and AAAA addresses in the answer section of
+// msg and the smallest TTL among them. A name that does not exist has no
+// addresses.
+func parseDNSAnswers(msg []byte) ([]string, time.Duration, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, 0, errDNSMalformed
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case dnsRcodeNoError:
+	case dnsRcodeNXName:
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("DNS server returned rcode %d", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		var ok bool
+		if off, ok = skipDNSName(msg, off); !ok || off+4 > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		off += 4
+	}
+
+	var addrs []string
+	var minTTL uint32
+	for i := 0; i < ancount; i++ {
+		var ok bool
+		if off, ok = skipDNSName(msg, off); !ok || off+10 > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		if (rtype == dnsTypeA && rdlen == net.IPv4len) || (rtype == dnsTypeAAAA && rdlen == net.IPv6len) {
+			addrs = append(addrs, net.IP(msg[off:off+rdlen]).String())
+			if len(addrs) == 1 || ttl < minTTL {
+				minTTL = ttl
+			}
+		}
+		off += rdlen
+	}
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
+
+// skipDNSName returns the offset following the (possibly compressed) name at
+// off.
+func skipDNSName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(msg)
+		default:
+			off += 1 + l
+		}
+	}
+	return 0, false
+}
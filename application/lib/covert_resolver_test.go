@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stubDoHServer answers every A query with 192.0.2.33 (TTL 300) and every
+// AAAA query with no records, counting the queries.
+func stubDoHServer(queries *int64) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(queries, 1)
+		q, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || len(q) < 17 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		resp := append([]byte(nil), q...)
+		resp[2] |= 0x80 // response
+		qtype := binary.BigEndian.Uint16(q[len(q)-4:])
+		if qtype == dnsTypeA {
+			resp[7] = 1 // ancount
+			resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 1, 44, 0, 4, 192, 0, 2, 33)
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+}
+
+func TestCovertResolverDoH(t *testing.T) {
+	var queries int64
+	srv := stubDoHServer(&queries)
+	defer srv.Close()
+
+	r, err := NewCovertResolver(srv.URL+"/dns-query", false, time.Second, time.Minute)
+	require.Nil(t, err)
+	r.httpClient = srv.Client()
+	r.system = func(host string) ([]string, error) {
+		t.Fatalf("system resolver used for %s", host)
+		return nil, nil
+	}
+
+	addrs, err := r.LookupHost("covert.example")
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.33"}, addrs)
+	require.Equal(t, int64(2), atomic.LoadInt64(&queries))
+
+	// Answered from cache.
+	addrs, err = r.LookupHost("covert.example")
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.33"}, addrs)
+	require.Equal(t, int64(2), atomic.LoadInt64(&queries))
+}
+
+func TestCovertResolverFallback(t *testing.T) {
+	var queries int64
+	srv := stubDoHServer(&queries)
+	srv.Close()
+
+	system := func(host string) ([]string, error) { return []string{"198.51.100.5"}, nil }
+
+	r, err := NewCovertResolver(srv.URL+"/dns-query", false, time.Second, 0)
+	require.Nil(t, err)
+	r.system = system
+	_, err = r.LookupHost("covert.example")
+	require.NotNil(t, err)
+	var dnsErr *net.DNSError
+	require.True(t, errors.As(err, &dnsErr))
+
+	r, err = NewCovertResolver(srv.URL+"/dns-query", true, time.Second, 0)
+	require.Nil(t, err)
+	r.system = system
+	addrs, err := r.LookupHost("covert.example")
+	require.Nil(t, err)
+	require.Equal(t, []string{"198.51.100.5"}, addrs)
+
+	_, err = NewCovertResolver("udp://192.0.2.1", true, 0, 0)
+	require.NotNil(t, err)
+}
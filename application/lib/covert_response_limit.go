@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// covertResponseLimitDefault is the category of coverts limited by
+// CovertMaxResponseBytes itself, the label of metrics.CovertResponseLimited.
+const covertResponseLimitDefault = "default"
+
+// ErrCovertResponseLimit ends the half of a session relaying from its covert
+// once the covert sent more than the session may relay, see
+// ProxyConfig.CovertMaxResponseBytes.
+var ErrCovertResponseLimit = errors.New("covert response limit exceeded")
+
+func (c *ProxyConfig) parseCovertResponseLimits() error {
+	if c.CovertMaxResponseBytes < 0 {
+		return fmt.Errorf("covert_max_response_bytes must not be negative")
+	}
+	c.covertResponseLimitPatterns = nil
+	for pattern := range c.CovertMaxResponseBytesCoverts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad covert_max_response_bytes_coverts pattern %q: %v", pattern, err)
+		}
+		c.covertResponseLimitPatterns = append(c.covertResponseLimitPatterns, pattern)
+	}
+	sort.Strings(c.covertResponseLimitPatterns)
+	return nil
+}
+
+// covertResponseLimit returns the bytes a session may relay from covert (a
+// host:port), zero for unlimited, and the category of the covert. conf may be
+// nil.
+func (c *ProxyConfig) covertResponseLimit(covert string) (int64, string) {
+	if c == nil {
+		return 0, covertResponseLimitDefault
+	}
+	limit, category := c.CovertMaxResponseBytes, covertResponseLimitDefault
+	if pattern, ok := matchCovertPattern(covert, c.covertResponseLimitPatterns); ok {
+		limit, category = c.CovertMaxResponseBytesCoverts[pattern], pattern
+	}
+	if limit < 0 {
+		return 0, category
+	}
+	return limit, category
+}
+
+// limitsCovertResponses reports whether the covert of a session is held to
+// its response limit (see withCovertResponseLimit). The limit is a safeguard
+// for sessions relayed straight to a plain covert, HTTP and the like: not
+// for mux streams or resumable sessions, which carry tunnels outliving any
+// one response (direct is false for them), coverts behind a covert transport
+// or the embedded echo covert. conf may be nil.
+func (c *ProxyConfig) limitsCovertResponses(direct bool) bool {
+	if !direct || c.covertEchoing() {
+		return false
+	}
+	_, plain := c.getCovertTransport().(noneCovertTransport)
+	return plain
+}
+
+// withCovertResponseLimit limits the bytes read from conn, a session's
+// connection to covert, to the covert's response limit. raw is the
+// connection returned by dialCovert that conn wraps, it is never reused once
+// the limit is hit as the rest of the response is left unread. conn is
+// returned as is if the covert is unlimited.
+func (c *ProxyConfig) withCovertResponseLimit(covert string, conn, raw net.Conn) net.Conn {
+	limit, category := c.covertResponseLimit(covert)
+	if limit == 0 {
+		return conn
+	}
+	return &responseLimitedConn{halfCloser: halfCloser{conn}, raw: raw, left: limit, category: category}
+}
+
+// responseLimitedConn returns the bytes up to its limit of a read going past
+// it with ErrCovertResponseLimit, counting the session in
+// metrics.CovertResponseLimited and tainting raw, and fails every read after.
+// Only the down half of the proxy reads a covert connection.
+type responseLimitedConn struct {
+	halfCloser
+	raw      net.Conn
+	left     int64
+	category string
+}
+
+func (c *responseLimitedConn) Read(b []byte) (int, error) {
+	if c.left < 0 {
+		return 0, ErrCovertResponseLimit
+	}
+	n, err := c.Conn.Read(b)
+	if int64(n) <= c.left {
+		c.left -= int64(n)
+		return n, err
+	}
+	n, c.left = int(c.left), -1
+	taintCovertConn(c.raw)
+	metrics.CovertResponseLimited.Inc(c.category)
+	return n, ErrCovertResponseLimit
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertResponseLimitSelect(t *testing.T) {
+	conf := &ProxyConfig{
+		CovertMaxResponseBytes: 1 << 20,
+		CovertMaxResponseBytesCoverts: map[string]int64{
+			"*:80":              4096,
+			"video.example:443": -1,
+		},
+	}
+	require.Nil(t, conf.parseCovertResponseLimits())
+
+	for covert, want := range map[string]int64{
+		"a.example:443":     1 << 20,
+		"a.example:80":      4096,
+		"video.example:443": 0,
+	} {
+		limit, _ := conf.covertResponseLimit(covert)
+		require.Equal(t, want, limit, covert)
+	}
+	_, category := conf.covertResponseLimit("a.example:80")
+	require.Equal(t, "*:80", category)
+	_, category = conf.covertResponseLimit("a.example:443")
+	require.Equal(t, covertResponseLimitDefault, category)
+	limit, _ := (*ProxyConfig)(nil).covertResponseLimit("a.example:443")
+	require.Equal(t, int64(0), limit)
+
+	// Only sessions relayed directly to a plain covert are limited.
+	require.True(t, (*ProxyConfig)(nil).limitsCovertResponses(true))
+	require.True(t, conf.limitsCovertResponses(true))
+	require.False(t, conf.limitsCovertResponses(false))
+	require.False(t, (&ProxyConfig{covertTransport: lengthPrefixCovertTransport{}}).limitsCovertResponses(true))
+	require.False(t, (&ProxyConfig{covertEcho: &covertEchoServer{}}).limitsCovertResponses(true))
+
+	require.NotNil(t, (&ProxyConfig{CovertMaxResponseBytes: -1}).parseCovertResponseLimits())
+	require.NotNil(t, (&ProxyConfig{CovertMaxResponseBytesCoverts: map[string]int64{"[:80": 1}}).parseCovertResponseLimits())
+}
+
+func TestProxyCovertResponseLimit(t *testing.T) {
+	// The covert answers a request with far more than the session may relay,
+	// and would keep the connection open.
+	response := bytes.Repeat([]byte("0123456789"), 10000)
+	covert := preambleCovert(t, func(conn net.Conn) {
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		conn.Write(response)
+		io.Copy(ioutil.Discard, conn)
+	})
+	conf := &ProxyConfig{CovertMaxResponseBytesCoverts: map[string]int64{covert: 4096}}
+	require.Nil(t, conf.parseCovertResponseLimits())
+	before := metrics.CovertResponseLimited.Value(covert)
+
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: covert}
+	var logs lockedBuffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(&logs, "", 0)}, conf)
+		stationClient.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.Write([]byte("GET "))
+	require.Nil(t, err)
+
+	// The session is cut at the cap, both ways.
+	received, _ := ioutil.ReadAll(client)
+	require.Equal(t, response[:4096], received)
+	<-done
+	require.Contains(t, logs.String(), "closed: "+string(CloseCovertLimit))
+	require.Equal(t, before+1, metrics.CovertResponseLimited.Value(covert))
+}
+
+// A reusable covert connection whose response was cut at the cap is not
+// reused, even though the client ended its half of the session cleanly.
+func TestProxyCovertResponseLimitReuse(t *testing.T) {
+	covert := preambleCovert(t, func(conn net.Conn) {
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		conn.Write(bytes.Repeat([]byte("x"), 5000))
+		// The rest of the response only arrives once the session is done
+		// with the connection.
+		time.Sleep(time.Second)
+		conn.Write(bytes.Repeat([]byte("x"), 5000))
+		io.Copy(ioutil.Discard, conn)
+	})
+	conf := &ProxyConfig{
+		CovertReuse:                   []string{covert},
+		CovertMaxResponseBytesCoverts: map[string]int64{covert: 4096},
+	}
+	require.Nil(t, conf.parseCovertReuse())
+	require.Nil(t, conf.parseCovertResponseLimits())
+	conf.covertReuse = NewCovertReusePool(conf.CovertReuseIdle, time.Minute)
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = covert
+
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, conf)
+		stationClient.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.Write([]byte("GET "))
+	require.Nil(t, err)
+	require.Nil(t, client.CloseWrite())
+	received, _ := ioutil.ReadAll(client)
+	require.Equal(t, 4096, len(received))
+	<-done
+	require.Equal(t, 0, conf.covertReuse.Idle(covertReuseKey(reg, covert)))
+}
@@ -0,0 +1,334 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+const (
+	// defaultCovertReuseIdle is the CovertReuseIdle used when none is
+	// configured.
+	defaultCovertReuseIdle = 2
+
+	// defaultCovertReuseMaxIdle is the CovertReuseMaxIdle, in seconds, used
+	// when none is configured.
+	defaultCovertReuseMaxIdle = 10
+
+	// defaultCovertReuseDrain is the CovertReuseDrain, in milliseconds, used
+	// when none is configured.
+	defaultCovertReuseDrain = 500
+
+	// covertReuseInterval is how often idle connections past
+	// CovertReuseMaxIdle are closed.
+	covertReuseInterval = time.Second
+)
+
+// Outcomes of the connections handled by the reuse pool, the label of
+// metrics.CovertReuse.
+const (
+	covertReuseHit     = "hit"
+	covertReuseMiss    = "miss"
+	covertReuseTainted = "tainted"
+	covertReuseEvicted = "evicted"
+)
+
+// CovertReusePool keeps the covert connections of ended sessions idle for a
+// while and hands them to the next session of the same registration to the
+// same covert, saving the covert handshakes of clients polling a covert
+// through many short sessions. Connections are keyed by covert and
+// registration ID so one client never gets another's connection. A
+// connection is only kept if the session ended with the client closing it
+// cleanly, and it is discarded instead of reused if the covert closed it or
+// sent anything on it since, as those bytes belong to the previous session.
+type CovertReusePool struct {
+	size    int
+	maxIdle time.Duration
+	drain   time.Duration
+	now     func() time.Time
+
+	m    sync.Mutex
+	idle map[string][]pooledConn
+}
+
+// NewCovertReusePool returns a pool keeping up to size idle connections per
+// covert and registration for at most maxIdle. Expired connections are only
+// closed by Run. Sessions wait for their covert to go quiet for the default
+// drain period, see reusableConn.
+func NewCovertReusePool(size int, maxIdle time.Duration) *CovertReusePool {
+	return &CovertReusePool{
+		size:    size,
+		maxIdle: maxIdle,
+		drain:   defaultCovertReuseDrain * time.Millisecond,
+		now:     time.Now,
+		idle:    make(map[string][]pooledConn),
+	}
+}
+
+// covertReuseKey is the pool key of the connections to covert of reg.
+func covertReuseKey(reg *DecoyRegistration, covert string) string {
+	return covert + " " + reg.IDString()
+}
+
+// Get takes an idle connection kept under key, it returns nil if there is no
+// usable one.
+func (p *CovertReusePool) Get(key string) net.Conn {
+	p.m.Lock()
+	defer p.m.Unlock()
+	now := p.now()
+	for conns := p.idle[key]; len(conns) > 0; conns = p.idle[key] {
+		pc := conns[len(conns)-1]
+		p.setIdle(key, conns[:len(conns)-1])
+		if now.Sub(pc.since) >= p.maxIdle {
+			pc.conn.Close()
+			metrics.CovertReuse.Inc(covertReuseEvicted)
+			continue
+		}
+		if !pooledConnAlive(pc.conn) {
+			pc.conn.Close()
+			metrics.CovertReuse.Inc(covertReuseTainted)
+			continue
+		}
+		metrics.CovertReuse.Inc(covertReuseHit)
+		return pc.conn
+	}
+	metrics.CovertReuse.Inc(covertReuseMiss)
+	return nil
+}
+
+// put keeps conn idle under key, evicting the oldest connection if key
+// already has the maximum number.
+func (p *CovertReusePool) put(key string, conn net.Conn) {
+	if !pooledConnAlive(conn) {
+		conn.Close()
+		metrics.CovertReuse.Inc(covertReuseTainted)
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	conns := p.idle[key]
+	if len(conns) >= p.size {
+		conns[0].conn.Close()
+		metrics.CovertReuse.Inc(covertReuseEvicted)
+		conns = conns[1:]
+	}
+	p.idle[key] = append(conns, pooledConn{conn, p.now()})
+}
+
+// setIdle replaces the idle connections of key. Called with p.m held.
+func (p *CovertReusePool) setIdle(key string, conns []pooledConn) {
+	if len(conns) == 0 {
+		delete(p.idle, key)
+		return
+	}
+	p.idle[key] = conns
+}
+
+// Idle returns the number of idle connections kept under key.
+func (p *CovertReusePool) Idle(key string) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.idle[key])
+}
+
+// Run closes idle connections once they are CovertReuseMaxIdle old, it does
+// not return.
+func (p *CovertReusePool) Run() {
+	ticker := time.NewTicker(covertReuseInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.expire()
+	}
+}
+
+func (p *CovertReusePool) expire() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	now := p.now()
+	for key, conns := range p.idle {
+		fresh := conns[:0]
+		for _, pc := range conns {
+			if now.Sub(pc.since) < p.maxIdle {
+				fresh = append(fresh, pc)
+			} else {
+				pc.conn.Close()
+				metrics.CovertReuse.Inc(covertReuseEvicted)
+			}
+		}
+		p.setIdle(key, fresh)
+	}
+}
+
+// track wraps conn, the covert connection of a session, so that it returns
+// to the pool under key when the session closes it.
+func (p *CovertReusePool) track(key string, conn net.Conn) net.Conn {
+	return &reusableConn{Conn: conn, pool: p, key: key}
+}
+
+// reusableConn is the covert connection of a session whose connection may be
+// reused. The client ending its half of the session (CloseWrite, from
+// halfPipe) does not send the covert a FIN, the covert could not be reused
+// after one. Instead the covert's response is still relayed until the covert
+// has sent nothing for the pool's drain period, after which the read of the
+// covert reports EOF, so both halves of the session end with the connection
+// still open. Close returns it to the pool unless a read or write on it
+// failed or the client never ended its half.
+type reusableConn struct {
+	net.Conn
+	pool *CovertReusePool
+	key  string
+
+	m          sync.Mutex
+	clientDone bool
+	tainted    bool
+	closed     bool
+}
+
+func (c *reusableConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err == nil {
+		if c.clientDone {
+			// The covert is still responding.
+			c.Conn.SetReadDeadline(time.Now().Add(c.pool.drain))
+		}
+		return n, nil
+	}
+	var netErr net.Error
+	if c.clientDone && errors.As(err, &netErr) && netErr.Timeout() {
+		return n, io.EOF
+	}
+	c.tainted = true
+	return n, err
+}
+
+func (c *reusableConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.m.Lock()
+		c.tainted = true
+		c.m.Unlock()
+	}
+	return n, err
+}
+
+// SetReadDeadline keeps the drain deadline once the client is done, e.g.
+// from the covert read timeout set before every read.
+func (c *reusableConn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.clientDone {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *reusableConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// CloseWrite ends the client's half of the session, see reusableConn.
+func (c *reusableConn) CloseWrite() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.clientDone = true
+	return c.Conn.SetReadDeadline(time.Now().Add(c.pool.drain))
+}
+
+// CloseRead does nothing, the connection stays open for reuse.
+func (c *reusableConn) CloseRead() error { return nil }
+
+func (c *reusableConn) taint() {
+	c.m.Lock()
+	c.tainted = true
+	c.m.Unlock()
+}
+
+func (c *reusableConn) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.tainted || !c.clientDone {
+		if c.clientDone {
+			metrics.CovertReuse.Inc(covertReuseTainted)
+		}
+		return c.Conn.Close()
+	}
+	if err := c.Conn.SetDeadline(time.Time{}); err != nil {
+		return c.Conn.Close()
+	}
+	c.pool.put(c.key, c.Conn)
+	return nil
+}
+
+// taintCovertConn keeps conn, as returned by dialCovert, from being reused.
+func taintCovertConn(conn net.Conn) {
+	if tc, ok := conn.(*timeoutConn); ok {
+		conn = tc.Conn
+	}
+	if rc, ok := conn.(*reusableConn); ok {
+		rc.taint()
+	}
+}
+
+func (c *ProxyConfig) parseCovertReuse() error {
+	for _, covert := range c.CovertReuse {
+		if _, _, err := net.SplitHostPort(covert); err != nil {
+			return fmt.Errorf("covert_reuse %q: %v", covert, err)
+		}
+	}
+	if c.CovertReuseIdle <= 0 {
+		c.CovertReuseIdle = defaultCovertReuseIdle
+	}
+	if c.CovertReuseMaxIdle <= 0 {
+		c.CovertReuseMaxIdle = defaultCovertReuseMaxIdle
+	}
+	if c.CovertReuseDrain <= 0 {
+		c.CovertReuseDrain = defaultCovertReuseDrain
+	}
+	return nil
+}
+
+// StartCovertReuse starts keeping the covert connections of ended sessions
+// to the CovertReuse coverts, if any. It must be called before sessions are
+// proxied.
+func (c *ProxyConfig) StartCovertReuse() {
+	if len(c.CovertReuse) == 0 {
+		return
+	}
+	c.covertReuse = NewCovertReusePool(c.CovertReuseIdle, time.Duration(c.CovertReuseMaxIdle)*time.Second)
+	c.covertReuse.drain = time.Duration(c.CovertReuseDrain) * time.Millisecond
+	go c.covertReuse.Run()
+}
+
+// covertReusable reports whether the connection to covert of a session of
+// reg may be reused: covert is listed in CovertReuse and the station only
+// forwards bytes on the connection. A covert transport, the PROXY header and
+// strict TLS all tie state to a single connection, sessions using them never
+// reuse one.
+func (c *ProxyConfig) covertReusable(reg *DecoyRegistration, covert string) bool {
+	if c == nil || c.covertReuse == nil || c.CovertStrictTLS || c.CovertTLS[covert] != nil || reg.Flags.GetProxyHeader() || c.covertPreamble(covert) != nil {
+		return false
+	}
+	if _, plain := c.getCovertTransport().(noneCovertTransport); !plain {
+		return false
+	}
+	for _, reusable := range c.CovertReuse {
+		if reusable == covert {
+			return true
+		}
+	}
+	return false
+}
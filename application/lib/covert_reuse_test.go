@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertReusePool(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	p := NewCovertReusePool(2, time.Minute)
+	p.now = func() time.Time { return now }
+
+	var peers []*net.TCPConn
+	conn := func() net.Conn {
+		a, b := tcpPair(t)
+		peers = append(peers, b)
+		return a
+	}
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	misses := metrics.CovertReuse.Value(covertReuseMiss)
+	require.Nil(t, p.Get("covert:443 a"))
+	require.Equal(t, misses+1, metrics.CovertReuse.Value(covertReuseMiss))
+
+	kept := conn()
+	p.put("covert:443 a", kept)
+	require.Nil(t, p.Get("covert:443 b"))
+	require.Equal(t, kept, p.Get("covert:443 a"))
+
+	// A connection the covert sent data on while idle is never handed out.
+	tainted := metrics.CovertReuse.Value(covertReuseTainted)
+	p.put("covert:443 a", kept)
+	peers[0].Write([]byte("late response"))
+	time.Sleep(50 * time.Millisecond)
+	require.Nil(t, p.Get("covert:443 a"))
+	require.Equal(t, tainted+1, metrics.CovertReuse.Value(covertReuseTainted))
+
+	// The oldest connections make room for new ones and expire.
+	evicted := metrics.CovertReuse.Value(covertReuseEvicted)
+	for i := 0; i < 3; i++ {
+		p.put("covert:443 a", conn())
+	}
+	require.Equal(t, 2, p.Idle("covert:443 a"))
+	now = now.Add(time.Minute)
+	p.expire()
+	require.Equal(t, 0, p.Idle("covert:443 a"))
+	require.Equal(t, evicted+3, metrics.CovertReuse.Value(covertReuseEvicted))
+}
+
+func TestProxyCovertReuse(t *testing.T) {
+	covert, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	var accepted int64
+	go func() {
+		for {
+			conn, err := covert.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	conf := &ProxyConfig{CovertReuse: []string{covert.Addr().String()}}
+	require.Nil(t, conf.parseCovertReuse())
+	conf.covertReuse = NewCovertReusePool(conf.CovertReuseIdle, time.Minute)
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+
+	// session proxies one client session of reg, sending and reading back
+	// msg, and returns once Proxy did. A client with reset set aborts the
+	// session with a reset instead of closing it.
+	session := func(reg *DecoyRegistration, msg string, reset bool) {
+		client, stationClient := tcpPair(t)
+		done := make(chan struct{})
+		go func() {
+			Proxy(reg, stationClient, 443, nil, logger, conf)
+			stationClient.Close()
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.WriteString(client, msg)
+		require.Nil(t, err)
+		echoed := make([]byte, len(msg))
+		_, err = io.ReadFull(client, echoed)
+		require.Nil(t, err)
+		require.Equal(t, msg, string(echoed))
+		if reset {
+			client.SetLinger(0)
+		}
+		client.Close()
+		<-done
+	}
+
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = covert.Addr().String()
+	hits := metrics.CovertReuse.Value(covertReuseHit)
+	for i := 0; i < 3; i++ {
+		session(reg, "poll", false)
+		require.Equal(t, 1, conf.covertReuse.Idle(covertReuseKey(reg, reg.Covert)))
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&accepted))
+	require.Equal(t, hits+2, metrics.CovertReuse.Value(covertReuseHit))
+
+	// Another registration's sessions get a connection of their own.
+	other := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	other.Covert = reg.Covert
+	session(other, "poll", false)
+	require.Equal(t, int64(2), atomic.LoadInt64(&accepted))
+
+	// A session that did not end cleanly leaves nothing to reuse.
+	session(reg, "poll", true)
+	require.Equal(t, 0, conf.covertReuse.Idle(covertReuseKey(reg, reg.Covert)))
+
+	// Connections framed by a covert transport are never reused.
+	conf.CovertTransport = "length-prefix"
+	require.Nil(t, conf.parseCovertTransport())
+	require.False(t, conf.covertReusable(reg, reg.Covert))
+}
+
+// A client ending its half right after its request still gets the covert's
+// whole response, and the connection is kept once the covert is quiet.
+func TestProxyCovertReuseDrain(t *testing.T) {
+	covert, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	go func() {
+		for {
+			conn, err := covert.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return
+					}
+					// A slow response, in two parts.
+					time.Sleep(50 * time.Millisecond)
+					io.WriteString(conn, "resp")
+					time.Sleep(50 * time.Millisecond)
+					io.WriteString(conn, "onse")
+				}
+			}()
+		}
+	}()
+
+	conf := &ProxyConfig{CovertReuse: []string{covert.Addr().String()}, CovertReuseDrain: 200}
+	require.Nil(t, conf.parseCovertReuse())
+	conf.covertReuse = NewCovertReusePool(conf.CovertReuseIdle, time.Minute)
+	conf.covertReuse.drain = time.Duration(conf.CovertReuseDrain) * time.Millisecond
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = covert.Addr().String()
+
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, conf)
+		stationClient.Close()
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(client, "poll")
+	require.Nil(t, err)
+	require.Nil(t, client.CloseWrite())
+	response, err := ioutil.ReadAll(client)
+	require.Nil(t, err)
+	require.Equal(t, "response", string(response))
+	<-done
+	require.Equal(t, 1, conf.covertReuse.Idle(covertReuseKey(reg, reg.Covert)))
+}
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// covertSelectLabel names the SeededRand stream used to pick a covert address.
+const covertSelectLabel = "covert-select"
+
+// IP families a covert may be restricted to, see ProxyConfig.CovertFamily.
+const (
+	CovertFamilyAuto = "auto"
+	CovertFamilyV4   = "v4"
+	CovertFamilyV6   = "v6"
+)
+
+// ErrCovertFamily is wrapped by errors for coverts that have no address in the
+// IP family they are restricted to.
+var ErrCovertFamily = errors.New("no covert address in required IP family")
+
+func parseCovertFamily(family string) (string, error) {
+	switch family {
+	case "", CovertFamilyAuto:
+		return CovertFamilyAuto, nil
+	case CovertFamilyV4, CovertFamilyV6:
+		return family, nil
+	default:
+		return "", fmt.Errorf("unknown covert family %q, expected auto, v4 or v6", family)
+	}
+}
+
+// inCovertFamily reports whether ip belongs to family.
+func inCovertFamily(ip net.IP, family string) bool {
+	switch family {
+	case CovertFamilyV4:
+		return ip.To4() != nil
+	case CovertFamilyV6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// lookupHostFunc resolves a host name to its addresses.
+type lookupHostFunc func(host string) ([]string, error)
+
+func defaultLookupHost(host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(context.Background(), host)
+}
+
+// covertCandidates returns the addresses to dial, in order, for covert (a
+// host:port), keeping only addresses in family. When the host has several
+// addresses the first one is chosen from the registration shared secret so
+// that a client reconnecting with the same registration lands on the same
+// backend while different clients spread evenly across them. The remaining
+// addresses follow as fallbacks.
+func covertCandidates(covert string, sharedSecret []byte, family string, lookup lookupHostFunc) ([]string, error) {
+	host, port, err := net.SplitHostPort(covert)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !inCovertFamily(ip, family) {
+			return nil, fmt.Errorf("%w: covert %s is not %s", ErrCovertFamily, host, family)
+		}
+		return []string{covert}, nil
+	}
+
+	resolved, err := lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("no addresses for covert host %s", host)
+	}
+	var addrs []string
+	for _, addr := range resolved {
+		if ip := net.ParseIP(addr); ip != nil && inCovertFamily(ip, family) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: covert host %s has no %s address (resolved %d)", ErrCovertFamily, host, family, len(resolved))
+	}
+	// Resolvers rotate their answers, only the set of addresses is stable.
+	sort.Strings(addrs)
+
+	start := int(NewSeededRand(sharedSecret, covertSelectLabel).UintN(uint64(len(addrs))))
+	candidates := make([]string, 0, len(addrs))
+	for i := range addrs {
+		candidates = append(candidates, net.JoinHostPort(addrs[(start+i)%len(addrs)], port))
+	}
+	return candidates, nil
+}
+
+// covertDialOK is the outcome of a successful covert dial, as logged by
+// dialCovert. Failed dials are logged with the class of their error.
+const covertDialOK = "ok"
+
+// covertDialOutcome returns the outcome of a covert dial (or lookup): ok, or
+// the class of its error (see classifyCovertErr).
+func covertDialOutcome(err error) string {
+	if err == nil {
+		return covertDialOK
+	}
+	return classifyCovertErr(err)
+}
+
+// redactCovertAddr returns addr for logging, with the host removed if redact
+// is set.
+func redactCovertAddr(addr string, redact bool) string {
+	if !redact {
+		return addr
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort("[redacted]", port)
+	}
+	return "[redacted]"
+}
+
+// dialCovert connects to the covert address of reg, or one of its fallbacks,
+// see dialCovertFallbacks.
+func dialCovert(reg *DecoyRegistration, id uint64, conf *ProxyConfig, logger *Logger) (net.Conn, error) {
+	conn, _, _, err := dialCovertFallbacks(reg, reg.Covert, id, conf, logger)
+	return conn, err
+}
+
+// dialCovertTo connects to covert for a session of reg, see covertCandidates.
+// Every attempt is logged with its outcome and duration under connection ID
+// id, successes at debug level and failures at warn level. Each attempt is
+// bounded by the covert connect timeout, and all of them (TLS handshakes
+// included) by deadline unless it is zero. The returned connection enforces
+// the covert read and write timeouts. The idle connection of an earlier
+// session of reg to covert (see CovertReusePool) or a pre-warmed connection (see
+// CovertPool) is used if conf has one for the covert. For coverts in
+// CovertTLS the returned connection is the station's TLS connection, a failed
+// handshake fails the attempt. conf may be nil.
+func dialCovertTo(reg *DecoyRegistration, covert string, id uint64, deadline time.Time, conf *ProxyConfig, logger *Logger) (conn net.Conn, err error) {
+	defer func() { conf.noteCovertDial(covert, err) }()
+
+	var secret []byte
+	if reg.Keys != nil {
+		secret = reg.Keys.SharedSecret
+	}
+	redact := conf != nil && conf.RedactCovert
+	// wrap adds the covert timeouts and, if the connection may be reused,
+	// returns it to the reuse pool once the session is done with it.
+	wrap := func(conn net.Conn) net.Conn {
+		if conf.covertReusable(reg, covert) {
+			conn = conf.covertReuse.track(covertReuseKey(reg, covert), conn)
+		}
+		return conf.withCovertTimeouts(conn)
+	}
+	// Errors quote the address, so they are left out when it is redacted.
+	logFailure := func(addr string, start time.Time, err error) {
+		detail := ""
+		if !redact {
+			detail = ": " + err.Error()
+		}
+		outcome := covertDialOutcome(err)
+		metrics.CovertDialFailures.Inc(outcome)
+		logger.Warnf("covert dial conn=%d covert=%s outcome=%s duration=%v%s", id,
+			redactCovertAddr(addr, redact), outcome, time.Since(start), detail)
+	}
+	if conf.covertReusable(reg, covert) {
+		if reused := conf.covertReuse.Get(covertReuseKey(reg, covert)); reused != nil {
+			logger.Debugf("covert dial conn=%d covert=%s outcome=%s reused", id,
+				redactCovertAddr(reused.RemoteAddr().String(), redact), covertDialOK)
+			return wrap(reused), nil
+		}
+	}
+	if pooled := conf.prewarmedCovert(covert); pooled != nil {
+		start := time.Now()
+		addr := pooled.RemoteAddr().String()
+		conn, err := conf.covertTLSClient(reg, covert, wrap(pooled), deadline)
+		if err == nil {
+			logger.Debugf("covert dial conn=%d covert=%s outcome=%s pre-warmed", id,
+				redactCovertAddr(addr, redact), covertDialOK)
+			return conn, nil
+		}
+		// Dialed anew below.
+		logFailure(addr, start, err)
+	}
+
+	start := time.Now()
+	candidates, err := covertCandidates(covert, secret, conf.covertFamily(covert), conf.covertLookupHost())
+	if err != nil {
+		logFailure(covert, start, err)
+		return nil, err
+	}
+
+	for i, addr := range candidates {
+		start = time.Now()
+		var conn net.Conn
+		var timeout time.Duration
+		if loop := conf.covertLoop(addr); loop != "" {
+			metrics.CovertLoops.Inc(loop)
+			err = fmt.Errorf("%w: %s (%s)", ErrCovertLoop, addr, loop)
+		} else if conf.covertBlocklisted(addr) {
+			err = fmt.Errorf("%w: %s", ErrCovertBlocklisted, addr)
+		} else if release, werr := conf.acquireCovertWarmup(deadline); werr != nil {
+			err = werr
+		} else {
+			if timeout, err = conf.covertAttemptTimeout(deadline); err == nil {
+				conn, err = net.DialTimeout("tcp", addr, timeout)
+			}
+			release()
+		}
+		if err == nil {
+			conn, err = conf.covertTLSClient(reg, covert, wrap(conn), deadline)
+		}
+		if err == nil {
+			logger.Debugf("covert dial conn=%d covert=%s outcome=%s duration=%v", id,
+				redactCovertAddr(addr, redact), covertDialOK, time.Since(start))
+			return conn, nil
+		}
+		logFailure(addr, start, err)
+		if i == len(candidates)-1 {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no covert address to dial")
+}
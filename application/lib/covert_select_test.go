@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertCandidates(t *testing.T) {
+	backends := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	lookups := 0
+	lookup := func(host string) ([]string, error) {
+		require.Equal(t, "covert.example", host)
+		// Answers come back rotated, as from a round robin resolver.
+		lookups++
+		i := lookups % len(backends)
+		return append(append([]string{}, backends[i:]...), backends[:i]...), nil
+	}
+
+	// IP literals are used as is.
+	c, err := covertCandidates("1.2.3.4:443", []byte("secret"), CovertFamilyAuto, lookup)
+	require.Nil(t, err)
+	require.Equal(t, []string{"1.2.3.4:443"}, c)
+
+	// The same secret always lands on the same backend, with the others as
+	// fallbacks.
+	first, err := covertCandidates("covert.example:443", []byte("secret"), CovertFamilyAuto, lookup)
+	require.Nil(t, err)
+	require.Len(t, first, len(backends))
+	for i := 0; i < 10; i++ {
+		again, err := covertCandidates("covert.example:443", []byte("secret"), CovertFamilyAuto, lookup)
+		require.Nil(t, err)
+		require.Equal(t, first, again)
+	}
+
+	// Different secrets spread roughly evenly.
+	counts := map[string]int{}
+	const n = 4000
+	for i := 0; i < n; i++ {
+		c, err := covertCandidates("covert.example:443", []byte(fmt.Sprintf("secret-%d", i)), CovertFamilyAuto, lookup)
+		require.Nil(t, err)
+		counts[c[0]]++
+	}
+	require.Len(t, counts, len(backends))
+	for addr, count := range counts {
+		require.True(t, count > n/len(backends)*8/10 && count < n/len(backends)*12/10,
+			"%s chosen %d times out of %d", addr, count, n)
+	}
+
+	_, err = covertCandidates("no-port", []byte("secret"), CovertFamilyAuto, lookup)
+	require.NotNil(t, err)
+}
+
+func TestCovertCandidatesFamily(t *testing.T) {
+	lookup := func(host string) ([]string, error) {
+		switch host {
+		case "dual.example":
+			return []string{"2001:db8::2", "192.0.2.1", "2001:db8::1", "192.0.2.2"}, nil
+		case "v4only.example":
+			return []string{"192.0.2.1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	secret := []byte("secret")
+
+	c, err := covertCandidates("dual.example:443", secret, CovertFamilyAuto, lookup)
+	require.Nil(t, err)
+	require.Len(t, c, 4)
+
+	c, err = covertCandidates("dual.example:443", secret, CovertFamilyV4, lookup)
+	require.Nil(t, err)
+	sort.Strings(c)
+	require.Equal(t, []string{"192.0.2.1:443", "192.0.2.2:443"}, c)
+
+	c, err = covertCandidates("dual.example:443", secret, CovertFamilyV6, lookup)
+	require.Nil(t, err)
+	sort.Strings(c)
+	require.Equal(t, []string{"[2001:db8::1]:443", "[2001:db8::2]:443"}, c)
+
+	// No address in the required family.
+	_, err = covertCandidates("v4only.example:443", secret, CovertFamilyV6, lookup)
+	require.True(t, errors.Is(err, ErrCovertFamily), "%v", err)
+	require.Contains(t, err.Error(), "v4only.example has no v6 address")
+
+	// IP literals must match too.
+	_, err = covertCandidates("192.0.2.1:443", secret, CovertFamilyV6, lookup)
+	require.True(t, errors.Is(err, ErrCovertFamily), "%v", err)
+	c, err = covertCandidates("[2001:db8::1]:443", secret, CovertFamilyV6, lookup)
+	require.Nil(t, err)
+	require.Equal(t, []string{"[2001:db8::1]:443"}, c)
+}
+
+func TestProxyConfigCovertFamily(t *testing.T) {
+	conf := &ProxyConfig{CovertFamily: "v4", CovertFamilies: map[string]string{"v6.example": "v6", "any.example": ""}}
+	require.Nil(t, conf.parseCovertFamilies())
+	require.Equal(t, CovertFamilyV4, conf.covertFamily("other.example:443"))
+	require.Equal(t, CovertFamilyV6, conf.covertFamily("v6.example:443"))
+	require.Equal(t, CovertFamilyAuto, conf.covertFamily("any.example:443"))
+
+	var unset *ProxyConfig
+	require.Equal(t, CovertFamilyAuto, unset.covertFamily("other.example:443"))
+
+	bad := &ProxyConfig{CovertFamily: "ipv4"}
+	require.NotNil(t, bad.parseCovertFamilies())
+}
+
+func TestDialCovertLogsOutcome(t *testing.T) {
+	defer SetLogLevel(LevelInfo)
+	SetLogLevel(LevelDebug)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	var buf bytes.Buffer
+	logger := &Logger{log.New(&buf, "", 0)}
+
+	conn, err := dialCovert(&DecoyRegistration{Covert: ln.Addr().String()}, 7, nil, logger)
+	require.Nil(t, err)
+	conn.Close()
+	require.Contains(t, buf.String(), "[DEBUG] covert dial conn=7 covert="+ln.Addr().String()+" outcome=ok")
+
+	// Nothing listens on a port we just closed.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+
+	buf.Reset()
+	_, err = dialCovert(&DecoyRegistration{Covert: addr}, 8, &ProxyConfig{RedactCovert: true}, logger)
+	require.NotNil(t, err)
+	_, port, _ := net.SplitHostPort(addr)
+	require.Equal(t, "[WARN] covert dial conn=8 covert=[redacted]:"+port+" outcome=refused", strings.SplitN(buf.String(), " duration=", 2)[0])
+	require.NotContains(t, buf.String(), "127.0.0.1")
+}
+
+type dialTimeoutErr struct{}
+
+func (dialTimeoutErr) Error() string   { return "i/o timeout" }
+func (dialTimeoutErr) Timeout() bool   { return true }
+func (dialTimeoutErr) Temporary() bool { return true }
+
+func TestCovertDialOutcome(t *testing.T) {
+	require.Equal(t, covertDialOK, covertDialOutcome(nil))
+	require.Equal(t, covertErrDNS, covertDialOutcome(&net.DNSError{Err: "no such host", Name: "x"}))
+	require.Equal(t, covertErrTimeout, covertDialOutcome(&net.OpError{Op: "dial", Err: dialTimeoutErr{}}))
+	require.Equal(t, covertErrOther, covertDialOutcome(fmt.Errorf("boom")))
+}
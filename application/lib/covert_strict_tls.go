@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// strictTLSPort is the only covert port allowed with CovertStrictTLS. It is a
+// variable so tests can run coverts on ephemeral ports.
+var strictTLSPort = "443"
+
+const (
+	// Time a client has to start its TLS handshake with the covert.
+	strictTLSClientTimeout = 10 * time.Second
+
+	// Time the station's own handshake with a covert may take.
+	strictTLSVerifyTimeout = 5 * time.Second
+
+	// How long a covert address that passed certificate verification is
+	// trusted before it is verified again.
+	strictTLSVerifiedTTL = 10 * time.Minute
+
+	// Verified covert addresses remembered before expired ones are pruned.
+	strictTLSVerifiedMax = 1024
+)
+
+// Checks a session or registration can fail in strict TLS mode, the label of
+// metrics.StrictTLSRejections.
+const (
+	strictTLSCheckPort      = "port"
+	strictTLSCheckClientTLS = "client_tls"
+	strictTLSCheckCovertTLS = "covert_tls"
+)
+
+// strictTLSVerified remembers covert addresses whose certificate verified,
+// keyed by covert and dialed address, with the time the result expires.
+var strictTLSVerified = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// ViolatesStrictTLS reports whether covert may not be used because
+// CovertStrictTLS is enabled and covert is not on port 443. Registrations
+// failing this are rejected, and counted, before they are added.
+func (c *ProxyConfig) ViolatesStrictTLS(covert string) bool {
+	if c == nil || !c.CovertStrictTLS {
+		return false
+	}
+	_, port, err := net.SplitHostPort(covert)
+	if err == nil && port == strictTLSPort {
+		return false
+	}
+	metrics.StrictTLSRejections.Inc(strictTLSCheckPort)
+	return true
+}
+
+// checkStrictTLSClient waits for the first byte the client sends towards the
+// covert and requires it to start a TLS handshake record. It returns a conn
+// that still reads that byte.
+func checkStrictTLSClient(clientConn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(strictTLSClientTimeout))
+	first, err := r.Peek(1)
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		metrics.StrictTLSRejections.Inc(strictTLSCheckClientTLS)
+		return nil, fmt.Errorf("client sent no TLS handshake: %v", err)
+	}
+	if first[0] != tlsRecordTypeHandshake {
+		metrics.StrictTLSRejections.Inc(strictTLSCheckClientTLS)
+		return nil, fmt.Errorf("client sent a non-TLS record (first byte %#x)", first[0])
+	}
+	return makeBufferedReaderConn(clientConn, r), nil
+}
+
+// verifyStrictTLSCovert completes a TLS handshake of the station's own with
+// the covert at addr, the address the session's covert connection was made
+// to, verifying the certificate for the covert's host name (or IP address).
+// Results are cached for strictTLSVerifiedTTL, failures are never cached.
+func (c *ProxyConfig) verifyStrictTLSCovert(covert, addr string) error {
+	key := covert + " " + addr
+	now := time.Now()
+	strictTLSVerified.Lock()
+	expires, ok := strictTLSVerified.m[key]
+	strictTLSVerified.Unlock()
+	if ok && now.Before(expires) {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(covert)
+	if err != nil {
+		metrics.StrictTLSRejections.Inc(strictTLSCheckCovertTLS)
+		return err
+	}
+	dialer := &net.Dialer{Timeout: strictTLSVerifyTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host, RootCAs: c.strictTLSRoots})
+	if err != nil {
+		metrics.StrictTLSRejections.Inc(strictTLSCheckCovertTLS)
+		return fmt.Errorf("covert failed TLS verification: %v", err)
+	}
+	conn.Close()
+
+	strictTLSVerified.Lock()
+	if len(strictTLSVerified.m) >= strictTLSVerifiedMax {
+		for k, exp := range strictTLSVerified.m {
+			if now.After(exp) {
+				delete(strictTLSVerified.m, k)
+			}
+		}
+	}
+	strictTLSVerified.m[key] = now.Add(strictTLSVerifiedTTL)
+	strictTLSVerified.Unlock()
+	return nil
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViolatesStrictTLS(t *testing.T) {
+	conf := &ProxyConfig{}
+	require.False(t, conf.ViolatesStrictTLS("192.0.2.1:80"))
+
+	conf.CovertStrictTLS = true
+	before := metrics.StrictTLSRejections.Value(strictTLSCheckPort)
+	require.False(t, conf.ViolatesStrictTLS("192.0.2.1:443"))
+	require.False(t, conf.ViolatesStrictTLS("example.com:443"))
+	require.True(t, conf.ViolatesStrictTLS("192.0.2.1:80"))
+	require.True(t, conf.ViolatesStrictTLS("example.com"))
+	require.Equal(t, before+2, metrics.StrictTLSRejections.Value(strictTLSCheckPort))
+}
+
+// strictTLSProxy proxies a new client connection to covert with strict TLS
+// mode enabled, trusting roots, and returns the client's end. The station's
+// end is closed once Proxy returns, as the station does.
+func strictTLSProxy(t *testing.T, covert string, roots *x509.CertPool) net.Conn {
+	client, stationClient := tcpPair(t)
+	conf := &ProxyConfig{CovertStrictTLS: true, strictTLSRoots: roots}
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: covert}
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+	go func() {
+		Proxy(reg, stationClient, 443, nil, logger, conf)
+		stationClient.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func TestProxyStrictTLS(t *testing.T) {
+	https := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "covert")
+	}))
+	defer https.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer plain.Close()
+	go serveEcho(plain)
+
+	defer func(port string) { strictTLSPort = port }(strictTLSPort)
+
+	t.Run("https covert", func(t *testing.T) {
+		_, strictTLSPort, _ = net.SplitHostPort(https.Listener.Addr().String())
+		before := metrics.StrictTLSRejections.Value(strictTLSCheckCovertTLS)
+		client := strictTLSProxy(t, https.Listener.Addr().String(), roots)
+		defer client.Close()
+
+		conn := tls.Client(client, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots})
+		_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: covert\r\nConnection: close\r\n\r\n")
+		require.Nil(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "covert", string(body))
+		require.Equal(t, before, metrics.StrictTLSRejections.Value(strictTLSCheckCovertTLS))
+	})
+
+	t.Run("plaintext covert", func(t *testing.T) {
+		_, strictTLSPort, _ = net.SplitHostPort(plain.Addr().String())
+		before := metrics.StrictTLSRejections.Value(strictTLSCheckCovertTLS)
+		client := strictTLSProxy(t, plain.Addr().String(), roots)
+		defer client.Close()
+
+		// The station's own handshake with the echo server fails, so the
+		// client's is never answered.
+		conn := tls.Client(client, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots})
+		require.NotNil(t, conn.Handshake())
+		require.Equal(t, before+1, metrics.StrictTLSRejections.Value(strictTLSCheckCovertTLS))
+	})
+
+	t.Run("plaintext client", func(t *testing.T) {
+		_, strictTLSPort, _ = net.SplitHostPort(https.Listener.Addr().String())
+		before := metrics.StrictTLSRejections.Value(strictTLSCheckClientTLS)
+		client := strictTLSProxy(t, https.Listener.Addr().String(), roots)
+		defer client.Close()
+
+		_, err := io.WriteString(client, "GET / HTTP/1.1\r\nHost: covert\r\n\r\n")
+		require.Nil(t, err)
+		_, err = client.Read(make([]byte, 1))
+		require.NotNil(t, err)
+		require.Equal(t, before+1, metrics.StrictTLSRejections.Value(strictTLSCheckClientTLS))
+	})
+}
+
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
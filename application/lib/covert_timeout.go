@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+)
+
+// covertConnectTimeout returns the deadline for establishing a covert
+// connection, zero for none. conf may be nil.
+func (c *ProxyConfig) covertConnectTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.CovertConnectTimeout) * time.Millisecond
+}
+
+// withCovertTimeouts applies the configured read and write timeouts to an
+// established covert connection. conn is returned as is if neither is set.
+func (c *ProxyConfig) withCovertTimeouts(conn net.Conn) net.Conn {
+	if c == nil || (c.CovertReadTimeout <= 0 && c.CovertWriteTimeout <= 0) {
+		return conn
+	}
+	return &timeoutConn{
+		halfCloser:   halfCloser{conn},
+		clock:        c.getClock(),
+		readTimeout:  time.Duration(c.CovertReadTimeout) * time.Millisecond,
+		writeTimeout: time.Duration(c.CovertWriteTimeout) * time.Millisecond,
+	}
+}
+
+// timeoutConn extends the deadline of a connection before every read and
+// write, so an operation fails if it makes no progress for the timeout. A
+// deadline set explicitly, e.g. for a TLS handshake, still applies when it is
+// the sooner.
+type timeoutConn struct {
+	halfCloser
+	clock        clock.Clock
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	m             sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.m.Lock()
+		deadline := soonerDeadline(c.clock.Now(), c.readDeadline, c.readTimeout)
+		c.m.Unlock()
+		c.Conn.SetReadDeadline(deadline)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.m.Lock()
+		deadline := soonerDeadline(c.clock.Now(), c.writeDeadline, c.writeTimeout)
+		c.m.Unlock()
+		c.Conn.SetWriteDeadline(deadline)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.m.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.m.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	c.readDeadline = t
+	c.m.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.m.Lock()
+	c.writeDeadline = t
+	c.m.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// soonerDeadline returns the sooner of deadline, zero for none, and timeout
+// from now.
+func soonerDeadline(now, deadline time.Time, timeout time.Duration) time.Time {
+	if d := now.Add(timeout); deadline.IsZero() || d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
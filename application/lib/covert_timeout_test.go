@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// A covert that accepts connections but never sends anything must connect
+// fine and then have reads time out.
+func TestCovertReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	conf := &ProxyConfig{CovertConnectTimeout: 1000, CovertReadTimeout: 50, CovertWriteTimeout: 1000}
+	logger := &Logger{log.New(&bytes.Buffer{}, "", 0)}
+	conn, err := dialCovert(&DecoyRegistration{Covert: ln.Addr().String()}, 1, conf, logger)
+	require.Nil(t, err)
+	defer conn.Close()
+	defer func() {
+		if c := <-accepted; c != nil {
+			c.Close()
+		}
+	}()
+
+	// Writes still work, the covert just never answers.
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(t, err)
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 16))
+	require.NotNil(t, err)
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, netErr.Timeout())
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+	require.True(t, time.Since(start) < time.Second)
+
+	// Half-closes still reach the TCP connection.
+	_, ok = conn.(interface{ CloseWrite() error })
+	require.True(t, ok)
+}
+
+func TestCovertTimeoutsDisabled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var conf *ProxyConfig
+	require.Equal(t, time.Duration(0), conf.covertConnectTimeout())
+	require.Equal(t, c1, conf.withCovertTimeouts(c1))
+	require.Equal(t, c1, (&ProxyConfig{CovertConnectTimeout: 10}).withCovertTimeouts(c1))
+	require.Equal(t, 10*time.Millisecond, (&ProxyConfig{CovertConnectTimeout: 10}).covertConnectTimeout())
+}
+
+// A deadline set explicitly, as for a TLS handshake, is not pushed back by
+// the read timeout.
+func TestCovertTimeoutDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn := (&ProxyConfig{CovertReadTimeout: 5000}).withCovertTimeouts(c1)
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 16))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, netErr.Timeout())
+	require.True(t, time.Since(start) < time.Second)
+}
+
+// Timeouts are measured with the proxy's clock.
+func TestCovertTimeoutClock(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	require.Equal(t, start.Add(time.Second), soonerDeadline(start, time.Time{}, time.Second))
+	require.Equal(t, start.Add(time.Millisecond), soonerDeadline(start, start.Add(time.Millisecond), time.Second))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	clk := testutil.NewFakeClock(start)
+	conn := (&ProxyConfig{CovertReadTimeout: 50, clock: clk}).withCovertTimeouts(c1)
+	require.Equal(t, clk, conn.(*timeoutConn).clock)
+}
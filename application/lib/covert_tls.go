@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// covertTLSHandshakeTimeout bounds the station's TLS handshake with a covert.
+const covertTLSHandshakeTimeout = 10 * time.Second
+
+// ErrCovertTLSHandshake is wrapped by errors of the station's own TLS
+// handshake with a covert, see CovertTLSConfig.
+var ErrCovertTLSHandshake = errors.New("covert TLS handshake failed")
+
+// CovertTLSConfig is how the station speaks TLS to a covert itself, for
+// clients tunneling plaintext to an HTTPS-only covert. It is a
+// [covert_tls."host:port"] table of the config.
+type CovertTLSConfig struct {
+	// Server name sent and verified, empty uses the covert's host.
+	SNI string `toml:"sni"`
+
+	// Where the server name comes from: "host" (the default) uses SNI,
+	// "registration" the masked decoy server name of the session's
+	// registration so that the covert sees the name the client's decoy
+	// does, SNI if the registration has none that is a well-formed
+	// hostname. Unless the covert is pinned its certificate is verified for
+	// SNI whatever name is sent, registrations are the client's to choose.
+	SNIFrom string `toml:"sni_from"`
+
+	// Protocols offered by ALPN, e.g. ["h2", "http/1.1"]. Empty offers
+	// none.
+	ALPN []string `toml:"alpn"`
+
+	// Base64 SHA-256 hashes of the SubjectPublicKeyInfo of certificates
+	// the covert's leaf must be one of, or chain to (an intermediate, for a
+	// leaf valid for SNI). Pinned coverts are not verified against the
+	// system roots, so self-signed certificates can be pinned. Empty
+	// verifies the certificate for SNI against the system roots.
+	Pins []string `toml:"pins"`
+	pins map[[sha256.Size]byte]bool
+}
+
+func (c *ProxyConfig) parseCovertTLS() error {
+	for covert, conf := range c.CovertTLS {
+		host, _, err := net.SplitHostPort(covert)
+		if err != nil {
+			return fmt.Errorf("bad covert_tls covert %q: %v", covert, err)
+		}
+		if c.CovertStrictTLS {
+			return fmt.Errorf("covert_tls %q: the station speaking TLS to coverts does not combine with covert_strict_tls", covert)
+		}
+		if conf.SNI == "" {
+			conf.SNI = host
+		} else if !validSNI(conf.SNI) {
+			return fmt.Errorf("covert_tls %q: bad sni %q, expected a hostname", covert, conf.SNI)
+		}
+		switch conf.SNIFrom {
+		case "":
+			conf.SNIFrom = covertSNIFromHost
+		case covertSNIFromHost, covertSNIFromRegistration:
+		default:
+			return fmt.Errorf("covert_tls %q: unknown sni_from %q, expected %q or %q", covert, conf.SNIFrom, covertSNIFromHost, covertSNIFromRegistration)
+		}
+		conf.pins = make(map[[sha256.Size]byte]bool)
+		for _, pin := range conf.Pins {
+			b, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("covert_tls %q: bad pin %q, expected a base64 SHA-256 hash", covert, pin)
+			}
+			var h [sha256.Size]byte
+			copy(h[:], b)
+			conf.pins[h] = true
+		}
+	}
+	return nil
+}
+
+// Values of CovertTLSConfig.SNIFrom.
+const (
+	covertSNIFromHost         = "host"
+	covertSNIFromRegistration = "registration"
+)
+
+// validSNI reports whether name is a well-formed hostname to send as a
+// server name: dot separated labels of letters, digits and inner hyphens, not
+// an IP address.
+func validSNI(name string) bool {
+	if len(name) == 0 || len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// serverName returns the server name of the handshake for a session of reg,
+// which may be nil.
+func (c *CovertTLSConfig) serverName(reg *DecoyRegistration) string {
+	if c.SNIFrom == covertSNIFromRegistration && reg != nil && validSNI(reg.Mask) {
+		return reg.Mask
+	}
+	return c.SNI
+}
+
+// tlsConfig returns the TLS client config of the handshake for a session of
+// reg, trusting roots (nil uses the system roots) unless the covert is
+// pinned.
+func (c *CovertTLSConfig) tlsConfig(reg *DecoyRegistration, roots *x509.CertPool) *tls.Config {
+	conf := &tls.Config{ServerName: c.serverName(reg), NextProtos: c.ALPN, RootCAs: roots}
+	if len(c.pins) > 0 {
+		// Verified against the pins instead, below.
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = c.verifyPins
+	} else if conf.ServerName != c.SNI {
+		// The name sent is the client's, the certificate must still be
+		// valid for the configured one.
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			return c.verifySNI(state, roots)
+		}
+	}
+	return conf
+}
+
+// verifySNI accepts a covert whose leaf certificate is valid for SNI, chaining
+// to roots (nil uses the system roots) through the certificates it presented.
+func (c *CovertTLSConfig) verifySNI(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("tls: covert presented no certificate")
+	}
+	opts := x509.VerifyOptions{DNSName: c.SNI, Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("tls: covert certificate not valid for %s: %v", c.SNI, err)
+	}
+	return nil
+}
+
+// verifyPins accepts a covert whose leaf certificate is pinned, or whose leaf
+// chains through the certificates it presented to a pinned one and is valid
+// for SNI. A pinned certificate presented alongside an unrelated leaf is
+// refused, anyone can send it.
+func (c *CovertTLSConfig) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("tls: covert presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if c.pins[sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)] {
+		return nil
+	}
+	opts := x509.VerifyOptions{DNSName: c.SNI, Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+	pinned := false
+	for _, cert := range certs[1:] {
+		if c.pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			opts.Roots.AddCert(cert)
+			pinned = true
+		} else {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("tls: covert presented no pinned certificate")
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("tls: covert leaf does not chain to its pinned certificate: %v", err)
+	}
+	return nil
+}
+
+// covertTLSClient returns conn, a connection to covert for a session of reg,
+// after the station's TLS handshake if covert is configured for it, conn
+// itself otherwise. The handshake ends by deadline if it is sooner than the
+// handshake timeout. Handshake errors wrap ErrCovertTLSHandshake, conn is
+// closed on error. conf may be nil.
+func (c *ProxyConfig) covertTLSClient(reg *DecoyRegistration, covert string, conn net.Conn, deadline time.Time) (net.Conn, error) {
+	if c == nil || c.CovertTLS[covert] == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, c.CovertTLS[covert].tlsConfig(reg, c.covertTLSRoots))
+	handshakeDeadline := c.getClock().Now().Add(covertTLSHandshakeTimeout)
+	if !deadline.IsZero() && deadline.Before(handshakeDeadline) {
+		handshakeDeadline = deadline
+	}
+	tlsConn.SetDeadline(handshakeDeadline)
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrCovertTLSHandshake, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// covertTLSState returns the TLS version and protocol negotiated on conn, a
+// connection returned by dialCovertTo, if the station speaks TLS on it.
+func covertTLSState(conn net.Conn) (version, alpn string, ok bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", "", false
+	}
+	state := tlsConn.ConnectionState()
+	return tlsVersionName(state.Version), state.NegotiatedProtocol, true
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("%#04x", version)
+	}
+}
@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertTLSParse(t *testing.T) {
+	conf := &ProxyConfig{CovertTLS: map[string]*CovertTLSConfig{"covert.example:443": {}}}
+	require.Nil(t, conf.parseCovertTLS())
+	require.Equal(t, "covert.example", conf.CovertTLS["covert.example:443"].SNI)
+
+	for _, bad := range []*ProxyConfig{
+		{CovertTLS: map[string]*CovertTLSConfig{"covert.example": {}}},
+		{CovertTLS: map[string]*CovertTLSConfig{"covert.example:443": {Pins: []string{"c2hvcnQ="}}}},
+		{CovertTLS: map[string]*CovertTLSConfig{"covert.example:443": {}}, CovertStrictTLS: true},
+		{CovertTLS: map[string]*CovertTLSConfig{"covert.example:443": {SNI: "bad_name.example"}}},
+		{CovertTLS: map[string]*CovertTLSConfig{"covert.example:443": {SNI: "192.0.2.1"}}},
+		{CovertTLS: map[string]*CovertTLSConfig{"covert.example:443": {SNIFrom: "client"}}},
+	} {
+		require.NotNil(t, bad.parseCovertTLS())
+	}
+}
+
+func TestDialCovertTLS(t *testing.T) {
+	https := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "covert")
+	}))
+	defer https.Close()
+	covert := https.Listener.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	pin := sha256.Sum256(https.Certificate().RawSubjectPublicKeyInfo)
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+
+	dial := func(tlsConf *CovertTLSConfig, roots *x509.CertPool) (net.Conn, error) {
+		conf := &ProxyConfig{CovertTLS: map[string]*CovertTLSConfig{covert: tlsConf}, covertTLSRoots: roots}
+		require.Nil(t, conf.parseCovertTLS())
+		return dialCovert(&DecoyRegistration{Covert: covert}, 1, conf, logger)
+	}
+
+	// The httptest certificate is valid for example.com.
+	conn, err := dial(&CovertTLSConfig{SNI: "example.com", ALPN: []string{"http/1.1"}}, roots)
+	require.Nil(t, err)
+	version, alpn, ok := covertTLSState(conn)
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(version, "TLS 1."), version)
+	require.Equal(t, "http/1.1", alpn)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	require.Nil(t, err)
+	resp, _ := ioutil.ReadAll(conn)
+	require.True(t, strings.HasSuffix(string(resp), "covert"), string(resp))
+	conn.Close()
+
+	// A pinned covert needs no trusted roots.
+	conn, err = dial(&CovertTLSConfig{SNI: "example.com", Pins: []string{base64.StdEncoding.EncodeToString(pin[:])}}, nil)
+	require.Nil(t, err)
+	conn.Close()
+
+	failures := metrics.CovertDialFailures.Value(covertErrTLSHandshake)
+	for _, bad := range []struct {
+		conf  *CovertTLSConfig
+		roots *x509.CertPool
+	}{
+		// untrusted, for the wrong name and not pinned
+		{&CovertTLSConfig{SNI: "example.com"}, nil},
+		{&CovertTLSConfig{SNI: "other.example"}, roots},
+		{&CovertTLSConfig{Pins: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}}, nil},
+	} {
+		_, err := dial(bad.conf, bad.roots)
+		require.True(t, errors.Is(err, ErrCovertTLSHandshake), err)
+	}
+	require.Equal(t, failures+3, metrics.CovertDialFailures.Value(covertErrTLSHandshake))
+}
+
+// testCert returns a certificate for name signed by parent, self-signed if
+// parent is nil.
+func testCert(t *testing.T, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func TestCovertTLSPinnedChain(t *testing.T) {
+	ca, caKey := testCert(t, "ca.example", true, nil, nil)
+	leaf, _ := testCert(t, "origin.example", false, ca, caKey)
+	forged, forgedKey := testCert(t, "origin.example", false, nil, nil)
+	pin := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	conf := &ProxyConfig{CovertTLS: map[string]*CovertTLSConfig{"origin.example:443": {
+		Pins: []string{base64.StdEncoding.EncodeToString(pin[:])},
+	}}}
+	require.Nil(t, conf.parseCovertTLS())
+	tlsConf := conf.CovertTLS["origin.example:443"]
+
+	// A leaf issued by the pinned certificate, for the covert's name.
+	require.Nil(t, tlsConf.verifyPins([][]byte{leaf.Raw, ca.Raw}, nil))
+	require.Nil(t, tlsConf.verifyPins([][]byte{ca.Raw}, nil))
+
+	// The pinned certificate appended to a leaf it did not issue.
+	require.NotNil(t, tlsConf.verifyPins([][]byte{forged.Raw, ca.Raw}, nil))
+	require.NotNil(t, tlsConf.verifyPins([][]byte{forged.Raw}, nil))
+	require.NotNil(t, tlsConf.verifyPins(nil, nil))
+
+	// Issued by the pinned certificate, but for another name.
+	other, _ := testCert(t, "other.example", false, ca, caKey)
+	require.NotNil(t, tlsConf.verifyPins([][]byte{other.Raw, ca.Raw}, nil))
+
+	// Over a handshake, a covert serving the forged leaf is refused.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{forged.Raw, ca.Raw},
+		PrivateKey:  forgedKey,
+	}}})
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+	covert := ln.Addr().String()
+	conf.CovertTLS = map[string]*CovertTLSConfig{covert: {SNI: "origin.example", Pins: tlsConf.Pins}}
+	require.Nil(t, conf.parseCovertTLS())
+	_, err = dialCovert(&DecoyRegistration{Covert: covert}, 1, conf, &Logger{log.New(ioutil.Discard, "", 0)})
+	require.True(t, errors.Is(err, ErrCovertTLSHandshake), err)
+}
+
+func TestDialCovertTLSSNI(t *testing.T) {
+	sni := make(chan string, 1)
+	https := httptest.NewUnstartedServer(http.NotFoundHandler())
+	https.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- hello.ServerName
+		return nil, nil
+	}}
+	https.StartTLS()
+	defer https.Close()
+	covert := https.Listener.Addr().String()
+	pin := sha256.Sum256(https.Certificate().RawSubjectPublicKeyInfo)
+	pins := []string{base64.StdEncoding.EncodeToString(pin[:])}
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+
+	for _, c := range []struct {
+		conf *CovertTLSConfig
+		mask string
+		want string
+	}{
+		{&CovertTLSConfig{SNI: "origin.example"}, "decoy.example", "origin.example"},
+		{&CovertTLSConfig{SNI: "origin.example", SNIFrom: "registration"}, "decoy.example", "decoy.example"},
+		// malformed names fall back to the configured SNI
+		{&CovertTLSConfig{SNI: "origin.example", SNIFrom: "registration"}, "-bad.example", "origin.example"},
+		{&CovertTLSConfig{SNI: "origin.example", SNIFrom: "registration"}, "192.0.2.1", "origin.example"},
+		{&CovertTLSConfig{SNI: "origin.example", SNIFrom: "registration"}, "", "origin.example"},
+	} {
+		c.conf.Pins = pins
+		conf := &ProxyConfig{CovertTLS: map[string]*CovertTLSConfig{covert: c.conf}}
+		require.Nil(t, conf.parseCovertTLS())
+		reg := &DecoyRegistration{Covert: covert, Mask: c.mask}
+		require.Equal(t, c.want, c.conf.tlsConfig(reg, nil).ServerName)
+
+		conn, err := dialCovert(reg, 1, conf, logger)
+		require.Nil(t, err)
+		conn.Close()
+		require.Equal(t, c.want, <-sni, c.mask)
+	}
+}
+
+// Unpinned coverts are verified for the configured name, not the one a
+// registration has the station send.
+func TestDialCovertTLSRegistrationSNIVerified(t *testing.T) {
+	sni := make(chan string, 1)
+	https := httptest.NewUnstartedServer(http.NotFoundHandler())
+	https.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- hello.ServerName
+		return nil, nil
+	}}
+	https.StartTLS()
+	defer https.Close()
+	covert := https.Listener.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+
+	// The test certificate is valid for example.com.
+	for _, c := range []struct {
+		sni, mask string
+		ok        bool
+	}{
+		{"example.com", "decoy.example", true},
+		{"origin.example", "example.com", false},
+		{"origin.example", "decoy.example", false},
+	} {
+		conf := &ProxyConfig{CovertTLS: map[string]*CovertTLSConfig{covert: {SNI: c.sni, SNIFrom: "registration"}}, covertTLSRoots: roots}
+		require.Nil(t, conf.parseCovertTLS())
+		conn, err := dialCovert(&DecoyRegistration{Covert: covert, Mask: c.mask}, 1, conf, logger)
+		require.Equal(t, c.mask, <-sni)
+		if c.ok {
+			require.Nil(t, err)
+			conn.Close()
+		} else {
+			require.True(t, errors.Is(err, ErrCovertTLSHandshake), err)
+		}
+	}
+}
+
+// Clients of coverts the station speaks TLS to tunnel plaintext.
+func TestProxyCovertTLS(t *testing.T) {
+	https := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "covert")
+	}))
+	defer https.Close()
+	covert := https.Listener.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	conf := &ProxyConfig{CovertTLS: map[string]*CovertTLSConfig{covert: {SNI: "example.com"}}, covertTLSRoots: roots}
+	require.Nil(t, conf.parseCovertTLS())
+
+	client, stationClient := tcpPair(t)
+	defer client.Close()
+	go func() {
+		Proxy(&DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: covert}, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, conf)
+		stationClient.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(client, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	require.Nil(t, err)
+	resp, _ := ioutil.ReadAll(client)
+	require.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 200"), string(resp))
+	require.True(t, strings.HasSuffix(string(resp), "covert"), string(resp))
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// CovertTransport transforms the station's connection to the covert address,
+// e.g. to add framing or an obfuscation layer understood by the covert host.
+// Operators can compile in their own by calling RegisterCovertTransport from
+// an init function and selecting it by name in the station config.
+type CovertTransport interface {
+	// Wrap takes the raw connection to the covert and returns the connection
+	// that the proxy will read from and write to. Closing the returned
+	// connection must close the underlying one.
+	Wrap(net.Conn) net.Conn
+}
+
+var covertTransports = struct {
+	sync.RWMutex
+	m map[string]CovertTransport
+}{
+	m: map[string]CovertTransport{
+		"none":          noneCovertTransport{},
+		"length-prefix": lengthPrefixCovertTransport{},
+	},
+}
+
+// RegisterCovertTransport makes a covert transport available under name. It
+// returns an error if a transport is already registered with that name.
+func RegisterCovertTransport(name string, t CovertTransport) error {
+	if t == nil {
+		return fmt.Errorf("covert transport %q is nil", name)
+	}
+	covertTransports.Lock()
+	defer covertTransports.Unlock()
+	if _, ok := covertTransports.m[name]; ok {
+		return fmt.Errorf("covert transport %q already registered", name)
+	}
+	covertTransports.m[name] = t
+	return nil
+}
+
+// GetCovertTransport returns the covert transport registered under name. The
+// empty name is an alias for "none".
+func GetCovertTransport(name string) (CovertTransport, error) {
+	if name == "" {
+		name = "none"
+	}
+	covertTransports.RLock()
+	defer covertTransports.RUnlock()
+	t, ok := covertTransports.m[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown covert transport %q", name)
+	}
+	return t, nil
+}
+
+// noneCovertTransport passes the covert connection through unchanged.
+type noneCovertTransport struct{}
+
+func (noneCovertTransport) Wrap(c net.Conn) net.Conn { return c }
+
+// lengthPrefixCovertTransport frames the covert stream into chunks each
+// prefixed with a 2 byte big endian length.
+type lengthPrefixCovertTransport struct{}
+
+func (lengthPrefixCovertTransport) Wrap(c net.Conn) net.Conn {
+	return &lengthPrefixConn{Conn: c}
+}
+
+const maxLengthPrefixFrame = 0xffff
+
+type lengthPrefixConn struct {
+	net.Conn
+
+	// unread remainder of the current incoming frame
+	remaining int
+}
+
+func (c *lengthPrefixConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, fmt.Errorf("truncated length-prefix header")
+			}
+			return 0, err
+		}
+		// Zero length frames are allowed and skipped.
+		c.remaining = int(binary.BigEndian.Uint16(hdr[:]))
+	}
+
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *lengthPrefixConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxLengthPrefixFrame {
+			chunk = chunk[:maxLengthPrefixFrame]
+		}
+
+		frame := make([]byte, 2+len(chunk))
+		binary.BigEndian.PutUint16(frame, uint16(len(chunk)))
+		copy(frame[2:], chunk)
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
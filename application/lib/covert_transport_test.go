@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertTransportRegistry(t *testing.T) {
+	none, err := GetCovertTransport("")
+	require.Nil(t, err)
+	require.Equal(t, noneCovertTransport{}, none)
+
+	_, err = GetCovertTransport("length-prefix")
+	require.Nil(t, err)
+
+	_, err = GetCovertTransport("does-not-exist")
+	require.NotNil(t, err)
+
+	err = RegisterCovertTransport("none", noneCovertTransport{})
+	require.NotNil(t, err)
+
+	err = RegisterCovertTransport("test-custom", lengthPrefixCovertTransport{})
+	require.Nil(t, err)
+	custom, err := GetCovertTransport("test-custom")
+	require.Nil(t, err)
+	require.Equal(t, lengthPrefixCovertTransport{}, custom)
+
+	conf := &ProxyConfig{CovertTransport: "does-not-exist"}
+	require.NotNil(t, conf.parseCovertTransport())
+
+	var nilConf *ProxyConfig
+	require.Equal(t, noneCovertTransport{}, nilConf.getCovertTransport())
+}
+
+func TestCovertTransportNone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	wrapped := noneCovertTransport{}.Wrap(c1)
+	require.Equal(t, c1, wrapped)
+	wrapped.Close()
+}
+
+func TestCovertTransportLengthPrefix(t *testing.T) {
+	c1, c2 := net.Pipe()
+	station := lengthPrefixCovertTransport{}.Wrap(c1)
+	defer station.Close()
+	defer c2.Close()
+
+	// Writes larger than one frame are split.
+	payload := bytes.Repeat([]byte("covert"), 20000)
+	go func() {
+		n, err := station.Write(payload)
+		require.Nil(t, err)
+		require.Equal(t, len(payload), n)
+	}()
+
+	var raw []byte
+	for len(raw) < len(payload) {
+		var hdr [2]byte
+		_, err := io.ReadFull(c2, hdr[:])
+		require.Nil(t, err)
+		frame := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		require.True(t, len(frame) <= maxLengthPrefixFrame)
+		_, err = io.ReadFull(c2, frame)
+		require.Nil(t, err)
+		raw = append(raw, frame...)
+	}
+	require.Equal(t, payload, raw)
+
+	// Reads are unframed, including across empty frames and short buffers.
+	go func() {
+		c2.Write([]byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 1, '!'})
+	}()
+	got := make([]byte, 0, 6)
+	buf := make([]byte, 3)
+	for len(got) < 6 {
+		n, err := station.Read(buf)
+		require.Nil(t, err)
+		got = append(got, buf[:n]...)
+	}
+	require.Equal(t, "hello!", string(got))
+
+	// A peer closing mid-frame is reported rather than treated as a clean EOF.
+	go func() {
+		c2.Write([]byte{0, 10, 'a', 'b'})
+		c2.Close()
+	}()
+	n, err := station.Read(make([]byte, 10))
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	_, err = station.Read(make([]byte, 10))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
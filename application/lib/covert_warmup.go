@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+const (
+	// defaultCovertWarmupInitial and defaultCovertWarmupMax are the
+	// CovertWarmupInitial and CovertWarmupMax used when none is configured.
+	defaultCovertWarmupInitial = 4
+	defaultCovertWarmupMax     = 256
+
+	// covertWarmupReports is how many times over the window the progress of
+	// the warm-up is logged.
+	covertWarmupReports = 10
+)
+
+// Outcomes of covert dials that waited for the warm-up, the label of
+// metrics.CovertWarmupWaits.
+const (
+	covertWarmupDialed   = "dialed"
+	covertWarmupDeadline = "deadline"
+)
+
+// covertWarmup ramps up the covert dials allowed in flight at once over a
+// window after startup, from initial to max, so that a station starting with
+// pre-warming to fill or clients already connecting does not open all of
+// their covert connections at once and trip the coverts' rate limits or
+// alarms. Past the window dials are no longer limited. Only connects are
+// limited, reused and pre-warmed connections are taken as they are.
+type covertWarmup struct {
+	start   time.Time
+	window  time.Duration
+	initial int
+	max     int
+	clock   clock.Clock
+
+	m        sync.Mutex
+	inFlight int
+	released chan struct{} // closed and replaced as a dial ends
+}
+
+func newCovertWarmup(start time.Time, window time.Duration, initial, max int, c clock.Clock) *covertWarmup {
+	return &covertWarmup{
+		start:    start,
+		window:   window,
+		initial:  initial,
+		max:      max,
+		clock:    c,
+		released: make(chan struct{}),
+	}
+}
+
+// limit returns the dials allowed in flight at now, and whether the warm-up
+// is over.
+func (w *covertWarmup) limit(now time.Time) (int, bool) {
+	elapsed := now.Sub(w.start)
+	if elapsed >= w.window {
+		return 0, true
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return w.initial + int(int64(w.max-w.initial)*int64(elapsed)/int64(w.window)), false
+}
+
+// raised returns when the limit is next raised above limit.
+func (w *covertWarmup) raised(limit int) time.Time {
+	steps := int64(limit - w.initial + 1)
+	if w.max <= w.initial {
+		return w.start.Add(w.window)
+	}
+	// Rounded up, limit rounds the ramp down.
+	d := (steps*int64(w.window) + int64(w.max-w.initial) - 1) / int64(w.max-w.initial)
+	return w.start.Add(time.Duration(d))
+}
+
+// acquire waits for a dial slot, until deadline unless it is zero. It returns
+// the function releasing the slot, or an error wrapping
+// ErrCovertDialDeadline if none was free by deadline. w may be nil.
+func (w *covertWarmup) acquire(deadline time.Time) (func(), error) {
+	if w == nil {
+		return func() {}, nil
+	}
+	waited := false
+	for {
+		w.m.Lock()
+		now := w.clock.Now()
+		limit, over := w.limit(now)
+		if over || w.inFlight < limit {
+			w.inFlight++
+			metrics.CovertWarmupInFlight.Set(float64(w.inFlight))
+			w.m.Unlock()
+			if waited {
+				metrics.CovertWarmupWaits.Inc(covertWarmupDialed)
+			}
+			return w.release, nil
+		}
+		released := w.released
+		w.m.Unlock()
+
+		waited = true
+		wait := w.raised(limit).Sub(now)
+		if !deadline.IsZero() {
+			left := deadline.Sub(now)
+			if left <= 0 {
+				metrics.CovertWarmupWaits.Inc(covertWarmupDeadline)
+				return nil, fmt.Errorf("%w waiting for a slot of the covert dial warm-up (%d allowed in flight)", ErrCovertDialDeadline, limit)
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		timer := w.clock.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C():
+		}
+		timer.Stop()
+	}
+}
+
+func (w *covertWarmup) release() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.inFlight--
+	metrics.CovertWarmupInFlight.Set(float64(w.inFlight))
+	close(w.released)
+	w.released = make(chan struct{})
+}
+
+// run logs the progress of the warm-up and exports its limit, until it is
+// over.
+func (w *covertWarmup) run(logger *log.Logger) {
+	logger.Printf("ramping covert dials in flight from %d to %d over %v", w.initial, w.max, w.window)
+	for i := 1; ; i++ {
+		now := w.clock.Now()
+		limit, over := w.limit(now)
+		w.m.Lock()
+		inFlight := w.inFlight
+		w.m.Unlock()
+		if over {
+			metrics.CovertWarmupLimit.Set(0)
+			logger.Printf("covert dial warm-up done, %d dials in flight", inFlight)
+			return
+		}
+		metrics.CovertWarmupLimit.Set(float64(limit))
+		if i > 1 {
+			logger.Printf("covert dial warm-up %d%%: %d of %d dials allowed in flight, %d in flight",
+				int64(100*now.Sub(w.start)/w.window), limit, w.max, inFlight)
+		}
+		next := w.start.Add(w.window * time.Duration(i) / covertWarmupReports)
+		<-w.clock.After(next.Sub(now))
+	}
+}
+
+func (c *ProxyConfig) parseCovertWarmup() error {
+	if c.CovertWarmup < 0 || c.CovertWarmupInitial < 0 || c.CovertWarmupMax < 0 {
+		return fmt.Errorf("covert_warmup, covert_warmup_initial and covert_warmup_max must not be negative")
+	}
+	if c.CovertWarmupInitial == 0 {
+		c.CovertWarmupInitial = defaultCovertWarmupInitial
+	}
+	if c.CovertWarmupMax == 0 {
+		c.CovertWarmupMax = defaultCovertWarmupMax
+	}
+	if c.CovertWarmupMax < c.CovertWarmupInitial {
+		return fmt.Errorf("covert_warmup_max %d is less than covert_warmup_initial %d", c.CovertWarmupMax, c.CovertWarmupInitial)
+	}
+	return nil
+}
+
+// StartCovertWarmup starts ramping up the covert dials allowed in flight, if
+// CovertWarmup is set, logging its progress to logger. It must be called at
+// startup, before coverts are pre-warmed or sessions proxied.
+func (c *ProxyConfig) StartCovertWarmup(logger *log.Logger) {
+	if c.CovertWarmup <= 0 {
+		return
+	}
+	clk := c.getClock()
+	c.covertWarmup = newCovertWarmup(clk.Now(), time.Duration(c.CovertWarmup)*time.Second,
+		c.CovertWarmupInitial, c.CovertWarmupMax, clk)
+	go c.covertWarmup.run(logger)
+}
+
+// acquireCovertWarmup takes a slot of the covert dial warm-up, see
+// covertWarmup.acquire. conf may be nil.
+func (c *ProxyConfig) acquireCovertWarmup(deadline time.Time) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	return c.covertWarmup.acquire(deadline)
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovertWarmupRamp(t *testing.T) {
+	// The limit goes from 2 to 12 over 10s, one more dial every second.
+	start := time.Unix(1600000000, 0)
+	clk := testutil.NewFakeClock(start)
+	w := newCovertWarmup(start, 10*time.Second, 2, 12, clk)
+	for _, c := range []struct {
+		at    time.Duration
+		limit int
+	}{{0, 2}, {999 * time.Millisecond, 2}, {time.Second, 3}, {9500 * time.Millisecond, 11}} {
+		limit, over := w.limit(start.Add(c.at))
+		require.False(t, over)
+		require.Equal(t, c.limit, limit, c.at)
+		require.Equal(t, start.Add(time.Duration(c.limit-1)*time.Second), w.raised(c.limit))
+	}
+	_, over := w.limit(start.Add(10 * time.Second))
+	require.True(t, over)
+
+	// Dials holding their slot for 3s, far more of them than the ramp
+	// allows at first.
+	const dials = 40
+	waited := metrics.CovertWarmupWaits.Value(covertWarmupDialed)
+	var active, done, acquired int64
+	violations := make(chan string, dials)
+	for i := 0; i < dials; i++ {
+		go func() {
+			release, err := w.acquire(time.Time{})
+			if err != nil {
+				violations <- err.Error()
+				return
+			}
+			atomic.AddInt64(&acquired, 1)
+			n := atomic.AddInt64(&active, 1)
+			if limit, over := w.limit(clk.Now()); !over && n > int64(limit) {
+				violations <- "dials in flight above the ramp"
+			}
+			<-clk.After(3 * time.Second)
+			atomic.AddInt64(&active, -1)
+			atomic.AddInt64(&done, 1)
+			release()
+		}()
+	}
+	for now := time.Duration(0); atomic.LoadInt64(&done) < dials; now += 250 * time.Millisecond {
+		require.True(t, now < time.Minute, "dials never finished")
+		// Every dial not done waits on a timer, for a slot or holding one.
+		settled := time.Now().Add(5 * time.Second)
+		for clk.Timers() < dials-int(atomic.LoadInt64(&done)) {
+			require.True(t, time.Now().Before(settled), "dials did not settle at %v", now)
+			time.Sleep(time.Millisecond)
+		}
+		// Dials keep up with the ramp, no more are let through by the
+		// workers' own checks.
+		limit, over := w.limit(clk.Now())
+		for !over && atomic.LoadInt64(&acquired) < dials && atomic.LoadInt64(&active) < int64(limit) {
+			require.True(t, time.Now().Before(settled), "dials fell behind the ramp at %v", now)
+			time.Sleep(time.Millisecond)
+		}
+		if !over {
+			require.LessOrEqual(t, atomic.LoadInt64(&active), int64(limit))
+		}
+		clk.Advance(250 * time.Millisecond)
+	}
+	close(violations)
+	for v := range violations {
+		t.Error(v)
+	}
+	require.Greater(t, metrics.CovertWarmupWaits.Value(covertWarmupDialed), waited)
+}
+
+func TestCovertWarmupDeadline(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clk := testutil.NewFakeClock(start)
+	w := newCovertWarmup(start, 10*time.Second, 1, 1, clk)
+	release, err := w.acquire(start.Add(time.Second))
+	require.Nil(t, err)
+
+	// A dial waiting past its deadline fails as out of time.
+	failed := make(chan error, 1)
+	go func() {
+		_, err := w.acquire(start.Add(time.Second))
+		failed <- err
+	}()
+	require.True(t, clk.WaitForTimers(1, time.Second))
+	clk.Advance(time.Second)
+	err = <-failed
+	require.True(t, errors.Is(err, ErrCovertDialDeadline), err)
+	require.Equal(t, covertErrTimeout, covertDialOutcome(err))
+	release()
+
+	// Past the window, and without a warm-up, dials are not limited.
+	clk.Advance(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		_, err = w.acquire(time.Time{})
+		require.Nil(t, err)
+	}
+	release, err = (*ProxyConfig)(nil).acquireCovertWarmup(time.Time{})
+	require.Nil(t, err)
+	release()
+
+	for _, c := range []*ProxyConfig{
+		{CovertWarmup: -1},
+		{CovertWarmup: 10, CovertWarmupInitial: 8, CovertWarmupMax: 4},
+	} {
+		require.NotNil(t, c.parseCovertWarmup())
+	}
+	c := &ProxyConfig{CovertWarmup: 10}
+	require.Nil(t, c.parseCovertWarmup())
+	require.Equal(t, defaultCovertWarmupInitial, c.CovertWarmupInitial)
+	require.Equal(t, defaultCovertWarmupMax, c.CovertWarmupMax)
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// defaultEventLogKeep is the number of rotated event logs kept when none is
+// configured.
+const defaultEventLogKeep = 5
+
+// EventLog appends the event stream to a file as JSON lines, for SIEM and log
+// shippers that tail files. When the file grows past maxSize it is rotated to
+// path.1, the previous path.1 to path.2 and so on, keeping keep old files.
+// Like every consumer it has a bounded buffer, events it falls behind on are
+// dropped and counted instead of holding up the station.
+type EventLog struct {
+	path    string
+	maxSize int64 // bytes, zero never rotates
+	keep    int
+	logger  *log.Logger
+
+	m    sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewEventLog opens (appending to) the event log at path.
+func NewEventLog(path string, maxSize int64, keep int, logger *log.Logger) (*EventLog, error) {
+	if keep <= 0 {
+		keep = defaultEventLogKeep
+	}
+	l := &EventLog{path: path, maxSize: maxSize, keep: keep, logger: logger}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *EventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// Start subscribes the log to e and writes every event published from now on
+// to it, on its own goroutine.
+func (l *EventLog) Start(e *EventStream) {
+	c := e.subscribe()
+	go func() {
+		for line := range c.events {
+			if err := l.write(line); err != nil {
+				l.logger.Printf("failed to write event log: %v", err)
+			}
+		}
+	}()
+}
+
+func (l *EventLog) write(line []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, moves the current
+// log to path.1 and starts a new one.
+func (l *EventLog) rotate() error {
+	l.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		l.logger.Printf("failed to rotate event log: %v", err)
+	}
+	return l.open()
+}
+
+// Close closes the current log file.
+func (l *EventLog) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLogJSONLines(t *testing.T) {
+	events := NewEventStream(16)
+	path := filepath.Join(t.TempDir(), "events.log")
+	l, err := NewEventLog(path, 0, 0, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	defer l.Close()
+	l.Start(events)
+
+	events.Publish(Event{Type: EventRegistrationRejected, RegID: "abc", Source: "api", Reason: "blocklisted_phantom"})
+	events.Publish(Event{Type: EventAdminAction, Detail: "GET /status"})
+
+	var lines [][]byte
+	for i := 0; i < 1000; i++ {
+		b, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		if lines = bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")); len(lines) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, 2, len(lines))
+
+	var fields map[string]interface{}
+	require.Nil(t, json.Unmarshal(lines[0], &fields))
+	require.Equal(t, "registration_rejected", fields["type"])
+	require.Equal(t, "blocklisted_phantom", fields["reason"])
+	ts, err := time.Parse(time.RFC3339Nano, fields["time"].(string))
+	require.Nil(t, err)
+	require.Equal(t, time.UTC, ts.Location())
+
+	var ev Event
+	require.Nil(t, json.Unmarshal(lines[1], &ev))
+	require.Equal(t, EventAdminAction, ev.Type)
+	require.Equal(t, "GET /status", ev.Detail)
+}
+
+func TestEventLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	l, err := NewEventLog(path, 10, 2, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	defer l.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		require.Nil(t, l.write([]byte(line)))
+	}
+
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		b, err := ioutil.ReadFile(name)
+		require.Nil(t, err)
+		require.Equal(t, want, string(b))
+	}
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+
+	// Reopening appends to the current file.
+	l.Close()
+	l, err = NewEventLog(path, 10, 2, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	defer l.Close()
+	require.Equal(t, int64(len("fourth\n")), l.size)
+}
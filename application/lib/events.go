@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published on the event stream.
+const (
+	EventRegistrationAdded    = "registration_added"
+	EventRegistrationRejected = "registration_rejected"
+	EventRegistrationExpired  = "registration_expired"
+	EventConnectionStart      = "connection_start"
+	EventConnectionEnd        = "connection_end"
+	EventAdminAction          = "admin_action"
+	EventConfigReload         = "config_reload"
+)
+
+// DefaultEventBufferSize is the number of events buffered for each consumer
+// of the station-wide event stream.
+const DefaultEventBufferSize = 1024
+
+// Event is one line of the event stream. Field names are stable, consumers
+// (e.g. a SIEM) parse them. Events deliberately have no field that could hold
+// a shared secret, key or client address, so none can be published whatever
+// the privacy settings: add a field only for data that is safe to export.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RegID     string    `json:"reg_id,omitempty"`
+	Phantom   string    `json:"phantom,omitempty"`
+	Transport string    `json:"transport,omitempty"`
+	SessionID uint64    `json:"session_id,omitempty"`
+
+	// Duration is the session length in milliseconds for connection_end, and
+	// the registration lifetime for registration_expired.
+	Duration int64 `json:"duration_ms,omitempty"`
+
+	// Source is the registration source, see registrationSourceLabel.
+	Source string `json:"source,omitempty"`
+
+	// Reason says why a registration was rejected, or why a connection
+	// ended (a CloseReason).
+	Reason string `json:"reason,omitempty"`
+
+	// Detail describes admin actions ("GET /status/name") and config
+	// reloads.
+	Detail string `json:"detail,omitempty"`
+
+	// Identity of the publishing station, filled in by Publish.
+	Station string            `json:"station_id,omitempty"`
+	Region  string            `json:"region,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// EventStream fans events out to local consumers as newline delimited JSON.
+// Publishing never blocks: every consumer has a bounded buffer and events
+// that do not fit are dropped and counted.
+type EventStream struct {
+	m          sync.RWMutex
+	consumers  map[*eventConsumer]struct{}
+	bufferSize int
+	dropped    uint64
+}
+
+type eventConsumer struct {
+	events chan []byte
+}
+
+// NewEventStream returns a stream with no consumers that buffers up to
+// bufferSize events per consumer (DefaultEventBufferSize if not positive).
+func NewEventStream(bufferSize int) *EventStream {
+	if bufferSize <= 0 {
+		bufferSize = DefaultEventBufferSize
+	}
+	return &EventStream{
+		consumers:  make(map[*eventConsumer]struct{}),
+		bufferSize: bufferSize,
+	}
+}
+
+var eventsInstance *EventStream
+var eventsOnce sync.Once
+
+// Events returns the station-wide event stream.
+func Events() *EventStream {
+	eventsOnce.Do(func() {
+		eventsInstance = NewEventStream(DefaultEventBufferSize)
+	})
+	return eventsInstance
+}
+
+// Publish sends ev to every consumer. Time is set, in UTC, if it is zero, and
+// the station identity if Station is empty. It is cheap when nobody is
+// listening.
+func (e *EventStream) Publish(ev Event) {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	if len(e.consumers) == 0 {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if ev.Station == "" {
+		id := Station()
+		ev.Station, ev.Region, ev.Labels = id.ID, id.Region, id.Labels
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	for c := range e.consumers {
+		select {
+		case c.events <- line:
+		default:
+			atomic.AddUint64(&e.dropped, 1)
+			Stat().AddDroppedEvent()
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because a consumer's buffer
+// was full.
+func (e *EventStream) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Consumers returns the number of connected consumers.
+func (e *EventStream) Consumers() int {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	return len(e.consumers)
+}
+
+func (e *EventStream) subscribe() *eventConsumer {
+	c := &eventConsumer{events: make(chan []byte, e.bufferSize)}
+	e.m.Lock()
+	e.consumers[c] = struct{}{}
+	e.m.Unlock()
+	return c
+}
+
+func (e *EventStream) unsubscribe(c *eventConsumer) {
+	e.m.Lock()
+	delete(e.consumers, c)
+	e.m.Unlock()
+}
+
+// ListenUnix creates a Unix domain socket at path (replacing a stale socket
+// left by a previous run) and returns its listener. Serve must be called to
+// accept consumers.
+func (e *EventStream) ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve accepts consumers on ln until it is closed, streaming every event
+// published after a consumer connects to it.
+func (e *EventStream) Serve(ln net.Listener, logger *log.Logger) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go e.stream(conn, logger)
+	}
+}
+
+func (e *EventStream) stream(conn net.Conn, logger *log.Logger) {
+	c := e.subscribe()
+	defer conn.Close()
+	defer e.unsubscribe(c)
+
+	// Consumers only read, a read returning means they went away.
+	gone := make(chan struct{})
+	go func() {
+		var b [1]byte
+		for {
+			if _, err := conn.Read(b[:]); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-c.events:
+			if _, err := conn.Write(line); err != nil {
+				logger.Printf("event consumer went away: %v", err)
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// PublishRegistrationRejected publishes that reg was not added, and why.
+func PublishRegistrationRejected(reg *DecoyRegistration, reason string) {
+	ev := Event{
+		Type:      EventRegistrationRejected,
+		RegID:     reg.IDString(),
+		Transport: reg.Transport.String(),
+		Reason:    reason,
+	}
+	if reg.DarkDecoy != nil {
+		ev.Phantom = reg.DarkDecoy.String()
+	}
+	if reg.RegistrationSource != nil {
+		ev.Source = registrationSourceLabel(reg.RegistrationSource)
+	}
+	Events().Publish(ev)
+}
+
+func publishSessionEvent(eventType string, reg *DecoyRegistration, sess *Session) {
+	ev := Event{
+		Type:      eventType,
+		RegID:     sess.RegID,
+		Phantom:   reg.DarkDecoy.String(),
+		Transport: reg.Transport.String(),
+		SessionID: sess.ID,
+	}
+	if eventType == EventConnectionEnd {
+		ev.Duration = int64(time.Since(sess.Start) / time.Millisecond)
+		ev.Reason = string(sess.CloseReason())
+	}
+	Events().Publish(ev)
+}
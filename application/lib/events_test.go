@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForConsumers(t *testing.T, events *EventStream, n int) {
+	for i := 0; i < 1000 && events.Consumers() != n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, n, events.Consumers())
+}
+
+func TestEventStreamUnixConsumer(t *testing.T) {
+	events := NewEventStream(16)
+	path := filepath.Join(t.TempDir(), "events.sock")
+	ln, err := events.ListenUnix(path)
+	require.Nil(t, err)
+	defer ln.Close()
+	go events.Serve(ln, log.New(ioutil.Discard, "", 0))
+
+	conn, err := net.Dial("unix", path)
+	require.Nil(t, err)
+	defer conn.Close()
+	waitForConsumers(t, events, 1)
+
+	events.Publish(Event{Type: EventRegistrationAdded, RegID: "abc", Phantom: "192.0.2.1"})
+	events.Publish(Event{Type: EventConnectionEnd, RegID: "abc", SessionID: 7, Duration: 1500})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	var got []Event
+	for i := 0; i < 2; i++ {
+		line, err := r.ReadBytes('\n')
+		require.Nil(t, err)
+		var ev Event
+		require.Nil(t, json.Unmarshal(line, &ev))
+		got = append(got, ev)
+	}
+	require.Equal(t, EventRegistrationAdded, got[0].Type)
+	require.Equal(t, "192.0.2.1", got[0].Phantom)
+	require.False(t, got[0].Time.IsZero())
+	require.Equal(t, EventConnectionEnd, got[1].Type)
+	require.Equal(t, uint64(7), got[1].SessionID)
+	require.Equal(t, int64(1500), got[1].Duration)
+
+	// The consumer going away unsubscribes it.
+	conn.Close()
+	waitForConsumers(t, events, 0)
+}
+
+func TestEventStreamDropsForSlowConsumer(t *testing.T) {
+	events := NewEventStream(2)
+	c := events.subscribe()
+
+	for i := 0; i < 5; i++ {
+		events.Publish(Event{Type: EventConnectionStart})
+	}
+	require.Equal(t, 2, len(c.events))
+	require.Equal(t, uint64(3), events.Dropped())
+
+	events.unsubscribe(c)
+	events.Publish(Event{Type: EventConnectionStart})
+	require.Equal(t, uint64(3), events.Dropped())
+}
@@ -0,0 +1,25 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// experimentBucketLabel domain separates the bucket hash from other uses of
+// the shared secret.
+const experimentBucketLabel = "conjure-experiment-bucket"
+
+// ExperimentBucket assigns a shared secret to one of n experiment buckets.
+// The assignment depends only on the secret, so every station puts a client's
+// registrations in the same bucket without coordination. It is always 0 if n
+// is less than 2.
+func ExperimentBucket(sharedSecret []byte, n int) int {
+	if n < 2 {
+		return 0
+	}
+	h := sha256.New()
+	h.Write([]byte(experimentBucketLabel))
+	h.Write(sharedSecret)
+	sum := h.Sum(nil)
+	return int(binary.BigEndian.Uint64(sum[:8]) % uint64(n))
+}
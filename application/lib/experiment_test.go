@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExperimentBucketStable(t *testing.T) {
+	secret := make([]byte, 32)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	// Fixed values so a change to the assignment does not go unnoticed.
+	require.Equal(t, 4, ExperimentBucket(secret, 10))
+	require.Equal(t, 0, ExperimentBucket(secret, 2))
+	require.Equal(t, 4, ExperimentBucket(secret, 7))
+
+	require.Equal(t, 0, ExperimentBucket(secret, 0))
+	require.Equal(t, 0, ExperimentBucket(secret, 1))
+
+	// The bucket is part of the registration digest used in logs.
+	reg := &DecoyRegistration{Bucket: ExperimentBucket(secret, 10)}
+	require.Contains(t, reg.String(), `"Bucket":4`)
+
+	// Buckets are in range and all used.
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		_, err := rand.Read(secret)
+		require.Nil(t, err)
+		b := ExperimentBucket(secret, 5)
+		require.True(t, b >= 0 && b < 5)
+		seen[b] = true
+	}
+	require.Equal(t, 5, len(seen))
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Clients of registrations with HandshakeMAC set follow the connection tag
+// with an authenticator of the handshake:
+//
+//	time (8 bytes, big endian unix seconds) | nonce (16 bytes) |
+//	HMAC-SHA256(key, tag | time | nonce)
+//
+// where key is the registration's ExportKeyingMaterial for
+// handshakeMACLabel. Only a client that knows the shared secret can produce
+// it, a prober replaying a tag it observed cannot.
+const (
+	handshakeNonceLen = 16
+	handshakeMACLabel = "conjure handshake mac"
+	handshakeKeyLen   = 32
+
+	// HandshakeMACLen is the length of the authenticator.
+	HandshakeMACLen = 8 + handshakeNonceLen + sha256.Size
+
+	// handshakeMACWindow is how far the time of an authenticator may be
+	// from the station's, in either direction. Nonces are remembered until
+	// their authenticator is out of it, so each can only be used once.
+	handshakeMACWindow = 2 * time.Minute
+)
+
+// Reasons a handshake MAC is rejected for, the reason label of
+// metrics.HandshakeMACFailures.
+const (
+	handshakeMACBad    = "bad_mac"
+	handshakeMACStale  = "stale"
+	handshakeMACReplay = "replay"
+)
+
+// HandshakeAuthLen returns the length of the authenticator that follows the
+// connection tag of reg's connections, zero if reg does not use one.
+func HandshakeAuthLen(reg *DecoyRegistration) int {
+	if reg.HandshakeMAC {
+		return HandshakeMACLen
+	}
+	return 0
+}
+
+// HandshakeAuthenticator returns the authenticator a client sends after
+// tag, for the registration with keys, at now with nonce.
+func HandshakeAuthenticator(keys *ConjureSharedKeys, tag []byte, now time.Time, nonce []byte) ([]byte, error) {
+	key, err := keys.ExportKeyingMaterial(handshakeMACLabel, nil, handshakeKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	auth := make([]byte, 8, HandshakeMACLen)
+	binary.BigEndian.PutUint64(auth, uint64(now.Unix()))
+	auth = append(auth, nonce[:handshakeNonceLen]...)
+	return append(auth, handshakeMAC(key, tag, auth)...), nil
+}
+
+func handshakeMAC(key, tag, timeNonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(tag)
+	mac.Write(timeNonce)
+	return mac.Sum(nil)
+}
+
+// VerifyHandshakeMAC reports whether the authenticator auth a client sent
+// after tag on a connection of reg, for the transport named transport,
+// verifies. Failures are counted in metrics.HandshakeMACFailures.
+// Registrations without HandshakeMAC set always verify.
+func (regManager *RegistrationManager) VerifyHandshakeMAC(reg *DecoyRegistration, tag, auth []byte, transport string) bool {
+	if !reg.HandshakeMAC {
+		return true
+	}
+	reason := regManager.registeredDecoys.verifyHandshakeMAC(reg, tag, auth)
+	if reason != "" {
+		metrics.HandshakeMACFailures.Inc(transport, reason)
+		return false
+	}
+	return true
+}
+
+// verifyHandshakeMAC returns why auth does not verify, empty if it does.
+func (r *RegisteredDecoys) verifyHandshakeMAC(reg *DecoyRegistration, tag, auth []byte) string {
+	if len(auth) != HandshakeMACLen {
+		return handshakeMACBad
+	}
+	key, err := reg.ExportKeyingMaterial(handshakeMACLabel, nil, handshakeKeyLen)
+	if err != nil {
+		return handshakeMACBad
+	}
+	timeNonce, mac := auth[:8+handshakeNonceLen], auth[8+handshakeNonceLen:]
+	if !hmac.Equal(mac, handshakeMAC(key, tag, timeNonce)) {
+		return handshakeMACBad
+	}
+
+	now := r.clock.Now()
+	sent := time.Unix(int64(binary.BigEndian.Uint64(timeNonce)), 0)
+	if sent.Before(now.Add(-handshakeMACWindow)) || sent.After(now.Add(handshakeMACWindow)) {
+		return handshakeMACStale
+	}
+	if !r.handshakeNonces.add(string(tag)+string(timeNonce[8:]), now) {
+		return handshakeMACReplay
+	}
+	return ""
+}
+
+// handshakeNonces remembers the nonces of verified handshake authenticators
+// until their time window has passed, to reject replays.
+type handshakeNonces struct {
+	m         sync.Mutex
+	seen      map[string]time.Time // nonce, by tag, to when it is forgotten
+	lastSweep time.Time
+}
+
+func newHandshakeNonces() *handshakeNonces {
+	return &handshakeNonces{seen: make(map[string]time.Time)}
+}
+
+// add remembers nonce, it returns false if it already was.
+func (n *handshakeNonces) add(nonce string, now time.Time) bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if now.Sub(n.lastSweep) >= handshakeMACWindow {
+		for seen, until := range n.seen {
+			if now.After(until) {
+				delete(n.seen, seen)
+			}
+		}
+		n.lastSweep = now
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	// The authenticator's time is at most a window ahead, its nonce is
+	// useless once two windows have passed.
+	n.seen[nonce] = now.Add(2 * handshakeMACWindow)
+	return true
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeMAC(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clk := testutil.NewFakeClock(start)
+	rm := newTransferTestManager(clk)
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	tag := reg.Keys.ConnTag[:]
+	nonce := bytes.Repeat([]byte{1}, handshakeNonceLen)
+
+	// Registrations without a handshake MAC need none.
+	require.Equal(t, 0, HandshakeAuthLen(reg))
+	require.True(t, rm.VerifyHandshakeMAC(reg, tag, nil, "test"))
+
+	reg.HandshakeMAC = true
+	require.Equal(t, HandshakeMACLen, HandshakeAuthLen(reg))
+	auth, err := HandshakeAuthenticator(reg.Keys, tag, start, nonce)
+	require.Nil(t, err)
+	require.Len(t, auth, HandshakeMACLen)
+
+	failures := func(reason string) float64 {
+		return metrics.HandshakeMACFailures.Value("test", reason)
+	}
+	bad, stale, replay := failures(handshakeMACBad), failures(handshakeMACStale), failures(handshakeMACReplay)
+
+	tampered := append([]byte(nil), auth...)
+	tampered[len(tampered)-1] ^= 1
+	require.False(t, rm.VerifyHandshakeMAC(reg, tag, tampered, "test"))
+	require.False(t, rm.VerifyHandshakeMAC(reg, tag, auth[:HandshakeMACLen-1], "test"))
+	// The MAC covers the tag, another registration's MAC does not verify.
+	other := newConnTagTestReg(t, reg.DarkDecoy)
+	other.HandshakeMAC = true
+	require.False(t, rm.VerifyHandshakeMAC(other, other.Keys.ConnTag[:], auth, "test"))
+	require.Equal(t, bad+3, failures(handshakeMACBad))
+
+	require.True(t, rm.VerifyHandshakeMAC(reg, tag, auth, "test"))
+	require.False(t, rm.VerifyHandshakeMAC(reg, tag, auth, "test"))
+	require.Equal(t, replay+1, failures(handshakeMACReplay))
+
+	clk.Advance(handshakeMACWindow + time.Second)
+	nonce[0] = 2
+	old, err := HandshakeAuthenticator(reg.Keys, tag, start, nonce)
+	require.Nil(t, err)
+	require.False(t, rm.VerifyHandshakeMAC(reg, tag, old, "test"))
+	require.Equal(t, stale+1, failures(handshakeMACStale))
+	fresh, err := HandshakeAuthenticator(reg.Keys, tag, clk.Now(), nonce)
+	require.Nil(t, err)
+	require.True(t, rm.VerifyHandshakeMAC(reg, tag, fresh, "test"))
+
+	// Nonces are forgotten once their authenticators are stale anyway.
+	require.Len(t, rm.registeredDecoys.handshakeNonces.seen, 2)
+	clk.Advance(3 * handshakeMACWindow)
+	nonce[0] = 3
+	late, err := HandshakeAuthenticator(reg.Keys, tag, clk.Now(), nonce)
+	require.Nil(t, err)
+	require.True(t, rm.VerifyHandshakeMAC(reg, tag, late, "test"))
+	require.Len(t, rm.registeredDecoys.handshakeNonces.seen, 1)
+}
+
+func TestRegistrationHandshakeMACField(t *testing.T) {
+	raw := []byte{0x0a, 0x01, 0x00} // shared_secret
+	set, err := RegistrationHandshakeMAC(raw)
+	require.Nil(t, err)
+	require.False(t, set)
+	require.Equal(t, raw, AppendRegistrationHandshakeMAC(raw, false))
+
+	set, err = RegistrationHandshakeMAC(AppendRegistrationHandshakeMAC(raw, true))
+	require.Nil(t, err)
+	require.True(t, set)
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// durationHistogram counts observed durations into fixed buckets. Bucket i
+// counts observations <= bounds[i] (and > bounds[i-1]), the final bucket counts
+// everything larger than the last bound. Safe for concurrent use.
+type durationHistogram struct {
+	bounds  []time.Duration
+	buckets []int64
+	sum     int64 // nanoseconds
+}
+
+func newDurationHistogram(bounds ...time.Duration) *durationHistogram {
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return &durationHistogram{
+		bounds:  bounds,
+		buckets: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds d to the histogram.
+func (h *durationHistogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Counts returns the number of observations in each bucket.
+func (h *durationHistogram) Counts() []int64 {
+	counts := make([]int64, len(h.buckets))
+	for i := range h.buckets {
+		counts[i] = atomic.LoadInt64(&h.buckets[i])
+	}
+	return counts
+}
+
+// Sum returns the total of all observed durations.
+func (h *durationHistogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.sum))
+}
+
+func (h *durationHistogram) Reset() {
+	for i := range h.buckets {
+		atomic.StoreInt64(&h.buckets[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+}
+
+// String formats the bucket counts as "<=1s:3 <=5s:0 ... >1h:1".
+func (h *durationHistogram) String() string {
+	counts := h.Counts()
+	parts := make([]string, 0, len(counts))
+	for i, bound := range h.bounds {
+		parts = append(parts, fmt.Sprintf("<=%v:%d", bound, counts[i]))
+	}
+	if len(h.bounds) > 0 {
+		parts = append(parts, fmt.Sprintf(">%v:%d", h.bounds[len(h.bounds)-1], counts[len(h.bounds)]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *Config) parseSessionHistograms() error {
+	if len(c.SessionDurationBuckets) > 0 {
+		if err := metrics.SessionDurations.SetBuckets(c.SessionDurationBuckets...); err != nil {
+			return fmt.Errorf("session_duration_buckets: %v", err)
+		}
+	}
+	if len(c.SessionBytesBuckets) > 0 {
+		if err := metrics.SessionBytes.SetBuckets(c.SessionBytesBuckets...); err != nil {
+			return fmt.Errorf("session_bytes_buckets: %v", err)
+		}
+	}
+	return nil
+}
+
+// histogramInterval formats what a metrics histogram counted since the
+// previous call, as durationHistogram.String does, for the stats report.
+type histogramInterval struct {
+	h      *metrics.Histogram
+	format func(bound float64) string
+
+	m    sync.Mutex
+	last []uint64
+}
+
+func (i *histogramInterval) String() string {
+	bounds, counts := i.h.Snapshot()
+	i.m.Lock()
+	defer i.m.Unlock()
+	if len(i.last) != len(counts) {
+		// The buckets were replaced.
+		i.last = make([]uint64, len(counts))
+	}
+	parts := make([]string, 0, len(counts))
+	for j, count := range counts {
+		n := count - i.last[j]
+		if count < i.last[j] {
+			n = count
+		}
+		if j < len(bounds) {
+			parts = append(parts, fmt.Sprintf("<=%s:%d", i.format(bounds[j]), n))
+		} else {
+			parts = append(parts, fmt.Sprintf(">%s:%d", i.format(bounds[j-1]), n))
+		}
+	}
+	i.last = counts
+	return strings.Join(parts, " ")
+}
+
+func formatSecondsBound(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).String()
+}
+
+// formatBytesBound formats bytes with a decimal unit, e.g. 1MB.
+func formatBytesBound(bytes float64) string {
+	for _, unit := range []struct {
+		size   float64
+		suffix string
+	}{{1e9, "GB"}, {1e6, "MB"}, {1e3, "KB"}} {
+		if bytes >= unit.size {
+			return strconv.FormatFloat(bytes/unit.size, 'g', -1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatFloat(bytes, 'g', -1, 64) + "B"
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationHistogram(t *testing.T) {
+	h := newDurationHistogram(time.Minute, time.Second)
+
+	h.Observe(0)
+	h.Observe(time.Second)
+	h.Observe(time.Second + 1)
+	h.Observe(time.Minute)
+	h.Observe(time.Hour)
+
+	require.Equal(t, []int64{2, 2, 1}, h.Counts())
+	require.Equal(t, 2*time.Second+time.Minute+time.Hour+1, h.Sum())
+	require.Equal(t, "<=1s:2 <=1m0s:2 >1m0s:1", h.String())
+
+	h.Reset()
+	require.Equal(t, []int64{0, 0, 0}, h.Counts())
+	require.Equal(t, time.Duration(0), h.Sum())
+}
+
+func TestStatsRegistrationAge(t *testing.T) {
+	s := Stat()
+	s.Reset()
+	s.AddRegistrationAge(time.Now().Add(-10 * time.Minute))
+	s.AddRegistrationAge(time.Now())
+	require.Equal(t, []int64{1, 0, 0, 0, 0, 1, 0, 0, 0}, s.registrationAges.Counts())
+}
+
+func TestSessionHistograms(t *testing.T) {
+	bounds, _ := metrics.SessionBytes.Snapshot()
+	defer metrics.SessionBytes.SetBuckets(bounds...)
+
+	c := &Config{}
+	c.SessionBytesBuckets = []float64{1e6, 1e3}
+	require.NotNil(t, c.parseSessionHistograms())
+	c.SessionBytesBuckets = []float64{100, 1e3, 1.5e6}
+	require.Nil(t, c.parseSessionHistograms())
+
+	interval := &histogramInterval{h: metrics.SessionBytes, format: formatBytesBound}
+	require.Equal(t, "<=100B:0 <=1KB:0 <=1.5MB:0 >1.5MB:0", interval.String())
+
+	// Sessions are observed as they end.
+	tracker := NewSessionTracker()
+	client, covert, _, done := proxiedSession(t, tracker)
+	defer covert.Close()
+	client.Write(make([]byte, 200))
+	readN(t, covert, 200)
+	client.Close()
+	covert.Close()
+	waitDone(t, done)
+	require.Equal(t, "<=100B:0 <=1KB:1 <=1.5MB:0 >1.5MB:0", interval.String())
+	require.Equal(t, "<=100B:0 <=1KB:0 <=1.5MB:0 >1.5MB:0", interval.String())
+
+	durations := &histogramInterval{h: metrics.SessionDurations, format: formatSecondsBound}
+	require.True(t, strings.HasPrefix(durations.String(), "<=10ms:"))
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Ingestor is a source of registrations, one of the ways they reach the
+// station (the ZMQ proxy of the registrars and detector, a DNS registrar...).
+// Run receives registrations and delivers them to regs until ctx is done,
+// then returns nil; an error is returned if it cannot go on. Delivered
+// registrations are parsed but not yet checked, that is done for every
+// ingestor alike by the IngestPipeline's handler. Name identifies the
+// ingestor in logs, status and as the channel label of
+// metrics.IngestMessages, Stats is safe to call at any time.
+type Ingestor interface {
+	Name() string
+	Run(ctx context.Context, regs chan<- *DecoyRegistration) error
+	Stats() IngestorStats
+}
+
+// IngestorStats are an ingestor's counts since it was created.
+type IngestorStats struct {
+	// messages received
+	Messages int64 `json:"messages"`
+	// registrations delivered
+	Registrations int64 `json:"registrations"`
+	// messages that could not be read, parsed or turned into registrations
+	Errors int64 `json:"errors"`
+	// clock skew of the publishers registrations are received from, by
+	// publisher, for ingestors that know them
+	PublisherSkew map[string]PublisherSkewStats `json:"publisher_skew,omitempty"`
+}
+
+const (
+	// ingestQueueLen is the number of delivered registrations waiting for
+	// the handler before ingestors block.
+	ingestQueueLen = 256
+
+	// defaultIngestorRestartDelay is how long a failed ingestor waits before
+	// it is run again.
+	defaultIngestorRestartDelay = 5 * time.Second
+)
+
+// IngestPipeline runs a set of ingestors and feeds every registration they
+// deliver through a single handler, each in its own goroutine so that a slow
+// registration never holds up ingest. Each ingestor is isolated from the
+// others: one that fails, returning an error or panicking, is logged, counted
+// in metrics.IngestorFailures and run again after a delay.
+type IngestPipeline struct {
+	ingestors    []*ingestorState
+	handle       func(*DecoyRegistration)
+	logger       *Logger
+	restartDelay time.Duration
+}
+
+type ingestorState struct {
+	Ingestor
+	m         sync.Mutex
+	running   bool
+	failures  int
+	lastError string
+}
+
+// NewIngestPipeline returns a pipeline feeding the registrations of
+// ingestors, whose names must be unique, to handle.
+func NewIngestPipeline(handle func(*DecoyRegistration), logger *Logger, ingestors ...Ingestor) (*IngestPipeline, error) {
+	p := &IngestPipeline{handle: handle, logger: logger, restartDelay: defaultIngestorRestartDelay}
+	names := make(map[string]bool)
+	for _, in := range ingestors {
+		if names[in.Name()] {
+			return nil, fmt.Errorf("duplicate ingestor %q", in.Name())
+		}
+		names[in.Name()] = true
+		p.ingestors = append(p.ingestors, &ingestorState{Ingestor: in})
+	}
+	return p, nil
+}
+
+// Run runs the ingestors until ctx is done, and returns once they have all
+// stopped and the registrations they delivered are handed to the handler.
+func (p *IngestPipeline) Run(ctx context.Context) {
+	regs := make(chan *DecoyRegistration, ingestQueueLen)
+	var wg sync.WaitGroup
+	for _, s := range p.ingestors {
+		wg.Add(1)
+		go func(s *ingestorState) {
+			defer wg.Done()
+			p.supervise(ctx, s, regs)
+		}(s)
+	}
+	go func() {
+		wg.Wait()
+		close(regs)
+	}()
+	for reg := range regs {
+		if reg != nil {
+			go func(reg *DecoyRegistration) {
+				p.handle(reg)
+				reg.IngestHandled()
+			}(reg)
+		}
+	}
+}
+
+// HoldIngestSpan leaves the end of span, the ingest span of the message regs
+// were created from, to the pipeline: it ends once the handler is done with
+// all of them, so that the span covers their checks and tracking rather than
+// only their delivery. span is ended right away if regs is empty.
+func HoldIngestSpan(span *Span, regs []*DecoyRegistration) {
+	if span == nil || len(regs) == 0 {
+		span.End()
+		return
+	}
+	remaining := int32(len(regs))
+	for _, reg := range regs {
+		reg.ingestHandled = func() {
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				span.End()
+			}
+		}
+	}
+}
+
+// IngestHandled reports that reg has been handled, or will not be delivered
+// after all, ending the ingest span held for it once that is so for every
+// registration of its message (see HoldIngestSpan). Only the first call has an
+// effect.
+func (reg *DecoyRegistration) IngestHandled() {
+	if done := reg.ingestHandled; done != nil {
+		reg.ingestHandled = nil
+		done()
+	}
+}
+
+// supervise runs s until ctx is done, again after every failure.
+func (p *IngestPipeline) supervise(ctx context.Context, s *ingestorState, regs chan<- *DecoyRegistration) {
+	for {
+		s.setRunning(true)
+		err := runIngestor(ctx, s.Ingestor, regs)
+		s.setRunning(false)
+		if ctx.Err() != nil {
+			p.logger.Infof("ingestor %s stopped: %v", s.Name(), ctx.Err())
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		s.fail(err)
+		metrics.IngestorFailures.Inc(s.Name())
+		p.logger.Errorf("ingestor %s failed, restarting in %v: %v", s.Name(), p.restartDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.restartDelay):
+		}
+	}
+}
+
+// runIngestor runs in, returning its panic as an error.
+func runIngestor(ctx context.Context, in Ingestor, regs chan<- *DecoyRegistration) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return in.Run(ctx, regs)
+}
+
+func (s *ingestorState) setRunning(running bool) {
+	s.m.Lock()
+	s.running = running
+	s.m.Unlock()
+}
+
+func (s *ingestorState) fail(err error) {
+	s.m.Lock()
+	s.failures++
+	s.lastError = err.Error()
+	s.m.Unlock()
+}
+
+// IngestorStatus is the state of one ingestor of a pipeline.
+type IngestorStatus struct {
+	Name      string        `json:"name"`
+	Running   bool          `json:"running"`
+	Failures  int           `json:"failures"`
+	LastError string        `json:"last_error,omitempty"`
+	Stats     IngestorStats `json:"stats"`
+}
+
+// Status lists the state and stats of the pipeline's ingestors, by name.
+func (p *IngestPipeline) Status() interface{} {
+	status := make([]IngestorStatus, 0, len(p.ingestors))
+	for _, s := range p.ingestors {
+		s.m.Lock()
+		st := IngestorStatus{Name: s.Name(), Running: s.running, Failures: s.failures, LastError: s.lastError}
+		s.m.Unlock()
+		st.Stats = s.Stats()
+		status = append(status, st)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
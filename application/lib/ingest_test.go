@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// testIngestor delivers a registration for each of its phantoms per run, and
+// then fails as fail does on its first runs (nil staying up until stopped).
+type testIngestor struct {
+	name     string
+	phantoms []string
+	fail     func(run int32) error
+	runs     int32
+}
+
+func (in *testIngestor) Name() string { return in.name }
+
+func (in *testIngestor) Stats() IngestorStats {
+	return IngestorStats{Messages: int64(atomic.LoadInt32(&in.runs))}
+}
+
+func (in *testIngestor) Run(ctx context.Context, regs chan<- *DecoyRegistration) error {
+	run := atomic.AddInt32(&in.runs, 1)
+	for _, phantom := range in.phantoms {
+		regs <- &DecoyRegistration{DarkDecoy: net.ParseIP(phantom)}
+	}
+	if err := in.fail(run); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestIngestPipeline(t *testing.T) {
+	steady := &testIngestor{name: "steady", phantoms: []string{"192.0.2.1", "192.0.2.2"}, fail: func(int32) error { return nil }}
+	erring := &testIngestor{name: "erring", phantoms: []string{"198.51.100.1"}, fail: func(run int32) error {
+		if run == 1 {
+			return errors.New("connection lost")
+		}
+		return nil
+	}}
+	panicking := &testIngestor{name: "panicking", fail: func(run int32) error {
+		if run == 1 {
+			panic("bad message")
+		}
+		return nil
+	}}
+
+	handled := make(chan string, 16)
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+	_, err := NewIngestPipeline(nil, logger, steady, &testIngestor{name: "steady"})
+	require.NotNil(t, err)
+	p, err := NewIngestPipeline(func(reg *DecoyRegistration) { handled <- reg.DarkDecoy.String() }, logger, steady, erring, panicking)
+	require.Nil(t, err)
+	p.restartDelay = 10 * time.Millisecond
+
+	failures := metrics.IngestorFailures.Value("erring")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+
+	// The failing ingestors are restarted, the steady one is unaffected.
+	got := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		select {
+		case phantom := <-handled:
+			got[phantom]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only handled %v", got)
+		}
+	}
+	require.Equal(t, map[string]int{"192.0.2.1": 1, "192.0.2.2": 1, "198.51.100.1": 2}, got)
+	require.Equal(t, failures+1, metrics.IngestorFailures.Value("erring"))
+	for i := 0; atomic.LoadInt32(&panicking.runs) < 2; i++ {
+		require.Less(t, i, 500, "the panicking ingestor was not restarted")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := p.Status().([]IngestorStatus)
+	require.Len(t, status, 3)
+	require.Equal(t, "erring", status[0].Name)
+	require.Equal(t, 1, status[0].Failures)
+	require.Equal(t, "connection lost", status[0].LastError)
+	require.Equal(t, "panicking", status[1].Name)
+	require.Equal(t, "panic: bad message", status[1].LastError)
+	require.Equal(t, IngestorStatus{Name: "steady", Running: true, Stats: IngestorStats{Messages: 1}}, status[2])
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline did not stop")
+	}
+	require.False(t, p.Status().([]IngestorStatus)[2].Running)
+}
+
+// The ingest span of a message held for the pipeline ends once the handler is
+// done with every registration created from it.
+func TestIngestPipelineEndsHeldSpans(t *testing.T) {
+	tr, err := NewTracer("http://127.0.0.1:4318/v1/traces", 1, nil)
+	require.Nil(t, err)
+	EnableTracing(tr)
+	defer EnableTracing(nil)
+
+	span := StartRegistrationSpan("zmq")
+	regs := []*DecoyRegistration{{DarkDecoy: net.ParseIP("192.0.2.1")}, {DarkDecoy: net.ParseIP("2001:db8::1")}}
+	HoldIngestSpan(span, regs)
+
+	regs[0].IngestHandled()
+	regs[0].IngestHandled()
+	require.False(t, span.ended)
+	regs[1].IngestHandled()
+	require.True(t, span.ended)
+	require.Len(t, tr.queue, 1)
+
+	empty := StartRegistrationSpan("zmq")
+	HoldIngestSpan(empty, nil)
+	require.True(t, empty.ended)
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// InstanceLock is an exclusive advisory lock held on a file for the lifetime
+// of the station process. Holding it guarantees that no other station sharing
+// the same lock file path is running on this host.
+type InstanceLock struct {
+	path string
+	f    *os.File
+}
+
+// AcquireInstanceLock takes an exclusive, non-blocking flock on the file at
+// path, creating it if necessary, and records the current PID in it. If
+// another process already holds the lock the returned error names the lock
+// file and, when it can be read, the PID of the holder.
+func AcquireInstanceLock(path string) (*InstanceLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %v", path, err)
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		defer f.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid := readLockPID(f)
+			if pid > 0 {
+				return nil, fmt.Errorf("lock file %s is held by another station (pid %d)", path, pid)
+			}
+			return nil, fmt.Errorf("lock file %s is held by another station (pid unknown)", path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	// We own the lock, replace whatever PID was left behind by a previous run.
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write pid to lock file %s: %v", path, err)
+	}
+
+	return &InstanceLock{path: path, f: f}, nil
+}
+
+// Release drops the lock. The lock file itself is left in place so that the
+// next station to start can take it without racing on creation.
+func (l *InstanceLock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func readLockPID(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// DescribeTCPPortOwner returns a human readable description of the process
+// currently listening on the given TCP port, or an empty string if no owner
+// could be identified (e.g. insufficient permissions to inspect /proc).
+func DescribeTCPPortOwner(port int) string {
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		inode := findListeningTCPInode(table, port)
+		if inode == "" {
+			continue
+		}
+		if pid := findSocketInodeOwner(inode); pid > 0 {
+			return fmt.Sprintf("pid %d (%s)", pid, processName(pid))
+		}
+	}
+	return ""
+}
+
+// DescribeUnixSocketOwner returns a human readable description of the process
+// bound to the unix socket path. Abstract sockets are given with their leading
+// '@' as they are for ZMQ ipc:// endpoints.
+func DescribeUnixSocketOwner(path string) string {
+	f, err := os.Open("/proc/net/unix")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Num RefCount Protocol Flags Type St Inode Path
+		if len(fields) < 8 || fields[7] != path {
+			continue
+		}
+		if pid := findSocketInodeOwner(fields[6]); pid > 0 {
+			return fmt.Sprintf("pid %d (%s)", pid, processName(pid))
+		}
+	}
+	return ""
+}
+
+func findListeningTCPInode(table string, port int) string {
+	const tcpListenState = "0A"
+
+	f, err := os.Open(table)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListenState {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		p, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil || int(p) != port {
+			continue
+		}
+		return fields[9]
+	}
+	return ""
+}
+
+func findSocketInodeOwner(inode string) int {
+	target := "socket:[" + inode + "]"
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && link == target {
+				return pid
+			}
+		}
+	}
+	return 0
+}
+
+func processName(pid int) string {
+	comm, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(comm))
+}
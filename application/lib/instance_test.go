@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceLockContention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "station.lock")
+
+	lock, err := AcquireInstanceLock(path)
+	require.Nil(t, err)
+
+	// flock(2) locks belong to the open file description, so a second open in
+	// the same process contends exactly like a second station would.
+	_, err = AcquireInstanceLock(path)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), path)
+	require.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+
+	require.Nil(t, lock.Release())
+
+	lock, err = AcquireInstanceLock(path)
+	require.Nil(t, err)
+	require.Nil(t, lock.Release())
+}
+
+func TestDescribeTCPPortOwner(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	owner := DescribeTCPPortOwner(port)
+	require.True(t, strings.HasPrefix(owner, fmt.Sprintf("pid %d ", os.Getpid())), owner)
+}
@@ -0,0 +1,50 @@
+package lib
+
+// stringInterner shares one copy of each distinct string among the
+// registrations holding it. Coverts and masks repeat across thousands of
+// registrations (popular covert endpoints), so at a million registrations
+// keeping a copy per registration adds up. Strings are reference counted and
+// dropped with their last holder. It is not safe for concurrent use, the
+// RegisteredDecoys lock guards it.
+type stringInterner struct {
+	strings map[string]*internedString
+}
+
+type internedString struct {
+	s    string
+	refs int
+}
+
+func newStringInterner() *stringInterner {
+	return &stringInterner{strings: make(map[string]*internedString)}
+}
+
+// intern returns the shared copy of s, taking a reference to it that release
+// gives back. The empty string is not counted.
+func (in *stringInterner) intern(s string) string {
+	if s == "" {
+		return s
+	}
+	if e, ok := in.strings[s]; ok {
+		e.refs++
+		return e.s
+	}
+	in.strings[s] = &internedString{s: s, refs: 1}
+	return s
+}
+
+// release gives back a reference to s taken by intern.
+func (in *stringInterner) release(s string) {
+	e, ok := in.strings[s]
+	if !ok {
+		return
+	}
+	if e.refs--; e.refs <= 0 {
+		delete(in.strings, s)
+	}
+}
+
+// len is the number of distinct strings interned.
+func (in *stringInterner) len() int {
+	return len(in.strings)
+}
@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultIPFIXEnterpriseID is the enterprise number of the transport field
+// when none is configured, 32473 is reserved for documentation (RFC 5612).
+const defaultIPFIXEnterpriseID = 32473
+
+// ipfixMaxMessage is the largest message sent, so that datagrams are not
+// fragmented on a typical 1500 byte MTU.
+const ipfixMaxMessage = 1400
+
+// ipfixTemplateRefresh is how often templates are resent. Over UDP a
+// collector that restarts only learns them again from a resend (RFC 7011
+// section 8.4).
+const ipfixTemplateRefresh = time.Minute
+
+// ipfixWarnInterval is how often at most failing sends are logged.
+const ipfixWarnInterval = time.Minute
+
+// Template IDs of the flow records, one per address family.
+const (
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+)
+
+// Information elements (RFC 7012) of the flow records. The reverse counters
+// of the RFC 5103 biflows are the forward elements under the reverse
+// information element enterprise number.
+const (
+	ipfixOctetDeltaCount          = 1
+	ipfixPacketDeltaCount         = 2
+	ipfixProtocolIdentifier       = 4
+	ipfixSourceTransportPort      = 7
+	ipfixSourceIPv4Address        = 8
+	ipfixDestinationTransportPort = 11
+	ipfixDestinationIPv4Address   = 12
+	ipfixSourceIPv6Address        = 27
+	ipfixDestinationIPv6Address   = 28
+	ipfixFlowEndReason            = 136
+	ipfixFlowStartMilliseconds    = 152
+	ipfixFlowEndMilliseconds      = 153
+
+	ipfixReversePEN = 29305
+
+	// ipfixConjureTransport is the enterprise specific element carrying the
+	// transport name, a variable length string.
+	ipfixConjureTransport = 1
+
+	// ipfixConjureStation is the enterprise specific element carrying the
+	// station ID, a variable length string.
+	ipfixConjureStation = 2
+
+	ipfixVarLen = 65535
+)
+
+// flowEndReason values.
+const (
+	ipfixEndIdleTimeout   = 1
+	ipfixEndActiveTimeout = 2
+	ipfixEndOfFlow        = 3
+	ipfixEndForced        = 4
+)
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+	pen    uint32
+}
+
+// flowCounters are the traffic counters of a session, exported as deltas,
+// and when they were read (unix nanoseconds, zero for never).
+type flowCounters struct {
+	bytesUp, bytesDown, readsUp, readsDown int64
+	at                                     int64
+}
+
+// IPFIXExporter sends an IPFIX (RFC 7011) flow record to a collector over UDP
+// for every proxied session that ends, and for sessions open longer than the
+// active timeout, one every active timeout while they last. A record is a
+// biflow: the client is the source, the phantom the destination, the forward
+// counters are the traffic from the client and the reverse counters the
+// traffic to it.
+//
+// The proxy only sees the data it reads, not TCP segments, so the packet
+// counts are the number of reads. Each read returns at least one segment,
+// they are a lower bound.
+//
+// Client addresses are zeros unless exporting them is enabled. Like the
+// StatsD sink, sends never wait for the collector: failures are counted and
+// logged at most once per ipfixWarnInterval, and records are not retried.
+type IPFIXExporter struct {
+	w           io.Writer
+	domain      uint32
+	enterprise  uint32
+	clientAddrs bool
+	logger      *log.Logger
+
+	m             sync.Mutex
+	seq           uint32 // data records sent, for the message header
+	lastTemplates time.Time
+	failures      int
+	lastErr       error
+	lastWarn      time.Time
+	now           func() time.Time
+}
+
+// NewIPFIXExporter returns an exporter sending to collector (host:port) for
+// observation domain domain. enterpriseID is the enterprise number of the
+// transport field, zero uses defaultIPFIXEnterpriseID. Client addresses and
+// ports are only included if clientAddrs is set.
+func NewIPFIXExporter(collector string, domain, enterpriseID uint32, clientAddrs bool, logger *log.Logger) (*IPFIXExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IPFIX socket: %v", err)
+	}
+	return newIPFIXExporter(conn, domain, enterpriseID, clientAddrs, logger), nil
+}
+
+func newIPFIXExporter(w io.Writer, domain, enterpriseID uint32, clientAddrs bool, logger *log.Logger) *IPFIXExporter {
+	if enterpriseID == 0 {
+		enterpriseID = defaultIPFIXEnterpriseID
+	}
+	return &IPFIXExporter{
+		w:           w,
+		domain:      domain,
+		enterprise:  enterpriseID,
+		clientAddrs: clientAddrs,
+		logger:      logger,
+		now:         time.Now,
+	}
+}
+
+// Run exports a record for every session in t that has been open for an
+// activeTimeout since its last record, forever.
+func (e *IPFIXExporter) Run(t *SessionTracker, activeTimeout time.Duration) {
+	tick := activeTimeout / 4
+	if tick < time.Second {
+		tick = time.Second
+	}
+	for {
+		time.Sleep(tick)
+		e.exportActive(t, activeTimeout)
+	}
+}
+
+func (e *IPFIXExporter) exportActive(t *SessionTracker, activeTimeout time.Duration) {
+	t.m.RLock()
+	sessions := make([]*Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.m.RUnlock()
+
+	e.m.Lock()
+	defer e.m.Unlock()
+	now := e.now()
+	var records [][]byte
+	for _, s := range sessions {
+		last := s.Start
+		if s.exported.at != 0 {
+			last = time.Unix(0, s.exported.at)
+		}
+		if now.Sub(last) >= activeTimeout {
+			records = append(records, e.record(s, now, ipfixEndActiveTimeout))
+		}
+	}
+	e.send(records)
+}
+
+// ExportEnded exports the final record of s.
+func (e *IPFIXExporter) ExportEnded(s *Session) {
+	reason := byte(ipfixEndOfFlow)
+	switch s.CloseReason() {
+	case CloseIdleTimeout:
+		reason = ipfixEndIdleTimeout
+	case CloseMaxLifetime, CloseCancelled, CloseDrained:
+		reason = ipfixEndForced
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.send([][]byte{e.record(s, e.now(), reason)})
+}
+
+// templates returns the template set.
+func (e *IPFIXExporter) templates() []byte {
+	set := []byte{0, 2, 0, 0}
+	for _, id := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+		fields := e.fields(id == ipfixTemplateIPv6)
+		set = appendUint16(set, id)
+		set = appendUint16(set, uint16(len(fields)))
+		for _, f := range fields {
+			if f.pen != 0 {
+				set = appendUint16(set, f.id|0x8000)
+				set = appendUint16(set, f.length)
+				set = appendUint32(set, f.pen)
+			} else {
+				set = appendUint16(set, f.id)
+				set = appendUint16(set, f.length)
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(set[2:], uint16(len(set)))
+	return set
+}
+
+// fields returns the fields of the records of the template for IPv6 or IPv4
+// phantoms, in the order record writes them.
+func (e *IPFIXExporter) fields(v6 bool) []ipfixField {
+	src, dst, addrLen := uint16(ipfixSourceIPv4Address), uint16(ipfixDestinationIPv4Address), uint16(net.IPv4len)
+	if v6 {
+		src, dst, addrLen = ipfixSourceIPv6Address, ipfixDestinationIPv6Address, net.IPv6len
+	}
+	return []ipfixField{
+		{ipfixFlowStartMilliseconds, 8, 0},
+		{ipfixFlowEndMilliseconds, 8, 0},
+		{src, addrLen, 0},
+		{dst, addrLen, 0},
+		{ipfixSourceTransportPort, 2, 0},
+		{ipfixDestinationTransportPort, 2, 0},
+		{ipfixProtocolIdentifier, 1, 0},
+		{ipfixFlowEndReason, 1, 0},
+		{ipfixOctetDeltaCount, 8, 0},
+		{ipfixPacketDeltaCount, 8, 0},
+		{ipfixOctetDeltaCount, 8, ipfixReversePEN},
+		{ipfixPacketDeltaCount, 8, ipfixReversePEN},
+		{ipfixConjureTransport, ipfixVarLen, e.enterprise},
+		{ipfixConjureStation, ipfixVarLen, e.enterprise},
+	}
+}
+
+// record returns the data record of s for the traffic since its last record,
+// prefixed by its template ID. e.m must be held.
+func (e *IPFIXExporter) record(s *Session, now time.Time, reason byte) []byte {
+	cur := flowCounters{
+		bytesUp:   atomic.LoadInt64(&s.bytesUp),
+		bytesDown: atomic.LoadInt64(&s.bytesDown),
+		readsUp:   atomic.LoadInt64(&s.readsUp),
+		readsDown: atomic.LoadInt64(&s.readsDown),
+	}
+	prev := s.exported
+	cur.at = now.UnixNano()
+	s.exported = cur
+
+	dst := s.Phantom.To4()
+	template := uint16(ipfixTemplateIPv4)
+	if dst == nil {
+		dst = s.Phantom.To16()
+		template = ipfixTemplateIPv6
+	}
+	if dst == nil {
+		dst = make(net.IP, net.IPv6len)
+	}
+	src := make(net.IP, len(dst))
+	srcPort := 0
+	if client, ok := s.clientAddr().(*net.TCPAddr); ok && e.clientAddrs {
+		if ip := client.IP.To4(); ip != nil && len(src) == net.IPv4len {
+			src = ip
+		} else if len(src) == net.IPv6len {
+			src = client.IP.To16()
+		}
+		srcPort = client.Port
+	}
+
+	r := appendUint16(nil, template)
+	r = appendUint64(r, uint64(s.Start.UnixNano()/int64(time.Millisecond)))
+	r = appendUint64(r, uint64(now.UnixNano()/int64(time.Millisecond)))
+	r = append(r, src...)
+	r = append(r, dst...)
+	r = appendUint16(r, uint16(srcPort))
+	r = appendUint16(r, uint16(s.PhantomPort))
+	r = append(r, 6, reason) // TCP
+	r = appendUint64(r, uint64(cur.bytesUp-prev.bytesUp))
+	r = appendUint64(r, uint64(cur.readsUp-prev.readsUp))
+	r = appendUint64(r, uint64(cur.bytesDown-prev.bytesDown))
+	r = appendUint64(r, uint64(cur.readsDown-prev.readsDown))
+
+	r = appendIPFIXString(r, s.Transport)
+	r = appendIPFIXString(r, Station().ID)
+	return r
+}
+
+// appendIPFIXString appends v as a variable length field, truncated to fit
+// the one byte length encoding.
+func appendIPFIXString(r []byte, v string) []byte {
+	if len(v) > 254 {
+		v = v[:254]
+	}
+	r = append(r, byte(len(v)))
+	return append(r, v...)
+}
+
+// send packs records, each prefixed by its template ID, into as few messages
+// as possible and sends them. e.m must be held.
+func (e *IPFIXExporter) send(records [][]byte) {
+	if len(records) == 0 {
+		return
+	}
+	now := e.now()
+
+	var msg []byte
+	var setStart int
+	var setTemplate uint16
+	closeSet := func() {
+		if setStart > 0 {
+			binary.BigEndian.PutUint16(msg[setStart+2:], uint16(len(msg)-setStart))
+			setStart = 0
+		}
+	}
+	flush := func() {
+		closeSet()
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		if _, err := e.w.Write(msg); err != nil {
+			e.failures++
+			e.lastErr = err
+		}
+		msg = nil
+	}
+	start := func() {
+		msg = appendUint16(nil, 10) // version
+		msg = appendUint16(msg, 0)  // length
+		msg = appendUint32(msg, uint32(now.Unix()))
+		msg = appendUint32(msg, e.seq)
+		msg = appendUint32(msg, e.domain)
+		if now.Sub(e.lastTemplates) >= ipfixTemplateRefresh {
+			msg = append(msg, e.templates()...)
+			e.lastTemplates = now
+		}
+	}
+
+	for _, r := range records {
+		template, data := binary.BigEndian.Uint16(r), r[2:]
+		if msg != nil && len(msg)+4+len(data) > ipfixMaxMessage {
+			flush()
+		}
+		if msg == nil {
+			start()
+		}
+		if setStart == 0 || setTemplate != template {
+			closeSet()
+			setStart, setTemplate = len(msg), template
+			msg = appendUint16(msg, template)
+			msg = appendUint16(msg, 0)
+		}
+		msg = append(msg, data...)
+		// The sequence number counts records sent, lost ones included, so
+		// that the collector can tell they were lost.
+		e.seq++
+	}
+	flush()
+
+	if e.failures > 0 && now.Sub(e.lastWarn) >= ipfixWarnInterval {
+		e.logger.Printf("ipfix: %d sends failed since the last warning, last error: %v", e.failures, e.lastErr)
+		e.failures = 0
+		e.lastWarn = now
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type ipfixRecorder struct{ messages [][]byte }
+
+func (r *ipfixRecorder) Write(b []byte) (int, error) {
+	r.messages = append(r.messages, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+type ipfixFailingWriter struct{ writes int }
+
+func (w *ipfixFailingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("connect: connection refused")
+}
+
+// ipfixMessage is a decoded message, data records are decoded with the
+// templates of the message (or of earlier ones, passed in).
+type ipfixMessage struct {
+	seq       uint32
+	domain    uint32
+	templates map[uint16][]ipfixField
+	records   []map[ipfixField][]byte
+}
+
+func decodeIPFIX(t *testing.T, msg []byte, templates map[uint16][]ipfixField) ipfixMessage {
+	require.True(t, len(msg) >= 16)
+	require.Equal(t, uint16(10), binary.BigEndian.Uint16(msg))
+	require.Equal(t, len(msg), int(binary.BigEndian.Uint16(msg[2:])))
+	m := ipfixMessage{
+		seq:       binary.BigEndian.Uint32(msg[8:]),
+		domain:    binary.BigEndian.Uint32(msg[12:]),
+		templates: templates,
+	}
+
+	for off := 16; off < len(msg); {
+		id := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+2:]))
+		require.True(t, length >= 4 && off+length <= len(msg))
+		set := msg[off+4 : off+length]
+		off += length
+
+		if id == 2 {
+			for len(set) > 0 {
+				tid, n := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+				set = set[4:]
+				var fields []ipfixField
+				for i := 0; i < n; i++ {
+					f := ipfixField{id: binary.BigEndian.Uint16(set), length: binary.BigEndian.Uint16(set[2:])}
+					set = set[4:]
+					if f.id&0x8000 != 0 {
+						f.id &^= 0x8000
+						f.pen = binary.BigEndian.Uint32(set)
+						set = set[4:]
+					}
+					fields = append(fields, f)
+				}
+				templates[tid] = fields
+			}
+			continue
+		}
+
+		fields, ok := templates[id]
+		require.True(t, ok, "data set for unknown template %d", id)
+		for len(set) > 0 {
+			r := make(map[ipfixField][]byte)
+			for _, f := range fields {
+				l := int(f.length)
+				if f.length == ipfixVarLen {
+					l = int(set[0])
+					set = set[1:]
+				}
+				r[ipfixField{id: f.id, pen: f.pen}] = set[:l]
+				set = set[l:]
+			}
+			m.records = append(m.records, r)
+		}
+	}
+	return m
+}
+
+func ipfixUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func TestIPFIXSessionRecord(t *testing.T) {
+	defer func(id StationIdentity) { stationIdentity = id }(stationIdentity)
+	stationIdentity = StationIdentity{ID: "s1"}
+	var rec ipfixRecorder
+	e := newIPFIXExporter(&rec, 7, 0, false, log.New(&bytes.Buffer{}, "", 0))
+	tracker := NewSessionTracker()
+	tracker.SetIPFIXExporter(e)
+
+	client, _ := net.Pipe()
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: "192.0.2.2:443"}
+	sess := tracker.add(tracker.NextID(), reg, 443, reg.Covert, client, nil)
+	sess.Transport = "min"
+	sess.addTraffic(true, 100)
+	sess.addTraffic(true, 50)
+	sess.addTraffic(false, 4000)
+	tracker.Remove(sess)
+	tracker.Remove(sess)
+
+	require.Equal(t, 1, len(rec.messages))
+	m := decodeIPFIX(t, rec.messages[0], make(map[uint16][]ipfixField))
+	require.Equal(t, uint32(0), m.seq)
+	require.Equal(t, uint32(7), m.domain)
+	require.Equal(t, 2, len(m.templates))
+	require.Equal(t, 1, len(m.records))
+
+	r := m.records[0]
+	require.Equal(t, net.IPv4(192, 0, 2, 1).To4(), net.IP(r[ipfixField{id: ipfixDestinationIPv4Address}]))
+	require.Equal(t, net.IPv4zero.To4(), net.IP(r[ipfixField{id: ipfixSourceIPv4Address}]))
+	require.Equal(t, uint64(443), ipfixUint(r[ipfixField{id: ipfixDestinationTransportPort}]))
+	require.Equal(t, uint64(6), ipfixUint(r[ipfixField{id: ipfixProtocolIdentifier}]))
+	require.Equal(t, uint64(ipfixEndOfFlow), ipfixUint(r[ipfixField{id: ipfixFlowEndReason}]))
+	require.Equal(t, uint64(150), ipfixUint(r[ipfixField{id: ipfixOctetDeltaCount}]))
+	require.Equal(t, uint64(2), ipfixUint(r[ipfixField{id: ipfixPacketDeltaCount}]))
+	require.Equal(t, uint64(4000), ipfixUint(r[ipfixField{id: ipfixOctetDeltaCount, pen: ipfixReversePEN}]))
+	require.Equal(t, uint64(1), ipfixUint(r[ipfixField{id: ipfixPacketDeltaCount, pen: ipfixReversePEN}]))
+	require.Equal(t, "min", string(r[ipfixField{id: ipfixConjureTransport, pen: defaultIPFIXEnterpriseID}]))
+	require.Equal(t, "s1", string(r[ipfixField{id: ipfixConjureStation, pen: defaultIPFIXEnterpriseID}]))
+	start := ipfixUint(r[ipfixField{id: ipfixFlowStartMilliseconds}])
+	require.Equal(t, uint64(sess.Start.UnixNano()/int64(time.Millisecond)), start)
+	require.True(t, ipfixUint(r[ipfixField{id: ipfixFlowEndMilliseconds}]) >= start)
+}
+
+func TestIPFIXActiveTimeout(t *testing.T) {
+	var rec ipfixRecorder
+	e := newIPFIXExporter(&rec, 0, 0, true, log.New(&bytes.Buffer{}, "", 0))
+	now := time.Now()
+	e.now = func() time.Time { return now }
+	tracker := NewSessionTracker()
+	tracker.SetIPFIXExporter(e)
+
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("2001:db8::1"), Covert: "192.0.2.2:443"}
+	var sessions []*Session
+	for i := 0; i < 30; i++ {
+		sess := tracker.add(tracker.NextID(), reg, 443, reg.Covert, nil, nil)
+		sess.Transport = strings.Repeat("t", 40)
+		sess.Start = now.Add(-2 * time.Minute)
+		sess.addTraffic(true, 10)
+		sessions = append(sessions, sess)
+	}
+	tracker.add(tracker.NextID(), reg, 443, reg.Covert, nil, nil) // too recent
+
+	e.exportActive(tracker, time.Minute)
+	require.True(t, len(rec.messages) > 1)
+	templates := make(map[uint16][]ipfixField)
+	var seq uint32
+	records := 0
+	for _, msg := range rec.messages {
+		require.True(t, len(msg) <= ipfixMaxMessage)
+		m := decodeIPFIX(t, msg, templates)
+		require.Equal(t, seq, m.seq)
+		seq += uint32(len(m.records))
+		records += len(m.records)
+		for _, r := range m.records {
+			require.Equal(t, net.ParseIP("2001:db8::1"), net.IP(r[ipfixField{id: ipfixDestinationIPv6Address}]))
+			require.Equal(t, uint64(ipfixEndActiveTimeout), ipfixUint(r[ipfixField{id: ipfixFlowEndReason}]))
+			require.Equal(t, uint64(10), ipfixUint(r[ipfixField{id: ipfixOctetDeltaCount}]))
+		}
+	}
+	require.Equal(t, 30, records)
+
+	// Ending a session exports only what was not exported yet, without
+	// templates as they were just sent.
+	sessions[0].addTraffic(true, 5)
+	rec.messages = nil
+	tracker.Remove(sessions[0])
+	require.Equal(t, 1, len(rec.messages))
+	m := decodeIPFIX(t, rec.messages[0], templates)
+	require.Equal(t, seq, m.seq)
+	require.Equal(t, uint64(5), ipfixUint(m.records[0][ipfixField{id: ipfixOctetDeltaCount}]))
+
+	// Nothing is due again until another active timeout has passed.
+	rec.messages = nil
+	e.exportActive(tracker, time.Minute)
+	require.Equal(t, 0, len(rec.messages))
+}
+
+func TestIPFIXUnreachableCollector(t *testing.T) {
+	var logged bytes.Buffer
+	var w ipfixFailingWriter
+	e := newIPFIXExporter(&w, 0, 0, false, log.New(&logged, "", 0))
+	tracker := NewSessionTracker()
+	tracker.SetIPFIXExporter(e)
+
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: "192.0.2.2:443"}
+	for i := 0; i < 5; i++ {
+		tracker.Remove(tracker.Add(reg, nil, nil))
+	}
+	require.Equal(t, 5, w.writes)
+	require.Equal(t, 1, strings.Count(logged.String(), "\n"))
+	require.Contains(t, logged.String(), "1 sends failed")
+	require.Equal(t, uint32(5), e.seq)
+}
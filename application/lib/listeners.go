@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// defaultListenAddr is used when no listen addresses are configured.
+const defaultListenAddr = ":41245"
+
+// ListenControl sets socket options on a listener before it binds, as the
+// Control hook of a net.ListenConfig. See ClientTCPConfig.Control.
+type ListenControl func(network, address string, c syscall.RawConn) error
+
+// ListenAll opens a TCP listener on each of addrs, passing control (which may
+// be nil) to the resolver. If any of them fails the listeners opened so far
+// are closed again and the error names the address (and the process holding
+// it, if it can be identified).
+func ListenAll(addrs []string, resolver OriginalDstResolver, control ListenControl) ([]*net.TCPListener, error) {
+	if len(addrs) == 0 {
+		addrs = []string{defaultListenAddr}
+	}
+
+	listeners := make([]*net.TCPListener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := listenTCP(addr, resolver, control)
+		if err != nil {
+			CloseAll(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func listenTCP(addr string, resolver OriginalDstResolver, control ListenControl) (*net.TCPListener, error) {
+	listenAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad listen address %q: %v", addr, err)
+	}
+	ln, err := resolver.Listen(listenAddr, control)
+	if err != nil {
+		if owner := DescribeTCPPortOwner(listenAddr.Port); owner != "" {
+			return nil, fmt.Errorf("failed to listen on %v (in use by %s): %v", listenAddr, owner, err)
+		}
+		return nil, fmt.Errorf("failed to listen on %v: %v", listenAddr, err)
+	}
+	return ln, nil
+}
+
+// listenControlled opens a plain listener on addr with control as its
+// Control hook.
+func listenControlled(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: control}
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// CloseAll closes every listener.
+func CloseAll(listeners []*net.TCPListener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
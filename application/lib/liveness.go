@@ -0,0 +1,352 @@
+package lib
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultLivenessTimeout is how long the phantom liveness probes wait for an
+// answer unless configured otherwise.
+const DefaultLivenessTimeout = 500 * time.Millisecond
+
+// Liveness probe methods, as counted in stats.
+const (
+	livenessTCP  = "tcp"
+	livenessICMP = "icmp"
+)
+
+var livenessTimeout = int64(DefaultLivenessTimeout)
+
+// SetLivenessTimeout sets the deadline for phantom liveness probes. A non
+// positive timeout restores DefaultLivenessTimeout.
+func SetLivenessTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultLivenessTimeout
+	}
+	atomic.StoreInt64(&livenessTimeout, int64(timeout))
+}
+
+// DefaultLivenessConcurrency is the number of phantoms probed at once unless
+// configured otherwise.
+const DefaultLivenessConcurrency = 64
+
+// livenessLimiter bounds the number of phantoms being probed at once so that
+// a burst of registrations can not exhaust sockets. Callers over the limit
+// queue until a slot is free.
+type livenessLimiter struct {
+	sem    chan struct{}
+	queued int64
+}
+
+func newLivenessLimiter(n int) *livenessLimiter {
+	if n <= 0 {
+		n = DefaultLivenessConcurrency
+	}
+	return &livenessLimiter{sem: make(chan struct{}, n)}
+}
+
+// do runs f once a slot is free.
+func (l *livenessLimiter) do(f func()) {
+	atomic.AddInt64(&l.queued, 1)
+	l.sem <- struct{}{}
+	atomic.AddInt64(&l.queued, -1)
+	defer func() { <-l.sem }()
+	f()
+}
+
+var livenessLimit atomic.Value // *livenessLimiter
+
+func init() {
+	livenessLimit.Store(newLivenessLimiter(DefaultLivenessConcurrency))
+}
+
+// SetLivenessConcurrency sets the maximum number of phantoms probed at once.
+// A non positive n restores DefaultLivenessConcurrency. It is meant to be
+// called at startup, probes already queued keep the old limit.
+func SetLivenessConcurrency(n int) {
+	livenessLimit.Store(newLivenessLimiter(n))
+}
+
+// LivenessQueueDepth returns the number of liveness checks waiting for a
+// free probe slot or a liveness pool worker.
+func LivenessQueueDepth() int64 {
+	depth := atomic.LoadInt64(&livenessLimit.Load().(*livenessLimiter).queued)
+	if p := livenessPool.Load().(*LivenessPool); p != nil {
+		depth += int64(len(p.queue))
+	}
+	return depth
+}
+
+// DefaultLivenessQueue is the number of liveness checks of pending
+// registrations that may wait for a worker unless configured otherwise.
+const DefaultLivenessQueue = 4096
+
+// LivenessPool runs the liveness checks of pending registrations on a fixed
+// number of workers, so that a burst of registrations queues checks rather
+// than goroutines. Its workers start with its first check.
+type LivenessPool struct {
+	queue   chan func()
+	workers int
+	start   sync.Once
+}
+
+// NewLivenessPool returns a pool of workers, each running one check at a
+// time, with room for queue checks waiting. Non positive values use
+// DefaultLivenessConcurrency and DefaultLivenessQueue.
+func NewLivenessPool(workers, queue int) *LivenessPool {
+	if workers <= 0 {
+		workers = DefaultLivenessConcurrency
+	}
+	if queue <= 0 {
+		queue = DefaultLivenessQueue
+	}
+	return &LivenessPool{queue: make(chan func(), queue), workers: workers}
+}
+
+// Go queues check to run on a worker. It returns false, without running
+// check, if the queue is full.
+func (p *LivenessPool) Go(check func()) bool {
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go func() {
+				for check := range p.queue {
+					check()
+				}
+			}()
+		}
+	})
+	select {
+	case p.queue <- check:
+		return true
+	default:
+		return false
+	}
+}
+
+var livenessPool atomic.Value // *LivenessPool, nil until SetLivenessPool
+
+func init() {
+	livenessPool.Store((*LivenessPool)(nil))
+}
+
+// SetLivenessPool sets the pool whose queue LivenessQueueDepth includes.
+func SetLivenessPool(p *LivenessPool) {
+	livenessPool.Store(p)
+}
+
+// Policies for registrations whose phantom turns out to be live, see
+// Config.LivePhantomPolicy.
+const (
+	// LivePhantomReject drops the registration.
+	LivePhantomReject = "reject"
+	// LivePhantomLogOnly keeps the registration, tagged with the policy.
+	LivePhantomLogOnly = "log-only"
+	// LivePhantomDivert keeps the registration but connections to it are
+	// forwarded to its mask host rather than proxied to the covert.
+	LivePhantomDivert = "divert"
+)
+
+func parseLivePhantomPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return LivePhantomReject, nil
+	case LivePhantomReject, LivePhantomLogOnly, LivePhantomDivert:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown live phantom policy %q, expected reject, log-only or divert", policy)
+	}
+}
+
+// icmpUnavailable is set once opening a raw ICMP socket fails for lack of
+// privileges, after which only the TCP probe is used.
+var icmpUnavailable int32
+
+// livenessProbe reports whether something answered a probe sent to
+// address (host:port) before ctx is done.
+type livenessProbe struct {
+	method string
+	probe  func(ctx context.Context, address string) (bool, error)
+}
+
+type livenessResult struct {
+	method string
+	live   bool
+	err    error
+}
+
+func phantomIsLive(address string) (bool, error) {
+	probes := []livenessProbe{{livenessTCP, tcpProbe}}
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip != nil && atomic.LoadInt32(&icmpUnavailable) == 0 {
+		probes = append(probes, livenessProbe{livenessICMP, func(ctx context.Context, _ string) (bool, error) {
+			return icmpProbe(ctx, ip)
+		}})
+	}
+
+	var live bool
+	var reason error
+	livenessLimit.Load().(*livenessLimiter).do(func() {
+		live, reason = probePhantom(address, time.Duration(atomic.LoadInt64(&livenessTimeout)), probes)
+	})
+	return live, reason
+}
+
+// probePhantom runs all probes against address concurrently. The phantom is
+// live as soon as any probe gets an answer (for TCP a SYN-ACK or a RST, for
+// ICMP an echo reply) before timeout. Anything else, including failing to
+// send a probe at all, is not live. The returned error gives the reason for
+// the decision.
+func probePhantom(address string, timeout time.Duration, probes []livenessProbe) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := make(chan livenessResult, len(probes))
+	for _, p := range probes {
+		go func(p livenessProbe) {
+			live, err := p.probe(ctx, address)
+			results <- livenessResult{p.method, live, err}
+		}(p)
+	}
+
+	var probeErrs []string
+	for range probes {
+		r := <-results
+		if r.err != nil {
+			Stat().AddLivenessErr()
+			probeErrs = append(probeErrs, fmt.Sprintf("%s: %v", r.method, r.err))
+			continue
+		}
+		if r.live {
+			Stat().AddLivenessMethod(r.method)
+			return true, fmt.Errorf("phantom answered %s probe", r.method)
+		}
+	}
+
+	if len(probeErrs) > 0 {
+		return false, fmt.Errorf("no answer within %v (%s)", timeout, strings.Join(probeErrs, "; "))
+	}
+	return false, fmt.Errorf("no answer within %v", timeout)
+}
+
+// tcpProbe attempts a TCP connection. Both a SYN-ACK and a RST mean a host
+// is using the address. Running out of time is not an error.
+func tcpProbe(ctx context.Context, address string) (bool, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err == nil {
+		conn.Close()
+		return true, nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true, nil
+	}
+	var netErr net.Error
+	if ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return false, nil
+	}
+	return false, err
+}
+
+// dialICMP opens the raw socket for ICMP probes to ip. If the process is not
+// allowed to open one ICMP probing is disabled from then on.
+func dialICMP(network string, ip net.IP) (*net.IPConn, error) {
+	conn, err := net.DialIP(network, nil, &net.IPAddr{IP: ip})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		atomic.StoreInt32(&icmpUnavailable, 1)
+	}
+	return conn, err
+}
+
+// CheckICMPProbes opens (and closes) the raw socket ICMP liveness probes use.
+// Without one, e.g. lacking CAP_NET_RAW, phantoms are only probed over TCP.
+func CheckICMPProbes() error {
+	conn, err := dialICMP("ip4:icmp", net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// icmpProbe sends an ICMP (or ICMPv6) echo request to ip and waits for the
+// matching reply. It needs a raw socket, see dialICMP.
+func icmpProbe(ctx context.Context, ip net.IP) (bool, error) {
+	network, echo, reply := "ip4:icmp", byte(8), byte(0)
+	if ip.To4() == nil {
+		network, echo, reply = "ip6:ipv6-icmp", 128, 129
+	}
+
+	conn, err := dialICMP(network, ip)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Unblock the read as soon as the probe is no longer needed.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var id [2]byte
+	crand.Read(id[:])
+	msg := newICMPEcho(echo, id, 1)
+	if _, err := conn.Write(msg); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		// For ip4 ReadFrom strips the IP header.
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, nil
+			}
+			return false, err
+		}
+		if n >= 8 && buf[0] == reply && buf[4] == id[0] && buf[5] == id[1] && buf[6] == 0 && buf[7] == 1 {
+			return true, nil
+		}
+	}
+}
+
+// newICMPEcho builds an echo request of the given type. The checksum is only
+// needed for ICMPv4, the kernel fills it in for ICMPv6.
+func newICMPEcho(echoType byte, id [2]byte, seq uint16) []byte {
+	msg := []byte{echoType, 0, 0, 0, id[0], id[1], byte(seq >> 8), byte(seq)}
+	msg = append(msg, "conjure liveness"...)
+	if echoType == 8 {
+		sum := icmpChecksum(msg)
+		msg[2], msg[3] = byte(sum>>8), byte(sum)
+	}
+	return msg
+}
+
+// icmpChecksum is the RFC 1071 internet checksum of b.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+)
+
+// livenessCache remembers liveness results by phantom address so that
+// phantoms clients re-register with are not probed again and again. Live
+// results are kept for liveTTL, as an address in use tends to stay in use,
+// and not live results for the usually much shorter notLiveTTL. At most size
+// entries are kept, evicting the least recently used.
+type livenessCache struct {
+	m          sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List // front is most recently used
+	size       int
+	liveTTL    time.Duration
+	notLiveTTL time.Duration
+	clock      clock.Clock
+}
+
+type livenessCacheEntry struct {
+	phantom string
+	live    bool
+	reason  error
+	expires time.Time
+}
+
+func newLivenessCache(size int, liveTTL, notLiveTTL time.Duration) *livenessCache {
+	return &livenessCache{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		size:       size,
+		liveTTL:    liveTTL,
+		notLiveTTL: notLiveTTL,
+		clock:      clock.Real,
+	}
+}
+
+// get returns the cached result for phantom, if there is one that has not
+// expired.
+func (c *livenessCache) get(phantom string) (live bool, reason error, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	el, ok := c.entries[phantom]
+	if !ok {
+		return false, nil, false
+	}
+	e := el.Value.(*livenessCacheEntry)
+	if !c.clock.Now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, phantom)
+		return false, nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.live, e.reason, true
+}
+
+// put caches a result for phantom. Results whose TTL is zero are not cached.
+func (c *livenessCache) put(phantom string, live bool, reason error) {
+	ttl := c.notLiveTTL
+	if live {
+		ttl = c.liveTTL
+	}
+	if ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e := &livenessCacheEntry{phantom, live, reason, c.clock.Now().Add(ttl)}
+	if el, ok := c.entries[phantom]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[phantom] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*livenessCacheEntry).phantom)
+	}
+}
+
+func (c *livenessCache) len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.lru.Len()
+}
+
+var livenessResults atomic.Value // *livenessCache, nil when disabled
+
+func init() {
+	livenessResults.Store((*livenessCache)(nil))
+}
+
+// SetLivenessCache enables caching liveness results for up to size phantoms,
+// live results for liveTTL and not live results for notLiveTTL. A size of
+// zero disables the cache, a zero TTL disables caching that kind of result.
+func SetLivenessCache(size int, liveTTL, notLiveTTL time.Duration) {
+	if size <= 0 {
+		livenessResults.Store((*livenessCache)(nil))
+		return
+	}
+	livenessResults.Store(newLivenessCache(size, liveTTL, notLiveTTL))
+}
+
+// cachedPhantomIsLive is learnedPhantomIsLive for address, answering from
+// cache when it holds a result for the phantom IP. A nil cache always probes.
+func cachedPhantomIsLive(cache *livenessCache, phantom, address string) (bool, error) {
+	learner := livenessSubnets.Load().(*subnetLearner)
+	if cache == nil {
+		return learnedPhantomIsLive(learner, phantom, address)
+	}
+	if live, reason, ok := cache.get(phantom); ok {
+		Stat().AddLivenessCacheHit()
+		return live, fmt.Errorf("cached: %v", reason)
+	}
+	Stat().AddLivenessCacheMiss()
+
+	live, reason := learnedPhantomIsLive(learner, phantom, address)
+	cache.put(phantom, live, reason)
+	return live, reason
+}
+
+// LivePhantomTopic is the first frame of a detector message reporting
+// phantoms seen originating traffic. The second frame holds the addresses, 16
+// bytes each with IPv4 addresses IPv4-mapped.
+const LivePhantomTopic = "phantom_live"
+
+// errReportedLive is the reason given for phantoms reported live by the
+// detector.
+var errReportedLive = errors.New("reported live by detector")
+
+// ParseLivePhantomReport returns the addresses in the address frame of a live
+// phantom report.
+func ParseLivePhantomReport(frame []byte) ([]net.IP, error) {
+	if len(frame)%net.IPv6len != 0 {
+		return nil, fmt.Errorf("live phantom report of %d bytes is not a list of %d byte addresses", len(frame), net.IPv6len)
+	}
+	addrs := make([]net.IP, 0, len(frame)/net.IPv6len)
+	for i := 0; i < len(frame); i += net.IPv6len {
+		addrs = append(addrs, net.IP(append([]byte(nil), frame[i:i+net.IPv6len]...)))
+	}
+	return addrs, nil
+}
+
+// ReportLivePhantom records that the detector saw phantom originate
+// traffic. The report is authoritative: the phantom is cached as live, for
+// the live TTL, replacing any probe result. It returns false if there is no
+// liveness cache to record it in.
+func ReportLivePhantom(phantom net.IP) bool {
+	Stat().AddLivenessReport()
+	cache := livenessResults.Load().(*livenessCache)
+	if cache == nil {
+		return false
+	}
+	cache.put(phantom.String(), true, errReportedLive)
+	return true
+}
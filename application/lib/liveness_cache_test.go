@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLivenessCacheTTLs(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	c := newLivenessCache(10, time.Hour, time.Minute)
+	c.clock = clk
+
+	_, _, ok := c.get("192.0.2.1")
+	require.False(t, ok)
+
+	c.put("192.0.2.1", true, errors.New("phantom answered tcp probe"))
+	c.put("192.0.2.2", false, errors.New("no answer within 500ms"))
+
+	live, reason, ok := c.get("192.0.2.1")
+	require.True(t, ok)
+	require.True(t, live)
+	require.Equal(t, "phantom answered tcp probe", reason.Error())
+
+	// Not live results expire first.
+	clk.Advance(2 * time.Minute)
+	_, _, ok = c.get("192.0.2.2")
+	require.False(t, ok)
+	_, _, ok = c.get("192.0.2.1")
+	require.True(t, ok)
+
+	clk.Advance(time.Hour)
+	_, _, ok = c.get("192.0.2.1")
+	require.False(t, ok)
+	require.Equal(t, 0, c.len())
+
+	// A zero TTL does not cache that kind of result.
+	c.notLiveTTL = 0
+	c.put("192.0.2.3", false, nil)
+	_, _, ok = c.get("192.0.2.3")
+	require.False(t, ok)
+}
+
+func TestLivenessCacheLRU(t *testing.T) {
+	c := newLivenessCache(2, time.Hour, time.Hour)
+	c.put("a", true, nil)
+	c.put("b", true, nil)
+	_, _, ok := c.get("a")
+	require.True(t, ok)
+
+	// b is now the least recently used.
+	c.put("c", true, nil)
+	require.Equal(t, 2, c.len())
+	_, _, ok = c.get("b")
+	require.False(t, ok)
+	_, _, ok = c.get("a")
+	require.True(t, ok)
+	_, _, ok = c.get("c")
+	require.True(t, ok)
+}
+
+func TestLivenessCacheConcurrent(t *testing.T) {
+	c := newLivenessCache(50, time.Hour, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				phantom := fmt.Sprintf("10.0.%d.%d", i, j%100)
+				if _, _, ok := c.get(phantom); !ok {
+					c.put(phantom, j%2 == 0, nil)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, 50, c.len())
+}
+
+func TestParseLivePhantomReport(t *testing.T) {
+	frame := append(net.ParseIP("192.0.2.1").To16(), net.ParseIP("2001:db8::1")...)
+	addrs, err := ParseLivePhantomReport(frame)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(addrs))
+	require.Equal(t, "192.0.2.1", addrs[0].String())
+	require.Equal(t, "2001:db8::1", addrs[1].String())
+
+	_, err = ParseLivePhantomReport(frame[:20])
+	require.NotNil(t, err)
+}
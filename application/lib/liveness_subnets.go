@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix lengths phantoms are grouped by when learning subnet liveness.
+const (
+	livenessSubnetV4Bits = 24
+	livenessSubnetV6Bits = 64
+)
+
+// maxLearnedSubnets bounds the number of subnets tracked. Phantoms in
+// subnets beyond it are always probed.
+const maxLearnedSubnets = 1 << 16
+
+// subnetLearner tracks liveness results per phantom subnet. Once a subnet has
+// had threshold consecutive not live results, probes of phantoms in it are
+// skipped (and the phantom taken as not live) for skipFor, except for one in
+// every resample which is still probed to notice the subnet coming alive.
+type subnetLearner struct {
+	m         sync.Mutex
+	subnets   map[string]*subnetState
+	threshold int
+	skipFor   time.Duration
+	resample  int
+	now       func() time.Time
+}
+
+type subnetState struct {
+	probes             int64
+	live               int64
+	skipped            int64
+	consecutiveNotLive int
+	skipUntil          time.Time
+}
+
+// SubnetLiveness is the learned liveness state of one phantom subnet.
+type SubnetLiveness struct {
+	Subnet             string    `json:"subnet"`
+	Probes             int64     `json:"probes"`
+	Live               int64     `json:"live"`
+	Skipped            int64     `json:"skipped"`
+	ConsecutiveNotLive int       `json:"consecutive_not_live"`
+	SkipUntil          time.Time `json:"skip_until,omitempty"`
+	Skipping           bool      `json:"skipping"`
+}
+
+func newSubnetLearner(threshold int, skipFor time.Duration, resample int) *subnetLearner {
+	return &subnetLearner{
+		subnets:   make(map[string]*subnetState),
+		threshold: threshold,
+		skipFor:   skipFor,
+		resample:  resample,
+		now:       time.Now,
+	}
+}
+
+func livenessSubnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(livenessSubnetV4Bits, 32)), Mask: net.CIDRMask(livenessSubnetV4Bits, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(livenessSubnetV6Bits, 128)), Mask: net.CIDRMask(livenessSubnetV6Bits, 128)}).String()
+}
+
+// skip reports whether probing ip can be skipped because its subnet is known
+// not to be live, and the subnet.
+func (l *subnetLearner) skip(ip net.IP) (string, bool) {
+	subnet := livenessSubnet(ip)
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	s, ok := l.subnets[subnet]
+	if !ok || !l.now().Before(s.skipUntil) {
+		return subnet, false
+	}
+	s.skipped++
+	if l.resample > 0 && s.skipped%int64(l.resample) == 0 {
+		return subnet, false
+	}
+	return subnet, true
+}
+
+// record adds a probe result for ip.
+func (l *subnetLearner) record(ip net.IP, live bool) {
+	subnet := livenessSubnet(ip)
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	s, ok := l.subnets[subnet]
+	if !ok {
+		if len(l.subnets) >= maxLearnedSubnets {
+			return
+		}
+		s = &subnetState{}
+		l.subnets[subnet] = s
+	}
+	s.probes++
+	if live {
+		s.live++
+		s.consecutiveNotLive = 0
+		s.skipUntil = time.Time{}
+		return
+	}
+	s.consecutiveNotLive++
+	if s.consecutiveNotLive >= l.threshold && !l.now().Before(s.skipUntil) {
+		s.skipUntil = l.now().Add(l.skipFor)
+	}
+}
+
+func (l *subnetLearner) snapshot() []SubnetLiveness {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	states := make([]SubnetLiveness, 0, len(l.subnets))
+	for subnet, s := range l.subnets {
+		states = append(states, SubnetLiveness{
+			Subnet:             subnet,
+			Probes:             s.probes,
+			Live:               s.live,
+			Skipped:            s.skipped,
+			ConsecutiveNotLive: s.consecutiveNotLive,
+			SkipUntil:          s.skipUntil,
+			Skipping:           now.Before(s.skipUntil),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Subnet < states[j].Subnet })
+	return states
+}
+
+var livenessSubnets atomic.Value // *subnetLearner, nil when disabled
+
+func init() {
+	livenessSubnets.Store((*subnetLearner)(nil))
+}
+
+// SetLivenessSubnetLearning enables skipping probes for phantoms in subnets
+// (/24 for IPv4, /64 for IPv6) that had threshold consecutive not live
+// results, for skipFor at a time. One in every resample skipped phantoms is
+// probed anyway. A threshold of zero disables learning.
+func SetLivenessSubnetLearning(threshold int, skipFor time.Duration, resample int) {
+	if threshold <= 0 || skipFor <= 0 {
+		livenessSubnets.Store((*subnetLearner)(nil))
+		return
+	}
+	livenessSubnets.Store(newSubnetLearner(threshold, skipFor, resample))
+}
+
+// LivenessSubnets returns the learned state of every tracked phantom subnet,
+// nil if subnet learning is disabled.
+func LivenessSubnets() []SubnetLiveness {
+	l := livenessSubnets.Load().(*subnetLearner)
+	if l == nil {
+		return nil
+	}
+	return l.snapshot()
+}
+
+// learnedPhantomIsLive is phantomIsLive for address unless the subnet of
+// phantom is known not to be live.
+func learnedPhantomIsLive(learner *subnetLearner, phantom, address string) (bool, error) {
+	ip := net.ParseIP(phantom)
+	if learner == nil || ip == nil {
+		return phantomIsLive(address)
+	}
+	if subnet, skip := learner.skip(ip); skip {
+		Stat().AddLivenessSubnetSkip()
+		return false, fmt.Errorf("probe skipped, no live phantoms seen in %s", subnet)
+	}
+	live, reason := phantomIsLive(address)
+	learner.record(ip, live)
+	return live, reason
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubnetLearner(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newSubnetLearner(3, time.Minute, 4)
+	l.now = func() time.Time { return now }
+
+	ip := func(s string) net.IP { return net.ParseIP(s) }
+	require.Equal(t, "192.0.2.0/24", livenessSubnet(ip("192.0.2.77")))
+	require.Equal(t, "2001:db8:0:1::/64", livenessSubnet(ip("2001:db8:0:1:2:3:4:5")))
+
+	// A live result resets the streak.
+	l.record(ip("192.0.2.1"), false)
+	l.record(ip("192.0.2.2"), true)
+	l.record(ip("192.0.2.3"), false)
+	l.record(ip("192.0.2.4"), false)
+	_, skip := l.skip(ip("192.0.2.5"))
+	require.False(t, skip)
+
+	l.record(ip("192.0.2.5"), false)
+	subnet, skip := l.skip(ip("192.0.2.6"))
+	require.True(t, skip)
+	require.Equal(t, "192.0.2.0/24", subnet)
+
+	// Other subnets are unaffected.
+	_, skip = l.skip(ip("198.51.100.1"))
+	require.False(t, skip)
+
+	// Every fourth skipped phantom is still probed.
+	for i := 0; i < 2; i++ {
+		_, skip = l.skip(ip("192.0.2.7"))
+		require.True(t, skip)
+	}
+	_, skip = l.skip(ip("192.0.2.8"))
+	require.False(t, skip)
+
+	states := l.snapshot()
+	require.Equal(t, 1, len(states))
+	require.Equal(t, SubnetLiveness{
+		Subnet: "192.0.2.0/24", Probes: 5, Live: 1, Skipped: 4, ConsecutiveNotLive: 3,
+		SkipUntil: now.Add(time.Minute), Skipping: true,
+	}, states[0])
+
+	// A resampled live phantom ends the skipping.
+	l.record(ip("192.0.2.8"), true)
+	_, skip = l.skip(ip("192.0.2.9"))
+	require.False(t, skip)
+
+	// As does the skip period running out.
+	for i := 10; i < 13; i++ {
+		l.record(ip("192.0.2.1"), false)
+	}
+	_, skip = l.skip(ip("192.0.2.9"))
+	require.True(t, skip)
+	now = now.Add(time.Minute)
+	_, skip = l.skip(ip("192.0.2.9"))
+	require.False(t, skip)
+	require.False(t, l.snapshot()[0].Skipping)
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPProbe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A SYN-ACK is live.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	live, err := tcpProbe(ctx, ln.Addr().String())
+	require.Nil(t, err)
+	require.True(t, live)
+
+	// So is a RST from a host with nothing listening on the port.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+	live, err = tcpProbe(ctx, addr)
+	require.Nil(t, err)
+	require.True(t, live)
+}
+
+func TestProbePhantom(t *testing.T) {
+	silent := livenessProbe{"silent", func(ctx context.Context, _ string) (bool, error) {
+		<-ctx.Done()
+		return false, nil
+	}}
+	broken := livenessProbe{"broken", func(context.Context, string) (bool, error) {
+		return false, errors.New("operation not permitted")
+	}}
+	answers := livenessProbe{livenessTCP, func(context.Context, string) (bool, error) {
+		time.Sleep(10 * time.Millisecond)
+		return true, nil
+	}}
+
+	// No answer before the deadline is not live, and the deadline holds.
+	start := time.Now()
+	live, reason := probePhantom("192.0.2.1:443", 50*time.Millisecond, []livenessProbe{silent, broken})
+	require.False(t, live)
+	require.Contains(t, reason.Error(), "broken: operation not permitted")
+	require.True(t, time.Since(start) < time.Second)
+
+	// One answer is enough, without waiting for the deadline.
+	start = time.Now()
+	live, reason = probePhantom("192.0.2.1:443", 5*time.Second, []livenessProbe{silent, answers})
+	require.True(t, live)
+	require.Equal(t, "phantom answered tcp probe", reason.Error())
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestICMPEcho(t *testing.T) {
+	msg := newICMPEcho(8, [2]byte{0x12, 0x34}, 1)
+	require.Equal(t, []byte{8, 0, 0x12, 0x34, 0, 1}, []byte{msg[0], msg[1], msg[4], msg[5], msg[6], msg[7]})
+	// A packet with a correct checksum sums to zero.
+	require.Equal(t, uint16(0), icmpChecksum(msg))
+	require.Equal(t, uint16(0xf7ff), icmpChecksum([]byte{8, 0, 0, 0, 0, 0, 0, 0}))
+
+	// The kernel computes ICMPv6 checksums.
+	msg = newICMPEcho(128, [2]byte{0x12, 0x34}, 1)
+	require.Equal(t, []byte{0, 0}, msg[2:4])
+}
+
+func TestLivenessLimiter(t *testing.T) {
+	l := newLivenessLimiter(2)
+	release := make(chan struct{})
+	var active, maxActive int64
+	done := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		go func() {
+			l.do(func() {
+				n := atomic.AddInt64(&active, 1)
+				for {
+					m := atomic.LoadInt64(&maxActive)
+					if n <= m || atomic.CompareAndSwapInt64(&maxActive, m, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt64(&active, -1)
+			})
+			done <- struct{}{}
+		}()
+	}
+
+	for i := 0; i < 1000 && atomic.LoadInt64(&l.queued) != 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, int64(3), atomic.LoadInt64(&l.queued))
+	require.Equal(t, int64(2), atomic.LoadInt64(&active))
+
+	close(release)
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+	require.Equal(t, int64(2), maxActive)
+	require.Equal(t, int64(0), atomic.LoadInt64(&l.queued))
+}
+
+func TestLivenessPool(t *testing.T) {
+	p := NewLivenessPool(1, 1)
+	SetLivenessPool(p)
+	defer SetLivenessPool(nil)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var ran int64
+	done := make(chan struct{}, 2)
+	require.True(t, p.Go(func() {
+		close(started)
+		<-release
+		atomic.AddInt64(&ran, 1)
+		done <- struct{}{}
+	}))
+	<-started
+
+	// One check waits for the busy worker, the queue has no room for more.
+	require.True(t, p.Go(func() {
+		atomic.AddInt64(&ran, 1)
+		done <- struct{}{}
+	}))
+	require.Equal(t, int64(1), LivenessQueueDepth())
+	require.False(t, p.Go(func() { t.Error("check run from a full queue") }))
+
+	close(release)
+	<-done
+	<-done
+	require.Equal(t, int64(2), atomic.LoadInt64(&ran))
+}
+
+func TestLivePhantomPolicy(t *testing.T) {
+	for in, want := range map[string]string{
+		"":         LivePhantomReject,
+		"reject":   LivePhantomReject,
+		"log-only": LivePhantomLogOnly,
+		"divert":   LivePhantomDivert,
+	} {
+		got, err := parseLivePhantomPolicy(in)
+		require.Nil(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err := parseLivePhantomPolicy("drop")
+	require.NotNil(t, err)
+
+	// The policy applied shows up in the registration digest.
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1")}
+	require.Equal(t, "", reg.LivePhantomPolicy())
+	require.False(t, strings.Contains(reg.String(), "LivePhantom"))
+	reg.MarkLivePhantom(LivePhantomDivert)
+	require.Equal(t, LivePhantomDivert, reg.LivePhantomPolicy())
+	require.True(t, strings.Contains(reg.String(), `"LivePhantom":"divert"`), reg.String())
+}
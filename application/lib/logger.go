@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the severity of a log line. Lines below the level set with
+// SetLogLevel are dropped.
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses one of "debug", "info", "warn" or "error".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+var logLevel = int32(LevelInfo)
+
+// SetLogLevel sets the minimum level logged by every Logger.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// Logger is a *log.Logger with leveled output. The embedded Printf family
+// still logs unconditionally.
+type Logger struct {
+	*log.Logger
+}
+
+// NewLogger returns a Logger writing to stdout with the usual station prefix
+// and flags.
+func NewLogger(prefix string) *Logger {
+	return &Logger{log.New(os.Stdout, prefix, log.Ldate|log.Lmicroseconds)}
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+func (l *Logger) Infof(format string, v ...interface{})  { l.logf(LevelInfo, format, v...) }
+func (l *Logger) Warnf(format string, v ...interface{})  { l.logf(LevelWarn, format, v...) }
+func (l *Logger) Errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+func (l *Logger) logf(level LogLevel, format string, v ...interface{}) {
+	if level < LogLevel(atomic.LoadInt32(&logLevel)) {
+		return
+	}
+	l.Output(3, "["+strings.ToUpper(level.String())+"] "+fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	defer SetLogLevel(LevelInfo)
+
+	var buf bytes.Buffer
+	logger := &Logger{log.New(&buf, "[TEST] ", 0)}
+
+	SetLogLevel(LevelInfo)
+	logger.Debugf("hidden %d", 1)
+	require.Equal(t, "", buf.String())
+	logger.Warnf("shown %d", 2)
+	require.Equal(t, "[TEST] [WARN] shown 2\n", buf.String())
+
+	buf.Reset()
+	SetLogLevel(LevelDebug)
+	logger.Debugf("shown %d", 3)
+	require.Equal(t, "[TEST] [DEBUG] shown 3\n", buf.String())
+
+	level, err := ParseLogLevel("WARN")
+	require.Nil(t, err)
+	require.Equal(t, LevelWarn, level)
+	_, err = ParseLogLevel("verbose")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,546 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// TransportTypeMux identifies the mux transport in registrations. The
+// generated protobuf bindings predate it, see proto/signalling.proto.
+const TransportTypeMux pb.TransportType = 3
+
+// A mux session carries several streams, each proxied to a covert of its
+// own, over a single client connection to the phantom. The client starts
+// with a random muxNonceLen byte nonce, the station answers with one of its
+// own, and then both directions are a sequence of frames:
+//
+//	stream ID (uint32) | type (byte) | sealed length (uint16) | sealed payload
+//
+// all big endian, with payloads of at most muxMaxPayload bytes. Payloads are
+// sealed with AES-256-GCM, the frame's header as additional data and its
+// sequence number in its direction (from 0) as the big endian nonce, under
+// keys exported from the registration (see ExportKeyingMaterial): labeled
+// "mux client" with the client's nonce as context for the client's frames,
+// "mux station" with both nonces, client's first, for the station's. A frame
+// that fails to open ends the session. The client
+// opens a stream with an Open frame carrying the covert (host:port, empty
+// for the covert of the registration) under an ID greater than that of any
+// stream it opened before, the first being 1. Data frames carry the stream's
+// bytes, a Close frame ends the sender's half of the stream (like a FIN) and
+// a Reset frame aborts the whole stream, its payload optionally giving the
+// reason. Frames for streams that are not open are ignored, frames too long
+// or of an unknown type and reused stream IDs end the session.
+const (
+	muxHeaderLen  = 7
+	muxMaxPayload = 16384
+	muxNonceLen   = 16
+	muxKeyLen     = 32
+
+	muxClientKeyLabel  = "mux client"
+	muxStationKeyLabel = "mux station"
+
+	muxFrameOpen  = 1
+	muxFrameData  = 2
+	muxFrameClose = 3
+	muxFrameReset = 4
+
+	// Reasons of the Reset frames the station sends: a stream limit was
+	// reached, the covert is not allowed, or the stream failed or was closed
+	// by the station before both halves ended.
+	muxResetLimit   = 1
+	muxResetBlocked = 2
+	muxResetError   = 3
+
+	// defaultMuxMaxStreams is the MuxMaxStreams used when none is configured.
+	defaultMuxMaxStreams = 16
+
+	// muxStreamQueue is the number of Data frames queued for a stream before
+	// reading frames for all streams stops until the stream catches up.
+	muxStreamQueue = 8
+)
+
+// Outcomes of the streams clients open, the label of metrics.MuxStreams.
+const (
+	muxStreamOpened  = "opened"
+	muxStreamLimit   = "limit"
+	muxStreamBlocked = "blocked"
+)
+
+// errMuxStreamReset is returned from reads and writes of a stream the client
+// reset, it is a connection reset for the session's close reason.
+var errMuxStreamReset = fmt.Errorf("mux stream reset by client: %w", syscall.ECONNRESET)
+
+func (c *ProxyConfig) parseMux() error {
+	if c.MuxMaxStreamsTotal < 0 {
+		return fmt.Errorf("mux_max_streams_total must not be negative")
+	}
+	if c.MuxMaxStreams <= 0 {
+		c.MuxMaxStreams = defaultMuxMaxStreams
+	}
+	return nil
+}
+
+// ProxyMux proxies clientConn, a mux transport connection to a phantom on
+// phantomPort, until the client closes it or breaks the framing. Each stream
+// is proxied to its covert as a session of reg of its own, with its own
+// accounting, events and flow records, and traced as a child of span, which
+// may be nil. blocked reports whether a covert a stream asks for is
+// blocklisted, streams to those and to coverts strict TLS does not allow are
+// reset, as are streams past MuxMaxStreams open at once or
+// MuxMaxStreamsTotal over the session. Registrations count a mux session as
+// one connection, however many streams it carries.
+func ProxyMux(reg *DecoyRegistration, clientConn net.Conn, phantomPort int, span *Span, logger *Logger, conf *ProxyConfig, blocked func(string) bool) {
+	m := &muxSession{
+		reg:        reg,
+		conn:       clientConn,
+		port:       phantomPort,
+		span:       span,
+		logger:     logger,
+		conf:       conf,
+		blocked:    blocked,
+		maxStreams: defaultMuxMaxStreams,
+		streams:    make(map[uint32]*muxStream),
+	}
+	if conf != nil {
+		if conf.MuxMaxStreams > 0 {
+			m.maxStreams = conf.MuxMaxStreams
+		}
+		m.maxTotal = conf.MuxMaxStreamsTotal
+	}
+
+	err := m.handshake()
+	if err == nil {
+		err = m.run()
+	}
+	m.shutdown()
+	if err != io.EOF {
+		span.SetError(err)
+	}
+	logger.Printf("mux session closed after %d streams, %d bytes up, %d bytes down: %v",
+		m.accepted, atomic.LoadInt64(&m.bytesUp), atomic.LoadInt64(&m.bytesDown), err)
+}
+
+// muxSession is the state of a client connection proxied by ProxyMux.
+type muxSession struct {
+	reg     *DecoyRegistration
+	conn    net.Conn
+	port    int
+	span    *Span
+	logger  *Logger
+	conf    *ProxyConfig
+	blocked func(string) bool
+
+	maxStreams, maxTotal int
+
+	// seal the frames read from and written to conn, see handshake
+	in, out *muxSealer
+
+	// serializes the frames written to conn
+	wm sync.Mutex
+
+	m        sync.Mutex
+	streams  map[uint32]*muxStream
+	lastID   uint32
+	accepted int
+	wg       sync.WaitGroup
+
+	// traffic of all streams, up is client to covert
+	bytesUp, bytesDown int64
+}
+
+// handshake exchanges the nonces starting the session and derives the keys
+// its frames are sealed with.
+func (m *muxSession) handshake() error {
+	nonces := make([]byte, 2*muxNonceLen)
+	if _, err := io.ReadFull(m.conn, nonces[:muxNonceLen]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(nonces[muxNonceLen:]); err != nil {
+		return err
+	}
+	var err error
+	if m.in, err = newMuxSealer(m.reg, muxClientKeyLabel, nonces[:muxNonceLen]); err != nil {
+		return err
+	}
+	if m.out, err = newMuxSealer(m.reg, muxStationKeyLabel, nonces); err != nil {
+		return err
+	}
+	_, err = m.conn.Write(nonces[muxNonceLen:])
+	return err
+}
+
+// run reads frames from the client until it closes the connection, returning
+// io.EOF, or an error ends the session.
+func (m *muxSession) run() error {
+	var hdr [muxHeaderLen]byte
+	overhead := m.in.aead.Overhead()
+	for {
+		if _, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+			return err
+		}
+		id := binary.BigEndian.Uint32(hdr[0:4])
+		n := int(binary.BigEndian.Uint16(hdr[5:7]))
+		if n < overhead || n-overhead > muxMaxPayload {
+			return fmt.Errorf("stream %d: frame of %d bytes", id, n)
+		}
+		sealed := make([]byte, n)
+		if _, err := io.ReadFull(m.conn, sealed); err != nil {
+			return err
+		}
+		payload, err := m.in.aead.Open(sealed[:0], m.in.nonce(), sealed, hdr[:])
+		if err != nil {
+			return fmt.Errorf("stream %d: frame failed authentication", id)
+		}
+
+		switch hdr[4] {
+		case muxFrameOpen:
+			if err := m.open(id, string(payload)); err != nil {
+				return err
+			}
+		case muxFrameData:
+			if s := m.stream(id); s != nil {
+				s.deliver(payload)
+			}
+		case muxFrameClose:
+			if s := m.stream(id); s != nil {
+				s.closeInbound()
+			}
+		case muxFrameReset:
+			if s := m.stream(id); s != nil {
+				s.reset()
+			}
+		default:
+			return fmt.Errorf("stream %d: unknown frame type %d", id, hdr[4])
+		}
+	}
+}
+
+// open starts proxying stream id to covert, or resets it if it is past a
+// limit or covert is not allowed.
+func (m *muxSession) open(id uint32, covert string) error {
+	if covert == "" {
+		covert = m.reg.Covert
+	}
+
+	m.m.Lock()
+	if id <= m.lastID {
+		m.m.Unlock()
+		return fmt.Errorf("stream %d opened after stream %d", id, m.lastID)
+	}
+	m.lastID = id
+	if (m.blocked != nil && m.blocked(covert)) || m.conf.ViolatesStrictTLS(covert) {
+		m.m.Unlock()
+		// Counted, and only logged at debug as clients choose what they
+		// open.
+		metrics.MuxStreams.Inc(muxStreamBlocked)
+		m.logger.Debugf("mux stream %d: resetting, covert %s not allowed", id, redactCovertAddr(covert, m.conf != nil && m.conf.RedactCovert))
+		m.writeFrame(id, muxFrameReset, []byte{muxResetBlocked})
+		return nil
+	}
+	if open, accepted := len(m.streams), m.accepted; open >= m.maxStreams || (m.maxTotal > 0 && accepted >= m.maxTotal) {
+		m.m.Unlock()
+		metrics.MuxStreams.Inc(muxStreamLimit)
+		m.logger.Debugf("mux stream %d: resetting, %d streams open, %d opened", id, open, accepted)
+		m.writeFrame(id, muxFrameReset, []byte{muxResetLimit})
+		return nil
+	}
+	s := &muxStream{
+		mux:  m,
+		id:   id,
+		in:   make(chan []byte, muxStreamQueue),
+		done: make(chan struct{}),
+	}
+	m.streams[id] = s
+	m.accepted++
+	m.wg.Add(1)
+	m.m.Unlock()
+	metrics.MuxStreams.Inc(muxStreamOpened)
+
+	go func() {
+		defer m.wg.Done()
+		span := m.span.Child("mux.stream")
+		span.SetIntAttr(traceAttrMuxStreamID, int64(id))
+		proxyTo(m.reg, covert, s, m.port, nil, span, m.logger, m.conf, s.track)
+		span.End()
+		s.Close()
+
+		m.m.Lock()
+		delete(m.streams, id)
+		m.m.Unlock()
+	}()
+	return nil
+}
+
+func (m *muxSession) stream(id uint32) *muxStream {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.streams[id]
+}
+
+// shutdown closes the client connection, which ends every stream, and waits
+// for the streams' sessions to end.
+func (m *muxSession) shutdown() {
+	m.conn.Close()
+	m.m.Lock()
+	streams := make([]*muxStream, 0, len(m.streams))
+	for _, s := range m.streams {
+		streams = append(streams, s)
+	}
+	m.m.Unlock()
+	for _, s := range streams {
+		s.Close()
+	}
+	m.wg.Wait()
+}
+
+func (m *muxSession) writeFrame(id uint32, typ byte, payload []byte) error {
+	var hdr [muxHeaderLen]byte
+	binary.BigEndian.PutUint32(hdr[0:4], id)
+	hdr[4] = typ
+	binary.BigEndian.PutUint16(hdr[5:7], uint16(len(payload)+m.out.aead.Overhead()))
+	frame := make([]byte, muxHeaderLen, muxHeaderLen+len(payload)+m.out.aead.Overhead())
+	copy(frame, hdr[:])
+
+	// Frames are sealed in the order they are written, which their nonces
+	// follow.
+	m.wm.Lock()
+	defer m.wm.Unlock()
+	frame = m.out.aead.Seal(frame, m.out.nonce(), payload, hdr[:])
+	_, err := m.conn.Write(frame)
+	return err
+}
+
+// muxSealer seals or opens the frames of one direction of a mux session.
+type muxSealer struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+// newMuxSealer returns the sealer of the key exported from reg with label and
+// context.
+func newMuxSealer(reg *DecoyRegistration, label string, context []byte) (*muxSealer, error) {
+	key, err := reg.ExportKeyingMaterial(label, context, muxKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &muxSealer{aead: aead}, nil
+}
+
+// nonce returns the nonce of the next frame.
+func (s *muxSealer) nonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.seq)
+	s.seq++
+	return nonce
+}
+
+// muxStream is a stream of a mux session, the client connection of its
+// session. Writes are sent as Data frames as soon as they are made, so a
+// client not reading its connection holds up every stream, as does a stream
+// whose covert does not keep up once muxStreamQueue frames are queued for it.
+// Write deadlines are not supported, the client connection is shared.
+type muxStream struct {
+	mux  *muxSession
+	id   uint32
+	in   chan []byte   // Data frames from the client, closed by its Close frame
+	done chan struct{} // closed by Close
+
+	// the rest of the Data frame Read last took from in
+	pending []byte
+
+	m            sync.Mutex
+	readDeadline time.Time
+	inClosed     bool // the client sent a Close frame
+	sentClose    bool // the station sent a Close frame
+	gotReset     bool // the client reset the stream
+	closed       bool
+	tracked      *Session
+}
+
+// Read returns the data the client sent on the stream, io.EOF after its
+// Close frame. A read deadline set while a Read is blocked applies from the
+// next Read.
+func (s *muxStream) Read(b []byte) (int, error) {
+	if len(s.pending) == 0 {
+		var timeout <-chan time.Time
+		s.m.Lock()
+		deadline := s.readDeadline
+		s.m.Unlock()
+		if !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case p, ok := <-s.in:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.pending = p
+		case <-s.done:
+			return 0, s.closedErr()
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	atomic.AddInt64(&s.mux.bytesUp, int64(n))
+	return n, nil
+}
+
+func (s *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		select {
+		case <-s.done:
+			return written, s.closedErr()
+		default:
+		}
+		n := len(b)
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+		if err := s.mux.writeFrame(s.id, muxFrameData, b[:n]); err != nil {
+			return written, err
+		}
+		atomic.AddInt64(&s.mux.bytesDown, int64(n))
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (s *muxStream) closedErr() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.gotReset {
+		return errMuxStreamReset
+	}
+	return io.ErrClosedPipe
+}
+
+// CloseWrite sends the client a Close frame, once.
+func (s *muxStream) CloseWrite() error {
+	s.m.Lock()
+	if s.sentClose || s.closed {
+		s.m.Unlock()
+		return nil
+	}
+	s.sentClose = true
+	s.m.Unlock()
+	return s.mux.writeFrame(s.id, muxFrameClose, nil)
+}
+
+// CloseRead does nothing, the client ends its half with a Close frame.
+func (s *muxStream) CloseRead() error { return nil }
+
+// Close ends the stream, resetting it unless both halves had ended or the
+// client reset it, and closes the covert connection of its session.
+func (s *muxStream) Close() error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return nil
+	}
+	s.closed = true
+	finished := s.gotReset || (s.inClosed && s.sentClose)
+	tracked := s.tracked
+	close(s.done)
+	s.m.Unlock()
+
+	var err error
+	if !finished {
+		err = s.mux.writeFrame(s.id, muxFrameReset, []byte{muxResetError})
+	}
+	// Only the covert: Session.Close, e.g. from the reaper, closes the
+	// stream first.
+	if tracked != nil && tracked.covertConn != nil {
+		tracked.covertConn.Close()
+	}
+	return err
+}
+
+// track is called by proxyTo with the session of the stream, the streams
+// closed before their covert dial completed close its connection right away.
+func (s *muxStream) track(sess *Session) {
+	s.m.Lock()
+	s.tracked = sess
+	closed := s.closed
+	s.m.Unlock()
+	if closed && sess.covertConn != nil {
+		sess.covertConn.Close()
+	}
+}
+
+// deliver queues a Data frame from the client, called from the session's
+// read loop only.
+func (s *muxStream) deliver(p []byte) {
+	s.m.Lock()
+	inClosed := s.inClosed
+	s.m.Unlock()
+	if inClosed || len(p) == 0 {
+		return
+	}
+	select {
+	case s.in <- p:
+	case <-s.done:
+	}
+}
+
+// closeInbound handles the client's Close frame, called from the session's
+// read loop only.
+func (s *muxStream) closeInbound() {
+	s.m.Lock()
+	if s.inClosed {
+		s.m.Unlock()
+		return
+	}
+	s.inClosed = true
+	s.m.Unlock()
+	close(s.in)
+}
+
+// reset handles the client's Reset frame.
+func (s *muxStream) reset() {
+	s.m.Lock()
+	s.gotReset = true
+	s.m.Unlock()
+	s.Close()
+}
+
+func (s *muxStream) LocalAddr() net.Addr  { return s.mux.conn.LocalAddr() }
+func (s *muxStream) RemoteAddr() net.Addr { return s.mux.conn.RemoteAddr() }
+
+func (s *muxStream) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, see muxStream.
+func (s *muxStream) SetWriteDeadline(t time.Time) error { return nil }
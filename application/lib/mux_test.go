@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// muxTestClient speaks the mux framing to a session proxied by ProxyMux.
+type muxTestClient struct {
+	t       *testing.T
+	conn    *net.TCPConn
+	in, out *muxSealer
+	done    chan struct{} // closed once ProxyMux returned
+}
+
+func newMuxTestClient(t *testing.T, reg *DecoyRegistration, conf *ProxyConfig, blocked func(string) bool) *muxTestClient {
+	client, stationClient := tcpPair(t)
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+	c := &muxTestClient{t: t, conn: client, done: make(chan struct{})}
+	go func() {
+		ProxyMux(reg, stationClient, 443, nil, logger, conf, blocked)
+		close(c.done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	nonces := make([]byte, 2*muxNonceLen)
+	_, err := rand.Read(nonces[:muxNonceLen])
+	require.Nil(t, err)
+	_, err = client.Write(nonces[:muxNonceLen])
+	require.Nil(t, err)
+	_, err = io.ReadFull(client, nonces[muxNonceLen:])
+	require.Nil(t, err)
+	c.out, err = newMuxSealer(reg, muxClientKeyLabel, nonces[:muxNonceLen])
+	require.Nil(t, err)
+	c.in, err = newMuxSealer(reg, muxStationKeyLabel, nonces)
+	require.Nil(t, err)
+	return c
+}
+
+func (c *muxTestClient) send(id uint32, typ byte, payload string) {
+	var hdr [muxHeaderLen]byte
+	binary.BigEndian.PutUint32(hdr[0:4], id)
+	hdr[4] = typ
+	binary.BigEndian.PutUint16(hdr[5:7], uint16(len(payload)+c.out.aead.Overhead()))
+	frame := c.out.aead.Seal(hdr[:], c.out.nonce(), []byte(payload), hdr[:])
+	_, err := c.conn.Write(frame)
+	require.Nil(c.t, err)
+}
+
+func (c *muxTestClient) recv() (uint32, byte, []byte) {
+	var hdr [muxHeaderLen]byte
+	_, err := io.ReadFull(c.conn, hdr[:])
+	require.Nil(c.t, err)
+	sealed := make([]byte, binary.BigEndian.Uint16(hdr[5:7]))
+	_, err = io.ReadFull(c.conn, sealed)
+	require.Nil(c.t, err)
+	payload, err := c.in.aead.Open(nil, c.in.nonce(), sealed, hdr[:])
+	require.Nil(c.t, err)
+	return binary.BigEndian.Uint32(hdr[0:4]), hdr[4], payload
+}
+
+// expect reads the next frame and requires it to be the given one.
+func (c *muxTestClient) expect(id uint32, typ byte, payload string) {
+	gotID, gotType, got := c.recv()
+	require.Equal(c.t, id, gotID)
+	require.Equal(c.t, typ, gotType)
+	require.Equal(c.t, payload, string(got))
+}
+
+// expectData reads Data frames of stream id until they make up want.
+func (c *muxTestClient) expectData(id uint32, want string) {
+	var got []byte
+	for len(got) < len(want) {
+		gotID, typ, payload := c.recv()
+		require.Equal(c.t, id, gotID)
+		require.Equal(c.t, byte(muxFrameData), typ)
+		got = append(got, payload...)
+	}
+	require.Equal(c.t, want, string(got))
+}
+
+// serveGreeting sends every connection greeting then echoes it.
+func serveGreeting(ln net.Listener, greeting string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.WriteString(conn, greeting)
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestProxyMux(t *testing.T) {
+	covertA, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covertA.Close()
+	go serveGreeting(covertA, "A")
+	covertB, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covertB.Close()
+	go serveGreeting(covertB, "B")
+
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = covertA.Addr().String()
+	conf := &ProxyConfig{}
+	require.Nil(t, conf.parseMux())
+
+	t.Run("streams", func(t *testing.T) {
+		opened := metrics.MuxStreams.Value(muxStreamOpened)
+		c := newMuxTestClient(t, reg, conf, nil)
+		defer c.conn.Close()
+
+		// An empty Open frame is for the covert of the registration.
+		c.send(1, muxFrameOpen, "")
+		c.expectData(1, "A")
+		c.send(2, muxFrameOpen, covertB.Addr().String())
+		c.expectData(2, "B")
+		c.send(1, muxFrameData, "one")
+		c.expectData(1, "one")
+		c.send(2, muxFrameData, "two")
+		c.expectData(2, "two")
+
+		// Each stream is a session of its own.
+		coverts := make(map[string]bool)
+		Sessions().m.RLock()
+		for _, sess := range Sessions().sessions {
+			if sess.RegID == reg.IDString() {
+				coverts[sess.Covert] = true
+			}
+		}
+		Sessions().m.RUnlock()
+		require.Equal(t, map[string]bool{covertA.Addr().String(): true, covertB.Addr().String(): true}, coverts)
+
+		// Ending the client's half of a stream ends the covert's, the
+		// other stream carries on.
+		c.send(1, muxFrameClose, "")
+		c.expect(1, muxFrameClose, "")
+		c.send(1, muxFrameData, "ignored")
+		c.send(2, muxFrameData, "still open")
+		c.expectData(2, "still open")
+
+		// The client ending the connection ends the streams still open.
+		c.conn.CloseWrite()
+		<-c.done
+		_, err := c.conn.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+		Sessions().m.RLock()
+		for _, sess := range Sessions().sessions {
+			require.NotEqual(t, reg.IDString(), sess.RegID)
+		}
+		Sessions().m.RUnlock()
+		require.Equal(t, opened+2, metrics.MuxStreams.Value(muxStreamOpened))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		limited := metrics.MuxStreams.Value(muxStreamLimit)
+		c := newMuxTestClient(t, reg, &ProxyConfig{MuxMaxStreams: 1, MuxMaxStreamsTotal: 2}, nil)
+		defer c.conn.Close()
+
+		c.send(1, muxFrameOpen, "")
+		c.expectData(1, "A")
+		c.send(2, muxFrameOpen, "")
+		c.expect(2, muxFrameReset, string([]byte{muxResetLimit}))
+
+		c.send(1, muxFrameReset, "")
+		time.Sleep(50 * time.Millisecond)
+		c.send(3, muxFrameOpen, "")
+		c.expectData(3, "A")
+		c.send(3, muxFrameReset, "")
+		time.Sleep(50 * time.Millisecond)
+		c.send(4, muxFrameOpen, "")
+		c.expect(4, muxFrameReset, string([]byte{muxResetLimit}))
+		require.Equal(t, limited+2, metrics.MuxStreams.Value(muxStreamLimit))
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		blockedStreams := metrics.MuxStreams.Value(muxStreamBlocked)
+		blocked := func(covert string) bool { return covert == covertB.Addr().String() }
+		c := newMuxTestClient(t, reg, conf, blocked)
+		defer c.conn.Close()
+
+		c.send(1, muxFrameOpen, covertB.Addr().String())
+		c.expect(1, muxFrameReset, string([]byte{muxResetBlocked}))
+		c.send(2, muxFrameOpen, "")
+		c.expectData(2, "A")
+		require.Equal(t, blockedStreams+1, metrics.MuxStreams.Value(muxStreamBlocked))
+	})
+
+	t.Run("client reset", func(t *testing.T) {
+		covert, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer covert.Close()
+		closed := make(chan error, 1)
+		go func() {
+			conn, err := covert.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "C")
+			_, err = conn.Read(make([]byte, 1))
+			closed <- err
+		}()
+
+		c := newMuxTestClient(t, reg, conf, nil)
+		defer c.conn.Close()
+		c.send(1, muxFrameOpen, covert.Addr().String())
+		c.expectData(1, "C")
+		c.send(1, muxFrameReset, "")
+		select {
+		case err := <-closed:
+			require.Equal(t, io.EOF, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("covert connection of the reset stream not closed")
+		}
+		// The stream is gone, frames for it are ignored.
+		c.send(1, muxFrameData, "ignored")
+		c.send(2, muxFrameOpen, "")
+		c.expectData(2, "A")
+	})
+
+	t.Run("protocol errors", func(t *testing.T) {
+		for name, frame := range map[string]func(c *muxTestClient){
+			"unknown type": func(c *muxTestClient) { c.send(1, 9, "") },
+			"reused ID":    func(c *muxTestClient) { c.send(1, muxFrameOpen, "") },
+			"too long": func(c *muxTestClient) {
+				c.send(1, muxFrameData, string(make([]byte, muxMaxPayload+1)))
+			},
+			// A frame sealed for another sequence number, e.g. replayed.
+			"replayed": func(c *muxTestClient) {
+				c.out.seq--
+				c.send(1, muxFrameData, "again")
+			},
+			"forged": func(c *muxTestClient) {
+				hdr := []byte{0, 0, 0, 1, muxFrameData, 0, 20}
+				_, err := c.conn.Write(append(hdr, make([]byte, 20)...))
+				require.Nil(c.t, err)
+			},
+		} {
+			c := newMuxTestClient(t, reg, conf, nil)
+			c.send(1, muxFrameOpen, "")
+			c.expectData(1, "A")
+			frame(c)
+			select {
+			case <-c.done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: session did not end", name)
+			}
+			_, err := c.conn.Read(make([]byte, 1))
+			require.NotNil(t, err, name)
+			c.conn.Close()
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OriginalDstResolver recovers the address (phantom IP and port) a client
+// connected to before its connection was diverted to one of the station's
+// listeners. How the traffic is diverted determines both how the listeners
+// must be created and how the original destination is found.
+type OriginalDstResolver interface {
+	// Listen opens a listener on addr able to receive diverted connections,
+	// calling control (if not nil) on its socket before it binds.
+	Listen(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error)
+
+	// OriginalDst returns the address conn was originally sent to.
+	OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error)
+
+	// SelfCheck reports host configuration problems that would stop
+	// OriginalDst from working on connections accepted by ln. It is called
+	// before ln starts accepting connections.
+	SelfCheck(ln *net.TCPListener) error
+}
+
+// NewOriginalDstResolver returns the resolver for the configured
+// original_dst_mode, "redirect" (the default), "tproxy" or, on macOS for
+// development, "pf". "proxy_header" is for testing only.
+func NewOriginalDstResolver(mode string) (OriginalDstResolver, error) {
+	switch mode {
+	case "", "redirect":
+		return redirectResolver{}, nil
+	case "tproxy":
+		return tproxyResolver{}, nil
+	case "pf":
+		return newPFResolver()
+	case "proxy_header":
+		return proxyHeaderResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown original_dst_mode %q", mode)
+	}
+}
+
+// redirectResolver handles traffic diverted by an iptables REDIRECT or DNAT
+// rule. The original destination is read from conntrack with SO_ORIGINAL_DST.
+type redirectResolver struct{}
+
+func (redirectResolver) Listen(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	return listenControlled(addr, control)
+}
+
+func (redirectResolver) OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	originalDst, err := connOriginalDst(conn)
+	if err != nil {
+		return nil, err
+	}
+	checkNotRedirected(conn, originalDst)
+	return originalDst, nil
+}
+
+// SelfCheck makes a loopback connection to an ephemeral listener on the
+// address of ln and checks that its original destination can be recovered.
+// Without connection tracking SO_ORIGINAL_DST fails and every connection is
+// silently dropped. ln itself is left alone: a client connecting to it during
+// the check would otherwise be accepted, and dropped, here. Loopback
+// connections are never redirected so getting the listener address back is
+// expected here, see checkNotRedirected for the per connection counterpart.
+func (redirectResolver) SelfCheck(ln *net.TCPListener) error {
+	addr := *ln.Addr().(*net.TCPAddr)
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	addr.Port = 0
+
+	probe, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("self-check failed to listen: %v", err)
+	}
+	defer probe.Close()
+	probe.SetDeadline(time.Now().Add(2 * time.Second))
+
+	client, err := net.DialTCP("tcp", nil, probe.Addr().(*net.TCPAddr))
+	if err != nil {
+		return fmt.Errorf("self-check failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := probe.AcceptTCP()
+	if err != nil {
+		return fmt.Errorf("self-check failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := connOriginalDst(conn); err != nil {
+		return fmt.Errorf("SO_ORIGINAL_DST unavailable (%v), is NAT connection tracking enabled?", err)
+	}
+	return nil
+}
+
+var notRedirectedOnce sync.Once
+
+// checkNotRedirected logs a warning, once, if conn reached the station without
+// being redirected, i.e. its original destination is the listener itself.
+func checkNotRedirected(conn *net.TCPConn, originalDst *net.TCPAddr) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || local.Port != originalDst.Port || !local.IP.Equal(originalDst.IP) {
+		return
+	}
+	notRedirectedOnce.Do(func() {
+		NewLogger("[REG] ").Warnf("received a connection that was not redirected (original destination is the listener %v), check the iptables REDIRECT/DNAT rules", local)
+	})
+}
+
+// tproxyResolver handles traffic diverted by an iptables TPROXY rule. The
+// connection is delivered unmodified to a transparent listener, so its local
+// address is the original destination.
+type tproxyResolver struct{}
+
+func (tproxyResolver) Listen(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	return listenTransparent(addr, control)
+}
+
+func (tproxyResolver) OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address type %T", conn.LocalAddr())
+	}
+	return local, nil
+}
+
+// SelfCheck has nothing to verify, Listen already failed if the socket could
+// not be made transparent (e.g. missing CAP_NET_ADMIN).
+func (tproxyResolver) SelfCheck(ln *net.TCPListener) error { return nil }
+
+// proxyHeaderResolver is for end to end tests without any redirect rule: test
+// clients (see cmd/conjure-client) connect straight to a listener and send
+// the phantom they would have connected to in a PROXY protocol v1 header,
+//
+//	PROXY TCP4 <client ip> <phantom ip> <client port> <phantom port>\r\n
+//
+// before anything else. It trusts whatever the client claims, so it must never
+// be used on a station reachable by real clients.
+type proxyHeaderResolver struct{}
+
+// maxPROXYHeaderLen is the longest PROXY protocol v1 header, CRLF included.
+const maxPROXYHeaderLen = 107
+
+func (proxyHeaderResolver) Listen(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	return listenControlled(addr, control)
+}
+
+// OriginalDst reads the header a byte at a time so that nothing after it is
+// consumed.
+func (proxyHeaderResolver) OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var line []byte
+	var b [1]byte
+	for !strings.HasSuffix(string(line), "\r\n") {
+		if len(line) >= maxPROXYHeaderLen {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+		if _, err := conn.Read(b[:]); err != nil {
+			return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+		}
+		line = append(line, b[0])
+	}
+	return parsePROXYHeaderDst(strings.TrimSuffix(string(line), "\r\n"))
+}
+
+// parsePROXYHeaderDst returns the destination of a PROXY protocol v1 header
+// line.
+func parsePROXYHeaderDst(line string) (*net.TCPAddr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[3])
+	port, err := strconv.Atoi(fields[5])
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY header destination in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// SelfCheck has nothing to verify, every connection states its destination.
+func (proxyHeaderResolver) SelfCheck(ln *net.TCPListener) error { return nil }
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// getOriginalDst returns the address (phantom IP and port) the client
+// connected to before being redirected to one of the station's listeners.
+func getOriginalDst(fd uintptr) (*net.TCPAddr, error) {
+	const SO_ORIGINAL_DST = 80
+	if sockOpt, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST); err == nil {
+		// parse ipv4 (struct sockaddr_in: family, port, addr)
+		ip := net.IPv4(sockOpt.Multiaddr[4], sockOpt.Multiaddr[5], sockOpt.Multiaddr[6], sockOpt.Multiaddr[7])
+		port := int(sockOpt.Multiaddr[2])<<8 | int(sockOpt.Multiaddr[3])
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	} else if mtuinfo, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, SO_ORIGINAL_DST); err == nil {
+		// parse ipv6. Port holds the network byte order value as read on the
+		// little endian hosts the station runs on.
+		port := int(mtuinfo.Addr.Port&0xff)<<8 | int(mtuinfo.Addr.Port>>8)
+		return &net.TCPAddr{IP: net.IP(mtuinfo.Addr.Addr[:]), Port: port}, nil
+	} else {
+		return nil, err
+	}
+}
+
+// connOriginalDst returns the original destination of conn, see getOriginalDst.
+func connOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	fd, err := conn.File()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file descriptor: %v", err)
+	}
+	defer fd.Close()
+
+	fdPtr := fd.Fd()
+	originalDst, err := getOriginalDst(fdPtr)
+
+	// We need to set the underlying file descriptor back into
+	// non-blocking mode after calling Fd (which puts it into blocking
+	// mode), or else deadlines won't work.
+	if nbErr := syscall.SetNonblock(int(fdPtr), true); nbErr != nil {
+		NewLogger("[REG] ").Warnf("failed to set non-blocking mode on fd: %v", nbErr)
+	}
+
+	return originalDst, err
+}
+
+// IPV6_TRANSPARENT is not defined by the syscall package.
+const ipv6Transparent = 75
+
+// listenTransparent opens a listener with IP_TRANSPARENT (and
+// IPV6_TRANSPARENT for v6 sockets) set, so that it accepts connections that
+// TPROXY delivers to it for any destination address. control, if not nil, is
+// called first.
+func listenTransparent(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if sockErr == nil && network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("failed to set IP_TRANSPARENT: %v", sockErr)
+			}
+			return nil
+		},
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package lib
+
+import (
+	"fmt"
+	"net"
+)
+
+func connOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("SO_ORIGINAL_DST is only supported on linux")
+}
+
+func listenTransparent(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	return nil, fmt.Errorf("transparent (TPROXY) listeners are only supported on linux")
+}
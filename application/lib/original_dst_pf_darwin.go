@@ -0,0 +1,112 @@
+// +build darwin
+
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// pfResolver handles traffic diverted by a PF rdr rule on macOS, for running
+// the station on a development machine. It is not meant for production.
+//
+// The original destination is looked up in the PF state table with the
+// DIOCNATLOOK ioctl on /dev/pf, which requires running as root. To divert
+// connections to phantoms in 192.0.2.0/24 to a listener on :41245, add to
+// /etc/pf.conf (or a file loaded with pfctl -f) and enable PF with pfctl -e:
+//
+//	rdr pass on lo0 inet proto tcp from any to 192.0.2.0/24 -> 127.0.0.1 port 41245
+//	pass out route-to lo0 inet proto tcp from any to 192.0.2.0/24
+//
+// The route-to rule sends locally generated connections to the phantoms
+// through lo0 so that the rdr rule sees them, which is what testing with a
+// client on the same machine needs. Traffic arriving on another interface is
+// diverted with an rdr rule on that interface instead.
+type pfResolver struct {
+	m   sync.Mutex // serializes the ioctls on dev
+	dev *os.File
+}
+
+func newPFResolver() (OriginalDstResolver, error) {
+	dev, err := os.OpenFile("/dev/pf", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/pf for original destination lookups (run as root): %v", err)
+	}
+	return &pfResolver{dev: dev}, nil
+}
+
+func (*pfResolver) Listen(addr *net.TCPAddr, control ListenControl) (*net.TCPListener, error) {
+	return listenControlled(addr, control)
+}
+
+// Layout of struct pfioc_natlook in xnu's bsd/net/pfvar.h: four 16 byte
+// struct pf_addr (saddr, daddr, rsaddr, rdaddr), four 4 byte union
+// pf_state_xport whose first member is the port in network byte order
+// (sxport, dxport, rsxport, rdxport), then af, proto, proto_variant and
+// direction bytes.
+const (
+	pfNatlookSaddr     = 0
+	pfNatlookDaddr     = 16
+	pfNatlookRdaddr    = 48
+	pfNatlookSxport    = 64
+	pfNatlookDxport    = 68
+	pfNatlookRdxport   = 76
+	pfNatlookAf        = 80
+	pfNatlookProto     = 81
+	pfNatlookDirection = 83
+	pfNatlookSize      = 84
+
+	// _IOWR('D', 23, struct pfioc_natlook)
+	pfDIOCNATLOOK = 0xc0000000 | pfNatlookSize<<16 | 'D'<<8 | 23
+
+	pfOut = 2 // PF_OUT
+)
+
+func (p *pfResolver) OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected remote address type %T", conn.RemoteAddr())
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address type %T", conn.LocalAddr())
+	}
+
+	var nl [pfNatlookSize]byte
+	if ip4 := remote.IP.To4(); ip4 != nil {
+		copy(nl[pfNatlookSaddr:], ip4)
+		copy(nl[pfNatlookDaddr:], local.IP.To4())
+		nl[pfNatlookAf] = syscall.AF_INET
+	} else {
+		copy(nl[pfNatlookSaddr:], remote.IP.To16())
+		copy(nl[pfNatlookDaddr:], local.IP.To16())
+		nl[pfNatlookAf] = syscall.AF_INET6
+	}
+	binary.BigEndian.PutUint16(nl[pfNatlookSxport:], uint16(remote.Port))
+	binary.BigEndian.PutUint16(nl[pfNatlookDxport:], uint16(local.Port))
+	nl[pfNatlookProto] = syscall.IPPROTO_TCP
+	nl[pfNatlookDirection] = pfOut
+
+	p.m.Lock()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, p.dev.Fd(), pfDIOCNATLOOK, uintptr(unsafe.Pointer(&nl[0])))
+	p.m.Unlock()
+	if errno != 0 {
+		return nil, fmt.Errorf("DIOCNATLOOK failed, is the connection diverted by a PF rdr rule? %v", errno)
+	}
+
+	ip := net.IP(append([]byte(nil), nl[pfNatlookRdaddr:pfNatlookRdaddr+16]...))
+	if nl[pfNatlookAf] == syscall.AF_INET {
+		ip = ip[:net.IPv4len]
+	}
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(nl[pfNatlookRdxport:]))}, nil
+}
+
+// SelfCheck has nothing to verify, a loopback connection is never diverted so
+// there is no state to look up. newPFResolver already failed if /dev/pf could
+// not be opened.
+func (*pfResolver) SelfCheck(ln *net.TCPListener) error { return nil }
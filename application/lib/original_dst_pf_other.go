@@ -0,0 +1,9 @@
+// +build !darwin
+
+package lib
+
+import "fmt"
+
+func newPFResolver() (OriginalDstResolver, error) {
+	return nil, fmt.Errorf("original_dst_mode \"pf\" is only supported on macOS")
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenAllCleanup(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	// The second address is already taken.
+	_, err = ListenAll([]string{"127.0.0.1:0", ln.Addr().String()}, redirectResolver{}, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ln.Addr().String())
+
+	_, err = ListenAll([]string{"not an address"}, redirectResolver{}, nil)
+	require.NotNil(t, err)
+}
+
+// Without a REDIRECT rule (and usually without conntrack) in the test
+// environment the self-check must not pass silently.
+func TestCheckRedirectWithoutNAT(t *testing.T) {
+	listeners, err := ListenAll([]string{"127.0.0.1:0"}, redirectResolver{}, nil)
+	require.Nil(t, err)
+	defer CloseAll(listeners)
+
+	err = redirectResolver{}.SelfCheck(listeners[0])
+	if err == nil {
+		t.Skip("SO_ORIGINAL_DST available on this host")
+	}
+	require.Contains(t, err.Error(), "SO_ORIGINAL_DST")
+}
+
+// A client already waiting on the listener is left for the listener's own
+// accept loop.
+func TestSelfCheckLeavesListener(t *testing.T) {
+	listeners, err := ListenAll([]string{"127.0.0.1:0"}, redirectResolver{}, nil)
+	require.Nil(t, err)
+	defer CloseAll(listeners)
+
+	client, err := net.Dial("tcp", listeners[0].Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	redirectResolver{}.SelfCheck(listeners[0])
+
+	listeners[0].SetDeadline(time.Now().Add(time.Second))
+	conn, err := listeners[0].Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+}
+
+func TestOriginalDstResolverSelection(t *testing.T) {
+	r, err := NewOriginalDstResolver("")
+	require.Nil(t, err)
+	require.Equal(t, redirectResolver{}, r)
+
+	r, err = NewOriginalDstResolver("tproxy")
+	require.Nil(t, err)
+	require.Equal(t, tproxyResolver{}, r)
+
+	if runtime.GOOS != "darwin" {
+		_, err = NewOriginalDstResolver("pf")
+		require.NotNil(t, err)
+	}
+
+	r, err = NewOriginalDstResolver("proxy_header")
+	require.Nil(t, err)
+	require.Equal(t, proxyHeaderResolver{}, r)
+
+	_, err = NewOriginalDstResolver("nat")
+	require.NotNil(t, err)
+}
+
+// With TPROXY the connection's local address is the original destination.
+func TestTProxyOriginalDst(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	conn, err := ln.AcceptTCP()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	dst, err := tproxyResolver{}.OriginalDst(conn)
+	require.Nil(t, err)
+	require.Equal(t, ln.Addr().String(), dst.String())
+}
+
+// The PROXY header is consumed, and only the header.
+func TestProxyHeaderOriginalDst(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	conn, err := ln.AcceptTCP()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	client.Write([]byte("PROXY TCP6 2001:db8::2 2001:db8::1 5555 443\r\nhello"))
+	dst, err := proxyHeaderResolver{}.OriginalDst(conn)
+	require.Nil(t, err)
+	require.Equal(t, "[2001:db8::1]:443", dst.String())
+
+	rest := make([]byte, 5)
+	_, err = io.ReadFull(conn, rest)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(rest))
+
+	_, err = parsePROXYHeaderDst("PROXY UNKNOWN")
+	require.NotNil(t, err)
+	_, err = parsePROXYHeaderDst("PROXY TCP4 192.0.2.2 192.0.2.1 5555 99999")
+	require.NotNil(t, err)
+}
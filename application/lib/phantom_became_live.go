@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"net"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// PhantomKnownLive reports whether phantom is known to be live, and why,
+// answering from the liveness cache without probing. It is the connection
+// time re-check of the phantom of a registration that was not live when it
+// registered: the address may since have been assigned to a host. The cache
+// learns of such phantoms from the detector's live phantom reports (see
+// ReportLivePhantom) and the liveness checks of other registrations. Without a
+// liveness cache no phantom is known live.
+func PhantomKnownLive(phantom net.IP) (bool, error) {
+	cache := livenessResults.Load().(*livenessCache)
+	if cache == nil || phantom == nil {
+		return false, nil
+	}
+	live, reason, ok := cache.get(phantom.String())
+	if !ok || !live {
+		return false, nil
+	}
+	return true, reason
+}
+
+// PhantomBecameLive handles reg, matched by a connection, whose phantom was
+// not live when it registered but is known live now (see PhantomKnownLive).
+// The live phantom policy then applies as if the phantom had been found live
+// at registration: with LivePhantomReject the registration is evicted, with
+// the others it is tagged with the policy, which its connections follow from
+// then on, starting with the one that matched it. With expire every other
+// registration with the phantom is expired too, so that the station stops
+// serving it at once rather than as each one is connected to. It returns the
+// number of registrations removed, the race is counted in
+// metrics.PhantomBecameLive and logged.
+func (regManager *RegistrationManager) PhantomBecameLive(reg *DecoyRegistration, reason error, policy string, expire bool) int {
+	metrics.PhantomBecameLive.Inc(policy)
+	removed := 0
+	if expire {
+		removed = regManager.ExpirePhantom(reg.DarkDecoy, reg)
+		metrics.PhantomBecameLiveExpired.Add(float64(removed))
+	}
+	if policy == LivePhantomReject {
+		regManager.EvictRegistration(reg)
+		removed++
+	} else {
+		reg.MarkLivePhantom(policy)
+	}
+	if regManager.Logger != nil {
+		regManager.Logger.Warnf("phantom became live {reg_id: %s, phantom: %s, registered: %s ago, reason: %v, policy: %s, removed: %d}",
+			reg.IDString(), reg.DarkDecoy, time.Since(reg.RegistrationTime).Truncate(time.Second), reason, policy, removed)
+	}
+	return removed
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhantomBecameLive(t *testing.T) {
+	SetLivenessCache(16, time.Hour, time.Hour)
+	defer SetLivenessCache(0, 0, 0)
+	rm := &RegistrationManager{registeredDecoys: newConnTagTestDecoys(), Logger: &Logger{log.New(ioutil.Discard, "", 0)}}
+
+	// Registrations made while the phantom was dead, and one with another
+	// phantom.
+	phantom, other := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()
+	var regs []*DecoyRegistration
+	for i := 0; i < 3; i++ {
+		reg := newConnTagTestReg(t, phantom)
+		require.Nil(t, rm.TrackRegistration(reg))
+		regs = append(regs, reg)
+	}
+	require.Nil(t, rm.TrackRegistration(newConnTagTestReg(t, other)))
+	live, _ := PhantomKnownLive(phantom)
+	require.False(t, live)
+
+	// The phantom is assigned to a host, which the detector sees.
+	require.True(t, ReportLivePhantom(net.ParseIP("::ffff:192.0.2.1")))
+	live, reason := PhantomKnownLive(phantom)
+	require.True(t, live)
+	require.Equal(t, errReportedLive, reason)
+	live, _ = PhantomKnownLive(other)
+	require.False(t, live)
+
+	// Without expiry only the registration connected to is affected.
+	logOnly := metrics.PhantomBecameLive.Value(LivePhantomLogOnly)
+	require.Equal(t, 0, rm.PhantomBecameLive(regs[0], reason, LivePhantomLogOnly, false))
+	require.Equal(t, LivePhantomLogOnly, regs[0].LivePhantomPolicy())
+	require.Equal(t, "", regs[1].LivePhantomPolicy())
+	require.Equal(t, 3, rm.CountRegistrations(phantom))
+	require.Equal(t, logOnly+1, metrics.PhantomBecameLive.Value(LivePhantomLogOnly))
+
+	require.Equal(t, 1, rm.PhantomBecameLive(regs[1], reason, LivePhantomReject, false))
+	require.Equal(t, 2, rm.CountRegistrations(phantom))
+
+	// With expiry the phantom is no longer served but for the registration
+	// connected to, whose connection goes on under the policy.
+	expired := metrics.PhantomBecameLiveExpired.Value()
+	secret := append([]byte(nil), regs[2].Keys.SharedSecret...)
+	require.Equal(t, 1, rm.PhantomBecameLive(regs[2], reason, LivePhantomLogOnly, true))
+	require.Equal(t, 1, rm.CountRegistrations(phantom))
+	require.Equal(t, 1, rm.CountRegistrations(other))
+	require.Equal(t, expired+1, metrics.PhantomBecameLiveExpired.Value())
+	require.Equal(t, LivePhantomLogOnly, regs[2].LivePhantomPolicy())
+	require.Equal(t, secret, regs[2].Keys.SharedSecret)
+	require.True(t, regs[2].HoldKeys())
+	regs[2].ReleaseKeys()
+
+	// Rejecting removes it as well.
+	require.Equal(t, 1, rm.PhantomBecameLive(regs[2], reason, LivePhantomReject, true))
+	require.Equal(t, 0, rm.CountRegistrations(phantom))
+
+	// Nothing is known live without a cache.
+	SetLivenessCache(0, 0, 0)
+	live, _ = PhantomKnownLive(phantom)
+	require.False(t, live)
+}
@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// ErrPhantomDrained is wrapped by the error of creating a registration whose
+// phantom is in a drained subnet, see PhantomDrain.
+var ErrPhantomDrained = errors.New("phantom subnet drained")
+
+// What was refused for a drained phantom subnet, the kind label of
+// metrics.PhantomDrainRejections.
+const (
+	phantomDrainRegistration = "registration"
+	phantomDrainConnection   = "connection"
+)
+
+// PhantomDrain is the set of phantom subnets the station has stopped serving,
+// e.g. during incident response for a subnet that has been burned. Only
+// subnets of the phantom subnet file (of any generation) can be drained. New
+// registrations with a phantom in a drained subnet are rejected and
+// connections to one are treated as matching no registration; existing
+// sessions are only closed when asked to. A nil PhantomDrain drains nothing.
+type PhantomDrain struct {
+	m sync.RWMutex
+	// the phantom subnets of every generation
+	subnets []*net.IPNet
+	// since when each drained subnet is, by subnet
+	drained map[string]time.Time
+	// clock drains are timed with, see RegistrationManager.SetClock
+	clock clock.Clock
+}
+
+// NewPhantomDrain returns the drain of the phantom subnets of selector, with
+// the subnets initial (e.g. drained_phantom_subnets) drained.
+func NewPhantomDrain(selector *PhantomIPSelector, initial []string) (*PhantomDrain, error) {
+	subnets, err := selector.allSubnets()
+	if err != nil {
+		return nil, err
+	}
+	p := &PhantomDrain{subnets: subnets, drained: make(map[string]time.Time), clock: clock.Real}
+	for _, subnet := range initial {
+		if _, err := p.Drain(subnet); err != nil {
+			return nil, fmt.Errorf("drained_phantom_subnets: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// phantomSubnet returns the phantom subnet s is, in canonical form.
+func (p *PhantomDrain) phantomSubnet(s string) (string, error) {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", fmt.Errorf("bad subnet %q: %v", s, err)
+	}
+	for _, phantoms := range p.subnets {
+		if phantoms.String() == subnet.String() {
+			return subnet.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a phantom subnet", subnet)
+}
+
+// Drain drains subnet, a phantom subnet, and returns whether it was not
+// already drained.
+func (p *PhantomDrain) Drain(subnet string) (bool, error) {
+	subnet, err := p.phantomSubnet(subnet)
+	if err != nil {
+		return false, err
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.drained[subnet]; ok {
+		return false, nil
+	}
+	p.drained[subnet] = p.clock.Now()
+	metrics.PhantomSubnetsDrained.Inc()
+	return true, nil
+}
+
+// Undrain serves subnet, a phantom subnet, again and returns whether it was
+// drained.
+func (p *PhantomDrain) Undrain(subnet string) (bool, error) {
+	subnet, err := p.phantomSubnet(subnet)
+	if err != nil {
+		return false, err
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.drained[subnet]; !ok {
+		return false, nil
+	}
+	delete(p.drained, subnet)
+	metrics.PhantomSubnetsDrained.Dec()
+	return true, nil
+}
+
+// Drained returns the drained phantom subnet containing ip, and whether there
+// is one. p may be nil.
+func (p *PhantomDrain) Drained(ip net.IP) (string, bool) {
+	if p == nil || ip == nil {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p.m.RLock()
+	defer p.m.RUnlock()
+	if len(p.drained) == 0 {
+		return "", false
+	}
+	for _, subnet := range p.subnets {
+		if _, ok := p.drained[subnet.String()]; ok && subnet.Contains(ip) {
+			return subnet.String(), true
+		}
+	}
+	return "", false
+}
+
+// RefuseConnection reports whether a connection to phantom must be refused
+// for its drained subnet, counting it if so. p may be nil.
+func (p *PhantomDrain) RefuseConnection(phantom net.IP) (string, bool) {
+	subnet, drained := p.Drained(phantom)
+	if drained {
+		metrics.PhantomDrainRejections.Inc(phantomDrainConnection)
+	}
+	return subnet, drained
+}
+
+// CloseSessions force-closes the tracked sessions to phantoms in subnet and
+// returns how many, they end with CloseDrained.
+func (p *PhantomDrain) CloseSessions(tracker *SessionTracker, subnet string) (int, error) {
+	subnet, err := p.phantomSubnet(subnet)
+	if err != nil {
+		return 0, err
+	}
+	_, ipNet, _ := net.ParseCIDR(subnet)
+	return tracker.CloseMatching(func(s *Session) bool { return s.Phantom != nil && ipNet.Contains(s.Phantom) }, CloseDrained), nil
+}
+
+type drainedSubnet struct {
+	Subnet string    `json:"subnet"`
+	Since  time.Time `json:"since"`
+}
+
+// Status lists the drained subnets.
+func (p *PhantomDrain) Status() interface{} {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	status := make([]drainedSubnet, 0, len(p.drained))
+	for subnet, since := range p.drained {
+		status = append(status, drainedSubnet{subnet, since})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Subnet < status[j].Subnet })
+	return status
+}
+
+// checkDrained rejects reg if its phantom is in a drained subnet, logging and
+// counting it.
+func (regManager *RegistrationManager) checkDrained(reg *DecoyRegistration) error {
+	subnet, drained := regManager.PhantomDrain.Drained(reg.DarkDecoy)
+	if !drained {
+		return nil
+	}
+	metrics.PhantomDrainRejections.Inc(phantomDrainRegistration)
+	if regManager.Logger != nil {
+		regManager.Logger.Debugf("registration %s rejected, phantom %s is in drained subnet %s", reg.IDString(), reg.DarkDecoy, subnet)
+	}
+	return fmt.Errorf("%w: %s", ErrPhantomDrained, subnet)
+}
+
+// HandleAdmin serves the drained subnets at /status/phantom_drain, drains a
+// subnet when POSTed /phantom_drain/drain?subnet=<cidr>, closing its sessions
+// too with &terminate=true, and serves one again when POSTed
+// /phantom_drain/undrain?subnet=<cidr>.
+func (p *PhantomDrain) HandleAdmin(logger *Logger) {
+	Admin().HandleStatus("phantom_drain", p.Status)
+	Admin().Handle("/phantom_drain/drain", phantomDrainAction{p, false, logger})
+	Admin().Handle("/phantom_drain/undrain", phantomDrainAction{p, true, logger})
+}
+
+// phantomDrainAction is the management endpoint draining a phantom subnet, or
+// serving it again. The reply gives whether that changed anything and the
+// number of sessions closed.
+type phantomDrainAction struct {
+	drain   *PhantomDrain
+	undrain bool
+	logger  *Logger
+}
+
+func (a phantomDrainAction) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	subnet := r.URL.Query().Get("subnet")
+	if subnet == "" {
+		http.Error(w, "missing subnet", http.StatusBadRequest)
+		return
+	}
+	var terminate bool
+	if t := r.URL.Query().Get("terminate"); t != "" {
+		var err error
+		if terminate, err = strconv.ParseBool(t); err != nil || (terminate && a.undrain) {
+			http.Error(w, "bad terminate", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var changed bool
+	var err error
+	if a.undrain {
+		changed, err = a.drain.Undrain(subnet)
+	} else {
+		changed, err = a.drain.Drain(subnet)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	closed := 0
+	if terminate {
+		closed, _ = a.drain.CloseSessions(Sessions(), subnet)
+	}
+	if a.undrain {
+		a.logger.Infof("phantom subnet %s no longer drained", subnet)
+	} else {
+		a.logger.Infof("phantom subnet %s drained, %d sessions closed", subnet, closed)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Subnet  string `json:"subnet"`
+		Changed bool   `json:"changed"`
+		Closed  int    `json:"closed"`
+	}{subnet, changed, closed})
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+// drainTestSelector has generation 1 phantoms in 192.0.2.0/24 and generation
+// 2 ones in 198.51.100.0/24 and 203.0.113.0/24.
+func drainTestSelector() *PhantomIPSelector {
+	return &PhantomIPSelector{Networks: map[uint]*SubnetConfig{
+		1: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24"}}}},
+		2: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"198.51.100.0/24", "203.0.113.0/24"}}}},
+	}}
+}
+
+func TestPhantomDrain(t *testing.T) {
+	selector := drainTestSelector()
+	_, err := NewPhantomDrain(selector, []string{"10.0.0.0/8"})
+	require.NotNil(t, err)
+	drain, err := NewPhantomDrain(selector, []string{"192.0.2.7/24"})
+	require.Nil(t, err)
+
+	rm := &RegistrationManager{PhantomSelector: selector, PhantomDrain: drain, registeredDecoys: NewRegisteredDecoys()}
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	rm.SetClock(clk)
+	c2s, keys := mockReceiveFromDetector()
+	source := pb.RegistrationSource_Detector
+	gen1, gen2 := uint32(1), uint32(2)
+
+	// Registrations with a phantom in the drained subnet are rejected,
+	// others proceed.
+	rejected := metrics.PhantomDrainRejections.Value(phantomDrainRegistration)
+	c2s.DecoyListGeneration = &gen1
+	_, err = rm.NewRegistration(&c2s, &keys, false, &source)
+	require.True(t, errors.Is(err, ErrPhantomDrained))
+	require.Equal(t, rejected+1, metrics.PhantomDrainRejections.Value(phantomDrainRegistration))
+
+	c2s.DecoyListGeneration = &gen2
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &source)
+	require.Nil(t, err)
+	_, drained := drain.Drained(reg.DarkDecoy)
+	require.False(t, drained)
+	require.Equal(t, clk.Now(), reg.RegistrationTime)
+
+	// So are connections.
+	refused := metrics.PhantomDrainRejections.Value(phantomDrainConnection)
+	subnet, drained := drain.RefuseConnection(net.ParseIP("::ffff:192.0.2.9"))
+	require.True(t, drained)
+	require.Equal(t, "192.0.2.0/24", subnet)
+	_, drained = drain.RefuseConnection(net.ParseIP("198.51.100.9"))
+	require.False(t, drained)
+	require.Equal(t, refused+1, metrics.PhantomDrainRejections.Value(phantomDrainConnection))
+
+	changed, err := drain.Undrain("192.0.2.0/24")
+	require.Nil(t, err)
+	require.True(t, changed)
+	c2s.DecoyListGeneration = &gen1
+	_, err = rm.NewRegistration(&c2s, &keys, false, &source)
+	require.Nil(t, err)
+
+	// Drains are timed with the manager's clock.
+	clk.Advance(time.Minute)
+	_, err = drain.Drain("203.0.113.0/24")
+	require.Nil(t, err)
+	require.Equal(t, []drainedSubnet{{"203.0.113.0/24", clk.Now()}}, drain.Status())
+
+	_, drained = (*PhantomDrain)(nil).Drained(net.ParseIP("192.0.2.9"))
+	require.False(t, drained)
+}
+
+func TestPhantomDrainEndpoint(t *testing.T) {
+	drain, err := NewPhantomDrain(drainTestSelector(), nil)
+	require.Nil(t, err)
+	logger := &Logger{log.New(ioutil.Discard, "", 0)}
+	drainAction := phantomDrainAction{drain, false, logger}
+	undrainAction := phantomDrainAction{drain, true, logger}
+
+	// A session to a phantom in the subnet drained and one to another.
+	var sessions []*Session
+	for _, phantom := range []string{"203.0.113.1", "198.51.100.1"} {
+		client, station := tcpPair(t)
+		defer client.Close()
+		s := Sessions().Add(&DecoyRegistration{DarkDecoy: net.ParseIP(phantom), Keys: &ConjureSharedKeys{}}, station, nil)
+		defer Sessions().Remove(s)
+		sessions = append(sessions, s)
+	}
+
+	for _, c := range []struct {
+		action         phantomDrainAction
+		method, target string
+		code           int
+		changed        bool
+		closed         int
+	}{
+		{drainAction, http.MethodGet, "/phantom_drain/drain?subnet=203.0.113.0/24", http.StatusMethodNotAllowed, false, 0},
+		{drainAction, http.MethodPost, "/phantom_drain/drain", http.StatusBadRequest, false, 0},
+		{drainAction, http.MethodPost, "/phantom_drain/drain?subnet=203.0.113.0/25", http.StatusNotFound, false, 0},
+		{drainAction, http.MethodPost, "/phantom_drain/drain?subnet=203.0.113.0/24&terminate=maybe", http.StatusBadRequest, false, 0},
+		{drainAction, http.MethodPost, "/phantom_drain/drain?subnet=203.0.113.0/24", http.StatusOK, true, 0},
+		{drainAction, http.MethodPost, "/phantom_drain/drain?subnet=203.0.113.0/24&terminate=true", http.StatusOK, false, 1},
+		{undrainAction, http.MethodPost, "/phantom_drain/undrain?subnet=203.0.113.0/24", http.StatusOK, true, 0},
+		{undrainAction, http.MethodPost, "/phantom_drain/undrain?subnet=203.0.113.0/24", http.StatusOK, false, 0},
+	} {
+		w := httptest.NewRecorder()
+		c.action.ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		require.Equal(t, c.code, w.Code, c.target)
+		if c.code == http.StatusOK {
+			var reply struct {
+				Subnet  string
+				Changed bool
+				Closed  int
+			}
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+			require.Equal(t, "203.0.113.0/24", reply.Subnet)
+			require.Equal(t, c.changed, reply.Changed, c.target)
+			require.Equal(t, c.closed, reply.Closed, c.target)
+		}
+	}
+	require.Equal(t, CloseDrained, sessions[0].CloseReason())
+	require.Equal(t, CloseReason(""), sessions[1].CloseReason())
+	require.Empty(t, drain.Status())
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// phantomPortLabel is the SeededRand label of phantom port derivation.
+const phantomPortLabel = "phantom-port"
+
+// DefaultPhantomPort is the port clients connect to phantoms on when their
+// transport derives none.
+const DefaultPhantomPort = 443
+
+// What was done with connections to a phantom port other than the one their
+// registration derived, the label of metrics.PhantomPortMismatches.
+const (
+	phantomPortRejected = "rejected"
+	phantomPortWarned   = "warned"
+)
+
+// PortRange is an inclusive range of phantom ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (r PortRange) size() uint64 {
+	return uint64(r.Max) - uint64(r.Min) + 1
+}
+
+// parsePortRange parses a port ("443") or an inclusive range of ports
+// ("1024-65535").
+func parsePortRange(s string) (PortRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil || min == 0 {
+		return PortRange{}, fmt.Errorf("bad port range %q", s)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil || max < min {
+		return PortRange{}, fmt.Errorf("bad port range %q", s)
+	}
+	return PortRange{uint16(min), uint16(max)}, nil
+}
+
+// parseTransportName returns the transport named name, case insensitively:
+// null, min, obfs4, mux or prefix.
+func parseTransportName(name string) (pb.TransportType, error) {
+	if strings.EqualFold(name, "mux") {
+		return TransportTypeMux, nil
+	}
+	if strings.EqualFold(name, "prefix") {
+		return TransportTypePrefix, nil
+	}
+	for n, t := range pb.TransportType_value {
+		if strings.EqualFold(name, n) {
+			return pb.TransportType(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown transport %q", name)
+}
+
+// parsePhantomPorts parses the Ports of a phantom subnet file, lists of port
+// ranges keyed by transport name.
+func parsePhantomPorts(ports map[string][]string) (map[pb.TransportType][]PortRange, error) {
+	parsed := make(map[pb.TransportType][]PortRange)
+	for name, ranges := range ports {
+		t, err := parseTransportName(name)
+		if err != nil {
+			return nil, fmt.Errorf("Ports: %v", err)
+		}
+		for _, s := range ranges {
+			r, err := parsePortRange(s)
+			if err != nil {
+				return nil, fmt.Errorf("Ports.%s: %v", name, err)
+			}
+			parsed[t] = append(parsed[t], r)
+		}
+	}
+	return parsed, nil
+}
+
+// SelectPort derives the phantom port clients of registrations with seed and
+// transport connect to, or returns 0 if the transport has no port ranges (its
+// clients connect to any port, in practice 443). The port is picked
+// uniformly from all the ports of the transport's ranges, in the order the
+// ranges were given, with UintN of the SeededRand of seed labeled
+// "phantom-port"; clients must derive it the same way, see
+// TestPhantomPortVectors.
+func (p *PhantomIPSelector) SelectPort(seed []byte, transport pb.TransportType) uint16 {
+	if p == nil {
+		return 0
+	}
+	ranges := p.Ports[transport]
+	var total uint64
+	for _, r := range ranges {
+		total += r.size()
+	}
+	if total == 0 {
+		return 0
+	}
+	n := NewSeededRand(seed, phantomPortLabel).UintN(total)
+	for _, r := range ranges {
+		if n < r.size() {
+			return uint16(uint64(r.Min) + n)
+		}
+		n -= r.size()
+	}
+	// unreachable
+	return 0
+}
+
+// DstPort returns the port clients of reg connect to its phantom on: the
+// port it derived, DefaultPhantomPort if it derived none.
+func (reg *DecoyRegistration) DstPort() uint16 {
+	if reg.PhantomPort == 0 {
+		return DefaultPhantomPort
+	}
+	return reg.PhantomPort
+}
+
+// CheckPhantomPort verifies that port, the phantom port of a connection for
+// reg, is the port reg derived if it derived one. A mismatch is counted in
+// metrics.PhantomPortMismatches and returned as an error; the connection is
+// allowed anyway with PhantomPortWarnOnly.
+func (c *Config) CheckPhantomPort(reg *DecoyRegistration, port int) (allowed bool, err error) {
+	if reg.PhantomPort == 0 || int(reg.PhantomPort) == port {
+		return true, nil
+	}
+	err = fmt.Errorf("connection to phantom port %d, registration derived %d", port, reg.PhantomPort)
+	if c != nil && c.PhantomPortWarnOnly {
+		metrics.PhantomPortMismatches.Inc(phantomPortWarned)
+		return true, err
+	}
+	metrics.PhantomPortMismatches.Inc(phantomPortRejected)
+	return false, err
+}
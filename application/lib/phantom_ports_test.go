@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+// Clients deriving phantom ports must reproduce these. The gotapdance client
+// does not derive phantom ports yet, so there is no client implementation
+// outside this tree to take them from: they pin the station's derivation
+// (which the client registration helper shares) and are to be checked
+// against the gotapdance client once it derives ports.
+func TestPhantomPortVectors(t *testing.T) {
+	p := &PhantomIPSelector{Ports: map[pb.TransportType][]PortRange{
+		pb.TransportType_Min:   {{1024, 65535}},
+		pb.TransportType_Obfs4: {{443, 443}, {8443, 8443}, {10000, 10099}},
+		TransportTypeMux:       {{443, 443}},
+	}}
+	vectors := []struct {
+		seed            string
+		min, obfs4, mux uint16
+	}{
+		{"5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f", 4551, 10063, 443},
+		{"00000000000000000000000000000000", 2783, 10029, 443},
+		{"ffffffffffffffffffffffffffffffff", 63414, 10012, 443},
+	}
+	for _, v := range vectors {
+		seed, err := hex.DecodeString(v.seed)
+		require.Nil(t, err)
+		require.Equal(t, v.min, p.SelectPort(seed, pb.TransportType_Min), v.seed)
+		require.Equal(t, v.obfs4, p.SelectPort(seed, pb.TransportType_Obfs4), v.seed)
+		require.Equal(t, v.mux, p.SelectPort(seed, TransportTypeMux), v.seed)
+		require.Equal(t, uint16(0), p.SelectPort(seed, pb.TransportType_Null), v.seed)
+	}
+}
+
+func TestPhantomPortsParse(t *testing.T) {
+	write := func(ports string) string {
+		path := filepath.Join(t.TempDir(), "phantom_subnets.toml")
+		subnets := "[Networks]\n[Networks.1]\nGeneration = 1\n[[Networks.1.WeightedSubnets]]\nWeight = 1\nSubnets = [\"192.0.2.0/24\"]\n"
+		require.Nil(t, ioutil.WriteFile(path, []byte(ports+"\n"+subnets), 0600))
+		return path
+	}
+
+	p, err := SubnetsFromTomlFile(write("[Ports]\nmin = [\"1024-65535\"]\nMux = [\"443\", \" 8000 - 8099 \"]"))
+	require.Nil(t, err)
+	require.Equal(t, map[pb.TransportType][]PortRange{
+		pb.TransportType_Min: {{1024, 65535}},
+		TransportTypeMux:     {{443, 443}, {8000, 8099}},
+	}, p.Ports)
+
+	// No ranges derive no ports.
+	p, err = SubnetsFromTomlFile(write(""))
+	require.Nil(t, err)
+	require.Empty(t, p.Ports)
+	require.Equal(t, uint16(0), p.SelectPort([]byte("seed"), pb.TransportType_Min))
+
+	for _, bad := range []string{`min = ["0"]`, `min = ["2000-1000"]`, `min = ["70000"]`, `min = ["http"]`, `tcp = ["443"]`} {
+		_, err := SubnetsFromTomlFile(write("[Ports]\n" + bad))
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestCheckPhantomPort(t *testing.T) {
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), PhantomPort: 4551}
+	rejected := metrics.PhantomPortMismatches.Value(phantomPortRejected)
+	warned := metrics.PhantomPortMismatches.Value(phantomPortWarned)
+
+	conf := &Config{}
+	allowed, err := conf.CheckPhantomPort(reg, 4551)
+	require.True(t, allowed)
+	require.Nil(t, err)
+	allowed, err = conf.CheckPhantomPort(reg, 443)
+	require.False(t, allowed)
+	require.NotNil(t, err)
+	require.Equal(t, rejected+1, metrics.PhantomPortMismatches.Value(phantomPortRejected))
+
+	conf.PhantomPortWarnOnly = true
+	allowed, err = conf.CheckPhantomPort(reg, 443)
+	require.True(t, allowed)
+	require.NotNil(t, err)
+	require.Equal(t, warned+1, metrics.PhantomPortMismatches.Value(phantomPortWarned))
+
+	// Registrations without a derived port match any port.
+	allowed, err = (&Config{}).CheckPhantomPort(&DecoyRegistration{}, 8443)
+	require.True(t, allowed)
+	require.Nil(t, err)
+}
@@ -1,42 +1,30 @@
 package lib
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
-	"math/rand"
 	"net"
-
-	wr "github.com/mroth/weightedrand"
 )
 
 // getSubnets - return EITHER all subnet strings as one composite array if we are
 //		selecting unweighted, or return the array associated with the (seed) selected
 //		array of subnet strings based on the associated weights
-func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) []string {
+func (sc *SubnetConfig) getSubnets(src seededSource, weighted bool) []string {
 
 	var out []string = []string{}
 
 	if weighted {
-		// seed random with hkdf derived seed provided by client
-		seedInt, err := binary.ReadVarint(bytes.NewBuffer(seed))
-		if err != nil {
-			return nil
-		}
-		rand.Seed(seedInt)
-
-		choices := make([]wr.Choice, 0, len(sc.WeightedSubnets))
+		weights := make([]uint, 0, len(sc.WeightedSubnets))
 		for _, cjSubnet := range sc.WeightedSubnets {
-			choices = append(choices, wr.Choice{Item: cjSubnet.Subnets, Weight: uint(cjSubnet.Weight)})
+			weights = append(weights, uint(cjSubnet.Weight))
 		}
-		c, err := wr.NewChooser(choices...)
-		if err != nil {
+		i := src.PickWeighted(weights)
+		if i < 0 {
 			return out
 		}
 
-		out = c.Pick().([]string)
+		out = sc.WeightedSubnets[i].Subnets
 	} else {
 
 		// Use unweighted config for subnets, concat all into one array and return.
@@ -105,6 +93,31 @@ func parseSubnets(phantomSubnets []string) ([]*net.IPNet, error) {
 	// return nil, fmt.Errorf("parseSubnets not implemented yet")
 }
 
+// allSubnets returns the phantom subnets of every generation, each once. The
+// selector may be nil.
+func (p *PhantomIPSelector) allSubnets() ([]*net.IPNet, error) {
+	if p == nil {
+		return nil, nil
+	}
+	var all []*net.IPNet
+	seen := make(map[string]bool)
+	for generation, conf := range p.Networks {
+		for _, weighted := range conf.WeightedSubnets {
+			subnets, err := parseSubnets(weighted.Subnets)
+			if err != nil {
+				return nil, fmt.Errorf("bad phantom subnets of generation %d: %v", generation, err)
+			}
+			for _, subnet := range subnets {
+				if !seen[subnet.String()] {
+					seen[subnet.String()] = true
+					all = append(all, subnet)
+				}
+			}
+		}
+	}
+	return all, nil
+}
+
 // NewPhantomIPSelector - create object currently populated with a static map of generation number
 //		to SubnetConfig, but this may be loaded dynamically in the future.
 func NewPhantomIPSelector() (*PhantomIPSelector, error) {
@@ -125,7 +138,13 @@ func (p *PhantomIPSelector) Select(seed []byte, generation uint, v6Support bool)
 		return nil, fmt.Errorf("generation number not recognized")
 	}
 
-	genSubnetStrings := genConfig.getSubnets(seed, true)
+	// The client seeds a fresh stream for picking the subnet list and for
+	// picking the address within the chosen subnet.
+	subnetRand, err := newLegacyPhantomRand(seed)
+	if err != nil {
+		return nil, err
+	}
+	genSubnetStrings := genConfig.getSubnets(subnetRand, true)
 
 	genSubnets, err := parseSubnets(genSubnetStrings)
 	if err != nil {
@@ -197,6 +216,14 @@ func (p *PhantomIPSelector) Select(seed []byte, generation uint, v6Support bool)
 //		already specified by the CIDR block. Tde masked random value is then
 //		added to the cidr block base giving the final randomly selected address.
 func SelectAddrFromSubnet(seed []byte, net1 *net.IPNet) (net.IP, error) {
+	src, err := newLegacyPhantomRand(seed)
+	if err != nil {
+		return nil, err
+	}
+	return selectAddrFromSubnet(src, net1)
+}
+
+func selectAddrFromSubnet(src seededSource, net1 *net.IPNet) (net.IP, error) {
 	bits, addrLen := net1.Mask.Size()
 
 	ipBigInt := &big.Int{}
@@ -206,14 +233,8 @@ func SelectAddrFromSubnet(seed []byte, net1 *net.IPNet) (net.IP, error) {
 		ipBigInt.SetBytes(net1.IP.To16())
 	}
 
-	seedInt, err := binary.ReadVarint(bytes.NewBuffer(seed))
-	if err != nil {
-		return nil, err
-	}
-
-	rand.Seed(seedInt)
 	randBytes := make([]byte, addrLen/8)
-	_, err = rand.Read(randBytes)
+	_, err := src.Read(randBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	toml "github.com/pelletier/go-toml"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
 )
 
 // ConjurePhantomSubnet - Weighted option to choose phantom address from.
@@ -22,12 +23,17 @@ type SubnetConfig struct {
 // PhantomIPSelector - Object for tracking current generation to SubnetConfig Mapping.
 type PhantomIPSelector struct {
 	Networks map[uint]*SubnetConfig
+
+	// Ports are the ranges phantom ports are derived from for registrations
+	// of each transport, see SelectPort.
+	Ports map[pb.TransportType][]PortRange
 }
 
 // type shim because github.com/pelletier/go-toml doesn't allow for integer value keys to maps so
 // we have to parse them ourselves. :(
 type phantomIPSelectorInternal struct {
 	Networks map[string]*SubnetConfig
+	Ports    map[string][]string
 }
 
 // GetPhantomSubnetSelector gets the location of the configuration file from an
@@ -64,5 +70,10 @@ func SubnetsFromTomlFile(path string) (*PhantomIPSelector, error) {
 		pss.AddGeneration(g, set)
 	}
 
+	pss.Ports, err = parsePhantomPorts(phantomSelectorSet.Ports)
+	if err != nil {
+		return nil, err
+	}
+
 	return pss, nil
 }
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// TransportTypePrefix identifies the prefix transport in registrations. The
+// generated protobuf bindings predate it, see proto/signalling.proto.
+const TransportTypePrefix pb.TransportType = 4
+
+// What is done with connections that start with a prefix of the prefix
+// transport but carry no registered tag, see PrefixTransportConfig.OnFailure.
+const (
+	PrefixFailureClose = "close"
+	PrefixFailureMask  = "mask"
+)
+
+// PrefixTransportConfig configures the prefix transport, the [prefix_transport]
+// section of the config. Its clients start their connections with one of
+// Prefixes, plaintext that makes them look like another protocol to
+// observers, followed by the connection tag of min; the rest is proxied as
+// for min.
+type PrefixTransportConfig struct {
+	// Plaintext prefixes clients may start their connections with, e.g.
+	// "GET / HTTP/1.1\r\n". Empty disables the transport.
+	Prefixes []string `toml:"prefixes"`
+
+	// What is done with connections that start with one of Prefixes but
+	// whose tag matches no registration: "close" (the default, they are
+	// read until the handshake deadline and closed as in [client_tcp], like
+	// any connection no transport recognized) or "mask" (forwarded to Mask
+	// with the bytes already read replayed, as soon as the tag is read).
+	OnFailure string `toml:"on_failure"`
+
+	// Address ("host:port", port 443 if omitted) unregistered connections
+	// are forwarded to with OnFailure "mask".
+	Mask string `toml:"mask"`
+}
+
+func (c *PrefixTransportConfig) parse() error {
+	for _, p := range c.Prefixes {
+		if p == "" {
+			return fmt.Errorf("prefix_transport prefixes must not be empty strings")
+		}
+	}
+	switch c.OnFailure {
+	case "":
+		c.OnFailure = PrefixFailureClose
+	case PrefixFailureClose:
+	case PrefixFailureMask:
+		if c.Mask == "" {
+			return fmt.Errorf("prefix_transport on_failure %q requires a mask", c.OnFailure)
+		}
+		if _, _, err := net.SplitHostPort(c.Mask); err != nil {
+			c.Mask = net.JoinHostPort(c.Mask, "443")
+		}
+	default:
+		return fmt.Errorf("unknown prefix_transport on_failure %q", c.OnFailure)
+	}
+	return nil
+}
+
+// FailureMask returns the address connections for no registration are
+// forwarded to, empty if they are closed instead.
+func (c *PrefixTransportConfig) FailureMask() string {
+	if c.OnFailure != PrefixFailureMask {
+		return ""
+	}
+	return c.Mask
+}
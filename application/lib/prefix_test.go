@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixTransportConfig(t *testing.T) {
+	c := &PrefixTransportConfig{Prefixes: []string{"GET / HTTP/1.1\r\n"}}
+	require.Nil(t, c.parse())
+	require.Equal(t, PrefixFailureClose, c.OnFailure)
+	require.Equal(t, "", c.FailureMask())
+
+	c = &PrefixTransportConfig{OnFailure: PrefixFailureMask, Mask: "example.com"}
+	require.Nil(t, c.parse())
+	require.Equal(t, "example.com:443", c.FailureMask())
+
+	for _, bad := range []*PrefixTransportConfig{
+		{Prefixes: []string{""}},
+		{OnFailure: PrefixFailureMask},
+		{OnFailure: "drop"},
+	} {
+		require.NotNil(t, bad.parse(), bad)
+	}
+}
+
+// Unregistered connections forwarded to the mask get the bytes already read
+// first.
+func TestMaskForwardUnregistered(t *testing.T) {
+	mask, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer mask.Close()
+	go serveEcho(mask)
+
+	client, stationClient := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		MaskForwardUnregistered(mask.Addr().String(), stationClient, []byte("GET / HTTP/1.1\r\n"), &Logger{log.New(ioutil.Discard, "", 0)})
+		stationClient.Close()
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(client, "Host: example.com\r\n")
+	require.Nil(t, err)
+	echoed := make([]byte, len("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	_, err = io.ReadFull(client, echoed)
+	require.Nil(t, err)
+	require.Equal(t, "GET / HTTP/1.1\r\nHost: example.com\r\n", string(echoed))
+	client.Close()
+	<-done
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"bufio"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -13,8 +14,11 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
 	tls "github.com/refraction-networking/utls"
 )
 
@@ -51,6 +55,291 @@ const (
 
 var bufferPool = sync.Pool{New: createBuffer}
 
+// ProxyConfig - Configuration options relevant to proxying sessions to their
+// covert address
+type ProxyConfig struct {
+	// Name of the CovertTransport applied to the covert leg of each session.
+	CovertTransport string `toml:"covert_transport"`
+	covertTransport CovertTransport
+
+	// Log covert addresses with the host redacted, keeping only the port.
+	RedactCovert bool `toml:"redact_covert"`
+
+	// IP family used to reach coverts: "auto" (any resolved address), "v4" or
+	// "v6". CovertFamilies overrides it for individual covert hosts.
+	CovertFamily   string            `toml:"covert_family"`
+	CovertFamilies map[string]string `toml:"covert_families"`
+
+	// Milliseconds to wait for a TCP connection to a covert address before
+	// trying the next one (or failing). Zero waits as long as the OS does.
+	CovertConnectTimeout int `toml:"covert_connect_timeout"`
+
+	// Milliseconds an established covert connection may go without a read
+	// (or write) making progress before the session is closed. Zero disables
+	// the timeout.
+	CovertReadTimeout  int `toml:"covert_read_timeout"`
+	CovertWriteTimeout int `toml:"covert_write_timeout"`
+
+	// Server covert host names are resolved with instead of the system
+	// resolver: a DoH URL ("https://host/dns-query") or a DoT server
+	// ("tls://host[:port]"). Empty uses the system resolver. With
+	// CovertResolverFallback names the server fails to resolve are looked up
+	// with the system resolver. CovertResolverTimeout is in milliseconds,
+	// zero uses the default of 2000.
+	CovertResolver         string `toml:"covert_resolver"`
+	CovertResolverFallback bool   `toml:"covert_resolver_fallback"`
+	CovertResolverTimeout  int    `toml:"covert_resolver_timeout"`
+
+	// Seconds covert host name results are cached for at most, records with
+	// a shorter TTL expire sooner. Zero disables caching.
+	CovertDNSCacheTTL int `toml:"covert_dns_cache_ttl"`
+	covertResolver    *CovertResolver
+
+	// Bytes per second each session may move to and from its covert, both
+	// directions combined. Zero is unlimited. SessionRateLimitBuckets
+	// overrides it for registrations in the given experiment buckets, where
+	// a negative rate is unlimited. A registration's own override, see
+	// RegistrationManager.SetSessionRateLimit, comes before both.
+	SessionRateLimit        int64            `toml:"session_rate_limit"`
+	SessionRateLimitBuckets map[string]int64 `toml:"session_rate_limit_buckets"`
+	sessionRateLimitBuckets map[int]int64
+
+	// Only proxy to coverts on port 443 that complete a TLS handshake with a
+	// certificate valid for the covert host, for clients that start one.
+	// Registrations for other ports are rejected, sessions failing either
+	// handshake check are closed before anything is proxied.
+	CovertStrictTLS bool           `toml:"covert_strict_tls"`
+	strictTLSRoots  *x509.CertPool // nil uses the system roots
+
+	// Coverts (host:port, as registrations give them) the station speaks TLS
+	// to itself, with the SNI, ALPN and pins of their [covert_tls."host:port"]
+	// table: sessions for them are proxied over the station's TLS connection,
+	// their clients tunnel plaintext. Does not combine with CovertStrictTLS.
+	CovertTLS      map[string]*CovertTLSConfig `toml:"covert_tls"`
+	covertTLSRoots *x509.CertPool              // nil uses the system roots
+
+	// Preambles written to coverts matching the keys of the
+	// [covert_preamble."pattern"] tables (a host:port or a glob of them)
+	// before the client's data, and the replies expected of them.
+	CovertPreamble         map[string]*CovertPreambleConfig `toml:"covert_preamble"`
+	covertPreamblePatterns []string                         // sorted
+
+	// Coverts (host:port, as registrations give them) to keep
+	// CovertPrewarmIdle idle connections open to, zero uses the default of
+	// 2, so that sessions for them skip the connect. Idle connections are
+	// replaced after CovertPrewarmMaxIdle seconds, zero uses the default of
+	// 30. Coverts failing several dials in a row are not pre-warmed for a
+	// while.
+	CovertPrewarm        []string `toml:"covert_prewarm"`
+	CovertPrewarmIdle    int      `toml:"covert_prewarm_idle"`
+	CovertPrewarmMaxIdle int      `toml:"covert_prewarm_max_idle"`
+	covertPool           *CovertPool
+
+	// Bytes the client must send towards the covert before it is dialed, or
+	// with CovertMinClientRecord a complete TLS record of any size, within
+	// CovertMinClientTimeout milliseconds (zero uses the default of 10000).
+	// Sessions falling short are closed as probable scans. Zero bytes and no
+	// record dials at once.
+	CovertMinClientBytes   int  `toml:"covert_min_client_bytes"`
+	CovertMinClientRecord  bool `toml:"covert_min_client_record"`
+	CovertMinClientTimeout int  `toml:"covert_min_client_timeout"`
+
+	// Coverts (host:port, as registrations give them) whose connections are
+	// kept after a session the client ended cleanly and handed to the next
+	// session of the same registration, for clients polling a covert with
+	// many short sessions. Only for coverts without per-connection state
+	// (e.g. plaintext HTTP keep-alive), and never with a covert transport,
+	// the PROXY header, a covert preamble or CovertStrictTLS. Up to CovertReuseIdle connections
+	// (zero uses the default of 2) per covert and registration are kept for
+	// CovertReuseMaxIdle seconds (zero uses the default of 10). Once the
+	// client ended its half, the covert's response is relayed until the
+	// covert is quiet for CovertReuseDrain milliseconds (zero uses the
+	// default of 500).
+	CovertReuse        []string `toml:"covert_reuse"`
+	CovertReuseIdle    int      `toml:"covert_reuse_idle"`
+	CovertReuseMaxIdle int      `toml:"covert_reuse_max_idle"`
+	CovertReuseDrain   int      `toml:"covert_reuse_drain"`
+	covertReuse        *CovertReusePool
+
+	// Streams a client may have open at once in a mux session (zero uses the
+	// default of 16) and open over the whole session (zero is unlimited).
+	// Streams opened past either limit are reset.
+	MuxMaxStreams      int `toml:"mux_max_streams"`
+	MuxMaxStreamsTotal int `toml:"mux_max_streams_total"`
+
+	// Covert dials in flight at once for the sessions of a single client IP,
+	// zero is unlimited. Sessions past the limit are closed without dialing.
+	CovertDialsPerIP  int `toml:"covert_dials_per_ip"`
+	covertDialLimiter *covertDialLimiter
+
+	// Seconds after startup over which the covert dials allowed in flight at
+	// once ramp up linearly from CovertWarmupInitial (zero uses the default
+	// of 4) to CovertWarmupMax (zero uses the default of 256), rather than
+	// every session and pre-warmed connection dialing at once. Dials past the
+	// limit wait for a slot, those of sessions until their dial deadline.
+	// Zero disables the warm-up.
+	CovertWarmup        int `toml:"covert_warmup"`
+	CovertWarmupInitial int `toml:"covert_warmup_initial"`
+	CovertWarmupMax     int `toml:"covert_warmup_max"`
+	covertWarmup        *covertWarmup
+
+	// Fallback coverts (host:port) tried in order, for registrations whose
+	// covert is a key of the [covert_fallbacks] table, when dialing their
+	// covert fails with a lookup, connect or loop error (or a failed TLS
+	// handshake of the station's own). Fallbacks are subject to the covert
+	// blocklists and CovertStrictTLS like the covert. All attempts of a
+	// session's dial together are bounded by CovertDialDeadline
+	// milliseconds, zero uses the default of 15000, each connect is cut short
+	// to what is left of it.
+	CovertFallbacks    map[string][]string `toml:"covert_fallbacks"`
+	CovertDialDeadline int                 `toml:"covert_dial_deadline"`
+
+	// Addresses the station's listeners are reachable on other than those of
+	// its interfaces (e.g. public addresses behind NAT or a load balancer),
+	// "ip" (at every listen port) or "ip:port". Coverts resolving to any
+	// listener address, into the phantom subnets or to any other address of
+	// the host are never dialed, see ErrCovertLoop.
+	CovertSelfAddrs []string `toml:"covert_self_addrs"`
+	covertSelf      *covertSelfAddrs
+	covertPhantoms  []*net.IPNet // see SetPhantomSubnets
+
+	// Don't time the first byte a session reads from its covert, which wraps
+	// every covert connection, the other stages of session setup are timed
+	// all the same (see SessionTiming).
+	DisableFirstByteTiming bool `toml:"disable_first_byte_timing"`
+
+	// Milliseconds a session of a registration using session resumption
+	// keeps its covert connection open after losing its client connection,
+	// waiting for the client to resume it, zero uses the default of 10000.
+	SessionResumeGrace int `toml:"session_resume_grace"`
+
+	// Bytes a session may relay from its covert to the client, after which
+	// the session is closed, so that a misbehaving covert cannot be used to
+	// amplify traffic. Zero is unlimited. CovertMaxResponseBytesCoverts
+	// overrides it for the coverts matching its keys, a host:port or a glob
+	// of them matched as for CovertPreamble, each key being a category of
+	// coverts; a negative cap there is unlimited.
+	CovertMaxResponseBytes        int64            `toml:"covert_max_response_bytes"`
+	CovertMaxResponseBytesCoverts map[string]int64 `toml:"covert_max_response_bytes_coverts"`
+	covertResponseLimitPatterns   []string         // sorted
+
+	// Test only, for load testing without real coverts: every covert dial
+	// goes to a covert the station runs itself on CovertEchoAddr, a loopback
+	// address (the default of 127.0.0.1:0 picks a free port), that writes
+	// back ("echo") or discards ("sink") what it is sent. Covert TLS,
+	// preambles and PROXY headers are skipped for it, and the bytes proxied
+	// to it are only counted in metrics.CovertEchoBytes. Empty disables it.
+	// See Config.StartCovertEcho.
+	CovertEcho     string `toml:"covert_echo"`
+	CovertEchoAddr string `toml:"covert_echo_addr"`
+	covertEcho     *covertEchoServer
+
+	// clock session setup and covert deadlines are measured with,
+	// clock.Real if nil.
+	clock clock.Clock
+}
+
+func (c *ProxyConfig) getClock() clock.Clock {
+	if c == nil || c.clock == nil {
+		return clock.Real
+	}
+	return c.clock
+}
+
+// Now returns the time on the clock sessions are set up and covert deadlines
+// measured with, for the stages of SessionTiming timed by the caller.
+func (c *ProxyConfig) Now() time.Time {
+	return c.getClock().Now()
+}
+
+func (c *ProxyConfig) parseCovertResolver() error {
+	if c.CovertResolver == "" && c.CovertDNSCacheTTL <= 0 {
+		return nil
+	}
+	r, err := NewCovertResolver(c.CovertResolver, c.CovertResolverFallback,
+		time.Duration(c.CovertResolverTimeout)*time.Millisecond, time.Duration(c.CovertDNSCacheTTL)*time.Second)
+	if err != nil {
+		return err
+	}
+	c.covertResolver = r
+	return nil
+}
+
+// covertLookupHost returns the function covert host names are resolved with.
+func (c *ProxyConfig) covertLookupHost() lookupHostFunc {
+	if c == nil || c.covertResolver == nil {
+		return defaultLookupHost
+	}
+	return c.covertResolver.LookupHost
+}
+
+func (c *ProxyConfig) parseCovertFamilies() error {
+	var err error
+	if c.CovertFamily, err = parseCovertFamily(c.CovertFamily); err != nil {
+		return err
+	}
+	for host, family := range c.CovertFamilies {
+		if c.CovertFamilies[host], err = parseCovertFamily(family); err != nil {
+			return fmt.Errorf("covert_families %s: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// covertFamily returns the IP family to use for covert (a host:port).
+func (c *ProxyConfig) covertFamily(covert string) string {
+	if c == nil {
+		return CovertFamilyAuto
+	}
+	if host, _, err := net.SplitHostPort(covert); err == nil {
+		if family, ok := c.CovertFamilies[host]; ok {
+			return family
+		}
+	}
+	if c.CovertFamily == "" {
+		return CovertFamilyAuto
+	}
+	return c.CovertFamily
+}
+
+func (c *ProxyConfig) parseCovertTransport() error {
+	t, err := GetCovertTransport(c.CovertTransport)
+	if err != nil {
+		return err
+	}
+	c.covertTransport = t
+	return nil
+}
+
+func (c *ProxyConfig) getCovertTransport() CovertTransport {
+	if c == nil || c.covertTransport == nil {
+		return noneCovertTransport{}
+	}
+	return c.covertTransport
+}
+
+// halfCloser forwards CloseWrite and CloseRead to the connection it wraps,
+// closing it entirely if it cannot half-close. Connection wrappers embed it
+// in place of net.Conn to keep the half-close behavior of halfPipe working
+// for wrapped TCP connections.
+type halfCloser struct {
+	net.Conn
+}
+
+func (c halfCloser) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c halfCloser) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
 func ProxyFactory(reg *DecoyRegistration, proxyProtocol uint) func(*DecoyRegistration, *net.TCPConn, net.IP) {
 	switch proxyProtocol {
 	case 0:
@@ -73,11 +362,19 @@ func ProxyFactory(reg *DecoyRegistration, proxyProtocol uint) func(*DecoyRegistr
 	}
 }
 
+// proxyBufferSize bounds the data held for each direction of a proxied
+// session. halfPipe reads at most this much and does not read again until it
+// has all been written, so a slow reader on either side stalls the other
+// side's reads instead of data piling up at the station.
+const proxyBufferSize = 32 * 1024
+
 type sessionStats struct {
 	Duration int64
 	Written  int64
+	Blocked  int64 // milliseconds spent waiting for writes to dst
 	Tag      string
 	Err      string
+	Class    string `json:",omitempty"` // class of a covert read or write error, see classifyCovertErr
 }
 
 // this function is kinda ugly, uses undecorated logger, and passes things around it doesn't have to pass around
@@ -86,7 +383,8 @@ func halfPipe(src, dst net.Conn,
 	wg *sync.WaitGroup,
 	oncePrintErr *sync.Once,
 	logger *log.Logger,
-	tag string) {
+	tag string,
+	sess *Session) {
 
 	var proxyStartTime = time.Now()
 
@@ -111,23 +409,50 @@ func halfPipe(src, dst net.Conn,
 
 	// If we run into perf problems, we can revert
 
+	up := strings.HasPrefix(tag, "Up")
+	transport := "unknown"
+	if sess != nil {
+		transport = sess.Transport
+	}
+	var blocked time.Duration
+	srcEOF := false
+	// The covert is dst of the up half and src of the down half.
+	var covertErr error
 	written, err := func() (totWritten int64, err error) {
-		buf := make([]byte, 32*1024)
+		buf := make([]byte, proxyBufferSize)
 		for {
 			nr, er := src.Read(buf)
 			if nr > 0 {
+				sess.Touch()
+				writeStart := time.Now()
 				nw, ew := dst.Write(buf[0:nr])
+				writeTime := time.Since(writeStart)
+				blocked += writeTime
 				totWritten += int64(nw)
+				sess.addTraffic(up, nw)
 				// Update stats:
-				if strings.HasPrefix(tag, "Up") {
+				if sess.covertEchoing() {
+					// Not a covert's traffic, see ProxyConfig.CovertEcho.
+					if up {
+						metrics.CovertEchoBytes.Add(float64(nw), metrics.DirectionUp)
+					} else {
+						metrics.CovertEchoBytes.Add(float64(nw), metrics.DirectionDown)
+					}
+				} else if up {
 					Stat().AddBytesUp(int64(nw))
+					Stat().AddCovertWrite(writeTime)
+					metrics.ProxyBytes.Add(float64(nw), metrics.DirectionUp, transport)
 				} else {
 					Stat().AddBytesDown(int64(nw))
+					metrics.ProxyBytes.Add(float64(nw), metrics.DirectionDown, transport)
 				}
 
 				if ew != nil {
 					if ew != io.EOF {
 						err = ew
+						if up {
+							covertErr = ew
+						}
 					}
 					break
 				}
@@ -139,6 +464,11 @@ func halfPipe(src, dst net.Conn,
 			if er != nil {
 				if er != io.EOF {
 					err = er
+					if !up {
+						covertErr = er
+					}
+				} else {
+					srcEOF = true
 				}
 				break
 			}
@@ -171,11 +501,28 @@ func halfPipe(src, dst net.Conn,
 	stats := sessionStats{
 		Duration: int64(proxyEndTime / time.Millisecond),
 		Written:  written,
+		Blocked:  int64(blocked / time.Millisecond),
 		Tag:      tag,
 		Err:      ""}
 	if err != nil {
 		stats.Err = err.Error()
 	}
+	// A covert connection closed by the station, once the other half ended,
+	// is no covert failure.
+	if covertErr != nil && classifyCloseErr(covertErr) != CloseCancelled && !errors.Is(covertErr, ErrCovertResponseLimit) && !sess.covertEchoing() {
+		stats.Class = classifyCovertErr(covertErr)
+		metrics.CovertRelayErrors.Inc(stats.Class)
+	}
+	if srcEOF {
+		sess.noteEOF(up)
+	} else {
+		sess.noteErr(err)
+	}
+	// A covert over its response limit ends the whole session, not only the
+	// half relaying from it.
+	if errors.Is(err, ErrCovertResponseLimit) {
+		sess.Close()
+	}
 	stats_str, _ := json.Marshal(stats)
 	logger.Printf("stopping forwarding %s", stats_str)
 	/*
@@ -200,15 +547,99 @@ func readAtMost(conn *net.TCPConn, buf []byte) (int, error) {
 	return tot, nil
 }
 
-func Proxy(reg *DecoyRegistration, clientConn net.Conn, logger *log.Logger) {
-	covertConn, err := net.Dial("tcp", reg.Covert)
+// Proxy proxies clientConn, a connection to a phantom on phantomPort, to the
+// covert of reg. The dial and copy phases are recorded as children of span,
+// which may be nil.
+func Proxy(reg *DecoyRegistration, clientConn net.Conn, phantomPort int, span *Span, logger *Logger, conf *ProxyConfig) {
+	ProxyWithTiming(reg, clientConn, phantomPort, nil, span, logger, conf)
+}
+
+// ProxyWithTiming is Proxy for a connection whose accept and registration
+// match were timed in timing, nil if they were not.
+func ProxyWithTiming(reg *DecoyRegistration, clientConn net.Conn, phantomPort int, timing *SessionTiming, span *Span, logger *Logger, conf *ProxyConfig) {
+	if reg.SessionResumption {
+		proxyResumable(reg, clientConn, phantomPort, timing, span, logger, conf)
+		return
+	}
+	proxyTo(reg, reg.Covert, clientConn, phantomPort, timing, span, logger, conf, nil)
+}
+
+// proxyTo is ProxyWithTiming to covert, the covert of reg or of one of its
+// mux streams. tracked, if not nil, is called with the session once it is
+// tracked; it is given for mux streams and resumable sessions only.
+func proxyTo(reg *DecoyRegistration, covert string, clientConn net.Conn, phantomPort int, timing *SessionTiming, span *Span, logger *Logger, conf *ProxyConfig, tracked func(*Session)) {
+	if timing == nil {
+		timing = &SessionTiming{}
+	}
+	strict := conf != nil && conf.CovertStrictTLS
+	if strict {
+		var err error
+		check := span.Child("session.tls")
+		clientConn, err = checkStrictTLSClient(clientConn)
+		check.SetError(err)
+		check.End()
+		if err != nil {
+			span.SetError(err)
+			logger.Warnf("strict TLS: %v", err)
+			return
+		}
+	}
+
+	clientConn, err := conf.awaitClientData(clientConn)
 	if err != nil {
+		span.SetError(err)
+		logger.Printf("not dialing covert: %v", err)
+		return
+	}
+
+	timing.authenticated = conf.getClock().Now()
+
+	release, err := conf.acquireCovertDial(clientConn.RemoteAddr())
+	if err != nil {
+		span.SetError(err)
+		logger.Warnf("not dialing covert: %v", err)
+		return
+	}
+	id := Sessions().NextID()
+	span.SetIntAttr(traceAttrSessionID, int64(id))
+	if span.Context().IsValid() {
+		logger.Debugf("session %d trace %s", id, span.Context().TraceIDString())
+	}
+	dial := span.Child("session.dial")
+	rawCovertConn, covert, attempt, err := dialCovertFallbacks(reg, covert, id, conf, logger)
+	release()
+	dial.SetError(err)
+	dial.End()
+	if err != nil {
+		span.SetError(err)
 		logger.Printf("failed to dial target: %s", err)
 		return
 	}
+	echo := conf.covertEchoing()
+	if strict && !echo {
+		verify := span.Child("session.tls_verify")
+		err = conf.verifyStrictTLSCovert(covert, rawCovertConn.RemoteAddr().String())
+		verify.SetError(err)
+		verify.End()
+		if err != nil {
+			rawCovertConn.Close()
+			span.SetError(err)
+			logger.Warnf("strict TLS: %v", err)
+			return
+		}
+	}
+	covertConn := conf.withSessionRateLimit(reg, conf.getCovertTransport().Wrap(rawCovertConn))
 	defer covertConn.Close()
 
-	if reg.Flags.GetProxyHeader() {
+	// The embedded covert expects nothing before the client's data.
+	if preamble := conf.covertPreamble(covert); preamble != nil && !echo {
+		err = preamble.run(covertConn, clientConn.RemoteAddr().String(), reg.Flags.GetProxyHeader(), reg.CovertCredentials)
+		if err != nil {
+			span.SetError(err)
+			logger.Warnf("session %d covert %s: %v", id, redactCovertAddr(covert, conf.RedactCovert), err)
+			return
+		}
+	} else if reg.Flags.GetProxyHeader() && !echo {
 		err = writePROXYHeader(covertConn, clientConn.RemoteAddr().String())
 		if err != nil {
 			logger.Printf("failed to send PROXY header: %s", err)
@@ -216,12 +647,103 @@ func Proxy(reg *DecoyRegistration, clientConn net.Conn, logger *log.Logger) {
 		}
 	}
 
+	timing.covertConnected = conf.getClock().Now()
+	covertConn = conf.withFirstByteTiming(covertConn, timing)
+	if conf.limitsCovertResponses(tracked == nil) {
+		covertConn = conf.withCovertResponseLimit(covert, covertConn, rawCovertConn)
+	}
+
+	sess := Sessions().add(id, reg, phantomPort, covert, clientConn, covertConn)
+	defer Sessions().Remove(sess)
+	sess.CovertAttempt = attempt
+	sess.CovertEcho = echo
+	if attempt > 1 {
+		logger.Infof("session %d proxied to fallback covert %s, attempt %d", id,
+			redactCovertAddr(covert, conf != nil && conf.RedactCovert), attempt)
+	}
+	if version, alpn, ok := covertTLSState(rawCovertConn); ok {
+		sess.CovertTLSVersion, sess.CovertALPN = version, alpn
+		logger.Debugf("session %d speaks %s to the covert, ALPN %q", id, version, alpn)
+	}
+	if tracked != nil {
+		tracked(sess)
+	}
+	publishSessionEvent(EventConnectionStart, reg, sess)
+	defer publishSessionEvent(EventConnectionEnd, reg, sess)
+
+	copySpan := span.Child("session.copy")
+	wg := sync.WaitGroup{}
+	oncePrintErr := sync.Once{}
+	wg.Add(2)
+
+	go halfPipe(clientConn, covertConn, &wg, &oncePrintErr, logger.Logger, "Up "+reg.IDString(), sess)
+	go halfPipe(covertConn, clientConn, &wg, &oncePrintErr, logger.Logger, "Down "+reg.IDString(), sess)
+	wg.Wait()
+	up, down := atomic.LoadInt64(&sess.bytesUp), atomic.LoadInt64(&sess.bytesDown)
+	copySpan.SetIntAttr(traceAttrBytesUp, up)
+	copySpan.SetIntAttr(traceAttrBytesDown, down)
+	copySpan.End()
+	// Only a session the client ended cleanly leaves its covert connection
+	// in a state another session can start from.
+	if sess.CloseReason() != CloseClientEOF {
+		taintCovertConn(rawCovertConn)
+	}
+	span.SetIntAttr(traceAttrBytesUp, up)
+	span.SetIntAttr(traceAttrBytesDown, down)
+	span.SetAttr(traceAttrCloseReason, string(sess.CloseReason()))
+	timing.observe(sess.Transport)
+	logger.Printf("session %d closed: %s, setup %v", sess.ID, sess.CloseReason(), timing)
+}
+
+// MaskForward forwards clientConn to the registration's mask host (port 443
+// unless given) instead of proxying it to the covert, replaying received, the
+// bytes already read from the client. It is used for registrations diverted
+// by the live phantom policy.
+func MaskForward(reg *DecoyRegistration, clientConn net.Conn, received []byte, logger *Logger) {
+	maskHostPort := reg.Mask
+	if maskHostPort == "" {
+		logger.Warnf("diverted registration has no mask host, dropping connection")
+		return
+	}
+	if _, _, err := net.SplitHostPort(maskHostPort); err != nil {
+		maskHostPort = net.JoinHostPort(maskHostPort, "443")
+	}
+	maskForwardTo(reg, maskHostPort, clientConn, received, logger)
+}
+
+// MaskForwardUnregistered is MaskForward for a connection that is for no
+// registration, to maskHostPort. It is not tracked as a session.
+func MaskForwardUnregistered(maskHostPort string, clientConn net.Conn, received []byte, logger *Logger) {
+	maskForwardTo(nil, maskHostPort, clientConn, received, logger)
+}
+
+// maskForwardTo is MaskForward to maskHostPort, tracked as a session of reg
+// unless reg is nil.
+func maskForwardTo(reg *DecoyRegistration, maskHostPort string, clientConn net.Conn, received []byte, logger *Logger) {
+	maskConn, err := net.DialTimeout("tcp", maskHostPort, time.Second*10)
+	if err != nil {
+		logger.Warnf("failed to dial mask host: %v", err)
+		return
+	}
+	defer maskConn.Close()
+
+	if _, err := maskConn.Write(received); err != nil {
+		logger.Warnf("failed to replay client data to mask host: %v", err)
+		return
+	}
+
+	var sess *Session
+	if reg != nil {
+		sess = Sessions().AddWithID(Sessions().NextID(), reg, clientConn, maskConn)
+		defer Sessions().Remove(sess)
+	}
+
 	wg := sync.WaitGroup{}
 	oncePrintErr := sync.Once{}
 	wg.Add(2)
 
-	go halfPipe(clientConn, covertConn, &wg, &oncePrintErr, logger, "Up "+reg.IDString())
-	go halfPipe(covertConn, clientConn, &wg, &oncePrintErr, logger, "Down "+reg.IDString())
+	go halfPipe(clientConn, maskConn, &wg, &oncePrintErr, logger.Logger, "Up "+reg.IDString(), sess)
+	go halfPipe(maskConn, clientConn, &wg, &oncePrintErr, logger.Logger, "Down "+reg.IDString(), sess)
 	wg.Wait()
 }
 
@@ -231,10 +753,10 @@ func twoWayProxy(reg *DecoyRegistration, clientConn *net.TCPConn, originalDstIP
 	notReallyOriginalSrc := clientConn.RemoteAddr().String()
 	flowDescription := fmt.Sprintf("[%s -> %s (covert=%s)] ",
 		notReallyOriginalSrc, originalDst, reg.Covert)
-	logger := log.New(os.Stdout, "[2WP] "+flowDescription, log.Ldate|log.Lmicroseconds)
+	logger := NewLogger("[2WP] " + flowDescription)
 	logger.Println("new flow")
 
-	covertConn, err := net.Dial("tcp", reg.Covert)
+	covertConn, err := dialCovert(reg, Sessions().NextID(), nil, logger)
 	if err != nil {
 		logger.Printf("failed to dial target: %s", err)
 		return
@@ -253,8 +775,8 @@ func twoWayProxy(reg *DecoyRegistration, clientConn *net.TCPConn, originalDstIP
 	oncePrintErr := sync.Once{}
 	wg.Add(2)
 
-	go halfPipe(clientConn, covertConn, &wg, &oncePrintErr, logger, "Up")
-	go halfPipe(covertConn, clientConn, &wg, &oncePrintErr, logger, "Down")
+	go halfPipe(clientConn, covertConn, &wg, &oncePrintErr, logger.Logger, "Up", nil)
+	go halfPipe(covertConn, clientConn, &wg, &oncePrintErr, logger.Logger, "Down", nil)
 	wg.Wait()
 }
 
@@ -465,13 +987,13 @@ func threeWayProxy(reg *DecoyRegistration, clientConn *net.TCPConn, originalDstI
 	oncePrintErr := sync.Once{}
 	wg.Add(2)
 
-	go halfPipe(finalClientConn, finalTargetConn, &wg, &oncePrintErr, logger, "Up")
+	go halfPipe(finalClientConn, finalTargetConn, &wg, &oncePrintErr, logger, "Up", nil)
 
 	go func() {
 		// wait for readFromServerAndParse to exit first, as it probably haven't seen appdata yet
 		select {
 		case _ = <-serverErrChan:
-			halfPipe(finalClientConn, finalTargetConn, &wg, &oncePrintErr, logger, "Down")
+			halfPipe(finalClientConn, finalTargetConn, &wg, &oncePrintErr, logger, "Down", nil)
 		case <-time.After(10 * time.Second):
 			finalClientConn.Close()
 			wg.Done()
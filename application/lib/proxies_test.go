@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fastClientConn hands out data as fast as it is read, counting it.
+type fastClientConn struct {
+	net.Conn
+	remaining int64
+	read      int64
+}
+
+func (c *fastClientConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt64(&c.remaining) <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	atomic.AddInt64(&c.remaining, -int64(len(b)))
+	atomic.AddInt64(&c.read, int64(len(b)))
+	return len(b), nil
+}
+
+func (c *fastClientConn) Close() error { return nil }
+
+// slowCovertConn takes a while to accept each write, recording the largest.
+type slowCovertConn struct {
+	net.Conn
+	written  int64
+	maxWrite int
+}
+
+func (c *slowCovertConn) Write(b []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	if len(b) > c.maxWrite {
+		c.maxWrite = len(b)
+	}
+	atomic.AddInt64(&c.written, int64(len(b)))
+	return len(b), nil
+}
+
+func (c *slowCovertConn) Close() error { return nil }
+
+func TestHalfPipeSlowCovertBounded(t *testing.T) {
+	const total = 40 * proxyBufferSize
+	client := &fastClientConn{remaining: total}
+	covert := &slowCovertConn{}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		halfPipe(client, covert, &wg, &once, log.New(ioutil.Discard, "", 0), "Up test", nil)
+		close(done)
+	}()
+
+	// The station never holds more than one buffer of data the covert has
+	// not taken yet.
+	for {
+		select {
+		case <-done:
+			require.Equal(t, int64(total), atomic.LoadInt64(&covert.written))
+			require.True(t, covert.maxWrite <= proxyBufferSize)
+			return
+		default:
+		}
+		inFlight := atomic.LoadInt64(&client.read) - atomic.LoadInt64(&covert.written)
+		require.True(t, inFlight <= proxyBufferSize, "%d bytes buffered", inFlight)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHalfPipeReportsBlockedTime(t *testing.T) {
+	client := &fastClientConn{remaining: 3 * proxyBufferSize}
+	covert := &slowCovertConn{}
+
+	var logs bytes.Buffer
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	halfPipe(client, covert, &wg, &once, log.New(&logs, "", 0), "Up test", nil)
+
+	require.Contains(t, logs.String(), `"Blocked":`)
+	require.NotContains(t, logs.String(), `"Blocked":0,`)
+}
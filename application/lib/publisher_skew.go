@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// c2sWrapperPublishTimeField is the field number of the publish_time field in
+// the C2SWrapper message. See proto/signalling.proto.
+const c2sWrapperPublishTimeField = 15
+
+// defaultPublisherSkewWarn is the PublisherSkewWarn, in milliseconds, used
+// when none is configured.
+const defaultPublisherSkewWarn = 30000
+
+// publisherSkewWindow is the number of recent registrations of each publisher
+// its skew stats are computed over.
+const publisherSkewWindow = 128
+
+// RegistrationPublishTime returns the publish time set in the marshaled
+// C2SWrapper raw, zero if it sets none.
+func RegistrationPublishTime(raw []byte) (time.Time, error) {
+	var ms uint64
+	var set bool
+	err := walkC2SWrapper(raw, func(field uint64, varint uint64, data []byte) {
+		if field == c2sWrapperPublishTimeField {
+			ms, set = varint, true
+		}
+	})
+	if err != nil || !set {
+		return time.Time{}, err
+	}
+	if max := uint64(math.MaxInt64 / int64(time.Millisecond)); ms > max {
+		ms = max
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)), nil
+}
+
+// AppendRegistrationPublishTime appends the publish_time field set to t to the
+// marshaled C2SWrapper raw, as a registrar publishing it does. A zero t is
+// not appended.
+func AppendRegistrationPublishTime(raw []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return raw
+	}
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], c2sWrapperPublishTimeField<<3)
+	n += binary.PutUvarint(buf[n:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	return append(raw, buf[:n]...)
+}
+
+// RegistrationStale reports whether a registration published at publishTime,
+// zero if unknown, is older than StaleRegistrationAge at now.
+func (c *ZMQConfig) RegistrationStale(publishTime, now time.Time) bool {
+	if c.StaleRegistrationAge <= 0 || publishTime.IsZero() {
+		return false
+	}
+	return now.Sub(publishTime) > time.Duration(c.StaleRegistrationAge)*time.Second
+}
+
+// StaleRegistrationExpiry returns the expiry of a stale registration
+// published at publishTime whose wire expiry is expiry (zero if none): with
+// StaleRegistrationShortenTTL, the earlier of expiry and the end of the
+// station's registration lifetime counted from publishTime rather than from
+// now, otherwise expiry.
+func (c *ZMQConfig) StaleRegistrationExpiry(publishTime, expiry time.Time) time.Time {
+	if !c.StaleRegistrationShortenTTL {
+		return expiry
+	}
+	end := publishTime.Add(maxRegistrationTTL)
+	if expiry.IsZero() || end.Before(expiry) {
+		return end
+	}
+	return expiry
+}
+
+// PublisherSkewStats are the clock skew of a publisher over its recent
+// registrations, in milliseconds, positive if its clock is ahead of the
+// station's. Max is the skew largest in magnitude.
+type PublisherSkewStats struct {
+	Samples  int64 `json:"samples"`
+	MedianMs int64 `json:"median_ms"`
+	MaxMs    int64 `json:"max_ms"`
+}
+
+// PublisherSkewTracker tracks the clock skew of the publishers registrations
+// are received from, by the publish_time of their registrations, and warns
+// once for each publisher whose median skew goes past its threshold: likely
+// its NTP is broken, and its registrations look older (or younger) than they
+// are. The skew includes the time a registration took to arrive.
+type PublisherSkewTracker struct {
+	m          sync.Mutex
+	warn       time.Duration
+	logger     *log.Logger
+	publishers map[string]*publisherSkew
+}
+
+type publisherSkew struct {
+	samples int64
+	window  []time.Duration // ring of the most recent skews
+	next    int
+	warned  bool
+}
+
+// NewPublisherSkewTracker returns a tracker warning to logger of publishers
+// whose median skew is more than warn, zero never warns.
+func NewPublisherSkewTracker(warn time.Duration, logger *log.Logger) *PublisherSkewTracker {
+	return &PublisherSkewTracker{warn: warn, logger: logger, publishers: make(map[string]*publisherSkew)}
+}
+
+var publisherSkews = NewPublisherSkewTracker(defaultPublisherSkewWarn*time.Millisecond,
+	log.New(os.Stdout, "[ZMQ_PROXY] ", log.Ldate|log.Lmicroseconds))
+
+// PublisherSkews returns the tracker of the publishers of the ZMQ proxy.
+func PublisherSkews() *PublisherSkewTracker {
+	return publisherSkews
+}
+
+// setWarn changes the threshold and logger of the warnings.
+func (t *PublisherSkewTracker) setWarn(warn time.Duration, logger *log.Logger) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.warn, t.logger = warn, logger
+}
+
+// ObserveMessage records the skew of every registration of frames, a message
+// received from publisher at now: a single C2SWrapper, or a batch of them
+// (see RegistrationBatchTopic). Registrations without a publish time, and
+// other messages, are skipped.
+func (t *PublisherSkewTracker) ObserveMessage(publisher string, frames [][]byte, now time.Time) {
+	if len(frames) > 1 && string(frames[0]) == RegistrationBatchTopic {
+		frames = frames[1:]
+	} else if len(frames) != 1 {
+		return
+	}
+	for _, frame := range frames {
+		publishTime, err := RegistrationPublishTime(frame)
+		if err == nil && !publishTime.IsZero() {
+			t.Observe(publisher, publishTime.Sub(now))
+		}
+	}
+}
+
+// Observe records skew, the publish time of a registration of publisher less
+// the time it was received.
+func (t *PublisherSkewTracker) Observe(publisher string, skew time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	p := t.publishers[publisher]
+	if p == nil {
+		p = &publisherSkew{}
+		t.publishers[publisher] = p
+	}
+	p.samples++
+	if len(p.window) < publisherSkewWindow {
+		p.window = append(p.window, skew)
+	} else {
+		p.window[p.next] = skew
+		p.next = (p.next + 1) % publisherSkewWindow
+	}
+
+	// The median is only worth sorting for once a skew is past the
+	// threshold, a single late registration does not warn.
+	if t.warn <= 0 || p.warned || absDuration(skew) <= t.warn {
+		return
+	}
+	if median := p.stats().MedianMs; absDuration(time.Duration(median)*time.Millisecond) > t.warn {
+		p.warned = true
+		t.logger.Printf("publisher %s clock is %dms off the station's (median of its last %d registrations), check its NTP",
+			publisher, median, len(p.window))
+	}
+}
+
+// Stats returns the skew stats of every publisher seen, by publisher.
+func (t *PublisherSkewTracker) Stats() map[string]PublisherSkewStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if len(t.publishers) == 0 {
+		return nil
+	}
+	stats := make(map[string]PublisherSkewStats, len(t.publishers))
+	for publisher, p := range t.publishers {
+		stats[publisher] = p.stats()
+	}
+	return stats
+}
+
+func (p *publisherSkew) stats() PublisherSkewStats {
+	sorted := append([]time.Duration(nil), p.window...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	max := sorted[0]
+	if absDuration(sorted[len(sorted)-1]) > absDuration(max) {
+		max = sorted[len(sorted)-1]
+	}
+	return PublisherSkewStats{
+		Samples:  p.samples,
+		MedianMs: int64(sorted[len(sorted)/2] / time.Millisecond),
+		MaxMs:    int64(max / time.Millisecond),
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
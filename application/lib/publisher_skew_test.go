@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationPublishTime(t *testing.T) {
+	raw, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: make([]byte, 32)})
+	require.Nil(t, err)
+
+	publishTime, err := RegistrationPublishTime(raw)
+	require.Nil(t, err)
+	require.True(t, publishTime.IsZero())
+	require.Equal(t, raw, AppendRegistrationPublishTime(raw, time.Time{}))
+
+	at := time.Unix(1700000000, 123000000)
+	stamped := AppendRegistrationPublishTime(append([]byte(nil), raw...), at)
+	require.Nil(t, proto.Unmarshal(stamped, &pb.C2SWrapper{}))
+	publishTime, err = RegistrationPublishTime(stamped)
+	require.Nil(t, err)
+	require.True(t, at.Equal(publishTime))
+}
+
+func TestStaleRegistration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	conf := &ZMQConfig{StaleRegistrationAge: 60}
+	require.False(t, conf.RegistrationStale(time.Time{}, now))
+	require.False(t, conf.RegistrationStale(now.Add(-time.Minute), now))
+	require.True(t, conf.RegistrationStale(now.Add(-time.Hour), now))
+	require.False(t, (&ZMQConfig{}).RegistrationStale(now.Add(-time.Hour), now))
+
+	// The lifetime is only shortened when asked to, and never lengthened.
+	published := now.Add(-time.Hour)
+	expiry := now.Add(10 * time.Hour)
+	require.Equal(t, expiry, conf.StaleRegistrationExpiry(published, expiry))
+	conf.StaleRegistrationShortenTTL = true
+	require.Equal(t, published.Add(maxRegistrationTTL), conf.StaleRegistrationExpiry(published, expiry))
+	require.Equal(t, published.Add(maxRegistrationTTL), conf.StaleRegistrationExpiry(published, time.Time{}))
+	require.Equal(t, now.Add(time.Minute), conf.StaleRegistrationExpiry(published, now.Add(time.Minute)))
+}
+
+func TestPublisherSkewTracker(t *testing.T) {
+	var logs bytes.Buffer
+	tracker := NewPublisherSkewTracker(time.Second, log.New(&logs, "", 0))
+	require.Nil(t, tracker.Stats())
+
+	for _, ms := range []int64{10, -20, 30, 40, -500} {
+		tracker.Observe("tcp://a:5591", time.Duration(ms)*time.Millisecond)
+	}
+	require.Equal(t, map[string]PublisherSkewStats{
+		"tcp://a:5591": {Samples: 5, MedianMs: 10, MaxMs: -500},
+	}, tracker.Stats())
+
+	// A single late registration is no clock skew.
+	tracker.Observe("tcp://a:5591", 5*time.Second)
+	require.Empty(t, logs.String())
+
+	// A publisher whose clock is off warns once.
+	for i := 0; i < 2*publisherSkewWindow; i++ {
+		tracker.Observe("tcp://b:5591", -2*time.Minute)
+	}
+	require.Equal(t, 1, strings.Count(logs.String(), "\n"))
+	require.Contains(t, logs.String(), "tcp://b:5591 clock is -120000ms off")
+	stats := tracker.Stats()["tcp://b:5591"]
+	require.Equal(t, int64(2*publisherSkewWindow), stats.Samples)
+	require.Equal(t, int64(-120000), stats.MedianMs)
+}
+
+func TestPublisherSkewObserveMessage(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	raw, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: make([]byte, 32)})
+	require.Nil(t, err)
+	stamped := AppendRegistrationPublishTime(append([]byte(nil), raw...), now.Add(-3*time.Second))
+
+	tracker := NewPublisherSkewTracker(0, nil)
+	tracker.ObserveMessage("a", [][]byte{stamped}, now)
+	tracker.ObserveMessage("a", [][]byte{[]byte(RegistrationBatchTopic), stamped, raw, stamped}, now)
+	tracker.ObserveMessage("a", [][]byte{raw}, now)
+	tracker.ObserveMessage("a", [][]byte{[]byte(LivePhantomTopic), stamped}, now)
+	require.Equal(t, PublisherSkewStats{Samples: 3, MedianMs: -3000, MaxMs: -3000}, tracker.Stats()["a"])
+}
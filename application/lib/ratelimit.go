@@ -0,0 +1,220 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimitBurst is the number of bytes a rate limited session may send at
+// once after being idle, a full proxy buffer.
+const rateLimitBurst = proxyBufferSize
+
+// tokenBucket limits throughput to rate bytes per second, allowing bursts of
+// up to burst bytes. Callers take the bytes they moved and are put to sleep
+// for as long as it takes the bucket to pay them back, so a read or write
+// larger than the burst still goes through, it just waits longer.
+type tokenBucket struct {
+	m      sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newTokenBucket(rate int64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// take removes n bytes from the bucket, blocking while it is in debt.
+func (b *tokenBucket) take(n int) {
+	if n <= 0 {
+		return
+	}
+	b.m.Lock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.m.Unlock()
+
+	if wait > 0 {
+		b.sleep(wait)
+	}
+}
+
+// rateLimitedReader is an io.Reader drawing what it reads from a token
+// bucket.
+type rateLimitedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.bucket.take(n)
+	return n, err
+}
+
+// rateLimitedWriter is an io.Writer drawing what it writes from a token
+// bucket.
+type rateLimitedWriter struct {
+	w      io.Writer
+	bucket *tokenBucket
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	w.bucket.take(len(p))
+	return w.w.Write(p)
+}
+
+// rateLimitedConn limits the combined throughput of reads and writes on a
+// connection.
+type rateLimitedConn struct {
+	halfCloser
+	r rateLimitedReader
+	w rateLimitedWriter
+}
+
+func newRateLimitedConn(conn net.Conn, rate int64) *rateLimitedConn {
+	bucket := newTokenBucket(rate, rateLimitBurst)
+	return &rateLimitedConn{
+		halfCloser: halfCloser{conn},
+		r:          rateLimitedReader{conn, bucket},
+		w:          rateLimitedWriter{conn, bucket},
+	}
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *rateLimitedConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *ProxyConfig) parseSessionRateLimits() error {
+	c.sessionRateLimitBuckets = make(map[int]int64)
+	for key, rate := range c.SessionRateLimitBuckets {
+		bucket, err := strconv.Atoi(key)
+		if err != nil || bucket < 0 {
+			return fmt.Errorf("session_rate_limit_buckets: %q is not an experiment bucket", key)
+		}
+		c.sessionRateLimitBuckets[bucket] = rate
+	}
+	return nil
+}
+
+// sessionRateLimit returns the bytes per second sessions for reg are limited
+// to, zero for unlimited: the registration's own override if it has one, that
+// of its experiment bucket otherwise. conf may be nil.
+func (c *ProxyConfig) sessionRateLimit(reg *DecoyRegistration) int64 {
+	if c == nil {
+		return 0
+	}
+	rate := c.SessionRateLimit
+	if override, ok := c.sessionRateLimitBuckets[reg.Bucket]; ok {
+		rate = override
+	}
+	if override := atomic.LoadInt64(&reg.sessionRateLimit); override != 0 {
+		rate = override
+	}
+	if rate < 0 {
+		return 0
+	}
+	return rate
+}
+
+// withSessionRateLimit limits the throughput, both ways combined, of a
+// session's covert connection to the rate for reg. conn is returned as is if
+// the session is unlimited.
+func (c *ProxyConfig) withSessionRateLimit(reg *DecoyRegistration, conn net.Conn) net.Conn {
+	rate := c.sessionRateLimit(reg)
+	if rate == 0 {
+		return conn
+	}
+	return newRateLimitedConn(conn, rate)
+}
+
+// SetSessionRateLimit overrides the rate limit of the sessions of the tracked
+// registrations with the registration ID id (one per address family) that
+// start from now on, in bytes per second, a negative rate being unlimited.
+// Zero removes the override. It returns the number of registrations changed.
+func (regManager *RegistrationManager) SetSessionRateLimit(id string, rate int64) int {
+	r := regManager.registeredDecoys
+	r.m.RLock()
+	defer r.m.RUnlock()
+	n := 0
+	for _, regs := range r.decoys {
+		for _, reg := range regs {
+			if reg.IDString() == id {
+				atomic.StoreInt64(&reg.sessionRateLimit, rate)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// HandleSessionRateLimits overrides the session rate limit of a registration
+// when POSTed /registrations/rate_limit?id=<registration id>&rate=<bytes per
+// second>, see SetSessionRateLimit.
+func (regManager *RegistrationManager) HandleSessionRateLimits(logger *Logger) {
+	Admin().Handle("/registrations/rate_limit", registrationRateLimit{regManager, logger})
+}
+
+// registrationRateLimit is the management endpoint overriding the session
+// rate limit of a registration. The reply gives the number of registrations
+// changed.
+type registrationRateLimit struct {
+	regManager *RegistrationManager
+	logger     *Logger
+}
+
+func (a registrationRateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	rate, err := strconv.ParseInt(r.URL.Query().Get("rate"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad rate", http.StatusBadRequest)
+		return
+	}
+
+	changed := a.regManager.SetSessionRateLimit(id, rate)
+	if changed == 0 {
+		http.Error(w, "no such registration", http.StatusNotFound)
+		return
+	}
+	a.logger.Infof("session rate limit of registration %s set to %d", id, rate)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID      string `json:"id"`
+		Rate    int64  `json:"rate"`
+		Changed int    `json:"changed"`
+	}{id, rate, changed})
+}
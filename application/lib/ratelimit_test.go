@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// A capped session never moves more than the burst plus the rate times the
+// elapsed time.
+func TestRateLimitedConnThroughput(t *testing.T) {
+	client, covert := net.Pipe()
+	defer client.Close()
+	defer covert.Close()
+
+	const rate = 256 * 1024
+	conf := &ProxyConfig{SessionRateLimit: rate}
+	require.Nil(t, conf.parseSessionRateLimits())
+	limited := conf.withSessionRateLimit(&DecoyRegistration{}, covert)
+
+	const total = 160 * 1024
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		close(done)
+	}()
+
+	start := time.Now()
+	buf := make([]byte, 8*1024)
+	for sent := 0; sent < total; sent += len(buf) {
+		_, err := limited.Write(buf)
+		require.Nil(t, err)
+		elapsed := time.Since(start)
+		limit := float64(rateLimitBurst) + rate*elapsed.Seconds()
+		require.True(t, float64(sent+len(buf)) <= limit+1, "%d bytes after %v", sent+len(buf), elapsed)
+	}
+	require.True(t, time.Since(start) >= (total-rateLimitBurst)*time.Second/rate-10*time.Millisecond)
+
+	covert.Close()
+	<-done
+}
+
+func TestSessionRateLimitOverrides(t *testing.T) {
+	conf := &ProxyConfig{SessionRateLimit: 1000, SessionRateLimitBuckets: map[string]int64{"1": 500, "2": -1}}
+	require.Nil(t, conf.parseSessionRateLimits())
+
+	require.Equal(t, int64(1000), conf.sessionRateLimit(&DecoyRegistration{Bucket: 0}))
+	require.Equal(t, int64(500), conf.sessionRateLimit(&DecoyRegistration{Bucket: 1}))
+	require.Equal(t, int64(0), conf.sessionRateLimit(&DecoyRegistration{Bucket: 2}))
+
+	// A registration's own override comes before its bucket's.
+	require.Equal(t, int64(200), conf.sessionRateLimit(&DecoyRegistration{Bucket: 1, sessionRateLimit: 200}))
+	require.Equal(t, int64(0), conf.sessionRateLimit(&DecoyRegistration{Bucket: 1, sessionRateLimit: -1}))
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	require.Equal(t, conn, conf.withSessionRateLimit(&DecoyRegistration{Bucket: 2}, conn))
+
+	conf.SessionRateLimitBuckets = map[string]int64{"blue": 1}
+	require.NotNil(t, conf.parseSessionRateLimits())
+}
+
+func TestSessionRateLimitEndpoint(t *testing.T) {
+	rm := newTransferTestManager(testutil.NewFakeClock(time.Unix(1600000000, 0)))
+	v4 := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	rm.AddRegistration(v4)
+	v6 := newConnTagTestReg(t, net.ParseIP("2001:db8::1"))
+	v6.Keys = v4.Keys
+	rm.AddRegistration(v6)
+	other := newConnTagTestReg(t, net.ParseIP("192.0.2.2"))
+	rm.AddRegistration(other)
+	conf := &ProxyConfig{SessionRateLimit: 1000}
+
+	action := registrationRateLimit{rm, &Logger{log.New(ioutil.Discard, "", 0)}}
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodGet, "/registrations/rate_limit?id=" + v4.IDString() + "&rate=100", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/registrations/rate_limit?rate=100", http.StatusBadRequest},
+		{http.MethodPost, "/registrations/rate_limit?id=" + v4.IDString() + "&rate=fast", http.StatusBadRequest},
+		{http.MethodPost, "/registrations/rate_limit?id=ffffffffffffffffffff&rate=100", http.StatusNotFound},
+		{http.MethodPost, "/registrations/rate_limit?id=" + v4.IDString() + "&rate=100", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		action.ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		require.Equal(t, c.code, w.Code, c.target)
+	}
+
+	// Both families of the registration are overridden, no other.
+	require.Equal(t, int64(100), conf.sessionRateLimit(v4))
+	require.Equal(t, int64(100), conf.sessionRateLimit(v6))
+	require.Equal(t, int64(1000), conf.sessionRateLimit(other))
+
+	require.Equal(t, 2, rm.SetSessionRateLimit(v4.IDString(), 0))
+	require.Equal(t, int64(1000), conf.sessionRateLimit(v4))
+}
@@ -6,14 +6,15 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/refraction-networking/conjure/application/clock"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 )
 
@@ -66,6 +67,10 @@ type WrappingTransport interface {
 	// hasn't yet been enough data sent to be conclusive), they should return
 	// transports.ErrTryAgain. If the transport can be conclusively determined to not
 	// exist on the connection, implementations should return transports.ErrNotTransport.
+	//
+	// Transports that need keys beyond those in reg.Keys, e.g. to rekey a long
+	// lived session, should derive them with reg.ExportKeyingMaterial so that
+	// all key derivation stays in one place.
 	WrapConnection(data *bytes.Buffer, conn net.Conn, phantom net.IP, rm *RegistrationManager) (reg *DecoyRegistration, wrapped net.Conn, err error)
 }
 
@@ -82,12 +87,31 @@ type ConnectingTransport interface {
 // RegistrationManager manages registration tracking for the station.
 type RegistrationManager struct {
 	registeredDecoys *RegisteredDecoys
-	Logger           *log.Logger
+	Logger           *Logger
 	PhantomSelector  *PhantomIPSelector
+
+	// StationKeys, in priority order, are used to derive shared secrets from
+	// client representatives instead of trusting the publisher supplied secret.
+	StationKeys []*StationKey
+
+	// ExperimentBuckets is the number of experiment buckets registrations are
+	// split into, see ExperimentBucket.
+	ExperimentBuckets int
+
+	// Policy is consulted about every registration created, nil accepts
+	// them all (see AllowAllRegistrations).
+	Policy RegistrationPolicy
+
+	// PhantomDrain rejects registrations with a phantom in a drained subnet,
+	// nil drains none.
+	PhantomDrain *PhantomDrain
+
+	// LivenessPool runs the liveness checks of pending registrations.
+	LivenessPool *LivenessPool
 }
 
 func NewRegistrationManager() *RegistrationManager {
-	logger := log.New(os.Stdout, "[REG] ", log.Ldate|log.Lmicroseconds)
+	logger := NewLogger("[REG] ")
 
 	p, err := NewPhantomIPSelector()
 	if err != nil {
@@ -98,6 +122,7 @@ func NewRegistrationManager() *RegistrationManager {
 		Logger:           logger,
 		registeredDecoys: NewRegisteredDecoys(),
 		PhantomSelector:  p,
+		LivenessPool:     NewLivenessPool(0, 0),
 	}
 }
 
@@ -105,7 +130,7 @@ func NewRegistrationManager() *RegistrationManager {
 // clients register.
 func (regManager *RegistrationManager) AddTransport(index pb.TransportType, t Transport) error {
 	if regManager == nil {
-		logger := log.New(os.Stdout, "[REG] ", log.Ldate|log.Lmicroseconds)
+		logger := NewLogger("[REG] ")
 
 		p, err := NewPhantomIPSelector()
 		if err != nil {
@@ -149,7 +174,7 @@ func (regManager *RegistrationManager) GetWrappingTransports() map[pb.TransportT
 func (regManager *RegistrationManager) NewRegistration(c2s *pb.ClientToStation, conjureKeys *ConjureSharedKeys, includeV6 bool, registrationSource *pb.RegistrationSource) (*DecoyRegistration, error) {
 
 	phantomAddr, err := regManager.PhantomSelector.Select(
-		conjureKeys.DarkDecoySeed, uint(c2s.GetDecoyListGeneration()), includeV6)
+		conjureKeys.DarkDecoySeed[:], uint(c2s.GetDecoyListGeneration()), includeV6)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select phantom IP address: %v", err)
@@ -157,17 +182,23 @@ func (regManager *RegistrationManager) NewRegistration(c2s *pb.ClientToStation,
 
 	reg := DecoyRegistration{
 		DarkDecoy:          phantomAddr,
+		PhantomPort:        regManager.PhantomSelector.SelectPort(conjureKeys.DarkDecoySeed[:], c2s.GetTransport()),
 		Keys:               conjureKeys,
 		Covert:             c2s.GetCovertAddress(),
 		Mask:               c2s.GetMaskedDecoyServerName(),
 		Flags:              c2s.Flags,
 		Transport:          c2s.GetTransport(),
 		DecoyListVersion:   c2s.GetDecoyListGeneration(),
-		RegistrationTime:   time.Now(),
+		RegistrationTime:   regManager.Now(),
 		RegistrationSource: registrationSource,
 		regCount:           0,
+		StationKeyIndex:    -1,
+		Bucket:             ExperimentBucket(conjureKeys.SharedSecret, regManager.ExperimentBuckets),
 	}
 
+	if err := regManager.checkDrained(&reg); err != nil {
+		return nil, err
+	}
 	return &reg, nil
 }
 
@@ -180,7 +211,7 @@ func (regManager *RegistrationManager) NewRegistrationC2SWrapper(c2sw *pb.C2SWra
 	conjureKeys, err := GenSharedKeys(c2sw.GetSharedSecret())
 
 	phantomAddr, err := regManager.PhantomSelector.Select(
-		conjureKeys.DarkDecoySeed, uint(c2s.GetDecoyListGeneration()), includeV6)
+		conjureKeys.DarkDecoySeed[:], uint(c2s.GetDecoyListGeneration()), includeV6)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select phantom IP address: %v", err)
@@ -197,6 +228,7 @@ func (regManager *RegistrationManager) NewRegistrationC2SWrapper(c2sw *pb.C2SWra
 	regSrc := c2sw.GetRegistrationSource()
 	reg := DecoyRegistration{
 		DarkDecoy:          phantomAddr,
+		PhantomPort:        regManager.PhantomSelector.SelectPort(conjureKeys.DarkDecoySeed[:], c2s.GetTransport()),
 		registrationAddr:   net.IP(c2sw.GetRegistrationAddress()),
 		Keys:               &conjureKeys,
 		Covert:             c2s.GetCovertAddress(),
@@ -204,11 +236,16 @@ func (regManager *RegistrationManager) NewRegistrationC2SWrapper(c2sw *pb.C2SWra
 		Flags:              c2s.Flags,
 		Transport:          c2s.GetTransport(),
 		DecoyListVersion:   c2s.GetDecoyListGeneration(),
-		RegistrationTime:   time.Now(),
+		RegistrationTime:   regManager.Now(),
 		RegistrationSource: &regSrc,
 		regCount:           0,
+		StationKeyIndex:    -1,
+		Bucket:             ExperimentBucket(conjureKeys.SharedSecret, regManager.ExperimentBuckets),
 	}
 
+	if err := regManager.checkDrained(&reg); err != nil {
+		return nil, err
+	}
 	return &reg, nil
 }
 
@@ -225,12 +262,59 @@ func (regManager *RegistrationManager) TrackRegistration(d *DecoyRegistration) e
 func (regManager *RegistrationManager) AddRegistration(d *DecoyRegistration) {
 
 	darkDecoyAddr := d.DarkDecoy.String()
-	err := regManager.registeredDecoys.register(darkDecoyAddr, d)
+	err := regManager.registeredDecoys.register(darkDecoyAddr, d, time.Time{})
+	if err != nil {
+		regManager.Logger.Errorf("Error registering decoy: %s", err)
+	}
+}
+
+// AddPendingRegistration adds the registration before its phantom liveness
+// check has completed. Until ConfirmRegistration is called the registration
+// is only served if SetServePending is enabled, and not at all after timeout,
+// so a backlog of liveness checks can never leave it pending indefinitely.
+func (regManager *RegistrationManager) AddPendingRegistration(d *DecoyRegistration, timeout time.Duration) {
+	darkDecoyAddr := d.DarkDecoy.String()
+	err := regManager.registeredDecoys.register(darkDecoyAddr, d, regManager.registeredDecoys.clock.Now().Add(timeout))
 	if err != nil {
-		regManager.Logger.Printf("Error registering decoy: %s", err)
+		regManager.Logger.Errorf("Error registering decoy: %s", err)
 	}
 }
 
+// ConfirmRegistration marks a pending registration as having passed its
+// liveness check. A registration whose pending timeout has already passed is
+// removed instead and false is returned.
+func (regManager *RegistrationManager) ConfirmRegistration(d *DecoyRegistration) bool {
+	return regManager.registeredDecoys.confirm(d)
+}
+
+// PendingExpired reports whether d is waiting for its liveness check past its
+// pending deadline, by the manager's clock. Its check need not run,
+// ConfirmRegistration would drop it.
+func (regManager *RegistrationManager) PendingExpired(d *DecoyRegistration) bool {
+	pending := atomic.LoadInt64(&d.pendingUntil)
+	return pending != 0 && regManager.registeredDecoys.clock.Now().UnixNano() >= pending
+}
+
+// EvictRegistration removes a registration, e.g. one whose phantom turned out
+// to be live.
+func (regManager *RegistrationManager) EvictRegistration(d *DecoyRegistration) {
+	regManager.registeredDecoys.removeRegistration(d.IDString() + d.DarkDecoy.String())
+}
+
+// ExpirePhantom removes every registration with phantom but keep, which may
+// be nil, and returns how many.
+func (regManager *RegistrationManager) ExpirePhantom(phantom net.IP, keep *DecoyRegistration) int {
+	return regManager.registeredDecoys.expirePhantom(phantom.String(), keep)
+}
+
+// SetServePending sets whether connections are matched to registrations that
+// are still waiting for their liveness check.
+func (regManager *RegistrationManager) SetServePending(servePending bool) {
+	regManager.registeredDecoys.m.Lock()
+	regManager.registeredDecoys.servePending = servePending
+	regManager.registeredDecoys.m.Unlock()
+}
+
 // RegistrationExists checks if the registration is already tracked by the manager, this is
 // independent of the validity tag, this just checks to see if the registration exists.
 func (regManager *RegistrationManager) RegistrationExists(reg *DecoyRegistration) bool {
@@ -249,6 +333,25 @@ func (regManager *RegistrationManager) CountRegistrations(phantomAddr net.IP) in
 	return regManager.registeredDecoys.countRegistrations(phantomAddr)
 }
 
+// SetClock sets the clock registration lifetimes and pending deadlines are
+// measured with, and subnets drained, clock.Real by default. It must be set
+// before registrations are added.
+func (regManager *RegistrationManager) SetClock(c clock.Clock) {
+	regManager.registeredDecoys.clock = c
+	if regManager.PhantomDrain != nil {
+		regManager.PhantomDrain.clock = c
+	}
+}
+
+// Now returns the time on the clock registration lifetimes are measured with,
+// see SetClock. Managers that track no registrations use clock.Real.
+func (regManager *RegistrationManager) Now() time.Time {
+	if regManager.registeredDecoys == nil {
+		return clock.Real.Now()
+	}
+	return regManager.registeredDecoys.clock.Now()
+}
+
 // RemoveOldRegistrations garbage collects old registrations
 func (regManager *RegistrationManager) RemoveOldRegistrations() {
 	regManager.registeredDecoys.removeOldRegistrations(regManager.Logger)
@@ -256,20 +359,176 @@ func (regManager *RegistrationManager) RemoveOldRegistrations() {
 
 // DecoyRegistration is a struct for tracking individual sessions that are expecting or tracking connections.
 type DecoyRegistration struct {
+	// Fields are ordered by size to keep padding down, a station holds up
+	// to millions of registrations.
+
+	// pendingUntil is the deadline, in unix nanoseconds, for the liveness
+	// check of a registration added with AddPendingRegistration. It is zero
+	// once the check passed (or if it was never needed). It is accessed
+	// atomically and so comes first, to be 64-bit aligned on 32-bit
+	// platforms.
+	pendingUntil int64
+
 	DarkDecoy          net.IP
 	registrationAddr   net.IP
 	Keys               *ConjureSharedKeys
 	Covert, Mask       string
 	Flags              *pb.RegistrationFlags
-	Transport          pb.TransportType
 	RegistrationTime   time.Time
 	RegistrationSource *pb.RegistrationSource
-	DecoyListVersion   uint32
-	regCount           int32
+
+	// StationKeyIndex is the index of the station key the shared secret was
+	// derived with, or -1 if the secret was supplied by the publisher.
+	StationKeyIndex int
+
+	// keyCandidates links the registrations created under every station key
+	// from a message whose payload does not choose one, see
+	// LinkKeyCandidates.
+	keyCandidates *keyCandidates
+
+	// Bucket is the experiment bucket of the registration, derived from the
+	// shared secret.
+	Bucket int
+
+	// CovertFallbacks are the coverts tried in order when dialing Covert
+	// fails, see Config.SetCovertFallbacks.
+	CovertFallbacks []string
+
+	// livePhantom is the live phantom policy applied to the registration,
+	// stored as a string, unset if the phantom was not found to be live.
+	livePhantom atomic.Value
+
+	// Expiry is when the registration stops being served as set on the wire
+	// (see RegistrationExpiry), zero if it did not set one. It is only ever
+	// honored when earlier than maxRegistrationTTL.
+	Expiry time.Time
+
+	// AllowedSources are the networks clients may connect from, any if
+	// empty (see RegistrationAllowedSources and CheckSource).
+	AllowedSources []*net.IPNet
+
+	Transport        pb.TransportType
+	DecoyListVersion uint32
+	regCount         int32
+
+	// keyHolds counts the connections using Keys, with keysRetired set once
+	// the registration is removed; see HoldKeys. It is accessed atomically.
+	keyHolds int32
+
+	// PhantomPort is the port on DarkDecoy clients connect to, derived from
+	// the seed, or zero if the transport does not derive ports.
+	PhantomPort uint16
 
 	// validity marks whether the registration has been validated through liveness and other checks.
 	// This also denotes whether the registration has been shared with the detector.
 	Valid bool
+
+	// HandshakeMAC is set if the client authenticates its connections with
+	// a handshake MAC after the connection tag (see
+	// RegistrationHandshakeMAC and VerifyHandshakeMAC).
+	HandshakeMAC bool
+
+	// SessionResumption is set if the client's connections start with the
+	// session resumption header, so that its sessions can be resumed on a
+	// new connection (see RegistrationSessionResumption). Only sessions
+	// proxied with Proxy are resumable.
+	SessionResumption bool
+
+	// CovertCredentials are what the station authenticates to the covert
+	// with when its covert_preamble has a handshake, nil if the client gave
+	// none (see OpenRegistration). They must never be logged.
+	CovertCredentials *CovertCredentials
+
+	// Trace is the context of the span of the registration's ingest, invalid
+	// if it was not traced.
+	Trace SpanContext
+	// Called once the ingest pipeline's handler is done with the
+	// registration, see HoldIngestSpan.
+	ingestHandled func()
+
+	// Bytes per second the registration's sessions are limited to in place
+	// of the configured limit, negative for unlimited and zero for no
+	// override, see SetSessionRateLimit. Accessed atomically.
+	sessionRateLimit int64
+}
+
+// LivenessPending reports whether the registration is still waiting for its
+// phantom liveness check.
+func (reg *DecoyRegistration) LivenessPending() bool {
+	return atomic.LoadInt64(&reg.pendingUntil) != 0
+}
+
+// MarkLivePhantom records that the registration's phantom was found live and
+// policy (LivePhantomLogOnly or LivePhantomDivert) was applied to keep it.
+func (reg *DecoyRegistration) MarkLivePhantom(policy string) {
+	reg.livePhantom.Store(policy)
+}
+
+// LivePhantomPolicy returns the live phantom policy applied to the
+// registration, or "" if its phantom was not found to be live.
+func (reg *DecoyRegistration) LivePhantomPolicy() string {
+	policy, _ := reg.livePhantom.Load().(string)
+	return policy
+}
+
+// keysRetired is set in keyHolds once a registration is removed, its keys
+// are zeroed as soon as nothing holds them.
+const keysRetired = 1 << 30
+
+// HoldKeys keeps the registration's keys from being zeroed when it is
+// removed, until ReleaseKeys. It returns false, holding nothing, if the
+// registration was already removed. Connections hold the keys of their
+// registration for as long as they use them.
+func (reg *DecoyRegistration) HoldKeys() bool {
+	for {
+		holds := atomic.LoadInt32(&reg.keyHolds)
+		if holds&keysRetired != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&reg.keyHolds, holds, holds+1) {
+			return true
+		}
+	}
+}
+
+// ReleaseKeys releases a hold taken with HoldKeys, zeroing the keys if the
+// registration was removed and this was the last hold.
+func (reg *DecoyRegistration) ReleaseKeys() {
+	if atomic.AddInt32(&reg.keyHolds, -1) == keysRetired {
+		reg.Keys.Zero()
+	}
+}
+
+// retireKeys marks the keys of a removed registration to be zeroed, now if
+// nothing holds them, otherwise when the last hold is released.
+func (reg *DecoyRegistration) retireKeys() {
+	for {
+		holds := atomic.LoadInt32(&reg.keyHolds)
+		if holds&keysRetired != 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&reg.keyHolds, holds, holds|keysRetired) {
+			if holds == 0 {
+				reg.Keys.Zero()
+			}
+			return
+		}
+	}
+}
+
+// regDigest is the JSON form of a registration used in logs. It must never hold
+// key material, see TestDumpTypesHoldNoSecrets.
+type regDigest struct {
+	Phantom          string
+	RegID            string
+	Covert, Mask     string
+	Flags            *pb.RegistrationFlags
+	Transport        pb.TransportType
+	RegTime          time.Time
+	DecoyListVersion uint32
+	Source           *pb.RegistrationSource
+	LivePhantom      string `json:",omitempty"`
+	Bucket           int
 }
 
 // String -- Print a digest of the important identifying information for this registration.
@@ -280,24 +539,17 @@ func (reg *DecoyRegistration) String() string {
 		return "{}"
 	}
 
-	stats := struct {
-		Phantom          string
-		SharedSecret     string
-		Covert, Mask     string
-		Flags            *pb.RegistrationFlags
-		Transport        pb.TransportType
-		RegTime          time.Time
-		DecoyListVersion uint32
-		Source           *pb.RegistrationSource
-	}{
+	stats := regDigest{
 		Phantom:          reg.DarkDecoy.String(),
-		SharedSecret:     hex.EncodeToString(reg.Keys.SharedSecret),
+		RegID:            reg.IDString(),
 		Mask:             reg.Mask,
 		Flags:            reg.Flags,
 		Transport:        reg.Transport,
 		RegTime:          reg.RegistrationTime,
 		DecoyListVersion: reg.DecoyListVersion,
 		Source:           reg.RegistrationSource,
+		LivePhantom:      reg.LivePhantomPolicy(),
+		Bucket:           reg.Bucket,
 	}
 	regStats, err := json.Marshal(stats)
 	if err != nil {
@@ -306,29 +558,23 @@ func (reg *DecoyRegistration) String() string {
 	return string(regStats)
 }
 
+// ExportKeyingMaterial derives keys bound to the registration for transports
+// that need fresh keys after their handshake, see
+// ConjureSharedKeys.ExportKeyingMaterial.
+func (reg *DecoyRegistration) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	return reg.Keys.ExportKeyingMaterial(label, context, length)
+}
+
 // Length of the registration ID for logging
-var regIDLen = 16
+const regIDLen = 16
 
-// IDString - return a short version of the id (HMAC-ID) of a registration for logging
+// IDString - return a short version of the id of a registration for logging,
+// exported from its shared secret, see ConjureSharedKeys.ID
 func (reg *DecoyRegistration) IDString() string {
-	var xid []string
-
-	for i := 0; i < regIDLen; i++ {
-		xid = append(xid, "0")
-	}
-	nilID := strings.Join(xid, "")
-
 	if reg == nil || reg.Keys == nil {
-
-		return nilID
+		return strings.Repeat("0", regIDLen)
 	}
-
-	secret := make([]byte, hex.EncodedLen(len(reg.Keys.SharedSecret)))
-	n := hex.Encode(secret, reg.Keys.SharedSecret)
-	if n < 16 {
-		return nilID
-	}
-	return fmt.Sprintf("%s", secret[:regIDLen])
+	return hex.EncodeToString(reg.Keys.ID[:])
 }
 
 func (reg *DecoyRegistration) GenerateClientToStation() *pb.ClientToStation {
@@ -385,61 +631,50 @@ func (reg *DecoyRegistration) PreScanned() bool {
 	return reg.Flags.GetPrescanned()
 }
 
-// PhantomIsLive - Test whether the phantom is live using
-// 8 syns which returns syn-acks from 99% of sites within 1 second.
-// see  ZMap: Fast Internet-wide Scanning  and Its Security Applications
-// https://www.usenix.org/system/files/conference/usenixsecurity13/sec13-paper_durumeric.pdf
+// PhantomIsLive - Test whether the phantom is live, i.e. whether some host
+// already answers on the address, in which case using it would collide with
+// that host. The phantom is probed with a TCP connection to the port clients
+// connect to it on (see DstPort) and an ICMP echo in parallel, see probePhantom and SetLivenessTimeout. Results are
+// cached by phantom IP when enabled with SetLivenessCache.
 //
 // return:	bool	true  - host is live
 // 					false - host is not life
 //			error	reason decision was made
 func (reg *DecoyRegistration) PhantomIsLive() (bool, error) {
-	return phantomIsLive(net.JoinHostPort(reg.DarkDecoy.String(), "443"))
+	cache := livenessResults.Load().(*livenessCache)
+	return cachedPhantomIsLive(cache, reg.DarkDecoy.String(), reg.livenessAddress())
 }
 
-func phantomIsLive(address string) (bool, error) {
-	width := 4
-	dialError := make(chan error, width)
-	timeout := 750 * time.Millisecond
-
-	testConnect := func() {
-		conn, err := net.DialTimeout("tcp", address, timeout)
-		if err != nil {
-			dialError <- err
-			return
-		}
-		conn.Close()
-		dialError <- nil
-	}
-
-	for i := 0; i < width; i++ {
-		go testConnect()
-	}
-
-	time.Sleep(timeout)
-
-	// If any return errors or connect then return nil before deadline it is live
-	select {
-	case err := <-dialError:
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			return false, fmt.Errorf("Reached connection timeout")
-		}
-		if err != nil {
-			return true, err
-		}
-		return true, fmt.Errorf("Phantom picked up the connection")
-	default:
-		return false, fmt.Errorf("Reached statistical timeout %v", timeout)
-	}
+// livenessAddress returns the address PhantomIsLive probes over TCP.
+func (reg *DecoyRegistration) livenessAddress() string {
+	return net.JoinHostPort(reg.DarkDecoy.String(), strconv.Itoa(int(reg.DstPort())))
 }
 
 type DecoyTimeout struct {
 	decoy            string
 	identifier       string
 	registrationTime time.Time
+	expiry           time.Time
 	regID            string
 }
 
+// maxRegistrationTTL is how long the station serves a registration after
+// first tracking it, at most.
+const maxRegistrationTTL = 6 * time.Hour
+
+// ttl returns how long after now reg is still served: maxRegistrationTTL, or
+// less if its wire expiry is earlier.
+func (reg *DecoyRegistration) ttl(now time.Time) time.Duration {
+	ttl := maxRegistrationTTL
+	if !reg.Expiry.IsZero() && reg.Expiry.Sub(now) < ttl {
+		ttl = reg.Expiry.Sub(now)
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
 type RegisteredDecoys struct {
 	// decoys will be a map from decoy_ip to a:
 	// map from "registration identifier" to registration.
@@ -450,15 +685,41 @@ type RegisteredDecoys struct {
 
 	transports map[pb.TransportType]Transport
 
+	// connTags indexes registrations by phantom and connection tag prefix so
+	// tag based transports can find a registration without trying each one.
+	connTags map[connTagKey]*DecoyRegistration
+
 	decoysTimeouts map[string]*DecoyTimeout
 	m              sync.RWMutex
+
+	// servePending allows matching connections to registrations that are
+	// still waiting for their liveness check.
+	servePending bool
+
+	// clock registration lifetimes and pending deadlines are measured with.
+	clock clock.Clock
+
+	// handshakeNonces are those of the handshake MACs verified recently.
+	handshakeNonces *handshakeNonces
+
+	// interned holds the coverts and masks of tracked registrations, shared
+	// among the registrations with the same ones.
+	interned *stringInterner
+
+	// parking holds connections waiting for a registration of their phantom,
+	// nil if they are not parked.
+	parking *ConnParking
 }
 
 func NewRegisteredDecoys() *RegisteredDecoys {
 	return &RegisteredDecoys{
-		decoys:         make(map[string]map[string]*DecoyRegistration),
-		transports:     make(map[pb.TransportType]Transport),
-		decoysTimeouts: make(map[string]*DecoyTimeout),
+		decoys:          make(map[string]map[string]*DecoyRegistration),
+		transports:      make(map[pb.TransportType]Transport),
+		connTags:        make(map[connTagKey]*DecoyRegistration),
+		decoysTimeouts:  make(map[string]*DecoyTimeout),
+		clock:           clock.Real,
+		handshakeNonces: newHandshakeNonces(),
+		interned:        newStringInterner(),
 	}
 }
 
@@ -491,6 +752,9 @@ func (r *RegisteredDecoys) track(d *DecoyRegistration) error {
 	// Newly tracked registrations are not valid and have only been seen once.
 	d.regCount = 1
 	d.Valid = false
+	d.Covert = r.interned.intern(d.Covert)
+	d.Mask = r.interned.intern(d.Mask)
+	Stat().SetInternedStrings(r.interned.len())
 
 	_, exists := r.decoys[phantomAddr]
 	if !exists {
@@ -498,11 +762,14 @@ func (r *RegisteredDecoys) track(d *DecoyRegistration) error {
 	}
 
 	r.decoys[phantomAddr][identifier] = d
+	r.indexConnTag(d)
 
+	now := r.clock.Now()
 	newtimeout := &DecoyTimeout{
 		decoy:            phantomAddr,
 		identifier:       identifier,
-		registrationTime: time.Now(),
+		registrationTime: now,
+		expiry:           now.Add(d.ttl(now)),
 		regID:            d.IDString(),
 	}
 	r.decoysTimeouts[d.IDString()+phantomAddr] = newtimeout
@@ -510,7 +777,9 @@ func (r *RegisteredDecoys) track(d *DecoyRegistration) error {
 	return nil
 }
 
-func (r *RegisteredDecoys) register(darkDecoyAddr string, d *DecoyRegistration) error {
+// register marks the registration valid. If pendingUntil is not zero the
+// registration is pending its liveness check until then, see servable.
+func (r *RegisteredDecoys) register(darkDecoyAddr string, d *DecoyRegistration, pendingUntil time.Time) error {
 
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -536,11 +805,102 @@ func (r *RegisteredDecoys) register(darkDecoyAddr string, d *DecoyRegistration)
 	}
 
 	reg.Valid = true
-	registerForDetector(reg)
+	if !pendingUntil.IsZero() {
+		atomic.StoreInt64(&reg.pendingUntil, pendingUntil.UnixNano())
+	}
+	registerForDetector(reg, r.clock.Now())
+	Events().Publish(Event{
+		Type:      EventRegistrationAdded,
+		RegID:     reg.IDString(),
+		Phantom:   darkDecoyAddr,
+		Transport: reg.Transport.String(),
+	})
+	r.parking.registrationAdded(darkDecoyAddr)
 
 	return nil
 }
 
+// confirm clears the pending state of a registration, or removes it if its
+// pending deadline has passed.
+func (r *RegisteredDecoys) confirm(d *DecoyRegistration) bool {
+	r.m.Lock()
+	reg := r.registrationExists(d)
+	if reg == nil {
+		r.m.Unlock()
+		return false
+	}
+	pending := atomic.LoadInt64(&reg.pendingUntil)
+	if pending == 0 || r.clock.Now().UnixNano() < pending {
+		atomic.StoreInt64(&reg.pendingUntil, 0)
+		r.m.Unlock()
+		return true
+	}
+	r.m.Unlock()
+
+	r.removeRegistration(d.IDString() + d.DarkDecoy.String())
+	return false
+}
+
+// transferable returns the registrations to transfer to another station,
+// those served and no longer waiting for their liveness check.
+func (r *RegisteredDecoys) transferable() []transferEntry {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var entries []transferEntry
+	for _, timeout := range r.decoysTimeouts {
+		reg, ok := r.decoys[timeout.decoy][timeout.identifier]
+		if !ok || !r.servable(reg) || reg.LivenessPending() {
+			continue
+		}
+		entries = append(entries, transferEntry{
+			reg:              reg,
+			registrationTime: timeout.registrationTime,
+			expiry:           timeout.expiry,
+			regCount:         reg.regCount,
+		})
+	}
+	return entries
+}
+
+// importRegistration tracks and registers d, a registration transferred from
+// another station that had tracked it since registrationTime and received it
+// regCount times. It returns false if d is already tracked.
+func (r *RegisteredDecoys) importRegistration(d *DecoyRegistration, regCount int32, registrationTime time.Time) (bool, error) {
+	r.m.Lock()
+	if r.registrationExists(d) != nil {
+		r.m.Unlock()
+		return false, nil
+	}
+	if err := r.track(d); err != nil {
+		r.m.Unlock()
+		return false, err
+	}
+	d.regCount = regCount
+	if timeout, ok := r.decoysTimeouts[d.IDString()+d.DarkDecoy.String()]; ok {
+		timeout.registrationTime = registrationTime
+	}
+	r.m.Unlock()
+
+	return true, r.register(d.DarkDecoy.String(), d, time.Time{})
+}
+
+// servable reports whether connections may be matched to reg. Registrations
+// waiting for their liveness check are only served when servePending is set,
+// and never once their pending deadline has passed. Neither is a registration
+// past its wire expiry, even before it is swept. r.m must be held.
+func (r *RegisteredDecoys) servable(reg *DecoyRegistration) bool {
+	if !reg.Valid {
+		return false
+	}
+	now := r.clock.Now()
+	if !reg.Expiry.IsZero() && !now.Before(reg.Expiry) {
+		return false
+	}
+	pending := atomic.LoadInt64(&reg.pendingUntil)
+	return pending == 0 || (r.servePending && now.UnixNano() < pending)
+}
+
 func (r *RegisteredDecoys) getRegistrations(darkDecoyAddr net.IP) map[string]*DecoyRegistration {
 	darkDecoyAddrStatic := darkDecoyAddr.String()
 	r.m.RLock()
@@ -550,7 +910,7 @@ func (r *RegisteredDecoys) getRegistrations(darkDecoyAddr net.IP) map[string]*De
 
 	regs := make(map[string]*DecoyRegistration)
 	for k, v := range original {
-		if v.Valid {
+		if r.servable(v) {
 			// only return valid registration so we don't allow connections to a
 			// registration that has not been validated yet.
 			regs[k] = v
@@ -622,6 +982,8 @@ func (r *RegisteredDecoys) registrationExists(d *DecoyRegistration) *DecoyRegist
 	return reg
 }
 
+// regExpireLogMsg is logged as JSON. It must never hold key material, see
+// TestDumpTypesHoldNoSecrets.
 type regExpireLogMsg struct {
 	DecoyAddr  string
 	Reg2expire int64
@@ -633,14 +995,14 @@ func (r *RegisteredDecoys) getExpiredRegistrations() []string {
 	r.m.RLock()
 	defer r.m.RUnlock()
 
-	const regTimeout = time.Hour * 6
-	var cutoff = time.Now().Add(-regTimeout)
+	var now = r.clock.Now()
 	var expiredRegTimeoutIndices = []string{}
 
 	for idx, decoyTimeout := range r.decoysTimeouts {
-		if decoyTimeout.registrationTime.Before(cutoff) {
-			// if a registration was received before the cutoff time add it
-			// to the list of registrations to be removed.
+		if !now.Before(decoyTimeout.expiry) {
+			// if a registration reached the earlier of its wire expiry and
+			// the maximum lifetime add it to the list of registrations to
+			// be removed.
 			expiredRegTimeoutIndices = append(expiredRegTimeoutIndices, idx)
 		}
 	}
@@ -652,7 +1014,11 @@ func (r *RegisteredDecoys) removeRegistration(index string) *regExpireLogMsg {
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	expiredReg := r.decoysTimeouts[index]
+	expiredReg, ok := r.decoysTimeouts[index]
+	if !ok {
+		// Already removed, e.g. evicted while expiring.
+		return nil
+	}
 	expiredRegObj, ok := r.decoys[expiredReg.decoy][expiredReg.identifier]
 	if !ok {
 		return nil
@@ -660,13 +1026,28 @@ func (r *RegisteredDecoys) removeRegistration(index string) *regExpireLogMsg {
 
 	stats := &regExpireLogMsg{
 		DecoyAddr:  expiredReg.decoy,
-		Reg2expire: int64(time.Since(expiredReg.registrationTime) / time.Millisecond),
+		Reg2expire: int64(r.clock.Now().Sub(expiredReg.registrationTime) / time.Millisecond),
 		RegID:      expiredReg.regID,
 		RegCount:   expiredRegObj.regCount,
 	}
 
 	// Update stats
 	Stat().ExpireReg(expiredRegObj.DecoyListVersion, expiredRegObj.RegistrationSource)
+	Events().Publish(Event{
+		Type:      EventRegistrationExpired,
+		RegID:     expiredReg.regID,
+		Phantom:   expiredReg.decoy,
+		Transport: expiredRegObj.Transport.String(),
+		Duration:  stats.Reg2expire,
+	})
+
+	// Nothing can look the registration up any more, its keys are wiped
+	// once the connections still using them are done.
+	r.unindexConnTag(expiredRegObj)
+	expiredRegObj.retireKeys()
+	r.interned.release(expiredRegObj.Covert)
+	r.interned.release(expiredRegObj.Mask)
+	Stat().SetInternedStrings(r.interned.len())
 
 	// remove from timeout tracking
 	delete(r.decoysTimeouts, index)
@@ -682,14 +1063,35 @@ func (r *RegisteredDecoys) removeRegistration(index string) *regExpireLogMsg {
 	return stats
 }
 
+// expirePhantom removes every registration with phantom but keep and returns
+// how many.
+func (r *RegisteredDecoys) expirePhantom(phantom string, keep *DecoyRegistration) int {
+	r.m.RLock()
+	indices := make([]string, 0, len(r.decoys[phantom]))
+	for _, reg := range r.decoys[phantom] {
+		if reg != keep {
+			indices = append(indices, reg.IDString()+phantom)
+		}
+	}
+	r.m.RUnlock()
+
+	expired := 0
+	for _, index := range indices {
+		if r.removeRegistration(index) != nil {
+			expired++
+		}
+	}
+	return expired
+}
+
 // This whole process of tracking timeouts and registrations separately
 // makes less and less sense every time I come back to it.
 // Note: please try to limit duration that this process is capable of taking the
 // lock on the RegisteredDecoys mutex to prevent thread locking.
-func (r *RegisteredDecoys) removeOldRegistrations(logger *log.Logger) {
+func (r *RegisteredDecoys) removeOldRegistrations(logger *Logger) {
 	var expiredRegTimeoutIndices = r.getExpiredRegistrations()
 
-	logger.Printf("cleansing registrations - registrations: %d, timeouts: %d, expired: %d",
+	logger.Infof("cleansing registrations - registrations: %d, timeouts: %d, expired: %d",
 		r.TotalRegistrations(), len(r.decoysTimeouts), len(expiredRegTimeoutIndices))
 
 	for _, idx := range expiredRegTimeoutIndices {
@@ -697,7 +1099,7 @@ func (r *RegisteredDecoys) removeOldRegistrations(logger *log.Logger) {
 		stats := r.removeRegistration(idx)
 		if stats != nil {
 			statsStr, _ := json.Marshal(stats)
-			logger.Printf("expired registration %s", statsStr)
+			logger.Debugf("expired registration %s", statsStr)
 		}
 	}
 }
@@ -705,14 +1107,14 @@ func (r *RegisteredDecoys) removeOldRegistrations(logger *log.Logger) {
 // **NOTE**: If you mess with this function make sure the
 // session tracking tests on the detector side do what you expect
 // them to do. (conjure/src/session.rs)
-func registerForDetector(reg *DecoyRegistration) {
+func registerForDetector(reg *DecoyRegistration, now time.Time) {
 	client := getRedisClient()
 	if client == nil {
 		fmt.Printf("couldn't connect to redis")
 		return
 	}
 
-	duration := uint64(6 * time.Hour.Nanoseconds())
+	duration := uint64(reg.ttl(now).Nanoseconds())
 	src := reg.registrationAddr.String()
 	phantom := reg.DarkDecoy.String()
 	msg := &pb.StationToDetector{
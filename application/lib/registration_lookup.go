@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// registrationLookupPath is where the management endpoint answers the
+// registration queries of detectors in remote query mode.
+const registrationLookupPath = "/registrations/lookup"
+
+// HandleLookups serves the registration queries of detectors in remote query
+// mode (detector_registration_query_addr) on the management endpoint: GET
+// /registrations/lookup?phantom=<ip>&client=<ip> answers 200 with the
+// remaining lifetime, in nanoseconds, of the longest lived servable
+// registration of phantom, and 404 if there is none. IPv4 phantoms only match
+// registrations from client, IPv6 phantoms are looked up without one as the
+// detector tracks them by phantom alone.
+func (regManager *RegistrationManager) HandleLookups() {
+	Admin().Handle(registrationLookupPath, registrationLookup{regManager})
+}
+
+type registrationLookup struct {
+	regManager *RegistrationManager
+}
+
+func (l registrationLookup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	phantom := net.ParseIP(r.URL.Query().Get("phantom"))
+	if phantom == nil {
+		http.Error(w, "missing phantom", http.StatusBadRequest)
+		return
+	}
+	var client net.IP
+	if phantom.To4() != nil {
+		if client = net.ParseIP(r.URL.Query().Get("client")); client == nil {
+			http.Error(w, "missing client", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := l.regManager.registeredDecoys.lookupTTL(phantom, client)
+	if ttl <= 0 {
+		http.Error(w, "not registered", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.FormatInt(int64(ttl), 10)))
+}
+
+// lookupTTL returns how much longer the longest lived servable registration
+// of phantom is served, zero if there is none. If client is not nil only
+// registrations from client are considered.
+func (r *RegisteredDecoys) lookupTTL(phantom, client net.IP) time.Duration {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	now := r.clock.Now()
+	var ttl time.Duration
+	for _, reg := range r.decoys[phantom.String()] {
+		if !r.servable(reg) || (client != nil && !reg.registrationAddr.Equal(client)) {
+			continue
+		}
+		timeout := r.decoysTimeouts[reg.IDString()+reg.DarkDecoy.String()]
+		if timeout != nil && timeout.expiry.Sub(now) > ttl {
+			ttl = timeout.expiry.Sub(now)
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationLookupQuery(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clk := testutil.NewFakeClock(start)
+	rm := newTransferTestManager(clk)
+
+	v4 := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	v4.registrationAddr = net.ParseIP("198.51.100.7")
+	rm.AddRegistration(v4)
+	v6 := newConnTagTestReg(t, net.ParseIP("2001:db8::1"))
+	v6.Expiry = start.Add(time.Hour)
+	rm.AddRegistration(v6)
+	clk.Advance(time.Minute)
+
+	lookup := registrationLookup{rm}
+	for _, c := range []struct {
+		method, target string
+		status         int
+		body           string
+	}{
+		{http.MethodGet, "/registrations/lookup?phantom=192.0.2.1&client=198.51.100.7", http.StatusOK, "21540000000000"},
+		{http.MethodGet, "/registrations/lookup?phantom=192.0.2.1&client=198.51.100.8", http.StatusNotFound, ""},
+		{http.MethodGet, "/registrations/lookup?phantom=192.0.2.2&client=198.51.100.7", http.StatusNotFound, ""},
+		{http.MethodGet, "/registrations/lookup?phantom=2001:db8::1", http.StatusOK, "3540000000000"},
+		{http.MethodGet, "/registrations/lookup?phantom=192.0.2.1", http.StatusBadRequest, ""},
+		{http.MethodGet, "/registrations/lookup?phantom=bogus", http.StatusBadRequest, ""},
+		{http.MethodPost, "/registrations/lookup?phantom=2001:db8::1", http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		lookup.ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		require.Equal(t, c.status, w.Code, c.target)
+		if c.body != "" {
+			require.Equal(t, c.body, w.Body.String(), c.target)
+		}
+	}
+
+	// Expired registrations are not registered.
+	clk.Advance(time.Hour)
+	w := httptest.NewRecorder()
+	lookup.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/registrations/lookup?phantom=2001:db8::1", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
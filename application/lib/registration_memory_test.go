@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registrationMemoryBudget is the most heap a tracked registration may take,
+// in bytes: the DecoyRegistration itself, its keys and phantom, its entries
+// in the registration, timeout and connection tag maps, and its share of the
+// interned coverts and masks. Raise it only knowingly, a station holds up to
+// millions of registrations.
+const registrationMemoryBudget = 1536
+
+// memoryTestKeys returns keys to derive those of memoryTestReg from.
+func memoryTestKeys(t testing.TB) *ConjureSharedKeys {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.Nil(t, err)
+	keys, err := GenSharedKeys(secret)
+	require.Nil(t, err)
+	return &keys
+}
+
+// memoryTestReg returns registration i of a synthetic population in which
+// coverts and masks repeat, as they do for the popular covert endpoints. Each
+// gets its own copy of the strings, as decoding a registration does. Its keys
+// are those of template but for the secret and connection tag, deriving
+// obfs4 keys for every registration takes too long for a test.
+func memoryTestReg(t testing.TB, template *ConjureSharedKeys, i int) *DecoyRegistration {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.Nil(t, err)
+	keys := *template
+	keys.SharedSecret = secret
+	copy(keys.ConnTag[:], conjureHMAC(secret, ConnTagHMACString))
+	privateKey, publicKey, nodeID := *template.Obfs4Keys.PrivateKey, *template.Obfs4Keys.PublicKey, *template.Obfs4Keys.NodeID
+	keys.Obfs4Keys = Obfs4Keys{PrivateKey: &privateKey, PublicKey: &publicKey, NodeID: &nodeID}
+
+	phantom := make(net.IP, net.IPv6len)
+	copy(phantom, net.ParseIP("2001:db8::"))
+	binary.BigEndian.PutUint32(phantom[12:], uint32(i))
+	return &DecoyRegistration{
+		DarkDecoy: phantom,
+		Keys:      &keys,
+		Covert:    fmt.Sprintf("192.0.2.%d:443", i%50),
+		Mask:      fmt.Sprintf("www%d.example.com", i%20),
+	}
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.HeapAlloc
+}
+
+// TestRegistrationMemoryBudget tracks CONJURE_MEMORY_REGS registrations
+// (1000000 if it is "full"), and takes over a gigabyte of heap at that. It is
+// skipped unless the variable is set, BenchmarkRegistrationMemory measures the
+// same at any size.
+func TestRegistrationMemoryBudget(t *testing.T) {
+	env := os.Getenv("CONJURE_MEMORY_REGS")
+	if env == "" {
+		t.Skip("CONJURE_MEMORY_REGS not set")
+	}
+	n := 1000000
+	if env != "full" {
+		var err error
+		if n, err = strconv.Atoi(env); err != nil || n < 1000 {
+			t.Fatalf("bad CONJURE_MEMORY_REGS %q, expected \"full\" or a count of at least 1000", env)
+		}
+	}
+	keys := memoryTestKeys(t)
+	r := newConnTagTestDecoys()
+	before := heapAlloc()
+	for i := 0; i < n; i++ {
+		require.Nil(t, r.Track(memoryTestReg(t, keys, i)))
+	}
+	perReg := (heapAlloc() - before) / uint64(n)
+	t.Logf("%d registrations, %d bytes each (DecoyRegistration %d bytes)", n, perReg, unsafe.Sizeof(DecoyRegistration{}))
+	require.LessOrEqual(t, perReg, uint64(registrationMemoryBudget))
+	require.Equal(t, 70, r.interned.len())
+	runtime.KeepAlive(r)
+}
+
+func TestStringInterner(t *testing.T) {
+	r := newConnTagTestDecoys()
+	keys := memoryTestKeys(t)
+	regs := []*DecoyRegistration{memoryTestReg(t, keys, 0), memoryTestReg(t, keys, 100)}
+	for _, reg := range regs {
+		require.Nil(t, r.Track(reg))
+	}
+	require.Equal(t, regs[0].Covert, regs[1].Covert)
+	require.True(t, stringData(regs[0].Covert) == stringData(regs[1].Covert))
+	require.True(t, stringData(regs[0].Mask) == stringData(regs[1].Mask))
+	require.Equal(t, 2, r.interned.len())
+
+	// A string is dropped with its last registration.
+	r.removeRegistration(regs[0].IDString() + regs[0].DarkDecoy.String())
+	require.Equal(t, 2, r.interned.len())
+	r.removeRegistration(regs[1].IDString() + regs[1].DarkDecoy.String())
+	require.Equal(t, 0, r.interned.len())
+}
+
+func stringData(s string) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&s))
+}
+
+func BenchmarkRegistrationMemory(b *testing.B) {
+	keys := memoryTestKeys(b)
+	r := newConnTagTestDecoys()
+	before := heapAlloc()
+	for i := 0; i < b.N; i++ {
+		if err := r.Track(memoryTestReg(b, keys, i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(heapAlloc()-before)/float64(b.N), "heap-B/reg")
+	runtime.KeepAlive(r)
+}
@@ -0,0 +1,335 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// Field numbers of the registration payload format, expiry, handshake MAC and
+// sealed covert credentials fields in the C2SWrapper message. See
+// proto/signalling.proto.
+const (
+	c2sWrapperPayloadVersionField    = 9
+	c2sWrapperEncryptedPayloadField  = 10
+	c2sWrapperExpiryField            = 11
+	c2sWrapperHandshakeMACField      = 12
+	c2sWrapperSealedCredentialsField = 16
+)
+
+// Registration payload formats, given by the payload_version field of the
+// C2SWrapper.
+const (
+	// RegistrationPayloadPlaintext carries the ClientToStation in the
+	// registration_payload field. This is the format used when the field is
+	// absent.
+	RegistrationPayloadPlaintext = 0
+
+	// RegistrationPayloadAESGCM carries the marshaled ClientToStation in the
+	// encrypted_registration_payload field sealed with AES-128-GCM under a key
+	// and nonce of their own, exported from the shared secret for
+	// registrationPayloadLabel (see ExportKeyingMaterial): the first 16 bytes
+	// are the key, the last 12 the nonce. The VSP key and IV are not reused,
+	// the client already seals its VSP with them.
+	RegistrationPayloadAESGCM = 1
+)
+
+// Keying material of RegistrationPayloadAESGCM payloads.
+const (
+	registrationPayloadLabel    = "conjure registration payload"
+	registrationPayloadKeyLen   = 16
+	registrationPayloadNonceLen = 12
+)
+
+// Keying material of the sealed_covert_credentials of a registration shared
+// between stations. The key is exported for a label of its own and every
+// sealing draws a fresh random nonce, sent ahead of the ciphertext: a
+// registration may be shared several times, and never under the key and
+// nonce its client sealed the payload with.
+const (
+	covertCredentialsLabel    = "conjure covert credentials"
+	covertCredentialsKeyLen   = 16
+	covertCredentialsNonceLen = 12
+)
+
+// ErrRegistrationAuth is returned when an encrypted registration payload fails
+// to decrypt. It deliberately does not say whether the ciphertext was too short
+// or the tag did not match.
+var ErrRegistrationAuth = errors.New("registration payload failed authentication")
+
+// ErrRegistrationExpired is returned for a registration whose wire expiry has
+// already passed.
+var ErrRegistrationExpired = errors.New("registration expiry has passed")
+
+// RegistrationExpiry returns the expiry set in the marshaled C2SWrapper raw,
+// zero if it sets none. It returns ErrRegistrationExpired if the expiry is not
+// after now.
+func RegistrationExpiry(raw []byte, now time.Time) (time.Time, error) {
+	var expiry uint64
+	var set bool
+	err := walkC2SWrapper(raw, func(field uint64, varint uint64, data []byte) {
+		if field == c2sWrapperExpiryField {
+			expiry, set = varint, true
+		}
+	})
+	if err != nil || !set {
+		return time.Time{}, err
+	}
+	if expiry > math.MaxInt64 {
+		expiry = math.MaxInt64
+	}
+	t := time.Unix(int64(expiry), 0)
+	if !t.After(now) {
+		return t, ErrRegistrationExpired
+	}
+	return t, nil
+}
+
+// AppendRegistrationExpiry appends the expiry field set to expiry to the
+// marshaled C2SWrapper raw, so that a registration shared onwards keeps it. A
+// zero expiry is not appended.
+func AppendRegistrationExpiry(raw []byte, expiry time.Time) []byte {
+	if expiry.IsZero() {
+		return raw
+	}
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], c2sWrapperExpiryField<<3)
+	n += binary.PutUvarint(buf[n:], uint64(expiry.Unix()))
+	return append(raw, buf[:n]...)
+}
+
+// RegistrationHandshakeMAC reports whether the marshaled C2SWrapper raw sets
+// handshake_mac, i.e. whether the client follows the connection tag with a
+// handshake MAC (see HandshakeAuthenticator).
+func RegistrationHandshakeMAC(raw []byte) (bool, error) {
+	return c2sWrapperBool(raw, c2sWrapperHandshakeMACField)
+}
+
+// AppendRegistrationHandshakeMAC appends the handshake_mac field to the
+// marshaled C2SWrapper raw if set, so that a registration shared onwards
+// keeps it.
+func AppendRegistrationHandshakeMAC(raw []byte, set bool) []byte {
+	return appendC2SWrapperBool(raw, c2sWrapperHandshakeMACField, set)
+}
+
+// c2sWrapperBool returns the bool field of the marshaled C2SWrapper raw,
+// false if it is absent.
+func c2sWrapperBool(raw []byte, field uint64) (bool, error) {
+	var set bool
+	err := walkC2SWrapper(raw, func(f uint64, varint uint64, data []byte) {
+		if f == field {
+			set = varint != 0
+		}
+	})
+	return set, err
+}
+
+// appendC2SWrapperBool appends the bool field set to true to the marshaled
+// C2SWrapper raw if set, nothing for false.
+func appendC2SWrapperBool(raw []byte, field uint64, set bool) []byte {
+	if !set {
+		return raw
+	}
+	var buf [binary.MaxVarintLen64 + 1]byte
+	n := binary.PutUvarint(buf[:], field<<3)
+	buf[n] = 1
+	return append(raw, buf[:n+1]...)
+}
+
+// OpenRegistrationPayload returns the ClientToStation carried encrypted in the
+// marshaled C2SWrapper raw, decrypted with the keys derived from sharedSecret.
+// It returns nil and no error if the registration payload is in plaintext, in
+// which case the registration_payload field of the parsed wrapper applies.
+func OpenRegistrationPayload(raw []byte, sharedSecret []byte) (*pb.ClientToStation, error) {
+	c2s, _, err := OpenRegistration(raw, sharedSecret)
+	return c2s, err
+}
+
+// OpenRegistration is OpenRegistrationPayload also returning the covert
+// credentials of the registration, read from the decrypted ClientToStation or,
+// for a plaintext payload, from the sealed_covert_credentials of a
+// registration shared by another station (see MarshalRegistration). They are
+// nil if the registration carries none. Credentials in a plaintext
+// registration_payload are ignored: anyone on the path between the client
+// and the registrar would read them.
+func OpenRegistration(raw []byte, sharedSecret []byte) (*pb.ClientToStation, *CovertCredentials, error) {
+	plaintext, err := openRegistrationPayload(raw, sharedSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	if plaintext == nil {
+		creds, err := openSealedCovertCredentials(raw, sharedSecret)
+		return nil, creds, err
+	}
+
+	c2s := &pb.ClientToStation{}
+	err = proto.Unmarshal(plaintext, c2s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal decrypted ClientToStation: %v", err)
+	}
+	creds, err := parseCovertCredentials(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c2s, creds, nil
+}
+
+// MarshalRegistration marshals c2sw, as a registration shared onwards to
+// another station, with its registration payload in plaintext. Covert
+// credentials are only read from encrypted fields and never travel in the
+// clear, so they are sealed on their own in the sealed_covert_credentials
+// field.
+func MarshalRegistration(c2sw *pb.C2SWrapper, creds *CovertCredentials) ([]byte, error) {
+	raw, err := proto.Marshal(c2sw)
+	if err != nil || creds == nil {
+		return raw, err
+	}
+	sealed, err := sealCovertCredentials(c2sw.GetSharedSecret(), creds)
+	if err != nil {
+		return nil, err
+	}
+	raw = appendTransferUvarint(raw, c2sWrapperSealedCredentialsField<<3|2)
+	raw = appendTransferUvarint(raw, uint64(len(sealed)))
+	return append(raw, sealed...), nil
+}
+
+// sealCovertCredentials returns creds sealed as the sealed_covert_credentials
+// of a registration with sharedSecret: a random nonce followed by the
+// credentials, marshaled as a ClientToStation holding only them, sealed with
+// AES-128-GCM under the key exported for covertCredentialsLabel.
+func sealCovertCredentials(sharedSecret []byte, creds *CovertCredentials) ([]byte, error) {
+	keys := &ConjureSharedKeys{SharedSecret: sharedSecret}
+	key, err := keys.ExportKeyingMaterial(covertCredentialsLabel, nil, covertCredentialsKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive covert credentials key: %v", err)
+	}
+	defer zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, covertCredentialsNonceLen)
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, fmt.Errorf("failed to generate covert credentials nonce: %v", err)
+	}
+	plaintext := appendCovertCredentials(nil, creds)
+	sealed = aead.Seal(sealed, sealed, plaintext, nil)
+	zero(plaintext)
+	return sealed, nil
+}
+
+// openSealedCovertCredentials returns the covert credentials in the
+// sealed_covert_credentials field of the marshaled C2SWrapper raw, nil if it
+// has none, and ErrRegistrationAuth if they do not open under sharedSecret.
+func openSealedCovertCredentials(raw []byte, sharedSecret []byte) (*CovertCredentials, error) {
+	var sealed []byte
+	err := walkC2SWrapper(raw, func(field uint64, varint uint64, data []byte) {
+		if field == c2sWrapperSealedCredentialsField && data != nil {
+			sealed = data
+		}
+	})
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+
+	keys := &ConjureSharedKeys{SharedSecret: sharedSecret}
+	key, err := keys.ExportKeyingMaterial(covertCredentialsLabel, nil, covertCredentialsKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive covert credentials key: %v", err)
+	}
+	defer zero(key)
+
+	nonce := make([]byte, covertCredentialsNonceLen)
+	copy(nonce, sealed)
+	var ciphertext []byte
+	if len(sealed) > covertCredentialsNonceLen {
+		ciphertext = sealed[covertCredentialsNonceLen:]
+	}
+	plaintext, err := openAESGCM(key, nonce, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(plaintext)
+	return parseCovertCredentials(plaintext)
+}
+
+// openRegistrationPayload returns the marshaled ClientToStation carried
+// encrypted in the marshaled C2SWrapper raw, nil if the payload is in
+// plaintext.
+func openRegistrationPayload(raw []byte, sharedSecret []byte) ([]byte, error) {
+	var version uint64
+	var ciphertext []byte
+	err := walkC2SWrapper(raw, func(field uint64, varint uint64, data []byte) {
+		switch field {
+		case c2sWrapperPayloadVersionField:
+			version = varint
+		case c2sWrapperEncryptedPayloadField:
+			ciphertext = data
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case RegistrationPayloadPlaintext:
+		return nil, nil
+	case RegistrationPayloadAESGCM:
+	default:
+		return nil, fmt.Errorf("unknown registration payload version %d", version)
+	}
+
+	keys := &ConjureSharedKeys{SharedSecret: sharedSecret}
+	ekm, err := keys.ExportKeyingMaterial(registrationPayloadLabel, nil, registrationPayloadKeyLen+registrationPayloadNonceLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive registration payload key: %v", err)
+	}
+	defer zero(ekm)
+
+	plaintext, err := openAESGCM(ekm[:registrationPayloadKeyLen], ekm[registrationPayloadKeyLen:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext == nil {
+		// An empty ClientToStation, not a plaintext payload.
+		plaintext = []byte{}
+	}
+	return plaintext, nil
+}
+
+// openAESGCM decrypts ciphertext, returning ErrRegistrationAuth on any
+// failure. A ciphertext too short to hold a tag still goes through a full
+// (failing) Open so that it is not distinguishable from a bad tag by timing.
+func openAESGCM(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrRegistrationAuth
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ErrRegistrationAuth
+	}
+
+	tooShort := len(ciphertext) < aead.Overhead()
+	if tooShort {
+		ciphertext = make([]byte, aead.Overhead())
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil || tooShort {
+		return nil, ErrRegistrationAuth
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptedWrapper builds a marshaled C2SWrapper carrying c2s encrypted with
+// the keys derived from secret, as a registrar using payload version 1 would.
+func encryptedWrapper(t *testing.T, secret []byte, c2s *pb.ClientToStation) []byte {
+	plaintext, err := proto.Marshal(c2s)
+	require.Nil(t, err)
+	return sealedWrapper(t, secret, plaintext)
+}
+
+// sealedWrapper is encryptedWrapper for the marshaled ClientToStation
+// plaintext.
+func sealedWrapper(t *testing.T, secret []byte, plaintext []byte) []byte {
+	keys := &ConjureSharedKeys{SharedSecret: secret}
+	ekm, err := keys.ExportKeyingMaterial(registrationPayloadLabel, nil, registrationPayloadKeyLen+registrationPayloadNonceLen)
+	require.Nil(t, err)
+	return sealedWrapperWith(t, secret, ekm[:registrationPayloadKeyLen], ekm[registrationPayloadKeyLen:], plaintext)
+}
+
+// sealedWrapperWith is sealedWrapper sealing with key and nonce.
+func sealedWrapperWith(t *testing.T, secret, key, nonce, plaintext []byte) []byte {
+	block, err := aes.NewCipher(key)
+	require.Nil(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.Nil(t, err)
+
+	ciphertext := aead.Seal(nil, nonce, plaintext, nil)
+
+	raw, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret})
+	require.Nil(t, err)
+	raw = append(raw, c2sWrapperPayloadVersionField<<3|0, RegistrationPayloadAESGCM)
+	raw = append(raw, c2sWrapperEncryptedPayloadField<<3|2, byte(len(ciphertext)))
+	return append(raw, ciphertext...)
+}
+
+func TestOpenRegistrationPayload(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	c2s := &pb.ClientToStation{CovertAddress: proto.String("1.2.3.4:443")}
+
+	// Plaintext payloads are left to the parsed wrapper.
+	plain, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret, RegistrationPayload: c2s})
+	require.Nil(t, err)
+	payload, err := OpenRegistrationPayload(plain, secret)
+	require.Nil(t, err)
+	require.Nil(t, payload)
+
+	raw := encryptedWrapper(t, secret, c2s)
+	parsed := &pb.C2SWrapper{}
+	require.Nil(t, proto.Unmarshal(raw, parsed))
+	payload, err = OpenRegistrationPayload(raw, secret)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4:443", payload.GetCovertAddress())
+
+	// Wrong key, flipped tag bit and truncated ciphertext are all reported
+	// the same way.
+	_, err = OpenRegistrationPayload(raw, []byte("another secret, another secret!!"))
+	require.Equal(t, ErrRegistrationAuth, err)
+
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = OpenRegistrationPayload(tampered, secret)
+	require.Equal(t, ErrRegistrationAuth, err)
+
+	// The VSP key and IV do not open payloads, they are the client's VSP's.
+	keys, err := GenSharedKeys(secret)
+	require.Nil(t, err)
+	plaintext, err := proto.Marshal(c2s)
+	require.Nil(t, err)
+	_, err = OpenRegistrationPayload(sealedWrapperWith(t, secret, keys.VspKey[:], keys.VspIv[:], plaintext), secret)
+	require.Equal(t, ErrRegistrationAuth, err)
+
+	short, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret})
+	require.Nil(t, err)
+	short = append(short, c2sWrapperPayloadVersionField<<3|0, RegistrationPayloadAESGCM,
+		c2sWrapperEncryptedPayloadField<<3|2, 4, 1, 2, 3, 4)
+	_, err = OpenRegistrationPayload(short, secret)
+	require.Equal(t, ErrRegistrationAuth, err)
+
+	unknown := append(append([]byte(nil), plain...), c2sWrapperPayloadVersionField<<3|0, 7)
+	_, err = OpenRegistrationPayload(unknown, secret)
+	require.NotNil(t, err)
+	require.NotEqual(t, ErrRegistrationAuth, err)
+}
+
+// c2sWrapperRegistrationPayloadField is the field number of the plaintext
+// ClientToStation in the C2SWrapper message.
+const c2sWrapperRegistrationPayloadField = 3
+
+// covertCredentialsField is the covert_credentials field of a marshaled
+// ClientToStation, as newer clients append it.
+func covertCredentialsField(username, password string) []byte {
+	msg := appendLengthDelimited(nil, 1, []byte(username))
+	msg = appendLengthDelimited(msg, 2, []byte(password))
+	return appendLengthDelimited(nil, c2sCovertCredentialsField, msg)
+}
+
+// appendLengthDelimited appends the length delimited field with data to b.
+func appendLengthDelimited(b []byte, field uint64, data []byte) []byte {
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], field<<3|2)
+	n += binary.PutUvarint(buf[n:], uint64(len(data)))
+	return append(append(b, buf[:n]...), data...)
+}
+
+func TestOpenRegistrationCovertCredentials(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	c2s, err := proto.Marshal(&pb.ClientToStation{CovertAddress: proto.String("1.2.3.4:443")})
+	require.Nil(t, err)
+	withCreds := append(append([]byte(nil), c2s...), covertCredentialsField("alice", "s3cret")...)
+
+	// Without credentials, encrypted or not.
+	payload, creds, err := OpenRegistration(sealedWrapper(t, secret, c2s), secret)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4:443", payload.GetCovertAddress())
+	require.Nil(t, creds)
+	plain, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret})
+	require.Nil(t, err)
+	plain = appendLengthDelimited(plain, c2sWrapperRegistrationPayloadField, c2s)
+	_, creds, err = OpenRegistration(plain, secret)
+	require.Nil(t, err)
+	require.Nil(t, creds)
+
+	// The decrypted payload's only, a plaintext one's are ignored even though
+	// the generated package parses it without them.
+	payload, creds, err = OpenRegistration(sealedWrapper(t, secret, withCreds), secret)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4:443", payload.GetCovertAddress())
+	require.Equal(t, &CovertCredentials{Username: "alice", Password: "s3cret"}, creds)
+
+	plain, err = proto.Marshal(&pb.C2SWrapper{SharedSecret: secret})
+	require.Nil(t, err)
+	plain = appendLengthDelimited(plain, c2sWrapperRegistrationPayloadField, withCreds)
+	parsed := &pb.C2SWrapper{}
+	require.Nil(t, proto.Unmarshal(plain, parsed))
+	require.Equal(t, "1.2.3.4:443", parsed.GetRegistrationPayload().GetCovertAddress())
+	payload, creds, err = OpenRegistration(plain, secret)
+	require.Nil(t, err)
+	require.Nil(t, payload)
+	require.Nil(t, creds)
+
+	for _, bad := range [][]byte{
+		covertCredentialsField("", "s3cret"),
+		covertCredentialsField("alice", strings.Repeat("p", maxCovertCredential+1)),
+	} {
+		_, _, err = OpenRegistration(sealedWrapper(t, secret, append(append([]byte(nil), c2s...), bad...)), secret)
+		require.NotNil(t, err)
+	}
+}
+
+func TestMarshalRegistration(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	c2sw := &pb.C2SWrapper{
+		SharedSecret:        secret,
+		RegistrationPayload: &pb.ClientToStation{CovertAddress: proto.String("1.2.3.4:443")},
+	}
+
+	// Without credentials the payload stays in plaintext.
+	raw, err := MarshalRegistration(c2sw, nil)
+	require.Nil(t, err)
+	payload, creds, err := OpenRegistration(raw, secret)
+	require.Nil(t, err)
+	require.Nil(t, payload)
+	require.Nil(t, creds)
+
+	// With them the payload is still in plaintext, the credentials are
+	// sealed on their own and are not in the clear.
+	want := &CovertCredentials{Username: "alice", Password: "s3cret-pw"}
+	raw, err = MarshalRegistration(c2sw, want)
+	require.Nil(t, err)
+	require.NotContains(t, string(raw), "s3cret-pw")
+	parsed := &pb.C2SWrapper{}
+	require.Nil(t, proto.Unmarshal(raw, parsed))
+	require.Equal(t, "1.2.3.4:443", parsed.GetRegistrationPayload().GetCovertAddress())
+	require.Equal(t, secret, parsed.GetSharedSecret())
+	payload, creds, err = OpenRegistration(raw, secret)
+	require.Nil(t, err)
+	require.Nil(t, payload)
+	require.Equal(t, want, creds)
+
+	// Every share is sealed under a fresh nonce.
+	again, err := MarshalRegistration(c2sw, want)
+	require.Nil(t, err)
+	require.NotEqual(t, raw, again)
+
+	// They only open under the registration's secret, and not at all once
+	// tampered with.
+	_, _, err = OpenRegistration(raw, []byte("fedcba9876543210fedcba9876543210"))
+	require.Equal(t, ErrRegistrationAuth, err)
+	raw[len(raw)-1] ^= 1
+	_, _, err = OpenRegistration(raw, secret)
+	require.Equal(t, ErrRegistrationAuth, err)
+
+	// c2sw itself is left as it was.
+	require.Equal(t, "1.2.3.4:443", c2sw.GetRegistrationPayload().GetCovertAddress())
+}
+
+func TestRegistrationExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	raw, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: make([]byte, 32)})
+	require.Nil(t, err)
+
+	// Absent: the station's own lifetime applies.
+	expiry, err := RegistrationExpiry(raw, now)
+	require.Nil(t, err)
+	require.True(t, expiry.IsZero())
+	require.Equal(t, raw, AppendRegistrationExpiry(raw, time.Time{}))
+
+	// Future.
+	future := AppendRegistrationExpiry(append([]byte(nil), raw...), now.Add(time.Minute))
+	require.Nil(t, proto.Unmarshal(future, &pb.C2SWrapper{}))
+	expiry, err = RegistrationExpiry(future, now)
+	require.Nil(t, err)
+	require.Equal(t, now.Add(time.Minute), expiry)
+
+	// Past, or right now.
+	for _, at := range []time.Time{now.Add(-time.Minute), now} {
+		past := AppendRegistrationExpiry(append([]byte(nil), raw...), at)
+		_, err = RegistrationExpiry(past, now)
+		require.Equal(t, ErrRegistrationExpired, err)
+	}
+}
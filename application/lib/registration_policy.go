@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// RegistrationPolicy decides whether the station accepts a registration, the
+// extension point for deployment specific acceptance policies (e.g. by client
+// geography, ASN, time of day or quota). Allow is called for every
+// registration ingested, once all of it is read from its message (expiry,
+// allowed sources and handshake MAC included), from any goroutine, with src
+// the address the client registered from, nil if it is unknown. It rejects
+// reg, and with it the other registrations of its message, by returning false
+// and a reason, which labels metrics.RegistrationPolicyRejections and so
+// should be one of a small fixed set.
+type RegistrationPolicy interface {
+	Allow(reg *DecoyRegistration, src net.IP) (bool, string)
+}
+
+// RegistrationPolicyFunc is a function used as a RegistrationPolicy.
+type RegistrationPolicyFunc func(reg *DecoyRegistration, src net.IP) (bool, string)
+
+// Allow returns f(reg, src).
+func (f RegistrationPolicyFunc) Allow(reg *DecoyRegistration, src net.IP) (bool, string) {
+	return f(reg, src)
+}
+
+// AllowAllRegistrations is the default RegistrationPolicy, which accepts every
+// registration.
+var AllowAllRegistrations RegistrationPolicy = RegistrationPolicyFunc(func(*DecoyRegistration, net.IP) (bool, string) {
+	return true, ""
+})
+
+// ErrRegistrationPolicy is wrapped by the error of creating a registration the
+// RegistrationPolicy rejected.
+var ErrRegistrationPolicy = errors.New("registration rejected by policy")
+
+// registrationPolicyUnspecified is the reason of a rejection without one.
+const registrationPolicyUnspecified = "unspecified"
+
+// CheckPolicy consults the manager's policy about regs, the registrations
+// created from one message (one per address family), registered from src.
+// The message is rejected as a whole if the policy rejects any of them, which
+// is logged and counted once, by the reason of the first rejected.
+func (regManager *RegistrationManager) CheckPolicy(regs []*DecoyRegistration, src net.IP) error {
+	policy := regManager.Policy
+	if policy == nil {
+		policy = AllowAllRegistrations
+	}
+	for _, reg := range regs {
+		ok, reason := policy.Allow(reg, src)
+		if ok {
+			continue
+		}
+		if reason == "" {
+			reason = registrationPolicyUnspecified
+		}
+		metrics.RegistrationPolicyRejections.Inc(reason)
+		if regManager.Logger != nil {
+			regManager.Logger.Warnf("registration %s rejected by policy: %s", reg.IDString(), reason)
+		}
+		return fmt.Errorf("%w: %s", ErrRegistrationPolicy, reason)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationPolicy(t *testing.T) {
+	selector, err := SubnetsFromTomlFile("test/phantom_subnets.toml")
+	require.Nil(t, err)
+	rm := &RegistrationManager{PhantomSelector: selector}
+	c2s, keys := mockReceiveFromDetector()
+	source := pb.RegistrationSource_Detector
+	v4, err := rm.NewRegistration(&c2s, &keys, false, &source)
+	require.Nil(t, err)
+	v6, err := rm.NewRegistration(&c2s, &keys, true, &source)
+	require.Nil(t, err)
+	regs := []*DecoyRegistration{v4, v6}
+
+	// Without a policy every registration is accepted.
+	require.Nil(t, rm.CheckPolicy(regs, nil))
+
+	// A policy rejecting coverts by category, which sees the registrations
+	// complete.
+	expiry := time.Unix(1600000000, 0)
+	for _, reg := range regs {
+		reg.Expiry = expiry
+	}
+	categories := map[string]string{c2s.GetCovertAddress(): "streaming"}
+	var sources []net.IP
+	rm.Policy = RegistrationPolicyFunc(func(reg *DecoyRegistration, src net.IP) (bool, string) {
+		require.Equal(t, expiry, reg.Expiry)
+		sources = append(sources, src)
+		if category := categories[reg.Covert]; category == "streaming" {
+			return false, "covert_category"
+		}
+		return true, ""
+	})
+
+	// A message is rejected, and counted, once for all its registrations.
+	// The policy is told where the client registered from.
+	rejected := metrics.RegistrationPolicyRejections.Value("covert_category")
+	src := net.ParseIP("192.0.2.9").To4()
+	err = rm.CheckPolicy(regs, src)
+	require.True(t, errors.Is(err, ErrRegistrationPolicy))
+	require.Equal(t, rejected+1, metrics.RegistrationPolicyRejections.Value("covert_category"))
+	require.Equal(t, []net.IP{src}, sources)
+
+	other := "192.0.2.10:443"
+	for _, reg := range regs {
+		reg.Covert = other
+	}
+	require.Nil(t, rm.CheckPolicy(regs, src))
+	require.Nil(t, rm.CheckPolicy(nil, src))
+
+	// Rejections without a reason are counted as unspecified.
+	rm.Policy = RegistrationPolicyFunc(func(*DecoyRegistration, net.IP) (bool, string) { return false, "" })
+	unspecified := metrics.RegistrationPolicyRejections.Value(registrationPolicyUnspecified)
+	require.NotNil(t, rm.CheckPolicy(regs, nil))
+	require.Equal(t, unspecified+1, metrics.RegistrationPolicyRejections.Value(registrationPolicyUnspecified))
+}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/refraction-networking/conjure/application/testutil"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 	"github.com/stretchr/testify/require"
 )
@@ -137,6 +140,15 @@ func TestLivenessCheck(t *testing.T) {
 	}
 }
 
+func TestLivenessAddress(t *testing.T) {
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1")}
+	require.Equal(t, "192.0.2.1:443", reg.livenessAddress())
+	reg.PhantomPort = 8443
+	require.Equal(t, "192.0.2.1:8443", reg.livenessAddress())
+	reg.DarkDecoy = net.ParseIP("2001:db8::1")
+	require.Equal(t, "[2001:db8::1]:8443", reg.livenessAddress())
+}
+
 func TestLiveness(t *testing.T) {
 
 	liveness, response := phantomIsLive("1.1.1.1.:80")
@@ -172,7 +184,7 @@ func TestRegisterForDetectorOnce(t *testing.T) {
 	channel := pubsub.Channel()
 
 	// send message to redis pubsub, wait, then close subscriber & channel
-	registerForDetector(&reg)
+	registerForDetector(&reg, time.Now())
 
 	time.AfterFunc(time.Second*1, func() {
 		_ = pubsub.Close()
@@ -230,7 +242,7 @@ func TestRegisterForDetectorArray(t *testing.T) {
 		}
 
 		// send message to redis pubsub, wait, then close subscriber & channel
-		registerForDetector(reg)
+		registerForDetector(reg, time.Now())
 
 		// check message
 		msg := <-channel
@@ -290,7 +302,7 @@ func TestRegisterForDetectorMultithread(t *testing.T) {
 
 		// send message to redis pubsub, wait, then close subscriber & channel
 		go func() {
-			registerForDetector(reg)
+			registerForDetector(reg, time.Now())
 		}()
 	}
 
@@ -343,3 +355,120 @@ func TestRegString(t *testing.T) {
 
 	t.Logf("%s - %s", newReg.IDString(), newReg.String())
 }
+
+func TestPendingRegistration(t *testing.T) {
+	r := newConnTagTestDecoys()
+	phantom := net.ParseIP("192.0.2.1")
+	reg := newConnTagTestReg(t, phantom)
+	tag := append([]byte(nil), reg.Keys.ConnTag[:]...)
+
+	require.Nil(t, r.register(phantom.String(), reg, time.Now().Add(time.Hour)))
+	require.True(t, reg.LivenessPending())
+
+	// Pending registrations are only served if configured to.
+	require.Nil(t, r.lookupConnTag(phantom, tag))
+	require.Equal(t, 0, len(r.getRegistrations(phantom)))
+	r.servePending = true
+	require.Equal(t, reg, r.lookupConnTag(phantom, tag))
+	require.Equal(t, 1, len(r.getRegistrations(phantom)))
+
+	// Confirming clears the pending state.
+	require.True(t, r.confirm(reg))
+	require.False(t, reg.LivenessPending())
+	r.servePending = false
+	require.Equal(t, reg, r.lookupConnTag(phantom, tag))
+
+	// Past the deadline a pending registration is not served and confirming
+	// it removes it.
+	late := newConnTagTestReg(t, phantom)
+	require.Nil(t, r.register(phantom.String(), late, time.Now().Add(-time.Second)))
+	r.servePending = true
+	require.Nil(t, r.lookupConnTag(phantom, late.Keys.ConnTag[:]))
+	require.False(t, r.confirm(late))
+	require.Nil(t, r.RegistrationExists(late))
+
+	// Eviction removes a registration, e.g. when its phantom is live.
+	evicted := newConnTagTestReg(t, phantom)
+	require.Nil(t, r.register(phantom.String(), evicted, time.Now().Add(time.Hour)))
+	require.NotNil(t, r.removeRegistration(evicted.IDString()+phantom.String()))
+	require.Nil(t, r.lookupConnTag(phantom, evicted.Keys.ConnTag[:]))
+	require.Equal(t, 1, len(r.getRegistrations(phantom)))
+}
+
+// A pending registration expires by the manager's clock, whose checks are
+// then skipped.
+func TestPendingExpired(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	rm := newTransferTestManager(clk)
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	rm.AddPendingRegistration(reg, time.Minute)
+	require.False(t, rm.PendingExpired(reg))
+
+	clk.Advance(time.Minute)
+	require.True(t, rm.PendingExpired(reg))
+	require.False(t, rm.ConfirmRegistration(reg))
+	require.False(t, rm.PendingExpired(newConnTagTestReg(t, net.ParseIP("192.0.2.2"))))
+}
+
+// The keys of a removed registration are only zeroed once the connections
+// holding them are done.
+func TestRegistrationKeyHolds(t *testing.T) {
+	r := newConnTagTestDecoys()
+	phantom := net.ParseIP("192.0.2.1")
+	reg := newConnTagTestReg(t, phantom)
+	secret := append([]byte(nil), reg.Keys.SharedSecret...)
+	require.Nil(t, r.register(phantom.String(), reg, time.Time{}))
+
+	require.True(t, reg.HoldKeys())
+	require.True(t, reg.HoldKeys())
+	require.NotNil(t, r.removeRegistration(reg.IDString()+phantom.String()))
+	require.False(t, reg.HoldKeys())
+	require.Equal(t, secret, reg.Keys.SharedSecret)
+	reg.ReleaseKeys()
+	require.Equal(t, secret, reg.Keys.SharedSecret)
+	reg.ReleaseKeys()
+	require.Equal(t, make([]byte, len(secret)), reg.Keys.SharedSecret)
+
+	// Without holds they are zeroed on removal.
+	unheld := newConnTagTestReg(t, phantom)
+	require.Nil(t, r.register(phantom.String(), unheld, time.Time{}))
+	require.NotNil(t, r.removeRegistration(unheld.IDString()+phantom.String()))
+	require.Equal(t, make([]byte, len(secret)), unheld.Keys.SharedSecret)
+}
+
+// The sweep removes a registration at the earlier of its wire expiry and the
+// station's maximum lifetime, and it is not served once expired.
+func TestRegistrationWireExpiry(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	now := clk.Now()
+	reg := &DecoyRegistration{}
+	require.Equal(t, maxRegistrationTTL, reg.ttl(now))
+	reg.Expiry = now.Add(time.Minute)
+	require.Equal(t, time.Minute, reg.ttl(now))
+	reg.Expiry = now.Add(2 * maxRegistrationTTL)
+	require.Equal(t, maxRegistrationTTL, reg.ttl(now))
+	reg.Expiry = now.Add(-time.Minute)
+	require.Equal(t, time.Duration(0), reg.ttl(now))
+
+	r := newConnTagTestDecoys()
+	r.clock = clk
+	phantom := net.ParseIP("192.0.2.1")
+	absent := newConnTagTestReg(t, phantom)
+	future := newConnTagTestReg(t, phantom)
+	future.Expiry = now.Add(time.Hour)
+	short := newConnTagTestReg(t, phantom)
+	short.Expiry = now.Add(100 * time.Millisecond)
+	for _, reg := range []*DecoyRegistration{absent, future, short} {
+		require.Nil(t, r.register(phantom.String(), reg, time.Time{}))
+	}
+	require.Equal(t, 3, len(r.getRegistrations(phantom)))
+
+	clk.Advance(150 * time.Millisecond)
+	require.Nil(t, r.lookupConnTag(phantom, short.Keys.ConnTag[:]))
+	require.Equal(t, 2, len(r.getRegistrations(phantom)))
+
+	r.removeOldRegistrations(&Logger{log.New(ioutil.Discard, "", 0)})
+	require.Nil(t, r.RegistrationExists(short))
+	require.NotNil(t, r.RegistrationExists(future))
+	require.NotNil(t, r.RegistrationExists(absent))
+}
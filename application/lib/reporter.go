@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+)
+
+// StatsReport is one periodic report of a component's stats.
+type StatsReport struct {
+	// Line is the report as a log line.
+	Line string
+	// Fields are the report's values, written by the JSON sink.
+	Fields interface{}
+}
+
+// StatsSink writes the periodic stats reports of components.
+type StatsSink interface {
+	WriteReport(component string, t time.Time, report StatsReport)
+}
+
+// Outputs of periodic stats reports, see Config.StatsOutput.
+const (
+	StatsOutputLog     = "log"
+	StatsOutputJSON    = "json"
+	StatsOutputMetrics = "metrics"
+)
+
+// Components reporting stats, see Config.StatsIntervals.
+const (
+	// StatsComponentStation reports the station's counters, and resets
+	// those kept per interval.
+	StatsComponentStation = "station"
+	// StatsComponentHeartbeat reports that the station is alive.
+	StatsComponentHeartbeat = "heartbeat"
+	// StatsComponentDetector is the detector's stats line. The detector
+	// reads its interval from the same config, the station does not report
+	// it.
+	StatsComponentDetector = "detector"
+)
+
+var statsComponents = []string{StatsComponentStation, StatsComponentHeartbeat, StatsComponentDetector}
+
+// defaultStationStatsInterval is how often the station stats are reported,
+// unless configured otherwise, and collected when they are not reported.
+const defaultStationStatsInterval = 5 * time.Second
+
+// NewStatsSink returns the sink of output: log lines on w prefixed with the
+// component's name, JSON lines on w, or for metrics-only one writing nothing,
+// the stats being left to the metrics endpoint.
+func NewStatsSink(output string, w io.Writer) (StatsSink, error) {
+	switch output {
+	case StatsOutputLog, "":
+		return &logStatsSink{w: w, loggers: make(map[string]*log.Logger)}, nil
+	case StatsOutputJSON:
+		return &jsonStatsSink{enc: json.NewEncoder(w)}, nil
+	case StatsOutputMetrics:
+		return discardStatsSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown stats output %q, expected log, json or metrics", output)
+	}
+}
+
+// logStatsSink logs the lines of reports, prefixed with their component's
+// name as [HEARTBEAT], or for the station stats [STATS] as they always were.
+type logStatsSink struct {
+	m       sync.Mutex
+	w       io.Writer
+	loggers map[string]*log.Logger
+}
+
+func (s *logStatsSink) WriteReport(component string, t time.Time, report StatsReport) {
+	s.m.Lock()
+	logger, ok := s.loggers[component]
+	if !ok {
+		prefix := "[" + strings.ToUpper(component) + "] "
+		if component == StatsComponentStation {
+			prefix = "[STATS] "
+		}
+		logger = log.New(s.w, prefix, log.Ldate|log.Lmicroseconds)
+		s.loggers[component] = logger
+	}
+	s.m.Unlock()
+	logger.Print(report.Line)
+}
+
+// jsonStatsSink writes the fields of reports as JSON lines.
+type jsonStatsSink struct {
+	m   sync.Mutex
+	enc *json.Encoder
+}
+
+func (s *jsonStatsSink) WriteReport(component string, t time.Time, report StatsReport) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.enc.Encode(struct {
+		Time      time.Time   `json:"time"`
+		Component string      `json:"component"`
+		Stats     interface{} `json:"stats"`
+	}{t, component, report.Fields})
+}
+
+type discardStatsSink struct{}
+
+func (discardStatsSink) WriteReport(string, time.Time, StatsReport) {}
+
+// Reporter takes the periodic stats reports of the station's components and
+// writes them to a sink, each at its own interval, from a single goroutine.
+type Reporter struct {
+	sink       StatsSink
+	intervals  map[string]time.Duration
+	components []*reportComponent
+	clock      clock.Clock
+}
+
+type reportComponent struct {
+	name   string
+	period time.Duration
+	quiet  bool
+	report func() StatsReport
+	next   time.Time
+}
+
+// NewReporter returns a reporter writing to sink, with intervals the
+// configured intervals between the reports of components, by name (see
+// Config.StatsReportIntervals).
+func NewReporter(sink StatsSink, intervals map[string]time.Duration) *Reporter {
+	return &Reporter{sink: sink, intervals: intervals, clock: clock.Real}
+}
+
+// Register adds the component name, whose report is taken with report every
+// interval: the configured one if there is one, else def. A configured
+// interval of zero quiets the component: its report is still taken every def
+// but not written, so that components whose reports end an interval (the
+// station stats reset their counters) go on collecting. A component without
+// either interval is never reported. Components are registered before Run.
+func (r *Reporter) Register(name string, def time.Duration, report func() StatsReport) {
+	c := &reportComponent{name: name, period: def, report: report}
+	if interval, ok := r.intervals[name]; ok {
+		if interval > 0 {
+			c.period = interval
+		} else {
+			c.quiet = true
+		}
+	}
+	if c.period <= 0 {
+		return
+	}
+	r.components = append(r.components, c)
+}
+
+// RegisterStats registers s as the station and heartbeat components.
+func (r *Reporter) RegisterStats(s *Stats) {
+	r.Register(StatsComponentStation, defaultStationStatsInterval, s.Report)
+	r.Register(StatsComponentHeartbeat, 0, s.HeartbeatReport)
+}
+
+// Run takes and writes reports until ctx is done.
+func (r *Reporter) Run(ctx context.Context) {
+	if len(r.components) == 0 {
+		return
+	}
+	now := r.clock.Now()
+	for _, c := range r.components {
+		c.next = now.Add(c.period)
+	}
+	for {
+		next := r.components[0].next
+		for _, c := range r.components[1:] {
+			if c.next.Before(next) {
+				next = c.next
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.clock.After(next.Sub(r.clock.Now())):
+		}
+		now := r.clock.Now()
+		for _, c := range r.components {
+			if now.Before(c.next) {
+				continue
+			}
+			report := c.report()
+			if !c.quiet {
+				r.sink.WriteReport(c.name, now, report)
+			}
+			// Reports missed while busy are skipped, not caught up on.
+			for !now.Before(c.next) {
+				c.next = c.next.Add(c.period)
+			}
+		}
+	}
+}
+
+// parseStatsReporting checks the stats output and intervals, which default
+// to stats_heartbeat_interval for the heartbeat.
+func (c *Config) parseStatsReporting() error {
+	if _, err := NewStatsSink(c.StatsOutput, ioutil.Discard); err != nil {
+		return fmt.Errorf("stats_output: %v", err)
+	}
+	for name, interval := range c.StatsIntervals {
+		known := false
+		for _, component := range statsComponents {
+			known = known || name == component
+		}
+		if !known {
+			return fmt.Errorf("stats_intervals: unknown component %q, expected one of %s", name, strings.Join(statsComponents, ", "))
+		}
+		if interval < 0 {
+			return fmt.Errorf("stats_intervals: negative interval %d for %s", interval, name)
+		}
+	}
+	if _, ok := c.StatsIntervals[StatsComponentHeartbeat]; !ok {
+		if c.StatsIntervals == nil {
+			c.StatsIntervals = make(map[string]int)
+		}
+		c.StatsIntervals[StatsComponentHeartbeat] = c.StatsHeartbeatInterval
+	}
+	return nil
+}
+
+// StatsReportIntervals returns the configured intervals between the stats
+// reports of components, by name.
+func (c *Config) StatsReportIntervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration, len(c.StatsIntervals))
+	for name, seconds := range c.StatsIntervals {
+		intervals[name] = time.Duration(seconds) * time.Second
+	}
+	return intervals
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clk := testutil.NewFakeClock(start)
+	var out bytes.Buffer
+	sink, err := NewStatsSink(StatsOutputJSON, &out)
+	require.Nil(t, err)
+	r := NewReporter(sink, map[string]time.Duration{"fast": 2 * time.Second, "quiet": 0})
+	r.clock = clk
+
+	// A component at its default interval, one at its configured one, one
+	// quieted and one without any interval.
+	var reports [4]int64
+	component := func(i int) func() StatsReport {
+		return func() StatsReport {
+			n := atomic.AddInt64(&reports[i], 1)
+			return StatsReport{Line: "line", Fields: map[string]int64{"n": n}}
+		}
+	}
+	r.Register("default", 5*time.Second, component(0))
+	r.Register("fast", 5*time.Second, component(1))
+	r.Register("quiet", 3*time.Second, component(2))
+	r.Register("off", 0, component(3))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+	for i := 0; i < 10; i++ {
+		require.True(t, clk.WaitForTimers(1, time.Second))
+		clk.Advance(time.Second)
+	}
+	require.True(t, clk.WaitForTimers(1, time.Second))
+	cancel()
+	<-done
+
+	require.Equal(t, int64(2), atomic.LoadInt64(&reports[0]))
+	require.Equal(t, int64(5), atomic.LoadInt64(&reports[1]))
+	require.Equal(t, int64(3), atomic.LoadInt64(&reports[2]))
+	require.Equal(t, int64(0), atomic.LoadInt64(&reports[3]))
+
+	// Only the reports of components that are not quiet are written.
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 7)
+	require.Equal(t, `{"time":"`+start.Add(2*time.Second).Format(time.RFC3339Nano)+`","component":"fast","stats":{"n":1}}`, lines[0])
+	require.False(t, strings.Contains(out.String(), "quiet"))
+}
+
+func TestStatsSinks(t *testing.T) {
+	var out bytes.Buffer
+	sink, err := NewStatsSink(StatsOutputLog, &out)
+	require.Nil(t, err)
+	sink.WriteReport(StatsComponentStation, time.Now(), StatsReport{Line: "Conns: 1 cur"})
+	sink.WriteReport(StatsComponentHeartbeat, time.Now(), StatsReport{Line: "Heartbeat: 0 regs"})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], "[STATS] "), lines[0])
+	require.True(t, strings.HasSuffix(lines[0], " Conns: 1 cur"), lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "[HEARTBEAT] "), lines[1])
+
+	out.Reset()
+	sink, err = NewStatsSink(StatsOutputMetrics, &out)
+	require.Nil(t, err)
+	sink.WriteReport(StatsComponentStation, time.Now(), StatsReport{Line: "Conns: 1 cur"})
+	require.Equal(t, 0, out.Len())
+
+	_, err = NewStatsSink("syslog", &out)
+	require.NotNil(t, err)
+}
+
+func TestParseStatsReporting(t *testing.T) {
+	c := &Config{StatsHeartbeatInterval: 60}
+	require.Nil(t, c.parseStatsReporting())
+	require.Equal(t, map[string]time.Duration{StatsComponentHeartbeat: time.Minute}, c.StatsReportIntervals())
+
+	c = &Config{StatsHeartbeatInterval: 60, StatsIntervals: map[string]int{StatsComponentStation: 0, StatsComponentHeartbeat: 10}}
+	require.Nil(t, c.parseStatsReporting())
+	require.Equal(t, map[string]time.Duration{StatsComponentStation: 0, StatsComponentHeartbeat: 10 * time.Second}, c.StatsReportIntervals())
+
+	// The detector's interval is the detector's to read.
+	c = &Config{StatsIntervals: map[string]int{StatsComponentDetector: 3}}
+	require.Nil(t, c.parseStatsReporting())
+
+	for _, c := range []*Config{
+		{StatsOutput: "syslog"},
+		{StatsIntervals: map[string]int{"gobbler": 3}},
+		{StatsIntervals: map[string]int{StatsComponentStation: -1}},
+	} {
+		require.NotNil(t, c.parseStatsReporting())
+	}
+}
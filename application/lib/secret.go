@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSecretMissing is wrapped by LoadSecret errors when the secret's source
+// does not exist (no such file, variable or credential).
+var ErrSecretMissing = errors.New("secret source missing")
+
+// ErrSecretMalformed is wrapped by errors about secret contents that can not
+// be used as the expected key material.
+var ErrSecretMalformed = errors.New("malformed key material")
+
+// LoadSecret reads the key material named by uri, which is one of:
+//
+//	file:/path/to/key          raw bytes read from the file
+//	env:NAME                   hex encoded bytes in environment variable NAME
+//	systemd-credential:NAME    raw bytes of a systemd credential (LoadCredential=)
+//
+// A uri without a scheme is treated as a file path. Environment variables are
+// removed from the process environment once read so that child processes do
+// not inherit them. That does not scrub /proc/self/environ, which shows the
+// environment the process was started with for as long as it runs: use file:
+// or systemd-credential: where other processes of the same user must not read
+// the secret.
+func LoadSecret(uri string) ([]byte, error) {
+	scheme, name := "file", uri
+	if i := strings.Index(uri, ":"); i > 0 {
+		switch uri[:i] {
+		case "file", "env", "systemd-credential":
+			scheme, name = uri[:i], uri[i+1:]
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty secret name in %q", ErrSecretMissing, uri)
+	}
+
+	switch scheme {
+	case "env":
+		return loadEnvSecret(name)
+	case "systemd-credential":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("%w: credential %s requested but CREDENTIALS_DIRECTORY is not set", ErrSecretMissing, name)
+		}
+		if strings.ContainsRune(name, '/') {
+			return nil, fmt.Errorf("%w: bad credential name %q", ErrSecretMissing, name)
+		}
+		return loadFileSecret(filepath.Join(dir, name))
+	default:
+		return loadFileSecret(name)
+	}
+}
+
+func loadFileSecret(path string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v", ErrSecretMissing, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read secret: %v", err)
+	}
+	return secret, nil
+}
+
+func loadEnvSecret(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: environment variable %s is not set", ErrSecretMissing, name)
+	}
+	os.Unsetenv(name)
+
+	secret, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		// Don't include the value, or the decode error that quotes it.
+		return nil, fmt.Errorf("%w: environment variable %s is not hex encoded", ErrSecretMalformed, name)
+	}
+	return secret, nil
+}
@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSecretSources(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key")
+	require.Nil(t, ioutil.WriteFile(path, []byte{1, 2, 3}, 0600))
+
+	for _, uri := range []string{path, "file:" + path} {
+		secret, err := LoadSecret(uri)
+		require.Nil(t, err)
+		require.Equal(t, []byte{1, 2, 3}, secret)
+	}
+
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+	secret, err := LoadSecret("systemd-credential:key")
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 2, 3}, secret)
+
+	// Environment secrets are hex and removed from the environment once read.
+	os.Setenv("CJ_TEST_SECRET", "010203\n")
+	secret, err = LoadSecret("env:CJ_TEST_SECRET")
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 2, 3}, secret)
+	_, ok := os.LookupEnv("CJ_TEST_SECRET")
+	require.False(t, ok)
+}
+
+func TestLoadSecretErrors(t *testing.T) {
+	for _, uri := range []string{
+		filepath.Join(t.TempDir(), "missing"),
+		"env:CJ_TEST_SECRET_UNSET",
+		"systemd-credential:missing",
+		"env:",
+	} {
+		_, err := LoadSecret(uri)
+		require.True(t, errors.Is(err, ErrSecretMissing), "%s: %v", uri, err)
+		require.False(t, errors.Is(err, ErrSecretMalformed))
+	}
+
+	os.Setenv("CJ_TEST_SECRET", "zz-secret-zz")
+	_, err := LoadSecret("env:CJ_TEST_SECRET")
+	require.True(t, errors.Is(err, ErrSecretMalformed))
+	require.NotContains(t, err.Error(), "zz-secret-zz")
+
+	_, err = LoadStationKey(writeStationKey(t, make([]byte, 16)))
+	require.True(t, errors.Is(err, ErrSecretMalformed))
+	_, err = LoadStationKey(filepath.Join(t.TempDir(), "missing"))
+	require.True(t, errors.Is(err, ErrSecretMissing))
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	wr "github.com/mroth/weightedrand"
+	"golang.org/x/crypto/hkdf"
+)
+
+// seededSource is a deterministic source for per registration choices that
+// the client and station must agree on. Nothing that implements it may depend
+// on global state, so concurrent registrations can never disturb each other.
+type seededSource interface {
+	io.Reader
+
+	// PickWeighted returns an index into weights, chosen with probability
+	// proportional to its weight.
+	PickWeighted(weights []uint) int
+}
+
+// SeededRand is a deterministic random stream derived from a registration
+// seed (or key) and a label naming what it is used for, so that each use gets
+// an independent stream. The stream is HKDF-SHA256-Expand(seed, label), which
+// clients must reproduce exactly; see TestSeededRandVectors. A stream holds at
+// most 255*32 bytes, running past that is a programming error and panics.
+type SeededRand struct {
+	r io.Reader
+}
+
+// NewSeededRand returns the stream for seed and label.
+func NewSeededRand(seed []byte, label string) *SeededRand {
+	return &SeededRand{r: hkdf.Expand(sha256.New, seed, []byte(label))}
+}
+
+func (s *SeededRand) Read(p []byte) (int, error) {
+	return io.ReadFull(s.r, p)
+}
+
+// Uint64 returns the next 8 bytes of the stream as a big endian integer.
+func (s *SeededRand) Uint64() uint64 {
+	var b [8]byte
+	if _, err := s.Read(b[:]); err != nil {
+		panic("seeded random stream exhausted")
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// UintN returns a uniformly distributed value in [0, n). It panics if n is 0.
+func (s *SeededRand) UintN(n uint64) uint64 {
+	if n == 0 {
+		panic("UintN called with n == 0")
+	}
+	// Reject the values above the largest multiple of n to avoid modulo bias.
+	limit := ^uint64(0) - (^uint64(0)%n+1)%n
+	for {
+		v := s.Uint64()
+		if v <= limit {
+			return v % n
+		}
+	}
+}
+
+// PickWeighted returns an index into weights, chosen with probability
+// proportional to its weight, or -1 if all weights are zero.
+func (s *SeededRand) PickWeighted(weights []uint) int {
+	var total uint64
+	for _, w := range weights {
+		total += uint64(w)
+	}
+	if total == 0 {
+		return -1
+	}
+
+	r := s.UintN(total)
+	for i, w := range weights {
+		if r < uint64(w) {
+			return i
+		}
+		r -= uint64(w)
+	}
+	// unreachable
+	return -1
+}
+
+// legacyPhantomRand reproduces the math/rand stream that clients seed from
+// the first bytes of the phantom seed (as a varint) for phantom selection. It
+// must not change without a matching client change, see the phantom selection
+// tests for vectors taken from the client.
+type legacyPhantomRand struct {
+	*rand.Rand
+}
+
+func newLegacyPhantomRand(seed []byte) (*legacyPhantomRand, error) {
+	seedInt, err := binary.ReadVarint(bytes.NewBuffer(seed))
+	if err != nil {
+		return nil, err
+	}
+	return &legacyPhantomRand{rand.New(rand.NewSource(seedInt))}, nil
+}
+
+func (l *legacyPhantomRand) PickWeighted(weights []uint) int {
+	choices := make([]wr.Choice, 0, len(weights))
+	for i, w := range weights {
+		choices = append(choices, wr.Choice{Item: i, Weight: w})
+	}
+	c, err := wr.NewChooser(choices...)
+	if err != nil {
+		return -1
+	}
+	return c.PickSource(l.Rand).(int)
+}
+
+// jitterRand is the source for randomized behavior that must NOT be
+// reproducible from anything a client or observer knows, e.g. timeouts. It is
+// seeded from crypto/rand and is never used for per registration values.
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(cryptoSeed()))}
+
+func cryptoSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+// Jitter returns a random duration in [min, max) from the non-deterministic
+// jitter source. It is safe for concurrent use.
+func Jitter(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+	return min + time.Duration(jitterRand.Int63n(int64(max-min)))
+}
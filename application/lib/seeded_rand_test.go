@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Clients implementing per registration randomized parameters must reproduce
+// these streams exactly. The vectors were computed with an independent HKDF
+// implementation (Python hmac/hashlib).
+func TestSeededRandVectors(t *testing.T) {
+	seed, err := hex.DecodeString("5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f")
+	require.Nil(t, err)
+
+	s := NewSeededRand(seed, "phantom-port")
+	buf := make([]byte, 16)
+	_, err = s.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "7955ace6e3e7b1c7a607dfcc1013c2d0", hex.EncodeToString(buf))
+
+	s = NewSeededRand(seed, "phantom-port")
+	var uints []uint64
+	for i := 0; i < 4; i++ {
+		uints = append(uints, s.UintN(1000))
+	}
+	require.Equal(t, []uint64{927, 912, 936, 458}, uints)
+
+	s = NewSeededRand(seed, "phantom-port")
+	var picks []int
+	for i := 0; i < 8; i++ {
+		picks = append(picks, s.PickWeighted([]uint{1, 0, 2, 3}))
+	}
+	require.Equal(t, []int{3, 2, 3, 0, 3, 2, 3, 2}, picks)
+
+	// Different labels give independent streams.
+	other := make([]byte, 16)
+	_, err = NewSeededRand(seed, "other").Read(other)
+	require.Nil(t, err)
+	require.NotEqual(t, buf, other)
+}
+
+func TestSeededRandDistribution(t *testing.T) {
+	s := NewSeededRand([]byte("distribution"), "test")
+	counts := make([]int, 3)
+	for i := 0; i < 200; i++ {
+		i := s.PickWeighted([]uint{1, 0, 3})
+		require.True(t, i == 0 || i == 2)
+		require.True(t, s.UintN(7) < 7)
+		counts[i]++
+	}
+	require.Equal(t, 0, counts[1])
+	require.True(t, counts[2] > counts[0])
+
+	require.Equal(t, -1, s.PickWeighted([]uint{0, 0}))
+	require.Equal(t, -1, s.PickWeighted(nil))
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		j := Jitter(10*time.Second, 60*time.Second)
+		require.True(t, j >= 10*time.Second && j < 60*time.Second)
+	}
+	require.Equal(t, time.Second, Jitter(time.Second, time.Second))
+}
@@ -0,0 +1,500 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Sessions of registrations with SessionResumption set survive the loss of
+// their client connection, e.g. a dual-stack client failing over from the
+// phantom of its v6 registration to that of its v4 one: a new connection of
+// the registration can take the place of the lost one within the resume
+// grace period, the covert connection is kept open meanwhile.
+//
+// Connections of such registrations start, after whatever identified the
+// registration to its transport, with a byte saying what they are for:
+//
+//	new session: 0
+//	resume:      1 | session ID (8) | token (32) | bytes received (8)
+//
+// The station answers a new session with its session ID (8 bytes) before
+// the covert's data. The token of the n-th resume of a session is
+// SessionResumeToken(keys, ID, n), which only the client can derive, and only
+// once: an observed resume cannot be replayed. A resume states how many bytes
+// of the covert's data the client received, the station answers it with
+//
+//	resumed:  0 | bytes received (8)
+//	rejected: 1
+//
+// stating how many of the client's bytes it received in turn, then resends
+// the covert's data the client did not receive. Each side resumes sending
+// from what the other received; the station keeps sessionResumeBufferSize
+// bytes of the covert's data to resend, a resume needing more is rejected.
+// Integers are big endian.
+const (
+	sessionResumeNew    = 0
+	sessionResumeResume = 1
+
+	sessionResumeOK       = 0
+	sessionResumeRejected = 1
+
+	sessionResumeLabel    = "conjure session resumption"
+	sessionResumeTokenLen = 32
+
+	// sessionResumeBufferSize is how much of the covert's data, the most
+	// recent, is kept to resend on a resume.
+	sessionResumeBufferSize = 4 * proxyBufferSize
+
+	// sessionResumeHeaderTimeout bounds the wait for the header of a
+	// connection.
+	sessionResumeHeaderTimeout = 10 * time.Second
+
+	// defaultSessionResumeGrace is the SessionResumeGrace, in milliseconds,
+	// used when none is configured.
+	defaultSessionResumeGrace = 10000
+)
+
+// c2sWrapperSessionResumptionField is the field number of the
+// session_resumption field in the C2SWrapper message. See
+// proto/signalling.proto.
+const c2sWrapperSessionResumptionField = 14
+
+// Outcomes of session resumption, the label of metrics.SessionResumptions.
+const (
+	sessionResumeResumed  = "resumed"
+	sessionResumeUnknown  = "unknown"
+	sessionResumeBadToken = "bad_token"
+	sessionResumeGap      = "gap"
+	sessionResumeExpired  = "expired"
+)
+
+// Errors of a rejected resume.
+var (
+	errResumeUnknown  = errors.New("no resumable session with that ID")
+	errResumeBadToken = errors.New("bad session resumption token")
+	errResumeGap      = errors.New("data the client did not receive is no longer buffered")
+)
+
+// RegistrationSessionResumption reports whether the marshaled C2SWrapper raw
+// sets session_resumption, i.e. whether the client's connections start with
+// the session resumption header.
+func RegistrationSessionResumption(raw []byte) (bool, error) {
+	return c2sWrapperBool(raw, c2sWrapperSessionResumptionField)
+}
+
+// AppendRegistrationSessionResumption appends the session_resumption field to
+// the marshaled C2SWrapper raw if set, so that a registration shared onwards
+// keeps it.
+func AppendRegistrationSessionResumption(raw []byte, set bool) []byte {
+	return appendC2SWrapperBool(raw, c2sWrapperSessionResumptionField, set)
+}
+
+// SessionResumeToken returns the token of the resume-th resume (from 1) of
+// the session with the station session ID id, of the registration with keys.
+func SessionResumeToken(keys *ConjureSharedKeys, id uint64, resume uint32) ([]byte, error) {
+	var context [12]byte
+	binary.BigEndian.PutUint64(context[:], id)
+	binary.BigEndian.PutUint32(context[8:], resume)
+	return keys.ExportKeyingMaterial(sessionResumeLabel, context[:], sessionResumeTokenLen)
+}
+
+func (c *ProxyConfig) parseSessionResume() error {
+	if c.SessionResumeGrace < 0 {
+		return fmt.Errorf("session_resume_grace must not be negative")
+	}
+	if c.SessionResumeGrace == 0 {
+		c.SessionResumeGrace = defaultSessionResumeGrace
+	}
+	return nil
+}
+
+func (c *ProxyConfig) sessionResumeGrace() time.Duration {
+	if c == nil || c.SessionResumeGrace <= 0 {
+		return defaultSessionResumeGrace * time.Millisecond
+	}
+	return time.Duration(c.SessionResumeGrace) * time.Millisecond
+}
+
+// proxyResumable is ProxyWithTiming for registrations with SessionResumption set. It
+// reads the session resumption header and either proxies a new resumable
+// session or hands clientConn to the session it resumes, returning once that
+// session is done with it.
+func proxyResumable(reg *DecoyRegistration, clientConn net.Conn, phantomPort int, timing *SessionTiming, span *Span, logger *Logger, conf *ProxyConfig) {
+	clientConn.SetReadDeadline(time.Now().Add(sessionResumeHeaderTimeout))
+	var kind [1]byte
+	if _, err := io.ReadFull(clientConn, kind[:]); err != nil {
+		span.SetError(err)
+		logger.Printf("failed to read session resumption header: %v", err)
+		return
+	}
+
+	switch kind[0] {
+	case sessionResumeNew:
+		clientConn.SetReadDeadline(time.Time{})
+		rc := newResumableConn(reg, clientConn, conf.sessionResumeGrace(), conf.getClock())
+		defer rc.Close()
+		proxyTo(reg, reg.Covert, rc, phantomPort, timing, span, logger, conf, func(sess *Session) {
+			rc.start(sess.ID)
+		})
+
+	case sessionResumeResume:
+		var req [8 + sessionResumeTokenLen + 8]byte
+		_, err := io.ReadFull(clientConn, req[:])
+		clientConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			span.SetError(err)
+			logger.Printf("failed to read session resumption header: %v", err)
+			return
+		}
+		id := binary.BigEndian.Uint64(req[:8])
+		token := req[8 : 8+sessionResumeTokenLen]
+		received := binary.BigEndian.Uint64(req[8+sessionResumeTokenLen:])
+
+		span.SetIntAttr(traceAttrSessionID, int64(id))
+		released, err := Sessions().resume(reg, id, token, received, clientConn)
+		if err != nil {
+			span.SetError(err)
+			logger.Warnf("session %d not resumed: %v", id, err)
+			clientConn.Write([]byte{sessionResumeRejected})
+			return
+		}
+		logger.Infof("session %d resumed from %v", id, clientConn.RemoteAddr())
+		<-released
+
+	default:
+		err := fmt.Errorf("bad session resumption header %#x", kind[0])
+		span.SetError(err)
+		logger.Warnf("%v", err)
+	}
+}
+
+// resume hands conn, a connection of reg resuming the session id, to the
+// session. It returns a channel closed once the session is done with conn.
+func (t *SessionTracker) resume(reg *DecoyRegistration, id uint64, token []byte, received uint64, conn net.Conn) (<-chan struct{}, error) {
+	t.m.RLock()
+	rc := t.resumable[id]
+	t.m.RUnlock()
+	if rc == nil {
+		metrics.SessionResumptions.Inc(sessionResumeUnknown)
+		return nil, errResumeUnknown
+	}
+	released, err := rc.resume(reg, token, received, conn)
+	switch {
+	case errors.Is(err, errResumeBadToken):
+		metrics.SessionResumptions.Inc(sessionResumeBadToken)
+	case errors.Is(err, errResumeGap):
+		metrics.SessionResumptions.Inc(sessionResumeGap)
+	case errors.Is(err, errResumeUnknown):
+		metrics.SessionResumptions.Inc(sessionResumeUnknown)
+	case err == nil:
+		metrics.SessionResumptions.Inc(sessionResumeResumed)
+	}
+	return released, err
+}
+
+// addResumable makes the session id resumable through rc.
+func (t *SessionTracker) addResumable(id uint64, rc *resumableConn) {
+	t.m.Lock()
+	t.resumable[id] = rc
+	t.m.Unlock()
+}
+
+func (t *SessionTracker) removeResumable(id uint64) {
+	t.m.Lock()
+	delete(t.resumable, id)
+	t.m.Unlock()
+}
+
+// resumableConn is the client leg of a resumable session, whose connection
+// can be replaced by that of a resume. Reads and writes failing on a
+// connection wait for the grace period for a resume to replace it before
+// failing. It counts what it read from the client and keeps what it wrote to
+// resend on a resume.
+type resumableConn struct {
+	reg   *DecoyRegistration
+	grace time.Duration
+	clock clock.Clock
+
+	// wm serializes writes to the connection, taken before m
+	wm sync.Mutex
+
+	m        sync.Mutex
+	id       uint64 // session ID, zero until started
+	conn     net.Conn
+	leg      int           // replacements of conn so far
+	replaced chan struct{} // closed when conn is replaced or rc closed
+	released chan struct{} // closed when rc is done with conn
+	closed   bool
+	expired  bool // the grace period ran out
+
+	received uint64 // bytes read from the client
+	sent     uint64 // bytes written to the client
+	unacked  []byte // the last bytes written, up to sessionResumeBufferSize
+	pending  []byte // the reply to a resume, written before anything else
+
+	readDeadline, writeDeadline time.Time
+}
+
+func newResumableConn(reg *DecoyRegistration, conn net.Conn, grace time.Duration, clk clock.Clock) *resumableConn {
+	return &resumableConn{
+		reg:      reg,
+		grace:    grace,
+		clock:    clk,
+		conn:     conn,
+		replaced: make(chan struct{}),
+		released: make(chan struct{}),
+	}
+}
+
+// start tells the client the session ID id and makes the session resumable.
+func (rc *resumableConn) start(id uint64) {
+	rc.m.Lock()
+	rc.id = id
+	conn := rc.conn
+	rc.m.Unlock()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	conn.Write(b[:])
+	Sessions().addResumable(id, rc)
+}
+
+// current returns the connection and its leg number.
+func (rc *resumableConn) current() (net.Conn, int) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	return rc.conn, rc.leg
+}
+
+// await waits up to the grace period for the connection of leg to be
+// replaced after it failed. It reports whether it was.
+func (rc *resumableConn) await(leg int) bool {
+	rc.m.Lock()
+	if rc.closed || rc.expired {
+		rc.m.Unlock()
+		return false
+	}
+	if rc.leg != leg {
+		rc.m.Unlock()
+		return true
+	}
+	replaced := rc.replaced
+	rc.m.Unlock()
+
+	timer := rc.clock.NewTimer(rc.grace)
+	defer timer.Stop()
+	select {
+	case <-replaced:
+	case <-timer.C():
+	}
+
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	if rc.closed {
+		return false
+	}
+	if rc.leg != leg {
+		return true
+	}
+	if !rc.expired {
+		rc.expired = true
+		metrics.SessionResumptions.Inc(sessionResumeExpired)
+	}
+	return false
+}
+
+func (rc *resumableConn) Read(b []byte) (int, error) {
+	for {
+		conn, leg := rc.current()
+		n, err := conn.Read(b)
+		rc.m.Lock()
+		if rc.leg != leg && !rc.closed {
+			// The client resends what was read from the connection
+			// after it was replaced, the resume told it what was
+			// received before.
+			rc.m.Unlock()
+			continue
+		}
+		rc.received += uint64(n)
+		rc.m.Unlock()
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if isTimeout(err) || !rc.await(leg) {
+			return 0, err
+		}
+	}
+}
+
+func (rc *resumableConn) Write(b []byte) (int, error) {
+	rc.wm.Lock()
+	rc.m.Lock()
+	rc.unacked = append(rc.unacked, b...)
+	if extra := len(rc.unacked) - sessionResumeBufferSize; extra > 0 {
+		rc.unacked = rc.unacked[:copy(rc.unacked, rc.unacked[extra:])]
+	}
+	rc.sent += uint64(len(b))
+	conn, leg := rc.conn, rc.leg
+	pending := rc.pending
+	rc.pending = nil
+	rc.m.Unlock()
+	if pending != nil {
+		b = append(pending, b...)
+	}
+	_, err := conn.Write(b)
+	rc.wm.Unlock()
+
+	if err != nil {
+		// b is buffered, a resume resends what the client missed of it.
+		if isTimeout(err) || !rc.await(leg) {
+			return 0, err
+		}
+	}
+	return len(b) - len(pending), nil
+}
+
+// isTimeout reports whether err is a deadline passing, which a resume does
+// not help with.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// flushPending writes the reply to a resume, unless a Write already did.
+func (rc *resumableConn) flushPending() {
+	rc.wm.Lock()
+	defer rc.wm.Unlock()
+	rc.m.Lock()
+	conn, pending := rc.conn, rc.pending
+	rc.pending = nil
+	rc.m.Unlock()
+	if pending != nil {
+		// Should this fail the connection is as good as lost again,
+		// which reads and writes on it find out.
+		conn.Write(pending)
+	}
+}
+
+// resume replaces the connection with conn, of reg, if token is that of the
+// next resume. received is how much the client received of what was
+// written. It returns a channel closed once rc is done with conn.
+func (rc *resumableConn) resume(reg *DecoyRegistration, token []byte, received uint64, conn net.Conn) (<-chan struct{}, error) {
+	released, err := rc.replace(reg, token, received, conn)
+	if err != nil {
+		return nil, err
+	}
+	rc.flushPending()
+	return released, nil
+}
+
+// replace is resume up to writing the reply, which is left pending.
+func (rc *resumableConn) replace(reg *DecoyRegistration, token []byte, received uint64, conn net.Conn) (<-chan struct{}, error) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	if rc.closed || rc.expired {
+		return nil, errResumeUnknown
+	}
+	want, err := SessionResumeToken(rc.reg.Keys, rc.id, uint32(rc.leg+1))
+	if err != nil || reg.Keys.ConnTag != rc.reg.Keys.ConnTag || !hmac.Equal(token, want) {
+		return nil, errResumeBadToken
+	}
+	if received > rc.sent || rc.sent-received > uint64(len(rc.unacked)) {
+		return nil, errResumeGap
+	}
+
+	rc.conn.Close()
+	close(rc.released)
+	rc.conn = conn
+	rc.leg++
+	close(rc.replaced)
+	rc.replaced = make(chan struct{})
+	rc.released = make(chan struct{})
+	conn.SetReadDeadline(rc.readDeadline)
+	conn.SetWriteDeadline(rc.writeDeadline)
+
+	// A reply still pending went to the connection replaced, this one
+	// supersedes it.
+	reply := make([]byte, 9, 9+rc.sent-received)
+	reply[0] = sessionResumeOK
+	binary.BigEndian.PutUint64(reply[1:], rc.received)
+	rc.pending = append(reply, rc.unacked[uint64(len(rc.unacked))-(rc.sent-received):]...)
+	return rc.released, nil
+}
+
+// Close closes the connection, without waiting for a resume. The session is
+// no longer resumable.
+func (rc *resumableConn) Close() error {
+	rc.m.Lock()
+	if rc.closed {
+		rc.m.Unlock()
+		return nil
+	}
+	rc.closed = true
+	close(rc.replaced)
+	close(rc.released)
+	conn, id := rc.conn, rc.id
+	rc.m.Unlock()
+	if id != 0 {
+		Sessions().removeResumable(id)
+	}
+	return conn.Close()
+}
+
+// CloseWrite and CloseRead half-close the connection, if it supports it.
+func (rc *resumableConn) CloseWrite() error {
+	conn, _ := rc.current()
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (rc *resumableConn) CloseRead() error {
+	conn, _ := rc.current()
+	if cr, ok := conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (rc *resumableConn) LocalAddr() net.Addr {
+	conn, _ := rc.current()
+	return conn.LocalAddr()
+}
+
+func (rc *resumableConn) RemoteAddr() net.Addr {
+	conn, _ := rc.current()
+	return conn.RemoteAddr()
+}
+
+func (rc *resumableConn) SetDeadline(t time.Time) error {
+	if err := rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return rc.SetWriteDeadline(t)
+}
+
+func (rc *resumableConn) SetReadDeadline(t time.Time) error {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.readDeadline = t
+	return rc.conn.SetReadDeadline(t)
+}
+
+func (rc *resumableConn) SetWriteDeadline(t time.Time) error {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.writeDeadline = t
+	return rc.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// resumeTestCovert is an echo covert that counts the connections it accepts.
+func resumeTestCovert(t *testing.T) (addr string, accepted *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	accepted = new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), accepted
+}
+
+// proxyResumeTest proxies a new client connection for reg as Proxy does. done
+// is closed once Proxy returns.
+func proxyResumeTest(t *testing.T, reg *DecoyRegistration, conf *ProxyConfig) (client *net.TCPConn, done chan struct{}) {
+	client, stationClient := tcpPair(t)
+	t.Cleanup(func() { client.Close() })
+	done = make(chan struct{})
+	go func() {
+		Proxy(reg, stationClient, 443, nil, &Logger{log.New(ioutil.Discard, "", 0)}, conf)
+		stationClient.Close()
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, done
+}
+
+func readN(t *testing.T, conn net.Conn, n int) []byte {
+	b := make([]byte, n)
+	_, err := io.ReadFull(conn, b)
+	require.Nil(t, err)
+	return b
+}
+
+// resumeHeader returns the header of the resume-th resume of the session id
+// of reg, having received received bytes.
+func resumeHeader(t *testing.T, reg *DecoyRegistration, id uint64, resume uint32, received uint64) []byte {
+	token, err := SessionResumeToken(reg.Keys, id, resume)
+	require.Nil(t, err)
+	header := make([]byte, 1+8, 1+8+sessionResumeTokenLen+8)
+	header[0] = sessionResumeResume
+	binary.BigEndian.PutUint64(header[1:], id)
+	header = append(header, token...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], received)
+	return append(header, b[:]...)
+}
+
+func TestSessionResume(t *testing.T) {
+	covert, accepted := resumeTestCovert(t)
+	conf := &ProxyConfig{}
+	require.Nil(t, conf.parseSessionResume())
+
+	v6 := newConnTagTestReg(t, net.ParseIP("2001:db8::1"))
+	v6.Covert = covert
+	v6.SessionResumption = true
+	// The v4 registration of the same dual-stack client.
+	v4 := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Keys: v6.Keys, Covert: covert, SessionResumption: true}
+
+	client, done := proxyResumeTest(t, v6, conf)
+	_, err := client.Write(append([]byte{sessionResumeNew}, "hello"...))
+	require.Nil(t, err)
+	id := binary.BigEndian.Uint64(readN(t, client, 8))
+	require.NotEqual(t, uint64(0), id)
+	require.Equal(t, "hello", string(readN(t, client, 5)))
+
+	// The covert's echo of "lost" reaches the station but not the client,
+	// whose connection is then lost.
+	_, err = client.Write([]byte("lost"))
+	require.Nil(t, err)
+	Sessions().m.RLock()
+	rc := Sessions().resumable[id]
+	Sessions().m.RUnlock()
+	require.NotNil(t, rc)
+	for i := 0; ; i++ {
+		rc.m.Lock()
+		sent := rc.sent
+		rc.m.Unlock()
+		if sent == 9 {
+			break
+		}
+		require.Less(t, i, 500, "the covert's echo did not reach the station")
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.SetLinger(0)
+	client.Close()
+
+	resumed := metrics.SessionResumptions.Value(sessionResumeResumed)
+	badToken := metrics.SessionResumptions.Value(sessionResumeBadToken)
+
+	// The client resumes on the v4 phantom.
+	header := resumeHeader(t, v4, id, 1, 5)
+	client2, done2 := proxyResumeTest(t, v4, conf)
+	_, err = client2.Write(header)
+	require.Nil(t, err)
+	reply := readN(t, client2, 9)
+	require.Equal(t, byte(sessionResumeOK), reply[0])
+	require.Equal(t, uint64(9), binary.BigEndian.Uint64(reply[1:]))
+	require.Equal(t, "lost", string(readN(t, client2, 4)))
+	_, err = client2.Write([]byte("more"))
+	require.Nil(t, err)
+	require.Equal(t, "more", string(readN(t, client2, 4)))
+	require.Equal(t, resumed+1, metrics.SessionResumptions.Value(sessionResumeResumed))
+	require.Equal(t, int32(1), atomic.LoadInt32(accepted))
+
+	// An observed resume cannot be replayed.
+	client3, done3 := proxyResumeTest(t, v4, conf)
+	_, err = client3.Write(header)
+	require.Nil(t, err)
+	require.Equal(t, []byte{sessionResumeRejected}, readN(t, client3, 1))
+	waitDone(t, done3)
+	require.Equal(t, badToken+1, metrics.SessionResumptions.Value(sessionResumeBadToken))
+
+	// Neither can another registration's client resume the session.
+	other := newConnTagTestReg(t, v4.DarkDecoy)
+	other.Covert, other.SessionResumption = covert, true
+	client4, done4 := proxyResumeTest(t, other, conf)
+	_, err = client4.Write(resumeHeader(t, other, id, 2, 9))
+	require.Nil(t, err)
+	require.Equal(t, []byte{sessionResumeRejected}, readN(t, client4, 1))
+	waitDone(t, done4)
+
+	// The session still ends when the client closes it.
+	client2.CloseWrite()
+	_, err = ioutil.ReadAll(client2)
+	require.Nil(t, err)
+	waitDone(t, done2)
+	waitDone(t, done)
+	Sessions().m.RLock()
+	require.Nil(t, Sessions().resumable[id])
+	Sessions().m.RUnlock()
+}
+
+func TestSessionResumeGraceExpiry(t *testing.T) {
+	covert, _ := resumeTestCovert(t)
+	conf := &ProxyConfig{SessionResumeGrace: 200}
+	require.Nil(t, conf.parseSessionResume())
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert, reg.SessionResumption = covert, true
+
+	expired := metrics.SessionResumptions.Value(sessionResumeExpired)
+	unknown := metrics.SessionResumptions.Value(sessionResumeUnknown)
+	client, done := proxyResumeTest(t, reg, conf)
+	_, err := client.Write([]byte{sessionResumeNew})
+	require.Nil(t, err)
+	id := binary.BigEndian.Uint64(readN(t, client, 8))
+	client.SetLinger(0)
+	client.Close()
+
+	// Without a resume the session ends once the grace period is over.
+	waitDone(t, done)
+	require.Equal(t, expired+1, metrics.SessionResumptions.Value(sessionResumeExpired))
+
+	client2, done2 := proxyResumeTest(t, reg, conf)
+	_, err = client2.Write(resumeHeader(t, reg, id, 1, 0))
+	require.Nil(t, err)
+	require.Equal(t, []byte{sessionResumeRejected}, readN(t, client2, 1))
+	waitDone(t, done2)
+	require.Equal(t, unknown+1, metrics.SessionResumptions.Value(sessionResumeUnknown))
+}
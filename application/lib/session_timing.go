@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Stages of setting up a session, the stage label of
+// metrics.SessionSetupSeconds. Each is timed from the end of the one before.
+const (
+	SetupStageMatch         = "match"          // accepted until a transport found the registration
+	SetupStageAuth          = "auth"           // until the client passed every check before the covert is dialed
+	SetupStageCovertConnect = "covert_connect" // until the covert was dialed and any preamble or PROXY header written
+	SetupStageFirstByte     = "first_byte"     // until the first covert byte was read to relay to the client
+)
+
+// SessionTiming is when a connection reached each stage of setting up its
+// session, which together are the latency its client sees before the covert
+// answers. Stages a connection does not go through are zero, as are the
+// delays to and from them: the streams of a mux session are accepted and
+// matched with its connection, so only their later stages are timed.
+type SessionTiming struct {
+	Accepted time.Time // the station accepted the connection
+	Matched  time.Time // a transport found its registration
+
+	authenticated   time.Time
+	covertConnected time.Time
+	firstByte       time.Time // set by firstByteConn
+}
+
+// NewSessionTiming returns the timing of a connection accepted at accepted.
+func NewSessionTiming(accepted time.Time) *SessionTiming {
+	return &SessionTiming{Accepted: accepted}
+}
+
+// setupDelay is the time a session took to go through one stage.
+type setupDelay struct {
+	stage string
+	d     time.Duration
+}
+
+// delays returns the delays of the stages t went through, in order.
+func (t *SessionTiming) delays() []setupDelay {
+	marks := []time.Time{t.Accepted, t.Matched, t.authenticated, t.covertConnected, t.firstByte}
+	stages := []string{SetupStageMatch, SetupStageAuth, SetupStageCovertConnect, SetupStageFirstByte}
+	var delays []setupDelay
+	for i, stage := range stages {
+		if marks[i].IsZero() || marks[i+1].IsZero() {
+			continue
+		}
+		delays = append(delays, setupDelay{stage, marks[i+1].Sub(marks[i])})
+	}
+	return delays
+}
+
+// observe exports the delays of t as setup latencies of transport.
+func (t *SessionTiming) observe(transport string) {
+	for _, d := range t.delays() {
+		metrics.SessionSetupSeconds.Observe(d.d.Seconds(), d.stage, transport)
+	}
+}
+
+// String formats the delays of t for the session close log line, e.g.
+// "{match: 12ms, auth: 1ms, covert_connect: 40ms, first_byte: 85ms}".
+func (t *SessionTiming) String() string {
+	delays := t.delays()
+	parts := make([]string, len(delays))
+	for i, d := range delays {
+		parts[i] = fmt.Sprintf("%s: %v", d.stage, d.d.Round(time.Millisecond))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// withFirstByteTiming wraps covertConn to record in timing when the first
+// byte is read from it, unless DisableFirstByteTiming is set. conf may be
+// nil.
+func (c *ProxyConfig) withFirstByteTiming(covertConn net.Conn, timing *SessionTiming) net.Conn {
+	if c != nil && c.DisableFirstByteTiming {
+		return covertConn
+	}
+	return &firstByteConn{halfCloser: halfCloser{covertConn}, timing: timing, clock: c.getClock()}
+}
+
+// firstByteConn records the time of the first read returning data. Only the
+// down half of the proxy reads a covert connection, and the timing is read
+// once both halves are done, so the check costs a branch per read.
+type firstByteConn struct {
+	halfCloser
+	timing *SessionTiming
+	clock  clock.Clock
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.timing.firstByte.IsZero() {
+		c.timing.firstByte = c.clock.Now()
+	}
+	return n, err
+}
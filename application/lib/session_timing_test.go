@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTimingDelays(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	timing := NewSessionTiming(start)
+	timing.Matched = start.Add(12 * time.Millisecond)
+	timing.authenticated = start.Add(13 * time.Millisecond)
+	timing.covertConnected = start.Add(53 * time.Millisecond)
+	timing.firstByte = start.Add(138 * time.Millisecond)
+	require.Equal(t, "{match: 12ms, auth: 1ms, covert_connect: 40ms, first_byte: 85ms}", timing.String())
+
+	// A mux stream is not accepted or matched itself, a session without
+	// first byte timing never reads its first byte.
+	timing = &SessionTiming{authenticated: start, covertConnected: start.Add(40 * time.Millisecond)}
+	require.Equal(t, []setupDelay{{SetupStageCovertConnect, 40 * time.Millisecond}}, timing.delays())
+	require.Equal(t, "{}", (&SessionTiming{}).String())
+}
+
+// countSetup returns the number of observations of stage for sessions of
+// transport.
+func countSetup(stage, transport string) uint64 {
+	_, counts := metrics.SessionSetupSeconds.With(stage, transport).Snapshot()
+	var n uint64
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+func TestProxyWithTiming(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		covert := preambleCovert(t, func(conn net.Conn) { io.Copy(conn, conn) })
+		reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: covert}
+		transport := reg.Transport.String()
+		var before [4]uint64
+		stages := []string{SetupStageMatch, SetupStageAuth, SetupStageCovertConnect, SetupStageFirstByte}
+		for i, stage := range stages {
+			before[i] = countSetup(stage, transport)
+		}
+
+		client, stationClient := tcpPair(t)
+		var logs bytes.Buffer
+		timing := NewSessionTiming(time.Now())
+		timing.Matched = time.Now()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ProxyWithTiming(reg, stationClient, 443, timing, nil, &Logger{log.New(&logs, "", 0)}, &ProxyConfig{DisableFirstByteTiming: disabled})
+			stationClient.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := client.Write([]byte("ping"))
+		require.Nil(t, err)
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(client, reply)
+		require.Nil(t, err)
+		client.CloseWrite()
+		io.Copy(ioutil.Discard, client)
+		client.Close()
+		<-done
+
+		var closed string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "closed:") {
+				closed = line
+			}
+		}
+		require.Contains(t, closed, "setup {match: ")
+		require.Contains(t, closed, "covert_connect: ")
+		require.Equal(t, !disabled, strings.Contains(closed, "first_byte: "), closed)
+		for i, stage := range stages {
+			want := before[i] + 1
+			if disabled && stage == SetupStageFirstByte {
+				want = before[i]
+			}
+			require.Equal(t, want, countSetup(stage, transport), stage)
+		}
+	}
+}
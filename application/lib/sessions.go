@@ -0,0 +1,451 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// CloseReason is why a session ended. It is logged, published with the
+// connection's end event and counted in metrics.SessionCloseReasons.
+type CloseReason string
+
+// Reasons a session ends. The first thing to end either half of the proxy
+// decides it, what follows (e.g. the other half seeing the closed
+// connection) is a consequence.
+const (
+	CloseClientEOF   CloseReason = "client_eof"   // the client closed its side
+	CloseCovertEOF   CloseReason = "covert_eof"   // the covert closed its side
+	CloseIdleTimeout CloseReason = "idle_timeout" // a read or write timed out, or the reaper found it idle
+	CloseMaxLifetime CloseReason = "max_lifetime" // the reaper closed it for being too old
+	CloseReset       CloseReason = "reset"        // either side reset the connection
+	CloseCancelled   CloseReason = "cancelled"    // the station closed it
+	CloseDrained     CloseReason = "drained"      // its phantom subnet was drained
+	CloseCovertLimit CloseReason = "covert_limit" // the covert sent more than the session may relay
+	CloseError       CloseReason = "error"        // any other error on either side
+)
+
+// Reasons of metrics.SessionsCompleted, as they were before close reasons
+// were classified further so that dashboards and alerts on them still match.
+const (
+	sessionCompletedEOF     = "eof"
+	sessionCompletedTimeout = "timeout"
+	sessionCompletedError   = "error"
+	sessionCompletedReaped  = "reaped"
+)
+
+// Session tracks a single proxied connection from the point where the covert
+// leg is established until both halves of the proxy have finished.
+type Session struct {
+	ID        uint64
+	RegID     string
+	Phantom   net.IP
+	Covert    string
+	Transport string
+	Start     time.Time
+
+	// PhantomPort is the port the client connected to the phantom on.
+	PhantomPort int
+
+	// CovertAttempt is which of its registration's coverts Covert is: 1 for
+	// the registration's covert, 2 on for its fallbacks in order (see
+	// DecoyRegistration.CovertFallbacks).
+	CovertAttempt int
+
+	// TLS version and ALPN protocol negotiated with the covert, if the
+	// station speaks TLS to it (see ProxyConfig.CovertTLS).
+	CovertTLSVersion string
+	CovertALPN       string
+
+	// CovertEcho is set if the session was proxied to the station's embedded
+	// covert rather than Covert, see ProxyConfig.CovertEcho.
+	CovertEcho bool
+
+	// unix nanoseconds of the last successful read on either leg, by clock
+	lastActive int64
+	clock      clock.Clock
+
+	// traffic proxied in each direction, up is client to covert
+	bytesUp, bytesDown int64
+	readsUp, readsDown int64
+
+	// what was last exported as an IPFIX record, guarded by the exporter
+	exported flowCounters
+
+	clientConn net.Conn
+	covertConn net.Conn
+	closeOnce  sync.Once
+
+	// why the session ended, the first reason recorded wins
+	reasonMu    sync.Mutex
+	closeReason CloseReason
+	reaped      bool // closeReason was the reaper's
+	endOnce     sync.Once
+}
+
+// Touch records activity on the session. Safe to call on a nil session so
+// that proxy code paths without tracking need no special casing.
+func (s *Session) Touch() {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.lastActive, s.now().UnixNano())
+}
+
+func (s *Session) now() time.Time {
+	if s.clock == nil {
+		return clock.Real.Now()
+	}
+	return s.clock.Now()
+}
+
+// addTraffic counts n bytes proxied up or down, read at once. Safe to call on
+// a nil session.
+func (s *Session) addTraffic(up bool, n int) {
+	if s == nil {
+		return
+	}
+	if up {
+		atomic.AddInt64(&s.bytesUp, int64(n))
+		atomic.AddInt64(&s.readsUp, 1)
+	} else {
+		atomic.AddInt64(&s.bytesDown, int64(n))
+		atomic.AddInt64(&s.readsDown, 1)
+	}
+}
+
+// covertEchoing reports whether the session is proxied to the embedded
+// covert. Safe to call on a nil session.
+func (s *Session) covertEchoing() bool {
+	return s != nil && s.CovertEcho
+}
+
+// clientAddr returns the client's address, nil if unknown.
+func (s *Session) clientAddr() net.Addr {
+	if s.clientConn == nil {
+		return nil
+	}
+	return s.clientConn.RemoteAddr()
+}
+
+// LastActive returns the time of the last recorded activity on the session.
+func (s *Session) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+// noteEOF records that the source of the up (client) or down (covert) half
+// of the proxy closed as the reason the session ended, unless a reason was
+// already recorded. Safe to call on a nil session.
+func (s *Session) noteEOF(up bool) {
+	if s == nil {
+		return
+	}
+	if up {
+		s.setCloseReason(CloseClientEOF)
+	} else {
+		s.setCloseReason(CloseCovertEOF)
+	}
+}
+
+// noteErr records err, from either half of the proxy, as the reason the
+// session ended unless a reason was already recorded. Safe to call on a nil
+// session.
+func (s *Session) noteErr(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.setCloseReason(classifyCloseErr(err))
+}
+
+// classifyCloseErr returns the close reason for an error ending one half of
+// the proxy.
+func classifyCloseErr(err error) CloseReason {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrCovertResponseLimit):
+		return CloseCovertLimit
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseIdleTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return CloseReset
+	case errors.Is(err, context.Canceled),
+		// net.ErrClosed is only exported from Go 1.16.
+		strings.Contains(err.Error(), "use of closed network connection"),
+		errors.Is(err, io.ErrClosedPipe):
+		return CloseCancelled
+	default:
+		return CloseError
+	}
+}
+
+func (s *Session) setCloseReason(reason CloseReason) {
+	s.reasonMu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.reasonMu.Unlock()
+}
+
+// setReaped records reason, the reaper's, as the reason the session ended
+// unless a reason was already recorded.
+func (s *Session) setReaped(reason CloseReason) {
+	s.reasonMu.Lock()
+	if s.closeReason == "" {
+		s.closeReason, s.reaped = reason, true
+	}
+	s.reasonMu.Unlock()
+}
+
+// completedReason returns the reason label of metrics.SessionsCompleted for
+// the session.
+func (s *Session) completedReason() string {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	switch {
+	case s.reaped:
+		return sessionCompletedReaped
+	case s.closeReason == CloseClientEOF, s.closeReason == CloseCovertEOF:
+		return sessionCompletedEOF
+	case s.closeReason == CloseIdleTimeout:
+		return sessionCompletedTimeout
+	default:
+		return sessionCompletedError
+	}
+}
+
+// CloseReason returns why the session ended, empty while no reason was
+// recorded.
+func (s *Session) CloseReason() CloseReason {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	return s.closeReason
+}
+
+// end counts the session as ended, once however many times it is called. It
+// returns whether this call ended it.
+func (s *Session) end() bool {
+	ended := false
+	s.endOnce.Do(func() {
+		s.setCloseReason(CloseError)
+		metrics.SessionsOpen.Dec()
+		metrics.SessionsCompleted.Inc(s.completedReason())
+		metrics.SessionCloseReasons.Inc(string(s.CloseReason()))
+		metrics.SessionDurations.Observe(s.now().Sub(s.Start).Seconds())
+		metrics.SessionBytes.Observe(float64(atomic.LoadInt64(&s.bytesUp) + atomic.LoadInt64(&s.bytesDown)))
+		ended = true
+	})
+	return ended
+}
+
+// Close force-closes both legs of the session. The proxy goroutines notice the
+// closed connections and clean up as they would on a normal close.
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		if s.clientConn != nil {
+			s.clientConn.Close()
+		}
+		if s.covertConn != nil {
+			s.covertConn.Close()
+		}
+	})
+}
+
+// SessionTracker is the table of all active proxied sessions on the station.
+type SessionTracker struct {
+	m        sync.RWMutex
+	sessions map[uint64]*Session
+	nextID   uint64
+	exporter *IPFIXExporter
+	clock    clock.Clock
+
+	// resumable are the sessions a connection may resume, by ID.
+	resumable map[uint64]*resumableConn
+}
+
+// NewSessionTracker returns an empty session table.
+func NewSessionTracker() *SessionTracker {
+	return &SessionTracker{
+		sessions:  make(map[uint64]*Session),
+		clock:     clock.Real,
+		resumable: make(map[uint64]*resumableConn),
+	}
+}
+
+// SetClock sets the clock session activity, idle timeouts and lifetimes are
+// measured with, clock.Real by default. It must be set before sessions are
+// added.
+func (t *SessionTracker) SetClock(c clock.Clock) {
+	t.clock = c
+}
+
+var sessionsInstance *SessionTracker
+var sessionsOnce sync.Once
+
+// Sessions returns the station-wide session table.
+func Sessions() *SessionTracker {
+	sessionsOnce.Do(func() {
+		sessionsInstance = NewSessionTracker()
+	})
+	return sessionsInstance
+}
+
+// SetIPFIXExporter makes the tracker export a flow record for every session
+// that ends to e. It must be called before sessions are added.
+func (t *SessionTracker) SetIPFIXExporter(e *IPFIXExporter) {
+	t.exporter = e
+}
+
+// NextID allocates a session ID, for logging about a connection before its
+// session is tracked with AddWithID.
+func (t *SessionTracker) NextID() uint64 {
+	return atomic.AddUint64(&t.nextID, 1)
+}
+
+// Add starts tracking a session for the registration proxying between the
+// given client and covert connections.
+func (t *SessionTracker) Add(reg *DecoyRegistration, clientConn, covertConn net.Conn) *Session {
+	return t.AddWithID(t.NextID(), reg, clientConn, covertConn)
+}
+
+// AddWithID is Add for a session ID already allocated with NextID.
+func (t *SessionTracker) AddWithID(id uint64, reg *DecoyRegistration, clientConn, covertConn net.Conn) *Session {
+	return t.add(id, reg, 0, reg.Covert, clientConn, covertConn)
+}
+
+// add is AddWithID recording the phantom port the client connected to, zero
+// if unknown, and the covert dialed, that of reg or of one of its mux
+// streams.
+func (t *SessionTracker) add(id uint64, reg *DecoyRegistration, phantomPort int, covert string, clientConn, covertConn net.Conn) *Session {
+	now := t.clock.Now()
+	s := &Session{
+		ID:          id,
+		PhantomPort: phantomPort,
+		RegID:       reg.IDString(),
+		Phantom:     reg.DarkDecoy,
+		Covert:      covert,
+		Transport:   reg.Transport.String(),
+		Start:       now,
+		lastActive:  now.UnixNano(),
+		clock:       t.clock,
+		clientConn:  clientConn,
+		covertConn:  covertConn,
+	}
+
+	t.m.Lock()
+	t.sessions[s.ID] = s
+	t.m.Unlock()
+	metrics.SessionsOpen.Inc()
+	return s
+}
+
+// Remove stops tracking the session.
+func (t *SessionTracker) Remove(s *Session) {
+	if s == nil {
+		return
+	}
+	t.m.Lock()
+	delete(t.sessions, s.ID)
+	t.m.Unlock()
+	if s.end() && t.exporter != nil {
+		t.exporter.ExportEnded(s)
+	}
+}
+
+// Count returns the number of tracked sessions.
+func (t *SessionTracker) Count() int {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return len(t.sessions)
+}
+
+// drainPollInterval is how often Drain checks whether sessions are left.
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain waits up to timeout for every tracked session to end and returns the
+// number still open.
+func (t *SessionTracker) Drain(timeout time.Duration) int {
+	deadline := t.clock.Now().Add(timeout)
+	for {
+		n := t.Count()
+		if n == 0 || !t.clock.Now().Before(deadline) {
+			return n
+		}
+		<-t.clock.After(drainPollInterval)
+	}
+}
+
+// CloseMatching force-closes every session match returns true for, recording
+// reason as why it ended, and returns how many. The proxy goroutines stop
+// tracking them as they would on a normal close.
+func (t *SessionTracker) CloseMatching(match func(*Session) bool, reason CloseReason) int {
+	var matched []*Session
+	t.m.RLock()
+	for _, s := range t.sessions {
+		if match(s) {
+			matched = append(matched, s)
+		}
+	}
+	t.m.RUnlock()
+
+	// Close outside of the lock, closing a connection can block.
+	for _, s := range matched {
+		s.setCloseReason(reason)
+		s.Close()
+	}
+	return len(matched)
+}
+
+// Reap force-closes and stops tracking every session that has been idle for
+// longer than idleTimeout or alive for longer than maxLifetime. A zero
+// duration disables the corresponding limit. Reaped sessions are logged and
+// counted in stats.
+func (t *SessionTracker) Reap(idleTimeout, maxLifetime time.Duration, logger *log.Logger) int {
+	if idleTimeout <= 0 && maxLifetime <= 0 {
+		return 0
+	}
+
+	now := t.clock.Now()
+	var reaped []*Session
+
+	t.m.Lock()
+	for id, s := range t.sessions {
+		idle := now.Sub(s.LastActive())
+		age := now.Sub(s.Start)
+		switch {
+		case maxLifetime > 0 && age > maxLifetime:
+			s.setReaped(CloseMaxLifetime)
+		case idleTimeout > 0 && idle > idleTimeout:
+			s.setReaped(CloseIdleTimeout)
+		default:
+			continue
+		}
+		reaped = append(reaped, s)
+		delete(t.sessions, id)
+	}
+	t.m.Unlock()
+
+	// Close outside of the lock, closing a connection can block.
+	for _, s := range reaped {
+		s.Close()
+		if s.end() && t.exporter != nil {
+			t.exporter.ExportEnded(s)
+		}
+		Stat().AddReapedSession()
+		logger.Printf("reaped session %d %s -> %s (%s, age %v, idle %v)", s.ID, s.RegID, s.Covert, s.CloseReason(),
+			now.Sub(s.Start).Round(time.Second), now.Sub(s.LastActive()).Round(time.Second))
+	}
+	return len(reaped)
+}
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionReaper(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	tracker := NewSessionTracker()
+	tracker.SetClock(clk)
+
+	idleClient, idleCovert := net.Pipe()
+	activeClient, activeCovert := net.Pipe()
+	defer activeClient.Close()
+	defer activeCovert.Close()
+
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: "192.0.2.2:443"}
+	tracker.Add(reg, idleClient, idleCovert)
+	active := tracker.Add(reg, activeClient, activeCovert)
+	require.Equal(t, 2, tracker.Count())
+
+	// No limits means nothing is ever reaped
+	clk.Advance(time.Hour)
+	active.Touch()
+	require.Equal(t, 0, tracker.Reap(0, 0, logger))
+
+	require.Equal(t, 1, tracker.Reap(time.Minute, 0, logger))
+	require.Equal(t, 1, tracker.Count())
+
+	// The reaped session's connections are closed
+	_, err := idleClient.Write([]byte("x"))
+	require.NotNil(t, err)
+
+	// Active sessions are still reaped once they outlive the max lifetime
+	clk.Advance(time.Hour)
+	active.Touch()
+	require.Equal(t, 0, tracker.Reap(time.Minute, 0, logger))
+	require.Equal(t, 1, tracker.Reap(time.Minute, time.Hour, logger))
+	require.Equal(t, 0, tracker.Count())
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer ln.Close()
+	a, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	require.Nil(t, err)
+	b, err := ln.AcceptTCP()
+	require.Nil(t, err)
+	return a, b
+}
+
+// proxiedSession proxies between a client and a covert, as Proxy does, and
+// returns the client and covert peers along with the session. done is closed
+// once both halves of the proxy have finished.
+func proxiedSession(t *testing.T, tracker *SessionTracker) (client, covert *net.TCPConn, sess *Session, done chan struct{}) {
+	client, stationClient := tcpPair(t)
+	stationCovert, covert := tcpPair(t)
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: "192.0.2.2:443"}
+	sess = tracker.Add(reg, stationClient, stationCovert)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	done = make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		oncePrintErr := sync.Once{}
+		wg.Add(2)
+		go halfPipe(stationClient, stationCovert, &wg, &oncePrintErr, logger, "Up test", sess)
+		go halfPipe(stationCovert, stationClient, &wg, &oncePrintErr, logger, "Down test", sess)
+		wg.Wait()
+		stationClient.Close()
+		stationCovert.Close()
+		tracker.Remove(sess)
+		close(done)
+	}()
+	return client, covert, sess, done
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not finish")
+	}
+}
+
+func TestSessionCloseReasons(t *testing.T) {
+	tracker := NewSessionTracker()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	t.Run("client_eof", func(t *testing.T) {
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		defer covert.Close()
+		client.CloseWrite()
+		ioutil.ReadAll(covert)
+		covert.Close()
+		waitDone(t, done)
+		require.Equal(t, CloseClientEOF, sess.CloseReason())
+		require.Equal(t, sessionCompletedEOF, sess.completedReason())
+	})
+
+	t.Run("covert_eof", func(t *testing.T) {
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		covert.Close()
+		ioutil.ReadAll(client)
+		client.Close()
+		waitDone(t, done)
+		require.Equal(t, CloseCovertEOF, sess.CloseReason())
+		require.Equal(t, sessionCompletedEOF, sess.completedReason())
+	})
+
+	t.Run("idle_timeout", func(t *testing.T) {
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		defer covert.Close()
+		sess.clientConn.SetReadDeadline(time.Now())
+		sess.covertConn.SetReadDeadline(time.Now())
+		waitDone(t, done)
+		require.Equal(t, CloseIdleTimeout, sess.CloseReason())
+		require.Equal(t, sessionCompletedTimeout, sess.completedReason())
+	})
+
+	t.Run("reaped_idle", func(t *testing.T) {
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		defer covert.Close()
+		atomic.StoreInt64(&sess.lastActive, time.Now().Add(-time.Hour).UnixNano())
+		require.Equal(t, 1, tracker.Reap(time.Minute, 0, logger))
+		waitDone(t, done)
+		require.Equal(t, CloseIdleTimeout, sess.CloseReason())
+		require.Equal(t, sessionCompletedReaped, sess.completedReason())
+	})
+
+	t.Run("max_lifetime", func(t *testing.T) {
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		defer covert.Close()
+		sess.Start = time.Now().Add(-2 * time.Hour)
+		require.Equal(t, 1, tracker.Reap(time.Minute, time.Hour, logger))
+		waitDone(t, done)
+		require.Equal(t, CloseMaxLifetime, sess.CloseReason())
+		require.Equal(t, sessionCompletedReaped, sess.completedReason())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		resets := metrics.CovertRelayErrors.Value(covertErrReset)
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		covert.SetLinger(0)
+		covert.Close()
+		ioutil.ReadAll(client)
+		client.Close()
+		waitDone(t, done)
+		require.Equal(t, CloseReset, sess.CloseReason())
+		require.Equal(t, sessionCompletedError, sess.completedReason())
+		require.Equal(t, resets+1, metrics.CovertRelayErrors.Value(covertErrReset))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		other := metrics.CovertRelayErrors.Value(covertErrOther)
+		client, covert, sess, done := proxiedSession(t, tracker)
+		defer client.Close()
+		defer covert.Close()
+		sess.Close()
+		waitDone(t, done)
+		require.Equal(t, CloseCancelled, sess.CloseReason())
+		require.Equal(t, sessionCompletedError, sess.completedReason())
+		require.Equal(t, other, metrics.CovertRelayErrors.Value(covertErrOther))
+	})
+
+	require.Equal(t, CloseError, classifyCloseErr(errors.New("tls: bad record MAC")))
+	require.Equal(t, 0, tracker.Count())
+}
+
+func TestSessionsDrain(t *testing.T) {
+	tracker := NewSessionTracker()
+	require.Equal(t, 0, tracker.Drain(time.Hour))
+
+	client, covert := net.Pipe()
+	defer client.Close()
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), Covert: "192.0.2.2:443"}
+	s := tracker.Add(reg, client, covert)
+	require.Equal(t, 1, tracker.Drain(10*time.Millisecond))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tracker.Remove(s)
+	}()
+	require.Equal(t, 0, tracker.Drain(5*time.Second))
+}
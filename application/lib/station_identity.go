@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// StationHeader carries the ID of the station sharing a registration over
+// the registration API.
+const StationHeader = "X-Conjure-Station"
+
+// Metric labels of the station identity.
+const (
+	stationIDLabel     = "station_id"
+	stationRegionLabel = "region"
+)
+
+// StationIdentity tells apart the records of stations feeding shared
+// collectors. It is attached to every metric as labels, to events, IPFIX
+// flow records, alerts, traces and registrations shared over the API.
+type StationIdentity struct {
+	// Station ID, the host name if empty.
+	ID string `toml:"id"`
+
+	// Deployment region, omitted if empty.
+	Region string `toml:"region"`
+
+	// Further deployment labels. Names must be valid Prometheus label names
+	// other than station_id and region.
+	Labels map[string]string `toml:"labels"`
+}
+
+// stationIdentity is the identity set with SetStationIdentity, the host name
+// until then.
+var stationIdentity = defaultStationIdentity()
+
+func defaultStationIdentity() StationIdentity {
+	var s StationIdentity
+	if s.parse() != nil {
+		s.ID = "unknown"
+	}
+	return s
+}
+
+func (s *StationIdentity) parse() error {
+	if s.ID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("station id is not set and the host name is unknown: %v", err)
+		}
+		s.ID = host
+	}
+	for name := range s.Labels {
+		if name == stationIDLabel || name == stationRegionLabel {
+			return fmt.Errorf("station label %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// metricLabels returns the labels attached to every metric.
+func (s StationIdentity) metricLabels() map[string]string {
+	labels := map[string]string{stationIDLabel: s.ID}
+	if s.Region != "" {
+		labels[stationRegionLabel] = s.Region
+	}
+	for name, value := range s.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+func (s StationIdentity) String() string {
+	str := fmt.Sprintf("%q", s.ID)
+	if s.Region != "" {
+		str += fmt.Sprintf(" region %q", s.Region)
+	}
+	if len(s.Labels) > 0 {
+		pairs := make([]string, 0, len(s.Labels))
+		for name, value := range s.Labels {
+			pairs = append(pairs, name+"="+value)
+		}
+		sort.Strings(pairs)
+		str += " labels " + strings.Join(pairs, ",")
+	}
+	return str
+}
+
+// SetStationIdentity makes id the station's identity and labels every metric
+// with it. It must be called at startup, before any event, flow record or
+// trace is exported; the identity cannot change while the station runs.
+func SetStationIdentity(id StationIdentity) error {
+	if err := metrics.Default.SetConstLabels(id.metricLabels()); err != nil {
+		return fmt.Errorf("invalid station labels: %v", err)
+	}
+	stationIdentity = id
+	return nil
+}
+
+// Station returns the station's identity.
+func Station() StationIdentity {
+	return stationIdentity
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStationIdentityParse(t *testing.T) {
+	host, err := os.Hostname()
+	require.Nil(t, err)
+
+	var id StationIdentity
+	require.Nil(t, id.parse())
+	require.Equal(t, host, id.ID)
+
+	id = StationIdentity{ID: "s1"}
+	require.Nil(t, id.parse())
+	require.Equal(t, "s1", id.ID)
+
+	id = StationIdentity{Labels: map[string]string{"region": "eu"}}
+	require.NotNil(t, id.parse())
+}
+
+func TestSetStationIdentity(t *testing.T) {
+	defer func(id StationIdentity) { stationIdentity = id }(stationIdentity)
+	defer metrics.Default.SetConstLabels(nil)
+
+	require.NotNil(t, SetStationIdentity(StationIdentity{ID: "s1", Labels: map[string]string{"bad-name": "x"}}))
+	require.Nil(t, SetStationIdentity(StationIdentity{ID: "s1", Region: "eu", Labels: map[string]string{"site": "ams"}}))
+	require.Equal(t, "s1", Station().ID)
+
+	var buf bytes.Buffer
+	metrics.Default.Write(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		require.Contains(t, line, `station_id="s1"`)
+		require.Contains(t, line, `region="eu"`)
+		require.Contains(t, line, `site="ams"`)
+	}
+
+	events := NewEventStream(1)
+	c := events.subscribe()
+	events.Publish(Event{Type: EventConnectionStart})
+	var ev Event
+	require.Nil(t, json.Unmarshal(<-c.events, &ev))
+	require.Equal(t, "s1", ev.Station)
+	require.Equal(t, "eu", ev.Region)
+	require.Equal(t, map[string]string{"site": "ams"}, ev.Labels)
+}
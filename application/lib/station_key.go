@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"golang.org/x/crypto/curve25519"
+)
+
+// c2sWrapperRepresentativeField is the field number of the (optional) client
+// elligator representative in the C2SWrapper message. See proto/signalling.proto.
+const c2sWrapperRepresentativeField = 8
+
+// StationKey is the station's long term Curve25519 keypair used to compute
+// shared secrets with clients from the representative they embed in their
+// registration.
+type StationKey struct {
+	PrivateKey [32]byte
+	PublicKey  [32]byte
+}
+
+// MaxStationKeys bounds the number of station keys tried for each
+// registration.
+const MaxStationKeys = 4
+
+// LoadStationKeys loads the station keys at paths, given in priority order.
+func LoadStationKeys(paths []string) ([]*StationKey, error) {
+	if len(paths) > MaxStationKeys {
+		return nil, fmt.Errorf("too many station keys: %d (max %d)", len(paths), MaxStationKeys)
+	}
+
+	keys := make([]*StationKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := LoadStationKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// LoadStationKey reads the station private key from path, which may be any
+// LoadSecret uri. The format is the one used by the detector (see loadkey.c):
+// the raw 32 byte private key, optionally followed by the raw 32 byte public
+// key. If the public key is present it must match the private key.
+func LoadStationKey(path string) (*StationKey, error) {
+	keyBytes, err := LoadSecret(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load station key %s: %w", path, err)
+	}
+	defer zero(keyBytes)
+	if len(keyBytes) < 32 {
+		return nil, fmt.Errorf("%w: station key %s too short: %d bytes", ErrSecretMalformed, path, len(keyBytes))
+	}
+
+	key := &StationKey{}
+	copy(key.PrivateKey[:], keyBytes[:32])
+	pub, err := curve25519.X25519(key.PrivateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid station key %s: %v", ErrSecretMalformed, path, err)
+	}
+	copy(key.PublicKey[:], pub)
+
+	if len(keyBytes) >= 64 && !bytes.Equal(keyBytes[32:64], key.PublicKey[:]) {
+		return nil, fmt.Errorf("%w: public key in %s does not match private key", ErrSecretMalformed, path)
+	}
+
+	return key, nil
+}
+
+// SharedSecret recovers the client's public key from its elligator encoded
+// representative and computes the Curve25519 shared secret with the station
+// private key. This is the same exchange the detector performs on tagged
+// registrations.
+func (k *StationKey) SharedSecret(representative []byte) ([]byte, error) {
+	if len(representative) != ntor.RepresentativeLength {
+		return nil, fmt.Errorf("bad representative length %d", len(representative))
+	}
+
+	var repr ntor.Representative
+	copy(repr[:], representative)
+	// The client randomizes the two high bits, they are not part of the point.
+	repr[31] &= 0x3f
+
+	clientPub := repr.ToPublic()
+	sharedSecret, err := curve25519.X25519(k.PrivateKey[:], clientPub[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+	return sharedSecret, nil
+}
+
+// SharedSecretCandidate is a possible shared secret for a received
+// registration and the index of the station key that derived it, or -1 if the
+// secret was supplied by the publisher.
+type SharedSecretCandidate struct {
+	Secret   []byte
+	KeyIndex int
+}
+
+// SharedSecretCandidates returns the shared secrets to try for a wrapper
+// received from a registrar. If the raw message carries a client
+// representative and station keys are loaded, a secret is derived with every
+// key in priority order; the one the client used is the one its sealed
+// registration payload opens under. A plaintext payload is registered under
+// every candidate until a connection shows which one the client used, see
+// LinkKeyCandidates. Every key is always tried so that the work done does not
+// depend on which key the client used. Otherwise the secret supplied by the
+// publisher is used as is.
+func (regManager *RegistrationManager) SharedSecretCandidates(c2sw *pb.C2SWrapper, raw []byte) ([]SharedSecretCandidate, error) {
+	publisherSecret := []SharedSecretCandidate{{Secret: c2sw.GetSharedSecret(), KeyIndex: -1}}
+	if len(regManager.StationKeys) == 0 {
+		return publisherSecret, nil
+	}
+
+	repr, err := wrapperRepresentative(raw)
+	if err != nil {
+		return nil, err
+	}
+	if repr == nil {
+		return publisherSecret, nil
+	}
+
+	candidates := make([]SharedSecretCandidate, 0, len(regManager.StationKeys))
+	var firstErr error
+	for i, key := range regManager.StationKeys {
+		sharedSecret, err := key.SharedSecret(repr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		candidates = append(candidates, SharedSecretCandidate{Secret: sharedSecret, KeyIndex: i})
+	}
+	if len(candidates) == 0 {
+		return nil, firstErr
+	}
+	return candidates, nil
+}
+
+// keyCandidates are the registrations created from one message under
+// different station keys.
+type keyCandidates struct {
+	once sync.Once
+	regs []*DecoyRegistration
+}
+
+// LinkKeyCandidates links the registrations created from one message under
+// different station keys, those of a plaintext payload that does not choose
+// the key the client used. Only the registrations of that key will see a
+// connection whose transport tag validates, at which point BindStationKey
+// removes the others. Registrations all derived with one key are left as they
+// are.
+func LinkKeyCandidates(regs []*DecoyRegistration) {
+	keys := make(map[int]bool)
+	for _, reg := range regs {
+		keys[reg.StationKeyIndex] = true
+	}
+	if len(keys) < 2 {
+		return
+	}
+	c := &keyCandidates{regs: append([]*DecoyRegistration(nil), regs...)}
+	for _, reg := range regs {
+		reg.keyCandidates = c
+	}
+}
+
+// BindStationKey removes the registrations created from the same message as
+// reg under other station keys, once a connection matched reg, and returns how
+// many it removed. Only the first connection of the message does any work.
+func (regManager *RegistrationManager) BindStationKey(reg *DecoyRegistration) int {
+	c := reg.keyCandidates
+	if c == nil {
+		return 0
+	}
+	removed := 0
+	c.once.Do(func() {
+		for _, other := range c.regs {
+			if other.StationKeyIndex == reg.StationKeyIndex {
+				continue
+			}
+			if regManager.registeredDecoys.removeRegistration(other.IDString()+other.DarkDecoy.String()) != nil {
+				removed++
+			}
+		}
+	})
+	return removed
+}
+
+// wrapperRepresentative extracts the representative field from a marshaled
+// C2SWrapper, returning nil if the field is absent. The generated protobuf
+// package predates the field so the wire format is walked directly.
+func wrapperRepresentative(raw []byte) ([]byte, error) {
+	var repr []byte
+	err := walkC2SWrapper(raw, func(field uint64, varint uint64, data []byte) {
+		if field == c2sWrapperRepresentativeField && data != nil {
+			repr = data
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repr, nil
+}
+
+// walkC2SWrapper calls fn for every field in a marshaled C2SWrapper with the
+// value of varint fields or the contents of length delimited ones (data is
+// nil for every other wire type). It is used to read fields that the
+// generated protobuf package does not know about.
+func walkC2SWrapper(raw []byte, fn func(field uint64, varint uint64, data []byte)) error {
+	for len(raw) > 0 {
+		key, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return fmt.Errorf("malformed C2SWrapper field key")
+		}
+		raw = raw[n:]
+
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0: // varint
+			var v uint64
+			v, n = binary.Uvarint(raw)
+			if n <= 0 {
+				return fmt.Errorf("malformed C2SWrapper varint")
+			}
+			fn(field, v, nil)
+		case 1: // fixed64
+			n = 8
+		case 2: // length delimited
+			l, m := binary.Uvarint(raw)
+			if m <= 0 || l > uint64(len(raw)-m) {
+				return fmt.Errorf("malformed C2SWrapper length")
+			}
+			fn(field, 0, raw[m:m+int(l)])
+			n = m + int(l)
+		case 5: // fixed32
+			n = 4
+		default:
+			return fmt.Errorf("unsupported C2SWrapper wire type %d", wireType)
+		}
+		if n > len(raw) {
+			return fmt.Errorf("truncated C2SWrapper")
+		}
+		raw = raw[n:]
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"golang.org/x/crypto/curve25519"
+)
+
+func writeStationKey(t *testing.T, contents []byte) string {
+	path := filepath.Join(t.TempDir(), "privkey")
+	require.Nil(t, ioutil.WriteFile(path, contents, 0600))
+	return path
+}
+
+func TestLoadStationKey(t *testing.T) {
+	kp, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+
+	// privkey only
+	key, err := LoadStationKey(writeStationKey(t, kp.Private()[:]))
+	require.Nil(t, err)
+	require.Equal(t, kp.Public()[:], key.PublicKey[:])
+
+	// privkey || pubkey
+	key, err = LoadStationKey(writeStationKey(t, append(kp.Private()[:], kp.Public()[:]...)))
+	require.Nil(t, err)
+	require.Equal(t, kp.Private()[:], key.PrivateKey[:])
+
+	// privkey || someone else's pubkey
+	other, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+	_, err = LoadStationKey(writeStationKey(t, append(kp.Private()[:], other.Public()[:]...)))
+	require.Contains(t, err.Error(), "does not match")
+
+	_, err = LoadStationKey(writeStationKey(t, kp.Private()[:16]))
+	require.Contains(t, err.Error(), "too short")
+}
+
+func TestStationKeySharedSecret(t *testing.T) {
+	stationKP, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+	key, err := LoadStationKey(writeStationKey(t, stationKP.Private()[:]))
+	require.Nil(t, err)
+
+	for i := 0; i < 8; i++ {
+		clientKP, err := ntor.NewKeypair(true)
+		require.Nil(t, err)
+
+		expected, err := curve25519.X25519(clientKP.Private()[:], stationKP.Public()[:])
+		require.Nil(t, err)
+
+		repr := *clientKP.Representative()
+		// The client sets the high bits at random.
+		repr[31] |= byte(i<<6) & 0xc0
+
+		sharedSecret, err := key.SharedSecret(repr[:])
+		require.Nil(t, err)
+		require.Equal(t, expected, sharedSecret)
+	}
+
+	_, err = key.SharedSecret(make([]byte, 31))
+	require.NotNil(t, err)
+}
+
+func TestSharedSecretCandidates(t *testing.T) {
+	newKP, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+	oldKP, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+
+	// The client still holds the old station public key.
+	clientKP, err := ntor.NewKeypair(true)
+	require.Nil(t, err)
+	expected, err := curve25519.X25519(clientKP.Private()[:], oldKP.Public()[:])
+	require.Nil(t, err)
+
+	regManager := &RegistrationManager{}
+	regManager.StationKeys, err = LoadStationKeys([]string{
+		writeStationKey(t, newKP.Private()[:]),
+		writeStationKey(t, oldKP.Private()[:]),
+	})
+	require.Nil(t, err)
+	require.Len(t, regManager.StationKeys, 2)
+
+	c2sw := &pb.C2SWrapper{
+		SharedSecret:        []byte("publisher supplied secret"),
+		RegistrationPayload: &pb.ClientToStation{CovertAddress: proto.String("1.2.3.4:443")},
+	}
+	raw, err := proto.Marshal(c2sw)
+	require.Nil(t, err)
+
+	// No representative: the publisher supplied secret is used.
+	parsed := &pb.C2SWrapper{}
+	require.Nil(t, proto.Unmarshal(raw, parsed))
+	candidates, err := regManager.SharedSecretCandidates(parsed, raw)
+	require.Nil(t, err)
+	require.Equal(t, []SharedSecretCandidate{{Secret: []byte("publisher supplied secret"), KeyIndex: -1}}, candidates)
+
+	// Representative present (field 8, length delimited): one secret per key.
+	raw = append(raw, c2sWrapperRepresentativeField<<3|2, ntor.RepresentativeLength)
+	raw = append(raw, clientKP.Representative()[:]...)
+	parsed = &pb.C2SWrapper{}
+	require.Nil(t, proto.Unmarshal(raw, parsed))
+	require.Equal(t, "1.2.3.4:443", parsed.GetRegistrationPayload().GetCovertAddress())
+	candidates, err = regManager.SharedSecretCandidates(parsed, raw)
+	require.Nil(t, err)
+	require.Len(t, candidates, 2)
+	require.Equal(t, 0, candidates[0].KeyIndex)
+	require.NotEqual(t, expected, candidates[0].Secret)
+	require.Equal(t, 1, candidates[1].KeyIndex)
+	require.Equal(t, expected, candidates[1].Secret)
+
+	_, err = wrapperRepresentative(raw[:len(raw)-1])
+	require.NotNil(t, err)
+
+	// Without station keys the representative is ignored.
+	candidates, err = (&RegistrationManager{}).SharedSecretCandidates(parsed, raw)
+	require.Nil(t, err)
+	require.Equal(t, -1, candidates[0].KeyIndex)
+}
+
+func TestLoadStationKeysBound(t *testing.T) {
+	kp, err := ntor.NewKeypair(false)
+	require.Nil(t, err)
+	path := writeStationKey(t, kp.Private()[:])
+
+	paths := []string{}
+	for i := 0; i <= MaxStationKeys; i++ {
+		paths = append(paths, path)
+	}
+	_, err = LoadStationKeys(paths)
+	require.NotNil(t, err)
+
+	keys, err := LoadStationKeys(paths[:MaxStationKeys])
+	require.Nil(t, err)
+	require.Len(t, keys, MaxStationKeys)
+}
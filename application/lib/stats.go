@@ -1,18 +1,20 @@
 package lib
 
 import (
-	"log"
-	"os"
+	"fmt"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/refraction-networking/conjure/application/clock"
+	"github.com/refraction-networking/conjure/application/metrics"
+
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 )
 
 // We would use uint64, but we want to atomically subtract sometimes
 type Stats struct {
-	logger      *log.Logger
 	activeConns int64 // incremented on add, decremented on remove, not reset
 	newConns    int64 // new connections since last stats.reset()
 	newErrConns int64 // new connections that had some sort of error since last reset()
@@ -20,21 +22,105 @@ type Stats struct {
 	activeRegistrations     int64 // Current number of active registrations we have
 	newLocalRegistrations   int64 // Current registrations that were picked up from this detector (also included in newRegistrations)
 	newApiRegistrations     int64 // Current registrations that we heard about from the API (also included in newRegistrations)
+	newStationAPIRegs       int64 // Registrations POSTed to this station's own registration endpoint
 	newSharedRegistrations  int64 // Current registrations that we heard about from the API sharing system (also included in newRegistrations)
 	newUnknownRegistrations int64 // Current registrations that we heard about with unknown source (also included in newRegistrations)a
 	newRegistrations        int64 // Added registrations since last reset()
 	newMissedRegistrations  int64 // number of "missed" registrations (as seen by a connection with no registration)
 	newErrRegistrations     int64 // number of registrations that had some kinda error
 	newDupRegistrations     int64 // number of duplicate registrations (doesn't uniquify, so might have some double counting)
+	newAuthErrRegistrations int64 // number of registrations whose encrypted payload failed authentication
+	newPastExpiryRegs       int64 // number of registrations rejected because their wire expiry had passed
 
 	newLivenessPass int64 // Liveness tests that passed (non-live phantom) since reset()
 	newLivenessFail int64 // Liveness tests that failed (live phantom) since reset()
+	newLivenessTCP  int64 // Live phantoms found by the TCP probe since reset()
+	newLivenessICMP int64 // Live phantoms found by the ICMP probe since reset()
+	newLivenessErr  int64 // Liveness probes that could not be sent or failed since reset()
+
+	newPendingServed     int64 // Connections matched to registrations pending their liveness check since reset()
+	newLivenessConfirmed int64 // Pending registrations confirmed by their liveness check since reset()
+	newLivenessEvicted   int64 // Pending registrations evicted because the phantom was live since reset()
+	newPendingExpired    int64 // Pending registrations dropped because their liveness check was too late since reset()
+
+	newLivePhantomReject  int64 // Registrations rejected for a live phantom since reset()
+	newLivePhantomLogOnly int64 // Registrations kept despite a live phantom since reset()
+	newLivePhantomDivert  int64 // Registrations with a live phantom diverted to the mask host since reset()
+	newLivePhantomConns   int64 // Connections to registrations with a live phantom since reset()
+
+	newLivenessCacheHit  int64 // Liveness checks answered from the liveness cache since reset()
+	newLivenessCacheMiss int64 // Liveness checks that had to probe since reset()
+	newLivenessReports   int64 // Phantoms reported live by the detector since reset()
+
+	newLivenessSubnetSkip int64 // Liveness probes skipped for subnets known not to be live since reset()
+
+	newReapedSessions int64 // Sessions force-closed by the session reaper since reset()
+
+	parkedConns     int64 // Current number of connections parked waiting for their registration, not reset
+	newParkRescued  int64 // Parked connections whose registration arrived since reset()
+	newParkTimeouts int64 // Parked connections whose registration did not arrive in time since reset()
+	newParkFull     int64 // Connections not parked because the parking was full since reset()
+
+	newDroppedEvents int64 // Events dropped for slow event stream consumers since reset()
+
+	newCovertDials     int64 // Sessions' covert dials since reset()
+	newCovertDialFails int64 // Sessions' covert dials that failed (every candidate address) since reset()
+
+	newCovertFallbackDials int64 // Sessions' covert dials that connected to a fallback covert since reset()
+
+	newStationKeyUses [MaxStationKeys]int64 // Connections matched to a registration derived with each station key since reset()
+
+	connTagIndexSize int64 // Current number of registrations in the connection tag index, not reset
+
+	internedStrings    int64 // Current number of distinct coverts and masks of tracked registrations, not reset
+	registrationMemory int32 // Whether the heartbeat reports heap bytes per registration, see SetRegistrationMemory
+
+	registrationAges *durationHistogram // Age of registrations when a connection is matched to them since reset()
+	covertWrites     *durationHistogram // Time spent blocked in each write to a covert since reset()
+
+	sessionDurations *histogramInterval // Durations of sessions ended since the last report
+	sessionBytes     *histogramInterval // Bytes proxied by sessions ended since the last report
+
+	bucketMutex *sync.Mutex   // Lock for bucketConns map
+	bucketConns map[int]int64 // Connections matched to a registration in each experiment bucket since reset()
 
 	genMutex    *sync.Mutex      // Lock for generations map
 	generations map[uint32]int64 // Map from ClientConf generation to number of registrations we saw using it
 
 	newBytesUp   int64 // TODO: need to redo halfPipe to make this not really jumpy
 	newBytesDown int64 // ditto
+
+	totalBytesUp   int64 // Bytes proxied towards the covert since start, not reset
+	totalBytesDown int64 // Bytes proxied towards the client since start, not reset
+
+	snapshotMutex    sync.Mutex
+	snapshotHandlers []func(StatsSnapshot)
+	lastSnapshot     time.Time
+
+	clock clock.Clock // of snapshots and registration ages, clock.Real if nil
+}
+
+func (s *Stats) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// StatsSnapshot holds some of the counters of one stats interval, taken just
+// before they are reset. Watching snapshots adds no work where the counters
+// are updated.
+type StatsSnapshot struct {
+	Time     time.Time     `json:"-"`
+	Interval time.Duration `json:"interval_ns"` // since the previous snapshot
+
+	NewConns            int64 `json:"new_conns"`
+	NewRegistrations    int64 `json:"new_registrations"`
+	NewDupRegistrations int64 `json:"new_dup_registrations"`
+	NewErrRegistrations int64 `json:"new_err_registrations"`
+	CovertDials         int64 `json:"covert_dials"`
+	CovertDialFailures  int64 `json:"covert_dial_failures"`
+	CovertFallbackDials int64 `json:"covert_fallback_dials"`
 }
 
 var statInstance Stats
@@ -46,24 +132,24 @@ func Stat() *Stats {
 	return &statInstance
 }
 
+// initStats sets up the stats, which a Reporter reports and resets
+// periodically (see Reporter.RegisterStats).
 func initStats() {
-	logger := log.New(os.Stdout, "[STATS] ", log.Ldate|log.Lmicroseconds)
 	statInstance = Stats{
-		logger:      logger,
 		generations: make(map[uint32]int64),
 		genMutex:    &sync.Mutex{},
-	}
+		bucketConns: make(map[int]int64),
+		bucketMutex: &sync.Mutex{},
 
-	// Periodic PrintStats()
-	ticker := time.NewTicker(5 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				statInstance.PrintStats()
-			}
-		}
-	}()
+		// Registrations expire after 6 hours (see getExpiredRegistrations)
+		registrationAges: newDurationHistogram(time.Second, 5*time.Second, 30*time.Second,
+			time.Minute, 5*time.Minute, 30*time.Minute, time.Hour, 6*time.Hour),
+		covertWrites: newDurationHistogram(time.Millisecond, 10*time.Millisecond, 100*time.Millisecond,
+			time.Second, 10*time.Second),
+		sessionDurations: &histogramInterval{h: metrics.SessionDurations, format: formatSecondsBound},
+		sessionBytes:     &histogramInterval{h: metrics.SessionBytes, format: formatBytesBound},
+		clock:            clock.Real,
+	}
 }
 
 func (s *Stats) Reset() {
@@ -71,28 +157,129 @@ func (s *Stats) Reset() {
 	atomic.StoreInt64(&s.newRegistrations, 0)
 	atomic.StoreInt64(&s.newLocalRegistrations, 0)
 	atomic.StoreInt64(&s.newApiRegistrations, 0)
+	atomic.StoreInt64(&s.newStationAPIRegs, 0)
 	atomic.StoreInt64(&s.newSharedRegistrations, 0)
 	atomic.StoreInt64(&s.newUnknownRegistrations, 0)
 	atomic.StoreInt64(&s.newMissedRegistrations, 0)
 	atomic.StoreInt64(&s.newErrRegistrations, 0)
 	atomic.StoreInt64(&s.newDupRegistrations, 0)
+	atomic.StoreInt64(&s.newAuthErrRegistrations, 0)
+	atomic.StoreInt64(&s.newPastExpiryRegs, 0)
 	atomic.StoreInt64(&s.newLivenessPass, 0)
 	atomic.StoreInt64(&s.newLivenessFail, 0)
+	atomic.StoreInt64(&s.newLivenessTCP, 0)
+	atomic.StoreInt64(&s.newLivenessICMP, 0)
+	atomic.StoreInt64(&s.newLivenessErr, 0)
+	atomic.StoreInt64(&s.newLivenessCacheHit, 0)
+	atomic.StoreInt64(&s.newPendingServed, 0)
+	atomic.StoreInt64(&s.newLivenessConfirmed, 0)
+	atomic.StoreInt64(&s.newLivenessEvicted, 0)
+	atomic.StoreInt64(&s.newPendingExpired, 0)
+	atomic.StoreInt64(&s.newLivePhantomReject, 0)
+	atomic.StoreInt64(&s.newLivePhantomLogOnly, 0)
+	atomic.StoreInt64(&s.newLivePhantomDivert, 0)
+	atomic.StoreInt64(&s.newLivePhantomConns, 0)
+	atomic.StoreInt64(&s.newLivenessCacheMiss, 0)
+	atomic.StoreInt64(&s.newLivenessReports, 0)
+	atomic.StoreInt64(&s.newLivenessSubnetSkip, 0)
+	atomic.StoreInt64(&s.newReapedSessions, 0)
+	atomic.StoreInt64(&s.newParkRescued, 0)
+	atomic.StoreInt64(&s.newParkTimeouts, 0)
+	atomic.StoreInt64(&s.newParkFull, 0)
+	atomic.StoreInt64(&s.newDroppedEvents, 0)
+	atomic.StoreInt64(&s.newCovertDials, 0)
+	atomic.StoreInt64(&s.newCovertDialFails, 0)
+	atomic.StoreInt64(&s.newCovertFallbackDials, 0)
+	for i := range s.newStationKeyUses {
+		atomic.StoreInt64(&s.newStationKeyUses[i], 0)
+	}
+	s.registrationAges.Reset()
+	s.covertWrites.Reset()
+	s.bucketMutex.Lock()
+	s.bucketConns = make(map[int]int64)
+	s.bucketMutex.Unlock()
 	atomic.StoreInt64(&s.newBytesUp, 0)
 	atomic.StoreInt64(&s.newBytesDown, 0)
 }
 
-func (s *Stats) PrintStats() {
-	s.logger.Printf("Conns: %d cur %d new %d err Regs: %d cur %d new (%d local %d API %d shared %d unknown) %d miss %d err %d dup LiveT: %d valid %d live Byte: %d up %d down",
+// stationStats are the fields of the station stats report.
+type stationStats struct {
+	ActiveConns         int64 `json:"active_conns"`
+	ActiveRegistrations int64 `json:"active_registrations"`
+	StatsSnapshot
+}
+
+// Report returns the station stats report of the interval since the
+// previous one, and starts the next interval: snapshot handlers are called
+// and the per interval counters reset.
+func (s *Stats) Report() StatsReport {
+	line := fmt.Sprintf("Conns: %d cur %d new %d err Regs: %d cur %d new (%d local %d API %d station-API %d shared %d unknown) %d miss %d err %d dup %d auth %d past-expiry LiveT: %d valid %d live (%d tcp %d icmp) %d err %d queued (cache %d hit %d miss %d reported) (subnet %d skip) Pending: %d served %d confirmed %d evicted %d expired LivePolicy: %d reject %d log-only %d divert (%d conns) Byte: %d up %d down Reaped: %d Parked: %d cur %d rescued %d timeout %d full EvDrop: %d Keys: %v Buckets: %v RegAge: %v CovertWr: %v (%v blocked) SessDur: %v SessBytes: %v TagIdx: %d",
 		atomic.LoadInt64(&s.activeConns), atomic.LoadInt64(&s.newConns), atomic.LoadInt64(&s.newErrConns),
 		atomic.LoadInt64(&s.activeRegistrations),
 		atomic.LoadInt64(&s.newRegistrations),
-		atomic.LoadInt64(&s.newLocalRegistrations), atomic.LoadInt64(&s.newApiRegistrations), atomic.LoadInt64(&s.newSharedRegistrations), atomic.LoadInt64(&s.newUnknownRegistrations),
+		atomic.LoadInt64(&s.newLocalRegistrations), atomic.LoadInt64(&s.newApiRegistrations), atomic.LoadInt64(&s.newStationAPIRegs), atomic.LoadInt64(&s.newSharedRegistrations), atomic.LoadInt64(&s.newUnknownRegistrations),
 		atomic.LoadInt64(&s.newMissedRegistrations),
-		atomic.LoadInt64(&s.newErrRegistrations), atomic.LoadInt64(&s.newDupRegistrations),
+		atomic.LoadInt64(&s.newErrRegistrations), atomic.LoadInt64(&s.newDupRegistrations), atomic.LoadInt64(&s.newAuthErrRegistrations), atomic.LoadInt64(&s.newPastExpiryRegs),
 		atomic.LoadInt64(&s.newLivenessPass), atomic.LoadInt64(&s.newLivenessFail),
-		atomic.LoadInt64(&s.newBytesUp), atomic.LoadInt64(&s.newBytesDown))
+		atomic.LoadInt64(&s.newLivenessTCP), atomic.LoadInt64(&s.newLivenessICMP), atomic.LoadInt64(&s.newLivenessErr),
+		LivenessQueueDepth(),
+		atomic.LoadInt64(&s.newLivenessCacheHit), atomic.LoadInt64(&s.newLivenessCacheMiss),
+		atomic.LoadInt64(&s.newLivenessReports),
+		atomic.LoadInt64(&s.newLivenessSubnetSkip),
+		atomic.LoadInt64(&s.newPendingServed), atomic.LoadInt64(&s.newLivenessConfirmed),
+		atomic.LoadInt64(&s.newLivenessEvicted), atomic.LoadInt64(&s.newPendingExpired),
+		atomic.LoadInt64(&s.newLivePhantomReject), atomic.LoadInt64(&s.newLivePhantomLogOnly),
+		atomic.LoadInt64(&s.newLivePhantomDivert), atomic.LoadInt64(&s.newLivePhantomConns),
+		atomic.LoadInt64(&s.newBytesUp), atomic.LoadInt64(&s.newBytesDown),
+		atomic.LoadInt64(&s.newReapedSessions),
+		atomic.LoadInt64(&s.parkedConns), atomic.LoadInt64(&s.newParkRescued),
+		atomic.LoadInt64(&s.newParkTimeouts), atomic.LoadInt64(&s.newParkFull),
+		atomic.LoadInt64(&s.newDroppedEvents),
+		s.stationKeyUses(),
+		s.experimentBucketConns(),
+		s.registrationAges,
+		s.covertWrites, s.covertWrites.Sum().Truncate(time.Millisecond),
+		s.sessionDurations, s.sessionBytes,
+		atomic.LoadInt64(&s.connTagIndexSize))
+	fields := stationStats{
+		ActiveConns:         atomic.LoadInt64(&s.activeConns),
+		ActiveRegistrations: atomic.LoadInt64(&s.activeRegistrations),
+		StatsSnapshot:       s.snapshot(),
+	}
 	s.Reset()
+	return StatsReport{Line: line, Fields: fields}
+}
+
+// OnSnapshot calls f with a snapshot of every stats interval, from the stats
+// goroutine. f must not block.
+func (s *Stats) OnSnapshot(f func(StatsSnapshot)) {
+	s.snapshotMutex.Lock()
+	s.snapshotHandlers = append(s.snapshotHandlers, f)
+	s.snapshotMutex.Unlock()
+}
+
+func (s *Stats) snapshot() StatsSnapshot {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+	now := s.now()
+	snap := StatsSnapshot{
+		Time:                now,
+		NewConns:            atomic.LoadInt64(&s.newConns),
+		NewRegistrations:    atomic.LoadInt64(&s.newRegistrations),
+		NewDupRegistrations: atomic.LoadInt64(&s.newDupRegistrations),
+		NewErrRegistrations: atomic.LoadInt64(&s.newErrRegistrations),
+		CovertDials:         atomic.LoadInt64(&s.newCovertDials),
+		CovertDialFailures:  atomic.LoadInt64(&s.newCovertDialFails),
+		CovertFallbackDials: atomic.LoadInt64(&s.newCovertFallbackDials),
+	}
+	if !s.lastSnapshot.IsZero() {
+		snap.Interval = now.Sub(s.lastSnapshot)
+	}
+	s.lastSnapshot = now
+	for _, f := range s.snapshotHandlers {
+		f(snap)
+	}
+	return snap
 }
 
 func (s *Stats) AddConn() {
@@ -129,18 +316,59 @@ func (s *Stats) AddReg(generation uint32, source *pb.RegistrationSource) {
 	s.genMutex.Lock()
 	s.generations[generation] += 1
 	s.genMutex.Unlock()
+
+	metrics.Registrations.Inc(registrationSourceLabel(source))
+	metrics.RegistrationsActive.Inc()
+}
+
+// registrationSourceLabel is the source label of registration metrics.
+func registrationSourceLabel(source *pb.RegistrationSource) string {
+	switch *source {
+	case pb.RegistrationSource_Detector:
+		return "detector"
+	case pb.RegistrationSource_API:
+		return "api"
+	case pb.RegistrationSource_DetectorPrescan:
+		return "detector_prescan"
+	default:
+		return "unspecified"
+	}
+}
+
+// AddStationAPIReg counts a registration received over the station's own
+// registration endpoint rather than from a registrar.
+func (s *Stats) AddStationAPIReg() {
+	atomic.AddInt64(&s.newStationAPIRegs, 1)
 }
 
 func (s *Stats) AddDupReg() {
 	atomic.AddInt64(&s.newDupRegistrations, 1)
+	metrics.RegistrationStates.Inc("duplicate")
 }
 
 func (s *Stats) AddErrReg() {
 	atomic.AddInt64(&s.newErrRegistrations, 1)
+	metrics.RegistrationStates.Inc("error")
+}
+
+// AddAuthErrReg counts a registration whose encrypted payload could not be
+// decrypted with any candidate shared secret.
+func (s *Stats) AddAuthErrReg() {
+	atomic.AddInt64(&s.newAuthErrRegistrations, 1)
+	metrics.RegistrationStates.Inc("auth_error")
+}
+
+// AddPastExpiryReg counts a registration rejected because the expiry it
+// carried on the wire had already passed.
+func (s *Stats) AddPastExpiryReg() {
+	atomic.AddInt64(&s.newPastExpiryRegs, 1)
+	metrics.RegistrationStates.Inc("past_expiry")
 }
 
 func (s *Stats) ExpireReg(generation uint32, source *pb.RegistrationSource) {
 	atomic.AddInt64(&s.activeRegistrations, -1)
+	metrics.RegistrationsActive.Dec()
+	metrics.RegistrationStates.Inc("expired")
 
 	/*
 		if *source == pb.RegistrationSource_Detector {
@@ -155,6 +383,28 @@ func (s *Stats) ExpireReg(generation uint32, source *pb.RegistrationSource) {
 
 func (s *Stats) AddMissedReg() {
 	atomic.AddInt64(&s.newMissedRegistrations, 1)
+	metrics.RegistrationStates.Inc("missed")
+}
+
+// AddDroppedEvent counts an event dropped because an event stream consumer
+// was not keeping up.
+func (s *Stats) AddDroppedEvent() {
+	atomic.AddInt64(&s.newDroppedEvents, 1)
+}
+
+// AddCovertDial counts a session's covert dial, failed if no candidate
+// address could be connected to.
+func (s *Stats) AddCovertDial(ok bool) {
+	atomic.AddInt64(&s.newCovertDials, 1)
+	if !ok {
+		atomic.AddInt64(&s.newCovertDialFails, 1)
+	}
+}
+
+// AddCovertFallbackDial counts a session's covert dial that connected to a
+// fallback covert.
+func (s *Stats) AddCovertFallbackDial() {
+	atomic.AddInt64(&s.newCovertFallbackDials, 1)
 }
 
 func (s *Stats) AddLivenessPass() {
@@ -165,12 +415,192 @@ func (s *Stats) AddLivenessFail() {
 	atomic.AddInt64(&s.newLivenessFail, 1)
 }
 
+// AddLivenessMethod counts a live phantom by the probe method that found it.
+func (s *Stats) AddLivenessMethod(method string) {
+	switch method {
+	case livenessTCP:
+		atomic.AddInt64(&s.newLivenessTCP, 1)
+	case livenessICMP:
+		atomic.AddInt64(&s.newLivenessICMP, 1)
+	}
+}
+
+// AddPendingServed counts a connection matched to a registration that is
+// still pending its liveness check.
+func (s *Stats) AddPendingServed() {
+	atomic.AddInt64(&s.newPendingServed, 1)
+}
+
+// AddLivenessConfirmed counts a pending registration whose phantom was found
+// not to be live.
+func (s *Stats) AddLivenessConfirmed() {
+	atomic.AddInt64(&s.newLivenessConfirmed, 1)
+	metrics.RegistrationStates.Inc("pending_confirmed")
+}
+
+// AddLivenessEvicted counts a pending registration evicted because its
+// phantom was live.
+func (s *Stats) AddLivenessEvicted() {
+	atomic.AddInt64(&s.newLivenessEvicted, 1)
+	metrics.RegistrationStates.Inc("pending_evicted")
+}
+
+// AddPendingExpired counts a pending registration dropped because its
+// liveness check finished after the pending timeout.
+func (s *Stats) AddPendingExpired() {
+	atomic.AddInt64(&s.newPendingExpired, 1)
+	metrics.RegistrationStates.Inc("pending_expired")
+}
+
+// AddLivePhantomPolicy counts a registration with a live phantom by the
+// policy applied to it.
+func (s *Stats) AddLivePhantomPolicy(policy string) {
+	switch policy {
+	case LivePhantomReject:
+		atomic.AddInt64(&s.newLivePhantomReject, 1)
+	case LivePhantomLogOnly:
+		atomic.AddInt64(&s.newLivePhantomLogOnly, 1)
+	case LivePhantomDivert:
+		atomic.AddInt64(&s.newLivePhantomDivert, 1)
+	}
+}
+
+// AddLivePhantomConn counts a connection matched to a registration kept
+// despite its live phantom.
+func (s *Stats) AddLivePhantomConn() {
+	atomic.AddInt64(&s.newLivePhantomConns, 1)
+}
+
+// AddLivenessReport counts a phantom reported live by the detector.
+func (s *Stats) AddLivenessReport() {
+	atomic.AddInt64(&s.newLivenessReports, 1)
+	metrics.DetectorLivePhantomReports.Inc()
+}
+
+// AddLivenessSubnetSkip counts a liveness probe skipped because the phantom's
+// subnet is known not to be live.
+func (s *Stats) AddLivenessSubnetSkip() {
+	atomic.AddInt64(&s.newLivenessSubnetSkip, 1)
+}
+
+// AddLivenessCacheHit counts a liveness check answered from the cache.
+func (s *Stats) AddLivenessCacheHit() {
+	atomic.AddInt64(&s.newLivenessCacheHit, 1)
+}
+
+// AddLivenessCacheMiss counts a liveness check that was not in the cache.
+func (s *Stats) AddLivenessCacheMiss() {
+	atomic.AddInt64(&s.newLivenessCacheMiss, 1)
+}
+
+// AddLivenessErr counts a liveness probe that failed with an error.
+func (s *Stats) AddLivenessErr() {
+	atomic.AddInt64(&s.newLivenessErr, 1)
+}
+
+func (s *Stats) AddReapedSession() {
+	atomic.AddInt64(&s.newReapedSessions, 1)
+}
+
+// SetParkedConns sets the number of connections parked waiting for their
+// registration.
+func (s *Stats) SetParkedConns(n int) {
+	atomic.StoreInt64(&s.parkedConns, int64(n))
+}
+
+// AddParkedConn counts a connection that was parked, or could not be, by the
+// outcome: rescued, timeout or full (see ConnParking).
+func (s *Stats) AddParkedConn(outcome string) {
+	switch outcome {
+	case parkRescued:
+		atomic.AddInt64(&s.newParkRescued, 1)
+	case parkTimeout:
+		atomic.AddInt64(&s.newParkTimeouts, 1)
+	case parkFull:
+		atomic.AddInt64(&s.newParkFull, 1)
+	}
+}
+
+// AddStationKeyUse records a connection to a registration whose shared secret
+// was derived with the station key at keyIndex. Negative indices (secret
+// supplied by the publisher) are ignored.
+func (s *Stats) AddStationKeyUse(keyIndex int) {
+	if keyIndex < 0 || keyIndex >= MaxStationKeys {
+		return
+	}
+	atomic.AddInt64(&s.newStationKeyUses[keyIndex], 1)
+}
+
+// AddBucketConn records a connection to a registration in experiment bucket.
+func (s *Stats) AddBucketConn(bucket int) {
+	s.bucketMutex.Lock()
+	s.bucketConns[bucket]++
+	s.bucketMutex.Unlock()
+}
+
+func (s *Stats) experimentBucketConns() map[int]int64 {
+	s.bucketMutex.Lock()
+	defer s.bucketMutex.Unlock()
+	conns := make(map[int]int64, len(s.bucketConns))
+	for bucket, n := range s.bucketConns {
+		conns[bucket] = n
+	}
+	return conns
+}
+
+// SetConnTagIndexSize records the current size of the connection tag index.
+func (s *Stats) SetConnTagIndexSize(n int) {
+	atomic.StoreInt64(&s.connTagIndexSize, int64(n))
+}
+
+// SetInternedStrings records the current number of interned coverts and masks.
+func (s *Stats) SetInternedStrings(n int) {
+	atomic.StoreInt64(&s.internedStrings, int64(n))
+}
+
+// SetRegistrationMemory sets whether the heartbeat reports the heap in use
+// per active registration and the number of interned strings, a debugging aid
+// to catch regressions in the memory use of registrations. The figure is the
+// whole heap divided by the registrations, so it is only meaningful on a
+// station with many of them.
+func (s *Stats) SetRegistrationMemory(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.registrationMemory, v)
+}
+
+func (s *Stats) stationKeyUses() []int64 {
+	uses := make([]int64, len(s.newStationKeyUses))
+	atomic.StoreInt64(&s.newCovertDials, 0)
+	atomic.StoreInt64(&s.newCovertDialFails, 0)
+	for i := range s.newStationKeyUses {
+		uses[i] = atomic.LoadInt64(&s.newStationKeyUses[i])
+	}
+	return uses
+}
+
+// AddRegistrationAge records the age of a registration, measured from its
+// RegistrationTime, when a connection is matched to it.
+func (s *Stats) AddRegistrationAge(registrationTime time.Time) {
+	s.registrationAges.Observe(s.now().Sub(registrationTime))
+}
+
+// AddCovertWrite records the time a write to a covert connection blocked
+// for, so slow coverts are visible in stats.
+func (s *Stats) AddCovertWrite(d time.Duration) {
+	s.covertWrites.Observe(d)
+}
+
 func (s *Stats) AddBytesUp(n int64) {
 	atomic.AddInt64(&s.newBytesUp, n)
+	atomic.AddInt64(&s.totalBytesUp, n)
 }
 
 func (s *Stats) AddBytesDown(n int64) {
 	atomic.AddInt64(&s.newBytesDown, n)
+	atomic.AddInt64(&s.totalBytesDown, n)
 }
 
 func (s *Stats) AddBytes(n int64, dir string) {
@@ -180,3 +610,52 @@ func (s *Stats) AddBytes(n int64, dir string) {
 		s.AddBytesDown(n)
 	}
 }
+
+// heartbeatStats are the fields of the heartbeat report.
+type heartbeatStats struct {
+	Registrations   int64  `json:"registrations"`
+	Conns           int64  `json:"conns"`
+	BytesUp         int64  `json:"bytes_up"`
+	BytesDown       int64  `json:"bytes_down"`
+	HeapBytes       uint64 `json:"heap_bytes"`
+	SysBytes        uint64 `json:"sys_bytes"`
+	NumGC           uint32 `json:"num_gc"`
+	Goroutines      int    `json:"goroutines"`
+	BytesPerReg     uint64 `json:"bytes_per_registration,omitempty"`
+	InternedStrings int64  `json:"interned_strings,omitempty"`
+}
+
+// HeartbeatReport returns a one line summary confirming the station is
+// alive: active registrations and connections, bytes proxied since start and
+// current memory use. Unlike Report it resets nothing.
+func (s *Stats) HeartbeatReport() StatsReport {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return s.heartbeat(&mem)
+}
+
+func (s *Stats) heartbeat(mem *runtime.MemStats) StatsReport {
+	f := heartbeatStats{
+		Registrations: atomic.LoadInt64(&s.activeRegistrations),
+		Conns:         atomic.LoadInt64(&s.activeConns),
+		BytesUp:       atomic.LoadInt64(&s.totalBytesUp),
+		BytesDown:     atomic.LoadInt64(&s.totalBytesDown),
+		HeapBytes:     mem.HeapAlloc,
+		SysBytes:      mem.Sys,
+		NumGC:         mem.NumGC,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	line := fmt.Sprintf("Heartbeat: %d regs %d conns Proxied: %d bytes (%d up %d down) Mem: %d MiB heap %d MiB sys %d GC Goroutines: %d",
+		f.Registrations, f.Conns,
+		f.BytesUp+f.BytesDown, f.BytesUp, f.BytesDown,
+		f.HeapBytes>>20, f.SysBytes>>20, f.NumGC,
+		f.Goroutines)
+	if atomic.LoadInt32(&s.registrationMemory) != 0 {
+		if f.Registrations > 0 {
+			f.BytesPerReg = mem.HeapAlloc / uint64(f.Registrations)
+		}
+		f.InternedStrings = atomic.LoadInt64(&s.internedStrings)
+		line += fmt.Sprintf(" RegMem: %d B/reg %d interned", f.BytesPerReg, f.InternedStrings)
+	}
+	return StatsReport{Line: line, Fields: f}
+}
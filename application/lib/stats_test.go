@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatSurvivesReset(t *testing.T) {
+	s := &Stats{registrationAges: newDurationHistogram(), covertWrites: newDurationHistogram(), bucketMutex: &sync.Mutex{}}
+	s.AddConn()
+	s.AddBytesUp(100)
+	s.AddBytesDown(23)
+	s.Reset()
+	s.AddBytesDown(2)
+
+	mem := &runtime.MemStats{HeapAlloc: 3 << 20, Sys: 10 << 20, NumGC: 7}
+	line := s.heartbeat(mem).Line
+	require.True(t, strings.HasPrefix(line, "Heartbeat: 0 regs 1 conns Proxied: 125 bytes (100 up 25 down) Mem: 3 MiB heap 10 MiB sys 7 GC"), line)
+	require.False(t, strings.Contains(line, "RegMem"), line)
+
+	s.SetRegistrationMemory(true)
+	s.SetInternedStrings(3)
+	atomic.StoreInt64(&s.activeRegistrations, 1024)
+	line = s.heartbeat(mem).Line
+	require.True(t, strings.HasSuffix(line, " RegMem: 3072 B/reg 3 interned"), line)
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	s := &Stats{registrationAges: newDurationHistogram(), covertWrites: newDurationHistogram(), bucketMutex: &sync.Mutex{}, clock: clk}
+	var snaps []StatsSnapshot
+	s.OnSnapshot(func(snap StatsSnapshot) { snaps = append(snaps, snap) })
+
+	s.AddCovertDial(true)
+	s.AddCovertDial(false)
+	s.snapshot()
+	s.Reset()
+	clk.Advance(5 * time.Second)
+	s.snapshot()
+	require.Len(t, snaps, 2)
+	require.Equal(t, int64(2), snaps[0].CovertDials)
+	require.Equal(t, int64(1), snaps[0].CovertDialFailures)
+	require.Equal(t, int64(0), snaps[1].CovertDials)
+	require.Equal(t, 5*time.Second, snaps[1].Interval)
+	require.Equal(t, clk.Now(), snaps[1].Time)
+}
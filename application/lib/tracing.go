@@ -0,0 +1,449 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Limits of the span export.
+const (
+	// tracingQueueSize is the number of ended spans waiting to be exported
+	// before further ones are dropped.
+	tracingQueueSize = 4096
+
+	// tracingBatchSize is the most spans exported in one request.
+	tracingBatchSize = 512
+
+	// tracingExportTimeout bounds a single export request.
+	tracingExportTimeout = 10 * time.Second
+
+	// tracingExportInterval is how often at most ended spans wait for
+	// export.
+	tracingExportInterval = 5 * time.Second
+
+	// tracingWarnInterval is how often at most failing exports are logged.
+	tracingWarnInterval = time.Minute
+)
+
+// Span attribute keys.
+const (
+	traceAttrRegistrationID = "conjure.registration_id"
+	traceAttrTransport      = "conjure.transport"
+	traceAttrChannel        = "conjure.channel"
+	traceAttrPhantomPort    = "conjure.phantom_port"
+	traceAttrSessionID      = "conjure.session_id"
+	traceAttrCloseReason    = "conjure.close_reason"
+	traceAttrMuxStreamID    = "conjure.mux_stream_id"
+	traceAttrBytesUp        = "conjure.bytes_up"
+	traceAttrBytesDown      = "conjure.bytes_down"
+)
+
+// tracer is the station-wide tracer, nil when tracing is disabled.
+var tracer *Tracer
+
+// SpanContext identifies a span across traces, it is stored on
+// registrations so that the spans of their sessions link to their ingest.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether c identifies a span.
+func (c SpanContext) IsValid() bool {
+	return c.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the hex encoded trace ID of c, as collectors show it.
+func (c SpanContext) TraceIDString() string {
+	return hex.EncodeToString(c.TraceID[:])
+}
+
+type spanAttr struct {
+	key      string
+	str      string
+	num      int64
+	isNumber bool
+}
+
+// Span is one timed operation of a trace. A nil *Span is a span that is not
+// recorded, because tracing is disabled or the trace was not sampled: all
+// its methods are no-ops that do not allocate, so instrumented code needs no
+// checks of its own. A span is not safe for concurrent use, but its children
+// are independent of it.
+type Span struct {
+	tracer *Tracer
+	name   string
+	ctx    SpanContext
+	parent [8]byte
+	link   SpanContext
+	start  time.Time
+	end    time.Time
+	attrs  []spanAttr
+	err    string
+	ended  bool
+}
+
+// StartSpan starts the root span of a new trace, sampled at the configured
+// ratio.
+func StartSpan(name string) *Span {
+	t := tracer
+	if t == nil || !t.sample() {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: time.Now()}
+	rand.Read(s.ctx.TraceID[:])
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+// StartChild starts a span of parent's trace. The trace of a span is sampled
+// as a whole, a nil parent yields a nil child.
+func StartChild(name string, parent SpanContext) *Span {
+	t := tracer
+	if t == nil || !parent.IsValid() {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, parent: parent.SpanID, start: time.Now()}
+	s.ctx.TraceID = parent.TraceID
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+// StartRegistrationSpan starts the trace of a registration message received
+// over channel. Its parse, derive and liveness phases are child spans, ingest
+// stores its context in the registrations created (DecoyRegistration.Trace).
+func StartRegistrationSpan(channel string) *Span {
+	s := StartSpan("registration.ingest")
+	s.SetAttr(traceAttrChannel, channel)
+	return s
+}
+
+// StartSessionSpan starts the trace of a connection to a phantom on
+// phantomPort. Its handshake (with the registration lookup), phantom check,
+// strict TLS checks, dial and copy phases are child spans, and it links to
+// the registration's ingest once the registration is known.
+func StartSessionSpan(phantomPort int) *Span {
+	s := StartSpan("session")
+	s.SetIntAttr(traceAttrPhantomPort, int64(phantomPort))
+	return s
+}
+
+// Child starts a child span of s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return StartChild(name, s.ctx)
+}
+
+// Context returns the context of s, the zero (invalid) context if s is not
+// recorded.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttr sets a string attribute.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttr{key: key, str: value})
+}
+
+// SetIntAttr sets an integer attribute.
+func (s *Span) SetIntAttr(key string, value int64) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttr{key: key, num: value, isNumber: true})
+}
+
+// SetRegistration sets the registration ID and transport attributes that
+// correlate the spans of a registration, here and in other components'
+// traces, and links s to the registration's ingest span (for a span of
+// another trace).
+func (s *Span) SetRegistration(reg *DecoyRegistration) {
+	if s == nil || reg == nil {
+		return
+	}
+	s.SetAttr(traceAttrRegistrationID, reg.IDString())
+	s.SetAttr(traceAttrTransport, reg.Transport.String())
+	if reg.Trace.IsValid() && reg.Trace.TraceID != s.ctx.TraceID {
+		s.link = reg.Trace
+	}
+}
+
+// SetError marks the span as failed with err, if err is not nil and the span
+// has not ended (it may already be exported).
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil || s.ended {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export. Only the first call has an
+// effect.
+func (s *Span) End() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// Tracer exports ended spans to an OpenTelemetry collector over OTLP/HTTP,
+// JSON encoded (e.g. to http://localhost:4318/v1/traces). Like the IPFIX
+// exporter it never holds up the station: spans that do not fit the queue
+// are dropped and counted, failed exports are logged at most once per
+// tracingWarnInterval and not retried.
+type Tracer struct {
+	endpoint  string
+	threshold uint64 // traces are sampled if a random uint64 is below it
+	all       bool
+	client    *http.Client
+	logger    *log.Logger
+	queue     chan *Span
+	interval  time.Duration
+
+	lastWarn time.Time
+	failures int
+	lastErr  error
+}
+
+// NewTracer returns a tracer exporting to endpoint, sampling ratio (between 0
+// and 1) of the traces. Spans are only recorded once it is enabled with
+// EnableTracing.
+func NewTracer(endpoint string, ratio float64, logger *log.Logger) (*Tracer, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio %v is not between 0 and 1", ratio)
+	}
+	return &Tracer{
+		endpoint:  endpoint,
+		threshold: uint64(ratio * (1 << 64)),
+		all:       ratio == 1,
+		client:    &http.Client{Timeout: tracingExportTimeout},
+		logger:    logger,
+		queue:     make(chan *Span, tracingQueueSize),
+		interval:  tracingExportInterval,
+	}, nil
+}
+
+// EnableTracing makes t the station-wide tracer. It must be called before
+// any span is started.
+func EnableTracing(t *Tracer) {
+	tracer = t
+}
+
+func (t *Tracer) sample() bool {
+	if t.all {
+		return true
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:]) < t.threshold
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		metrics.TracingSpansDropped.Inc()
+	}
+}
+
+// Run exports the queued spans, in batches of up to tracingBatchSize and at
+// least every tracingExportInterval. It does not return.
+func (t *Tracer) Run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	err := t.post(batch)
+	if err == nil {
+		return
+	}
+	t.failures++
+	t.lastErr = err
+	if time.Since(t.lastWarn) >= tracingWarnInterval {
+		t.logger.Printf("failed to export spans %d times, last: %v", t.failures, t.lastErr)
+		t.lastWarn = time.Now()
+		t.failures = 0
+	}
+}
+
+func (t *Tracer) post(batch []*Span) error {
+	body, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding (opentelemetry-proto trace/v1, with the JSON mapping's
+// hex trace and span IDs and string encoded 64 bit integers).
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+// OTLP span kind and status codes.
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func (t *Tracer) encode(batch []*Span) otlpTraces {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.link.IsValid() {
+			o.Links = []otlpLink{{
+				TraceID: hex.EncodeToString(s.link.TraceID[:]),
+				SpanID:  hex.EncodeToString(s.link.SpanID[:]),
+			}}
+		}
+		for _, a := range s.attrs {
+			if a.isNumber {
+				n := strconv.FormatInt(a.num, 10)
+				o.Attributes = append(o.Attributes, otlpKeyValue{Key: a.key, Value: otlpValue{IntValue: &n}})
+			} else {
+				o.Attributes = append(o.Attributes, otlpString(a.key, a.str))
+			}
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		spans = append(spans, o)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: tracingResource(Station())},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "conjure"}, Spans: spans}},
+	}}}
+}
+
+// tracingResource returns the resource attributes identifying the station.
+func tracingResource(id StationIdentity) []otlpKeyValue {
+	attrs := []otlpKeyValue{
+		otlpString("service.name", "conjure-station"),
+		otlpString("service.instance.id", id.ID),
+	}
+	if id.Region != "" {
+		attrs = append(attrs, otlpString("cloud.region", id.Region))
+	}
+	names := make([]string, 0, len(id.Labels))
+	for name := range id.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, otlpString("conjure.label."+name, id.Labels[name]))
+	}
+	return attrs
+}
@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sessionSpans instruments a proxy session the way handleNewConn and Proxy
+// do.
+func sessionSpans(reg *DecoyRegistration) {
+	span := StartSessionSpan(443)
+	defer span.End()
+	handshake := span.Child("session.handshake")
+	lookup := handshake.Child("session.lookup")
+	lookup.End()
+	handshake.End()
+	span.SetRegistration(reg)
+	phantomCheck := span.Child("session.phantom_check")
+	phantomCheck.End()
+	span.SetIntAttr(traceAttrSessionID, 7)
+	dial := span.Child("session.dial")
+	dial.SetError(nil)
+	dial.End()
+	copySpan := span.Child("session.copy")
+	copySpan.SetIntAttr(traceAttrBytesUp, 11)
+	copySpan.End()
+	span.SetAttr(traceAttrCloseReason, string(CloseClientEOF))
+}
+
+// With tracing disabled the instrumentation of a session does not allocate.
+func TestTracingDisabledAllocs(t *testing.T) {
+	require.Nil(t, tracer)
+	reg := &DecoyRegistration{}
+	require.Equal(t, float64(0), testing.AllocsPerRun(100, func() { sessionSpans(reg) }))
+}
+
+func BenchmarkSessionSpansDisabled(b *testing.B) {
+	reg := &DecoyRegistration{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sessionSpans(reg)
+	}
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	_, err := NewTracer("http://127.0.0.1:4318/v1/traces", 1.5, nil)
+	require.NotNil(t, err)
+
+	never, err := NewTracer("http://127.0.0.1:4318/v1/traces", 0, nil)
+	require.Nil(t, err)
+	always, err := NewTracer("http://127.0.0.1:4318/v1/traces", 1, nil)
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		require.False(t, never.sample())
+		require.True(t, always.sample())
+	}
+}
+
+func TestTracingExport(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	tr, err := NewTracer(srv.URL, 1, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	EnableTracing(tr)
+	defer EnableTracing(nil)
+
+	ingest := StartRegistrationSpan("zmq")
+	parse := ingest.Child("registration.parse")
+	parse.SetError(errors.New("bad"))
+	parse.End()
+	// Queued for export, it is no longer changed.
+	parse.SetError(errors.New("late"))
+	reg := &DecoyRegistration{Trace: ingest.Context()}
+	ingest.End()
+	sessionSpans(reg)
+
+	var batch []*Span
+	for len(tr.queue) > 0 {
+		batch = append(batch, <-tr.queue)
+	}
+	require.Len(t, batch, 8)
+	tr.export(batch)
+
+	var decoded otlpTraces
+	require.Nil(t, json.Unmarshal(<-bodies, &decoded))
+	require.Len(t, decoded.ResourceSpans, 1)
+	spans := make(map[string]otlpSpan)
+	for _, s := range decoded.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[s.Name] = s
+	}
+
+	ingestID := hex.EncodeToString(reg.Trace.SpanID[:])
+	require.Equal(t, ingestID, spans["registration.ingest"].SpanID)
+	require.Equal(t, "", spans["registration.ingest"].ParentSpanID)
+	require.Equal(t, ingestID, spans["registration.parse"].ParentSpanID)
+	require.Equal(t, otlpStatus{Code: otlpStatusError, Message: "bad"}, spans["registration.parse"].Status)
+
+	session := spans["session"]
+	require.NotEqual(t, spans["registration.ingest"].TraceID, session.TraceID)
+	require.Equal(t, []otlpLink{{TraceID: spans["registration.ingest"].TraceID, SpanID: ingestID}}, session.Links)
+	for _, name := range []string{"session.handshake", "session.phantom_check", "session.dial", "session.copy"} {
+		require.Equal(t, session.TraceID, spans[name].TraceID, name)
+		require.Equal(t, session.SpanID, spans[name].ParentSpanID, name)
+	}
+	attrs := make(map[string]otlpValue)
+	for _, a := range session.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	require.Equal(t, reg.IDString(), *attrs[traceAttrRegistrationID].StringValue)
+	require.Equal(t, "443", *attrs[traceAttrPhantomPort].IntValue)
+	require.Equal(t, string(CloseClientEOF), *attrs[traceAttrCloseReason].StringValue)
+	require.Equal(t, spans["session.handshake"].SpanID, spans["session.lookup"].ParentSpanID)
+}
+
+// exportedSpans takes the spans queued for export by tr, encoded as they
+// would be exported, by name.
+func exportedSpans(tr *Tracer) map[string]otlpSpan {
+	var batch []*Span
+	for len(tr.queue) > 0 {
+		batch = append(batch, <-tr.queue)
+	}
+	spans := make(map[string]otlpSpan)
+	for _, s := range tr.encode(batch).ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func spanAttrs(s otlpSpan) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range s.Attributes {
+		if a.Value.IntValue != nil {
+			attrs[a.Key] = *a.Value.IntValue
+		} else {
+			attrs[a.Key] = *a.Value.StringValue
+		}
+	}
+	return attrs
+}
+
+// Proxy records the dial and copy of a session, with the bytes proxied.
+func TestTracingProxySession(t *testing.T) {
+	covert, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer covert.Close()
+	go serveEcho(covert)
+
+	tr, err := NewTracer("http://127.0.0.1:4318/v1/traces", 1, log.New(ioutil.Discard, "", 0))
+	require.Nil(t, err)
+	EnableTracing(tr)
+	defer EnableTracing(nil)
+
+	reg := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	reg.Covert = covert.Addr().String()
+	client, stationClient := tcpPair(t)
+	span := StartSessionSpan(443)
+	done := make(chan struct{})
+	go func() {
+		Proxy(reg, stationClient, 443, span, &Logger{log.New(ioutil.Discard, "", 0)}, &ProxyConfig{})
+		stationClient.Close()
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(client, "hello covert")
+	require.Nil(t, err)
+	echoed := make([]byte, len("hello covert"))
+	_, err = io.ReadFull(client, echoed)
+	require.Nil(t, err)
+	client.Close()
+	<-done
+	span.End()
+
+	spans := exportedSpans(tr)
+	session := spans["session"]
+	for _, name := range []string{"session.dial", "session.copy"} {
+		require.Equal(t, session.SpanID, spans[name].ParentSpanID, name)
+		require.Equal(t, otlpStatus{Code: otlpStatusOK}, spans[name].Status, name)
+	}
+	copyAttrs := spanAttrs(spans["session.copy"])
+	require.Equal(t, "12", copyAttrs[traceAttrBytesUp])
+	require.Equal(t, "12", copyAttrs[traceAttrBytesDown])
+	attrs := spanAttrs(session)
+	require.Equal(t, "12", attrs[traceAttrBytesUp])
+	require.Equal(t, string(CloseClientEOF), attrs[traceAttrCloseReason])
+	require.NotEmpty(t, attrs[traceAttrSessionID])
+	// Strict TLS is off, its checks are not recorded.
+	require.NotContains(t, spans, "session.tls")
+}
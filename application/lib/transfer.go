@@ -0,0 +1,582 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Registration transfer hands the live registrations of one station to
+// another, e.g. a standby taking over for maintenance, so that clients do not
+// notice the switch. The exporting station connects to the importing one and
+// streams its registrations as RegistrationTransfer messages (see
+// proto/signalling.proto), each in a frame of a 4 byte big endian length
+// followed by the sealed message.
+//
+// Both stations hold the same transfer key. Each side sends a random nonce,
+// the keys of the stream are derived from the transfer key and both nonces
+// with HKDF, and each side proves it holds the transfer key with an HMAC
+// before any registration is sent. Frames are then sealed with AES-256-GCM
+// under a key per direction, with the frame's sequence number as nonce, so
+// that registrations (and their shared secrets) are neither readable nor
+// forgeable, reordered or replayed on the way.
+//
+// Importing is idempotent: registrations the importer already has are
+// skipped, so an interrupted transfer is resumed by running it again.
+
+// minTransferKeyLen is the least number of bytes of a transfer key.
+const minTransferKeyLen = 32
+
+// transferNonceLen is the length of the nonce each side sends.
+const transferNonceLen = 32
+
+// transferMaxFrame bounds the sealed frames a station accepts, in bytes.
+const transferMaxFrame = 1 << 20
+
+// transferIOTimeout bounds the wait for each frame of a transfer.
+const transferIOTimeout = 30 * time.Second
+
+// Types of transfer frames, the first byte of their plaintext.
+const (
+	transferFrameRecord  = 1 // a RegistrationTransfer
+	transferFrameEnd     = 2 // no more records, with the number sent
+	transferFrameSummary = 3 // the importer's TransferSummary
+)
+
+// Outcomes of transferred registrations, the label of
+// metrics.TransferredRegistrations.
+const (
+	transferExported = "exported"
+	transferImported = "imported"
+	transferSkipped  = "skipped"
+	transferExpired  = "expired"
+	transferFailed   = "failed"
+)
+
+// ErrTransferAuth is returned when the other station of a transfer does not
+// hold the same transfer key, or a frame fails authentication.
+var ErrTransferAuth = errors.New("registration transfer failed authentication")
+
+// TransferSummary counts the registrations of a transfer.
+type TransferSummary struct {
+	Exported int `json:"exported"` // sent by the exporting station
+	Imported int `json:"imported"` // added by the importing station
+	Skipped  int `json:"skipped"`  // already present on the importing station
+	Expired  int `json:"expired"`  // expired by the time they were imported
+	Failed   int `json:"failed"`   // not understood by the importing station
+}
+
+func (s TransferSummary) marshal() []byte {
+	var b []byte
+	for _, n := range []int{s.Exported, s.Imported, s.Skipped, s.Expired, s.Failed} {
+		b = appendTransferUvarint(b, uint64(n))
+	}
+	return b
+}
+
+func (s *TransferSummary) unmarshal(b []byte) error {
+	for _, n := range []*int{&s.Exported, &s.Imported, &s.Skipped, &s.Expired, &s.Failed} {
+		v, l := binary.Uvarint(b)
+		if l <= 0 {
+			return fmt.Errorf("malformed transfer summary")
+		}
+		*n, b = int(v), b[l:]
+	}
+	return nil
+}
+
+func appendTransferUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// Field keys (field number and wire type) of the RegistrationTransfer
+// message. The gotapdance protobuf package predates it, so it is encoded by
+// hand.
+const (
+	transferRegistrationKey = 1<<3 | 2 // length delimited
+	transferPhantomKey      = 2<<3 | 2 // length delimited
+	transferPhantomPortKey  = 3<<3 | 0 // varint
+	transferRegTimeKey      = 4<<3 | 0 // varint
+	transferRegCountKey     = 5<<3 | 0 // varint
+	transferLivePhantomKey  = 6<<3 | 2 // length delimited
+)
+
+// transferEntry is a registration as exported, with the state it has on the
+// exporting station.
+type transferEntry struct {
+	reg              *DecoyRegistration
+	registrationTime time.Time // when the station first tracked it
+	expiry           time.Time // when the station stops serving it
+	regCount         int32     // times the station received it
+}
+
+// marshalTransfer encodes e as a RegistrationTransfer. The registration is a
+// C2SWrapper with its shared secret, registration payload, sealed covert
+// credentials if it has any (see MarshalRegistration) and expiry set to when
+// the exporting station stops serving it.
+func marshalTransfer(e transferEntry) ([]byte, error) {
+	reg := e.reg
+	transport := reg.Transport
+	c2sw := &pb.C2SWrapper{
+		SharedSecret: reg.Keys.SharedSecret,
+		RegistrationPayload: &pb.ClientToStation{
+			DecoyListGeneration:   proto.Uint32(reg.DecoyListVersion),
+			Transport:             &transport,
+			CovertAddress:         proto.String(reg.Covert),
+			MaskedDecoyServerName: proto.String(reg.Mask),
+			Flags:                 reg.Flags,
+		},
+		RegistrationSource:  reg.RegistrationSource,
+		RegistrationAddress: reg.registrationAddr,
+	}
+	raw, err := MarshalRegistration(c2sw, reg.CovertCredentials)
+	if err != nil {
+		return nil, err
+	}
+	raw = AppendRegistrationExpiry(raw, e.expiry)
+	raw = AppendRegistrationHandshakeMAC(raw, reg.HandshakeMAC)
+	raw = AppendRegistrationAllowedSources(raw, reg.AllowedSources)
+	raw = AppendRegistrationSessionResumption(raw, reg.SessionResumption)
+
+	phantom := reg.DarkDecoy.To4()
+	if phantom == nil {
+		phantom = reg.DarkDecoy.To16()
+	}
+	b := appendTransferUvarint(nil, transferRegistrationKey)
+	b = appendTransferUvarint(b, uint64(len(raw)))
+	b = append(b, raw...)
+	b = appendTransferUvarint(b, transferPhantomKey)
+	b = appendTransferUvarint(b, uint64(len(phantom)))
+	b = append(b, phantom...)
+	b = appendTransferUvarint(b, transferPhantomPortKey)
+	b = appendTransferUvarint(b, uint64(reg.PhantomPort))
+	b = appendTransferUvarint(b, transferRegTimeKey)
+	b = appendTransferUvarint(b, uint64(e.registrationTime.UnixNano()))
+	b = appendTransferUvarint(b, transferRegCountKey)
+	b = appendTransferUvarint(b, uint64(e.regCount))
+	if policy := reg.LivePhantomPolicy(); policy != "" {
+		b = appendTransferUvarint(b, transferLivePhantomKey)
+		b = appendTransferUvarint(b, uint64(len(policy)))
+		b = append(b, policy...)
+	}
+	return b, nil
+}
+
+// unmarshalTransfer decodes a RegistrationTransfer into the registration it
+// carries, as it was on the exporting station. It returns
+// ErrRegistrationExpired if the registration expired by now.
+func (regManager *RegistrationManager) unmarshalTransfer(b []byte, now time.Time) (*transferEntry, error) {
+	var raw, phantom []byte
+	var port, regTime, regCount uint64
+	var policy string
+	err := walkC2SWrapper(b, func(field uint64, varint uint64, data []byte) {
+		switch field {
+		case transferRegistrationKey >> 3:
+			raw = data
+		case transferPhantomKey >> 3:
+			phantom = data
+		case transferPhantomPortKey >> 3:
+			port = varint
+		case transferRegTimeKey >> 3:
+			regTime = varint
+		case transferRegCountKey >> 3:
+			regCount = varint
+		case transferLivePhantomKey >> 3:
+			policy = string(data)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("malformed registration transfer: %v", err)
+	}
+	if len(phantom) != net.IPv4len && len(phantom) != net.IPv6len {
+		return nil, fmt.Errorf("registration transfer has no phantom")
+	}
+
+	expiry, err := RegistrationExpiry(raw, now)
+	if err != nil {
+		return nil, err
+	}
+	handshakeMAC, err := RegistrationHandshakeMAC(raw)
+	if err != nil {
+		return nil, fmt.Errorf("malformed transferred registration: %v", err)
+	}
+	allowedSources, err := RegistrationAllowedSources(raw)
+	if err != nil {
+		return nil, fmt.Errorf("malformed transferred registration: %v", err)
+	}
+	resumption, err := RegistrationSessionResumption(raw)
+	if err != nil {
+		return nil, fmt.Errorf("malformed transferred registration: %v", err)
+	}
+	c2sw := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(raw, c2sw); err != nil {
+		return nil, fmt.Errorf("malformed transferred registration: %v", err)
+	}
+	keys, err := GenSharedKeys(c2sw.GetSharedSecret())
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keys of transferred registration: %v", err)
+	}
+	c2s, creds, err := OpenRegistration(raw, keys.SharedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("malformed transferred registration: %v", err)
+	}
+	if c2s == nil {
+		c2s = c2sw.GetRegistrationPayload()
+	}
+	regSrc := c2sw.GetRegistrationSource()
+	reg := &DecoyRegistration{
+		DarkDecoy:          net.IP(append([]byte(nil), phantom...)),
+		PhantomPort:        uint16(port),
+		registrationAddr:   net.IP(c2sw.GetRegistrationAddress()),
+		Keys:               &keys,
+		Covert:             c2s.GetCovertAddress(),
+		Mask:               c2s.GetMaskedDecoyServerName(),
+		Flags:              c2s.Flags,
+		Transport:          c2s.GetTransport(),
+		DecoyListVersion:   c2s.GetDecoyListGeneration(),
+		RegistrationTime:   time.Unix(0, int64(regTime)),
+		RegistrationSource: &regSrc,
+		StationKeyIndex:    -1,
+		Bucket:             ExperimentBucket(keys.SharedSecret, regManager.ExperimentBuckets),
+		Expiry:             expiry,
+		HandshakeMAC:       handshakeMAC,
+		AllowedSources:     allowedSources,
+		SessionResumption:  resumption,
+		CovertCredentials:  creds,
+	}
+	if policy != "" {
+		reg.MarkLivePhantom(policy)
+	}
+	return &transferEntry{reg: reg, registrationTime: reg.RegistrationTime, expiry: expiry, regCount: int32(regCount)}, nil
+}
+
+// transferStream is one side of the sealed frames of a transfer.
+type transferStream struct {
+	conn       net.Conn
+	send, recv cipher.AEAD
+	sent, read uint64 // frames sent and read, the nonces of the next ones
+}
+
+// newTransferStream runs the handshake of a transfer over conn, as the
+// exporting side if export is set, and returns the stream of sealed frames.
+// It fails with ErrTransferAuth if the other side holds another key.
+func newTransferStream(conn net.Conn, key []byte, export bool) (*transferStream, error) {
+	if len(key) < minTransferKeyLen {
+		return nil, fmt.Errorf("transfer key must be at least %d bytes", minTransferKeyLen)
+	}
+	conn.SetDeadline(time.Now().Add(transferIOTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var ours, theirs [transferNonceLen]byte
+	if _, err := rand.Read(ours[:]); err != nil {
+		return nil, err
+	}
+	var salt []byte
+	if export {
+		if _, err := conn.Write(ours[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, theirs[:]); err != nil {
+			return nil, err
+		}
+		salt = append(ours[:], theirs[:]...)
+	} else {
+		if _, err := io.ReadFull(conn, theirs[:]); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(ours[:]); err != nil {
+			return nil, err
+		}
+		salt = append(theirs[:], ours[:]...)
+	}
+
+	var keys [3 * 32]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("conjure registration transfer")), keys[:]); err != nil {
+		return nil, err
+	}
+	exportKey, importKey, macKey := keys[:32], keys[32:64], keys[64:]
+	proof := func(side string) []byte {
+		mac := hmac.New(sha256.New, macKey)
+		mac.Write([]byte(side))
+		return mac.Sum(nil)
+	}
+
+	// The exporter proves it holds the key first, so that nothing is learnt
+	// from an importer about the key by connecting to it.
+	theirProof := make([]byte, sha256.Size)
+	if export {
+		if _, err := conn.Write(proof("export")); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, theirProof); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(theirProof, proof("import")) {
+			return nil, ErrTransferAuth
+		}
+	} else {
+		if _, err := io.ReadFull(conn, theirProof); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(theirProof, proof("export")) {
+			return nil, ErrTransferAuth
+		}
+		if _, err := conn.Write(proof("import")); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &transferStream{conn: conn}
+	sendKey, recvKey := exportKey, importKey
+	if !export {
+		sendKey, recvKey = importKey, exportKey
+	}
+	var err error
+	if s.send, err = newTransferAEAD(sendKey); err != nil {
+		return nil, err
+	}
+	if s.recv, err = newTransferAEAD(recvKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newTransferAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func transferNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (s *transferStream) writeFrame(typ byte, body []byte) error {
+	sealed := s.send.Seal(nil, transferNonce(s.send, s.sent), append([]byte{typ}, body...), nil)
+	s.sent++
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	s.conn.SetWriteDeadline(time.Now().Add(transferIOTimeout))
+	_, err := s.conn.Write(append(frame, sealed...))
+	return err
+}
+
+func (s *transferStream) readFrame() (byte, []byte, error) {
+	s.conn.SetReadDeadline(time.Now().Add(transferIOTimeout))
+	var length [4]byte
+	if _, err := io.ReadFull(s.conn, length[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > transferMaxFrame {
+		return 0, nil, fmt.Errorf("transfer frame of %d bytes is too large", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(s.conn, sealed); err != nil {
+		return 0, nil, err
+	}
+	plain, err := s.recv.Open(nil, transferNonce(s.recv, s.read), sealed, nil)
+	if err != nil || len(plain) == 0 {
+		return 0, nil, ErrTransferAuth
+	}
+	s.read++
+	return plain[0], plain[1:], nil
+}
+
+// ExportRegistrations sends the registrations this station serves to the
+// importing station on conn, see ServeTransfers. Registrations still waiting
+// for their liveness check are not sent. It returns the importer's summary,
+// with Exported the number sent.
+func (regManager *RegistrationManager) ExportRegistrations(conn net.Conn, key []byte) (TransferSummary, error) {
+	var summary TransferSummary
+	s, err := newTransferStream(conn, key, true)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, e := range regManager.registeredDecoys.transferable() {
+		b, err := marshalTransfer(e)
+		if err != nil {
+			return summary, fmt.Errorf("failed to marshal registration %s: %v", e.reg.IDString(), err)
+		}
+		if err := s.writeFrame(transferFrameRecord, b); err != nil {
+			return summary, err
+		}
+		summary.Exported++
+		metrics.TransferredRegistrations.Inc(transferExported)
+	}
+	if err := s.writeFrame(transferFrameEnd, appendTransferUvarint(nil, uint64(summary.Exported))); err != nil {
+		return summary, err
+	}
+
+	typ, body, err := s.readFrame()
+	if err != nil {
+		return summary, fmt.Errorf("no summary from the importing station: %v", err)
+	}
+	exported := summary.Exported
+	if typ != transferFrameSummary || summary.unmarshal(body) != nil {
+		return summary, fmt.Errorf("bad summary from the importing station")
+	}
+	if summary.Exported != exported {
+		return summary, fmt.Errorf("importing station received %d of %d registrations", summary.Exported, exported)
+	}
+	return summary, nil
+}
+
+// ImportRegistrations adds the registrations sent by the exporting station on
+// conn, see ExportRegistrations, and replies with the summary. Registrations
+// keep the phantom, expiry and usage counts they had on the exporting
+// station, and are served at once: their liveness was checked there.
+// Registrations already present are skipped, so importing the same
+// registrations again is harmless. If the transfer breaks off, what was
+// imported is kept and the summary so far is returned with the error.
+func (regManager *RegistrationManager) ImportRegistrations(conn net.Conn, key []byte, conf *Config) (TransferSummary, error) {
+	var summary TransferSummary
+	s, err := newTransferStream(conn, key, false)
+	if err != nil {
+		return summary, err
+	}
+
+	received := 0
+	for {
+		typ, body, err := s.readFrame()
+		if err != nil {
+			return summary, err
+		}
+		switch typ {
+		case transferFrameRecord:
+			received++
+			outcome := regManager.importTransfer(body, conf)
+			switch outcome {
+			case transferImported:
+				summary.Imported++
+			case transferSkipped:
+				summary.Skipped++
+			case transferExpired:
+				summary.Expired++
+			default:
+				summary.Failed++
+			}
+			metrics.TransferredRegistrations.Inc(outcome)
+		case transferFrameEnd:
+			sent, n := binary.Uvarint(body)
+			if n <= 0 || int(sent) != received {
+				return summary, fmt.Errorf("exporting station sent %d registrations, %d received", sent, received)
+			}
+			summary.Exported = received
+			return summary, s.writeFrame(transferFrameSummary, summary.marshal())
+		default:
+			return summary, fmt.Errorf("unexpected transfer frame type %d", typ)
+		}
+	}
+}
+
+// importTransfer adds the registration of a RegistrationTransfer and returns
+// the outcome.
+func (regManager *RegistrationManager) importTransfer(b []byte, conf *Config) string {
+	e, err := regManager.unmarshalTransfer(b, regManager.registeredDecoys.clock.Now())
+	if errors.Is(err, ErrRegistrationExpired) {
+		return transferExpired
+	} else if err != nil {
+		regManager.Logger.Debugf("failed to import registration: %v", err)
+		return transferFailed
+	}
+	if conf != nil {
+		conf.SetCovertFallbacks(e.reg)
+	}
+	added, err := regManager.registeredDecoys.importRegistration(e.reg, e.regCount, e.registrationTime)
+	if err != nil {
+		regManager.Logger.Debugf("failed to import registration %s: %v", e.reg.IDString(), err)
+		return transferFailed
+	}
+	if !added {
+		return transferSkipped
+	}
+	return transferImported
+}
+
+// ServeTransfers imports the registrations of every transfer accepted on ln
+// until it is closed, one transfer at a time, logging the summary of each.
+func (regManager *RegistrationManager) ServeTransfers(ln net.Listener, key []byte, conf *Config, logger *Logger) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		summary, err := regManager.ImportRegistrations(conn, key, conf)
+		conn.Close()
+		if err != nil {
+			logger.Errorf("registration transfer from %v failed after importing %d registrations (%d skipped, %d expired, %d failed): %v",
+				conn.RemoteAddr(), summary.Imported, summary.Skipped, summary.Expired, summary.Failed, err)
+			continue
+		}
+		logger.Infof("imported %d of %d registrations transferred from %v, skipped %d already present, %d expired, %d failed",
+			summary.Imported, summary.Exported, conn.RemoteAddr(), summary.Skipped, summary.Expired, summary.Failed)
+	}
+}
+
+// ListenTransfer opens the listener of transfers, addr is "unix:/path" or
+// "host:port". A stale unix socket file is replaced.
+func ListenTransfer(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// DialTransfer connects to the transfer listener of another station, addr is
+// as for ListenTransfer.
+func DialTransfer(addr string) (net.Conn, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return net.DialTimeout("unix", path, transferIOTimeout)
+	}
+	return net.DialTimeout("tcp", addr, transferIOTimeout)
+}
+
+func (c *Config) parseTransfer() error {
+	if c.TransferKeyPath == "" {
+		if c.TransferListenAddr != "" {
+			return fmt.Errorf("transfer_listen_addr requires a transfer_key_path")
+		}
+		return nil
+	}
+	key, err := LoadSecret(c.TransferKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load transfer key: %v", err)
+	}
+	if len(key) < minTransferKeyLen {
+		return fmt.Errorf("transfer key must be at least %d bytes", minTransferKeyLen)
+	}
+	c.transferKey = key
+	return nil
+}
+
+// TransferKey returns the key of registration transfers, nil if none is
+// configured.
+func (c *Config) TransferKey() []byte {
+	return c.transferKey
+}
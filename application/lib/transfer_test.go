@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/testutil"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func newTransferTestManager(clk *testutil.FakeClock) *RegistrationManager {
+	rm := &RegistrationManager{registeredDecoys: newConnTagTestDecoys(), Logger: &Logger{log.New(ioutil.Discard, "", 0)}}
+	rm.SetClock(clk)
+	return rm
+}
+
+// transfer runs a transfer from exporter to importer over a pipe.
+func transfer(exporter, importer *RegistrationManager, exportKey, importKey []byte) (exported, imported TransferSummary, exportErr, importErr error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer b.Close()
+		imported, importErr = importer.ImportRegistrations(b, importKey, nil)
+	}()
+	exported, exportErr = exporter.ExportRegistrations(a, exportKey)
+	a.Close()
+	<-done
+	return
+}
+
+func TestRegistrationTransfer(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	exportClock := testutil.NewFakeClock(start)
+	exporter := newTransferTestManager(exportClock)
+
+	source := pb.RegistrationSource_API
+	v4 := newConnTagTestReg(t, net.ParseIP("192.0.2.1"))
+	v4.Covert, v4.Mask, v4.PhantomPort, v4.RegistrationSource = "198.51.100.1:443", "example.com", 8443, &source
+	v4.MarkLivePhantom(LivePhantomLogOnly)
+	v4.HandshakeMAC = true
+	_, allowed, _ := net.ParseCIDR("198.51.100.0/24")
+	v4.AllowedSources = []*net.IPNet{allowed}
+	v4.SessionResumption = true
+	v4.CovertCredentials = &CovertCredentials{Username: "alice", Password: "s3cret"}
+	require.Nil(t, exporter.TrackRegistration(v4))
+	require.Nil(t, exporter.TrackRegistration(v4)) // received twice
+	exporter.AddRegistration(v4)
+	v6 := newConnTagTestReg(t, net.ParseIP("2001:db8::1"))
+	exporter.AddRegistration(v6)
+	short := newConnTagTestReg(t, net.ParseIP("192.0.2.2"))
+	short.Expiry = start.Add(90 * time.Minute)
+	exporter.AddRegistration(short)
+	pending := newConnTagTestReg(t, net.ParseIP("192.0.2.3"))
+	exporter.AddPendingRegistration(pending, time.Minute)
+	exportClock.Advance(time.Hour)
+
+	// By the time the registrations are imported short has expired.
+	importer := newTransferTestManager(testutil.NewFakeClock(start.Add(2 * time.Hour)))
+	key := bytes.Repeat([]byte{7}, 32)
+	exported, imported, exportErr, importErr := transfer(exporter, importer, key, key)
+	require.Nil(t, exportErr)
+	require.Nil(t, importErr)
+	require.Equal(t, TransferSummary{Exported: 3, Imported: 2, Expired: 1}, exported)
+	require.Equal(t, exported, imported)
+
+	got := importer.registeredDecoys.RegistrationExists(v4)
+	require.NotNil(t, got)
+	require.Equal(t, v4.Covert, got.Covert)
+	require.Equal(t, v4.Mask, got.Mask)
+	require.Equal(t, v4.PhantomPort, got.PhantomPort)
+	require.Equal(t, pb.RegistrationSource_API, *got.RegistrationSource)
+	require.Equal(t, LivePhantomLogOnly, got.LivePhantomPolicy())
+	require.Equal(t, v4.Keys.ConnTag, got.Keys.ConnTag)
+	require.Equal(t, int32(2), got.regCount)
+	require.True(t, got.HandshakeMAC)
+	require.Equal(t, v4.AllowedSources, got.AllowedSources)
+	require.True(t, got.SessionResumption)
+	require.Equal(t, v4.CovertCredentials, got.CovertCredentials)
+	require.Len(t, importer.GetRegistrations(v6.DarkDecoy), 1)
+	got = importer.registeredDecoys.RegistrationExists(v6)
+	require.NotNil(t, got)
+	require.Nil(t, got.CovertCredentials)
+	require.Nil(t, importer.registeredDecoys.RegistrationExists(short))
+	require.Nil(t, importer.registeredDecoys.RegistrationExists(pending))
+
+	// Imported registrations keep their registration time and expire when
+	// they would have on the exporting station.
+	id := v4.IDString() + v4.DarkDecoy.String()
+	require.Equal(t, exporter.registeredDecoys.decoysTimeouts[id].expiry, importer.registeredDecoys.decoysTimeouts[id].expiry)
+	require.Equal(t, start, importer.registeredDecoys.decoysTimeouts[id].registrationTime)
+
+	// Transferring again, e.g. after a transfer broke off, only imports what
+	// is missing.
+	path := filepath.Join(t.TempDir(), "transfer.sock")
+	ln, err := ListenTransfer("unix:" + path)
+	require.Nil(t, err)
+	defer ln.Close()
+	go importer.ServeTransfers(ln, key, nil, importer.Logger)
+	conn, err := DialTransfer("unix:" + path)
+	require.Nil(t, err)
+	defer conn.Close()
+	exported, err = exporter.ExportRegistrations(conn, key)
+	require.Nil(t, err)
+	require.Equal(t, TransferSummary{Exported: 3, Skipped: 2, Expired: 1}, exported)
+}
+
+func TestRegistrationTransferAuth(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	exporter := newTransferTestManager(clk)
+	exporter.AddRegistration(newConnTagTestReg(t, net.ParseIP("192.0.2.1")))
+	importer := newTransferTestManager(clk)
+
+	_, _, exportErr, importErr := transfer(exporter, importer, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32))
+	require.NotNil(t, exportErr)
+	require.Equal(t, ErrTransferAuth, importErr)
+	require.Equal(t, 0, importer.registeredDecoys.TotalRegistrations())
+
+	_, _, exportErr, _ = transfer(exporter, importer, []byte("short"), []byte("short"))
+	require.NotNil(t, exportErr)
+
+	c := &Config{TransferListenAddr: "127.0.0.1:0"}
+	require.NotNil(t, c.parseTransfer())
+	c.TransferKeyPath = filepath.Join(t.TempDir(), "transfer.key")
+	require.Nil(t, ioutil.WriteFile(c.TransferKeyPath, bytes.Repeat([]byte{3}, 32), 0o600))
+	require.Nil(t, c.parseTransfer())
+	require.Len(t, c.TransferKey(), 32)
+}
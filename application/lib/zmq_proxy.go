@@ -3,13 +3,21 @@ package lib
 //
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"syscall"
 	"time"
 
 	zmq "github.com/pebbe/zmq4"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// Defaults of the ZMQ socket timeouts, in milliseconds.
+const (
+	defaultZMQSendTimeout = 1000
+	defaultZMQRecvTimeout = 1000
 )
 
 // ZMQConfig - Configuration options relevant to the ZMQ Proxy utility
@@ -19,6 +27,56 @@ type ZMQConfig struct {
 	PrivateKeyPath    string         `toml:"privkey_path"`
 	HeartbeatInterval int            `toml:"heartbeat_interval"`
 	HeartbeatTimeout  int            `toml:"heartbeat_timeout"`
+
+	// Time in milliseconds a message forwarded by the proxy may wait for
+	// room in a subscriber's queue, full at its high-water mark, before it
+	// is dropped (and counted in metrics.ZMQSendsDropped) instead, -1 waits
+	// indefinitely. Defaults to 1000.
+	SendTimeout int `toml:"send_timeout"`
+
+	// Time in milliseconds the station waits for a registration message
+	// before checking whether it is shutting down. Defaults to 1000.
+	RecvTimeout int `toml:"recv_timeout"`
+
+	// Time in milliseconds the median clock skew of a publisher, measured
+	// from the publish_time of its registrations, may reach before a
+	// warning is logged, once per publisher, see PublisherSkewTracker.
+	// Defaults to 30000, -1 never warns.
+	PublisherSkewWarn int `toml:"publisher_skew_warn"`
+
+	// Time in seconds since its publish_time after which a registration is
+	// stale, counted in metrics.StaleRegistrations. With
+	// StaleRegistrationShortenTTL a stale registration is only served for
+	// what is left of its lifetime counted from its publish time, rather
+	// than from when it was received. Zero never considers registrations
+	// stale.
+	StaleRegistrationAge        int  `toml:"stale_registration_age"`
+	StaleRegistrationShortenTTL bool `toml:"stale_registration_shorten_ttl"`
+}
+
+func (c *ZMQConfig) parse() error {
+	if c.SendTimeout == 0 {
+		c.SendTimeout = defaultZMQSendTimeout
+	}
+	if c.SendTimeout < -1 {
+		return fmt.Errorf("bad send_timeout %d, expected -1 or more milliseconds", c.SendTimeout)
+	}
+	if c.RecvTimeout == 0 {
+		c.RecvTimeout = defaultZMQRecvTimeout
+	}
+	if c.RecvTimeout < 0 {
+		return fmt.Errorf("bad recv_timeout %d, expected milliseconds", c.RecvTimeout)
+	}
+	if c.PublisherSkewWarn == 0 {
+		c.PublisherSkewWarn = defaultPublisherSkewWarn
+	}
+	if c.PublisherSkewWarn < -1 {
+		return fmt.Errorf("bad publisher_skew_warn %d, expected -1 or more milliseconds", c.PublisherSkewWarn)
+	}
+	if c.StaleRegistrationAge < 0 {
+		return fmt.Errorf("bad stale_registration_age %d, expected seconds", c.StaleRegistrationAge)
+	}
+	return nil
 }
 
 type socketConfig struct {
@@ -37,34 +95,110 @@ type proxy struct {
 // Specify the absolute location of the config file with
 // the CJ_PROXY_CONFIG environment variable.
 func ZMQProxy(c ZMQConfig) {
-	var p proxy
-	p.logger = log.New(os.Stdout, "[ZMQ_PROXY] ", log.Ldate|log.Lmicroseconds)
+	p, pubSock, err := bindZMQProxy(c)
+	if err != nil {
+		p.logger.Fatalln(err)
+	}
+	p.run(c, pubSock)
+}
+
+// StartZMQProxy binds the proxy PUB socket and returns any error doing so
+// before launching the proxy in the background. This allows the caller to
+// refuse to start (rather than silently running without registrations) when
+// another station already owns the socket.
+func StartZMQProxy(c ZMQConfig) error {
+	p, pubSock, err := bindZMQProxy(c)
+	if err != nil {
+		return err
+	}
+	go p.run(c, pubSock)
+	return nil
+}
+
+func bindZMQProxy(c ZMQConfig) (*proxy, *zmq.Socket, error) {
+	p := &proxy{
+		logger: log.New(os.Stdout, "[ZMQ_PROXY] ", log.Ldate|log.Lmicroseconds),
+	}
+
+	// An XPUB rather than a PUB: a PUB drops messages for a subscriber at its
+	// high-water mark without telling the sender, with no-drop set the send
+	// waits for room instead, up to the send timeout, and fails with EAGAIN.
+	pubSock, err := zmq.NewSocket(zmq.XPUB)
+	if err != nil {
+		return p, nil, fmt.Errorf("failed to create binding zmq socket: %v", err)
+	}
+	err = pubSock.SetXpubNodrop(true)
+	if err != nil {
+		pubSock.Close()
+		return p, nil, fmt.Errorf("failed to set no-drop on zmq socket: %v", err)
+	}
+
+	if c.SendTimeout != 0 {
+		err = pubSock.SetSndtimeo(time.Duration(c.SendTimeout) * time.Millisecond)
+		if err != nil {
+			pubSock.Close()
+			return p, nil, fmt.Errorf("failed to set send timeout of %v on zmq socket: %v", c.SendTimeout, err)
+		}
+	}
 
-	privkey, err := ioutil.ReadFile(c.PrivateKeyPath)
+	err = pubSock.Bind(fmt.Sprintf("ipc://@%s", c.SocketName))
 	if err != nil {
-		p.logger.Fatalln("failed to load private key:", err)
+		pubSock.Close()
+		if owner := DescribeUnixSocketOwner("@" + c.SocketName); owner != "" {
+			return p, nil, fmt.Errorf("failed to bind zmq socket ipc://@%s (in use by %s): %v", c.SocketName, owner, err)
+		}
+		return p, nil, fmt.Errorf("failed to bind zmq socket ipc://@%s: %v", c.SocketName, err)
+	}
+
+	return p, pubSock, nil
+}
+
+// loadZMQProxyKey returns the Z85 encoded CURVE keypair the proxy
+// authenticates to registrars with.
+func loadZMQProxyKey(c ZMQConfig) (privkey_z85, pubkey_z85 string, err error) {
+	privkey, err := LoadSecret(c.PrivateKeyPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load private key: %v", err)
+	}
+	if len(privkey) < 32 {
+		return "", "", fmt.Errorf("failed to load private key: %v: %d bytes, need 32", ErrSecretMalformed, len(privkey))
 	}
 
 	// Only use first 32 bytes of key (some keys store
 	// public key after private key)
-	privkey_z85 := zmq.Z85encode(string(privkey[:32]))
-	pubkey_z85, err := zmq.AuthCurvePublic(privkey_z85)
+	privkey_z85 = zmq.Z85encode(string(privkey[:32]))
+	pubkey_z85, err = zmq.AuthCurvePublic(privkey_z85)
 	if err != nil {
-		p.logger.Fatalln("failed to generate client public key from private key:", err)
+		return "", "", fmt.Errorf("failed to generate client public key from private key: %v", err)
 	}
+	return privkey_z85, pubkey_z85, nil
+}
 
-	pubSock, err := zmq.NewSocket(zmq.PUB)
+// CheckZMQProxy loads the proxy key and binds the proxy PUB socket, closing it
+// again, to verify that the proxy would start with c. It is used by
+// cmd/conjure-check.
+func CheckZMQProxy(c ZMQConfig) error {
+	if _, _, err := loadZMQProxyKey(c); err != nil {
+		return err
+	}
+	_, pubSock, err := bindZMQProxy(c)
 	if err != nil {
-		p.logger.Fatalln("failed to create binding zmq socket:", err)
+		return err
 	}
+	return pubSock.Close()
+}
 
-	err = pubSock.Bind(fmt.Sprintf("ipc://@%s", c.SocketName))
+func (p *proxy) run(c ZMQConfig, pubSock *zmq.Socket) {
+	defer pubSock.Close()
+
+	privkey_z85, pubkey_z85, err := loadZMQProxyKey(c)
 	if err != nil {
-		p.logger.Fatalln("failed to bind zmq socket:", err)
+		p.logger.Fatalln(err)
 	}
-	defer pubSock.Close()
 
-	messages := make(chan []byte)
+	publisherSkews.setWarn(time.Duration(c.PublisherSkewWarn)*time.Millisecond, p.logger)
+
+	messages := make(chan [][]byte)
 	// Create a socket for each socket we're connecting to. I would've
 	// liked to use a single socket for all connections, and ZMQ actually
 	// does support connecting to multiple sockets from a single socket,
@@ -74,6 +208,7 @@ func ZMQProxy(c ZMQConfig) {
 		sock, err := zmq.NewSocket(zmq.SUB)
 		if err != nil {
 			p.logger.Printf("failed to create subscriber zmq socket for %s: %v\n", connectSocket.Address, err)
+			continue
 		}
 
 		err = sock.SetHeartbeatIvl(time.Duration(c.HeartbeatInterval) * time.Millisecond)
@@ -107,22 +242,55 @@ func ZMQProxy(c ZMQConfig) {
 		}
 		defer sock.Close()
 
+		// Messages are forwarded with all of their frames intact so that a
+		// multi-part message is never split into several messages downstream.
 		go func(sub *zmq.Socket, config socketConfig) {
 			for {
-				msg, err := sub.RecvBytes(0)
+				msg, err := sub.RecvMessageBytes(0)
 				if err != nil {
 					p.logger.Printf("read from %s failed: %v\n", config.Address, err)
 					continue
 				}
+				publisherSkews.ObserveMessage(config.Address, msg, time.Now())
 				messages <- msg
 			}
 		}(sock, connectSocket)
 	}
 
 	for msg := range messages {
-		_, err := pubSock.SendBytes(msg, 0)
+		_, err := pubSock.SendMessage(msg)
+		if isZMQTimeout(err) {
+			// Dropped rather than holding up the messages behind it.
+			metrics.ZMQSendsDropped.Inc()
+			continue
+		}
 		if err != nil {
 			p.logger.Printf("write to pubSock failed: %v\n", err)
 		}
 	}
 }
+
+// isZMQTimeout returns whether err is a ZMQ send or receive that timed out.
+func isZMQTimeout(err error) bool {
+	return err != nil && zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN)
+}
+
+// RecvZMQMessage reads the next message from sock, whose receive timeout must
+// be set, checking ctx every time a receive times out. It returns ctx.Err()
+// once ctx is done.
+func RecvZMQMessage(ctx context.Context, sock *zmq.Socket) ([][]byte, error) {
+	for {
+		msg, err := sock.RecvMessageBytes(0)
+		if !isZMQTimeout(err) {
+			return msg, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// RegistrationBatchTopic is the first frame of a message batching several
+// registrations, for registrars publishing many. Each following frame is a
+// marshaled C2SWrapper, as the single frame of an unbatched registration.
+const RegistrationBatchTopic = "registration_batch"
@@ -123,3 +123,45 @@ func TestConcurrentProxy(t *testing.T) {
 		return
 	}
 }
+
+func TestZMQConfigParseTimeouts(t *testing.T) {
+	c := ZMQConfig{}
+	require.Nil(t, c.parse())
+	require.Equal(t, defaultZMQSendTimeout, c.SendTimeout)
+	require.Equal(t, defaultZMQRecvTimeout, c.RecvTimeout)
+
+	c = ZMQConfig{SendTimeout: -1, RecvTimeout: 50}
+	require.Nil(t, c.parse())
+	require.Equal(t, -1, c.SendTimeout)
+	require.Equal(t, 50, c.RecvTimeout)
+
+	c = ZMQConfig{SendTimeout: -2}
+	require.NotNil(t, c.parse())
+	c = ZMQConfig{RecvTimeout: -1}
+	require.NotNil(t, c.parse())
+}
+
+func TestZMQProxySendTimesOutWhenFull(t *testing.T) {
+	_, pubSock, err := bindZMQProxy(ZMQConfig{SocketName: "test-proxy-full", SendTimeout: 10})
+	require.Nil(t, err)
+	defer pubSock.Close()
+	require.Nil(t, pubSock.SetSndhwm(1))
+
+	// A subscriber that never reads, so its queue fills.
+	sub, err := zmq.NewSocket(zmq.SUB)
+	require.Nil(t, err)
+	defer sub.Close()
+	require.Nil(t, sub.SetRcvhwm(1))
+	require.Nil(t, sub.SetSubscribe(""))
+	require.Nil(t, sub.Connect("ipc://@test-proxy-full"))
+	time.Sleep(100 * time.Millisecond)
+
+	msg := make([]byte, 64*1024)
+	for i := 0; i < 10000; i++ {
+		_, err = pubSock.SendMessage(msg)
+		if err != nil {
+			break
+		}
+	}
+	require.True(t, isZMQTimeout(err), "sends to a full subscriber were not refused: %v", err)
+}
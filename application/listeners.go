@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// acceptLoops runs one accept loop per listener, passing every accepted
+// connection to handle in its own goroutine. It returns once all listeners
+// have been closed.
+func acceptLoops(listeners []*net.TCPListener, handle func(*net.TCPConn)) {
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln *net.TCPListener) {
+			defer wg.Done()
+			acceptLoop(ln, handle)
+		}(ln)
+	}
+	wg.Wait()
+}
+
+func acceptLoop(ln *net.TCPListener, handle func(*net.TCPConn)) {
+	for {
+		newConn, err := ln.AcceptTCP()
+		if err != nil {
+			if isClosedConnError(err) {
+				return
+			}
+			logger.Errorf("failed to AcceptTCP on %v: %v", ln.Addr(), err)
+			continue
+		}
+		go handle(newConn)
+	}
+}
+
+// isClosedConnError reports whether err is the error returned by Accept on a
+// listener that has been closed. net.ErrClosed is not available in the Go
+// version the station is built with.
+func isClosedConnError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	return opErr.Err.Error() == "use of closed network connection"
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenMultiplePorts(t *testing.T) {
+	resolver, err := cj.NewOriginalDstResolver("")
+	require.Nil(t, err)
+	listeners, err := cj.ListenAll([]string{"127.0.0.1:0", "127.0.0.1:0"}, resolver, nil)
+	require.Nil(t, err)
+	require.Len(t, listeners, 2)
+
+	accepted := make(chan string, 2)
+	done := make(chan struct{})
+	go func() {
+		acceptLoops(listeners, func(c *net.TCPConn) {
+			accepted <- c.LocalAddr().String()
+			c.Close()
+		})
+		close(done)
+	}()
+
+	for _, ln := range listeners {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		require.Nil(t, err)
+		c.Close()
+		select {
+		case addr := <-accepted:
+			require.Equal(t, ln.Addr().String(), addr)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection accepted on %v", ln.Addr())
+		}
+	}
+
+	// Closing the listeners stops every accept loop.
+	cj.CloseAll(listeners)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("accept loops did not return after listeners were closed")
+	}
+}
@@ -2,70 +2,55 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/golang/protobuf/proto"
-	zmq "github.com/pebbe/zmq4"
 	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/metrics"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 
 	"github.com/refraction-networking/conjure/application/transports"
 	"github.com/refraction-networking/conjure/application/transports/wrapping/min"
+	"github.com/refraction-networking/conjure/application/transports/wrapping/mux"
 	"github.com/refraction-networking/conjure/application/transports/wrapping/obfs4"
+	"github.com/refraction-networking/conjure/application/transports/wrapping/prefix"
 )
 
-func getOriginalDst(fd uintptr) (net.IP, error) {
-	const SO_ORIGINAL_DST = 80
-	if sockOpt, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST); err == nil {
-		// parse ipv4
-		return net.IPv4(sockOpt.Multiaddr[4], sockOpt.Multiaddr[5], sockOpt.Multiaddr[6], sockOpt.Multiaddr[7]), nil
-	} else if mtuinfo, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, SO_ORIGINAL_DST); err == nil {
-		// parse ipv6
-		return net.IP(mtuinfo.Addr.Addr[:]), nil
-	} else {
-		return nil, err
-	}
-}
-
 // Handle connection from client
 // NOTE: this is called as a goroutine
-func handleNewConn(regManager *cj.RegistrationManager, clientConn *net.TCPConn) {
-	defer clientConn.Close()
-
-	fd, err := clientConn.File()
-	if err != nil {
-		logger.Println("failed to get file descriptor on clientConn:", err)
-		return
-	}
+func handleNewConn(regManager *cj.RegistrationManager, clientConn *net.TCPConn, conf *cj.Config, resolver cj.OriginalDstResolver) {
+	timing := cj.NewSessionTiming(conf.Now())
+
+	// Connections given up on below are closed as configured in
+	// [client_tcp], those of found registrations normally.
+	failed := true
+	defer func() {
+		if failed {
+			conf.ClientTCP.CloseFailed(clientConn)
+		} else {
+			clientConn.Close()
+		}
+	}()
 
 	// TODO: if NOT mPort 443: just forward things and return
-	fdPtr := fd.Fd()
-	originalDstIP, err := getOriginalDst(fdPtr)
+	originalDstAddr, err := resolver.OriginalDst(clientConn)
 	if err != nil {
-		logger.Println("failed to getOriginalDst from fd:", err)
+		logger.Warnf("failed to get original destination: %v", err)
 		return
 	}
-
-	// We need to set the underlying file descriptor back into
-	// non-blocking mode after calling Fd (which puts it into blocking
-	// mode), or else deadlines won't work.
-	err = syscall.SetNonblock(int(fdPtr), true)
-	if err != nil {
-		logger.Println("failed to set non-blocking mode on fd:", err)
-	}
-	fd.Close()
+	originalDstIP := originalDstAddr.IP
 
 	var originalDst, originalSrc string
 	if logClientIP {
@@ -73,17 +58,15 @@ func handleNewConn(regManager *cj.RegistrationManager, clientConn *net.TCPConn)
 	} else {
 		originalSrc = "_"
 	}
-	originalDst = originalDstIP.String()
+	originalDst = originalDstAddr.String()
 	flowDescription := fmt.Sprintf("%s -> %s ", originalSrc, originalDst)
-	logger := log.New(os.Stdout, "[CONN] "+flowDescription, log.Ldate|log.Lmicroseconds)
+	logger := cj.NewLogger("[CONN] " + flowDescription)
 
 	count := regManager.CountRegistrations(originalDstIP)
-	logger.Printf("new connection (%d potential registrations)\n", count)
-	cj.Stat().AddConn()
+	conf.ConnLogSampler().Accept(logger, "new connection (%d potential registrations)", count)
 
 	// Pick random timeout between 10 and 60 seconds, down to millisecond precision
-	ms := rand.Int63n(50000) + 10000
-	timeout := time.Duration(ms) * time.Millisecond
+	timeout := cj.Jitter(10*time.Second, 60*time.Second).Truncate(time.Millisecond)
 
 	// Give the client a deadline to send enough data to identify a transport.
 	// This can be reset by transports to give more time for handshakes
@@ -91,6 +74,24 @@ func handleNewConn(regManager *cj.RegistrationManager, clientConn *net.TCPConn)
 	deadline := time.Now().Add(timeout)
 	clientConn.SetDeadline(deadline)
 
+	// Drained phantom subnets are served as if they had no registrations,
+	// whichever the connection would have matched.
+	if subnet, drained := regManager.PhantomDrain.RefuseConnection(originalDstIP); drained {
+		logger.Debugf("phantom subnet %s is drained, reading for %v then dropping connection", subnet, timeout)
+		cj.Stat().ConnErr()
+		io.Copy(ioutil.Discard, clientConn)
+		return
+	}
+
+	// The client may have connected before its registration reached the
+	// station, the connection waits for it a little if parking is enabled.
+	// Its deadline was set before, a registration that does not arrive in
+	// time leaves it as long to read from as any other without one.
+	if count < 1 && regManager.ParkConnection(originalDstIP) {
+		count = regManager.CountRegistrations(originalDstIP)
+		logger.Debugf("registration arrived while parked (%d potential registrations)", count)
+	}
+
 	if count < 1 {
 		// Here, reading from the connection would be pointless, but
 		// since the kernel already ACK'd this connection, we gain no
@@ -102,7 +103,7 @@ func handleNewConn(regManager *cj.RegistrationManager, clientConn *net.TCPConn)
 		// Possible TODO: use NFQUEUE to be able to drop the connection
 		// in userspace before the SYN-ACK is sent, increasing probe
 		// resistance.
-		logger.Printf("no possible registrations, reading for %v then dropping connection\n", timeout)
+		logger.Debugf("no possible registrations, reading for %v then dropping connection", timeout)
 		cj.Stat().AddMissedReg()
 		cj.Stat().CloseConn()
 
@@ -114,17 +115,32 @@ func handleNewConn(regManager *cj.RegistrationManager, clientConn *net.TCPConn)
 		return
 	}
 
+	span := cj.StartSessionSpan(originalDstAddr.Port)
+	defer span.End()
+	handshake := span.Child("session.handshake")
+	defer handshake.End()
+
 	var buf [4096]byte
 	received := bytes.Buffer{}
+	// Everything read from the client, kept in case the connection has to be
+	// forwarded to the mask host (transports consume received).
+	seen := bytes.Buffer{}
 	possibleTransports := regManager.GetWrappingTransports()
 
 	var reg *cj.DecoyRegistration
 	var wrapped net.Conn
+	var phantomCheck *cj.Span
+	// One lookup for all the reads it takes to identify the registration.
+	lookup := handshake.Child("session.lookup")
+	defer lookup.End()
 
 readLoop:
 	for {
 		if len(possibleTransports) < 1 {
-			logger.Printf("ran out of possible transports, reading for %v then giving up\n", time.Until(deadline))
+			logger.Debugf("ran out of possible transports, reading for %v then giving up", time.Until(deadline))
+			lookup.SetError(transports.ErrNotTransport)
+			lookup.End()
+			handshake.SetError(transports.ErrNotTransport)
 			cj.Stat().ConnErr()
 			io.Copy(ioutil.Discard, clientConn)
 			return
@@ -132,11 +148,14 @@ readLoop:
 
 		n, err := clientConn.Read(buf[:])
 		if err != nil {
-			logger.Printf("got error while reading from connection, giving up after %d bytes: %v\n", received.Len(), err)
+			logger.Debugf("got error while reading from connection, giving up after %d bytes: %v", received.Len(), err)
+			lookup.SetError(err)
+			handshake.SetError(err)
 			cj.Stat().ConnErr()
 			return
 		}
 		received.Write(buf[:n])
+		seen.Write(buf[:n])
 		// logger.Printf("read %d bytes so far", received.Len())
 
 	transports:
@@ -148,181 +167,432 @@ readLoop:
 				// logger.Printf("not transport %s, removing from checks\n", t.Name())
 				delete(possibleTransports, i)
 				continue transports
+			} else if errors.Is(err, transports.ErrNotRegistered) {
+				// The connection is one of transport t but for no
+				// registration, it is handled as configured for t.
+				lookup.SetError(err)
+				lookup.End()
+				handshake.SetError(err)
+				cj.Stat().ConnErr()
+				if mask := conf.PrefixTransport.FailureMask(); mask != "" {
+					logger.Debugf("no registration for transport %s, forwarding to mask host", t.Name())
+					failed = false
+					cj.MaskForwardUnregistered(mask, clientConn, seen.Bytes(), logger)
+					return
+				}
+				logger.Debugf("no registration for transport %s, reading for %v then giving up", t.Name(), time.Until(deadline))
+				io.Copy(ioutil.Discard, clientConn)
+				return
+			} else if errors.Is(err, transports.ErrHandshakeMAC) {
+				// The client knows a registered tag but not its shared
+				// secret, a probe replaying an observed connection. It is
+				// closed after reading as long as for no registration,
+				// the failure was counted by the transport.
+				lookup.SetError(err)
+				lookup.End()
+				handshake.SetError(err)
+				cj.Stat().ConnErr()
+				logger.Debugf("handshake MAC failed for transport %s, reading for %v then giving up", t.Name(), time.Until(deadline))
+				io.Copy(ioutil.Discard, clientConn)
+				return
 			} else if err != nil {
 				// If we got here, the error might have been produced while attempting
 				// to wrap the connection, which means received and the connection
 				// may no longer be valid. We should just give up on this connection.
 				d := time.Until(deadline)
-				logger.Printf("got unexpected error from transport %s, sleeping %v then giving up: %v\n", t.Name(), d, err)
+				logger.Warnf("got unexpected error from transport %s, sleeping %v then giving up: %v", t.Name(), d, err)
+				lookup.SetError(err)
+				lookup.End()
+				handshake.SetError(err)
 				cj.Stat().ConnErr()
 				time.Sleep(d)
 				return
 			}
 
+			// The registration may expire while the connection uses its
+			// keys, they are zeroed only once the connection is done.
+			if !reg.HoldKeys() {
+				lookup.SetError(transports.ErrNotRegistered)
+				lookup.End()
+				handshake.SetError(transports.ErrNotRegistered)
+				cj.Stat().ConnErr()
+				logger.Debugf("registration found by transport %s expired, reading for %v then giving up", t.Name(), time.Until(deadline))
+				io.Copy(ioutil.Discard, clientConn)
+				return
+			}
+			defer reg.ReleaseKeys()
+
+			// Registrations with a derived phantom port only match connections
+			// to that port. The transport consumed what identified the
+			// registration, so no other transport can match either.
+			lookup.End()
+			timing.Matched = conf.Now()
+			phantomCheck = span.Child("session.phantom_check")
+			if allowed, err := conf.CheckPhantomPort(reg, originalDstAddr.Port); !allowed {
+				logger.Debugf("registration found by transport %s, but %v", t.Name(), err)
+				phantomCheck.SetError(err)
+				phantomCheck.End()
+				possibleTransports = nil
+				continue readLoop
+			} else if err != nil {
+				phantomCheck.SetError(err)
+				logger.Warnf("%v, proxying anyway (warn-only)", err)
+			}
+
+			// Registrations limited to the clients' source networks are
+			// not served to connections from elsewhere, whoever leaked
+			// the phantom.
+			if err := reg.CheckSource(clientConn.RemoteAddr()); err != nil {
+				logger.Debugf("registration found by transport %s, but %v, reading for %v then giving up", t.Name(), err, time.Until(deadline))
+				phantomCheck.SetError(err)
+				phantomCheck.End()
+				handshake.SetError(err)
+				cj.Stat().ConnErr()
+				io.Copy(ioutil.Discard, clientConn)
+				return
+			}
+
 			// We found our transport! First order of business: disable deadline
+			failed = false
 			wrapped.SetDeadline(time.Time{})
+			handshake.End()
+			span.SetRegistration(reg)
 			logger.SetPrefix(fmt.Sprintf("[%s] %s ", t.LogPrefix(), reg.IDString()))
-			logger.Printf("registration found {reg_id: %s, phantom: %s, transport: %s}\n", reg.IDString(), originalDstIP, t.Name())
+			logger.Infof("registration found {reg_id: %s, phantom: %s, transport: %s, bucket: %d}", reg.IDString(), originalDstAddr, t.Name(), reg.Bucket)
+			cj.Stat().AddStationKeyUse(reg.StationKeyIndex)
+			if n := regManager.BindStationKey(reg); n > 0 {
+				logger.Debugf("client used station key %d, removed %d registrations under other keys", reg.StationKeyIndex, n)
+			}
+			cj.Stat().AddBucketConn(reg.Bucket)
+			cj.Stat().AddRegistrationAge(reg.RegistrationTime)
+			if reg.LivenessPending() {
+				cj.Stat().AddPendingServed()
+			}
 			break readLoop
 		}
 	}
 
-	cj.Proxy(reg, wrapped, logger)
-	cj.Stat().CloseConn()
-}
-
-func get_zmq_updates(connectAddr string, regManager *cj.RegistrationManager, conf *cj.Config) {
-	logger := log.New(os.Stdout, "[ZMQ] ", log.Ldate|log.Lmicroseconds)
-	sub, err := zmq.NewSocket(zmq.SUB)
-	if err != nil {
-		logger.Printf("could not create new ZMQ socket: %v\n", err)
+	policy := reg.LivePhantomPolicy()
+	if policy == "" {
+		// The phantom may have become live since the client registered.
+		if live, reason := cj.PhantomKnownLive(reg.DarkDecoy); live {
+			policy = conf.LivePhantomPolicy
+			regManager.PhantomBecameLive(reg, reason, policy, conf.ExpireLivePhantoms)
+		}
+	}
+	phantomCheck.End()
+	switch policy {
+	case cj.LivePhantomReject:
+		logger.Infof("phantom became live, dropping connection")
+		cj.Stat().AddLivePhantomConn()
+		cj.Stat().CloseConn()
+		return
+	case cj.LivePhantomDivert:
+		logger.Infof("phantom was live, forwarding to mask host instead of proxying")
+		cj.Stat().AddLivePhantomConn()
+		cj.MaskForward(reg, clientConn, seen.Bytes(), logger)
+		cj.Stat().CloseConn()
 		return
+	case cj.LivePhantomLogOnly:
+		logger.Infof("phantom was live, proxying anyway (log-only policy)")
+		cj.Stat().AddLivePhantomConn()
 	}
-	defer sub.Close()
 
-	sub.Connect(connectAddr)
-	sub.SetSubscribe("")
+	if reg.Transport == cj.TransportTypeMux {
+		cj.ProxyMux(reg, wrapped, originalDstAddr.Port, span, logger, &conf.ProxyConfig, conf.IsBlocklisted)
+	} else {
+		cj.ProxyWithTiming(reg, wrapped, originalDstAddr.Port, timing, span, logger, &conf.ProxyConfig)
+	}
+	cj.Stat().CloseConn()
+}
 
-	logger.Printf("ZMQ connected to %v\n", connectAddr)
+// Reasons ingestRegistration drops a registration.
+var (
+	errCovertBlocked  = errors.New("malformed or blocklisted covert")
+	errPhantomBlocked = errors.New("blocklisted phantom")
 
-	for {
+	errLivenessQueueFull = errors.New("liveness queue full")
+)
 
-		newRegs, err := recieve_zmq_message(sub, regManager, conf)
+// ingestRegistration runs a newly received registration through the checks
+// shared by every registration channel and adds it (possibly pending its
+// liveness check) if it passes. Duplicates only refresh the tracked
+// registration and are not an error.
+func ingestRegistration(reg *cj.DecoyRegistration, regManager *cj.RegistrationManager, conf *cj.Config, logger *cj.Logger) error {
+	if regManager.RegistrationExists(reg) {
+		// log phantom IP, shared secret, ipv6 support
+		logger.Debugf("Duplicate registration: %v %s", reg.IDString(), reg.RegistrationSource)
+		cj.Stat().AddDupReg()
+
+		// Track the received registration, if it is already tracked it will just update the record
+		err := regManager.TrackRegistration(reg)
 		if err != nil {
-			logger.Printf("Encountered err when creating Reg: %v\n", err)
-			continue
-		}
-		if len(newRegs) == 0 {
-			// no new registration
-			continue
+			logger.Errorf("error tracking registration: %v", err)
+			cj.Stat().AddErrReg()
 		}
+		return nil
+	}
 
-		go func() {
-			// Handle multiple as receive_zmq_messages returns separate registrations for v4 and v6
-			for _, reg := range newRegs {
-				if reg == nil {
-					continue
-				}
+	// log phantom IP, shared secret, ipv6 support
+	logger.Infof("New registration: %s %v", reg.IDString(), reg.String())
 
-				if regManager.RegistrationExists(reg) {
-					// log phantom IP, shared secret, ipv6 support
-					logger.Printf("Duplicate registration: %v %s\n", reg.IDString(), reg.RegistrationSource)
-					cj.Stat().AddDupReg()
-
-					// Track the received registration, if it is already tracked it will just update the record
-					err := regManager.TrackRegistration(reg)
-					if err != nil {
-						logger.Println("error tracking registration: ", err)
-						cj.Stat().AddErrReg()
-					}
-					continue
-				}
+	conf.SetCovertFallbacks(reg)
 
-				// log phantom IP, shared secret, ipv6 support
-				logger.Printf("New registration: %s %v\n", reg.IDString(), reg.String())
+	// Track the received registration
+	err := regManager.TrackRegistration(reg)
+	if err != nil {
+		logger.Errorf("error tracking registration: %v", err)
+		cj.Stat().AddErrReg()
+	}
 
-				// Track the received registration
-				err := regManager.TrackRegistration(reg)
-				if err != nil {
-					logger.Println("error tracking registration: ", err)
-					cj.Stat().AddErrReg()
-				}
+	// If registration is trying to connect to a dark decoy that is blocklisted continue
+	if reg.Covert == "" || conf.IsBlocklisted(reg.Covert) {
+		logger.Warnf("Dropping reg, malformed or blocklisted covert: %v, %s, %v", reg.IDString(), reg.Covert, err)
+		cj.Stat().AddErrReg()
+		cj.PublishRegistrationRejected(reg, "blocklisted_covert")
+		return errCovertBlocked
+	}
+	if conf.ViolatesStrictTLS(reg.Covert) {
+		logger.Warnf("Dropping reg, covert not allowed in strict TLS mode: %v, %s", reg.IDString(), reg.Covert)
+		cj.Stat().AddErrReg()
+		cj.PublishRegistrationRejected(reg, "strict_tls")
+		return errCovertBlocked
+	}
 
-				// If registration is trying to connect to a dark decoy that is blocklisted continue
-				if reg.Covert == "" || conf.IsBlocklisted(reg.Covert) {
-					logger.Printf("Dropping reg, malformed or blocklisted covert: %v, %s, %v", reg.IDString(), reg.Covert, err)
-					cj.Stat().AddErrReg()
-					continue
-				}
+	if !reg.PreScanned() {
+		// New registration received over channel that requires liveness scan for the
+		// phantom. Add it right away as pending and check the phantom in the background
+		// so that probing never holds up ingest.
+		blocked := conf.IsBlocklistedPhantom(reg.DarkDecoy)
+		if !blocked {
+			regManager.AddPendingRegistration(reg, time.Duration(conf.LivenessPendingTimeout)*time.Second)
+			logger.Debugf("Adding pending registration %v", reg.IDString())
+			cj.Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource)
+		}
+		queued := regManager.LivenessPool.Go(func() { checkPendingLiveness(regManager, reg, conf, blocked) })
+		if !queued && !blocked {
+			logger.Warnf("Dropping registration %v -- liveness queue full", reg.IDString())
+			regManager.EvictRegistration(reg)
+			cj.Stat().AddPendingExpired()
+			cj.PublishRegistrationRejected(reg, "pending_expired")
+			return errLivenessQueueFull
+		}
+		if blocked {
+			cj.PublishRegistrationRejected(reg, "blocklisted_phantom")
+			return errPhantomBlocked
+		}
+		return nil
+	}
 
-				if !reg.PreScanned() {
-					// New registration received over channel that requires liveness scan for the phantom
-					liveness, response := reg.PhantomIsLive()
-					if liveness == true {
-						logger.Printf("Dropping registration %v -- live phantom: %v\n", reg.IDString(), response)
-						cj.Stat().AddLivenessFail()
-						continue
-					}
-					cj.Stat().AddLivenessPass()
-				}
+	if conf.EnableShareOverAPI && *reg.RegistrationSource == pb.RegistrationSource_Detector {
+		// Registration received from decoy-registrar, share over API if enabled.
+		go tryShareRegistrationOverAPI(reg, conf.PreshareEndpoint)
+	}
 
-				if conf.EnableShareOverAPI && *reg.RegistrationSource == pb.RegistrationSource_Detector {
-					// Registration received from decoy-registrar, share over API if enabled.
-					go tryShareRegistrationOverAPI(reg, conf.PreshareEndpoint)
-				}
+	if conf.IsBlocklistedPhantom(reg.DarkDecoy) {
+		// Note: Phantom blocklist is applied at this stage because the phantom may only be blocked on this
+		// station. We may want other stations to be informed about the registration, but prevent this station
+		// specifically from handling / interfering in any subsequent connection. See PR #75
+		logger.Infof("ignoring registration with blocklisted phantom: %s %v", reg.IDString(), reg.DarkDecoy)
+		cj.PublishRegistrationRejected(reg, "blocklisted_phantom")
+		return errPhantomBlocked
+	}
 
-				if conf.IsBlocklistedPhantom(reg.DarkDecoy) {
-					// Note: Phantom blocklist is applied at this stage because the phantom may only be blocked on this
-					// station. We may want other stations to be informed about the registration, but prevent this station
-					// specifically from handling / interfering in any subsequent connection. See PR #75
-					logger.Printf("ignoring registration with blocklisted phantom: %s %v", reg.IDString(), reg.DarkDecoy)
-					continue
-				}
+	// validate the registration
+	regManager.AddRegistration(reg)
+	logger.Debugf("Adding registration %v", reg.IDString())
+	cj.Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource)
+	return nil
+}
 
-				// validate the registration
-				regManager.AddRegistration(reg)
-				logger.Printf("Adding registration %v\n", reg.IDString())
-				cj.Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource)
+// checkPendingLiveness runs the phantom liveness check for a registration
+// received without a prescan. If the phantom is live the registration is
+// evicted, unless the live phantom policy keeps it tagged. Otherwise it is
+// confirmed (and shared over the API if enabled). Blocked registrations were
+// not added, for them only the sharing is done.
+func checkPendingLiveness(regManager *cj.RegistrationManager, reg *cj.DecoyRegistration, conf *cj.Config, blocked bool) {
+	if !blocked && regManager.PendingExpired(reg) {
+		// Waited in the queue past its pending deadline, confirming it
+		// would fail: drop it without probing.
+		regManager.ConfirmRegistration(reg)
+		logger.Infof("Dropping registration %v -- liveness check finished after the pending timeout", reg.IDString())
+		cj.Stat().AddPendingExpired()
+		cj.PublishRegistrationRejected(reg, "pending_expired")
+		return
+	}
+
+	span := cj.StartChild("registration.liveness", reg.Trace)
+	liveness, response := reg.PhantomIsLive()
+	span.End()
+	if liveness {
+		cj.Stat().AddLivenessFail()
+		cj.Stat().AddLivePhantomPolicy(conf.LivePhantomPolicy)
+		if conf.LivePhantomPolicy == cj.LivePhantomReject {
+			logger.Infof("Dropping registration %v -- live phantom: %v", reg.IDString(), response)
+			if !blocked {
+				regManager.EvictRegistration(reg)
+				cj.Stat().AddLivenessEvicted()
+				cj.PublishRegistrationRejected(reg, "live_phantom")
 			}
-		}()
+			return
+		}
+		reg.MarkLivePhantom(conf.LivePhantomPolicy)
+		logger.Infof("Keeping registration %v -- live phantom: %v: %s", reg.IDString(), response, reg.String())
+	} else {
+		cj.Stat().AddLivenessPass()
+	}
+
+	if !blocked {
+		if !regManager.ConfirmRegistration(reg) {
+			logger.Infof("Dropping registration %v -- liveness check finished after the pending timeout", reg.IDString())
+			cj.Stat().AddPendingExpired()
+			cj.PublishRegistrationRejected(reg, "pending_expired")
+			return
+		}
+		cj.Stat().AddLivenessConfirmed()
+	}
+
+	if conf.EnableShareOverAPI && *reg.RegistrationSource == pb.RegistrationSource_Detector {
+		// Registration received from decoy-registrar, share over API if enabled.
+		go tryShareRegistrationOverAPI(reg, conf.PreshareEndpoint)
+	}
 
+	if blocked {
+		logger.Infof("ignoring registration with blocklisted phantom: %s %v", reg.IDString(), reg.DarkDecoy)
 	}
 }
 
 func tryShareRegistrationOverAPI(reg *cj.DecoyRegistration, apiEndpoint string) {
 	c2a := reg.GenerateC2SWrapper()
 
-	payload, err := proto.Marshal(c2a)
+	// Covert credentials are sealed on their own, never sent in the clear.
+	payload, err := cj.MarshalRegistration(c2a, reg.CovertCredentials)
 	if err != nil {
-		logger.Printf("%v failed to marshal C2SWrapper payload: %v", reg.IDString(), err)
+		logger.Errorf("%v failed to marshal C2SWrapper payload: %v", reg.IDString(), err)
 		return
 	}
+	payload = cj.AppendRegistrationExpiry(payload, reg.Expiry)
+	payload = cj.AppendRegistrationHandshakeMAC(payload, reg.HandshakeMAC)
+	payload = cj.AppendRegistrationAllowedSources(payload, reg.AllowedSources)
+	payload = cj.AppendRegistrationSessionResumption(payload, reg.SessionResumption)
 
 	err = executeHTTPRequest(reg, payload, apiEndpoint)
 	if err != nil {
-		logger.Printf("%v failed to share Registration over API: %v", reg.IDString(), err)
+		logger.Warnf("%v failed to share Registration over API: %v", reg.IDString(), err)
 		return
 	}
 	return
 }
 
 func executeHTTPRequest(reg *cj.DecoyRegistration, payload []byte, apiEndpoint string) error {
-	resp, err := http.Post(apiEndpoint, "", bytes.NewReader(payload))
+	req, err := http.NewRequest(http.MethodPost, apiEndpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	// Tells the receiving station which station shared the registration.
+	req.Header.Set(cj.StationHeader, cj.Station().ID)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		logger.Printf("%v failed to do HTTP request to registration endpoint %s: %v", reg.IDString(), apiEndpoint, err)
+		logger.Warnf("%v failed to do HTTP request to registration endpoint %s: %v", reg.IDString(), apiEndpoint, err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		logger.Printf("%v got non-success response code %d from registration endpoint %v", reg.IDString(), resp.StatusCode, apiEndpoint)
+		logger.Warnf("%v got non-success response code %d from registration endpoint %v", reg.IDString(), resp.StatusCode, apiEndpoint)
 		return fmt.Errorf("non-success response code %d on %s", resp.StatusCode, apiEndpoint)
 	}
 
 	return nil
 }
 
-// recieve_zmq_message  ingests messages from zmq and parses them into
-// registration structs for the registration manager to process.
-// **NOTE** : Avoid ALL blocking calls (i.e. things that require a lock on the
-// registration tracking structs) in this method because it will block and
-// prevent the station from ingesting new registrations.
-// **NOTE2**: If the registration address is IPv4 we will create registrations
-// for both IPv4 decoy and IPv6 decoy. However, If the client Address from
-// registrations is IPv6 we will only create an ipv6 registration because
-// 		1) we have no client address to match on for ipv4
-//	 	2) the client _should_ support ipv6
-func recieve_zmq_message(sub *zmq.Socket, regManager *cj.RegistrationManager, conf *cj.Config) ([]*cj.DecoyRegistration, error) {
-	msg, err := sub.RecvBytes(0)
+// Outcomes of received registration messages, see metrics.IngestMessages.
+const (
+	ingestOutcomeRegistration      = "registration"
+	ingestOutcomeEmpty             = "empty"
+	ingestOutcomeLivePhantomReport = "live_phantom_report"
+	ingestOutcomeMalformed         = "malformed"
+	ingestOutcomeRejected          = "rejected"
+)
+
+// parseRegistrationMessage creates the registrations for a marshaled
+// C2SWrapper received over channel. prepare, if not nil, can fill in fields
+// of the parsed wrapper that the channel knows better (e.g. the source). The
+// parse and derive phases are recorded as children of span, the ingest span
+// of the message (which may be nil), and the registrations keep its context.
+func parseRegistrationMessage(msg []byte, regManager *cj.RegistrationManager, conf *cj.Config, channel string, span *cj.Span, prepare func(*pb.C2SWrapper)) ([]*cj.DecoyRegistration, error) {
+	parse := span.Child("registration.parse")
+	parsed := &pb.C2SWrapper{}
+	err := proto.Unmarshal(msg, parsed)
+	parse.SetError(err)
+	parse.End()
 	if err != nil {
-		logger.Printf("error reading from ZMQ socket: %v\n", err)
+		metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+		logger.Warnf("Failed to unmarshall ClientToStation: %v", err)
 		return nil, err
 	}
+	if prepare != nil {
+		prepare(parsed)
+	}
 
-	parsed := &pb.C2SWrapper{}
-	err = proto.Unmarshal(msg, parsed)
+	// A registration may carry its own expiry, one already past is useless.
+	expiry, err := cj.RegistrationExpiry(msg, regManager.Now())
+	if errors.Is(err, cj.ErrRegistrationExpired) {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+		cj.Stat().AddPastExpiryReg()
+		cj.Events().Publish(cj.Event{Type: cj.EventRegistrationRejected, Reason: "past_expiry"})
+		logger.Warnf("Dropping registration: expired at %v", expiry)
+		return nil, err
+	} else if err != nil {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+		logger.Warnf("Failed to read registration expiry: %v", err)
+		return nil, err
+	}
+	// A registration published long ago may have lost much of its useful
+	// life on the way.
+	publishTime, err := cj.RegistrationPublishTime(msg)
+	if err != nil {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+		logger.Warnf("Failed to read registration publish time: %v", err)
+		return nil, err
+	}
+	if now := regManager.Now(); conf.RegistrationStale(publishTime, now) {
+		metrics.StaleRegistrations.Inc(channel)
+		expiry = conf.StaleRegistrationExpiry(publishTime, expiry)
+		if !expiry.IsZero() && !expiry.After(now) {
+			metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+			cj.Stat().AddPastExpiryReg()
+			cj.Events().Publish(cj.Event{Type: cj.EventRegistrationRejected, Reason: "past_expiry"})
+			logger.Warnf("Dropping stale registration: published %v ago", now.Sub(publishTime))
+			return nil, cj.ErrRegistrationExpired
+		}
+		logger.Debugf("stale registration published %v ago", now.Sub(publishTime))
+	}
+	handshakeMAC, err := cj.RegistrationHandshakeMAC(msg)
 	if err != nil {
-		logger.Printf("Failed to unmarshall ClientToStation: %v", err)
+		metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+		logger.Warnf("Failed to read registration handshake MAC: %v", err)
+		return nil, err
+	}
+	allowedSources, err := cj.RegistrationAllowedSources(msg)
+	if err != nil {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+		logger.Warnf("Failed to read registration allowed sources: %v", err)
+		return nil, err
+	}
+	resumption, err := cj.RegistrationSessionResumption(msg)
+	if err != nil {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+		logger.Warnf("Failed to read registration session resumption: %v", err)
+		return nil, err
+	}
+
+	derive := span.Child("registration.derive")
+	defer derive.End()
+	secrets, err := regManager.SharedSecretCandidates(parsed, msg)
+	if err != nil {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+		logger.Warnf("Failed to derive shared secret: %v", err)
 		return nil, err
 	}
 
@@ -343,56 +613,145 @@ func recieve_zmq_message(sub *zmq.Socket, regManager *cj.RegistrationManager, co
 	// Register one or both of v4 and v6 based on support specified by the client
 	var newRegs []*cj.DecoyRegistration
 
-	// if the clients address is ipv6 skip creating an ipv4 registration.
-	if parsed.GetRegistrationPayload().GetV4Support() && conf.EnableIPv4 && sourceAddr.To4() != nil {
-		reg, err := regManager.NewRegistrationC2SWrapper(parsed, false)
-		if err != nil {
-			logger.Printf("Failed to create registration: %v", err)
+	// When rotating station keys there is one candidate secret per key. A
+	// sealed registration payload only opens under the secret of the key the
+	// client used, which chooses the candidate. A plaintext one is not bound
+	// to any key: it is registered under every candidate, so that clients
+	// still on a rotated out key are served, and the candidates are linked so
+	// that the first connection whose tag validates removes the others.
+	authFailures := 0
+	for _, secret := range secrets {
+		parsed.SharedSecret = secret.Secret
+
+		// Newer registrars deliver the ClientToStation encrypted under a key
+		// derived from the shared secret. Only a candidate secret that
+		// decrypts it can produce a usable registration. Covert credentials
+		// are read from the same payload, and must never be logged.
+		payload, creds, err := cj.OpenRegistration(msg, secret.Secret)
+		if errors.Is(err, cj.ErrRegistrationAuth) {
+			authFailures++
+			continue
+		} else if err != nil {
+			metrics.IngestMessages.Inc(channel, ingestOutcomeMalformed)
+			logger.Warnf("Failed to read registration payload: %v", err)
 			return nil, err
 		}
+		if payload != nil {
+			parsed.RegistrationPayload = payload
+		}
 
-		// Received new registration, parse it and return
-		newRegs = append(newRegs, reg)
-	}
+		// if the clients address is ipv6 skip creating an ipv4 registration.
+		if parsed.GetRegistrationPayload().GetV4Support() && conf.EnableIPv4 && sourceAddr.To4() != nil {
+			reg, err := regManager.NewRegistrationC2SWrapper(parsed, false)
+			if errors.Is(err, cj.ErrPhantomDrained) {
+				// Logged and counted by the registration manager, the
+				// client's registration of the other family may proceed.
+				cj.Events().Publish(cj.Event{Type: cj.EventRegistrationRejected, Reason: "phantom_drained"})
+			} else if err != nil {
+				metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+				logger.Warnf("Failed to create registration: %v", err)
+				return nil, err
+			} else {
+				reg.StationKeyIndex = secret.KeyIndex
+				reg.CovertCredentials = creds
+
+				// Received new registration, parse it and return
+				newRegs = append(newRegs, reg)
+			}
+		}
 
-	if parsed.GetRegistrationPayload().GetV6Support() && conf.EnableIPv6 {
-		reg, err := regManager.NewRegistrationC2SWrapper(parsed, true)
-		if err != nil {
-			logger.Printf("Failed to create registration: %v", err)
-			return nil, err
+		if parsed.GetRegistrationPayload().GetV6Support() && conf.EnableIPv6 {
+			reg, err := regManager.NewRegistrationC2SWrapper(parsed, true)
+			if errors.Is(err, cj.ErrPhantomDrained) {
+				// Logged and counted by the registration manager, the
+				// client's registration of the other family may proceed.
+				cj.Events().Publish(cj.Event{Type: cj.EventRegistrationRejected, Reason: "phantom_drained"})
+			} else if err != nil {
+				metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+				logger.Warnf("Failed to create registration: %v", err)
+				return nil, err
+			} else {
+				reg.StationKeyIndex = secret.KeyIndex
+				reg.CovertCredentials = creds
+
+				// add to list of new registrations to be processed.
+				newRegs = append(newRegs, reg)
+			}
 		}
-		// add to list of new registrations to be processed.
-		newRegs = append(newRegs, reg)
+	}
+
+	if authFailures == len(secrets) {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+		cj.Stat().AddAuthErrReg()
+		// There is no registration to identify, the secret is unknown.
+		cj.Events().Publish(cj.Event{Type: cj.EventRegistrationRejected, Reason: "auth_error"})
+		logger.Warnf("Dropping registration: %v", cj.ErrRegistrationAuth)
+		return nil, cj.ErrRegistrationAuth
+	}
+
+	cj.LinkKeyCandidates(newRegs)
+	for _, reg := range newRegs {
+		reg.Expiry = expiry
+		reg.HandshakeMAC = handshakeMAC
+		reg.AllowedSources = allowedSources
+		reg.SessionResumption = resumption
+		reg.Trace = span.Context()
+	}
+
+	// The policy sees the registrations complete, and accepts or rejects
+	// the message as a whole.
+	if err := regManager.CheckPolicy(newRegs, sourceAddr); err != nil {
+		// Logged with its reason by the registration manager.
+		metrics.IngestMessages.Inc(channel, ingestOutcomeRejected)
+		cj.Events().Publish(cj.Event{Type: cj.EventRegistrationRejected, Reason: "policy"})
+		return nil, err
+	}
+
+	if len(newRegs) == 0 {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeEmpty)
+	} else {
+		metrics.IngestMessages.Inc(channel, ingestOutcomeRegistration)
 	}
 
 	// log decoy connection and id string
 	if len(newRegs) > 0 {
+		span.SetRegistration(newRegs[0])
 		if logClientIP {
-			logger.Printf("received registration: '%v' -> '%v' %v %s\n", sourceAddr, phantomAddr, newRegs[0].IDString(), parsed.GetRegistrationSource())
+			logger.Debugf("received registration: '%v' -> '%v' %v %s", sourceAddr, phantomAddr, newRegs[0].IDString(), parsed.GetRegistrationSource())
 		} else {
-			logger.Printf("received registration: '_' -> '%v' %v %s\n", phantomAddr, newRegs[0].IDString(), parsed.GetRegistrationSource())
+			logger.Debugf("received registration: '_' -> '%v' %v %s", phantomAddr, newRegs[0].IDString(), parsed.GetRegistrationSource())
 		}
 	}
 	return newRegs, nil
 }
 
-var logger *log.Logger
+var logger *cj.Logger
 var logClientIP = false
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
 	var err error
 	var zmqAddress string
+	var logLevelName string
+	var allowPublicManagement, allowPublicCovertEcho bool
 	flag.StringVar(&zmqAddress, "zmq-address", "ipc://@zmq-proxy", "Address of ZMQ proxy")
+	flag.StringVar(&logLevelName, "log-level", "info", "Minimum level to log: debug, info, warn or error")
+	flag.BoolVar(&allowPublicManagement, "allow-public-management", false, "Allow management_listen_addr to be a non-loopback address")
+	flag.BoolVar(&allowPublicCovertEcho, "allow-public-covert-echo", false, "Allow the test-only covert_echo with listeners on non-loopback addresses")
 	flag.Parse()
 
 	regManager := cj.NewRegistrationManager()
 	logger = regManager.Logger
 
+	logLevel, err := cj.ParseLogLevel(logLevelName)
+	if err != nil {
+		logger.Fatalf("[STARTUP] %v", err)
+	}
+	cj.SetLogLevel(logLevel)
+
 	// Should we log client IP addresses
 	logClientIP, err = strconv.ParseBool(os.Getenv("LOG_CLIENT_IP"))
 	if err != nil {
-		logger.Printf("failed parse client ip logging setting: %v\n", err)
+		logger.Debugf("failed parse client ip logging setting: %v", err)
 		logClientIP = false
 	}
 
@@ -404,22 +763,149 @@ func main() {
 	if err != nil {
 		logger.Fatalf("failed to parse app config: %v", err)
 	}
+	if err := conf.SetPhantomSubnets(regManager.PhantomSelector); err != nil {
+		logger.Fatalf("[STARTUP] %v", err)
+	}
+	regManager.PhantomDrain, err = cj.NewPhantomDrain(regManager.PhantomSelector, conf.DrainedPhantomSubnets)
+	if err != nil {
+		logger.Fatalf("[STARTUP] %v", err)
+	}
+	regManager.PhantomDrain.HandleAdmin(cj.NewLogger("[DRAIN] "))
+	regManager.HandleLookups()
+	regManager.HandleSessionRateLimits(cj.NewLogger("[RATE_LIMIT] "))
+	if len(conf.DrainedPhantomSubnets) > 0 {
+		logger.Infof("[STARTUP] Phantom subnets drained: %v", conf.DrainedPhantomSubnets)
+	}
+	regManager.SetConnParking(conf.ConnParking())
+	if conf.ParkConnections {
+		logger.Infof("[STARTUP] Parking up to %d connections without registration for %dms", conf.ParkMax, conf.ParkTimeout)
+	}
+
+	// The identity labels every metric series, event and flow record from
+	// here on. It is only read at startup.
+	if err := cj.SetStationIdentity(conf.Station); err != nil {
+		logger.Fatalf("[STARTUP] %v", err)
+	}
+	logger.Infof("[STARTUP] Station %v (changing the station identity requires a restart and starts new metric series)", cj.Station())
+
+	// Refuse to start if another station on this host holds the lock. This
+	// must happen before any socket is opened.
+	if conf.LockFile != "" {
+		lock, err := cj.AcquireInstanceLock(conf.LockFile)
+		if err != nil {
+			logger.Fatalf("[STARTUP] refusing to start: %v", err)
+		}
+		defer lock.Release()
+	}
+
+	// Internal endpoints are all served on the management address, never
+	// next to the public registration API.
+	managementLn, err := cj.ListenManagement(conf.ManagementListenAddr, allowPublicManagement)
+	if err != nil {
+		logger.Fatalf("[STARTUP] refusing to start: %v", err)
+	}
+	logger.Infof("[STARTUP] Serving management endpoint on %v", managementLn.Addr())
+	go func() {
+		err := http.Serve(managementLn, cj.Admin())
+		logger.Errorf("management endpoint closed: %v", err)
+	}()
 
 	// Launch local ZMQ proxy
-	go cj.ZMQProxy(conf.ZMQConfig)
+	err = cj.StartZMQProxy(conf.ZMQConfig)
+	if err != nil {
+		logger.Fatalf("[STARTUP] refusing to start: %v", err)
+	}
+
+	regManager.StationKeys, err = cj.LoadStationKeys(conf.StationPrivkeyPaths)
+	if err != nil {
+		logger.Fatalf("[STARTUP] %v", err)
+	}
+
+	// The registration manager and liveness checks are configured fully
+	// before anything that creates registrations (ingestors, the API,
+	// transfers) is started.
+	regManager.ExperimentBuckets = conf.ExperimentBuckets
+	cj.SetLivenessTimeout(time.Duration(conf.LivenessTimeout) * time.Millisecond)
+	cj.SetLivenessConcurrency(conf.LivenessConcurrency)
+	regManager.LivenessPool = cj.NewLivenessPool(conf.LivenessConcurrency, conf.LivenessQueue)
+	cj.SetLivenessPool(regManager.LivenessPool)
+	regManager.SetServePending(conf.ServePendingRegistrations)
+	cj.SetLivenessCache(conf.LivenessCacheSize, time.Duration(conf.LivenessCacheLiveTTL)*time.Second,
+		time.Duration(conf.LivenessCacheNotLiveTTL)*time.Second)
+	cj.SetLivenessSubnetLearning(conf.LivenessSubnetThreshold, time.Duration(conf.LivenessSubnetSkip)*time.Second,
+		conf.LivenessSubnetResample)
 
 	// Add registration channel options
 	err = regManager.AddTransport(pb.TransportType_Min, min.Transport{})
 	if err != nil {
-		logger.Printf("failed to add transport: %v", err)
+		logger.Errorf("failed to add transport: %v", err)
 	}
 	err = regManager.AddTransport(pb.TransportType_Obfs4, obfs4.Transport{})
 	if err != nil {
-		logger.Printf("failed to add transport: %v", err)
+		logger.Errorf("failed to add transport: %v", err)
+	}
+	err = regManager.AddTransport(cj.TransportTypeMux, mux.Transport{})
+	if err != nil {
+		logger.Errorf("failed to add transport: %v", err)
+	}
+	if len(conf.PrefixTransport.Prefixes) > 0 {
+		err = regManager.AddTransport(cj.TransportTypePrefix, prefix.New(&conf.PrefixTransport))
+		if err != nil {
+			logger.Errorf("failed to add transport: %v", err)
+		}
 	}
 
-	// Receive registration updates from ZMQ Proxy as subscriber
-	go get_zmq_updates(zmqAddress, regManager, conf)
+	if conf.TracingEndpoint != "" {
+		tracer, err := cj.NewTracer(conf.TracingEndpoint, conf.TracingSampleRatio, cj.NewLogger("[TRACING] ").Logger)
+		if err != nil {
+			logger.Fatalf("[STARTUP] %v", err)
+		}
+		cj.EnableTracing(tracer)
+		go tracer.Run()
+		logger.Infof("[STARTUP] Exporting traces to %v, sampling %v", conf.TracingEndpoint, conf.TracingSampleRatio)
+	}
+
+	// Load testing only: every session is proxied to the embedded covert.
+	if err := conf.StartCovertEcho(allowPublicCovertEcho, cj.NewLogger("[ECHO] ").Logger); err != nil {
+		logger.Fatalf("[STARTUP] refusing to start: %v", err)
+	}
+	if conf.CovertEcho != "" {
+		logger.Warnf("[STARTUP] TEST ONLY: proxying every session to the embedded %s covert on %v instead of its covert", conf.CovertEcho, conf.CovertEchoAddress())
+	}
+
+	conf.StartCovertWarmup(cj.NewLogger("[WARMUP] ").Logger)
+	conf.StartCovertPrewarm(cj.NewLogger("[PREWARM] ").Logger)
+	if len(conf.CovertPrewarm) > 0 {
+		logger.Infof("[STARTUP] Keeping %d idle connections to each of %d coverts", conf.CovertPrewarmIdle, len(conf.CovertPrewarm))
+	}
+	conf.StartCovertReuse()
+	if len(conf.CovertReuse) > 0 {
+		logger.Infof("[STARTUP] Reusing the covert connections of sessions to %d coverts for %ds", len(conf.CovertReuse), conf.CovertReuseMaxIdle)
+	}
+
+	// Receive registrations from the configured ingestors, all of them
+	// checked and added by the same pipeline.
+	var ingestors []cj.Ingestor
+	for _, name := range conf.Ingestors {
+		switch name {
+		case metrics.ChannelZMQ:
+			ingestors = append(ingestors, newZMQIngestor(zmqAddress, regManager, conf))
+		default:
+			logger.Fatalf("[STARTUP] unknown ingestor %q", name)
+		}
+	}
+	ingestLogger := cj.NewLogger("[INGEST] ")
+	pipeline, err := cj.NewIngestPipeline(func(reg *cj.DecoyRegistration) {
+		ingestRegistration(reg, regManager, conf, ingestLogger)
+	}, ingestLogger, ingestors...)
+	if err != nil {
+		logger.Fatalf("[STARTUP] %v", err)
+	}
+	cj.Admin().HandleStatus("ingestors", pipeline.Status)
+	logger.Infof("[STARTUP] Receiving registrations from %v", conf.Ingestors)
+	ingestCtx, stopIngest := context.WithCancel(context.Background())
+	defer stopIngest()
+	go pipeline.Run(ingestCtx)
 
 	// Periodically clean old registrations
 	go func() {
@@ -429,22 +915,181 @@ func main() {
 		}
 	}()
 
-	// listen for and handle incoming proxy traffic
-	listenAddr := &net.TCPAddr{IP: nil, Port: 41245, Zone: ""}
-	ln, err := net.ListenTCP("tcp", listenAddr)
+	// Periodically force-close sessions that have outlived their limits, in
+	// case a stuck proxy goroutine never notices on its own.
+	if conf.SessionReapInterval > 0 {
+		reapLogger := cj.NewLogger("[REAPER] ")
+		go func() {
+			for {
+				time.Sleep(time.Duration(conf.SessionReapInterval) * time.Second)
+				cj.Sessions().Reap(time.Duration(conf.SessionIdleTimeout)*time.Second,
+					time.Duration(conf.SessionMaxLifetime)*time.Second, reapLogger.Logger)
+			}
+		}()
+	}
+
+	// Periodically report the stats, and a heartbeat so operators can tell
+	// the station is alive and healthy at a glance.
+	cj.Stat().SetRegistrationMemory(conf.StatsRegistrationMemory)
+	statsSink, err := cj.NewStatsSink(conf.StatsOutput, os.Stdout)
 	if err != nil {
-		logger.Printf("failed to listen on %v: %v\n", listenAddr, err)
-		return
+		logger.Fatalf("[STARTUP] %v", err)
 	}
-	defer ln.Close()
-	logger.Printf("[STARTUP] Listening on %v\n", ln.Addr())
+	reporter := cj.NewReporter(statsSink, conf.StatsReportIntervals())
+	reporter.RegisterStats(cj.Stat())
+	go reporter.Run(context.Background())
 
-	for {
-		newConn, err := ln.AcceptTCP()
+	if conf.StatsdAddr != "" {
+		sink, err := metrics.NewStatsdSink(conf.StatsdAddr, conf.StatsdPrefix, conf.StatsdTags, cj.NewLogger("[STATSD] ").Logger)
 		if err != nil {
-			logger.Printf("[ERROR] failed to AcceptTCP on %v: %v\n", ln.Addr(), err)
-			continue
+			logger.Fatalf("[STARTUP] %v", err)
+		}
+		logger.Infof("[STARTUP] Sending metrics to statsd at %v every %ds", conf.StatsdAddr, conf.StatsdFlushInterval)
+		go sink.Run(time.Duration(conf.StatsdFlushInterval) * time.Second)
+	}
+
+	if conf.IPFIXCollector != "" {
+		exporter, err := cj.NewIPFIXExporter(conf.IPFIXCollector, conf.IPFIXObservationDomain, conf.IPFIXEnterpriseID, conf.IPFIXClientAddresses, cj.NewLogger("[IPFIX] ").Logger)
+		if err != nil {
+			logger.Fatalf("[STARTUP] %v", err)
+		}
+		cj.Sessions().SetIPFIXExporter(exporter)
+		if conf.IPFIXActiveTimeout > 0 {
+			go exporter.Run(cj.Sessions(), time.Duration(conf.IPFIXActiveTimeout)*time.Second)
+		}
+		logger.Infof("[STARTUP] Exporting session flow records to IPFIX collector %v", conf.IPFIXCollector)
+	}
+
+	if conf.AlertWebhook != "" {
+		alerter := cj.NewAlerter(conf.AlertWebhook, time.Duration(conf.AlertNoRegistrations)*time.Second,
+			conf.AlertDialFailureRatio, conf.AlertDialFailureWindow, time.Duration(conf.AlertRateLimit)*time.Second,
+			cj.NewLogger("[ALERT] ").Logger)
+		cj.Stat().OnSnapshot(alerter.Observe)
+		go alerter.Run()
+		logger.Infof("[STARTUP] Sending alerts to webhook")
+	}
+
+	if conf.RegistrationAPIAddr != "" {
+		api := &registrationAPI{regManager, conf, cj.NewLogger("[API] ")}
+		logger.Infof("[STARTUP] Accepting registrations over HTTPS on %v", conf.RegistrationAPIAddr)
+		go func() {
+			err := http.ListenAndServeTLS(conf.RegistrationAPIAddr, conf.RegistrationAPICert, conf.RegistrationAPIKey, api)
+			logger.Errorf("registration endpoint closed: %v", err)
+		}()
+	}
+
+	if conf.TransferKey() != nil {
+		transferLogger := cj.NewLogger("[TRANSFER] ")
+		cj.Admin().Handle("/registrations/export", &registrationExport{regManager, conf, transferLogger})
+		if conf.TransferListenAddr != "" {
+			transferLn, err := cj.ListenTransfer(conf.TransferListenAddr)
+			if err != nil {
+				logger.Fatalf("[STARTUP] failed to open registration transfer listener: %v", err)
+			}
+			logger.Infof("[STARTUP] Importing registrations transferred on %v", conf.TransferListenAddr)
+			go func() {
+				err := regManager.ServeTransfers(transferLn, conf.TransferKey(), conf, transferLogger)
+				transferLogger.Errorf("registration transfer listener closed: %v", err)
+			}()
+		}
+	}
+
+	if conf.EventSocket != "" {
+		eventLn, err := cj.Events().ListenUnix(conf.EventSocket)
+		if err != nil {
+			logger.Fatalf("[STARTUP] failed to open event socket: %v", err)
+		}
+		eventLogger := cj.NewLogger("[EVENTS] ")
+		logger.Infof("[STARTUP] Publishing events on %v", conf.EventSocket)
+		go func() {
+			err := cj.Events().Serve(eventLn, eventLogger.Logger)
+			eventLogger.Errorf("event socket closed: %v", err)
+		}()
+	}
+
+	if conf.EventLog != "" {
+		eventLog, err := cj.NewEventLog(conf.EventLog, int64(conf.EventLogMaxSize)<<20, conf.EventLogKeep, cj.NewLogger("[EVENTS] ").Logger)
+		if err != nil {
+			logger.Fatalf("[STARTUP] %v", err)
+		}
+		eventLog.Start(cj.Events())
+		logger.Infof("[STARTUP] Logging events to %v", conf.EventLog)
+	}
+	cj.Events().Publish(cj.Event{Type: cj.EventConfigReload, Detail: "startup"})
+
+	// Reload the covert policy files on SIGHUP, for the registrations (and
+	// mux streams) checked from then on.
+	if policy := conf.CovertPolicy(); policy != nil {
+		allow, deny := policy.Rules()
+		logger.Infof("[STARTUP] Covert policy of %d files: %d allow and %d deny rules", policy.Files(), allow, deny)
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				err := policy.Reload()
+				if err != nil {
+					logger.Errorf("[RELOAD] %v", err)
+				}
+				allow, deny := policy.Rules()
+				logger.Infof("[RELOAD] Covert policy of %d files: %d allow and %d deny rules", policy.Files(), allow, deny)
+				cj.Events().Publish(cj.Event{Type: cj.EventConfigReload, Detail: "covert_policy"})
+			}
+		}()
+	}
+
+	// listen for and handle incoming proxy traffic on every configured port
+	resolver, err := cj.NewOriginalDstResolver(conf.OriginalDstMode)
+	if err != nil {
+		logger.Fatalf("[STARTUP] %v\n", err)
+	}
+	if conf.OriginalDstMode == "proxy_header" {
+		logger.Warnf("[STARTUP] original_dst_mode \"proxy_header\" trusts the phantom clients claim to connect to, only use it for testing")
+	}
+	listeners, err := cj.ListenAll(conf.ListenAddrs, resolver, conf.ClientTCP.Control)
+	if err != nil {
+		logger.Fatalf("[STARTUP] %v\n", err)
+	}
+	for _, ln := range listeners {
+		logger.Infof("[STARTUP] Listening on %v", ln.Addr())
+		if err := resolver.SelfCheck(ln); err != nil {
+			logger.Warnf("[STARTUP] ========================")
+			logger.Warnf("[STARTUP] %v: %v", ln.Addr(), err)
+			logger.Warnf("[STARTUP] connections will only be matched to registrations if phantom traffic is redirected to this listener with an iptables REDIRECT/DNAT (or TPROXY) rule")
+		}
+	}
+
+	// Close all listeners on shutdown so that the accept loops return, give
+	// active sessions the grace period to finish, and let the deferred
+	// cleanup (e.g. releasing the instance lock) run. /healthz reports
+	// draining meanwhile.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		cj.SetHealth(cj.HealthDraining)
+		logger.Infof("[SHUTDOWN] received %v, closing listeners", sig)
+		stopIngest()
+		cj.CloseAll(listeners)
+	}()
+
+	acceptLoops(listeners, func(newConn *net.TCPConn) {
+		if !conf.ClientTCP.AllowAccept(newConn.RemoteAddr()) {
+			newConn.Close()
+			return
+		}
+		handleNewConn(regManager, newConn, conf, resolver)
+	})
+
+	if conf.ShutdownGracePeriod > 0 {
+		logger.Infof("[SHUTDOWN] waiting up to %ds for %d active sessions", conf.ShutdownGracePeriod, cj.Sessions().Count())
+		left := make(chan int, 1)
+		go func() { left <- cj.Sessions().Drain(time.Duration(conf.ShutdownGracePeriod) * time.Second) }()
+		select {
+		case n := <-left:
+			logger.Infof("[SHUTDOWN] %d sessions still open after the grace period", n)
+		case sig := <-sigCh:
+			logger.Infof("[SHUTDOWN] received %v, exiting with %d active sessions", sig, cj.Sessions().Count())
 		}
-		go handleNewConn(regManager, newConn)
 	}
+	cj.SetHealth(cj.HealthDown)
 }
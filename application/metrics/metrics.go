@@ -0,0 +1,477 @@
+// Package metrics is the station's metrics registry. Every metric the
+// station exports is defined in station.go and registered once, in Default.
+// Handler serves them in the Prometheus text exposition format and a
+// StatsdSink sends them to StatsD, either or both can be used.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types, as given in the TYPE line of the exposition format.
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// family is one metric name with its HELP and TYPE, and every label
+// combination seen so far.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	m        sync.RWMutex
+	children map[string]*child
+
+	hist    *Histogram    // the only series of a histogram family
+	histVec *HistogramVec // the series of a histogram family with labels
+}
+
+type child struct {
+	labelValues []string
+	bits        uint64 // float64 value
+}
+
+func (c *child) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&c.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (c *child) set(v float64) {
+	atomic.StoreUint64(&c.bits, math.Float64bits(v))
+}
+
+func (c *child) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (f *family) with(labelValues ...string) *child {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.m.RLock()
+	c, ok := f.children[key]
+	f.m.RUnlock()
+	if ok {
+		return c
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	if c, ok = f.children[key]; !ok {
+		c = &child{labelValues: append([]string(nil), labelValues...)}
+		f.children[key] = c
+	}
+	return c
+}
+
+// sortedChildren returns the series of f ordered by label values.
+func (f *family) sortedChildren() []*child {
+	f.m.RLock()
+	children := make([]*child, 0, len(f.children))
+	for _, c := range f.children {
+		children = append(children, c)
+	}
+	f.m.RUnlock()
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].labelValues, "\xff") < strings.Join(children[j].labelValues, "\xff")
+	})
+	return children
+}
+
+// write writes f with the registry's constant labels, consts, before its
+// own.
+func (f *family) write(w io.Writer, consts []labelPair) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.typ)
+	if f.hist != nil {
+		f.hist.write(w, consts)
+		return
+	}
+	if f.histVec != nil {
+		for _, h := range f.histVec.sortedSeries() {
+			h.write(w, consts)
+		}
+		return
+	}
+	names := make([]string, 0, len(consts)+len(f.labels))
+	constValues := make([]string, 0, len(consts))
+	for _, l := range consts {
+		names = append(names, l.name)
+		constValues = append(constValues, l.value)
+	}
+	names = append(names, f.labels...)
+	for _, c := range f.sortedChildren() {
+		values := append(append([]string(nil), constValues...), c.labelValues...)
+		fmt.Fprintf(w, "%s%s %v\n", f.name, formatLabels(names, values), c.value())
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", names[i], escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelValueEscaper.Replace(s) }
+
+// Registry is a set of uniquely named metric families.
+type Registry struct {
+	m        sync.Mutex
+	families []*family
+	names    map[string]bool
+	consts   []labelPair // labels of every series, ordered by name
+}
+
+type labelPair struct {
+	name, value string
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SetConstLabels sets labels attached to every series of r, e.g. the
+// station's identity. Label names must be valid Prometheus label names that
+// no metric of r uses itself.
+func (r *Registry) SetConstLabels(labels map[string]string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	used := make(map[string]string)
+	for _, f := range r.families {
+		for _, l := range f.labels {
+			used[l] = f.name
+		}
+	}
+	consts := make([]labelPair, 0, len(labels))
+	for name, value := range labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid metric label name %q", name)
+		}
+		if metric, ok := used[name]; ok {
+			return fmt.Errorf("label %q is already a label of %s", name, metric)
+		}
+		consts = append(consts, labelPair{name, value})
+	}
+	sort.Slice(consts, func(i, j int) bool { return consts[i].name < consts[j].name })
+	r.consts = consts
+	return nil
+}
+
+func (r *Registry) constLabels() []labelPair {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.consts
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Default is the registry holding every station metric.
+var Default = NewRegistry()
+
+func (r *Registry) register(f *family) *family {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.names[f.name] {
+		panic("metrics: duplicate metric " + f.name)
+	}
+	r.names[f.name] = true
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) newFamily(name, help, typ string, labels []string) *family {
+	return r.register(&family{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: make(map[string]*child),
+	})
+}
+
+// Write writes every family in r, ordered by name, in the text
+// exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.m.Lock()
+	families := append([]*family(nil), r.families...)
+	consts := r.consts
+	r.m.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		f.write(w, consts)
+	}
+}
+
+// Handler serves the Default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Default.Write(w)
+	})
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ f *family }
+
+func (r *Registry) newCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.newFamily(name, help, typeCounter, labels)}
+}
+
+// Add increases the counter with the given label values by n.
+func (v *CounterVec) Add(n float64, labelValues ...string) {
+	v.f.with(labelValues...).add(n)
+}
+
+// Inc increments the counter with the given label values.
+func (v *CounterVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Value returns the current value of the counter with the given label values.
+func (v *CounterVec) Value(labelValues ...string) float64 {
+	return v.f.with(labelValues...).value()
+}
+
+// Counter is a single value that only goes up.
+type Counter struct{ c *child }
+
+func (r *Registry) newCounter(name, help string) *Counter {
+	return &Counter{r.newFamily(name, help, typeCounter, nil).with()}
+}
+
+// Add increases the counter by n.
+func (c *Counter) Add(n float64) { c.c.add(n) }
+
+// Inc increments the counter.
+func (c *Counter) Inc() { c.c.add(1) }
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 { return c.c.value() }
+
+// Gauge is a single value that goes up and down.
+type Gauge struct{ c *child }
+
+func (r *Registry) newGauge(name, help string) *Gauge {
+	return &Gauge{r.newFamily(name, help, typeGauge, nil).with()}
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n float64) { g.c.set(n) }
+
+// Add changes the gauge by n, which may be negative.
+func (g *Gauge) Add(n float64) { g.c.add(n) }
+
+// Inc increments the gauge.
+func (g *Gauge) Inc() { g.c.add(1) }
+
+// Dec decrements the gauge.
+func (g *Gauge) Dec() { g.c.add(-1) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 { return g.c.value() }
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ f *family }
+
+func (r *Registry) newGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.newFamily(name, help, typeGauge, labels)}
+}
+
+// Set sets the gauge with the given label values to n.
+func (v *GaugeVec) Set(n float64, labelValues ...string) {
+	v.f.with(labelValues...).set(n)
+}
+
+// Value returns the current value of the gauge with the given label values.
+func (v *GaugeVec) Value(labelValues ...string) float64 {
+	return v.f.with(labelValues...).value()
+}
+
+// Histogram counts observations into buckets: bucket i counts observations
+// <= its upper bound and > the previous one, a final bucket counts everything
+// larger. It is served as cumulative _bucket series with an le label, _sum
+// and _count. Observations are counted atomically per bucket.
+type Histogram struct {
+	f           *family
+	labelValues []string     // those of its series in a HistogramVec
+	b           atomic.Value // *histogramBuckets
+}
+
+type histogramBuckets struct {
+	bounds []float64
+	counts []uint64 // len(bounds)+1, not cumulative
+	sum    child
+}
+
+func (r *Registry) newHistogram(name, help string, bounds ...float64) *Histogram {
+	h := &Histogram{f: r.newFamily(name, help, typeHistogram, nil)}
+	h.f.hist = h
+	if err := h.SetBuckets(bounds...); err != nil {
+		panic(fmt.Sprintf("metrics: %s: %v", name, err))
+	}
+	return h
+}
+
+// SetBuckets replaces the upper bounds of the buckets of h, which must be
+// finite and increasing, and drops every observation so far. It is meant for
+// configuring h before it is used.
+func (h *Histogram) SetBuckets(bounds ...float64) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("no histogram buckets")
+	}
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("histogram bucket bound %v is not finite", b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return fmt.Errorf("histogram bucket bounds are not increasing at %v", b)
+		}
+	}
+	h.b.Store(&histogramBuckets{
+		bounds: append([]float64(nil), bounds...),
+		counts: make([]uint64, len(bounds)+1),
+	})
+	return nil
+}
+
+// Observe adds v to h.
+func (h *Histogram) Observe(v float64) {
+	b := h.b.Load().(*histogramBuckets)
+	i := sort.SearchFloat64s(b.bounds, v)
+	atomic.AddUint64(&b.counts[i], 1)
+	b.sum.add(v)
+}
+
+// Snapshot returns the bucket upper bounds of h and the observations in each
+// bucket, the last counting those larger than every bound.
+func (h *Histogram) Snapshot() (bounds []float64, counts []uint64) {
+	b := h.b.Load().(*histogramBuckets)
+	counts = make([]uint64, len(b.counts))
+	for i := range b.counts {
+		counts[i] = atomic.LoadUint64(&b.counts[i])
+	}
+	return b.bounds, counts
+}
+
+// Sum returns the total of the observations.
+func (h *Histogram) Sum() float64 {
+	return h.b.Load().(*histogramBuckets).sum.value()
+}
+
+func (h *Histogram) write(w io.Writer, consts []labelPair) {
+	names := make([]string, 0, len(consts)+len(h.f.labels)+1)
+	values := make([]string, 0, len(consts)+len(h.f.labels)+1)
+	for _, l := range consts {
+		names = append(names, l.name)
+		values = append(values, l.value)
+	}
+	names = append(names, h.f.labels...)
+	values = append(values, h.labelValues...)
+	bounds, counts := h.Snapshot()
+	var total uint64
+	for i, c := range counts {
+		total += c
+		le := "+Inf"
+		if i < len(bounds) {
+			le = fmt.Sprint(bounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.f.name, formatLabels(append(names, "le"), append(values, le)), total)
+	}
+	fmt.Fprintf(w, "%s_sum%s %v\n", h.f.name, formatLabels(names, values), h.Sum())
+	fmt.Fprintf(w, "%s_count%s %d\n", h.f.name, formatLabels(names, values), total)
+}
+
+// HistogramVec is a histogram partitioned by labels, each series counting
+// into the same buckets.
+type HistogramVec struct {
+	f      *family
+	bounds []float64
+
+	m      sync.RWMutex
+	series map[string]*Histogram
+}
+
+func (r *Registry) newHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		f:      r.newFamily(name, help, typeHistogram, labels),
+		bounds: append([]float64(nil), bounds...),
+		series: make(map[string]*Histogram),
+	}
+	v.f.histVec = v
+	if err := (&Histogram{}).SetBuckets(bounds...); err != nil {
+		panic(fmt.Sprintf("metrics: %s: %v", name, err))
+	}
+	return v
+}
+
+// With returns the histogram with the given label values.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	if len(labelValues) != len(v.f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.f.name, len(v.f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.m.RLock()
+	h, ok := v.series[key]
+	v.m.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	if h, ok = v.series[key]; !ok {
+		h = &Histogram{f: v.f, labelValues: append([]string(nil), labelValues...)}
+		h.SetBuckets(v.bounds...)
+		v.series[key] = h
+	}
+	return h
+}
+
+// Observe adds x to the histogram with the given label values.
+func (v *HistogramVec) Observe(x float64, labelValues ...string) {
+	v.With(labelValues...).Observe(x)
+}
+
+// sortedSeries returns the series of v ordered by label values.
+func (v *HistogramVec) sortedSeries() []*Histogram {
+	v.m.RLock()
+	series := make([]*Histogram, 0, len(v.series))
+	for _, h := range v.series {
+		series = append(series, h)
+	}
+	v.m.RUnlock()
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labelValues, "\xff") < strings.Join(series[j].labelValues, "\xff")
+	})
+	return series
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.newCounterVec("test_things_total", "Things seen.\nBy kind.", "kind")
+	g := r.newGauge("test_open", "Open things.")
+	gv := r.newGaugeVec("test_size", "Sizes.", "kind")
+
+	c.Inc("b")
+	c.Add(2, "a")
+	c.Inc(`q"uo\te`)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	gv.Set(3, "a")
+	gv.Set(2, "a")
+
+	var b bytes.Buffer
+	r.Write(&b)
+	require.Equal(t, `# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 1
+# HELP test_size Sizes.
+# TYPE test_size gauge
+test_size{kind="a"} 2
+# HELP test_things_total Things seen.\nBy kind.
+# TYPE test_things_total counter
+test_things_total{kind="a"} 2
+test_things_total{kind="b"} 1
+test_things_total{kind="q\"uo\\te"} 1
+`, b.String())
+}
+
+func TestRegistryConstLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.newCounterVec("test_things_total", "Things seen.", "kind")
+	g := r.newGauge("test_open", "Open things.")
+	c.Inc("a")
+	g.Inc()
+
+	require.NotNil(t, r.SetConstLabels(map[string]string{"kind": "x"}))
+	require.NotNil(t, r.SetConstLabels(map[string]string{"bad-name": "x"}))
+	require.NotNil(t, r.SetConstLabels(map[string]string{"__reserved": "x"}))
+	require.Nil(t, r.SetConstLabels(map[string]string{"station_id": "s1", "region": "eu"}))
+
+	var b bytes.Buffer
+	r.Write(&b)
+	require.Equal(t, `# HELP test_open Open things.
+# TYPE test_open gauge
+test_open{region="eu",station_id="s1"} 1
+# HELP test_things_total Things seen.
+# TYPE test_things_total counter
+test_things_total{region="eu",station_id="s1",kind="a"} 1
+`, b.String())
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.newHistogram("test_duration_seconds", "Durations.", 0.1, 1, 10)
+	require.Nil(t, r.SetConstLabels(map[string]string{"station_id": "s1"}))
+
+	for _, v := range []float64{0.05, 0.1, 0.5, 20} {
+		h.Observe(v)
+	}
+	bounds, counts := h.Snapshot()
+	require.Equal(t, []float64{0.1, 1, 10}, bounds)
+	require.Equal(t, []uint64{2, 1, 0, 1}, counts)
+
+	var b bytes.Buffer
+	r.Write(&b)
+	require.Equal(t, `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{station_id="s1",le="0.1"} 2
+test_duration_seconds_bucket{station_id="s1",le="1"} 3
+test_duration_seconds_bucket{station_id="s1",le="10"} 3
+test_duration_seconds_bucket{station_id="s1",le="+Inf"} 4
+test_duration_seconds_sum{station_id="s1"} 20.65
+test_duration_seconds_count{station_id="s1"} 4
+`, b.String())
+
+	require.NotNil(t, h.SetBuckets())
+	require.NotNil(t, h.SetBuckets(1, 1))
+	require.NotNil(t, h.SetBuckets(1, math.Inf(1)))
+	require.Nil(t, h.SetBuckets(1e3, 1e6))
+	_, counts = h.Snapshot()
+	require.Equal(t, []uint64{0, 0, 0}, counts)
+	require.Equal(t, 0.0, h.Sum())
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	v := r.newHistogramVec("test_latency_seconds", "Latencies.", []float64{0.1, 1}, "stage", "transport")
+
+	v.Observe(0.5, "match", "prefix")
+	v.Observe(2, "match", "prefix")
+	v.Observe(0.05, "auth", "min")
+	bounds, counts := v.With("match", "prefix").Snapshot()
+	require.Equal(t, []float64{0.1, 1}, bounds)
+	require.Equal(t, []uint64{0, 1, 1}, counts)
+
+	var b bytes.Buffer
+	r.Write(&b)
+	require.Equal(t, `# HELP test_latency_seconds Latencies.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{stage="auth",transport="min",le="0.1"} 1
+test_latency_seconds_bucket{stage="auth",transport="min",le="1"} 1
+test_latency_seconds_bucket{stage="auth",transport="min",le="+Inf"} 1
+test_latency_seconds_sum{stage="auth",transport="min"} 0.05
+test_latency_seconds_count{stage="auth",transport="min"} 1
+test_latency_seconds_bucket{stage="match",transport="prefix",le="0.1"} 0
+test_latency_seconds_bucket{stage="match",transport="prefix",le="1"} 1
+test_latency_seconds_bucket{stage="match",transport="prefix",le="+Inf"} 2
+test_latency_seconds_sum{stage="match",transport="prefix"} 2.5
+test_latency_seconds_count{stage="match",transport="prefix"} 2
+`, b.String())
+}
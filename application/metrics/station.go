@@ -0,0 +1,298 @@
+package metrics
+
+// The station's metrics. Names and labels are part of the station's
+// monitoring interface, dashboards and alerts depend on them: add new metrics
+// or label values rather than renaming existing ones.
+var (
+	// Registrations added to the station, by source: detector, api,
+	// detector_prescan or unspecified (see RegistrationSource).
+	Registrations = Default.newCounterVec("conjure_registrations_total",
+		"Registrations added, by source.", "source")
+
+	// Registration messages the registration policy rejected, by the reason
+	// it gave (see lib.RegistrationPolicy).
+	RegistrationPolicyRejections = Default.newCounterVec("conjure_registration_policy_rejections_total",
+		"Registration messages rejected by the registration policy, by reason.", "reason")
+
+	// Registrations currently served by the station.
+	RegistrationsActive = Default.newGauge("conjure_registrations_active",
+		"Registrations currently active.")
+
+	// What happened to registrations other than being added, by state:
+	// duplicate, error, auth_error (encrypted payload failed to decrypt),
+	// past_expiry (wire expiry already passed), missed (connection for an
+	// unknown registration), expired,
+	// pending_confirmed, pending_evicted (phantom found live) and
+	// pending_expired (liveness check took too long).
+	RegistrationStates = Default.newCounterVec("conjure_registration_states_total",
+		"Registrations reaching a state other than added, by state.", "state")
+
+	// Messages received on a registration channel, by channel (zmq, api or
+	// the name of another ingestor) and outcome: registration (produced at
+	// least one registration), empty (valid but produced none),
+	// live_phantom_report, malformed (could not be read or parsed) or
+	// rejected (e.g. no valid shared secret).
+	IngestMessages = Default.newCounterVec("conjure_ingest_messages_total",
+		"Messages received on registration channels, by channel and outcome.", "channel", "outcome")
+
+	// Registrations older than the staleness bound (stale_registration_age)
+	// since their publish time when received, by channel.
+	StaleRegistrations = Default.newCounterVec("conjure_registrations_stale_total",
+		"Registrations received past the staleness bound since their publish time, by channel.", "channel")
+
+	// Records of registration batches received (see
+	// lib.RegistrationBatchTopic), by channel and outcome: ok or failed.
+	// Each record is also counted in IngestMessages.
+	IngestBatchRecords = Default.newCounterVec("conjure_ingest_batch_records_total",
+		"Records of registration batches received, by channel and outcome.", "channel", "outcome")
+
+	// Registration ingestors that failed and were restarted, by ingestor
+	// (see lib.IngestPipeline).
+	IngestorFailures = Default.newCounterVec("conjure_ingestor_failures_total",
+		"Registration ingestors that failed and were restarted, by ingestor.", "ingestor")
+
+	// Proxied sessions currently open.
+	SessionsOpen = Default.newGauge("conjure_sessions_open",
+		"Proxied sessions currently open.")
+
+	// Proxied sessions that have ended, by reason: eof (either side closed),
+	// timeout (a read or write timed out), reaped (the reaper closed it for
+	// being idle or too old) or error.
+	SessionsCompleted = Default.newCounterVec("conjure_sessions_completed_total",
+		"Proxied sessions ended, by close reason.", "reason")
+
+	// Proxied sessions that have ended, by finer reason: client_eof,
+	// covert_eof, idle_timeout, max_lifetime, reset, cancelled, drained,
+	// covert_limit or error (see lib.CloseReason).
+	SessionCloseReasons = Default.newCounterVec("conjure_session_close_reasons_total",
+		"Proxied sessions ended, by detailed close reason.", "reason")
+
+	// How long proxied sessions were open for, in seconds, and how many
+	// bytes they proxied in both directions together, observed as they end.
+	// Buckets are log-scaled by default, lib.Config can change them.
+	SessionDurations = Default.newHistogram("conjure_session_duration_seconds",
+		"Duration of ended proxied sessions.", 0.01, 0.1, 1, 10, 100, 1000, 10000)
+	SessionBytes = Default.newHistogram("conjure_session_bytes",
+		"Bytes proxied by ended sessions, both directions.", 100, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9)
+
+	// Time sessions took to go through each stage of their setup, by stage
+	// (see lib.SessionTiming) and registration transport, observed as they
+	// end.
+	SessionSetupSeconds = Default.newHistogramVec("conjure_session_setup_seconds",
+		"Time taken by each stage of setting up proxied sessions, by stage and transport.",
+		[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}, "stage", "transport")
+
+	// Bytes proxied, by direction (up is client to covert, down is covert to
+	// client) and registration transport.
+	ProxyBytes = Default.newCounterVec("conjure_proxy_bytes_total",
+		"Bytes proxied, by direction and transport.", "direction", "transport")
+
+	// Failed covert dial attempts, by class: dns-fail, refused, timeout,
+	// reset, tls, tls_handshake (of the station's own TLS to the covert),
+	// loop (the covert loops to the station, see CovertLoops), blocklisted
+	// (the covert's name resolves to a blocklisted address) or error.
+	CovertDialFailures = Default.newCounterVec("conjure_covert_dial_failures_total",
+		"Failed covert dial attempts, by failure class.", "class")
+
+	// Sessions closed because their covert's preamble failed, by reason:
+	// write, read (the covert closed or failed before replying), timeout,
+	// mismatch (the reply was not the one expected) or auth (the covert
+	// refused the registration's covert credentials, or their absence).
+	CovertPreambleFailures = Default.newCounterVec("conjure_covert_preamble_failures_total",
+		"Sessions closed because their covert preamble failed, by reason.", "reason")
+
+	// Covert dial attempts refused because the covert loops back to the
+	// station, by kind: listener (one of the station's listeners), phantom
+	// (an address in the phantom subnets) or local (any other address of the
+	// host: loopback, unspecified, link-local or an interface's).
+	CovertLoops = Default.newCounterVec("conjure_covert_loops_total",
+		"Covert dial attempts refused as loops to the station, by kind.", "kind")
+
+	// Proxied sessions ended by an error reading from or writing to the
+	// covert, by class as for CovertDialFailures.
+	CovertRelayErrors = Default.newCounterVec("conjure_covert_relay_errors_total",
+		"Sessions ended by a covert read or write error, by error class.", "class")
+
+	// Sessions closed for relaying more than their covert response limit, by
+	// category: the covert_max_response_bytes_coverts pattern the covert
+	// matched, or default.
+	CovertResponseLimited = Default.newCounterVec("conjure_covert_response_limited_total",
+		"Sessions closed at their covert response limit, by covert category.", "category")
+
+	// Bytes proxied to and from the test-only embedded covert (see
+	// covert_echo), by direction, counted here instead of in ProxyBytes.
+	CovertEchoBytes = Default.newCounterVec("conjure_covert_echo_bytes_total",
+		"Bytes proxied to and from the test-only embedded covert, by direction.", "direction")
+
+	// Covert dials that moved on to a fallback covert (see
+	// covert_fallbacks), by outcome: ok (a fallback connected), failed
+	// (every fallback tried failed) or deadline (the covert dial deadline
+	// ran out first).
+	CovertFallbackDials = Default.newCounterVec("conjure_covert_fallback_dials_total",
+		"Covert dials that moved on to a fallback covert, by outcome.", "outcome")
+
+	// Rules of the covert policy files in effect, by list: allow or deny.
+	CovertPolicyRules = Default.newGaugeVec("conjure_covert_policy_rules",
+		"Covert policy rules in effect, by list.", "list")
+
+	// Covert policy files that failed to load, at startup or reload. Files
+	// failing to reload keep their last rules.
+	CovertPolicyLoadErrors = Default.newCounter("conjure_covert_policy_load_errors_total",
+		"Covert policy file loads that failed.")
+
+	// Sessions and registrations rejected by the covert strict TLS mode, by
+	// check: port (covert not on port 443), client_tls (client did not start
+	// a TLS handshake) or covert_tls (covert failed certificate
+	// verification).
+	StrictTLSRejections = Default.newCounterVec("conjure_strict_tls_rejections_total",
+		"Sessions and registrations rejected by strict TLS mode, by check.", "check")
+
+	// Connections taken from the covert pre-warming pools, by outcome: hit
+	// (an idle connection was used), miss (none was left) or stale (an idle
+	// connection the covert had closed, discarded).
+	CovertPrewarm = Default.newCounterVec("conjure_covert_prewarm_total",
+		"Pre-warmed covert connections taken, by outcome.", "outcome")
+
+	// Connections the pre-warming pool of a covert holds idle or is
+	// dialing, and those it holds idle, by covert.
+	CovertPoolSize = Default.newGaugeVec("conjure_covert_pool_size",
+		"Connections held idle or being dialed by a covert's pre-warming pool, by covert.", "covert")
+	CovertPoolIdle = Default.newGaugeVec("conjure_covert_pool_idle",
+		"Idle connections in a covert's pre-warming pool, by covert.", "covert")
+
+	// Connections taken from the pre-warming pools as for CovertPrewarm, by
+	// covert and outcome: hit or miss.
+	CovertPoolGets = Default.newCounterVec("conjure_covert_pool_gets_total",
+		"Connections taken from a covert's pre-warming pool, by covert and outcome.", "covert", "outcome")
+
+	// Idle connections closed by the pre-warming pools, by covert and
+	// reason: expired (idle for covert_prewarm_max_idle), stale (the covert
+	// closed it) or flushed (see CovertPool.Flush).
+	CovertPoolEvictions = Default.newCounterVec("conjure_covert_pool_evictions_total",
+		"Idle connections closed by a covert's pre-warming pool, by covert and reason.", "covert", "reason")
+
+	// Covert connections handled by the reuse pool, by outcome: hit (a
+	// session reused an idle connection), miss (none was kept), tainted (a
+	// connection discarded because its session did not end cleanly, or the
+	// covert closed it or sent data on it while idle) or evicted (closed for
+	// being idle too long or to make room).
+	CovertReuse = Default.newCounterVec("conjure_covert_reuse_total",
+		"Covert connections handled by the reuse pool, by outcome.", "outcome")
+
+	// Sessions closed before their covert was dialed because the client did
+	// not send enough data in time, see covert_min_client_bytes.
+	ProbableScans = Default.newCounter("conjure_probable_scans_total",
+		"Sessions closed as probable scans before dialing the covert.")
+
+	// Sessions closed without dialing their covert because their client IP
+	// had covert_dials_per_ip dials in flight already.
+	CovertDialsRejected = Default.newCounter("conjure_covert_dials_rejected_total",
+		"Sessions closed because their client IP had too many covert dials in flight.")
+
+	// The covert dials allowed in flight at once during the warm-up after
+	// startup (see covert_warmup), zero once it is over, the dials in flight
+	// it counts, and the dials that waited for a slot, by whether they got
+	// one (dialed) or ran out of their dial deadline (deadline).
+	CovertWarmupLimit = Default.newGauge("conjure_covert_warmup_limit",
+		"Covert dials allowed in flight at once by the startup warm-up, zero once it is over.")
+	CovertWarmupInFlight = Default.newGauge("conjure_covert_warmup_in_flight",
+		"Covert dials in flight counted by the startup warm-up.")
+	CovertWarmupWaits = Default.newCounterVec("conjure_covert_warmup_waits_total",
+		"Covert dials that waited for a slot of the startup warm-up, by outcome.", "outcome")
+
+	// Connections closed right after accept because their source subnet was
+	// over the client_tcp accept_rate.
+	AcceptsRejected = Default.newCounter("conjure_accepts_rejected_total",
+		"Connections closed right after accept for exceeding the accept rate of their source subnet.")
+
+	// Connections of registrations using a handshake MAC closed because it
+	// did not verify, by transport and reason: bad_mac (wrong or malformed),
+	// stale (time outside the allowed window) or replay (nonce already
+	// used).
+	HandshakeMACFailures = Default.newCounterVec("conjure_handshake_mac_failures_total",
+		"Connections closed for a handshake MAC that did not verify, by transport and reason.", "transport", "reason")
+
+	// Connections closed because their client address is not one of the
+	// allowed sources of their registration.
+	SourceMismatches = Default.newCounter("conjure_source_mismatches_total",
+		"Connections closed for coming from outside their registration's allowed sources.")
+
+	// Session resumptions, by outcome: resumed (a new connection took the
+	// place of the lost one), unknown (no resumable session with the ID),
+	// bad_token, gap (what the client missed was no longer buffered) or
+	// expired (the grace period ran out before a resume).
+	SessionResumptions = Default.newCounterVec("conjure_session_resumptions_total",
+		"Session resumptions, by outcome.", "outcome")
+
+	// Connections to a phantom port other than the one their registration
+	// derived, by action: rejected (not matched to the registration) or
+	// warned (proxied anyway, see phantom_port_warn_only).
+	PhantomPortMismatches = Default.newCounterVec("conjure_phantom_port_mismatches_total",
+		"Connections to a phantom port other than their registration's, by action.", "action")
+
+	// Phantom subnets currently drained (see lib.PhantomDrain).
+	PhantomSubnetsDrained = Default.newGauge("conjure_phantom_subnets_drained",
+		"Phantom subnets currently drained.")
+
+	// Registrations and connections refused because their phantom is in a
+	// drained subnet, by kind: registration or connection.
+	PhantomDrainRejections = Default.newCounterVec("conjure_phantom_drain_rejections_total",
+		"Registrations and connections refused for a drained phantom subnet, by kind.", "kind")
+
+	// Connections matched to a registration whose phantom was not live when
+	// it registered but is known live now (see lib.PhantomBecameLive), by
+	// the live phantom policy applied: reject, log-only or divert.
+	PhantomBecameLive = Default.newCounterVec("conjure_phantom_became_live_total",
+		"Connections to a registration whose phantom became live after it registered, by policy.", "policy")
+
+	// Registrations expired because their phantom became live (see
+	// expire_live_phantoms).
+	PhantomBecameLiveExpired = Default.newCounter("conjure_phantom_became_live_expired_total",
+		"Registrations expired because their phantom became live after they registered.")
+
+	// Streams clients opened in mux sessions, by outcome: opened, limit (reset
+	// for exceeding a stream limit) or blocked (reset for a blocklisted or
+	// otherwise disallowed covert).
+	MuxStreams = Default.newCounterVec("conjure_mux_streams_total",
+		"Streams opened in mux sessions, by outcome.", "outcome")
+
+	// Registrations transferred between stations, by outcome: exported (sent
+	// to another station), or imported, skipped (already present), expired
+	// or failed on the importing station.
+	TransferredRegistrations = Default.newCounterVec("conjure_transferred_registrations_total",
+		"Registrations transferred between stations, by outcome.", "outcome")
+
+	// Trace spans dropped because the exporter fell behind, see
+	// lib.Tracer.
+	TracingSpansDropped = Default.newCounter("conjure_tracing_spans_dropped_total",
+		"Trace spans dropped because the export queue was full.")
+
+	// Messages the ZMQ proxy dropped because the station's queue stayed at
+	// its high-water mark for longer than send_timeout.
+	ZMQSendsDropped = Default.newCounter("conjure_zmq_sends_dropped_total",
+		"Registration messages dropped by the ZMQ proxy because the station's queue was full.")
+
+	// Connections to phantoms without registrations parked waiting for one
+	// to arrive (see park_connections), and those that were parked or could
+	// not be, by outcome: rescued by their registration arriving, timeout,
+	// or full when park_max connections were parked already.
+	ParkedConns = Default.newGauge("conjure_parked_connections",
+		"Connections parked waiting for their registration to arrive.")
+	ParkedConnOutcomes = Default.newCounterVec("conjure_parked_connections_total",
+		"Connections to phantoms without registrations that were parked, by outcome.", "outcome")
+
+	// Phantoms the detector reported live. The detector runs as a separate
+	// process and keeps its own packet counters in its log, only what it
+	// sends the station over ZMQ is counted here.
+	DetectorLivePhantomReports = Default.newCounter("conjure_detector_live_phantom_reports_total",
+		"Live phantom addresses reported by the detector.")
+)
+
+// Label values shared by several metrics.
+const (
+	ChannelZMQ = "zmq"
+	ChannelAPI = "api"
+
+	DirectionUp   = "up"
+	DirectionDown = "down"
+)
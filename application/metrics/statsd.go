@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacket is the largest datagram sent, so that packets are not
+// fragmented on a typical 1500 byte MTU.
+const statsdMaxPacket = 1432
+
+// statsdWarnInterval is how often at most failing sends are logged.
+const statsdWarnInterval = time.Minute
+
+// StatsdSink periodically sends the metrics of a registry to a StatsD (or
+// DogStatsD) server over UDP, alongside (not instead of) the Prometheus
+// handler. Counters are sent as the increase since the last flush, gauges as
+// their value. Labels, the registry's constant labels and the sink's own tags
+// are sent as DogStatsD tags. Histograms are only served by the Prometheus
+// handler.
+//
+// Sending happens on the sink's goroutine and UDP sends do not wait for the
+// server, so a missing or unreachable server never holds up the station.
+// Failed sends are counted and logged at most once per statsdWarnInterval.
+type StatsdSink struct {
+	registry *Registry
+	w        io.Writer
+	prefix   string
+	tags     []string
+	logger   *log.Logger
+
+	m        sync.Mutex
+	last     map[string]float64 // counter values at the last flush
+	failures int
+	lastErr  error
+	lastWarn time.Time
+	now      func() time.Time
+}
+
+// NewStatsdSink returns a sink sending the Default registry to addr
+// (host:port). Metric names are prefixed with prefix and every metric is
+// tagged with tags ("key:value").
+func NewStatsdSink(addr, prefix string, tags []string, logger *log.Logger) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open statsd socket: %v", err)
+	}
+	return newStatsdSink(Default, conn, prefix, tags, logger), nil
+}
+
+func newStatsdSink(r *Registry, w io.Writer, prefix string, tags []string, logger *log.Logger) *StatsdSink {
+	return &StatsdSink{
+		registry: r,
+		w:        w,
+		prefix:   prefix,
+		tags:     tags,
+		logger:   logger,
+		last:     make(map[string]float64),
+		now:      time.Now,
+	}
+}
+
+// Run flushes the sink every interval, forever.
+func (s *StatsdSink) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.Flush()
+	}
+}
+
+// Flush sends the current metrics.
+func (s *StatsdSink) Flush() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var packet []byte
+	send := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := s.w.Write(packet); err != nil {
+			s.failures++
+			s.lastErr = err
+		}
+		packet = packet[:0]
+	}
+
+	s.registry.each(func(f *family, c *child) {
+		v := c.value()
+		kind := "g"
+		if f.typ == typeCounter {
+			key := f.name + "\xff" + strings.Join(c.labelValues, "\xff")
+			delta := v - s.last[key]
+			s.last[key] = v
+			if delta == 0 {
+				return
+			}
+			v, kind = delta, "c"
+		}
+
+		line := s.formatLine(f, c, v, kind)
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			send()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	})
+	send()
+
+	if s.failures > 0 && s.now().Sub(s.lastWarn) >= statsdWarnInterval {
+		s.logger.Printf("statsd: %d sends failed since the last warning, last error: %v", s.failures, s.lastErr)
+		s.failures = 0
+		s.lastWarn = s.now()
+	}
+}
+
+// formatLine returns the DogStatsD line for one series,
+// "prefix.name:value|kind|#tag,...".
+func (s *StatsdSink) formatLine(f *family, c *child, v float64, kind string) string {
+	var b strings.Builder
+	if s.prefix != "" {
+		b.WriteString(s.prefix)
+		b.WriteByte('.')
+	}
+	b.WriteString(f.name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(kind)
+
+	tags := append([]string(nil), s.tags...)
+	for _, l := range s.registry.constLabels() {
+		tags = append(tags, l.name+":"+statsdTagValue(l.value))
+	}
+	for i, name := range f.labels {
+		tags = append(tags, name+":"+statsdTagValue(c.labelValues[i]))
+	}
+	if len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+	return b.String()
+}
+
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_")
+
+func statsdTagValue(v string) string { return statsdTagEscaper.Replace(v) }
+
+// each calls f for every series in r, ordered by family name then labels.
+func (r *Registry) each(f func(*family, *child)) {
+	r.m.Lock()
+	families := append([]*family(nil), r.families...)
+	r.m.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, fam := range families {
+		for _, c := range fam.sortedChildren() {
+			f(fam, c)
+		}
+	}
+}
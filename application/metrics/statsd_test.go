@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type packetRecorder struct{ packets []string }
+
+func (p *packetRecorder) Write(b []byte) (int, error) {
+	p.packets = append(p.packets, string(b))
+	return len(b), nil
+}
+
+type failingWriter struct{ writes int }
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	f.writes++
+	return 0, errors.New("connect: no route to host")
+}
+
+func TestStatsdFlush(t *testing.T) {
+	r := NewRegistry()
+	c := r.newCounterVec("test_things_total", "Things seen.", "kind")
+	g := r.newGauge("test_open", "Open things.")
+
+	var rec packetRecorder
+	s := newStatsdSink(r, &rec, "conjure", []string{"station:s1"}, log.New(&bytes.Buffer{}, "", 0))
+
+	c.Add(3, "a")
+	g.Add(2)
+	s.Flush()
+	require.Equal(t, []string{"conjure.test_open:2|g|#station:s1\nconjure.test_things_total:3|c|#station:s1,kind:a"}, rec.packets)
+
+	// Counters are sent as increments, unchanged counters not at all.
+	c.Inc("a")
+	c.Inc("b")
+	s.Flush()
+	require.Equal(t, "conjure.test_open:2|g|#station:s1\nconjure.test_things_total:1|c|#station:s1,kind:a\nconjure.test_things_total:1|c|#station:s1,kind:b", rec.packets[1])
+
+	// Constant labels come after the sink's tags.
+	require.Nil(t, r.SetConstLabels(map[string]string{"region": "eu"}))
+	g.Inc()
+	s.Flush()
+	require.Equal(t, "conjure.test_open:3|g|#station:s1,region:eu", rec.packets[2])
+}
+
+func TestStatsdPacketSize(t *testing.T) {
+	r := NewRegistry()
+	c := r.newCounterVec("test_things_total", "Things seen.", "kind")
+	for i := 0; i < 200; i++ {
+		c.Inc(strings.Repeat("x", i%50) + string(rune('a'+i%26)))
+	}
+
+	var rec packetRecorder
+	s := newStatsdSink(r, &rec, "", nil, log.New(&bytes.Buffer{}, "", 0))
+	s.Flush()
+	require.True(t, len(rec.packets) > 1)
+	for _, p := range rec.packets {
+		require.True(t, len(p) <= statsdMaxPacket, "packet of %d bytes", len(p))
+	}
+}
+
+func TestStatsdFailuresWarnOnce(t *testing.T) {
+	r := NewRegistry()
+	g := r.newGauge("test_open", "Open things.")
+	g.Inc()
+
+	var logged bytes.Buffer
+	var w failingWriter
+	s := newStatsdSink(r, &w, "", nil, log.New(&logged, "", 0))
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		s.Flush()
+	}
+	require.Equal(t, 10, w.writes)
+	require.Equal(t, 1, strings.Count(logged.String(), "\n"))
+	require.Contains(t, logged.String(), "1 sends failed")
+
+	now = now.Add(statsdWarnInterval)
+	s.Flush()
+	require.Equal(t, 2, strings.Count(logged.String(), "\n"))
+	require.Contains(t, logged.String(), "10 sends failed")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// registrationAPI accepts registrations POSTed directly to the station as a
+// marshaled C2SWrapper. They are parsed and ingested exactly like those
+// received from the detector over ZMQ, and the reply is a marshaled
+// RegistrationResponse (see proto/signalling.proto) with the phantoms
+// assigned. Their source is always API, and the client's word that it
+// scanned the phantom is not taken: the phantom liveness check runs after the
+// reply, as it does for any other registration that was not prescanned.
+type registrationAPI struct {
+	regManager *cj.RegistrationManager
+	conf       *cj.Config
+	logger     *cj.Logger
+}
+
+func (api *registrationAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, api.conf.RegistrationAPIMaxBody))
+	if err != nil {
+		metrics.IngestMessages.Inc(metrics.ChannelAPI, ingestOutcomeMalformed)
+		http.Error(w, fmt.Sprintf("request body over %d bytes", api.conf.RegistrationAPIMaxBody), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	span := cj.StartRegistrationSpan(metrics.ChannelAPI)
+	defer span.End()
+	clientAddr := net.ParseIP(remoteHost(r.RemoteAddr))
+	newRegs, err := parseRegistrationMessage(body, api.regManager, api.conf, metrics.ChannelAPI, span, func(c2sw *pb.C2SWrapper) {
+		// The station saw the client itself, so the address it registered
+		// from is known rather than reported.
+		if clientAddr != nil {
+			c2sw.RegistrationAddress = clientAddr.To16()
+		}
+		source := pb.RegistrationSource_API
+		c2sw.RegistrationSource = &source
+		if flags := c2sw.GetRegistrationPayload().GetFlags(); flags != nil {
+			flags.Prescanned = nil
+		}
+	})
+	if err != nil {
+		span.SetError(err)
+		http.Error(w, fmt.Sprintf("bad registration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(newRegs) == 0 {
+		writeRegistrationResponse(w, http.StatusBadRequest, nil, "no registration for the supported address families")
+		return
+	}
+
+	var accepted []*cj.DecoyRegistration
+	for _, reg := range newRegs {
+		cj.Stat().AddStationAPIReg()
+		if err := ingestRegistration(reg, api.regManager, api.conf, api.logger); err != nil {
+			api.logger.Debugf("registration over API not accepted: %v %v", reg.IDString(), err)
+			continue
+		}
+		accepted = append(accepted, reg)
+	}
+	if len(accepted) == 0 {
+		writeRegistrationResponse(w, http.StatusForbidden, nil, "registration not accepted")
+		return
+	}
+	writeRegistrationResponse(w, http.StatusOK, accepted, "")
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// writeRegistrationResponse replies with a RegistrationResponse holding the
+// phantoms and phantom port of regs, or errMsg if it is not empty.
+func writeRegistrationResponse(w http.ResponseWriter, status int, regs []*cj.DecoyRegistration, errMsg string) {
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(status)
+	w.Write(marshalRegistrationResponse(regs, errMsg))
+}
+
+// Field keys (field number and wire type) of the RegistrationResponse
+// message. The gotapdance protobuf package predates it, so it is encoded by
+// hand.
+const (
+	regRespIPv4AddrKey = 1<<3 | 5 // fixed32
+	regRespIPv6AddrKey = 2<<3 | 2 // length delimited
+	regRespDstPortKey  = 3<<3 | 0 // varint
+	regRespErrorKey    = 4<<3 | 2 // length delimited
+)
+
+func marshalRegistrationResponse(regs []*cj.DecoyRegistration, errMsg string) []byte {
+	var b []byte
+	if errMsg != "" {
+		b = appendUvarint(b, regRespErrorKey)
+		b = appendUvarint(b, uint64(len(errMsg)))
+		return append(b, errMsg...)
+	}
+
+	for _, reg := range regs {
+		if v4 := reg.DarkDecoy.To4(); v4 != nil {
+			// fixed32 is little endian on the wire, the address is the big
+			// endian integer of its bytes.
+			b = appendUvarint(b, regRespIPv4AddrKey)
+			var addr [4]byte
+			binary.LittleEndian.PutUint32(addr[:], binary.BigEndian.Uint32(v4))
+			b = append(b, addr[:]...)
+		} else {
+			b = appendUvarint(b, regRespIPv6AddrKey)
+			b = appendUvarint(b, net.IPv6len)
+			b = append(b, reg.DarkDecoy.To16()...)
+		}
+	}
+	// The registrations of a message share their seed, and so their port.
+	b = appendUvarint(b, regRespDstPortKey)
+	return appendUvarint(b, uint64(regs[0].DstPort()))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
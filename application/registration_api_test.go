@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/transports/wrapping/min"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+)
+
+func newTestRegistrationAPI(t *testing.T) *registrationAPI {
+	testSubnetPath := os.Getenv("GOPATH") + "/src/github.com/refraction-networking/conjure/application/lib/test/phantom_subnets.toml"
+	os.Setenv("PHANTOM_SUBNET_LOCATION", testSubnetPath)
+
+	rm := cj.NewRegistrationManager()
+	require.Nil(t, rm.AddTransport(pb.TransportType_Min, min.Transport{}))
+	// Registrations over the API are always checked for liveness first.
+	rm.SetServePending(true)
+	logger = rm.Logger
+
+	conf := &cj.Config{EnableIPv4: true, RegistrationAPIMaxBody: 1024}
+	conf.LivenessPendingTimeout = 60
+	return &registrationAPI{rm, conf, rm.Logger}
+}
+
+func postRegistration(api *registrationAPI, method string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", bytes.NewReader(body))
+	req.RemoteAddr = "192.0.2.10:51234"
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w
+}
+
+func TestRegistrationAPIRejects(t *testing.T) {
+	api := newTestRegistrationAPI(t)
+
+	w := postRegistration(api, http.MethodGet, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = postRegistration(api, http.MethodPost, make([]byte, 2048))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = postRegistration(api, http.MethodPost, []byte{0xff, 0xff, 0xff})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRegistrationAPIRegisters(t *testing.T) {
+	api := newTestRegistrationAPI(t)
+
+	c2s, _ := mockReceiveFromDetector()
+	transport := pb.TransportType_Min
+	gen := uint32(1)
+	v4, v6, prescanned := true, false, true
+	c2s.Transport = &transport
+	c2s.DecoyListGeneration = &gen
+	c2s.V4Support = &v4
+	c2s.V6Support = &v6
+	c2s.Flags.Prescanned = &prescanned
+
+	// The client claiming to be the detector, with a prescanned phantom.
+	secret, _ := hex.DecodeString("5414c734ad5dc53e6b56a7bb47ce695a14a3ef076a3d5ace9cbf3b4d12706b73")
+	source := pb.RegistrationSource_Detector
+	body, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret, RegistrationPayload: c2s, RegistrationSource: &source})
+	require.Nil(t, err)
+
+	w := postRegistration(api, http.MethodPost, body)
+	require.Equal(t, http.StatusOK, w.Code)
+	resp, _ := ioutil.ReadAll(w.Body)
+
+	// ipv4addr (fixed32) then dst_port (varint).
+	require.Equal(t, regRespIPv4AddrKey, int(resp[0]))
+	phantom := make(net.IP, 4)
+	binary.BigEndian.PutUint32(phantom, binary.LittleEndian.Uint32(resp[1:5]))
+	require.Equal(t, "192.122.190.148", phantom.String())
+	require.Equal(t, []byte{regRespDstPortKey, 0xbb, 0x03}, resp[5:])
+
+	regs := api.regManager.GetRegistrations(phantom)
+	require.Equal(t, 1, len(regs))
+	for _, reg := range regs {
+		require.Equal(t, pb.RegistrationSource_API, *reg.RegistrationSource)
+		require.False(t, reg.PreScanned())
+	}
+
+	// Registering again is a duplicate and still gets the phantom.
+	w = postRegistration(api, http.MethodPost, body)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 1, len(api.regManager.GetRegistrations(phantom)))
+}
+
+func TestRegistrationAPIExpiry(t *testing.T) {
+	api := newTestRegistrationAPI(t)
+
+	c2s, _ := mockReceiveFromDetector()
+	transport := pb.TransportType_Min
+	gen := uint32(1)
+	v4, v6, prescanned := true, false, true
+	c2s.Transport = &transport
+	c2s.DecoyListGeneration = &gen
+	c2s.V4Support = &v4
+	c2s.V6Support = &v6
+	c2s.Flags.Prescanned = &prescanned
+
+	secret, _ := hex.DecodeString("5414c734ad5dc53e6b56a7bb47ce695a14a3ef076a3d5ace9cbf3b4d12706b73")
+	body, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret, RegistrationPayload: c2s})
+	require.Nil(t, err)
+
+	// Past expiry is rejected and nothing is registered.
+	past := cj.AppendRegistrationExpiry(append([]byte(nil), body...), time.Now().Add(-time.Minute))
+	w := postRegistration(api, http.MethodPost, past)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	phantom := net.ParseIP("192.122.190.148")
+	require.Equal(t, 0, len(api.regManager.GetRegistrations(phantom)))
+
+	// Future expiry is kept on the registration.
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	w = postRegistration(api, http.MethodPost, cj.AppendRegistrationExpiry(body, expiry))
+	require.Equal(t, http.StatusOK, w.Code)
+	regs := api.regManager.GetRegistrations(phantom)
+	require.Equal(t, 1, len(regs))
+	for _, reg := range regs {
+		require.True(t, expiry.Equal(reg.Expiry))
+	}
+}
+
+// The port in the reply is the one the registrations derived.
+func TestRegistrationResponsePort(t *testing.T) {
+	reg := &cj.DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), PhantomPort: 8443}
+	resp := marshalRegistrationResponse([]*cj.DecoyRegistration{reg}, "")
+	require.Equal(t, []byte{regRespDstPortKey, 0xfb, 0x41}, resp[5:])
+
+	reg.PhantomPort = 0
+	resp = marshalRegistrationResponse([]*cj.DecoyRegistration{reg}, "")
+	require.Equal(t, []byte{regRespDstPortKey, 0xbb, 0x03}, resp[5:])
+}
+
+// A plaintext payload is not bound to a station key, it is registered under
+// A plaintext payload is not bound to a station key. It is registered under
+// every key, so that clients still on a rotated out key are served, until a
+// connection shows which key the client used.
+func TestRegistrationUnboundPayloadEveryKey(t *testing.T) {
+	api := newTestRegistrationAPI(t)
+	for i := 0; i < 2; i++ {
+		kp, err := ntor.NewKeypair(false)
+		require.Nil(t, err)
+		path := filepath.Join(t.TempDir(), "privkey")
+		require.Nil(t, ioutil.WriteFile(path, kp.Private()[:], 0600))
+		key, err := cj.LoadStationKey(path)
+		require.Nil(t, err)
+		api.regManager.StationKeys = append(api.regManager.StationKeys, key)
+	}
+
+	c2s, _ := mockReceiveFromDetector()
+	transport := pb.TransportType_Min
+	gen := uint32(1)
+	v4, v6 := true, false
+	c2s.Transport = &transport
+	c2s.DecoyListGeneration = &gen
+	c2s.V4Support = &v4
+	c2s.V6Support = &v6
+	body, err := proto.Marshal(&pb.C2SWrapper{RegistrationPayload: c2s, RegistrationAddress: []byte{192, 0, 2, 10}})
+	require.Nil(t, err)
+	clientKP, err := ntor.NewKeypair(true)
+	require.Nil(t, err)
+	// The client representative, field 8 of the C2SWrapper.
+	body = append(body, 8<<3|2, ntor.RepresentativeLength)
+	body = append(body, clientKP.Representative()[:]...)
+
+	regs, err := parseRegistrationMessage(body, api.regManager, api.conf, "test", nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(regs))
+	require.Equal(t, 0, regs[0].StationKeyIndex)
+	require.Equal(t, 1, regs[1].StationKeyIndex)
+	for _, reg := range regs {
+		api.regManager.AddRegistration(reg)
+	}
+
+	// A client on the older key connects: the registration under the other
+	// key is removed, once.
+	require.Equal(t, 1, api.regManager.BindStationKey(regs[1]))
+	require.False(t, api.regManager.RegistrationExists(regs[0]))
+	require.True(t, api.regManager.RegistrationExists(regs[1]))
+	require.Equal(t, 0, api.regManager.BindStationKey(regs[1]))
+}
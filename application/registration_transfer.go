@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	cj "github.com/refraction-networking/conjure/application/lib"
+)
+
+// registrationExport transfers the station's registrations to another
+// station when POSTed /registrations/export?to=<addr> on the management
+// endpoint, addr being the other station's transfer_listen_addr. The reply is
+// the TransferSummary as JSON, the importing station's counts included.
+type registrationExport struct {
+	regManager *cj.RegistrationManager
+	conf       *cj.Config
+	logger     *cj.Logger
+}
+
+func (e *registrationExport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		http.Error(w, "missing to address", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := cj.DialTransfer(to)
+	if err != nil {
+		e.logger.Errorf("registration transfer to %v failed: %v", to, err)
+		http.Error(w, fmt.Sprintf("failed to connect: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	summary, err := e.regManager.ExportRegistrations(conn, e.conf.TransferKey())
+	if err != nil {
+		e.logger.Errorf("registration transfer to %v failed after exporting %d registrations: %v", to, summary.Exported, err)
+		http.Error(w, fmt.Sprintf("transfer failed after %d registrations: %v", summary.Exported, err), http.StatusBadGateway)
+		return
+	}
+	e.logger.Infof("exported %d registrations to %v, imported %d, skipped %d already present, %d expired, %d failed",
+		summary.Exported, to, summary.Imported, summary.Skipped, summary.Expired, summary.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,130 @@
+// Package testutil has helpers for the station's tests.
+package testutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/application/clock"
+)
+
+// FakeClock is a clock.Clock that only moves when told to, with Advance. Its
+// timers fire, in order, as Advance moves past them.
+type FakeClock struct {
+	m      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // active timers
+}
+
+// NewFakeClock returns a FakeClock starting at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer firing once the clock is advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// After returns the channel of a new timer for d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing the timers due by then in the
+// order they are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		// The channel is buffered as for time.Timer, a timer nobody
+		// received from yet does not block the clock.
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of timers that have not fired or been stopped,
+// e.g. to wait for a goroutine to start waiting before advancing the clock.
+func (c *FakeClock) Timers() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers waits, in real time, up to timeout for the clock to have at
+// least n active timers. It reports whether it does.
+func (c *FakeClock) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for c.Timers() < n {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	ch    chan time.Time
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+// stop removes t from the active timers, c.m must be held.
+func (t *fakeTimer) stop() bool {
+	c := t.clock
+	for i, active := range c.timers {
+		if active == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.m.Lock()
+	defer t.clock.m.Unlock()
+	return t.stop()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.m.Lock()
+	defer c.m.Unlock()
+	active := t.stop()
+	t.when = c.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		return active
+	}
+	c.timers = append(c.timers, t)
+	return active
+}
@@ -0,0 +1,42 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	c := NewFakeClock(start)
+	require.Equal(t, start, c.Now())
+
+	late := c.NewTimer(2 * time.Second)
+	early := c.After(time.Second)
+	stopped := c.NewTimer(time.Second)
+	require.True(t, stopped.Stop())
+	require.Equal(t, 2, c.Timers())
+
+	c.Advance(time.Second)
+	require.Equal(t, start.Add(time.Second), <-early)
+	select {
+	case <-late.C():
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	// Reset moves the timer from now, not from when it was created.
+	require.True(t, late.Reset(2*time.Second))
+	c.Advance(time.Second)
+	require.Equal(t, 1, c.Timers())
+	c.Advance(time.Second)
+	require.Equal(t, start.Add(3*time.Second), <-late.C())
+	require.Equal(t, 0, c.Timers())
+
+	go func() { <-c.After(time.Minute) }()
+	require.True(t, c.WaitForTimers(1, time.Second))
+	c.Advance(time.Minute)
+}
@@ -17,6 +17,17 @@ var (
 	// contain this transport. The caller shouldn't retry
 	// with this transport.
 	ErrNotTransport = errors.New("connection does not contain transport")
+
+	// ErrNotRegistered is returned by transports when the connection
+	// conclusively is one of theirs, but for no registration. The caller
+	// shouldn't try other transports either.
+	ErrNotRegistered = errors.New("connection of transport is for no registration")
+
+	// ErrHandshakeMAC is returned by transports when the connection is for
+	// a registration using a handshake MAC (see lib.VerifyHandshakeMAC)
+	// that did not verify. The caller should close the connection without
+	// trying other transports.
+	ErrHandshakeMAC = errors.New("connection failed handshake MAC verification")
 )
 
 // PrefixConn allows arbitrary readers to serve as the data source
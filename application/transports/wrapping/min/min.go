@@ -6,6 +6,7 @@ import (
 
 	dd "github.com/refraction-networking/conjure/application/lib"
 	"github.com/refraction-networking/conjure/application/transports"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
 )
 
 type Transport struct{}
@@ -14,22 +15,31 @@ func (Transport) Name() string      { return "MinTransport" }
 func (Transport) LogPrefix() string { return "MIN" }
 
 func (Transport) GetIdentifier(d *dd.DecoyRegistration) string {
-	return string(d.Keys.ConjureHMAC("MinTrasportHMACString"))
+	return string(d.Keys.ConnTag[:])
 }
 
-func (Transport) WrapConnection(data *bytes.Buffer, c net.Conn, originalDst net.IP, regManager *dd.RegistrationManager) (*dd.DecoyRegistration, net.Conn, error) {
-	if data.Len() < 32 {
+func (t Transport) WrapConnection(data *bytes.Buffer, c net.Conn, originalDst net.IP, regManager *dd.RegistrationManager) (*dd.DecoyRegistration, net.Conn, error) {
+	if data.Len() < dd.ConnTagLen {
 		return nil, nil, transports.ErrTryAgain
 	}
 
-	hmacID := string(data.Bytes()[:32])
-	reg, ok := regManager.GetRegistrations(originalDst)[hmacID]
-	if !ok {
+	reg := regManager.GetRegistrationByConnTag(originalDst, data.Bytes()[:dd.ConnTagLen])
+	if reg == nil || reg.Transport != pb.TransportType_Min {
 		return nil, nil, transports.ErrNotTransport
 	}
 
-	// We don't want the first 32 bytes
-	data.Next(32)
+	// Registrations using a handshake MAC follow the tag with it.
+	authLen := dd.HandshakeAuthLen(reg)
+	if data.Len() < dd.ConnTagLen+authLen {
+		return nil, nil, transports.ErrTryAgain
+	}
+	b := data.Bytes()
+	if !regManager.VerifyHandshakeMAC(reg, b[:dd.ConnTagLen], b[dd.ConnTagLen:dd.ConnTagLen+authLen], t.Name()) {
+		return nil, nil, transports.ErrHandshakeMAC
+	}
+
+	// We don't want the tag or authenticator
+	data.Next(dd.ConnTagLen + authLen)
 
 	return reg, transports.PrependToConn(c, data), nil
 }
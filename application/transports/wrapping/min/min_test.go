@@ -6,7 +6,9 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
+	dd "github.com/refraction-networking/conjure/application/lib"
 	"github.com/refraction-networking/conjure/application/transports"
 	"github.com/refraction-networking/conjure/application/transports/wrapping/internal/tests"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
@@ -100,3 +102,58 @@ func TestTryAgain(t *testing.T) {
 		t.Fatalf("expected ErrNotTransport, got %v", err)
 	}
 }
+
+func TestHandshakeMAC(t *testing.T) {
+	var transport Transport
+	manager := tests.SetupRegistrationManager(tests.Transport{Index: pb.TransportType_Min, Transport: transport})
+	c2p, sfp, reg := tests.SetupPhantomConnections(manager, pb.TransportType_Min)
+	defer c2p.Close()
+	defer sfp.Close()
+	reg.HandshakeMAC = true
+
+	tag := reg.Keys.ConnTag[:]
+	nonce := make([]byte, 16)
+	auth, err := dd.HandshakeAuthenticator(reg.Keys, tag, time.Now(), nonce)
+	if err != nil {
+		t.Fatalf("failed to compute authenticator: %v", err)
+	}
+	message := []byte(`test message!`)
+
+	// The tag alone is not enough for a registration using a handshake MAC.
+	buffer := bytes.NewBuffer(append([]byte(nil), tag...))
+	_, _, err = transport.WrapConnection(buffer, sfp, reg.DarkDecoy, manager)
+	if !errors.Is(err, transports.ErrTryAgain) {
+		t.Fatalf("expected ErrTryAgain, got %v", err)
+	}
+
+	tampered := append([]byte(nil), auth...)
+	tampered[8] ^= 1
+	buffer = bytes.NewBuffer(append(append(append([]byte(nil), tag...), tampered...), message...))
+	_, _, err = transport.WrapConnection(buffer, sfp, reg.DarkDecoy, manager)
+	if !errors.Is(err, transports.ErrHandshakeMAC) {
+		t.Fatalf("expected ErrHandshakeMAC, got %v", err)
+	}
+
+	c2p.Write(append(append(append([]byte(nil), tag...), auth...), message...))
+	var buf [4096]byte
+	buffer = &bytes.Buffer{}
+	for buffer.Len() < dd.ConnTagLen+dd.HandshakeMACLen+len(message) {
+		n, err := sfp.Read(buf[:])
+		if err != nil {
+			t.Fatalf("failed reading from connection: %v", err)
+		}
+		buffer.Write(buf[:n])
+	}
+	_, wrapped, err := transport.WrapConnection(buffer, sfp, reg.DarkDecoy, manager)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(wrapped, received)
+	if err != nil {
+		t.Fatalf("failed reading from connection: %v", err)
+	}
+	if !bytes.Equal(message, received) {
+		t.Fatalf("expected %v, got %v", message, received)
+	}
+}
@@ -0,0 +1,47 @@
+package mux
+
+import (
+	"bytes"
+	"net"
+
+	dd "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/transports"
+)
+
+// Transport is the min transport for registrations multiplexing several
+// streams in their connection: the client sends the 32-byte HMAC ID of min
+// and then speaks the framing of dd.ProxyMux.
+type Transport struct{}
+
+func (Transport) Name() string      { return "MuxTransport" }
+func (Transport) LogPrefix() string { return "MUX" }
+
+func (Transport) GetIdentifier(d *dd.DecoyRegistration) string {
+	return string(d.Keys.ConnTag[:])
+}
+
+func (t Transport) WrapConnection(data *bytes.Buffer, c net.Conn, originalDst net.IP, regManager *dd.RegistrationManager) (*dd.DecoyRegistration, net.Conn, error) {
+	if data.Len() < dd.ConnTagLen {
+		return nil, nil, transports.ErrTryAgain
+	}
+
+	reg := regManager.GetRegistrationByConnTag(originalDst, data.Bytes()[:dd.ConnTagLen])
+	if reg == nil || reg.Transport != dd.TransportTypeMux {
+		return nil, nil, transports.ErrNotTransport
+	}
+
+	// Registrations using a handshake MAC follow the tag with it.
+	authLen := dd.HandshakeAuthLen(reg)
+	if data.Len() < dd.ConnTagLen+authLen {
+		return nil, nil, transports.ErrTryAgain
+	}
+	b := data.Bytes()
+	if !regManager.VerifyHandshakeMAC(reg, b[:dd.ConnTagLen], b[dd.ConnTagLen:dd.ConnTagLen+authLen], t.Name()) {
+		return nil, nil, transports.ErrHandshakeMAC
+	}
+
+	// We don't want the tag or authenticator
+	data.Next(dd.ConnTagLen + authLen)
+
+	return reg, transports.PrependToConn(c, data), nil
+}
@@ -0,0 +1,69 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	dd "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/transports"
+	"github.com/refraction-networking/conjure/application/transports/wrapping/internal/tests"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestSuccessfulWrap(t *testing.T) {
+	testSubnetPath := os.Getenv("GOPATH") + "/src/github.com/refraction-networking/conjure/application/lib/test/phantom_subnets.toml"
+	os.Setenv("PHANTOM_SUBNET_LOCATION", testSubnetPath)
+
+	var transport Transport
+	manager := tests.SetupRegistrationManager(tests.Transport{Index: dd.TransportTypeMux, Transport: transport})
+	c2p, sfp, reg := tests.SetupPhantomConnections(manager, dd.TransportTypeMux)
+	defer c2p.Close()
+	defer sfp.Close()
+
+	message := []byte("\x00\x00\x00\x01\x01\x00\x00")
+	c2p.Write(append(reg.Keys.ConnTag[:], message...))
+
+	var buf [4096]byte
+	var buffer bytes.Buffer
+	n, _ := sfp.Read(buf[:])
+	buffer.Write(buf[:n])
+
+	_, wrapped, err := transport.WrapConnection(&buffer, sfp, reg.DarkDecoy, manager)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(wrapped, received)
+	if err != nil {
+		t.Fatalf("failed reading from connection: %v", err)
+	}
+
+	if !bytes.Equal(message, received) {
+		t.Fatalf("expected %v, got %v", message, received)
+	}
+}
+
+func TestMinRegistration(t *testing.T) {
+	var transport Transport
+	manager := tests.SetupRegistrationManager(tests.Transport{Index: dd.TransportTypeMux, Transport: transport})
+	c2p, sfp, reg := tests.SetupPhantomConnections(manager, pb.TransportType_Min)
+	defer c2p.Close()
+	defer sfp.Close()
+
+	// The tag of a min registration is no mux connection.
+	c2p.Write(reg.Keys.ConnTag[:])
+
+	var buf [32]byte
+	var buffer bytes.Buffer
+	n, _ := sfp.Read(buf[:])
+	buffer.Write(buf[:n])
+
+	_, _, err := transport.WrapConnection(&buffer, sfp, reg.DarkDecoy, manager)
+	if !errors.Is(err, transports.ErrNotTransport) {
+		t.Fatalf("expected ErrNotTransport, got %v", err)
+	}
+}
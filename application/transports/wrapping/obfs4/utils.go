@@ -33,6 +33,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"fmt"
 
 	"gitlab.com/yawning/obfs4.git/common/drbg"
@@ -91,7 +92,7 @@ func findMarkMac(mark, buf []byte, startPos, maxPos int, fromTail bool) (pos int
 		// tail of the buffer.  The client can't send valid data past M_C |
 		// MAC_C as it does not have the server's public key yet.
 		pos = endPos - (MarkLength + MacLength)
-		if !hmac.Equal(buf[pos:pos+MarkLength], mark) {
+		if subtle.ConstantTimeCompare(buf[pos:pos+MarkLength], mark) != 1 {
 			return -1
 		}
 
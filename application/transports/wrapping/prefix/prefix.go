@@ -0,0 +1,86 @@
+package prefix
+
+import (
+	"bytes"
+	"net"
+
+	dd "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/transports"
+)
+
+// Transport is the prefix transport, see dd.PrefixTransportConfig: the client
+// sends one of Prefixes, the 32-byte HMAC ID of min and then the proxied
+// data. Whether a connection is for a registration is only decided once the
+// whole prefix and ID were read, so connections with a registered ID take no
+// less data, and no more lookups, than those without.
+type Transport struct {
+	Prefixes [][]byte
+}
+
+// New returns the prefix transport for the configured prefixes.
+func New(conf *dd.PrefixTransportConfig) Transport {
+	var t Transport
+	for _, p := range conf.Prefixes {
+		t.Prefixes = append(t.Prefixes, []byte(p))
+	}
+	return t
+}
+
+func (Transport) Name() string      { return "PrefixTransport" }
+func (Transport) LogPrefix() string { return "PREFIX" }
+
+func (Transport) GetIdentifier(d *dd.DecoyRegistration) string {
+	return string(d.Keys.ConnTag[:])
+}
+
+func (t Transport) WrapConnection(data *bytes.Buffer, c net.Conn, originalDst net.IP, regManager *dd.RegistrationManager) (*dd.DecoyRegistration, net.Conn, error) {
+	b := data.Bytes()
+	var reg *dd.DecoyRegistration
+	var consumed int
+	possible, matched := false, false
+	for _, p := range t.Prefixes {
+		if len(b) < len(p)+dd.ConnTagLen {
+			// Wait for the tag of any prefix the data may still start with.
+			n := len(b)
+			if n > len(p) {
+				n = len(p)
+			}
+			if bytes.Equal(b[:n], p[:n]) {
+				possible = true
+			}
+			continue
+		}
+		if !bytes.HasPrefix(b, p) {
+			continue
+		}
+		matched = true
+		// Every matching prefix is looked up, the first registered wins.
+		found := regManager.GetRegistrationByConnTag(originalDst, b[len(p):len(p)+dd.ConnTagLen])
+		if reg == nil && found != nil && found.Transport == dd.TransportTypePrefix {
+			reg, consumed = found, len(p)+dd.ConnTagLen
+		}
+	}
+	if possible {
+		return nil, nil, transports.ErrTryAgain
+	}
+	if reg == nil {
+		if matched {
+			return nil, nil, transports.ErrNotRegistered
+		}
+		return nil, nil, transports.ErrNotTransport
+	}
+
+	// Registrations using a handshake MAC follow the tag with it.
+	authLen := dd.HandshakeAuthLen(reg)
+	if len(b) < consumed+authLen {
+		return nil, nil, transports.ErrTryAgain
+	}
+	if !regManager.VerifyHandshakeMAC(reg, b[consumed-dd.ConnTagLen:consumed], b[consumed:consumed+authLen], t.Name()) {
+		return nil, nil, transports.ErrHandshakeMAC
+	}
+
+	// We don't want the prefix, tag or authenticator
+	data.Next(consumed + authLen)
+
+	return reg, transports.PrependToConn(c, data), nil
+}
@@ -0,0 +1,77 @@
+package prefix
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	dd "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/transports"
+	"github.com/refraction-networking/conjure/application/transports/wrapping/internal/tests"
+)
+
+var testTransport = New(&dd.PrefixTransportConfig{Prefixes: []string{"GET / HTTP/1.1\r\n", "GET /index.html HTTP/1.1\r\n"}})
+
+func TestSuccessfulWrap(t *testing.T) {
+	testSubnetPath := os.Getenv("GOPATH") + "/src/github.com/refraction-networking/conjure/application/lib/test/phantom_subnets.toml"
+	os.Setenv("PHANTOM_SUBNET_LOCATION", testSubnetPath)
+
+	transport := testTransport
+	manager := tests.SetupRegistrationManager(tests.Transport{Index: dd.TransportTypePrefix, Transport: transport})
+	c2p, sfp, reg := tests.SetupPhantomConnections(manager, dd.TransportTypePrefix)
+	defer c2p.Close()
+	defer sfp.Close()
+
+	message := []byte("hello covert")
+	sent := append([]byte("GET /index.html HTTP/1.1\r\n"), reg.Keys.ConnTag[:]...)
+	c2p.Write(append(sent, message...))
+
+	var buf [4096]byte
+	var buffer bytes.Buffer
+	n, _ := sfp.Read(buf[:])
+	buffer.Write(buf[:n])
+
+	_, wrapped, err := transport.WrapConnection(&buffer, sfp, reg.DarkDecoy, manager)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(wrapped, received)
+	if err != nil {
+		t.Fatalf("failed reading from connection: %v", err)
+	}
+
+	if !bytes.Equal(message, received) {
+		t.Fatalf("expected %v, got %v", message, received)
+	}
+}
+
+func TestWrapDecisions(t *testing.T) {
+	transport := testTransport
+	manager := tests.SetupRegistrationManager(tests.Transport{Index: dd.TransportTypePrefix, Transport: transport})
+	c2p, sfp, reg := tests.SetupPhantomConnections(manager, dd.TransportTypePrefix)
+	defer c2p.Close()
+	defer sfp.Close()
+
+	prefix := "GET / HTTP/1.1\r\n"
+	unregistered := make([]byte, dd.ConnTagLen)
+	for name, tc := range map[string]struct {
+		data string
+		err  error
+	}{
+		// Until the tag of every prefix the data may start with is read.
+		"partial prefix": {"GET /", transports.ErrTryAgain},
+		"partial tag":    {prefix + string(reg.Keys.ConnTag[:8]), transports.ErrTryAgain},
+		"longer prefix":  {"GET /index.html", transports.ErrTryAgain},
+		"no prefix":      {string(reg.Keys.ConnTag[:]), transports.ErrNotTransport},
+		"unregistered":   {prefix + string(unregistered), transports.ErrNotRegistered},
+	} {
+		_, _, err := transport.WrapConnection(bytes.NewBufferString(tc.data), sfp, reg.DarkDecoy, manager)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/metrics"
+)
+
+// zmqIngestor is the ingestor of the registrations published on the local
+// ZMQ proxy, by the registrars and the detector.
+type zmqIngestor struct {
+	connectAddr string
+	regManager  *cj.RegistrationManager
+	conf        *cj.Config
+
+	messages, registrations, errors int64
+}
+
+func newZMQIngestor(connectAddr string, regManager *cj.RegistrationManager, conf *cj.Config) *zmqIngestor {
+	return &zmqIngestor{connectAddr: connectAddr, regManager: regManager, conf: conf}
+}
+
+func (z *zmqIngestor) Name() string {
+	return metrics.ChannelZMQ
+}
+
+func (z *zmqIngestor) Stats() cj.IngestorStats {
+	return cj.IngestorStats{
+		Messages:      atomic.LoadInt64(&z.messages),
+		Registrations: atomic.LoadInt64(&z.registrations),
+		Errors:        atomic.LoadInt64(&z.errors),
+		PublisherSkew: cj.PublisherSkews().Stats(),
+	}
+}
+
+// Run subscribes to the ZMQ proxy and delivers the registrations received
+// until ctx is done.
+func (z *zmqIngestor) Run(ctx context.Context, regs chan<- *cj.DecoyRegistration) error {
+	logger := cj.NewLogger("[ZMQ] ")
+	sub, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return fmt.Errorf("could not create new ZMQ socket: %v", err)
+	}
+	defer sub.Close()
+
+	// Receives time out so that shutting down is noticed between messages.
+	err = sub.SetRcvtimeo(time.Duration(z.conf.RecvTimeout) * time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("could not set receive timeout of %v: %v", z.conf.RecvTimeout, err)
+	}
+
+	err = sub.Connect(z.connectAddr)
+	if err != nil {
+		return fmt.Errorf("could not connect to ZMQ proxy at %v: %v", z.connectAddr, err)
+	}
+	err = sub.SetSubscribe("")
+	if err != nil {
+		return fmt.Errorf("could not subscribe to ZMQ proxy at %v: %v", z.connectAddr, err)
+	}
+
+	logger.Infof("ZMQ connected to %v", z.connectAddr)
+
+	for {
+		records, err := z.receive(ctx, sub, logger)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			atomic.AddInt64(&z.errors, 1)
+			logger.Warnf("Encountered err when creating Reg: %v", err)
+			continue
+		}
+
+		// Each record holds separate registrations for v4 and v6. Its span
+		// ends once the pipeline has handled them all.
+		for _, record := range records {
+			cj.HoldIngestSpan(record.span, record.regs)
+		}
+		for i, record := range records {
+			for j, reg := range record.regs {
+				select {
+				case regs <- reg:
+					atomic.AddInt64(&z.registrations, 1)
+				case <-ctx.Done():
+					for _, reg := range record.regs[j:] {
+						reg.IngestHandled()
+					}
+					for _, record := range records[i+1:] {
+						record.span.End()
+					}
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// zmqRecord is a registration message received over ZMQ, on its own or in a
+// batch, with the registrations created for it and its ingest span.
+type zmqRecord struct {
+	regs []*cj.DecoyRegistration
+	span *cj.Span
+}
+
+// receive ingests messages from zmq and parses them into
+// registration structs for the registration manager to process, one record
+// per registration message, several for a batch. The error is that of a
+// message that could not be read, or of an unbatched one that could not be
+// parsed; the records of a batch that fail are only logged and counted.
+// **NOTE** : Avoid ALL blocking calls (i.e. things that require a lock on the
+// registration tracking structs) in this method because it will block and
+// prevent the station from ingesting new registrations.
+// **NOTE2**: If the registration address is IPv4 we will create registrations
+// for both IPv4 decoy and IPv6 decoy. However, If the client Address from
+// registrations is IPv6 we will only create an ipv6 registration because
+// 		1) we have no client address to match on for ipv4
+//	 	2) the client _should_ support ipv6
+func (z *zmqIngestor) receive(ctx context.Context, sub *zmq.Socket, logger *cj.Logger) ([]zmqRecord, error) {
+	msgs, batch, err := recvRegistrationFrames(ctx, sub)
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&z.messages, 1)
+	if err != nil {
+		metrics.IngestMessages.Inc(metrics.ChannelZMQ, ingestOutcomeMalformed)
+		logger.Errorf("error reading from ZMQ socket: %v", err)
+		return nil, err
+	}
+	if msgs == nil {
+		// Live phantom report from the detector, not a registration.
+		metrics.IngestMessages.Inc(metrics.ChannelZMQ, ingestOutcomeLivePhantomReport)
+		return nil, nil
+	}
+
+	// The records of a batch are independent, one that fails is counted and
+	// skipped.
+	records := make([]zmqRecord, 0, len(msgs))
+	for i, msg := range msgs {
+		span := cj.StartRegistrationSpan(metrics.ChannelZMQ)
+		regs, err := parseRegistrationMessage(msg, z.regManager, z.conf, metrics.ChannelZMQ, span, nil)
+		span.SetError(err)
+		if err != nil {
+			span.End()
+			if !batch {
+				return nil, err
+			}
+			atomic.AddInt64(&z.errors, 1)
+			metrics.IngestBatchRecords.Inc(metrics.ChannelZMQ, ingestBatchFailed)
+			logger.Warnf("Encountered err when creating Reg from record %d of %d of batch: %v", i+1, len(msgs), err)
+			continue
+		}
+		if batch {
+			metrics.IngestBatchRecords.Inc(metrics.ChannelZMQ, ingestBatchOK)
+		}
+		records = append(records, zmqRecord{regs, span})
+	}
+	return records, nil
+}
+
+// Outcomes of the records of registration batches, see
+// metrics.IngestBatchRecords.
+const (
+	ingestBatchOK     = "ok"
+	ingestBatchFailed = "failed"
+)
+
+// recvRegistrationFrames reads exactly one logical ZMQ message from the
+// socket and returns the registration payloads it holds. Registrars publish
+// each registration as a single frame containing a marshaled C2SWrapper, or
+// several as a batch (see cj.RegistrationBatchTopic), in which case batch is
+// set. RecvMessageBytes always consumes every frame of a multi-part message,
+// so an unexpected multi-part message is rejected as a whole rather than
+// having its trailing frames misread as the following registrations.
+//
+// The detector also publishes two frame live phantom reports (see
+// cj.LivePhantomTopic) on the same channel. These are fed to the liveness
+// cache and no payloads are returned for them.
+//
+// It returns ctx.Err() once ctx is done, see cj.RecvZMQMessage.
+func recvRegistrationFrames(ctx context.Context, sub *zmq.Socket) (msgs [][]byte, batch bool, err error) {
+	frames, err := cj.RecvZMQMessage(ctx, sub)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(frames) == 2 && string(frames[0]) == cj.LivePhantomTopic {
+		phantoms, err := cj.ParseLivePhantomReport(frames[1])
+		if err != nil {
+			return nil, false, err
+		}
+		for _, phantom := range phantoms {
+			cj.ReportLivePhantom(phantom)
+		}
+		return nil, false, nil
+	}
+
+	if len(frames) > 0 && string(frames[0]) == cj.RegistrationBatchTopic {
+		if len(frames) == 1 {
+			return nil, true, fmt.Errorf("empty registration batch")
+		}
+		return frames[1:], true, nil
+	}
+
+	if len(frames) != 1 {
+		return nil, false, fmt.Errorf("expected single-frame registration message, got %d frames", len(frames))
+	}
+	return frames, false, nil
+}
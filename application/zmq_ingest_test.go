@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+	cj "github.com/refraction-networking/conjure/application/lib"
+	"github.com/refraction-networking/conjure/application/metrics"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+// A multi-part message must be consumed and rejected as a whole so that the
+// following single-frame registration is still read intact.
+func TestZMQRecvRegistrationFrames(t *testing.T) {
+	pub, err := zmq.NewSocket(zmq.PUB)
+	require.Nil(t, err)
+	defer pub.Close()
+	require.Nil(t, pub.Bind("inproc://test-recv-frames"))
+
+	sub, err := zmq.NewSocket(zmq.SUB)
+	require.Nil(t, err)
+	defer sub.Close()
+	require.Nil(t, sub.Connect("inproc://test-recv-frames"))
+	require.Nil(t, sub.SetSubscribe(""))
+
+	// Give the subscription time to propagate so messages aren't dropped.
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = pub.SendMessage([]byte("frame-one"), []byte("frame-two"))
+	require.Nil(t, err)
+	_, err = pub.SendBytes([]byte("single-frame"), 0)
+	require.Nil(t, err)
+
+	_, _, err = recvRegistrationFrames(context.Background(), sub)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "got 2 frames")
+
+	msgs, batch, err := recvRegistrationFrames(context.Background(), sub)
+	require.Nil(t, err)
+	require.False(t, batch)
+	require.Equal(t, [][]byte{[]byte("single-frame")}, msgs)
+}
+
+// Live phantom reports from the detector go to the liveness cache and are not
+// mistaken for registrations.
+func TestZMQRecvLivePhantomReport(t *testing.T) {
+	pub, err := zmq.NewSocket(zmq.PUB)
+	require.Nil(t, err)
+	defer pub.Close()
+	require.Nil(t, pub.Bind("inproc://test-recv-live-phantoms"))
+
+	sub, err := zmq.NewSocket(zmq.SUB)
+	require.Nil(t, err)
+	defer sub.Close()
+	require.Nil(t, sub.Connect("inproc://test-recv-live-phantoms"))
+	require.Nil(t, sub.SetSubscribe(""))
+
+	time.Sleep(100 * time.Millisecond)
+
+	cj.SetLivenessCache(10, time.Hour, time.Minute)
+	defer cj.SetLivenessCache(0, 0, 0)
+
+	report := append(net.ParseIP("192.0.2.7").To16(), net.ParseIP("2001:db8::7")...)
+	_, err = pub.SendMessage([]byte(cj.LivePhantomTopic), []byte(report))
+	require.Nil(t, err)
+	_, err = pub.SendMessage([]byte(cj.LivePhantomTopic), []byte("short"))
+	require.Nil(t, err)
+
+	msgs, _, err := recvRegistrationFrames(context.Background(), sub)
+	require.Nil(t, err)
+	require.Nil(t, msgs)
+
+	_, _, err = recvRegistrationFrames(context.Background(), sub)
+	require.NotNil(t, err)
+
+	for _, phantom := range []string{"192.0.2.7", "2001:db8::7"} {
+		reg := &cj.DecoyRegistration{DarkDecoy: net.ParseIP(phantom)}
+		live, reason := reg.PhantomIsLive()
+		require.True(t, live, phantom)
+		require.Contains(t, reason.Error(), "reported live by detector")
+	}
+}
+
+// The registration loop notices shutdown while no registrations arrive, and
+// its receive timeouts are not counted as malformed messages.
+func TestZMQUpdatesStop(t *testing.T) {
+	conf := &cj.Config{}
+	conf.RecvTimeout = 10
+	malformed := metrics.IngestMessages.Value(metrics.ChannelZMQ, ingestOutcomeMalformed)
+
+	z := newZMQIngestor("inproc://test-zmq-updates-stop", nil, conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- z.Run(ctx, make(chan *cj.DecoyRegistration))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("registration loop did not stop")
+	}
+	require.Equal(t, malformed, metrics.IngestMessages.Value(metrics.ChannelZMQ, ingestOutcomeMalformed))
+	require.Equal(t, cj.IngestorStats{}, z.Stats())
+}
+
+// The records of a registration batch are ingested independently, a
+// malformed one does not lose the others.
+func TestZMQRecvRegistrationBatch(t *testing.T) {
+	pub, err := zmq.NewSocket(zmq.PUB)
+	require.Nil(t, err)
+	defer pub.Close()
+	require.Nil(t, pub.Bind("inproc://test-recv-batch"))
+
+	sub, err := zmq.NewSocket(zmq.SUB)
+	require.Nil(t, err)
+	defer sub.Close()
+	require.Nil(t, sub.Connect("inproc://test-recv-batch"))
+	require.Nil(t, sub.SetSubscribe(""))
+
+	time.Sleep(100 * time.Millisecond)
+
+	api := newTestRegistrationAPI(t)
+	z := newZMQIngestor("inproc://test-recv-batch", api.regManager, api.conf)
+
+	registration := func() []byte {
+		c2s, _ := mockReceiveFromDetector()
+		transport := pb.TransportType_Min
+		gen := uint32(1)
+		v4, v6 := true, false
+		c2s.Transport = &transport
+		c2s.DecoyListGeneration = &gen
+		c2s.V4Support = &v4
+		c2s.V6Support = &v6
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		require.Nil(t, err)
+		msg, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret, RegistrationPayload: c2s, RegistrationAddress: net.ParseIP("192.0.2.10").To4()})
+		require.Nil(t, err)
+		return msg
+	}
+	ok := metrics.IngestBatchRecords.Value(metrics.ChannelZMQ, ingestBatchOK)
+	failed := metrics.IngestBatchRecords.Value(metrics.ChannelZMQ, ingestBatchFailed)
+
+	_, err = pub.SendMessage([]byte(cj.RegistrationBatchTopic), registration(), []byte{0xff, 0xff, 0xff}, registration())
+	require.Nil(t, err)
+	_, err = pub.SendMessage([]byte(cj.RegistrationBatchTopic))
+	require.Nil(t, err)
+
+	records, err := z.receive(context.Background(), sub, cj.NewLogger(""))
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	for _, record := range records {
+		require.Len(t, record.regs, 1)
+		record.span.End()
+	}
+	require.NotEqual(t, records[0].regs[0].IDString(), records[1].regs[0].IDString())
+	require.Equal(t, ok+2, metrics.IngestBatchRecords.Value(metrics.ChannelZMQ, ingestBatchOK))
+	require.Equal(t, failed+1, metrics.IngestBatchRecords.Value(metrics.ChannelZMQ, ingestBatchFailed))
+	require.Equal(t, cj.IngestorStats{Messages: 1, Errors: 1}, z.Stats())
+
+	_, err = z.receive(context.Background(), sub, cj.NewLogger(""))
+	require.NotNil(t, err)
+}
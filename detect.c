@@ -111,8 +111,12 @@ void the_program(uint8_t core_id, unsigned int log_interval,
     struct timespec cur_time_ns;
     int64_t ns_since_last_drop;
     int64_t ns_since_status_report;
-    // log_interval is milliseconds
+    // log_interval is milliseconds, unless the station config sets the
+    // detector's stats interval (zero only quiets the reports)
     int64_t log_interval_ns = log_interval * 1000LL * 1000LL;
+    int64_t configured_interval_ms = rust_stats_interval_ms(rust_ptr);
+    if(configured_interval_ms > 0)
+        log_interval_ns = configured_interval_ms * 1000LL * 1000LL;
     pfring_maybezc_stat stats;
     pfring_maybezc_stats(g_ring, &stats);
     unsigned long drops_prev = stats.drop;
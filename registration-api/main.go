@@ -16,6 +16,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
 	zmq "github.com/pebbe/zmq4"
+	cj "github.com/refraction-networking/conjure/application/lib"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 )
 
@@ -214,10 +215,13 @@ func main() {
 	}
 
 	if s.AuthType == "CURVE" {
-		privkeyBytes, err := ioutil.ReadFile(s.PrivateKeyPath)
+		privkeyBytes, err := cj.LoadSecret(s.PrivateKeyPath)
 		if err != nil {
 			s.logger.Fatalln("failed to get private key:", err)
 		}
+		if len(privkeyBytes) < 32 {
+			s.logger.Fatalf("failed to get private key: %v: %d bytes, need 32", cj.ErrSecretMalformed, len(privkeyBytes))
+		}
 
 		privkey := zmq.Z85encode(string(privkeyBytes[:32]))
 
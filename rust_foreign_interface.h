@@ -15,6 +15,7 @@ uint8_t rust_process_packet(
 uint8_t rust_event_loop_tick(void *rust_global);
 // uint8_t rust_update_overloaded_decoys(void* rust_global);
 uint8_t rust_periodic_report(void *rust_global);
+int64_t rust_stats_interval_ms(void *rust_global);
 uint8_t rust_periodic_cleanup(void *rust_global);
 
 int send_packet_to_proxy(uint8_t id, uint8_t *pkt, size_t len);
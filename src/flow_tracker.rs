@@ -9,6 +9,7 @@ use util::IpPacket;
 use std::fmt;
 
 use sessions::SessionTracker;
+use seq_window::{SeqCheckMode, SeqTracker};
 
 // All members are stored in host-order, even src_ip and dst_ip.
 #[derive(PartialEq, Eq, Hash, Copy, Clone, Debug)]
@@ -185,6 +186,10 @@ pub struct FlowTracker
     // Map values are timeouts, which are used to drop stale dark decoys
     pub phantom_flows: SessionTracker,
     // pub phantom_flows: Arc<RwLock<HashMap<IpAddr, u64>>>,
+
+    // Sequence windows of the flows forwarded to registered phantoms, used
+    // to spot injected or replayed packets. Off unless configured.
+    pub forwarded_seqs: SeqTracker,
 }
 
 // Amount of time that we timeout all flows
@@ -204,6 +209,7 @@ impl FlowTracker
                 tracked_flows: HashSet::new(),
                 phantom_flows: SessionTracker::new(),
                 stale_drops_tracked: VecDeque::with_capacity(16384),
+                forwarded_seqs: SeqTracker::new(SeqCheckMode::Off, 0),
             };
 
         // launch thread to ingest from redis
@@ -229,6 +235,18 @@ impl FlowTracker
         self.phantom_flows.is_tracked_session(flow)
     }
 
+    /// is_phantom_session, asking the station if remote registration queries
+    /// are enabled, see SessionTracker::query_session.
+    pub fn query_phantom_session(&self, flow: &FlowNoSrcPort) -> bool
+    {
+        self.phantom_flows.query_session(flow)
+    }
+
+    pub fn is_registered_phantom(&self, ip: &IpAddr) -> bool
+    {
+        self.phantom_flows.is_registered_phantom(ip)
+    }
+
     pub fn is_tracked_flow(&self, flow: &Flow) -> bool
     {
         self.tracked_flows.contains(&flow)
@@ -283,10 +301,12 @@ impl FlowTracker
         self.phantom_flows.drop_stale_sessions()
     }
 
-    // This function returns the number of flows that it drops.
+    // This function returns the number of flows that it drops. Idle sequence
+    // windows are forgotten too, they are not counted as flows.
     #[allow(non_snake_case)]
     pub fn drop_all_stale_flows(&mut self) -> usize
     {
+        self.forwarded_seqs.drop_idle(precise_time_ns());
         self.drop_stale_tracked_flows() + self.drop_stale_phantom_flows()
     }
 
@@ -0,0 +1,108 @@
+// Checks that the corpus the Go station's interop tests decode
+// (application/interop/testdata) is byte for byte what the detector sends:
+// registrations are built here with the same setters as check_dark_decoy_tag
+// and live phantom reports with encode_live_phantom. If one of these fails
+// after a change to the detector's messages, recapture the corpus and
+// regenerate the goldens (make -C application interop-goldens). Captured
+// registrations (make -C application interop-capture) are checked to
+// re-encode unchanged with the detector's protobuf code.
+
+use std::fs;
+use std::net::IpAddr;
+use std::path::Path;
+
+use protobuf::Message;
+use signalling::{C2SWrapper, ClientToStation, RegistrationFlags, RegistrationSource, TransportType};
+use live_phantoms::encode_live_phantom;
+
+fn dummy_secret(first: u8) -> Vec<u8>
+{
+    (0..32).map(|i| first + i).collect()
+}
+
+fn addr_bytes(addr: &str) -> Vec<u8>
+{
+    // As Flow::export_addrs: 4 bytes for IPv4, 16 for IPv6.
+    match addr.parse::<IpAddr>().unwrap() {
+        IpAddr::V4(ip) => ip.octets().to_vec(),
+        IpAddr::V6(ip) => ip.octets().to_vec(),
+    }
+}
+
+fn registration(shared_secret: Vec<u8>, vsp: ClientToStation, src: &str, decoy: &str) -> Vec<u8>
+{
+    let mut zmq_msg = C2SWrapper::new();
+    zmq_msg.set_shared_secret(shared_secret);
+    zmq_msg.set_registration_payload(vsp);
+    zmq_msg.set_registration_source(RegistrationSource::Detector);
+    zmq_msg.set_decoy_address(addr_bytes(decoy));
+    zmq_msg.set_registration_address(addr_bytes(src));
+    zmq_msg.write_to_bytes().unwrap()
+}
+
+fn client_to_station(generation: u32, transport: TransportType, covert: &str,
+                     v4: bool, v6: bool) -> ClientToStation
+{
+    let mut c2s = ClientToStation::new();
+    c2s.set_decoy_list_generation(generation);
+    c2s.set_transport(transport);
+    c2s.set_covert_address(covert.to_string());
+    c2s.set_masked_decoy_server_name("example.com".to_string());
+    c2s.set_v6_support(v6);
+    c2s.set_v4_support(v4);
+    c2s
+}
+
+#[test]
+fn registration_corpus()
+{
+    let mut flags = RegistrationFlags::new();
+    flags.set_use_TIL(true);
+    let mut c2s = client_to_station(1153, TransportType::Min, "192.0.2.80:443", true, false);
+    c2s.set_flags(flags.clone());
+    assert_eq!(registration(dummy_secret(0x01), c2s, "198.51.100.7", "192.0.2.1"),
+        &include_bytes!("../application/interop/testdata/registration/detector_v4_min.bin")[..]);
+
+    let mut c2s = client_to_station(1153, TransportType::Min, "example.org:443", true, true);
+    c2s.set_flags(flags.clone());
+    c2s.set_padding((0..40).map(|i| 0xa0 + i).collect());
+    assert_eq!(registration(dummy_secret(0x81), c2s, "198.51.100.9", "192.0.2.2"),
+        &include_bytes!("../application/interop/testdata/registration/detector_padding.bin")[..]);
+
+    let mut v6_flags = RegistrationFlags::new();
+    v6_flags.set_upload_only(false);
+    v6_flags.set_use_TIL(true);
+    let mut c2s = client_to_station(1154, TransportType::Obfs4, "[2001:db8::80]:443", false, true);
+    c2s.set_flags(v6_flags);
+    assert_eq!(registration(dummy_secret(0x41), c2s, "2001:db8:1::7", "2001:db8::1"),
+        &include_bytes!("../application/interop/testdata/registration/detector_v6_obfs4.bin")[..]);
+}
+
+#[test]
+fn live_phantom_corpus()
+{
+    assert_eq!(encode_live_phantom("192.0.2.7".parse().unwrap()),
+        *include_bytes!("../application/interop/testdata/live_phantom/v4.bin"));
+    assert_eq!(encode_live_phantom("2001:db8::7".parse().unwrap()),
+        *include_bytes!("../application/interop/testdata/live_phantom/v6.bin"));
+}
+
+#[test]
+fn registration_corpus_reencodes()
+{
+    let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("application/interop/testdata/registration");
+    let mut checked = 0;
+    for entry in fs::read_dir(&dir).unwrap() {
+        let path = entry.unwrap().path();
+        let name = path.file_name().unwrap().to_string_lossy().into_owned();
+        if !name.ends_with(".bin") || name.starts_with("truncated") {
+            continue;
+        }
+        let msg = fs::read(&path).unwrap();
+        let parsed: C2SWrapper = Message::parse_from_bytes(&msg)
+            .unwrap_or_else(|e| panic!("{}: {}", name, e));
+        assert_eq!(parsed.write_to_bytes().unwrap(), msg, "{} re-encodes differently", name);
+        checked += 1;
+    }
+    assert!(checked > 0);
+}
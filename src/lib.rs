@@ -10,6 +10,7 @@ extern crate time;
 extern crate errno;
 extern crate hex;
 extern crate aes_gcm;
+extern crate ipnetwork;
 
 extern crate radix; // https://github.com/refraction-networking/radix
 extern crate tuntap; // https://github.com/ewust/tuntap.rs
@@ -31,6 +32,7 @@ use std::env;
 use std::fs;
 use serde_derive::Deserialize;
 
+use std::collections::HashMap;
 use std::ffi::CStr;
 use std::os::raw::c_char;
 
@@ -47,9 +49,20 @@ pub mod process_packet;
 pub mod util;
 pub mod signalling;
 pub mod sessions;
+pub mod live_phantoms;
+pub mod sampling;
+pub mod seq_window;
+pub mod registration_query;
+#[cfg(test)]
+mod interop;
 
 
 use flow_tracker::{Flow,FlowTracker};
+use live_phantoms::{LivePhantomReporter, LIVE_PHANTOM_REPORT_INTERVAL_NS};
+use sampling::FlowSampler;
+use seq_window::{SeqCheckMode, SeqTracker};
+use registration_query::RegistrationQuery;
+use process_packet::Decapsulation;
 
 
 // Global program state for one instance of a TapDance station process.
@@ -79,9 +92,23 @@ pub struct PerCoreGlobal
     // notifications. 
     filter_list: Vec<String>,
 
+    // Deduplicates reports of phantoms seen originating traffic, see
+    // check_live_phantom.
+    live_phantoms: LivePhantomReporter,
+
+    // Selects the flows checked for registrations when only a sample of the
+    // traffic is inspected, see detector_flow_sampling.
+    sampler: FlowSampler,
+
     // If we're reading from a GRE tap, we can provide an optional offset that we read
     // into the packet (skipping the GRE header).
     gre_offset: usize,
+
+    // Encapsulations looked inside of, see detector_decapsulation.
+    decapsulation: Decapsulation,
+
+    // Milliseconds between periodic reports, see rust_stats_interval_ms.
+    stats_interval_ms: i64,
 }
 
 // Tracking of some pretty straightforward quantities
@@ -97,6 +124,12 @@ pub struct PerCoreStats
     //pub reconns_this_period: u64,
     pub tls_bytes_this_period: u64,
     pub port_443_syns_this_period: u64,
+    // Port 443 packets not inspected as their flow was not sampled.
+    pub unsampled_packets_this_period: u64,
+    // Forwarded packets outside their flow's sequence window, and those of
+    // them dropped, see detector_seq_check.
+    pub seq_suspect_packets_this_period: u64,
+    pub seq_dropped_packets_this_period: u64,
     //pub cli2cov_raw_etherbytes_this_period: u64,
 
     // CPU time counters (cumulative)
@@ -116,6 +149,48 @@ pub struct PerCoreStats
 #[derive(Deserialize)]
 struct StationConfig {
     detector_filter_list: Vec<String>,
+
+    // Only check 1 in this many flows for registrations. 0 or 1 checks all.
+    #[serde(default)]
+    detector_flow_sampling: u64,
+
+    // Checks of forwarded packets against their flow's sequence window: off,
+    // count (the default) or enforce.
+    #[serde(default)]
+    detector_seq_check: String,
+
+    // Bytes of sequence space either side of what a flow has sent that are
+    // plausible. 0 uses DEFAULT_SEQ_WINDOW.
+    #[serde(default)]
+    detector_seq_window: u32,
+
+    // The encapsulations ("vxlan", "gre") looked inside of on each interface
+    // of CJ_IFACE.
+    #[serde(default)]
+    detector_decapsulation: HashMap<String, Vec<String>>,
+
+    // The station's management endpoint, host:port, asked about connections
+    // to phantoms in detector_registration_query_subnets that are not
+    // tracked. Empty only uses the registrations heard over redis.
+    #[serde(default)]
+    detector_registration_query_addr: String,
+    #[serde(default)]
+    detector_registration_query_subnets: Vec<String>,
+
+    // Timeout of a query and how long not registered answers are cached, in
+    // milliseconds. 0 uses the registration_query defaults.
+    #[serde(default)]
+    detector_registration_query_timeout: u64,
+    #[serde(default)]
+    detector_registration_negative_cache: u64,
+
+    // Seconds between the stats reports of each component, the station's
+    // stats_intervals; the detector's is "detector". stats_output "metrics"
+    // quiets the reports.
+    #[serde(default)]
+    stats_intervals: HashMap<String, i64>,
+    #[serde(default)]
+    stats_output: String,
 }
 
 const IP_LIST_PATH: &'static str = "/var/lib/dark-decoy.prefixes";
@@ -159,17 +234,45 @@ impl PerCoreGlobal
 
         debug!("gre_offset: {}", gre_offset);
 
+        let interfaces = env::var("CJ_IFACE").unwrap_or_default();
+        let decapsulation = Decapsulation::for_interfaces(&value.detector_decapsulation, &interfaces)
+            .expect("Bad detector_decapsulation, expected vxlan or gre");
+        debug!("decapsulation on {}: {:?}", interfaces, decapsulation);
+
+        let seq_mode = SeqCheckMode::parse(&value.detector_seq_check)
+            .expect("Bad detector_seq_check, expected off, count or enforce");
+        let mut flow_tracker = FlowTracker::new();
+        flow_tracker.forwarded_seqs = SeqTracker::new(seq_mode, value.detector_seq_window);
+        if !value.detector_registration_query_addr.is_empty() {
+            let query = RegistrationQuery::new(&value.detector_registration_query_addr,
+                                               &value.detector_registration_query_subnets,
+                                               value.detector_registration_query_timeout,
+                                               value.detector_registration_negative_cache)
+                .expect("Bad detector_registration_query_addr or detector_registration_query_subnets");
+            flow_tracker.phantom_flows.remote = Some(query);
+        }
+
+        let stats_interval_ms = if value.stats_output == "metrics" {
+            0
+        } else {
+            value.stats_intervals.get("detector").map_or(-1, |secs| secs * 1000)
+        };
+
         PerCoreGlobal {
             priv_key: priv_key,
             lcore: the_lcore,
             // sessions: HashMap::new(),
-            flow_tracker: FlowTracker::new(),
+            flow_tracker: flow_tracker,
             tun: tun,
             stats: PerCoreStats::new(),
             ip_tree: PrefixTree::new(),
             zmq_sock: zmq_sock,
             filter_list: value.detector_filter_list,
+            live_phantoms: LivePhantomReporter::new(LIVE_PHANTOM_REPORT_INTERVAL_NS),
+            sampler: FlowSampler::new(value.detector_flow_sampling),
             gre_offset: gre_offset,
+            decapsulation: decapsulation,
+            stats_interval_ms: stats_interval_ms,
         }
     }
 
@@ -210,6 +313,9 @@ impl PerCoreStats
                        //reconns_this_period: 0,
                        tls_bytes_this_period: 0,
                        port_443_syns_this_period: 0,
+                       unsampled_packets_this_period: 0,
+                       seq_suspect_packets_this_period: 0,
+                       seq_dropped_packets_this_period: 0,
                        //cli2cov_raw_etherbytes_this_period: 0,
 
                        tot_usr_us: 0,
@@ -219,7 +325,10 @@ impl PerCoreStats
                         not_in_tree_this_period: 0,
                         in_tree_this_period: 0 }
     }
-    fn periodic_status_report(&mut self, tracked: usize, dark_decoys: usize)
+    // quiet leaves the report out of the log, the reporter still gets it
+    // (stats_intervals.detector = 0, or stats_output = "metrics").
+    fn periodic_status_report(&mut self, tracked: usize, dark_decoys: usize, sample_one_in: u64,
+                              query_errors: usize, quiet: bool)
     {
         let cur_measure_time = precise_time_ns();
         let (user_secs, user_usecs, sys_secs, sys_usecs) =
@@ -250,13 +359,23 @@ impl PerCoreStats
                 0,
                 0);
         */
-        report!("stats {} pkts ({} v4, {} v6) dark decoy flows {} tracked flows {} tags checked {}",
+        let line = format!("stats {} pkts ({} v4, {} v6) dark decoy flows {} tracked flows {} tags checked {} sampling 1/{} ({} unsampled) seq suspect {} ({} dropped) remote query errors {}",
             self.packets_this_period,
             self.ipv4_packets_this_period,
             self.ipv6_packets_this_period,
             dark_decoys,
             tracked,
-            self.elligator_this_period);
+            self.elligator_this_period,
+            sample_one_in,
+            self.unsampled_packets_this_period,
+            self.seq_suspect_packets_this_period,
+            self.seq_dropped_packets_this_period,
+            query_errors);
+        if quiet {
+            report_quietly!("{}", line);
+        } else {
+            report!("{}", line);
+        }
 
         self.elligator_this_period = 0;
         self.packets_this_period = 0;
@@ -268,6 +387,9 @@ impl PerCoreStats
         //self.reconns_this_period = 0;
         self.tls_bytes_this_period = 0;
         self.port_443_syns_this_period = 0;
+        self.unsampled_packets_this_period = 0;
+        self.seq_suspect_packets_this_period = 0;
+        self.seq_dropped_packets_this_period = 0;
 
         self.tot_usr_us = user_microsecs;
         self.tot_sys_us = sys_microsecs;
@@ -286,7 +408,22 @@ pub extern "C" fn rust_periodic_report(ptr: *mut PerCoreGlobal)
     let mut global = unsafe { &mut *ptr };
     global.stats.periodic_status_report(
         global.flow_tracker.count_tracked_flows(),
-        global.flow_tracker.count_phantom_flows());
+        global.flow_tracker.count_phantom_flows(),
+        global.sampler.one_in(),
+        global.flow_tracker.phantom_flows.remote.as_ref().map_or(0, |q| q.take_errors()),
+        global.stats_interval_ms == 0);
+}
+
+// The interval between periodic reports in milliseconds, from
+// stats_intervals.detector in the station config, -1 if it does not set one
+// (detect.c then uses its -l interval). Zero quiets the reports, detect.c
+// still takes them at its -l interval so that the reporter keeps getting
+// them.
+#[no_mangle]
+pub extern "C" fn rust_stats_interval_ms(ptr: *mut PerCoreGlobal) -> i64
+{
+    let global = unsafe { &*ptr };
+    global.stats_interval_ms
 }
 
 #[repr(C)]
@@ -0,0 +1,87 @@
+use std::collections::HashMap;
+use std::net::IpAddr;
+
+// Topic frame of the detector -> station message reporting live phantoms. The
+// second frame holds the reported addresses, 16 bytes each (IPv4 addresses
+// are sent IPv4-mapped).
+pub const LIVE_PHANTOM_TOPIC: &'static [u8] = b"phantom_live";
+
+// Report each address at most once per interval so a chatty live host does
+// not produce a message per packet.
+pub const LIVE_PHANTOM_REPORT_INTERVAL_NS: u64 = 60 * 1000 * 1000 * 1000;
+
+// Bound on the addresses remembered for deduplication.
+const MAX_TRACKED_LIVE_PHANTOMS: usize = 65536;
+
+pub struct LivePhantomReporter
+{
+    last_report: HashMap<IpAddr, u64>,
+    interval_ns: u64,
+}
+
+impl LivePhantomReporter
+{
+    pub fn new(interval_ns: u64) -> LivePhantomReporter
+    {
+        LivePhantomReporter { last_report: HashMap::new(), interval_ns: interval_ns }
+    }
+
+    // should_report returns true if addr has not been reported in the last
+    // interval (now is in nanoseconds) and records the report.
+    pub fn should_report(&mut self, addr: IpAddr, now: u64) -> bool
+    {
+        if let Some(last) = self.last_report.get(&addr) {
+            if now.saturating_sub(*last) < self.interval_ns {
+                return false;
+            }
+        }
+
+        if self.last_report.len() >= MAX_TRACKED_LIVE_PHANTOMS {
+            let interval = self.interval_ns;
+            self.last_report.retain(|_, last| now.saturating_sub(*last) < interval);
+            if self.last_report.len() >= MAX_TRACKED_LIVE_PHANTOMS {
+                self.last_report.clear();
+            }
+        }
+        self.last_report.insert(addr, now);
+        true
+    }
+}
+
+// encode_live_phantom returns the address frame for addr.
+pub fn encode_live_phantom(addr: IpAddr) -> [u8; 16]
+{
+    match addr {
+        IpAddr::V4(a) => a.to_ipv6_mapped().octets(),
+        IpAddr::V6(a) => a.octets(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+use std::net::IpAddr;
+use live_phantoms::{LivePhantomReporter, encode_live_phantom};
+
+#[test]
+fn live_phantom_reports_are_deduplicated()
+{
+    let mut r = LivePhantomReporter::new(100);
+    let a: IpAddr = "192.0.2.1".parse().unwrap();
+    let b: IpAddr = "2001:db8::1".parse().unwrap();
+
+    assert!(r.should_report(a, 1000));
+    assert!(!r.should_report(a, 1050));
+    assert!(r.should_report(b, 1050));
+    assert!(r.should_report(a, 1100));
+}
+
+#[test]
+fn live_phantom_encoding()
+{
+    let a: IpAddr = "192.0.2.1".parse().unwrap();
+    assert_eq!(encode_live_phantom(a),
+        [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1]);
+    let b: IpAddr = "2001:db8::1".parse().unwrap();
+    assert_eq!(encode_live_phantom(b)[..4], [0x20, 0x01, 0x0d, 0xb8]);
+}
+}
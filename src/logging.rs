@@ -53,6 +53,15 @@ macro_rules! report {
         $crate::c_api::c_write_reporter(s2);
     }};
 }
+
+// As report!, without the log line: only the reporter hears it.
+#[macro_export]
+macro_rules! report_quietly {
+    ($($arg:tt)*) => {{
+        let s = format!("{}\n", format_args!($($arg)*));
+        $crate::c_api::c_write_reporter(s);
+    }};
+}
 //HACKY_CFG_NO_TEST_END*/
 /*//HACKY_CFG_YES_TEST_BEGIN
 #[macro_export]
@@ -62,6 +71,12 @@ macro_rules! report {
         debug!("{}", s);
     }};
 }
+#[macro_export]
+macro_rules! report_quietly {
+    ($($arg:tt)*) => {{
+        let _ = format!("{}\n", format_args!($($arg)*));
+    }};
+}
 //HACKY_CFG_YES_TEST_END*/
 
 
@@ -1,11 +1,11 @@
 use libc::size_t;
 use std::os::raw::c_void;
 use std::panic;
+use std::collections::HashMap;
 use std::slice;
 use std:: str;
 
 use pnet::packet::Packet;
-use pnet::packet::ethernet::{EthernetPacket, EtherTypes};
 use pnet::packet::ip::IpNextHeaderProtocols;
 use pnet::packet::ipv4::Ipv4Packet;
 use pnet::packet::ipv6::Ipv6Packet;
@@ -18,10 +18,14 @@ use std::u8;
 use flow_tracker::{Flow, FlowNoSrcPort};
 // use dd_selector::DDIpSelector;
 use PerCoreGlobal;
-use util::IpPacket;
+use util::{IpPacket, get_tcp_sack_blocks};
 use elligator;
 use protobuf::{Message};
 use signalling::{C2SWrapper, RegistrationSource};
+use live_phantoms::{encode_live_phantom, LIVE_PHANTOM_TOPIC};
+use seq_window::{SeqCheckMode, SeqSegment};
+use time::precise_time_ns;
+use zmq;
 
 
 const TLS_TYPE_APPLICATION_DATA: u8 = 0x17;
@@ -33,38 +37,169 @@ const SPECIAL_UDP_PAYLOAD: &'static [u8] = b"\x38xCKe9ECO5lNwXgd5Q25w0C2qUR7whlt
 
 //const STREAM_TIMEOUT_NS: u64 = 120*1000*1000*1000; // 120 seconds
 
-fn get_ip_packet<'p>(eth_pkt: &'p EthernetPacket) -> Option<IpPacket<'p>>
+const ETHERTYPE_IPV4: u16 = 0x0800;
+const ETHERTYPE_IPV6: u16 = 0x86dd;
+const ETHERTYPE_VLAN: u16 = 0x8100;
+// Transparent Ethernet bridging: GRE carrying whole Ethernet frames.
+const ETHERTYPE_TEB: u16 = 0x6558;
+const IP_PROTO_UDP: u8 = 17;
+const IP_PROTO_GRE: u8 = 47;
+const VXLAN_PORT: u16 = 4789;
+
+// The encapsulations the detector looks inside of, so that registrations and
+// tags are checked on the inner packets. See detector_decapsulation.
+#[derive(Default, Clone, Copy, PartialEq, Eq, Debug)]
+pub struct Decapsulation
 {
-    let payload = eth_pkt.payload();
+    pub vxlan: bool,
+    pub gre: bool,
+}
+
+impl Decapsulation
+{
+    // The encapsulations detector_decapsulation (conf) configures for any of
+    // interfaces, a comma separated list as in CJ_IFACE. zbalance merges the
+    // interfaces of a cluster, so which one a packet came in on is not known.
+    // Interfaces are named with or without their "zc:" prefix.
+    pub fn for_interfaces(conf: &HashMap<String, Vec<String>>, interfaces: &str)
+                          -> Result<Decapsulation, String>
+    {
+        fn strip_zc(iface: &str) -> &str {
+            let iface = iface.trim();
+            if iface.starts_with("zc:") { &iface[3..] } else { iface }
+        }
 
-    fn parse_v4<'a>(p: &[u8]) -> Option<IpPacket> {
-        match Ipv4Packet::new(p) {
-            Some(pkt) => Some(IpPacket::V4(pkt)),
-            None => None
+        let mut decap = Decapsulation::default();
+        for (iface, names) in conf {
+            let used = interfaces.split(',').any(|i| strip_zc(i) == strip_zc(iface));
+            for name in names {
+                match name.as_str() {
+                    "vxlan" => decap.vxlan |= used,
+                    "gre" => decap.gre |= used,
+                    _ => return Err(format!("unknown encapsulation {:?} for {}", name, iface)),
+                }
+            }
         }
+        Ok(decap)
     }
 
-    fn parse_v6(p: &[u8]) -> Option<IpPacket> {
-        match Ipv6Packet::new(p) {
-            Some(pkt) => Some(IpPacket::V6(pkt)),
-            None => None
+    // The ethertype and bytes of the packet encapsulated in the IP packet p, if
+    // it is an encapsulation looked inside of.
+    fn inner<'p>(&self, ethertype: u16, p: &'p [u8]) -> Option<(u16, &'p [u8])>
+    {
+        if !self.vxlan && !self.gre {
+            return None;
+        }
+        match ip_payload(ethertype, p) {
+            Some((IP_PROTO_UDP, payload)) if self.vxlan => vxlan_payload(payload),
+            Some((IP_PROTO_GRE, payload)) if self.gre => gre_payload(payload),
+            _ => None,
         }
     }
+}
 
-    match eth_pkt.get_ethertype() {
-        EtherTypes::Vlan => {
-            if payload[2] == 0x08 && payload[3] == 0x00 {
-                //let vlan_id: u16 = (payload[0] as u16)*256
-                //                 + (payload[1] as u16);
-                parse_v4(&payload[4..])
-            } else if payload[2] == 0x86 && payload[3] == 0xdd {
-                parse_v6(&payload[4..])
-            } else {
-                None
+fn be16(p: &[u8]) -> u16
+{
+    ((p[0] as u16) << 8) | (p[1] as u16)
+}
+
+// The ethertype and payload of an Ethernet frame, past one VLAN tag.
+fn ethernet_payload(frame: &[u8]) -> Option<(u16, &[u8])>
+{
+    if frame.len() < 14 {
+        return None;
+    }
+    match be16(&frame[12..]) {
+        ETHERTYPE_VLAN if frame.len() < 18 => None,
+        ETHERTYPE_VLAN => Some((be16(&frame[16..]), &frame[18..])),
+        ethertype => Some((ethertype, &frame[14..])),
+    }
+}
+
+// The protocol and payload of an IPv4 or IPv6 packet. Fragments are not
+// reassembled, and IPv6 extension headers are not followed.
+fn ip_payload(ethertype: u16, p: &[u8]) -> Option<(u8, &[u8])>
+{
+    match ethertype {
+        ETHERTYPE_IPV4 => {
+            if p.len() < 20 || p[0] >> 4 != 4 {
+                return None;
             }
+            let header_len = ((p[0] & 0x0f) as usize) * 4;
+            let total_len = be16(&p[2..]) as usize;
+            // More fragments, or a fragment offset.
+            if be16(&p[6..]) & 0x3fff != 0 || header_len < 20 || total_len < header_len ||
+                header_len > p.len() {
+                return None;
+            }
+            Some((p[9], &p[header_len..total_len.min(p.len())]))
+        },
+        ETHERTYPE_IPV6 => {
+            if p.len() < 40 || p[0] >> 4 != 6 {
+                return None;
+            }
+            let end = 40 + be16(&p[4..]) as usize;
+            Some((p[6], &p[40..end.min(p.len())]))
         },
-        EtherTypes::Ipv4 => parse_v4(&payload[0..]),
-        EtherTypes::Ipv6 => parse_v6(&payload[0..]),
+        _ => None,
+    }
+}
+
+// The ethertype and bytes of what a GRE packet (RFC 2784, with the key and
+// sequence number of RFC 2890) carries: IP packets, or the IP packets in the
+// Ethernet frames it bridges.
+fn gre_payload(p: &[u8]) -> Option<(u16, &[u8])>
+{
+    // Version 0 only, without the routing of RFC 1701.
+    if p.len() < 4 || p[1] & 0x07 != 0 || p[0] & 0x40 != 0 {
+        return None;
+    }
+    let mut header_len = 4;
+    for &(flag, len) in &[(0x80, 4), (0x20, 4), (0x10, 4)] {
+        // Checksum, key and sequence number.
+        if p[0] & flag != 0 {
+            header_len += len;
+        }
+    }
+    if p.len() < header_len {
+        return None;
+    }
+    match be16(&p[2..]) {
+        ETHERTYPE_TEB => ethernet_payload(&p[header_len..]),
+        ethertype => Some((ethertype, &p[header_len..])),
+    }
+}
+
+// The ethertype and bytes of the packet in the Ethernet frame a VXLAN packet
+// (RFC 7348) carries, given its UDP datagram.
+fn vxlan_payload(p: &[u8]) -> Option<(u16, &[u8])>
+{
+    // The UDP header, then the VXLAN header, whose I flag is always set.
+    if p.len() < 16 || be16(&p[2..]) != VXLAN_PORT || p[8] & 0x08 == 0 {
+        return None;
+    }
+    ethernet_payload(&p[16..])
+}
+
+// The ethertype and bytes of the IP packet in an Ethernet frame, or of the one
+// it encapsulates if decap looks inside of it. Only one layer is taken off.
+fn frame_ip_packet(frame: &[u8], decap: Decapsulation) -> Option<(u16, &[u8])>
+{
+    let (ethertype, p) = match ethernet_payload(frame) {
+        Some(payload) => payload,
+        None => return None,
+    };
+    match decap.inner(ethertype, p) {
+        Some(inner) => Some(inner),
+        None => Some((ethertype, p)),
+    }
+}
+
+fn get_ip_packet(frame: &[u8], decap: Decapsulation) -> Option<IpPacket>
+{
+    match frame_ip_packet(frame, decap) {
+        Some((ETHERTYPE_IPV4, p)) => Ipv4Packet::new(p).map(IpPacket::V4),
+        Some((ETHERTYPE_IPV6, p)) => Ipv6Packet::new(p).map(IpPacket::V6),
         _ => None,
     }
 }
@@ -91,12 +226,7 @@ pub extern "C" fn rust_process_packet(ptr: *mut PerCoreGlobal,
     global.stats.packets_this_period += 1;
     global.stats.bytes_this_period += rust_view_len as u64;
 
-    let eth_pkt = match EthernetPacket::new(&rust_view[global.gre_offset..]) {
-        Some(pkt) => pkt,
-        None => return,
-    };
-
-    match get_ip_packet(&eth_pkt) {
+    match get_ip_packet(&rust_view[global.gre_offset..], global.decapsulation) {
         Some(IpPacket::V4(pkt)) => global.process_ipv4_packet(pkt, rust_view_len),
         Some(IpPacket::V6(pkt)) => global.process_ipv6_packet(pkt, rust_view_len),
         None => return,
@@ -135,6 +265,8 @@ impl PerCoreGlobal
             return;
         }
         let ip = IpPacket::V4(ip_pkt);
+        self.check_live_phantom(&ip);
+        self.check_phantom_fin(&ip);
 
         {
             // Check TCP/443
@@ -144,10 +276,13 @@ impl PerCoreGlobal
             };
             self.stats.tcp_packets_this_period += 1;
 
-            // Ignore packets that aren't -> 443.
+            // Ignore packets that aren't -> 443, unless they are for a
+            // registered phantom: registrations may derive other phantom
+            // ports, which the station verifies.
             // libpnet getters all return host order. Ignore the "u16be" in their
             // docs; interactions with pnet are purely host order.
-            if tcp_pkt.get_destination() != 443 {
+            if tcp_pkt.get_destination() != 443 &&
+                !self.is_phantom_packet(&FlowNoSrcPort::new(&ip, &tcp_pkt), &tcp_pkt) {
                 return;
             }
         }
@@ -178,6 +313,8 @@ impl PerCoreGlobal
             return;
         }
         let ip = IpPacket::V6(ip_pkt);
+        self.check_live_phantom(&ip);
+        self.check_phantom_fin(&ip);
 
         {
             let tcp_pkt = match ip.tcp() {
@@ -186,7 +323,8 @@ impl PerCoreGlobal
             };
             self.stats.tcp_packets_this_period += 1;
 
-            if tcp_pkt.get_destination() != 443 {
+            if tcp_pkt.get_destination() != 443 &&
+                !self.is_phantom_packet(&FlowNoSrcPort::new(&ip, &tcp_pkt), &tcp_pkt) {
                 return;
             }
         }
@@ -217,7 +355,7 @@ impl PerCoreGlobal
         }
 
         let dd_flow = FlowNoSrcPort::from_flow(&flow);
-        if self.flow_tracker.is_phantom_session(&dd_flow) {
+        if self.is_phantom_packet(&dd_flow, &tcp_pkt) {
 
             // Handle packet destined for registered IP
             match self.filter_station_traffic(flow.src_ip.to_string()) {
@@ -229,6 +367,12 @@ impl PerCoreGlobal
                     if  (tcp_flags & TcpFlags::SYN) != 0  && (tcp_flags & TcpFlags::ACK) == 0 {
                         debug!("Connection for registered Phantom {}", flow);
                     }
+
+                    // Checked first so that dropped injections do not keep
+                    // the session alive.
+                    if !self.check_forwarded_seq(&flow, &tcp_pkt) {
+                        return;
+                    }
                 
                     // Update expire time if necessary
                     self.flow_tracker.update_phantom_flow(&dd_flow);
@@ -241,6 +385,18 @@ impl PerCoreGlobal
             }
         }
 
+        // Registrations are only looked for on 443.
+        if tcp_pkt.get_destination() != 443 {
+            return;
+        }
+
+        // Only registration detection is sampled, connections to registered
+        // phantoms above are always forwarded.
+        if !self.sampler.keep(&flow) {
+            self.stats.unsampled_packets_this_period += 1;
+            return;
+        }
+
         if (tcp_flags & TcpFlags::SYN) != 0 && (tcp_flags & TcpFlags::ACK) == 0
         {
             self.stats.port_443_syns_this_period += 1;
@@ -272,6 +428,114 @@ impl PerCoreGlobal
         }
     }
 
+    // Checks a client's packet to a registered phantom against the sequence
+    // window of its flow, counting it as a suspected injection if it falls
+    // outside, see detector_seq_check. Returns whether it is forwarded, which
+    // suspected injections only are not when enforcing.
+    fn check_forwarded_seq(&mut self, flow: &Flow, tcp_pkt: &TcpPacket) -> bool
+    {
+        let mode = self.flow_tracker.forwarded_seqs.mode();
+        if mode == SeqCheckMode::Off {
+            return true;
+        }
+        let flags = tcp_pkt.get_flags();
+        let mut len = tcp_pkt.payload().len() as u32;
+        if (flags & TcpFlags::SYN) != 0 {
+            len += 1;
+        }
+        if (flags & TcpFlags::FIN) != 0 {
+            len += 1;
+        }
+        let seg = SeqSegment {
+            seq: tcp_pkt.get_sequence(),
+            len: len,
+            ack: if (flags & TcpFlags::ACK) != 0 { Some(tcp_pkt.get_acknowledgement()) } else { None },
+            sack: get_tcp_sack_blocks(tcp_pkt),
+            syn: (flags & TcpFlags::SYN) != 0,
+            fin: (flags & TcpFlags::FIN) != 0,
+            rst: (flags & TcpFlags::RST) != 0,
+        };
+        if self.flow_tracker.forwarded_seqs.check(flow, &seg, precise_time_ns()) {
+            return true;
+        }
+
+        self.stats.seq_suspect_packets_this_period += 1;
+        debug!("Suspected injection into {}: seq {} ack {:?} outside the flow's window", flow, seg.seq, seg.ack);
+        if mode == SeqCheckMode::Enforce {
+            self.stats.seq_dropped_packets_this_period += 1;
+            return false;
+        }
+        true
+    }
+
+    // Whether tcp_pkt, of flow, is for a registered phantom. Only a client's
+    // SYN may ask the station about a session not tracked here (see
+    // detector_registration_query_addr): a session it has is then tracked for
+    // the rest of the connection, and every other packet is matched locally.
+    fn is_phantom_packet(&self, flow: &FlowNoSrcPort, tcp_pkt: &TcpPacket) -> bool
+    {
+        let tcp_flags = tcp_pkt.get_flags();
+        if (tcp_flags & TcpFlags::SYN) != 0 && (tcp_flags & TcpFlags::ACK) == 0 {
+            self.flow_tracker.query_phantom_session(flow)
+        } else {
+            self.flow_tracker.is_phantom_session(flow)
+        }
+    }
+
+    // A registered phantom never originates connections, the station only
+    // answers connections to it. A SYN from a phantom address means a real
+    // host is using it, so it is reported to the station as live (at most once
+    // per LIVE_PHANTOM_REPORT_INTERVAL_NS per address).
+    fn check_live_phantom(&mut self, ip_pkt: &IpPacket)
+    {
+        let tcp_pkt = match ip_pkt.tcp() {
+            Some(pkt) => pkt,
+            None => return,
+        };
+        let tcp_flags = tcp_pkt.get_flags();
+        if (tcp_flags & TcpFlags::SYN) == 0 || (tcp_flags & TcpFlags::ACK) != 0 {
+            return;
+        }
+
+        // Sessions are keyed on their client, which the phantom's SYN need
+        // not go to: only its source address is looked up.
+        let flow = Flow::new(ip_pkt, &tcp_pkt);
+        if !self.flow_tracker.is_registered_phantom(&flow.src_ip) {
+            return;
+        }
+        if !self.live_phantoms.should_report(flow.src_ip, precise_time_ns()) {
+            return;
+        }
+
+        debug!("Phantom {} originated a connection, reporting it live", flow.src_ip);
+        let addr = encode_live_phantom(flow.src_ip);
+        let res = self.zmq_sock.send(LIVE_PHANTOM_TOPIC, zmq::SNDMORE)
+            .and_then(|_| self.zmq_sock.send(&addr[..], 0));
+        if let Err(e) = res {
+            warn!("Failed to send live phantom report over ZMQ: {}", e);
+        }
+    }
+
+    // A FIN from a phantom, if the tap carries the station's side of a
+    // forwarded flow, ends the flow's sequence window once the client's FIN
+    // has been seen too, see SeqTracker::peer_fin.
+    fn check_phantom_fin(&mut self, ip_pkt: &IpPacket)
+    {
+        if self.flow_tracker.forwarded_seqs.mode() == SeqCheckMode::Off {
+            return;
+        }
+        let tcp_pkt = match ip_pkt.tcp() {
+            Some(pkt) => pkt,
+            None => return,
+        };
+        if (tcp_pkt.get_flags() & TcpFlags::FIN) == 0 {
+            return;
+        }
+        let flow = Flow::new(ip_pkt, &tcp_pkt);
+        let client_flow = Flow::from_parts(flow.dst_ip, flow.src_ip, flow.dst_port, flow.src_port);
+        self.flow_tracker.forwarded_seqs.peer_fin(&client_flow);
+    }
+
     fn forward_pkt(&mut self, ip_pkt: &IpPacket)
     {
         let data = match ip_pkt {
@@ -403,7 +667,207 @@ mod tests {
     use std::env;
     use std::fs;
     use toml;
+    use std::collections::HashMap;
     use StationConfig;
+    use process_packet::{frame_ip_packet, Decapsulation, ETHERTYPE_IPV4, ETHERTYPE_IPV6,
+                         ETHERTYPE_TEB, ETHERTYPE_VLAN, IP_PROTO_GRE, IP_PROTO_UDP,
+                         VXLAN_PORT};
+
+    const CLIENT: [u8; 4] = [192, 0, 2, 1];
+    const PHANTOM: [u8; 4] = [198, 51, 100, 1];
+    const TUNNEL_SRC: [u8; 4] = [10, 0, 0, 1];
+    const TUNNEL_DST: [u8; 4] = [10, 0, 0, 2];
+
+    fn ethernet(ethertype: u16, payload: &[u8]) -> Vec<u8>
+    {
+        let mut frame = vec![0; 12];
+        frame.extend_from_slice(&[(ethertype >> 8) as u8, ethertype as u8]);
+        frame.extend_from_slice(payload);
+        frame
+    }
+
+    fn ipv4(proto: u8, src: [u8; 4], dst: [u8; 4], payload: &[u8]) -> Vec<u8>
+    {
+        let len = 20 + payload.len();
+        let mut pkt = vec![0x45, 0, (len >> 8) as u8, len as u8, 0, 0, 0, 0, 64, proto, 0, 0];
+        pkt.extend_from_slice(&src);
+        pkt.extend_from_slice(&dst);
+        pkt.extend_from_slice(payload);
+        pkt
+    }
+
+    fn ipv6(next_header: u8, dst: [u8; 16], payload: &[u8]) -> Vec<u8>
+    {
+        let len = payload.len();
+        let mut pkt = vec![0x60, 0, 0, 0, (len >> 8) as u8, len as u8, next_header, 64];
+        pkt.extend_from_slice(&[0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2]);
+        pkt.extend_from_slice(&dst);
+        pkt.extend_from_slice(payload);
+        pkt
+    }
+
+    fn udp(dst_port: u16, payload: &[u8]) -> Vec<u8>
+    {
+        let len = 8 + payload.len();
+        let mut dgram = vec![0xc0, 0x00, (dst_port >> 8) as u8, dst_port as u8,
+                             (len >> 8) as u8, len as u8, 0, 0];
+        dgram.extend_from_slice(payload);
+        dgram
+    }
+
+    // A client SYN to port 443.
+    fn tcp_syn() -> Vec<u8>
+    {
+        vec![0x9c, 0x40, 0x01, 0xbb, 0, 0, 0, 1, 0, 0, 0, 0, 0x50, 0x02, 0xff, 0xff, 0, 0, 0, 0]
+    }
+
+    fn vxlan(inner_frame: &[u8]) -> Vec<u8>
+    {
+        let mut pkt = vec![0x08, 0, 0, 0, 0, 0, 0x2a, 0];
+        pkt.extend_from_slice(inner_frame);
+        pkt
+    }
+
+    fn gre(flags: u8, ethertype: u16, payload: &[u8]) -> Vec<u8>
+    {
+        let mut pkt = vec![flags, 0, (ethertype >> 8) as u8, ethertype as u8];
+        for &flag in &[0x80, 0x20, 0x10] {
+            if flags & flag != 0 {
+                pkt.extend_from_slice(&[0, 0, 0, flag]);
+            }
+        }
+        pkt.extend_from_slice(payload);
+        pkt
+    }
+
+    fn vxlan_frame() -> Vec<u8>
+    {
+        let inner = ethernet(ETHERTYPE_IPV4, &ipv4(6, CLIENT, PHANTOM, &tcp_syn()));
+        ethernet(ETHERTYPE_IPV4,
+                 &ipv4(IP_PROTO_UDP, TUNNEL_SRC, TUNNEL_DST, &udp(VXLAN_PORT, &vxlan(&inner))))
+    }
+
+    // The ethertype, protocol and destination of the IP packet the detector
+    // inspects in frame.
+    fn inspected(frame: &[u8], decap: Decapsulation) -> (u16, u8, Vec<u8>)
+    {
+        let (ethertype, p) = frame_ip_packet(frame, decap).unwrap();
+        match ethertype {
+            ETHERTYPE_IPV4 => (ethertype, p[9], p[16..20].to_vec()),
+            ETHERTYPE_IPV6 => (ethertype, p[6], p[24..40].to_vec()),
+            _ => panic!("not IP: {:x}", ethertype),
+        }
+    }
+
+    #[test]
+    fn test_vxlan_inner_destination()
+    {
+        let vxlan_only = Decapsulation { vxlan: true, gre: false };
+        assert_eq!(inspected(&vxlan_frame(), vxlan_only),
+                   (ETHERTYPE_IPV4, 6, PHANTOM.to_vec()));
+
+        // The tunnel itself, when VXLAN is not looked inside of.
+        let tunnel = (ETHERTYPE_IPV4, IP_PROTO_UDP, TUNNEL_DST.to_vec());
+        assert_eq!(inspected(&vxlan_frame(), Decapsulation::default()), tunnel);
+        assert_eq!(inspected(&vxlan_frame(), Decapsulation { vxlan: false, gre: true }), tunnel);
+    }
+
+    #[test]
+    fn test_vxlan_not_decapsulated()
+    {
+        let decap = Decapsulation { vxlan: true, gre: true };
+        let inner = ethernet(ETHERTYPE_IPV4, &ipv4(6, CLIENT, PHANTOM, &tcp_syn()));
+        let tunnel = (ETHERTYPE_IPV4, IP_PROTO_UDP, TUNNEL_DST.to_vec());
+
+        // Another port.
+        let frame = ethernet(ETHERTYPE_IPV4,
+                             &ipv4(IP_PROTO_UDP, TUNNEL_SRC, TUNNEL_DST, &udp(53, &vxlan(&inner))));
+        assert_eq!(inspected(&frame, decap), tunnel);
+
+        // No I flag.
+        let mut no_vni = vxlan(&inner);
+        no_vni[0] = 0;
+        let frame = ethernet(ETHERTYPE_IPV4,
+                             &ipv4(IP_PROTO_UDP, TUNNEL_SRC, TUNNEL_DST, &udp(VXLAN_PORT, &no_vni)));
+        assert_eq!(inspected(&frame, decap), tunnel);
+
+        // A fragment, of which only the first has the headers.
+        let mut frame = vxlan_frame();
+        frame[14 + 6] = 0x20;
+        assert_eq!(inspected(&frame, decap), tunnel);
+
+        // Too short for the inner Ethernet header.
+        let frame = ethernet(ETHERTYPE_IPV4,
+                             &ipv4(IP_PROTO_UDP, TUNNEL_SRC, TUNNEL_DST,
+                                   &udp(VXLAN_PORT, &vxlan(&inner[..10]))));
+        assert_eq!(frame_ip_packet(&frame, decap), Some((ETHERTYPE_IPV4, &frame[14..])));
+    }
+
+    #[test]
+    fn test_vxlan_ipv6_tunnel_vlan_tagged()
+    {
+        let mut tagged = vec![0; 12];
+        tagged.extend_from_slice(&[(ETHERTYPE_VLAN >> 8) as u8, ETHERTYPE_VLAN as u8, 0, 7]);
+        tagged.extend_from_slice(&ethernet(ETHERTYPE_IPV4, &ipv4(6, CLIENT, PHANTOM, &tcp_syn()))[12..]);
+        let tunnel = ipv6(IP_PROTO_UDP, [0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3],
+                          &udp(VXLAN_PORT, &vxlan(&tagged)));
+        let frame = ethernet(ETHERTYPE_IPV6, &tunnel);
+
+        assert_eq!(inspected(&frame, Decapsulation { vxlan: true, gre: false }),
+                   (ETHERTYPE_IPV4, 6, PHANTOM.to_vec()));
+    }
+
+    #[test]
+    fn test_gre_inner_destination()
+    {
+        let gre_only = Decapsulation { vxlan: false, gre: true };
+        let phantom6 = [0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1];
+
+        // IPv6 with a key and sequence number.
+        let inner = ipv6(6, phantom6, &tcp_syn());
+        let frame = ethernet(ETHERTYPE_IPV4,
+                             &ipv4(IP_PROTO_GRE, TUNNEL_SRC, TUNNEL_DST,
+                                   &gre(0x30, ETHERTYPE_IPV6, &inner)));
+        assert_eq!(inspected(&frame, gre_only), (ETHERTYPE_IPV6, 6, phantom6.to_vec()));
+        assert_eq!(inspected(&frame, Decapsulation { vxlan: true, gre: false }),
+                   (ETHERTYPE_IPV4, IP_PROTO_GRE, TUNNEL_DST.to_vec()));
+
+        // Bridged Ethernet frames, with a checksum.
+        let inner = ethernet(ETHERTYPE_IPV4, &ipv4(6, CLIENT, PHANTOM, &tcp_syn()));
+        let frame = ethernet(ETHERTYPE_IPV4,
+                             &ipv4(IP_PROTO_GRE, TUNNEL_SRC, TUNNEL_DST,
+                                   &gre(0x80, ETHERTYPE_TEB, &inner)));
+        assert_eq!(inspected(&frame, gre_only), (ETHERTYPE_IPV4, 6, PHANTOM.to_vec()));
+
+        // Version 1 (PPTP) is not looked inside of.
+        let mut pptp = gre(0x20, ETHERTYPE_IPV4, &ipv4(6, CLIENT, PHANTOM, &tcp_syn()));
+        pptp[1] = 1;
+        let frame = ethernet(ETHERTYPE_IPV4, &ipv4(IP_PROTO_GRE, TUNNEL_SRC, TUNNEL_DST, &pptp));
+        assert_eq!(inspected(&frame, gre_only),
+                   (ETHERTYPE_IPV4, IP_PROTO_GRE, TUNNEL_DST.to_vec()));
+    }
+
+    #[test]
+    fn test_decapsulation_for_interfaces()
+    {
+        let mut conf = HashMap::new();
+        conf.insert("enp179s0f0".to_string(), vec!["vxlan".to_string()]);
+        conf.insert("zc:enp179s0f1".to_string(), vec!["gre".to_string()]);
+
+        assert_eq!(Decapsulation::for_interfaces(&conf, "zc:enp179s0f0").unwrap(),
+                   Decapsulation { vxlan: true, gre: false });
+        assert_eq!(Decapsulation::for_interfaces(&conf, "enp179s0f1").unwrap(),
+                   Decapsulation { vxlan: false, gre: true });
+        assert_eq!(Decapsulation::for_interfaces(&conf, "zc:enp179s0f0,zc:enp179s0f1").unwrap(),
+                   Decapsulation { vxlan: true, gre: true });
+        assert_eq!(Decapsulation::for_interfaces(&conf, "eth0").unwrap(),
+                   Decapsulation::default());
+        assert_eq!(Decapsulation::for_interfaces(&conf, "").unwrap(),
+                   Decapsulation::default());
+
+        conf.insert("eth0".to_string(), vec!["geneve".to_string()]);
+        assert!(Decapsulation::for_interfaces(&conf, "zc:enp179s0f0").is_err());
+    }
 
 
     #[test]
@@ -0,0 +1,289 @@
+//
+// Remote registration queries
+//
+// In a split deployment the detector may not hear of every registration over
+// redis. With detector_registration_query_addr set it asks the station's
+// management endpoint about connections to phantoms it does not track:
+//
+//      GET /registrations/lookup?phantom=<ip>&client=<ip>
+//
+// answers 200 with the remaining lifetime of the registration in nanoseconds
+// as its body, and 404 if there is none. Queries are plain HTTP/1.0, one per
+// connection, bounded by a short timeout as they hold up the packet they are
+// made for. Only connections to the phantom subnets the detector is given,
+// detector_registration_query_subnets, are queried: every other SYN on the tap
+// would be a query otherwise.
+//
+// A query that fails for any reason counts as not registered (fail closed)
+// and is counted. Not registered answers and failures are cached for the
+// flow's session key so that it is not queried again for a while, which
+// bounds the query rate of a client retrying, or of a station that is down.
+
+use std::collections::HashMap;
+use std::io::{Read, Write};
+use std::net::{IpAddr, SocketAddr, TcpStream, ToSocketAddrs};
+use std::str::FromStr;
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Duration;
+
+use ipnetwork::IpNetwork;
+
+// Used when detector_registration_query_timeout is zero, in milliseconds.
+pub const DEFAULT_QUERY_TIMEOUT_MS: u64 = 50;
+
+// Used when detector_registration_negative_cache is zero, in milliseconds.
+pub const DEFAULT_NEGATIVE_CACHE_MS: u64 = 1000;
+
+// Most session keys cached as not registered at once. Once it is full, keys
+// not in the cache are taken as not registered without a query until entries
+// expire.
+const MAX_NEGATIVE_CACHE: usize = 1 << 16;
+
+// Longest response read, a lookup answer is a status line and a number.
+const MAX_RESPONSE: u64 = 1024;
+
+pub struct RegistrationQuery
+{
+    addr: SocketAddr,
+    subnets: Vec<IpNetwork>,
+    timeout: Duration,
+    negative_ttl_ns: u64,
+
+    // Session keys found not registered, with when to query them again.
+    negative: Mutex<HashMap<String, u64>>,
+
+    // Queries that failed since the last take_errors.
+    errors: AtomicUsize,
+}
+
+impl RegistrationQuery
+{
+    pub fn new(addr: &str, subnets: &[String], timeout_ms: u64, negative_cache_ms: u64) -> Result<RegistrationQuery, String>
+    {
+        let addr = match addr.to_socket_addrs().ok().and_then(|mut addrs| addrs.next()) {
+            Some(a) => a,
+            None => return Err(format!("bad registration query address {:?}", addr)),
+        };
+        if subnets.is_empty() {
+            return Err("registration queries need the phantom subnets to query for".to_string());
+        }
+        let mut nets = Vec::with_capacity(subnets.len());
+        for s in subnets {
+            match IpNetwork::from_str(s) {
+                Ok(net) => nets.push(net),
+                Err(_) => return Err(format!("bad registration query subnet {:?}", s)),
+            }
+        }
+        let timeout_ms = if timeout_ms == 0 { DEFAULT_QUERY_TIMEOUT_MS } else { timeout_ms };
+        let negative_cache_ms = if negative_cache_ms == 0 { DEFAULT_NEGATIVE_CACHE_MS } else { negative_cache_ms };
+        Ok(RegistrationQuery {
+            addr: addr,
+            subnets: nets,
+            timeout: Duration::from_millis(timeout_ms),
+            negative_ttl_ns: negative_cache_ms * 1000 * 1000,
+            negative: Mutex::new(HashMap::new()),
+            errors: AtomicUsize::new(0),
+        })
+    }
+
+    // Returns how much longer, in nanoseconds, the session key of a connection
+    // from client to phantom is registered, None if it is not, if the query
+    // failed, if key was found not registered less than the negative cache
+    // time before now, or if phantom is in none of the phantom subnets.
+    pub fn query(&self, key: &str, client: IpAddr, phantom: IpAddr, now: u64) -> Option<u64>
+    {
+        if !self.subnets.iter().any(|net| net.contains(phantom)) {
+            return None;
+        }
+        {
+            let mut negative = self.negative.lock().expect("Mutex broken");
+            match negative.get(key) {
+                Some(&until) if until > now => return None,
+                Some(_) => { negative.remove(key); },
+                None => {},
+            }
+            if negative.len() >= MAX_NEGATIVE_CACHE {
+                return None;
+            }
+        }
+
+        let ttl = match self.request(client, phantom) {
+            Ok(ttl) => ttl,
+            Err(e) => {
+                self.errors.fetch_add(1, Ordering::Relaxed);
+                debug!("Registration query for {} failed: {}", phantom, e);
+                None
+            }
+        };
+        if ttl.is_none() {
+            let mut negative = self.negative.lock().expect("Mutex broken");
+            negative.insert(key.to_string(), now + self.negative_ttl_ns);
+        }
+        ttl
+    }
+
+    // Forgets the negative answers that expired by now.
+    pub fn drop_stale(&self, now: u64)
+    {
+        let mut negative = self.negative.lock().expect("Mutex broken");
+        negative.retain(|_, until| *until > now);
+    }
+
+    // Returns the number of queries that failed since the last call.
+    pub fn take_errors(&self) -> usize
+    {
+        self.errors.swap(0, Ordering::Relaxed)
+    }
+
+    fn request(&self, client: IpAddr, phantom: IpAddr) -> Result<Option<u64>, String>
+    {
+        let mut conn = TcpStream::connect_timeout(&self.addr, self.timeout)
+            .map_err(|e| format!("connect: {}", e))?;
+        conn.set_read_timeout(Some(self.timeout)).map_err(|e| e.to_string())?;
+        conn.set_write_timeout(Some(self.timeout)).map_err(|e| e.to_string())?;
+
+        let req = format!("GET /registrations/lookup?phantom={}&client={} HTTP/1.0\r\nHost: {}\r\n\r\n",
+                          phantom, client, self.addr);
+        conn.write_all(req.as_bytes()).map_err(|e| format!("write: {}", e))?;
+
+        let mut resp = Vec::new();
+        conn.take(MAX_RESPONSE).read_to_end(&mut resp).map_err(|e| format!("read: {}", e))?;
+        parse_response(&resp)
+    }
+}
+
+// Parses the answer to a lookup: the lifetime left of a 200, None for a 404.
+fn parse_response(resp: &[u8]) -> Result<Option<u64>, String>
+{
+    let text = match ::std::str::from_utf8(resp) {
+        Ok(t) => t,
+        Err(_) => return Err("response is not text".to_string()),
+    };
+    let (head, body) = match text.find("\r\n\r\n") {
+        Some(i) => (&text[..i], &text[i+4..]),
+        None => return Err("truncated response".to_string()),
+    };
+    let status = head.lines().next().unwrap_or("").split_whitespace().nth(1).unwrap_or("");
+    match status {
+        "200" => match body.trim().parse::<u64>() {
+            Ok(ttl) if ttl > 0 => Ok(Some(ttl)),
+            _ => Err(format!("bad lifetime {:?}", body.trim())),
+        },
+        "404" => Ok(None),
+        _ => Err(format!("unexpected status {:?}", status)),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use registration_query::*;
+    use std::io::{BufRead, BufReader, Write};
+    use std::net::{IpAddr, TcpListener};
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::thread;
+    use std::time::Duration;
+
+    // Serves lookups like the station would, from a fixed list of
+    // registered phantoms, answering queries for "192.0.2.99" with a 500
+    // and never answering those for "192.0.2.98". Returns its address and
+    // the number of queries it received.
+    fn stub_station() -> (String, Arc<AtomicUsize>)
+    {
+        let ln = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = ln.local_addr().unwrap().to_string();
+        let queries = Arc::new(AtomicUsize::new(0));
+        let counter = Arc::clone(&queries);
+        thread::spawn(move || {
+            for conn in ln.incoming() {
+                let mut conn = match conn { Ok(c) => c, Err(_) => return };
+                counter.fetch_add(1, Ordering::SeqCst);
+                // Read the whole request, the first line is the query.
+                let mut reader = BufReader::new(&conn);
+                let mut line = String::new();
+                reader.read_line(&mut line).unwrap();
+                let mut header = String::new();
+                while reader.read_line(&mut header).unwrap_or(0) > 2 {
+                    header.clear();
+                }
+                let resp = if line.contains("phantom=192.0.2.1&client=198.51.100.7 ") ||
+                              line.contains("phantom=2001:db8::1&") {
+                    "HTTP/1.0 200 OK\r\n\r\n5000000000"
+                } else if line.contains("phantom=192.0.2.99&") {
+                    "HTTP/1.0 500 Internal Server Error\r\n\r\n"
+                } else if line.contains("phantom=192.0.2.98&") {
+                    thread::sleep(Duration::from_millis(500));
+                    ""
+                } else {
+                    "HTTP/1.0 404 Not Found\r\n\r\nnot registered\n"
+                };
+                let _ = conn.write_all(resp.as_bytes());
+            }
+        });
+        (addr, queries)
+    }
+
+    fn subnets() -> Vec<String>
+    {
+        vec!["192.0.2.0/24".to_string(), "2001:db8::/32".to_string()]
+    }
+
+    #[test]
+    fn test_registration_query() {
+        let (addr, queries) = stub_station();
+        let q = RegistrationQuery::new(&addr, &subnets(), 100, 1000).unwrap();
+        let client: IpAddr = "198.51.100.7".parse().unwrap();
+
+        assert_eq!(q.query("198.51.100.7-192.0.2.1", client, "192.0.2.1".parse().unwrap(), 0), Some(5000000000));
+        assert_eq!(q.query("2001:db8::1", "2001:db8::7".parse().unwrap(), "2001:db8::1".parse().unwrap(), 0), Some(5000000000));
+        assert_eq!(q.query("198.51.100.7-192.0.2.2", client, "192.0.2.2".parse().unwrap(), 0), None);
+        assert_eq!(queries.load(Ordering::SeqCst), 3);
+        assert_eq!(q.take_errors(), 0);
+
+        // Phantoms outside the subnets are not queried.
+        assert_eq!(q.query("198.51.100.7-203.0.113.1", client, "203.0.113.1".parse().unwrap(), 0), None);
+        assert_eq!(queries.load(Ordering::SeqCst), 3);
+
+        // Not registered is cached: the same key is not queried again until
+        // the negative cache time has passed.
+        assert_eq!(q.query("198.51.100.7-192.0.2.2", client, "192.0.2.2".parse().unwrap(), 999 * 1000 * 1000), None);
+        assert_eq!(queries.load(Ordering::SeqCst), 3);
+        assert_eq!(q.query("198.51.100.7-192.0.2.2", client, "192.0.2.2".parse().unwrap(), 1000 * 1000 * 1000), None);
+        assert_eq!(queries.load(Ordering::SeqCst), 4);
+
+        // Errors and timeouts fail closed, are counted and cached too.
+        assert_eq!(q.query("198.51.100.7-192.0.2.99", client, "192.0.2.99".parse().unwrap(), 0), None);
+        assert_eq!(q.query("198.51.100.7-192.0.2.98", client, "192.0.2.98".parse().unwrap(), 0), None);
+        assert_eq!(q.take_errors(), 2);
+        assert_eq!(q.take_errors(), 0);
+        assert_eq!(q.query("198.51.100.7-192.0.2.99", client, "192.0.2.99".parse().unwrap(), 0), None);
+        assert_eq!(queries.load(Ordering::SeqCst), 6);
+
+        q.drop_stale(u64::max_value());
+        assert_eq!(q.negative.lock().unwrap().len(), 0);
+    }
+
+    #[test]
+    fn test_registration_query_unreachable() {
+        // Nothing listens on the port once the listener is dropped.
+        let addr = TcpListener::bind("127.0.0.1:0").unwrap().local_addr().unwrap().to_string();
+        let q = RegistrationQuery::new(&addr, &subnets(), 100, 1000).unwrap();
+        assert_eq!(q.query("2001:db8::1", "2001:db8::7".parse().unwrap(), "2001:db8::1".parse().unwrap(), 0), None);
+        assert_eq!(q.take_errors(), 1);
+
+        assert!(RegistrationQuery::new("not an address", &subnets(), 0, 0).is_err());
+        assert!(RegistrationQuery::new(&addr, &[], 0, 0).is_err());
+        assert!(RegistrationQuery::new(&addr, &["192.0.2.0/33".to_string()], 0, 0).is_err());
+    }
+
+    #[test]
+    fn test_parse_response() {
+        assert_eq!(parse_response(b"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n42"), Ok(Some(42)));
+        assert_eq!(parse_response(b"HTTP/1.1 404 Not Found\r\n\r\nnot registered\n"), Ok(None));
+        assert!(parse_response(b"HTTP/1.1 200 OK\r\n\r\n0").is_err());
+        assert!(parse_response(b"HTTP/1.1 200 OK\r\n\r\nsoon").is_err());
+        assert!(parse_response(b"HTTP/1.1 200 OK\r\n").is_err());
+        assert!(parse_response(b"HTTP/1.1 403 Forbidden\r\n\r\n").is_err());
+    }
+}
@@ -0,0 +1,102 @@
+use std::net::IpAddr;
+
+use flow_tracker::Flow;
+
+// Samples 1 in every N flows by a hash of the flow, so that every packet of a
+// sampled flow, in either direction, is kept and every packet of any other
+// flow is dropped. The hash is fixed (not keyed per process) so that all cores
+// agree on which flows are sampled, whichever core fanout hands a packet to.
+pub struct FlowSampler
+{
+    one_in: u64,
+}
+
+impl FlowSampler
+{
+    // A one_in of 0 or 1 keeps every flow.
+    pub fn new(one_in: u64) -> FlowSampler
+    {
+        FlowSampler { one_in: if one_in == 0 { 1 } else { one_in } }
+    }
+
+    pub fn one_in(&self) -> u64
+    {
+        self.one_in
+    }
+
+    pub fn keep(&self, flow: &Flow) -> bool
+    {
+        self.one_in == 1 || flow_hash(flow) % self.one_in == 0
+    }
+}
+
+// flow_hash is FNV-1a over the flow's two endpoints in a canonical order, so
+// both directions of a flow hash the same.
+fn flow_hash(flow: &Flow) -> u64
+{
+    let a = endpoint_bytes(flow.src_ip, flow.src_port);
+    let b = endpoint_bytes(flow.dst_ip, flow.dst_port);
+    let (lo, hi) = if a <= b { (a, b) } else { (b, a) };
+
+    let mut h: u64 = 0xcbf29ce484222325;
+    for byte in lo.iter().chain(hi.iter()) {
+        h ^= *byte as u64;
+        h = h.wrapping_mul(0x100000001b3);
+    }
+    h
+}
+
+fn endpoint_bytes(ip: IpAddr, port: u16) -> [u8; 18]
+{
+    let mut b = [0u8; 18];
+    match ip {
+        IpAddr::V4(a) => b[..16].copy_from_slice(&a.to_ipv6_mapped().octets()),
+        IpAddr::V6(a) => b[..16].copy_from_slice(&a.octets()),
+    }
+    b[16] = (port >> 8) as u8;
+    b[17] = port as u8;
+    b
+}
+
+#[cfg(test)]
+mod tests {
+use std::net::IpAddr;
+use flow_tracker::Flow;
+use sampling::FlowSampler;
+
+fn flow(client_port: u16) -> Flow
+{
+    let client: IpAddr = "192.0.2.1".parse().unwrap();
+    let server: IpAddr = "198.51.100.1".parse().unwrap();
+    Flow::from_parts(client, server, client_port, 443)
+}
+
+#[test]
+fn sampling_keeps_both_directions_of_a_flow()
+{
+    let s = FlowSampler::new(4);
+    for port in 1000..1100 {
+        let f = flow(port);
+        let rev = Flow::from_parts(f.dst_ip, f.src_ip, f.dst_port, f.src_port);
+        assert_eq!(s.keep(&f), s.keep(&rev));
+    }
+}
+
+#[test]
+fn sampling_keeps_about_one_in_n()
+{
+    let s = FlowSampler::new(8);
+    let kept = (0..8000).filter(|p| s.keep(&flow(10000 + *p as u16))).count();
+    assert!(kept > 700 && kept < 1300, "kept {} of 8000", kept);
+}
+
+#[test]
+fn sampling_disabled_keeps_everything()
+{
+    for n in 0..2 {
+        let s = FlowSampler::new(n);
+        assert_eq!(s.one_in(), 1);
+        assert!((1000..1100).all(|p| s.keep(&flow(p))));
+    }
+}
+}
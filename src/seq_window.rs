@@ -0,0 +1,434 @@
+use std::collections::HashMap;
+
+use flow_tracker::Flow;
+
+// Default plausible window, in bytes of sequence space either side of what a
+// forwarded flow has sent, see detector_seq_window.
+pub const DEFAULT_SEQ_WINDOW: u32 = 16 * 1024 * 1024;
+
+// Sequence windows of flows idle for this long are forgotten. A flow seen
+// again afterwards starts over from its next packet, unchecked.
+pub const SEQ_WINDOW_IDLE_NS: u64 = 5 * 60 * 1000 * 1000 * 1000;
+
+// Windows of flows the client has finished are forgotten after this long
+// idle, if the phantom's FIN is not seen first: the tap need not carry the
+// station's side of the connection.
+pub const SEQ_WINDOW_CLOSING_IDLE_NS: u64 = 30 * 1000 * 1000 * 1000;
+
+// drop_idle only looks for idle windows this often, it is called on every
+// flow cleanup and the whole map is scanned.
+pub const SEQ_WINDOW_SWEEP_NS: u64 = 10 * 1000 * 1000 * 1000;
+
+// Most flows whose windows are tracked at once. Flows first seen while it is
+// full are forwarded unchecked.
+pub const MAX_SEQ_WINDOWS: usize = 1 << 18;
+
+// What is done with forwarded packets outside their flow's sequence window,
+// see detector_seq_check.
+#[derive(PartialEq, Eq, Copy, Clone, Debug)]
+pub enum SeqCheckMode
+{
+    // Sequence numbers are not tracked.
+    Off,
+    // Suspected injections are counted, and forwarded anyway.
+    Count,
+    // Suspected injections are counted and dropped.
+    Enforce,
+}
+
+impl SeqCheckMode
+{
+    // The empty string is the default, count.
+    pub fn parse(s: &str) -> Option<SeqCheckMode>
+    {
+        match s {
+            "off" => Some(SeqCheckMode::Off),
+            "" | "count" => Some(SeqCheckMode::Count),
+            "enforce" => Some(SeqCheckMode::Enforce),
+            _ => None,
+        }
+    }
+}
+
+// The parts of a TCP segment from the client that the window is checked
+// against, all in host order.
+pub struct SeqSegment
+{
+    pub seq: u32,
+    // Sequence space taken: the payload length, plus one each for SYN and FIN.
+    pub len: u32,
+    // The acknowledgement number, if the ACK flag is set.
+    pub ack: Option<u32>,
+    // The edges of SACK blocks, which like the ACK are in the sequence space
+    // of the other side.
+    pub sack: Vec<(u32, u32)>,
+    pub syn: bool,
+    pub fin: bool,
+    pub rst: bool,
+}
+
+// seq_diff is a - b in TCP sequence space, taking the shorter way around the
+// wrap (RFC 1982 serial number arithmetic).
+fn seq_diff(a: u32, b: u32) -> i64
+{
+    a.wrapping_sub(b) as i32 as i64
+}
+
+// SeqWindow is what one direction of a forwarded flow has been seen to send:
+// the end of the highest segment and the highest acknowledgement. The detector
+// only sees the client's side, so the window is this bound either way rather
+// than the receive window the station advertises.
+struct SeqWindow
+{
+    next: u32,
+    ack: Option<u32>,
+    last_seen: u64,
+    // Whether the client and the phantom have sent their FIN.
+    fin: bool,
+    peer_fin: bool,
+}
+
+impl SeqWindow
+{
+    fn new(seg: &SeqSegment, now: u64) -> SeqWindow
+    {
+        SeqWindow {
+            next: seg.seq.wrapping_add(seg.len),
+            ack: seg.ack,
+            last_seen: now,
+            fin: seg.fin,
+            peer_fin: false,
+        }
+    }
+
+    // plausible reports whether seg falls within window of what the flow has
+    // sent: its data (retransmissions behind, reordered or unseen segments
+    // ahead), its acknowledgement and every SACK edge, D-SACK blocks behind
+    // the acknowledgement included.
+    fn plausible(&self, seg: &SeqSegment, window: u32) -> bool
+    {
+        let w = window as i64;
+        let within = |a: u32, b: u32| seq_diff(a, b).abs() <= w;
+
+        if !within(seg.seq, self.next) || !within(seg.seq.wrapping_add(seg.len), self.next) {
+            return false;
+        }
+        let ack = match (seg.ack, self.ack) {
+            (Some(ack), Some(highest)) => {
+                if !within(ack, highest) {
+                    return false;
+                }
+                if seq_diff(ack, highest) > 0 { ack } else { highest }
+            },
+            (Some(ack), None) => ack,
+            (None, Some(highest)) => highest,
+            (None, None) => return seg.sack.is_empty(),
+        };
+        seg.sack.iter().all(|&(left, right)| {
+            seq_diff(right, left) > 0 && within(left, ack) && within(right, ack)
+        })
+    }
+
+    fn advance(&mut self, seg: &SeqSegment, now: u64)
+    {
+        let end = seg.seq.wrapping_add(seg.len);
+        if seq_diff(end, self.next) > 0 {
+            self.next = end;
+        }
+        if let Some(ack) = seg.ack {
+            match self.ack {
+                Some(highest) if seq_diff(ack, highest) <= 0 => {},
+                _ => self.ack = Some(ack),
+            }
+        }
+        self.fin = self.fin || seg.fin;
+        self.last_seen = now;
+    }
+
+    fn idle_timeout(&self) -> u64
+    {
+        if self.fin { SEQ_WINDOW_CLOSING_IDLE_NS } else { SEQ_WINDOW_IDLE_NS }
+    }
+}
+
+// SeqTracker follows the sequence numbers of the flows forwarded to the tun
+// interface, so that packets a censor injects or replays into a registered
+// flow can be told from the client's own before they desynchronize the
+// proxy. A flow's window starts from the first packet seen of it, or over
+// from the client's SYN when the connection is reopened.
+pub struct SeqTracker
+{
+    mode: SeqCheckMode,
+    window: u32,
+    flows: HashMap<Flow, SeqWindow>,
+    next_sweep: u64,
+}
+
+impl SeqTracker
+{
+    // A window of 0 uses DEFAULT_SEQ_WINDOW.
+    pub fn new(mode: SeqCheckMode, window: u32) -> SeqTracker
+    {
+        SeqTracker {
+            mode: mode,
+            window: if window == 0 { DEFAULT_SEQ_WINDOW } else { window },
+            flows: HashMap::new(),
+            next_sweep: 0,
+        }
+    }
+
+    pub fn mode(&self) -> SeqCheckMode
+    {
+        self.mode
+    }
+
+    // check reports whether seg, a packet of flow seen at now, is plausible.
+    // Implausible packets leave the window as it was, so that a later
+    // injection is judged against the client's own packets only. A SYN
+    // without ACK starts the window over, an accepted RST or FIN after the
+    // phantom's (see peer_fin) ends it.
+    pub fn check(&mut self, flow: &Flow, seg: &SeqSegment, now: u64) -> bool
+    {
+        if self.mode == SeqCheckMode::Off {
+            return true;
+        }
+        if seg.syn && seg.ack.is_none() {
+            if self.flows.contains_key(flow) || self.flows.len() < MAX_SEQ_WINDOWS {
+                self.flows.insert(*flow, SeqWindow::new(seg, now));
+            }
+            return true;
+        }
+        let window = self.window;
+        let plausible = match self.flows.get_mut(flow) {
+            Some(w) => {
+                let ok = w.plausible(seg, window);
+                if ok {
+                    w.advance(seg, now);
+                }
+                ok
+            },
+            None => {
+                if self.flows.len() < MAX_SEQ_WINDOWS {
+                    self.flows.insert(*flow, SeqWindow::new(seg, now));
+                }
+                true
+            },
+        };
+        let closed = seg.rst || self.flows.get(flow).map_or(false, |w| w.fin && w.peer_fin);
+        if plausible && closed {
+            self.flows.remove(flow);
+        }
+        plausible
+    }
+
+    // peer_fin records that the phantom of flow, a flow from the client, sent
+    // its FIN. The window ends once both sides have.
+    pub fn peer_fin(&mut self, flow: &Flow)
+    {
+        let closed = match self.flows.get_mut(flow) {
+            Some(w) => {
+                w.peer_fin = true;
+                w.fin
+            },
+            None => return,
+        };
+        if closed {
+            self.flows.remove(flow);
+        }
+    }
+
+    // drop_idle forgets the windows of flows not seen for SEQ_WINDOW_IDLE_NS,
+    // or SEQ_WINDOW_CLOSING_IDLE_NS once the client sent its FIN, returning
+    // how many were. It only looks once per SEQ_WINDOW_SWEEP_NS.
+    pub fn drop_idle(&mut self, now: u64) -> usize
+    {
+        if now < self.next_sweep {
+            return 0;
+        }
+        self.next_sweep = now + SEQ_WINDOW_SWEEP_NS;
+        let before = self.flows.len();
+        self.flows.retain(|_, w| now.saturating_sub(w.last_seen) < w.idle_timeout());
+        before - self.flows.len()
+    }
+
+    pub fn len(&self) -> usize
+    {
+        self.flows.len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+use std::net::IpAddr;
+use flow_tracker::Flow;
+use seq_window::{SeqCheckMode, SeqSegment, SeqTracker, MAX_SEQ_WINDOWS,
+                 SEQ_WINDOW_CLOSING_IDLE_NS, SEQ_WINDOW_IDLE_NS, SEQ_WINDOW_SWEEP_NS};
+
+fn flow() -> Flow
+{
+    let client: IpAddr = "192.0.2.1".parse().unwrap();
+    let phantom: IpAddr = "198.51.100.1".parse().unwrap();
+    Flow::from_parts(client, phantom, 40000, 443)
+}
+
+fn seg(seq: u32, len: u32, ack: Option<u32>) -> SeqSegment
+{
+    SeqSegment { seq: seq, len: len, ack: ack, sack: vec![], syn: false, fin: false, rst: false }
+}
+
+fn syn(seq: u32) -> SeqSegment
+{
+    let mut s = seg(seq, 1, None);
+    s.syn = true;
+    s
+}
+
+#[test]
+fn seq_window_follows_the_flow()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Count, 1 << 16);
+    let f = flow();
+    assert!(t.check(&f, &syn(1000), 0)); // SYN
+    assert!(t.check(&f, &seg(1001, 0, Some(5001)), 1));
+    assert!(t.check(&f, &seg(1001, 500, Some(5001)), 2));
+    // A retransmission, and a segment ahead of one not seen.
+    assert!(t.check(&f, &seg(1001, 500, Some(5001)), 3));
+    assert!(t.check(&f, &seg(3001, 500, Some(9001)), 4));
+
+    // Far outside, behind or ahead, in data or acknowledgement.
+    assert!(!t.check(&f, &seg(1001 + (1 << 20), 10, Some(9001)), 5));
+    assert!(!t.check(&f, &seg(1001u32.wrapping_sub(1 << 20), 10, Some(9001)), 6));
+    assert!(!t.check(&f, &seg(3501, 10, Some(9001 + (1 << 20))), 7));
+    // The injections did not move the window.
+    assert!(t.check(&f, &seg(3501, 10, Some(9001)), 8));
+}
+
+#[test]
+fn seq_window_wraps_around()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Enforce, 1 << 16);
+    let f = flow();
+    assert!(t.check(&f, &syn(0xffff_ff00), 0));
+    assert!(t.check(&f, &seg(0xffff_ff01, 0x200, Some(0xffff_fff0)), 1));
+    // Past the wrap in both spaces, then a retransmission from before it.
+    assert!(t.check(&f, &seg(0x101, 0x100, Some(0x40)), 2));
+    assert!(t.check(&f, &seg(0xffff_ff01, 0x200, Some(0x40)), 3));
+    assert!(!t.check(&f, &seg(0x8000_0000, 10, Some(0x40)), 4));
+}
+
+#[test]
+fn seq_window_checks_sack_blocks()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Count, 1 << 16);
+    let f = flow();
+    assert!(t.check(&f, &syn(1000), 0));
+    assert!(t.check(&f, &seg(1001, 0, Some(5001)), 1));
+
+    // Blocks above the acknowledgement, and a D-SACK below it.
+    let mut s = seg(1001, 0, Some(5001));
+    s.sack = vec![(6001, 7001), (8001, 9001)];
+    assert!(t.check(&f, &s, 2));
+    s.sack = vec![(4001, 5001)];
+    assert!(t.check(&f, &s, 3));
+
+    // Blocks far from the acknowledgement or inverted.
+    s.sack = vec![(6001, 7001), (5001 + (1 << 20), 6001 + (1 << 20))];
+    assert!(!t.check(&f, &s, 4));
+    s.sack = vec![(7001, 6001)];
+    assert!(!t.check(&f, &s, 5));
+}
+
+#[test]
+fn seq_window_rst_and_idle_flows()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Count, 1 << 16);
+    let f = flow();
+    assert!(t.check(&f, &syn(1000), 0));
+    let mut rst = seg(1001 + (1 << 20), 0, None);
+    rst.rst = true;
+    assert!(!t.check(&f, &rst, 1));
+    assert_eq!(t.len(), 1);
+    rst.seq = 1001;
+    assert!(t.check(&f, &rst, 2));
+    assert_eq!(t.len(), 0);
+
+    assert!(t.check(&f, &syn(1000), 3));
+    assert_eq!(t.drop_idle(3 + SEQ_WINDOW_IDLE_NS - 1), 0);
+    // Not looked at again until the next sweep.
+    assert_eq!(t.drop_idle(3 + SEQ_WINDOW_IDLE_NS), 0);
+    assert_eq!(t.drop_idle(3 + SEQ_WINDOW_IDLE_NS - 1 + SEQ_WINDOW_SWEEP_NS), 1);
+
+    let mut off = SeqTracker::new(SeqCheckMode::Off, 0);
+    assert!(off.check(&f, &syn(1000), 0));
+    assert!(off.check(&f, &seg(1000 + (1 << 30), 1, None), 1));
+    assert_eq!(off.len(), 0);
+}
+
+#[test]
+fn seq_window_restarts_on_syn()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Enforce, 1 << 16);
+    let f = flow();
+    assert!(t.check(&f, &syn(1000), 0));
+    assert!(t.check(&f, &seg(1001, 500, Some(5001)), 1));
+
+    // The client reopens the connection from the same port.
+    assert!(t.check(&f, &syn(1000 + (1 << 30)), 2));
+    assert!(t.check(&f, &seg(1001 + (1 << 30), 500, Some(9001)), 3));
+    assert!(!t.check(&f, &seg(1501, 10, Some(9001)), 4));
+}
+
+#[test]
+fn seq_window_ends_after_both_fins()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Count, 1 << 16);
+    let f = flow();
+    assert!(t.check(&f, &syn(1000), 0));
+    let mut fin = seg(1001, 1, Some(5001));
+    fin.fin = true;
+    assert!(t.check(&f, &fin, 1));
+    assert_eq!(t.len(), 1);
+    t.peer_fin(&f);
+    assert_eq!(t.len(), 0);
+
+    // The phantom first, then the client.
+    assert!(t.check(&f, &syn(1000), 2));
+    t.peer_fin(&f);
+    assert_eq!(t.len(), 1);
+    assert!(t.check(&f, &fin, 3));
+    assert_eq!(t.len(), 0);
+
+    // A client FIN alone, with the phantom's side not seen, shortens the idle
+    // time.
+    assert!(t.check(&f, &syn(1000), 4));
+    assert!(t.check(&f, &fin, 5));
+    assert_eq!(t.drop_idle(5 + SEQ_WINDOW_CLOSING_IDLE_NS), 1);
+}
+
+#[test]
+fn seq_window_count_is_bounded()
+{
+    let mut t = SeqTracker::new(SeqCheckMode::Enforce, 1 << 16);
+    let client: IpAddr = "192.0.2.1".parse().unwrap();
+    for i in 0..MAX_SEQ_WINDOWS {
+        let phantom = IpAddr::from([10, (i >> 16) as u8, (i >> 8) as u8, i as u8]);
+        assert!(t.check(&Flow::from_parts(client, phantom, 40000, 443), &syn(1000), 0));
+    }
+    assert_eq!(t.len(), MAX_SEQ_WINDOWS);
+
+    // Flows beyond the bound are not tracked, so not checked.
+    let f = flow();
+    assert!(t.check(&f, &syn(1000), 1));
+    assert!(t.check(&f, &seg(1000 + (1 << 30), 1, Some(5001)), 2));
+    assert_eq!(t.len(), MAX_SEQ_WINDOWS);
+}
+
+#[test]
+fn seq_check_mode_parse()
+{
+    assert_eq!(SeqCheckMode::parse(""), Some(SeqCheckMode::Count));
+    assert_eq!(SeqCheckMode::parse("off"), Some(SeqCheckMode::Off));
+    assert_eq!(SeqCheckMode::parse("enforce"), Some(SeqCheckMode::Enforce));
+    assert_eq!(SeqCheckMode::parse("drop"), None);
+}
+}
@@ -28,6 +28,10 @@
 //      * While not currently in use we could add the destination (phantom) port
 //        to the key strings if we need extra specificity. 
 //
+// - Registered phantoms are also tracked by address alone, whatever the
+//   client, so that traffic a phantom originates (towards anyone) can be
+//   recognized, see is_registered_phantom.
+//
 // - The ingest thread is launched as a subroutine of the SessionTracker struct
 //   and pulls from redis. The messages received come in the form of
 //   StationToDetector protobuf, which can be modified relatively independently.
@@ -51,6 +55,7 @@ use redis;
 use signalling::StationToDetector;
 use protobuf::Message;
 use flow_tracker::{FlowNoSrcPort,FLOW_CLIENT_LOG};
+use registration_query::RegistrationQuery;
 
 
 const S2NS: u64= 1000*1000*1000;
@@ -177,6 +182,14 @@ pub struct SessionTracker
     // string to further filter incoming connections. This is left off for now
     // to allow for testing of source-refraction. 
     pub tracked_sessions: Arc<RwLock<HashMap<String, u64>>>,
+
+    // The phantom addresses of tracked sessions, with the latest timeout of
+    // their sessions.
+    pub tracked_phantoms: Arc<RwLock<HashMap<IpAddr, u64>>>,
+
+    // Asks the station about sessions not tracked locally, see query_session.
+    // None unless detector_registration_query_addr is set.
+    pub remote: Option<RegistrationQuery>,
 }
 
 impl<'a> SessionTracker 
@@ -184,6 +197,8 @@ impl<'a> SessionTracker
     pub fn new() -> SessionTracker {
         SessionTracker{
             tracked_sessions: Arc::new(RwLock::new(HashMap::new())),
+            tracked_phantoms: Arc::new(RwLock::new(HashMap::new())),
+            remote: None,
         }
     }
 
@@ -193,7 +208,8 @@ impl<'a> SessionTracker
 
     pub fn spawn_update_thread(&self) {
         let write_map = Arc::clone(&self.tracked_sessions);
-        thread::spawn(move || { ingest_from_pubsub(write_map) });
+        let write_phantoms = Arc::clone(&self.tracked_phantoms);
+        thread::spawn(move || { ingest_from_pubsub(write_map, write_phantoms) });
     }
 
     pub fn is_tracked_session(&self, flow: &FlowNoSrcPort) -> bool {
@@ -204,6 +220,47 @@ impl<'a> SessionTracker
         self.session_exists(&key)
     }
 
+    /// is_tracked_session, also asking the station about a session not
+    /// tracked locally if remote queries are enabled (see RegistrationQuery).
+    /// A session the station has is tracked for the rest of its lifetime, so
+    /// that the following packets of its flows are matched locally.
+    pub fn query_session(&self, flow: &FlowNoSrcPort) -> bool {
+        if self.is_tracked_session(flow) {
+            return true
+        }
+        let remote = match self.remote {
+            Some(ref r) => r,
+            None => return false,
+        };
+        let key = match flow.dst_ip.is_ipv6() {
+            true => format!("{}", flow.dst_ip),
+            false => format!("{}-{}", flow.src_ip, flow.dst_ip)
+        };
+        let now = precise_time_ns();
+        let ttl = match remote.query(&key, flow.src_ip, flow.dst_ip, now) {
+            Some(ttl) => ttl,
+            None => return false,
+        };
+
+        let mut mmap = self.tracked_sessions.write().expect("RwLock broken");
+        let v = mmap.entry(key).or_insert(now + ttl);
+        if *v < now + ttl {
+            *v = now + ttl;
+        }
+        drop(mmap);
+        track_phantom(&self.tracked_phantoms, flow.dst_ip, now + ttl);
+        debug!("Added registered ip {} from station query", flow);
+        true
+    }
+
+    /// Whether ip is the phantom of a tracked session, of any client. Used to
+    /// match traffic the phantom itself originates, whose destination is not
+    /// the registered client.
+    pub fn is_registered_phantom(&self, ip: &IpAddr) -> bool {
+        let rmap = self.tracked_phantoms.read().expect("RwLock broken");
+        rmap.contains_key(ip)
+    }
+
     pub fn len(&self) -> usize {
         let map = self.tracked_sessions.read().expect("RwLock Broken");
         let res = map.len();
@@ -219,6 +276,11 @@ impl<'a> SessionTracker
         // Dark Decoys Map is not sorted by timeout, so need to check all
         map.retain(|_, v| ( *v > right_now));
         let num_sessions_after = map.len();
+        drop(map);
+        self.tracked_phantoms.write().expect("RwLock Broken").retain(|_, v| ( *v > right_now));
+        if let Some(ref remote) = self.remote {
+            remote.drop_stale(right_now);
+        }
         if num_sessions_before != num_sessions_after {
             debug!("Dark Decoys drops: {} - > {}", num_sessions_before, num_sessions_after);
         }
@@ -240,6 +302,7 @@ impl<'a> SessionTracker
         }
 
         self.try_update_session_timeout(key, TIMEOUT_PHANTOMS_NS);
+        track_phantom(&self.tracked_phantoms, flow.dst_ip, precise_time_ns() + TIMEOUT_PHANTOMS_NS);
     }
 
    
@@ -266,6 +329,7 @@ impl<'a> SessionTracker
     fn insert_session(&mut self, session: SessionDetails) {
         // is this already in the map? 
         let key = session.get_key();
+        track_phantom(&self.tracked_phantoms, session.phantom_ip, precise_time_ns() + session.timeout);
         if self.session_exists(&key) {
             self.try_update_session_timeout(key, session.timeout);
             return
@@ -309,8 +373,18 @@ impl<'a> SessionTracker
 
 }
 
+// Tracks phantom until expire_time, keeping the later timeout if it is already
+// tracked.
+fn track_phantom(phantoms: &RwLock<HashMap<IpAddr, u64>>, phantom: IpAddr, expire_time: u64) {
+    let mut pmap = phantoms.write().expect("RwLock broken");
+    let v = pmap.entry(phantom).or_insert(expire_time);
+    if *v < expire_time {
+        *v = expire_time;
+    }
+}
+
 // No returns in this function so that it runs for the lifetime of the process.
-fn ingest_from_pubsub(map: Arc<RwLock<HashMap<String, u64>>>) {
+fn ingest_from_pubsub(map: Arc<RwLock<HashMap<String, u64>>>, phantoms: Arc<RwLock<HashMap<IpAddr, u64>>>) {
     let mut con = get_redis_conn();
     let mut pubsub = con.as_pubsub();
     pubsub.subscribe("dark_decoy_map").expect("Can't subscribe to Redis");
@@ -345,6 +419,8 @@ fn ingest_from_pubsub(map: Arc<RwLock<HashMap<String, u64>>>) {
             }
         };
 
+        track_phantom(&phantoms, sd.phantom_ip, precise_time_ns() + sd.timeout);
+
         // is this already in the map? 
         let key = sd.get_key();
         // Get writable map
@@ -398,7 +474,7 @@ mod tests {
     // use std::fmt::Write;
     use sessions::*;
     use signalling::StationToDetector;
-    use flow_tracker::FlowNoSrcPort;
+    use flow_tracker::{Flow, FlowNoSrcPort};
     use std::{thread, time};
 
     #[test]
@@ -611,4 +687,34 @@ mod tests {
         
         assert_eq!(st.drop_stale_sessions(), 5);
     }
+
+    #[test]
+    fn test_session_tracker_phantom_origin() {
+        let mut st = SessionTracker::new();
+        st.insert_session(SessionDetails::new("192.168.0.1", "10.10.0.1", 5*S2NS).unwrap());
+        st.insert_session(SessionDetails::new("", "2001::1234", 5*S2NS).unwrap());
+        st.insert_session(SessionDetails::new("172.128.0.2", "8.0.0.1", 1).unwrap());
+
+        // A SYN the phantom sends, from an ephemeral port, to a host that is
+        // not its client.
+        let syns = [
+            ("10.10.0.1", 51234, "198.51.100.7", 443, true),
+            ("2001::1234", 40000, "2001:db8::7", 80, true),
+            ("10.10.0.2", 51234, "198.51.100.7", 443, false),
+        ];
+        for syn in &syns {
+            let flow = Flow::from_parts(syn.0.parse().unwrap(), syn.2.parse().unwrap(), syn.1, syn.3);
+            assert_eq!(st.is_registered_phantom(&flow.src_ip), syn.4);
+        }
+
+        // The v4 session key names the client, so the reversed flow never
+        // matches it.
+        let reversed = FlowNoSrcPort::from_parts("198.51.100.7".parse().unwrap(), "10.10.0.1".parse().unwrap(), 51234);
+        assert!(!st.is_tracked_session(&reversed));
+
+        thread::sleep(time::Duration::new(0, 1000));
+        assert_eq!(st.drop_stale_sessions(), 1);
+        assert!(!st.is_registered_phantom(&"8.0.0.1".parse().unwrap()));
+        assert!(st.is_registered_phantom(&"10.10.0.1".parse().unwrap()));
+    }
 }
\ No newline at end of file
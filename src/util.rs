@@ -85,6 +85,21 @@ pub fn get_tcp_timestamps(tcp_pkt: &TcpPacket) -> (u32, u32)
         }
 }
 
+// Returns the (left, right) edges of the blocks of a SACK option, in host
+// order, none if the packet has no SACK option.
+pub fn get_tcp_sack_blocks(tcp_pkt: &TcpPacket) -> Vec<(u32, u32)>
+{
+    match tcp_pkt.get_options_iter()
+        .find(|x| x.get_number() == TcpOptionNumbers::SACK)
+        {
+            Some(p) => p.payload().chunks(8)
+                .filter(|b| b.len() == 8)
+                .map(|b| (deser_be_u32_slice(&b[0..4]), deser_be_u32_slice(&b[4..8])))
+                .collect(),
+            None => vec![],
+        }
+}
+
 // Call on two TCP seq#s from reasonably nearby within the same TCP connection.
 // No need for s1 to be earlier in the sequence than s2.
 // Returns whether a wraparound happened in between.